@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	accessEventBuffer     = 1024
+	accessEventBatchSize  = 100
+	accessEventFlushEvery = time.Second
+)
+
+// accessRecorder writes access events in batches off the request path.
+// When the buffer is full, events are dropped rather than slowing playback.
+type accessRecorder struct {
+	db     database.Client
+	events chan database.AccessEvent
+}
+
+func newAccessRecorder(db database.Client) *accessRecorder {
+	return &accessRecorder{
+		db:     db,
+		events: make(chan database.AccessEvent, accessEventBuffer),
+	}
+}
+
+func (a *accessRecorder) record(event database.AccessEvent) {
+	select {
+	case a.events <- event:
+	default:
+		log.Printf("access event buffer full, dropping %s event for video %s", event.Kind, event.VideoID)
+	}
+}
+
+// run flushes queued events until ctx is done.
+func (a *accessRecorder) run(ctx context.Context) {
+	ticker := time.NewTicker(accessEventFlushEvery)
+	defer ticker.Stop()
+
+	batch := make([]database.AccessEvent, 0, accessEventBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.db.CreateAccessEvents(batch); err != nil {
+			log.Printf("couldn't write %d access events: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case event := <-a.events:
+			batch = append(batch, event)
+			if len(batch) >= accessEventBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// recordAccess queues an access event for videoID describing r's caller.
+func (cfg *apiConfig) recordAccess(r *http.Request, videoID uuid.UUID, kind string, shareToken *string) {
+	event := database.AccessEvent{
+		VideoID:    videoID,
+		OccurredAt: time.Now().UTC(),
+		Kind:       kind,
+		ShareToken: shareToken,
+	}
+	if identity := cfg.optionalIdentity(r); identity.UserID != uuid.Nil {
+		event.UserID = &identity.UserID
+		if identity.Impersonator != "" {
+			event.Impersonator = &identity.Impersonator
+		}
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event.ClientIP = &ip
+	}
+	if ua := r.UserAgent(); ua != "" {
+		event.UserAgent = &ua
+	}
+	cfg.accessEvents.record(event)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// requireAdmin checks the request carries ADMIN_TOKEN as its bearer token,
+// writing the error response and returning false otherwise. Admin endpoints
+// are disabled entirely when no token is configured.
+func (cfg *apiConfig) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminToken == "" {
+		respondWithError(w, http.StatusForbidden, "Admin endpoints are disabled", nil)
+		return false
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find admin token", err)
+		return false
+	}
+	if !cfg.isAdminToken(token) {
+		respondWithError(w, http.StatusForbidden, "Invalid admin token", nil)
+		return false
+	}
+	return true
+}
+
+// isAdminToken reports whether token is the configured admin token.
+func (cfg *apiConfig) isAdminToken(token string) bool {
+	return cfg.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminToken)) == 1
+}
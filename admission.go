@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons an upload is turned away, also reported by the readiness probe.
+const (
+	admissionTempSpaceLow     = "temp_space_low"
+	admissionTooManyUploads   = "too_many_uploads"
+	admissionProcessingBacked = "processing_backlog"
+	admissionQueueFull        = "processing_queue_full"
+)
+
+// admissionLimits are the watermarks past which new uploads are refused.
+// Zero disables a check.
+type admissionLimits struct {
+	maxActiveUploads int64
+	maxProcessing    int64
+	minTempFreeBytes int64
+}
+
+// admissionController turns uploads away while the server couldn't finish
+// them anyway, instead of letting the temp dir and processing pile up
+// until everything fails at once.
+type admissionController struct {
+	limits     admissionLimits
+	tempDir    string
+	active     atomic.Int64
+	processing atomic.Int64
+
+	// freeSpace reports free bytes under a directory; replaceable so the
+	// controller can be driven with synthetic gauges.
+	freeSpace func(dir string) (int64, error)
+}
+
+func newAdmissionController(limits admissionLimits) *admissionController {
+	return &admissionController{
+		limits:    limits,
+		tempDir:   os.TempDir(),
+		freeSpace: diskFreeBytes,
+	}
+}
+
+// saturated returns why new uploads would be refused, or "".
+func (a *admissionController) saturated() string {
+	if a.limits.maxActiveUploads > 0 && a.active.Load() >= a.limits.maxActiveUploads {
+		return admissionTooManyUploads
+	}
+	if a.limits.maxProcessing > 0 && a.processing.Load() >= a.limits.maxProcessing {
+		return admissionProcessingBacked
+	}
+	if a.limits.minTempFreeBytes > 0 {
+		// An unknown free space never blocks uploads
+		if free, err := a.freeSpace(a.tempDir); err == nil && free < a.limits.minTempFreeBytes {
+			return admissionTempSpaceLow
+		}
+	}
+	return ""
+}
+
+// admit counts an upload as active unless the server is saturated. The
+// returned release must be called when the upload's request finishes.
+func (a *admissionController) admit() (release func(), reason string) {
+	if reason := a.saturated(); reason != "" {
+		return nil, reason
+	}
+	a.active.Add(1)
+	return func() { a.active.Add(-1) }, ""
+}
+
+// startProcessing counts a video as being processed until the returned
+// function is called.
+func (a *admissionController) startProcessing() func() {
+	a.processing.Add(1)
+	return func() { a.processing.Add(-1) }
+}
+
+// respondWithSaturated refuses an upload with a jittered Retry-After, so
+// refused clients don't all come back in the same second.
+func respondWithSaturated(w http.ResponseWriter, reason string) {
+	retryAfter := 5 + rand.IntN(10)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	respondWithErrorDetails(w, http.StatusServiceUnavailable, errorCodeUploadsSaturated, "Server is busy; retry later", nil, map[string]any{
+		"reason": reason,
+	})
+}
+
+// admissionStats is the controller's state for admin stats.
+type admissionStats struct {
+	ActiveUploads    int64  `json:"active_uploads"`
+	MaxActiveUploads int64  `json:"max_active_uploads"`
+	Processing       int64  `json:"processing"`
+	MaxProcessing    int64  `json:"max_processing"`
+	TempFreeBytes    *int64 `json:"temp_free_bytes"`
+	MinTempFreeBytes int64  `json:"min_temp_free_bytes"`
+	Saturated        string `json:"saturated"`
+	CheckedAt        string `json:"checked_at"`
+}
+
+func (a *admissionController) stats() admissionStats {
+	s := admissionStats{
+		ActiveUploads:    a.active.Load(),
+		MaxActiveUploads: a.limits.maxActiveUploads,
+		Processing:       a.processing.Load(),
+		MaxProcessing:    a.limits.maxProcessing,
+		MinTempFreeBytes: a.limits.minTempFreeBytes,
+		Saturated:        a.saturated(),
+		CheckedAt:        apiTime(time.Now()),
+	}
+	if free, err := a.freeSpace(a.tempDir); err == nil {
+		s.TempFreeBytes = &free
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// syntheticAdmission is a controller whose free temp space is free, or
+// unknown when free is negative.
+func syntheticAdmission(limits admissionLimits, free int64) *admissionController {
+	a := newAdmissionController(limits)
+	a.freeSpace = func(string) (int64, error) {
+		if free < 0 {
+			return 0, errors.New("statfs failed")
+		}
+		return free, nil
+	}
+	return a
+}
+
+func TestAdmissionSaturated(t *testing.T) {
+	limits := admissionLimits{maxActiveUploads: 2, maxProcessing: 3, minTempFreeBytes: 100}
+	tests := []struct {
+		name       string
+		active     int64
+		processing int64
+		free       int64
+		want       string
+	}{
+		{"idle", 0, 0, 1000, ""},
+		{"below every watermark", 1, 2, 100, ""},
+		{"too many uploads", 2, 0, 1000, admissionTooManyUploads},
+		{"processing backlog", 0, 3, 1000, admissionProcessingBacked},
+		{"temp space low", 0, 0, 99, admissionTempSpaceLow},
+		{"unknown free space", 0, 0, -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := syntheticAdmission(limits, tt.free)
+			a.active.Store(tt.active)
+			a.processing.Store(tt.processing)
+			if got := a.saturated(); got != tt.want {
+				t.Errorf("saturated() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Zero watermarks disable their checks
+	a := syntheticAdmission(admissionLimits{}, 0)
+	a.active.Store(1000)
+	a.processing.Store(1000)
+	if got := a.saturated(); got != "" {
+		t.Errorf("saturated() without limits = %q, want \"\"", got)
+	}
+}
+
+func TestAdmissionAdmitAndRelease(t *testing.T) {
+	a := syntheticAdmission(admissionLimits{maxActiveUploads: 2}, 0)
+	first, reason := a.admit()
+	if reason != "" {
+		t.Fatalf("first upload refused: %s", reason)
+	}
+	second, _ := a.admit()
+	if _, reason := a.admit(); reason != admissionTooManyUploads {
+		t.Fatalf("third upload: reason %q, want %q", reason, admissionTooManyUploads)
+	}
+	if got := a.active.Load(); got != 2 {
+		t.Errorf("active = %d after a refusal, want 2", got)
+	}
+	first()
+	if _, reason := a.admit(); reason != "" {
+		t.Errorf("upload after a release refused: %s", reason)
+	}
+	second()
+
+	done := a.startProcessing()
+	if got := a.stats().Processing; got != 1 {
+		t.Errorf("processing = %d, want 1", got)
+	}
+	done()
+	if got := a.stats().Processing; got != 0 {
+		t.Errorf("processing = %d after finishing, want 0", got)
+	}
+}
+
+func TestUploadRefusedWhenSaturated(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.admission = syntheticAdmission(admissionLimits{minTempFreeBytes: 1 << 30}, 1<<20)
+	})
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Turned away")
+
+	resp, body := env.uploadVideo(t, token, video.ID, testVideoBytes(1024))
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCode(t, body) != errorCodeUploadsSaturated {
+		t.Fatalf("got %d: %s, want 503 %s", resp.StatusCode, body, errorCodeUploadsSaturated)
+	}
+	if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry < 5 || retry >= 15 {
+		t.Errorf("Retry-After = %q, want 5-14 seconds", resp.Header.Get("Retry-After"))
+	}
+	var refused struct {
+		Error struct {
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	decodeJSON(t, body, &refused)
+	if refused.Error.Reason != admissionTempSpaceLow {
+		t.Errorf("reason = %q, want %q", refused.Error.Reason, admissionTempSpaceLow)
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("refused upload was stored: %v", keys)
+	}
+
+	// Load balancers see the same signal
+	status, got := env.readiness(t)
+	if status != http.StatusServiceUnavailable || !slices.Contains(got.Reasons, admissionTempSpaceLow) {
+		t.Errorf("readiness = %d %v, want 503 with %s", status, got.Reasons, admissionTempSpaceLow)
+	}
+	var stats struct {
+		Admission admissionStats `json:"admission"`
+	}
+	env.doJSON(t, http.MethodGet, "/admin/stats", testAdmin, nil, http.StatusOK, &stats)
+	if got := stats.Admission; got.Saturated != admissionTempSpaceLow || got.TempFreeBytes == nil || *got.TempFreeBytes != 1<<20 || got.MinTempFreeBytes != 1<<30 {
+		t.Errorf("admin stats admission = %+v", got)
+	}
+
+	// Once space frees up, uploads are admitted again
+	env.cfg.admission.freeSpace = func(string) (int64, error) { return 2 << 30, nil }
+	if resp, body := env.uploadVideo(t, token, video.ID, testVideoBytes(1024)); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload after space freed: got %d: %s", resp.StatusCode, body)
+	}
+	if got := env.cfg.admission.active.Load(); got != 0 {
+		t.Errorf("active = %d after the upload's request finished, want 0", got)
+	}
+	env.waitForProcessing(t, token, video.ID)
+}
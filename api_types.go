@@ -0,0 +1,190 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// API response types are kept separate from the database structs so a
+// column rename can't silently change the wire format. Conventions:
+// timestamps are RFC 3339 in UTC, UUIDs are lowercase strings, nullable
+// fields are always present (null rather than omitted), and lists are
+// never null. The exception is owner-only fields, which are omitted from
+// responses to anyone else.
+
+// apiTime formats t for API responses.
+func apiTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+type videoResponse struct {
+	ID                 string   `json:"id"`
+	CreatedAt          string   `json:"created_at"`
+	UpdatedAt          string   `json:"updated_at"`
+	Title              string   `json:"title"`
+	Description        string   `json:"description"`
+	UserID             string   `json:"user_id"`
+	Status             string   `json:"status"`
+	Visibility         string   `json:"visibility"`
+	ThumbnailURL       *string  `json:"thumbnail_url"`
+	ThumbnailGridURL   *string  `json:"thumbnail_grid_url"`
+	ThumbnailModernURL *string  `json:"thumbnail_modern_url"`
+	ThumbnailWidth     *int     `json:"thumbnail_width"`
+	ThumbnailHeight    *int     `json:"thumbnail_height"`
+	VideoURL           *string  `json:"video_url"`
+	ContentType        *string  `json:"content_type"`
+	OriginalFilename   *string  `json:"original_filename"`
+	ProcessingWarnings []string `json:"processing_warnings"`
+	ProcessingBranch   *string  `json:"processing_branch"`
+	ProcessingStatus   *string  `json:"processing_status"`
+	ProcessingError    *string  `json:"processing_error"`
+	FastStart          *bool    `json:"faststart"`
+	PasswordProtected  bool     `json:"password_protected"`
+	Version            int      `json:"version"`
+	SizeBytes          *int64   `json:"size_bytes"`
+	DurationSeconds    *float64 `json:"duration_seconds"`
+
+	// Renditions maps labels such as 720p to URLs; "source" is video_url.
+	Renditions map[string]string `json:"renditions"`
+	// HLSURL is the adaptive streaming playlist, when one was packaged.
+	HLSURL *string `json:"hls_url"`
+	// ChecksumSHA256 is the base64 SHA-256 of the file at video_url, for
+	// verifying downloads. Direct uploads have none.
+	ChecksumSHA256 *string `json:"checksum_sha256"`
+	// Deleted is set while the video is in the trash, which only its
+	// owner can see. Its URLs are null until it is restored.
+	Deleted   bool    `json:"deleted"`
+	DeletedAt *string `json:"deleted_at"`
+
+	// Owner-only fields, omitted entirely for everyone else
+	AllowedEmbedOrigins *[]string `json:"allowed_embed_origins,omitempty"`
+}
+
+// presentURL returns u, or nil when no artifact is stored. Some older rows
+// hold an empty string rather than NULL.
+func presentURL(u *string) *string {
+	if u == nil || *u == "" {
+		return nil
+	}
+	return u
+}
+
+func newVideoResponse(video database.Video) videoResponse {
+	warnings := []string(video.ProcessingWarnings)
+	if warnings == nil {
+		warnings = []string{}
+	}
+	return videoResponse{
+		ID:                 video.ID.String(),
+		CreatedAt:          apiTime(video.CreatedAt),
+		UpdatedAt:          apiTime(video.UpdatedAt),
+		Title:              video.Title,
+		Description:        video.Description,
+		UserID:             video.UserID.String(),
+		Status:             video.Status,
+		Visibility:         video.Visibility,
+		ThumbnailURL:       presentURL(video.ThumbnailURL),
+		ThumbnailGridURL:   presentURL(video.ThumbnailGridURL),
+		ThumbnailModernURL: presentURL(video.ThumbnailModernURL),
+		ThumbnailWidth:     video.ThumbnailWidth,
+		ThumbnailHeight:    video.ThumbnailHeight,
+		VideoURL:           presentURL(video.VideoURL),
+		ContentType:        video.ContentType,
+		OriginalFilename:   video.OriginalFilename,
+		ProcessingWarnings: warnings,
+		ProcessingBranch:   video.ProcessingBranch,
+		ProcessingStatus:   video.ProcessingStatus,
+		ProcessingError:    video.ProcessingError,
+		PasswordProtected:  video.PasswordProtected,
+		Version:            video.Version,
+		SizeBytes:          video.SizeBytes,
+		DurationSeconds:    video.DurationSeconds,
+		FastStart:          fastStart(video),
+		Renditions:         apiRenditions(video),
+		HLSURL:             presentURL(video.HLSURL),
+		ChecksumSHA256:     video.ChecksumSHA256,
+		Deleted:            video.DeletedAt != nil,
+		DeletedAt:          apiTimePtr(video.DeletedAt),
+	}
+}
+
+// apiTimePtr formats t for API responses, or returns nil when it is.
+func apiTimePtr(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := apiTime(*t)
+	return &s
+}
+
+// fastStart reports whether video's stored file starts with its moov atom,
+// or nil when there is no file.
+func fastStart(video database.Video) *bool {
+	if presentURL(video.VideoURL) == nil {
+		return nil
+	}
+	ok := video.ProcessingBranch == nil || *video.ProcessingBranch != processingBranchOriginal
+	return &ok
+}
+
+// newOwnerVideoResponse adds the fields only a video's owner may see.
+func newOwnerVideoResponse(video database.Video) videoResponse {
+	resp := newVideoResponse(video)
+	origins := []string(video.AllowedEmbedOrigins)
+	if origins == nil {
+		origins = []string{}
+	}
+	resp.AllowedEmbedOrigins = &origins
+	return resp
+}
+
+// newVideoResponses lists the caller's own videos, so it includes the
+// owner-only fields.
+func newVideoResponses(videos []database.Video) []videoResponse {
+	resp := make([]videoResponse, 0, len(videos))
+	for _, video := range videos {
+		resp = append(resp, newOwnerVideoResponse(video))
+	}
+	return resp
+}
+
+type userResponse struct {
+	ID        string `json:"id"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	Email     string `json:"email"`
+}
+
+func newUserResponse(user database.User) userResponse {
+	return userResponse{
+		ID:        user.ID.String(),
+		CreatedAt: apiTime(user.CreatedAt),
+		UpdatedAt: apiTime(user.UpdatedAt),
+		Email:     user.Email,
+	}
+}
+
+type shareLinkResponse struct {
+	Token     string `json:"token"`
+	Path      string `json:"path"`
+	VideoID   string `json:"video_id"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	MaxViews  *int   `json:"max_views"`
+	Views     int    `json:"views"`
+}
+
+func newShareLinkResponse(link database.ShareLink) shareLinkResponse {
+	return shareLinkResponse{
+		Token:     link.Token,
+		Path:      "/s/" + link.Token,
+		VideoID:   link.VideoID.String(),
+		CreatedBy: link.CreatedBy.String(),
+		CreatedAt: apiTime(link.CreatedAt),
+		ExpiresAt: apiTime(link.ExpiresAt),
+		MaxViews:  link.MaxViews,
+		Views:     link.Views,
+	}
+}
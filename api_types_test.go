@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"image"
+	pngpkg "image/png"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Run with -update to rewrite the golden files after a deliberate change to
+// the wire format.
+var updateGolden = flag.Bool("update", false, "rewrite testdata/golden")
+
+// checkGolden compares v's indented JSON with testdata/golden/name.json.
+func checkGolden(t *testing.T, name string, v any) {
+	t.Helper()
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	path := filepath.Join("testdata", "golden", name+".json")
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed; run with -update if that was deliberate\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+var (
+	goldenVideoID = uuid.MustParse("0B7E9C3A-5D2F-4E61-9A8B-1C2D3E4F5A6B")
+	goldenUserID  = uuid.MustParse("6F1E2D3C-4B5A-4968-8776-A5B4C3D2E1F0")
+	// Not UTC, so the conversion shows in the output
+	goldenTime = time.Date(2024, 3, 9, 17, 4, 5, 123456789, time.FixedZone("UTC-5", -5*60*60))
+)
+
+// goldenVideo is a video with every optional field set.
+func goldenVideo() database.Video {
+	ready := database.ProcessingStatusReady
+	deleted := goldenTime.Add(time.Hour)
+	return database.Video{
+		ID:                  goldenVideoID,
+		CreatedAt:           goldenTime,
+		UpdatedAt:           goldenTime.Add(time.Minute),
+		ThumbnailURL:        ptr("https://" + testCDN + "/thumbnails/abc.jpg"),
+		ThumbnailGridURL:    ptr("https://" + testCDN + "/thumbnails/abc-grid.jpg"),
+		ThumbnailModernURL:  ptr("https://" + testCDN + "/thumbnails/abc.webp"),
+		ThumbnailWidth:      ptr(1280),
+		ThumbnailHeight:     ptr(720),
+		VideoURL:            ptr("https://" + testCDN + "/landscape/abc.mp4"),
+		Status:              "published",
+		ContentType:         ptr("video/mp4"),
+		OriginalFilename:    ptr("holiday.mp4"),
+		ProcessingWarnings:  database.StringList{"audio track was dropped"},
+		ProcessingBranch:    ptr("faststart"),
+		ProcessingStatus:    &ready,
+		Renditions:          database.Renditions{"720p": "https://" + testCDN + "/landscape/abc-720p.mp4"},
+		HLSURL:              ptr("https://" + testCDN + "/hls/abc/master.m3u8"),
+		ChecksumSHA256:      ptr("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="),
+		PasswordProtected:   true,
+		PasswordHash:        ptr("never serialized"),
+		Version:             3,
+		SizeBytes:           ptr(int64(1 << 20)),
+		DurationSeconds:     ptr(12.5),
+		AllowedEmbedOrigins: database.StringList{"https://blog.example"},
+		Visibility:          database.VisibilityUnlisted,
+		DeletedAt:           &deleted,
+		UploadMetadata: database.UploadMetadata{
+			UploadClientIP: ptr("203.0.113.7"),
+		},
+		CreateVideoParams: database.CreateVideoParams{
+			Title:       "Holiday",
+			Description: "At the beach",
+			UserID:      goldenUserID,
+		},
+	}
+}
+
+// minimalVideo is a draft as it is just after creation.
+func minimalVideo() database.Video {
+	return database.Video{
+		ID:         goldenVideoID,
+		CreatedAt:  goldenTime,
+		UpdatedAt:  goldenTime,
+		Status:     "draft",
+		Visibility: database.VisibilityPrivate,
+		CreateVideoParams: database.CreateVideoParams{
+			Title:  "Draft",
+			UserID: goldenUserID,
+		},
+	}
+}
+
+func TestResponseGoldenFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+	}{
+		{"video_full", newVideoResponse(goldenVideo())},
+		{"video_full_owner", newOwnerVideoResponse(goldenVideo())},
+		{"video_minimal", newVideoResponse(minimalVideo())},
+		{"video_minimal_owner", newOwnerVideoResponse(minimalVideo())},
+		{"video_list_empty", newVideoResponses(nil)},
+		{"user", newUserResponse(database.User{
+			ID:               goldenUserID,
+			CreatedAt:        goldenTime,
+			UpdatedAt:        goldenTime,
+			CreateUserParams: database.CreateUserParams{Email: "someone@example.com", Password: "never serialized"},
+		})},
+		{"share_link", newShareLinkResponse(database.ShareLink{
+			Token:     "tok",
+			CreatedAt: goldenTime,
+			Views:     2,
+			CreateShareLinkParams: database.CreateShareLinkParams{
+				VideoID:   goldenVideoID,
+				CreatedBy: goldenUserID,
+				ExpiresAt: goldenTime.Add(24 * time.Hour),
+				MaxViews:  ptr(5),
+			},
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGolden(t, tt.name, tt.v)
+		})
+	}
+}
+
+// TestHandlersUseVideoResponse checks that the upload handlers, which once
+// marshalled the database struct, answer with the same fields as GET.
+func TestHandlersUseVideoResponse(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Shape")
+
+	want, err := os.ReadFile(filepath.Join("testdata", "golden", "video_minimal_owner.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := func(data []byte) []string {
+		t.Helper()
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("decoding %s: %v", data, err)
+		}
+		return slices.Sorted(maps.Keys(fields))
+	}
+	wantKeys := keys(want)
+
+	resp, body := env.do(t, http.MethodGet, "/api/videos/"+video.ID, token, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET: got %d: %s", resp.StatusCode, body)
+	}
+	if got := keys(body); !slices.Equal(got, wantKeys) {
+		t.Errorf("GET fields = %v, want %v", got, wantKeys)
+	}
+
+	var png bytes.Buffer
+	if err := pngpkg.Encode(&png, image.NewRGBA(image.Rect(0, 0, 16, 9))); err != nil {
+		t.Fatal(err)
+	}
+	resp, body = env.do(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, "application/json", jsonBody(t, map[string]string{
+		"content_type": "image/png",
+		"data_base64":  base64.StdEncoding.EncodeToString(png.Bytes()),
+	}))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("thumbnail upload: got %d: %s", resp.StatusCode, body)
+	}
+	if got := keys(body); !slices.Equal(got, wantKeys) {
+		t.Errorf("thumbnail upload fields = %v, want %v", got, wantKeys)
+	}
+
+	resp, body = env.uploadVideo(t, token, video.ID, []byte("\x00\x00\x00\x10ftypisom\x00\x00\x02\x00"))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("video upload: got %d: %s", resp.StatusCode, body)
+	}
+	if got := keys(body); !slices.Equal(got, wantKeys) {
+		t.Errorf("video upload fields = %v, want %v", got, wantKeys)
+	}
+}
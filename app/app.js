@@ -36,7 +36,7 @@ async function createVideoDraft() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to create video draft: ${data.error}`);
+      throw new Error(`Failed to create video draft: ${data.error.message}`);
     }
 
     const videoID = data.id;
@@ -63,7 +63,7 @@ async function login() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to login: ${data.error}`);
+      throw new Error(`Failed to login: ${data.error.message}`);
     }
 
     if (data.token) {
@@ -93,7 +93,7 @@ async function signup() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to create user: ${data.error}`);
+      throw new Error(`Failed to create user: ${data.error.message}`);
     }
     console.log('User created!');
     await login();
@@ -139,7 +139,7 @@ async function uploadThumbnail(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload thumbnail. Error: ${data.error}`);
+      throw new Error(`Failed to upload thumbnail. Error: ${data.error.message}`);
     }
 
     await res.json();
@@ -152,6 +152,28 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+// Uploads are processed after the server responds; poll until that's done.
+async function waitForProcessing(videoID) {
+  for (;;) {
+    const res = await fetch(`/api/videos/${videoID}/status`, {
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to get processing status. Error: ${data.error.message}`);
+    }
+    if (data.processing_status === 'failed') {
+      throw new Error(`Failed to process video. Error: ${data.processing_error}`);
+    }
+    if (data.processing_status !== 'pending') {
+      return;
+    }
+    await new Promise((resolve) => setTimeout(resolve, 1000));
+  }
+}
+
 async function uploadVideoFile(videoID) {
   const videoFile = document.getElementById('video-file').files[0];
   if (!videoFile) return;
@@ -172,10 +194,11 @@ async function uploadVideoFile(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to upload video file. Error: ${data.error.message}`);
     }
 
-    console.log('Video uploaded!');
+    console.log('Video uploaded, processing...');
+    await waitForProcessing(videoID);
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
@@ -196,7 +219,7 @@ async function getVideos() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
+      throw new Error(`Failed to get videos. Error: ${data.error.message}`);
     }
 
     const videos = await res.json();
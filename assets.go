@@ -1,7 +1,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +18,93 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// assetURL returns the path a file stored under assetsRoot is served at.
+// Rows store it relative so the server's domain can change without a
+// migration; responses expand it with publicAssetURL.
+func (cfg apiConfig) assetURL(filename string) string {
+	return cfg.assetsPath + "/" + filename
+}
+
+// shardedAssetName places filename two directories deep, keyed by its first
+// four characters (abcdef.jpg becomes ab/cd/abcdef.jpg), so no directory
+// under assetsRoot grows too large to list. Names are slash-separated so
+// they work in URLs as well as through assetPath.
+func shardedAssetName(filename string) string {
+	if len(filename) < 5 {
+		return filename
+	}
+	return filename[:2] + "/" + filename[2:4] + "/" + filename
+}
+
+// assetPath returns where the asset called name is stored on disk.
+func (cfg apiConfig) assetPath(name string) string {
+	return filepath.Join(cfg.assetsRoot, filepath.FromSlash(name))
+}
+
+// localAssetName returns the name of the asset assetURL serves from
+// assetsRoot. Both the flat layout older rows use and the sharded one are
+// recognized; anything else isn't a local asset.
+func (cfg apiConfig) localAssetName(assetURL string) (string, bool) {
+	u, err := url.Parse(assetURL)
+	if err != nil {
+		return "", false
+	}
+	for _, prefix := range []string{cfg.assetsPath + "/", defaultAssetsPath + "/"} {
+		name, ok := strings.CutPrefix(u.Path, prefix)
+		if !ok || name == "" || path.Clean(name) != name {
+			continue
+		}
+		if !strings.Contains(name, "/") || name == shardedAssetName(path.Base(name)) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// assetHandler serves files under assetsRoot, with the asset name as the
+// request path. Unlike http.FileServer it sends a strong ETag, so
+// If-None-Match and If-Range work alongside Range requests, and it never
+// lists the shard directories or serves the dot files assets are written
+// to before they are complete.
+func (cfg apiConfig) assetHandler() http.Handler {
+	root := http.Dir(cfg.assetsRoot)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasPrefix(path.Base(name), ".") {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := root.Open(name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, "Couldn't open asset", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "Couldn't open asset", http.StatusInternalServerError)
+			return
+		}
+		if info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("ETag", assetETag(info))
+		// ServeContent answers conditional and Range requests, including
+		// 304, 206 with Content-Range, and 416 for unsatisfiable ranges
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+}
+
+// assetETag identifies an asset file's content by size and modification
+// time. Assets are named by their content and written once, so this only
+// changes if a file is rewritten in place.
+func assetETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// assetsDiskProbeBytes is how much the recovery check writes before it
+// trusts that the assets disk has room again.
+const assetsDiskProbeBytes = 1 << 20 // 1 MB
+
+// errAssetsDiskFull marks writes that failed because assetsRoot's
+// filesystem has no space left.
+var errAssetsDiskFull = errors.New("assets disk full")
+
+// createAssetFile creates the temp files assets are written to before
+// they are renamed into place. It is a variable so a full disk can be
+// simulated.
+var createAssetFile = os.CreateTemp
+
+// assetsDisk tracks whether assetsRoot has run out of space. While it is
+// degraded, optional work that writes assets is skipped rather than failed.
+type assetsDisk struct {
+	root          string
+	degradedSince atomic.Pointer[time.Time]
+}
+
+func newAssetsDisk(root string) *assetsDisk {
+	return &assetsDisk{root: root}
+}
+
+// degraded reports whether the disk is full and since when.
+func (d *assetsDisk) degraded() (time.Time, bool) {
+	since := d.degradedSince.Load()
+	if since == nil {
+		return time.Time{}, false
+	}
+	return *since, true
+}
+
+// check turns ENOSPC into errAssetsDiskFull, flipping the degraded flag.
+// Other errors are returned unchanged.
+func (d *assetsDisk) check(err error) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	now := time.Now()
+	if d.degradedSince.CompareAndSwap(nil, &now) {
+		log.Printf("assets disk %s is full; marking degraded", d.root)
+	}
+	return fmt.Errorf("%w: %v", errAssetsDiskFull, err)
+}
+
+// writeFile writes data to path, creating its shard directories. It
+// writes to a temp file beside path and renames it into place once the
+// data is synced, so a truncated asset is never served at path, even if
+// the server dies partway.
+func (d *assetsDisk) writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return d.check(err)
+	}
+	f, err := createAssetFile(filepath.Dir(path), ".asset-*")
+	if err != nil {
+		return d.check(err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	// CreateTemp makes files only the owner can read
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return d.check(err)
+	}
+	return nil
+}
+
+// watch clears the degraded flag once a probe file can be written again.
+func (d *assetsDisk) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, ok := d.degraded(); !ok {
+			continue
+		}
+		if err := d.probe(); err != nil {
+			continue
+		}
+		d.degradedSince.Store(nil)
+		log.Printf("assets disk %s has space again; clearing degraded", d.root)
+	}
+}
+
+func (d *assetsDisk) probe() error {
+	f, err := os.CreateTemp(d.root, ".diskprobe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(make([]byte, assetsDiskProbeBytes))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fillAssetsDisk makes asset writes fail with ENOSPC until the returned
+// function is called.
+func fillAssetsDisk(t *testing.T) (free func()) {
+	t.Helper()
+	createAssetFile = func(dir, pattern string) (*os.File, error) {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: syscall.ENOSPC}
+	}
+	free = func() { createAssetFile = os.CreateTemp }
+	t.Cleanup(free)
+	return free
+}
+
+// thumbnailJSON is a PNG thumbnail_json body of a w×h image in c.
+func thumbnailJSON(t *testing.T, w, h int, c color.Color) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, solidImage(w, h, c)); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]any{"content_type": "image/png", "data_base64": base64.StdEncoding.EncodeToString(buf.Bytes())}
+}
+
+func TestAssetsDiskCheck(t *testing.T) {
+	disk := newAssetsDisk(t.TempDir())
+	other := errors.New("permission denied")
+	if err := disk.check(other); err != other {
+		t.Errorf("check(%v) = %v, want it unchanged", other, err)
+	}
+	if _, degraded := disk.degraded(); degraded {
+		t.Fatal("degraded by an error that isn't ENOSPC")
+	}
+
+	err := disk.check(&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC})
+	if !errors.Is(err, errAssetsDiskFull) {
+		t.Errorf("check(ENOSPC) = %v, want errAssetsDiskFull", err)
+	}
+	since, degraded := disk.degraded()
+	if !degraded || time.Since(since) > time.Minute {
+		t.Errorf("degraded = %v since %v, want degraded from now", degraded, since)
+	}
+	// Later failures keep the first time
+	disk.check(syscall.ENOSPC)
+	if again, _ := disk.degraded(); !again.Equal(since) {
+		t.Errorf("degraded since moved from %v to %v", since, again)
+	}
+}
+
+func TestAssetsDiskFull(t *testing.T) {
+	// Thumbnails are kept under assetsRoot with the local backend
+	env := newTestEnv(t)
+	env.cfg.videoStorage = env.cfg.localStorage
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Full disk")
+	free := fillAssetsDisk(t)
+
+	resp, body := env.do(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, "application/json", jsonBody(t, thumbnailJSON(t, 16, 9, color.White)))
+	if resp.StatusCode != http.StatusInsufficientStorage || errorCode(t, body) != errorCodeAssetsDiskFull {
+		t.Fatalf("thumbnail on a full disk: got %d: %s", resp.StatusCode, body)
+	}
+	if !env.cfg.thumbnailDiskFull() {
+		t.Error("thumbnails aren't marked as unwritable")
+	}
+	if _, got := env.readiness(t); !slices.Contains(got.Reasons, errorCodeAssetsDiskFull) {
+		t.Errorf("readiness reasons = %v, want %s", got.Reasons, errorCodeAssetsDiskFull)
+	}
+	var stats struct {
+		AssetsDisk struct {
+			Degraded      bool    `json:"degraded"`
+			DegradedSince *string `json:"degraded_since"`
+		} `json:"assets_disk"`
+	}
+	env.doJSON(t, http.MethodGet, "/admin/stats", testAdmin, nil, http.StatusOK, &stats)
+	if !stats.AssetsDisk.Degraded || stats.AssetsDisk.DegradedSince == nil {
+		t.Errorf("admin stats assets_disk = %+v, want degraded", stats.AssetsDisk)
+	}
+	// Reads keep working
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, nil)
+
+	// Once space is freed the watcher clears the flag and thumbnails work
+	free()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go env.cfg.assetsDisk.watch(ctx, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for env.cfg.thumbnailDiskFull() {
+		if time.Now().After(deadline) {
+			t.Fatal("the assets disk stayed degraded after space was freed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, thumbnailJSON(t, 16, 9, color.White), http.StatusOK, nil)
+}
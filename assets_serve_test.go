@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const servedAsset = "ab/cd/abcdef.png"
+
+// assetServer is a test server with servedAsset holding "0123456789".
+func assetServer(t *testing.T) *testEnv {
+	t.Helper()
+	env := newTestEnv(t)
+	path := env.cfg.assetPath(servedAsset)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestAssetServedWithValidators(t *testing.T) {
+	env := assetServer(t)
+	resp, body := env.do(t, http.MethodGet, "/assets/"+servedAsset, "", "", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+		t.Fatalf("got %d: %q", resp.StatusCode, body)
+	}
+	etag := resp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Errorf("ETag = %q, want a strong one", etag)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+		t.Errorf("Cache-Control = %q, want assets cached for good", got)
+	}
+
+	resp, body = env.do(t, http.MethodGet, "/assets/"+servedAsset, "", "", nil, "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("If-None-Match: got %d: %q, want 304 without a body", resp.StatusCode, body)
+	}
+	resp, _ = env.do(t, http.MethodGet, "/assets/"+servedAsset, "", "", nil, "If-None-Match", `"stale"`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("stale If-None-Match: got %d, want 200", resp.StatusCode)
+	}
+
+	// The API keeps no-store
+	resp, _ = env.do(t, http.MethodGet, "/api/healthz", "", "", nil)
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("API Cache-Control = %q, want no-store", got)
+	}
+}
+
+func TestAssetRangeRequests(t *testing.T) {
+	env := assetServer(t)
+	resp, _ := env.do(t, http.MethodGet, "/assets/"+servedAsset, "", "", nil)
+	etag := resp.Header.Get("ETag")
+
+	tests := []struct {
+		name         string
+		headers      []string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"range", []string{"Range", "bytes=2-5"}, http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"suffix", []string{"Range", "bytes=-3"}, http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"if-range current", []string{"Range", "bytes=0-1", "If-Range", etag}, http.StatusPartialContent, "01", "bytes 0-1/10"},
+		{"if-range stale", []string{"Range", "bytes=0-1", "If-Range", `"stale"`}, http.StatusOK, "0123456789", ""},
+		{"unsatisfiable", []string{"Range", "bytes=100-200"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+	}
+	for _, tt := range tests {
+		resp, body := env.do(t, http.MethodGet, "/assets/"+servedAsset, "", "", nil, tt.headers...)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got %d: %q, want %d", tt.name, resp.StatusCode, body, tt.status)
+			continue
+		}
+		if tt.status != http.StatusRequestedRangeNotSatisfiable && string(body) != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.name, body, tt.body)
+		}
+		if got := resp.Header.Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tt.name, got, tt.contentRange)
+		}
+	}
+}
+
+func TestAssetHandlerHidesNonAssets(t *testing.T) {
+	env := assetServer(t)
+	if err := os.WriteFile(env.cfg.assetPath("ab/cd/.abcdef.png.tmp"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/assets/ab/", "/assets/ab/cd", "/assets/ab/cd/.abcdef.png.tmp", "/assets/missing.png"} {
+		if resp, body := env.do(t, http.MethodGet, path, "", "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: got %d: %q, want 404", path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestAssetETagFollowsRewrites(t *testing.T) {
+	env := assetServer(t)
+	resp, _ := env.do(t, http.MethodGet, "/assets/"+servedAsset, "", "", nil)
+	before := resp.Header.Get("ETag")
+
+	path := env.cfg.assetPath(servedAsset)
+	if err := os.WriteFile(path, []byte("9876543210"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := env.do(t, http.MethodGet, "/assets/"+servedAsset, "", "", nil, "If-None-Match", before)
+	if resp.StatusCode != http.StatusOK || string(body) != "9876543210" {
+		t.Errorf("after a rewrite: got %d: %q, want the new content", resp.StatusCode, body)
+	}
+	if after := resp.Header.Get("ETag"); after == before {
+		t.Errorf("ETag stayed %s across a rewrite", before)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// linkIntoShard makes the flat asset called name available at its sharded
+// name as well, returning the new name and whether this call created it.
+// The flat file stays in place so URLs already handed out keep working
+// until the row points at the new one. A link left by an interrupted run
+// is reused.
+func (cfg *apiConfig) linkIntoShard(name string) (string, bool, error) {
+	newName := shardedAssetName(name)
+	oldPath, newPath := cfg.assetPath(name), cfg.assetPath(newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return "", false, cfg.assetsDisk.check(err)
+	}
+
+	err := os.Link(oldPath, newPath)
+	if errors.Is(err, fs.ErrExist) {
+		oldInfo, oldErr := os.Stat(oldPath)
+		newInfo, newErr := os.Stat(newPath)
+		if oldErr != nil || newErr != nil || !os.SameFile(oldInfo, newInfo) {
+			return "", false, errors.New("target " + newName + " already exists")
+		}
+		return newName, false, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// Not every filesystem supports hard links
+		data, readErr := os.ReadFile(oldPath)
+		if readErr != nil {
+			return "", false, readErr
+		}
+		err = cfg.assetsDisk.writeFile(newPath, data)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return newName, true, nil
+}
+
+// removeShardedFlatAssets deletes flat files in assetsRoot that are hard
+// links of their sharded copy, left behind when a migration stopped after
+// updating a row but before removing the old file.
+func (cfg *apiConfig) removeShardedFlatAssets() int {
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || shardedAssetName(name) == name {
+			continue
+		}
+		flatInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		shardInfo, err := os.Stat(cfg.assetPath(shardedAssetName(name)))
+		if err != nil || !os.SameFile(flatInfo, shardInfo) {
+			continue
+		}
+		if os.Remove(cfg.assetPath(name)) == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// handlerShardAssets moves thumbnails stored flat in assetsRoot into the
+// sharded layout and points their videos at the new URLs. It can run while
+// serving traffic: both layouts stay readable, a video whose row changed
+// meanwhile is left for the next run, and running it again only finishes
+// what an interrupted run started.
+func (cfg *apiConfig) handlerShardAssets(w http.ResponseWriter, r *http.Request) {
+	type failure struct {
+		VideoID string `json:"video_id"`
+		Error   string `json:"error"`
+	}
+	type response struct {
+		Checked int       `json:"checked"`
+		Moved   int       `json:"moved"`
+		Skipped int       `json:"skipped"`
+		Removed int       `json:"removed_leftovers"`
+		Failed  []failure `json:"failed"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	videos, err := cfg.db.GetVideosWithThumbnails()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{Failed: []failure{}}
+	for _, video := range videos {
+		var oldNames, createdNames []string
+		var linkErr error
+		for _, field := range []**string{&video.ThumbnailURL, &video.ThumbnailGridURL, &video.ThumbnailModernURL} {
+			if *field == nil {
+				continue
+			}
+			name, ok := cfg.localAssetName(**field)
+			if !ok {
+				continue
+			}
+			resp.Checked++
+			if strings.Contains(name, "/") {
+				continue
+			}
+			newName, created, err := cfg.linkIntoShard(name)
+			if err != nil {
+				linkErr = err
+				break
+			}
+			if created {
+				createdNames = append(createdNames, newName)
+			}
+			oldNames = append(oldNames, name)
+			newURL := cfg.assetURL(newName)
+			*field = &newURL
+		}
+
+		updated := false
+		if linkErr != nil {
+			resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: linkErr.Error()})
+		} else if len(oldNames) > 0 {
+			updated, err = cfg.db.UpdateVideoIfVersion(video, video.Version)
+			if err != nil {
+				resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: "couldn't update video: " + err.Error()})
+			} else if !updated {
+				resp.Skipped++
+			}
+		}
+
+		// Only one layout should outlive this video's turn
+		remove := createdNames
+		if updated {
+			remove = oldNames
+			resp.Moved += len(oldNames)
+		}
+		for _, name := range remove {
+			os.Remove(cfg.assetPath(name))
+		}
+	}
+	resp.Removed = cfg.removeShardedFlatAssets()
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
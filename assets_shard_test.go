@@ -0,0 +1,201 @@
+package main
+
+import (
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedAssetName(t *testing.T) {
+	tests := map[string]string{
+		"abcdef.jpg":      "ab/cd/abcdef.jpg",
+		"0f1e2d_grid.png": "0f/1e/0f1e2d_grid.png",
+		"abcd":            "abcd",
+		"a.jp":            "a.jp",
+	}
+	for name, want := range tests {
+		if got := shardedAssetName(name); got != want {
+			t.Errorf("shardedAssetName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLocalAssetName(t *testing.T) {
+	cfg := apiConfig{assetsPath: "/media"}
+	tests := []struct {
+		url  string
+		name string
+		ok   bool
+	}{
+		{"/media/abcdef.jpg", "abcdef.jpg", true},
+		{"/media/ab/cd/abcdef.jpg", "ab/cd/abcdef.jpg", true},
+		{"http://localhost:8091/media/ab/cd/abcdef.jpg", "ab/cd/abcdef.jpg", true},
+		{"/assets/abcdef.jpg", "abcdef.jpg", true},
+		{"/media/xx/cd/abcdef.jpg", "", false},
+		{"/media/ab/abcdef.jpg", "", false},
+		{"/media/ab/cd/../../../etc/passwd", "", false},
+		{"/media/", "", false},
+		{"https://cdn.example.com/abcdef.jpg", "", false},
+		{"data:image/png;base64,AAAA", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := cfg.localAssetName(tt.url)
+		if name != tt.name || ok != tt.ok {
+			t.Errorf("localAssetName(%q) = %q, %v; want %q, %v", tt.url, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+// flatThumbnail stores a thumbnail the way files were kept before
+// sharding and points video's row at it.
+func (env *testEnv) flatThumbnail(t *testing.T, videoID, name string) {
+	t.Helper()
+	if err := os.WriteFile(env.cfg.assetPath(name), []byte("thumbnail "+name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	video, err := env.cfg.db.GetVideo(mustParseUUID(t, videoID), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := env.cfg.assetURL(name)
+	video.ThumbnailURL = &url
+	if err := env.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type shardResponse struct {
+	Checked int `json:"checked"`
+	Moved   int `json:"moved"`
+	Skipped int `json:"skipped"`
+	Removed int `json:"removed_leftovers"`
+	Failed  []struct {
+		VideoID string `json:"video_id"`
+		Error   string `json:"error"`
+	} `json:"failed"`
+}
+
+func (env *testEnv) shardAssets(t *testing.T) shardResponse {
+	t.Helper()
+	var got shardResponse
+	env.doJSON(t, http.MethodPost, "/admin/assets/shard", testAdmin, nil, http.StatusOK, &got)
+	return got
+}
+
+func TestShardAssetsMigration(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.videoStorage = env.cfg.localStorage
+	_, token := env.createUser(t)
+	flat := env.createVideo(t, token, "Flat")
+	env.flatThumbnail(t, flat.ID, "abcdef.png")
+
+	// A new thumbnail is sharded while the old flat one stays readable
+	sharded := env.createVideo(t, token, "Sharded")
+	var got videoResponse
+	env.doJSON(t, http.MethodPost, "/api/videos/"+sharded.ID+"/thumbnail_json", token, thumbnailJSON(t, 16, 9, color.White), http.StatusOK, &got)
+	name, ok := env.cfg.localAssetName(*got.ThumbnailURL)
+	if !ok || name != shardedAssetName(filepath.Base(name)) {
+		t.Fatalf("new thumbnail at %v, want a sharded name", *got.ThumbnailURL)
+	}
+	for _, name := range []string{"abcdef.png", name} {
+		if resp, body := env.do(t, http.MethodGet, "/assets/"+name, "", "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET /assets/%s: got %d: %s", name, resp.StatusCode, body)
+		}
+	}
+
+	result := env.shardAssets(t)
+	if result.Checked != 2 || result.Moved != 1 || len(result.Failed) != 0 {
+		t.Fatalf("first run = %+v, want the flat thumbnail moved", result)
+	}
+	env.doJSON(t, http.MethodGet, "/api/videos/"+flat.ID, token, nil, http.StatusOK, &got)
+	if name, _ := env.cfg.localAssetName(*got.ThumbnailURL); name != "ab/cd/abcdef.png" {
+		t.Errorf("thumbnail_url = %s, want the sharded name", *got.ThumbnailURL)
+	}
+	if _, err := os.Stat(env.cfg.assetPath("abcdef.png")); !os.IsNotExist(err) {
+		t.Errorf("flat file still there: %v", err)
+	}
+	resp, body := env.do(t, http.MethodGet, "/assets/ab/cd/abcdef.png", "", "", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "thumbnail abcdef.png" {
+		t.Errorf("moved thumbnail: got %d: %q", resp.StatusCode, body)
+	}
+
+	// Running it again changes nothing
+	if again := env.shardAssets(t); again.Checked != 2 || again.Moved != 0 || again.Removed != 0 || len(again.Failed) != 0 {
+		t.Errorf("second run = %+v, want nothing to do", again)
+	}
+}
+
+func TestShardAssetsFinishesInterruptedRun(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Interrupted")
+
+	// A run linked the file and updated the row, then stopped
+	env.flatThumbnail(t, video.ID, "123456.png")
+	if _, created, err := env.cfg.linkIntoShard("123456.png"); err != nil || !created {
+		t.Fatalf("linkIntoShard = %v, %v", created, err)
+	}
+	env.flatThumbnail(t, video.ID, "12/34/123456.png")
+	if _, created, err := env.cfg.linkIntoShard("123456.png"); err != nil || created {
+		t.Errorf("relinking = %v, %v; want the existing link reused", created, err)
+	}
+
+	result := env.shardAssets(t)
+	if result.Moved != 0 || result.Removed != 1 || len(result.Failed) != 0 {
+		t.Errorf("run = %+v, want the leftover flat file removed", result)
+	}
+	if _, err := os.Stat(env.cfg.assetPath("123456.png")); !os.IsNotExist(err) {
+		t.Errorf("flat file still there: %v", err)
+	}
+	if _, err := os.Stat(env.cfg.assetPath("12/34/123456.png")); err != nil {
+		t.Errorf("sharded file: %v", err)
+	}
+}
+
+func TestShardAssetsConflictingTarget(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Conflict")
+	env.flatThumbnail(t, video.ID, "fedcba.png")
+	if err := os.MkdirAll(env.cfg.assetPath("fe/dc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(env.cfg.assetPath("fe/dc/fedcba.png"), []byte("something else"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := env.shardAssets(t)
+	if len(result.Failed) != 1 || result.Failed[0].VideoID != video.ID || result.Moved != 0 {
+		t.Errorf("run = %+v, want the video reported as failed", result)
+	}
+	// The row and the flat file are left alone
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if name, _ := env.cfg.localAssetName(*got.ThumbnailURL); name != "fedcba.png" {
+		t.Errorf("thumbnail_url = %s, want it unchanged", *got.ThumbnailURL)
+	}
+	if _, err := os.Stat(env.cfg.assetPath("fedcba.png")); err != nil {
+		t.Errorf("flat file: %v", err)
+	}
+}
+
+func TestRemoveLocalAssetsBothLayouts(t *testing.T) {
+	env := newTestEnv(t)
+	if err := os.MkdirAll(env.cfg.assetPath("aa/bb"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"aabbcc.png", "aa/bb/aabbcc.jpg"} {
+		if err := os.WriteFile(env.cfg.assetPath(name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flat, sharded := env.cfg.assetURL("aabbcc.png"), env.cfg.assetURL("aa/bb/aabbcc.jpg")
+	env.cfg.removeLocalAssets(&flat, &sharded)
+	for _, name := range []string{"aabbcc.png", "aa/bb/aabbcc.jpg"} {
+		if _, err := os.Stat(env.cfg.assetPath(name)); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed: %v", name, err)
+		}
+	}
+}
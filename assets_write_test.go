@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// assetFiles returns every file under root, dot files included.
+func assetFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestAssetsWriteFileRenamesIntoPlace(t *testing.T) {
+	root := t.TempDir()
+	disk := newAssetsDisk(root)
+	path := filepath.Join(root, "ab", "cd", "abcdef.png")
+
+	for _, data := range []string{"first", "second"} {
+		if err := disk.writeFile(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(path); string(got) != data {
+			t.Errorf("file holds %q, want %q", got, data)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("mode %v, want assets readable by everyone", info.Mode().Perm())
+	}
+	if files := assetFiles(t, root); len(files) != 1 {
+		t.Errorf("files %v, want only the asset", files)
+	}
+}
+
+func TestAssetsWriteFileFailingPartway(t *testing.T) {
+	root := t.TempDir()
+	disk := newAssetsDisk(root)
+	path := filepath.Join(root, "ab", "cd", "abcdef.png")
+
+	// The temp file is created but can't be written
+	createAssetFile = func(dir, pattern string) (*os.File, error) {
+		f, err := os.CreateTemp(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		return os.Open(f.Name())
+	}
+	t.Cleanup(func() { createAssetFile = os.CreateTemp })
+
+	if err := disk.writeFile(path, []byte("never written")); err == nil {
+		t.Fatal("writeFile succeeded")
+	}
+	if files := assetFiles(t, root); len(files) != 0 {
+		t.Errorf("files %v left behind, want none", files)
+	}
+}
+
+func TestThumbnailUploadAbortedMidStream(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.videoStorage = env.cfg.localStorage
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Aborted thumbnail")
+
+	// Half the image arrives, then the client goes away
+	partial := bytes.Repeat(jpegBytes(t)[:64], 64)
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("thumbnail", "still.jpg")
+		if err == nil {
+			_, err = part.Write(partial)
+		}
+		if err == nil {
+			err = errors.New("client went away")
+		}
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequest(http.MethodPost, env.server.URL+"/api/thumbnail_upload/"+video.ID, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if resp, err := env.server.Client().Do(req); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 400 {
+			t.Errorf("aborted upload: got %d", resp.StatusCode)
+		}
+	}
+
+	if files := assetFiles(t, env.cfg.assetsRoot); len(files) != 0 {
+		t.Errorf("files %v left under assetsRoot, want none", files)
+	}
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if got.ThumbnailURL != nil {
+		t.Errorf("thumbnail_url = %s after an aborted upload", *got.ThumbnailURL)
+	}
+}
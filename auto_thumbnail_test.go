@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// fakeFFmpeg puts an ffmpeg on PATH that logs its arguments to the
+// returned file. Asked for a single frame it copies frame, when set, to
+// its output path; anything else, such as the fast start remux, copies
+// its input there.
+func fakeFFmpeg(t *testing.T, frame []byte) (argsLog string) {
+	t.Helper()
+	dir := t.TempDir()
+	argsLog = filepath.Join(dir, "args.log")
+	framePath := filepath.Join(dir, "frame.jpg")
+	if frame != nil {
+		if err := os.WriteFile(framePath, frame, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := `#!/bin/sh
+echo "$@" >> '` + argsLog + `'
+prev=
+for arg; do
+	[ "$prev" = -i ] && in=$arg
+	prev=$arg out=$arg
+done
+case " $* " in
+*" -frames:v 1 "*) in='` + framePath + `' ;;
+esac
+if [ -f "$in" ]; then cp "$in" "$out"; fi
+`
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsLog
+}
+
+func TestGenerateThumbnailFromVideo(t *testing.T) {
+	frame := jpegBytes(t)
+	argsLog := fakeFFmpeg(t, frame)
+	input := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(input, testVideoBytes(1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := generateThumbnailFromVideo(context.Background(), input, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(got)
+	if data, _ := os.ReadFile(got); !bytes.Equal(data, frame) {
+		t.Error("the returned file doesn't hold ffmpeg's frame")
+	}
+	args, _ := os.ReadFile(argsLog)
+	if !strings.Contains(string(args), "-ss 0.500 -i "+input) {
+		t.Errorf("ffmpeg args %q, want the frame taken at 0.5s", args)
+	}
+}
+
+func TestGenerateThumbnailFromVideoWithoutFrame(t *testing.T) {
+	// Audio-only input: ffmpeg succeeds but writes nothing
+	fakeFFmpeg(t, nil)
+	input := filepath.Join(t.TempDir(), "audio.mp4")
+	if err := os.WriteFile(input, testVideoBytes(1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := generateThumbnailFromVideo(context.Background(), input, 1); err == nil {
+		t.Fatalf("got %s, want an error", got)
+	}
+	if _, err := os.Stat(input + ".thumb.jpg"); !os.IsNotExist(err) {
+		t.Errorf("frame file left behind: %v", err)
+	}
+}
+
+// autoThumbnailEnv is a test server that runs the fake ffmpeg.
+func autoThumbnailEnv(t *testing.T, frame []byte) (*testEnv, string) {
+	t.Helper()
+	fakeFFmpeg(t, frame)
+	env := newTestEnv(t, func(cfg *apiConfig) { cfg.tools.FFmpeg = true })
+	_, token := env.createUser(t)
+	return env, token
+}
+
+func (env *testEnv) uploadAndProcess(t *testing.T, token, videoID string) videoResponse {
+	t.Helper()
+	if resp, body := env.uploadVideo(t, token, videoID, testVideoBytes(4<<10)); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload: got %d: %s", resp.StatusCode, body)
+	}
+	env.waitForProcessing(t, token, videoID)
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+videoID, token, nil, http.StatusOK, &got)
+	return got
+}
+
+func TestUploadGeneratesThumbnail(t *testing.T) {
+	env, token := autoThumbnailEnv(t, jpegBytes(t))
+	video := env.createVideo(t, token, "No thumbnail")
+
+	got := env.uploadAndProcess(t, token, video.ID)
+	if got.ThumbnailURL == nil || got.ThumbnailGridURL == nil {
+		t.Fatalf("thumbnail %v, grid %v; want both generated", got.ThumbnailURL, got.ThumbnailGridURL)
+	}
+	if got.ThumbnailWidth == nil || *got.ThumbnailWidth != 16 || got.ThumbnailHeight == nil || *got.ThumbnailHeight != 9 {
+		t.Errorf("thumbnail size %v×%v, want the frame's 16×9", got.ThumbnailWidth, got.ThumbnailHeight)
+	}
+}
+
+func TestUploadKeepsUploadedThumbnail(t *testing.T) {
+	env, token := autoThumbnailEnv(t, jpegBytes(t))
+	video := env.createVideo(t, token, "Own thumbnail")
+	var before videoResponse
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, thumbnailJSON(t, 32, 18, color.Black), http.StatusOK, &before)
+
+	got := env.uploadAndProcess(t, token, video.ID)
+	if got.ThumbnailURL == nil || *got.ThumbnailURL != *before.ThumbnailURL {
+		t.Errorf("thumbnail %v, want the uploaded %s kept", got.ThumbnailURL, *before.ThumbnailURL)
+	}
+}
+
+func TestUploadWithoutFrameSucceeds(t *testing.T) {
+	env, token := autoThumbnailEnv(t, nil)
+	video := env.createVideo(t, token, "Audio only")
+
+	got := env.uploadAndProcess(t, token, video.ID)
+	if got.ProcessingStatus == nil || *got.ProcessingStatus != database.ProcessingStatusReady || got.VideoURL == nil {
+		t.Errorf("processing %v with video_url %v, want the upload stored", got.ProcessingStatus, got.VideoURL)
+	}
+	if got.ThumbnailURL != nil {
+		t.Errorf("thumbnail %s, want none without a frame", *got.ThumbnailURL)
+	}
+}
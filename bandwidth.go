@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk is the largest write charged against a bucket at once, so
+// a big write is spread out instead of stalling and then bursting.
+const bandwidthChunk = 32 << 10 // 32 KB
+
+// tokenBucket meters bytes at rate per second with a one-second burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	return &tokenBucket{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait takes n tokens, sleeping until they're available or ctx is done.
+// Tokens are taken up front, so concurrent writers queue fairly by going
+// into debt rather than racing for refills.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bandwidthMeter counts bytes written through a limiter for admin stats.
+type bandwidthMeter struct {
+	mu          sync.Mutex
+	total       int64
+	windowStart time.Time
+	windowBytes int64
+	lastRate    float64
+}
+
+func (m *bandwidthMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(time.Now())
+	m.total += int64(n)
+	m.windowBytes += int64(n)
+}
+
+// roll closes the current one-second window once it has passed.
+func (m *bandwidthMeter) roll(now time.Time) {
+	elapsed := now.Sub(m.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+	m.lastRate = 0
+	if elapsed < 2*time.Second {
+		m.lastRate = float64(m.windowBytes) / elapsed.Seconds()
+	}
+	m.windowStart = now
+	m.windowBytes = 0
+}
+
+// rate returns bytes per second over the last full window and the total.
+func (m *bandwidthMeter) rate() (float64, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(time.Now())
+	return m.lastRate, m.total
+}
+
+// bandwidthLimiter caps how fast responses are written, per connection and
+// across all connections it serves. A zero limit disables that cap.
+type bandwidthLimiter struct {
+	perConn int64
+	global  *tokenBucket
+	meter   bandwidthMeter
+}
+
+func newBandwidthLimiter(perConn, global int64) *bandwidthLimiter {
+	l := &bandwidthLimiter{perConn: perConn}
+	if global > 0 {
+		l.global = newTokenBucket(global)
+	}
+	return l
+}
+
+func (l *bandwidthLimiter) enabled() bool {
+	return l.perConn > 0 || l.global != nil
+}
+
+// middleware throttles next's response bodies. Range requests are limited
+// like any other response; a client that goes away stops waiting at once.
+func (l *bandwidthLimiter) middleware(next http.Handler) http.Handler {
+	if !l.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiter: l}
+		if l.perConn > 0 {
+			tw.conn = newTokenBucket(l.perConn)
+		}
+		next.ServeHTTP(tw, r)
+	})
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *bandwidthLimiter
+	conn    *tokenBucket
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthChunk)]
+		if w.conn != nil {
+			if err := w.conn.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		if w.limiter.global != nil {
+			if err := w.limiter.global.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.limiter.meter.add(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// servePayload serves n bytes through limiter, honouring Range requests.
+func servePayload(t *testing.T, limiter *bandwidthLimiter, n int) *httptest.Server {
+	t.Helper()
+	payload := bytes.Repeat([]byte("x"), n)
+	server := httptest.NewServer(limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	})))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// timedGet fetches url and returns how many bytes arrived and how long it took.
+func timedGet(t *testing.T, url string) (int, time.Duration) {
+	t.Helper()
+	start := time.Now()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return 0, 0
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	return int(n), time.Since(start)
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := newTokenBucket(1000)
+	// The first second's worth is a burst
+	start := time.Now()
+	if err := b.wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("burst took %v", elapsed)
+	}
+
+	// Past the burst, a waiter gives up as soon as its context does
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := b.wait(ctx, 10000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the context's", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled wait took %v", elapsed)
+	}
+}
+
+func TestBandwidthLimiterPerConnection(t *testing.T) {
+	const rate = 256 << 10
+	server := servePayload(t, newBandwidthLimiter(rate, 0), 2*rate)
+
+	// One second's burst, then a second at the limit
+	n, elapsed := timedGet(t, server.URL)
+	if n != 2*rate {
+		t.Fatalf("received %d bytes, want %d", n, 2*rate)
+	}
+	if elapsed < 700*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("took %v, want about a second", elapsed)
+	}
+
+	// Each connection gets its own allowance
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			timedGet(t, server.URL)
+		}()
+	}
+	wg.Wait()
+	// Sharing one allowance would take five seconds
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("three connections took %v, want each limited separately", elapsed)
+	}
+}
+
+func TestBandwidthLimiterGlobal(t *testing.T) {
+	const rate = 256 << 10
+	limiter := newBandwidthLimiter(0, rate)
+	server := servePayload(t, limiter, rate)
+
+	// Two connections share one second's burst and one more second
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n, _ := timedGet(t, server.URL); n != rate {
+				t.Errorf("received %d bytes, want %d", n, rate)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("took %v, want about a second", elapsed)
+	}
+	// The last write is metered after the client may have read it
+	deadline := time.Now().Add(time.Second)
+	_, total := limiter.meter.rate()
+	for total < 2*rate && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, total = limiter.meter.rate()
+	}
+	if total != 2*rate {
+		t.Errorf("metered %d bytes, want %d", total, 2*rate)
+	}
+}
+
+func TestBandwidthLimiterRange(t *testing.T) {
+	const rate = 256 << 10
+	server := servePayload(t, newBandwidthLimiter(rate, 0), 4*rate)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Range", "bytes=100-1099")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || len(body) != 1000 {
+		t.Errorf("got %d with %d bytes, want 206 with 1000", resp.StatusCode, len(body))
+	}
+}
+
+func TestBandwidthLimiterClientGoesAway(t *testing.T) {
+	const rate = 64 << 10
+	done := make(chan error, 1)
+	limiter := newBandwidthLimiter(rate, 0)
+	server := httptest.NewServer(limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write(make([]byte, 100*rate))
+		done <- err
+	})))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("the write finished though the client went away")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler kept writing after the client went away")
+	}
+}
+
+func TestAdminStatsReportDownloads(t *testing.T) {
+	const rate = 256 << 10
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.downloadLimiter = newBandwidthLimiter(rate, 4*rate)
+	})
+	if err := os.WriteFile(filepath.Join(env.cfg.assetsRoot, "still.jpg"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := env.do(t, http.MethodGet, "/assets/still.jpg", "", "", nil)
+	if resp.StatusCode != http.StatusOK || len(body) != 1000 {
+		t.Fatalf("asset: got %d with %d bytes", resp.StatusCode, len(body))
+	}
+
+	var stats struct {
+		Downloads struct {
+			TotalBytes   int64 `json:"total_bytes"`
+			PerConnLimit int64 `json:"per_connection_limit_bytes_per_second"`
+			GlobalLimit  int64 `json:"global_limit_bytes_per_second"`
+		} `json:"downloads"`
+	}
+	env.doJSON(t, http.MethodGet, "/admin/stats", testAdmin, nil, http.StatusOK, &stats)
+	if got := stats.Downloads; got.TotalBytes != 1000 || got.PerConnLimit != rate || got.GlobalLimit != 4*rate {
+		t.Errorf("admin stats downloads = %+v", got)
+	}
+}
@@ -1,11 +1,105 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"os"
+	"strings"
+)
 
-func cacheMiddleware(next http.Handler) http.Handler {
+// cachePolicy is the Cache-Control applied to one family of routes.
+type cachePolicy struct {
+	// name identifies the policy for CACHE_CONTROL_<NAME> overrides
+	name     string
+	prefixes []string
+	header   string
+	// validators keeps ETag/Last-Modified revalidation; without it they are
+	// stripped so clients can't cache around the policy.
+	validators bool
+}
+
+// defaultCachePolicies returns the built-in policy table. Thumbnails are
+// named by their content, so assets never change in place. API responses
+// keep their validators because video ETags drive If-Match updates;
+// no-store already stops them being cached.
+func defaultCachePolicies(assetsPath string) []cachePolicy {
+	assetPrefixes := []string{assetsPath + "/"}
+	if assetsPath != defaultAssetsPath {
+		assetPrefixes = append(assetPrefixes, defaultAssetsPath+"/")
+	}
+	return []cachePolicy{
+		{name: "assets", prefixes: assetPrefixes, header: "public, max-age=31536000, immutable", validators: true},
+		{name: "app", prefixes: []string{"/app/"}, header: "no-cache", validators: true},
+		{name: "api", prefixes: []string{"/api/"}, header: "no-store", validators: true},
+		{name: "share", prefixes: []string{"/s/"}, header: "private, no-store"},
+		{name: "admin", prefixes: []string{"/admin/"}, header: "no-store"},
+	}
+}
+
+// applyCacheOverrides replaces policy headers from CACHE_CONTROL_<NAME>
+// environment variables, e.g. CACHE_CONTROL_ASSETS=no-store.
+func applyCacheOverrides(policies []cachePolicy) {
+	for i := range policies {
+		if v := os.Getenv("CACHE_CONTROL_" + strings.ToUpper(policies[i].name)); v != "" {
+			policies[i].header = v
+		}
+	}
+}
+
+// policyFor returns the policy with the longest prefix matching path.
+func policyFor(policies []cachePolicy, path string) (cachePolicy, bool) {
+	var best cachePolicy
+	bestLen := -1
+	for _, p := range policies {
+		for _, prefix := range p.prefixes {
+			if strings.HasPrefix(path, prefix) && len(prefix) > bestLen {
+				best, bestLen = p, len(prefix)
+			}
+		}
+	}
+	return best, bestLen >= 0
+}
+
+// cacheMiddleware sets the Cache-Control header from the policy table before
+// calling next, so a handler that knows better can still overwrite it.
+func cacheMiddleware(policies []cachePolicy, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Disable caching for responses handled by this middleware
-		w.Header().Set("Cache-Control", "no-store")
+		policy, ok := policyFor(policies, r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", policy.header)
+		if !policy.validators {
+			r.Header.Del("If-None-Match")
+			r.Header.Del("If-Modified-Since")
+			w = &noValidatorsWriter{ResponseWriter: w}
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// noValidatorsWriter drops ETag and Last-Modified from the response.
+type noValidatorsWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *noValidatorsWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Del("ETag")
+		w.Header().Del("Last-Modified")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *noValidatorsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *noValidatorsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,217 @@
+// Package client is a typed Go client for the Tubely HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials authenticate a Client. Set Token to use an existing access
+// token, or Email and Password to log in on first use.
+type Credentials struct {
+	Token    string
+	Email    string
+	Password string
+}
+
+// Client calls the API at a base URL such as "http://localhost:8091".
+type Client struct {
+	baseURL     string
+	credentials Credentials
+	httpClient  *http.Client
+
+	// MaxRetries is how many times a request answered with 429 or 503 is
+	// retried after its Retry-After delay. Streamed uploads are only
+	// retried when their body implements io.Seeker.
+	MaxRetries int
+	// MaxRetryWait caps the delay taken from Retry-After.
+	MaxRetryWait time.Duration
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewClient returns a Client for baseURL using http.DefaultClient.
+func NewClient(baseURL string, credentials Credentials) *Client {
+	return &Client{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		credentials:  credentials,
+		httpClient:   http.DefaultClient,
+		MaxRetries:   3,
+		MaxRetryWait: 30 * time.Second,
+		token:        credentials.Token,
+	}
+}
+
+// WithHTTPClient makes c send requests through hc, e.g. one with timeouts.
+func (c *Client) WithHTTPClient(hc *http.Client) *Client {
+	c.httpClient = hc
+	return c
+}
+
+// Error is a non-2xx response from the API.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Code is the server's machine-readable error code, such as
+	// "video_not_found"; branch on it rather than on Message.
+	Code string
+	// RetryAfter is the server's requested delay, when it sent one.
+	RetryAfter time.Duration
+	// RequestID is the server's ID for the failed request; quote it when
+	// reporting a problem so it can be found in the server logs.
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tubely: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is an API 404.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// accessToken returns the configured token, logging in once if needed.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		return c.token, nil
+	}
+	if c.credentials.Email == "" {
+		return "", errors.New("tubely: no token or email/password configured")
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"email":    c.credentials.Email,
+		"password": c.credentials.Password,
+	})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err = c.do(ctx, request{
+		method:      http.MethodPost,
+		path:        "/api/login",
+		body:        bytes.NewReader(body),
+		contentType: "application/json",
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	c.token = resp.Token
+	return c.token, nil
+}
+
+type request struct {
+	method      string
+	path        string
+	body        io.Reader
+	contentType string
+	header      http.Header
+	auth        bool
+}
+
+// call sends an authenticated request and decodes the JSON response into out.
+func (c *Client) call(ctx context.Context, req request, out any) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	if req.header == nil {
+		req.header = http.Header{}
+	}
+	req.header.Set("Authorization", "Bearer "+token)
+	return c.do(ctx, req, out)
+}
+
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	seeker, _ := req.body.(io.Seeker)
+	rewindable := req.body == nil || seeker != nil
+
+	for attempt := 0; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, req.body)
+		if err != nil {
+			return err
+		}
+		for k, v := range req.header {
+			httpReq.Header[k] = v
+		}
+		if req.contentType != "" {
+			httpReq.Header.Set("Content-Type", req.contentType)
+		}
+
+		resp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			return err
+		}
+		err = decodeResponse(resp, out)
+
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || !retryable(apiErr.StatusCode) || attempt >= c.MaxRetries || !rewindable {
+			return err
+		}
+		if seeker != nil {
+			if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr != nil {
+				// Report what the server said rather than why we can't retry
+				return err
+			}
+		}
+
+		wait := apiErr.RetryAfter
+		if wait <= 0 {
+			wait = time.Second << attempt
+		}
+		wait = min(wait, c.MaxRetryWait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+func decodeResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		apiErr := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+			apiErr.Message = body.Error.Message
+			apiErr.Code = body.Error.Code
+		}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return apiErr
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,473 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Video mirrors the API's video representation.
+type Video struct {
+	ID                 uuid.UUID `json:"id"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+	Title              string    `json:"title"`
+	Description        string    `json:"description"`
+	UserID             uuid.UUID `json:"user_id"`
+	Status             string    `json:"status"`
+	ThumbnailURL       *string   `json:"thumbnail_url"`
+	ThumbnailGridURL   *string   `json:"thumbnail_grid_url"`
+	ThumbnailModernURL *string   `json:"thumbnail_modern_url"`
+	ThumbnailWidth     *int      `json:"thumbnail_width"`
+	ThumbnailHeight    *int      `json:"thumbnail_height"`
+	VideoURL           *string   `json:"video_url"`
+	ContentType        *string   `json:"content_type"`
+	OriginalFilename   *string   `json:"original_filename"`
+	ProcessingWarnings []string  `json:"processing_warnings"`
+	ProcessingBranch   *string   `json:"processing_branch"`
+	ProcessingStatus   *string   `json:"processing_status"`
+	ProcessingError    *string   `json:"processing_error"`
+	FastStart          *bool     `json:"faststart"`
+	PasswordProtected  bool      `json:"password_protected"`
+	Version            int       `json:"version"`
+	SizeBytes          *int64    `json:"size_bytes"`
+	DurationSeconds    *float64  `json:"duration_seconds"`
+
+	// Renditions maps labels such as "720p" to URLs; "source" is VideoURL.
+	Renditions map[string]string `json:"renditions"`
+	// HLSURL is the adaptive streaming playlist, when one was packaged.
+	HLSURL *string `json:"hls_url"`
+	// ChecksumSHA256 is the base64 SHA-256 of the file at VideoURL, when
+	// the server knows it.
+	ChecksumSHA256 *string `json:"checksum_sha256"`
+	// AllowedEmbedOrigins is only returned to the video's owner.
+	AllowedEmbedOrigins []string `json:"allowed_embed_origins"`
+}
+
+// CreateVideo creates a draft video.
+func (c *Client) CreateVideo(ctx context.Context, title, description string) (Video, error) {
+	body, err := json.Marshal(map[string]string{"title": title, "description": description})
+	if err != nil {
+		return Video{}, err
+	}
+	var video Video
+	err = c.call(ctx, request{
+		method:      http.MethodPost,
+		path:        "/api/videos",
+		body:        bytes.NewReader(body),
+		contentType: "application/json",
+	}, &video)
+	return video, err
+}
+
+// GetVideo fetches one video. Use IsNotFound to detect a missing video.
+func (c *Client) GetVideo(ctx context.Context, id uuid.UUID) (Video, error) {
+	var video Video
+	err := c.call(ctx, request{method: http.MethodGet, path: "/api/videos/" + id.String()}, &video)
+	return video, err
+}
+
+// ListOptions filters ListVideos.
+type ListOptions struct {
+	ExcludeDrafts bool
+}
+
+// ListVideos returns the caller's videos, newest first. The API returns
+// the whole list in one response.
+func (c *Client) ListVideos(ctx context.Context, opts ListOptions) ([]Video, error) {
+	path := "/api/videos"
+	if opts.ExcludeDrafts {
+		path += "?" + url.Values{"drafts": {"exclude"}}.Encode()
+	}
+	var videos []Video
+	err := c.call(ctx, request{method: http.MethodGet, path: path}, &videos)
+	return videos, err
+}
+
+// PageOptions select a page of ListVideoPage. Zero values use the server
+// defaults: 20 videos, newest first.
+type PageOptions struct {
+	ExcludeDrafts bool
+	Limit         int
+	// Sort is "created_at" or "title"; Order is "asc" or "desc".
+	Sort  string
+	Order string
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+}
+
+// VideoPage is one page of the caller's videos. NextCursor is empty on the
+// last page.
+type VideoPage struct {
+	Videos     []Video `json:"videos"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+// ListVideoPage returns one page of the caller's videos.
+func (c *Client) ListVideoPage(ctx context.Context, opts PageOptions) (VideoPage, error) {
+	query := url.Values{}
+	if opts.ExcludeDrafts {
+		query.Set("drafts", "exclude")
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if opts.Order != "" {
+		query.Set("order", opts.Order)
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	// An explicit limit is what asks the server for a page
+	if !query.Has("limit") {
+		query.Set("limit", "20")
+	}
+	var page VideoPage
+	err := c.call(ctx, request{method: http.MethodGet, path: "/api/videos?" + query.Encode()}, &page)
+	return page, err
+}
+
+// DeleteVideo deletes a video and its stored files.
+func (c *Client) DeleteVideo(ctx context.Context, id uuid.UUID) error {
+	return c.call(ctx, request{method: http.MethodDelete, path: "/api/videos/" + id.String()}, nil)
+}
+
+// UploadOptions describe an uploaded file.
+type UploadOptions struct {
+	// Filename is shown to users as the original filename.
+	Filename string
+	// ContentType defaults to video/mp4 for videos.
+	ContentType string
+	// SHA256, when set, is the file's digest; the server rejects a video
+	// upload whose bytes don't match it.
+	SHA256 []byte
+}
+
+// UploadVideo streams r as the video's content. The body is never held in
+// memory; pass an *os.File (or another io.ReadSeeker) to allow retries.
+// The server processes the video after responding, so the returned video
+// is still pending; use WaitForVideo to get the processed one.
+func (c *Client) UploadVideo(ctx context.Context, id uuid.UUID, r io.Reader, opts UploadOptions) (Video, error) {
+	if opts.ContentType == "" {
+		opts.ContentType = "video/mp4"
+	}
+	if opts.Filename == "" {
+		opts.Filename = "video.mp4"
+	}
+	var video Video
+	err := c.uploadFile(ctx, "/api/video_upload/"+id.String(), "video", r, opts, &video)
+	return video, err
+}
+
+// UploadVideoDirect uploads size bytes from r straight to S3 through a
+// presigned URL, then has the server verify the object and make it the
+// video's content. Unlike UploadVideo, the video is ready on return, but
+// it is stored as sent, without faststart processing or renditions.
+func (c *Client) UploadVideoDirect(ctx context.Context, id uuid.UUID, r io.Reader, size int64) (Video, error) {
+	body, err := json.Marshal(map[string]int64{"size_bytes": size})
+	if err != nil {
+		return Video{}, err
+	}
+	var target struct {
+		Key       string            `json:"key"`
+		UploadURL string            `json:"upload_url"`
+		Method    string            `json:"method"`
+		Headers   map[string]string `json:"headers"`
+	}
+	err = c.call(ctx, request{
+		method:      http.MethodPost,
+		path:        "/api/videos/" + id.String() + "/upload-url",
+		body:        bytes.NewReader(body),
+		contentType: "application/json",
+	}, &target)
+	if err != nil {
+		return Video{}, err
+	}
+
+	put, err := http.NewRequestWithContext(ctx, target.Method, target.UploadURL, r)
+	if err != nil {
+		return Video{}, err
+	}
+	for k, v := range target.Headers {
+		put.Header.Set(k, v)
+	}
+	put.ContentLength = size
+	resp, err := c.httpClient.Do(put)
+	if err != nil {
+		return Video{}, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return Video{}, fmt.Errorf("tubely: direct upload of video %s failed: %s", id, resp.Status)
+	}
+
+	body, err = json.Marshal(map[string]string{"key": target.Key})
+	if err != nil {
+		return Video{}, err
+	}
+	var video Video
+	err = c.call(ctx, request{
+		method:      http.MethodPost,
+		path:        "/api/videos/" + id.String() + "/upload-complete",
+		body:        bytes.NewReader(body),
+		contentType: "application/json",
+	}, &video)
+	return video, err
+}
+
+// UploadSession is a chunked upload in progress. Chunk n covers bytes
+// [n*ChunkSize, (n+1)*ChunkSize) of the file; the last may be shorter.
+type UploadSession struct {
+	ID             string    `json:"id"`
+	VideoID        uuid.UUID `json:"video_id"`
+	SizeBytes      int64     `json:"size_bytes"`
+	ChunkSize      int64     `json:"chunk_size"`
+	ChunkCount     int       `json:"chunk_count"`
+	SHA256         string    `json:"sha256"`
+	ReceivedChunks []int     `json:"received_chunks"`
+	MissingChunks  []int     `json:"missing_chunks"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// UploadVideoChunked uploads size bytes from r through an upload session,
+// one chunk per request, so a dropped connection only costs the chunk in
+// flight. If it fails after the session was opened, the returned session's
+// ID can be passed to ResumeUploadSession. Like UploadVideo, the returned
+// video is still pending processing.
+func (c *Client) UploadVideoChunked(ctx context.Context, id uuid.UUID, r io.ReaderAt, size int64, opts UploadOptions) (Video, UploadSession, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(r, 0, size)); err != nil {
+		return Video{}, UploadSession{}, err
+	}
+	body, err := json.Marshal(map[string]any{
+		"size_bytes": size,
+		"sha256":     hex.EncodeToString(hasher.Sum(nil)),
+		"filename":   opts.Filename,
+	})
+	if err != nil {
+		return Video{}, UploadSession{}, err
+	}
+	var session UploadSession
+	err = c.call(ctx, request{
+		method:      http.MethodPost,
+		path:        "/api/videos/" + id.String() + "/uploads",
+		body:        bytes.NewReader(body),
+		contentType: "application/json",
+	}, &session)
+	if err != nil {
+		return Video{}, UploadSession{}, err
+	}
+	video, err := c.ResumeUploadSession(ctx, session.ID, r)
+	return video, session, err
+}
+
+// GetUploadSession reports which chunks of an upload session have arrived.
+func (c *Client) GetUploadSession(ctx context.Context, sessionID string) (UploadSession, error) {
+	var session UploadSession
+	err := c.call(ctx, request{method: http.MethodGet, path: "/api/uploads/" + url.PathEscape(sessionID)}, &session)
+	return session, err
+}
+
+// ResumeUploadSession sends whichever chunks of the session the server is
+// missing, reading them from r, and then completes the session.
+func (c *Client) ResumeUploadSession(ctx context.Context, sessionID string, r io.ReaderAt) (Video, error) {
+	session, err := c.GetUploadSession(ctx, sessionID)
+	if err != nil {
+		return Video{}, err
+	}
+	base := "/api/uploads/" + url.PathEscape(sessionID)
+	buf := make([]byte, session.ChunkSize)
+	for _, n := range session.MissingChunks {
+		off := int64(n) * session.ChunkSize
+		chunk := buf[:min(session.ChunkSize, session.SizeBytes-off)]
+		if _, err := io.ReadFull(io.NewSectionReader(r, off, int64(len(chunk))), chunk); err != nil {
+			return Video{}, err
+		}
+		sum := sha256.Sum256(chunk)
+		err := c.call(ctx, request{
+			method:      http.MethodPut,
+			path:        base + "/chunks/" + strconv.Itoa(n),
+			body:        bytes.NewReader(chunk),
+			contentType: "application/octet-stream",
+			header:      http.Header{"Upload-Chunk-Sha256": {hex.EncodeToString(sum[:])}},
+		}, nil)
+		if err != nil {
+			return Video{}, err
+		}
+	}
+	var video Video
+	err = c.call(ctx, request{method: http.MethodPost, path: base + "/complete"}, &video)
+	return video, err
+}
+
+// Processing states reported in Video.ProcessingStatus.
+const (
+	ProcessingPending = "pending"
+	ProcessingReady   = "ready"
+	ProcessingFailed  = "failed"
+)
+
+// VideoStatus is the processing state of a video's latest upload.
+type VideoStatus struct {
+	VideoID          uuid.UUID `json:"video_id"`
+	ProcessingStatus *string   `json:"processing_status"`
+	ProcessingError  *string   `json:"processing_error"`
+	// ProcessingWarnings are the ready upload's warnings, such as
+	// "faststart_skipped", for problems that didn't stop processing.
+	ProcessingWarnings []string `json:"processing_warnings"`
+	// Stage is the upload's progress stage, while the server tracks it.
+	Stage *string `json:"stage"`
+}
+
+// GetVideoStatus fetches the processing state of the caller's video.
+func (c *Client) GetVideoStatus(ctx context.Context, id uuid.UUID) (VideoStatus, error) {
+	var status VideoStatus
+	err := c.call(ctx, request{method: http.MethodGet, path: "/api/videos/" + id.String() + "/status"}, &status)
+	return status, err
+}
+
+// WaitForVideo polls every interval until the video's latest upload has
+// been processed, then returns the video. Videos with no upload are
+// returned straight away. A failed upload is returned as
+// an error carrying the server's message.
+func (c *Client) WaitForVideo(ctx context.Context, id uuid.UUID, interval time.Duration) (Video, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := c.GetVideoStatus(ctx, id)
+		if err != nil {
+			return Video{}, err
+		}
+		// Videos uploaded before processing was queued have no status
+		if status.ProcessingStatus == nil || *status.ProcessingStatus == ProcessingReady {
+			return c.GetVideo(ctx, id)
+		}
+		if *status.ProcessingStatus == ProcessingFailed {
+			msg := "unknown error"
+			if status.ProcessingError != nil {
+				msg = *status.ProcessingError
+			}
+			return Video{}, fmt.Errorf("tubely: processing video %s failed: %s", id, msg)
+		}
+		select {
+		case <-ctx.Done():
+			return Video{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// UploadThumbnail uploads an image/jpeg or image/png thumbnail.
+func (c *Client) UploadThumbnail(ctx context.Context, id uuid.UUID, r io.Reader, opts UploadOptions) (Video, error) {
+	if opts.Filename == "" {
+		opts.Filename = "thumbnail"
+	}
+	var video Video
+	err := c.uploadFile(ctx, "/api/thumbnail_upload/"+id.String(), "thumbnail", r, opts, &video)
+	return video, err
+}
+
+// uploadFile sends r as a single multipart file field, encoding it through
+// a pipe as the request body is read.
+func (c *Client) uploadFile(ctx context.Context, path, field string, r io.Reader, opts UploadOptions, out any) error {
+	body := &multipartBody{src: r, field: field, opts: opts}
+	body.reset()
+	header := http.Header{}
+	if opts.SHA256 != nil {
+		header.Set("X-Upload-Checksum-SHA256", base64.StdEncoding.EncodeToString(opts.SHA256))
+	}
+	return c.call(ctx, request{
+		method:      http.MethodPost,
+		path:        path,
+		body:        body,
+		contentType: body.contentType,
+		header:      header,
+	}, out)
+}
+
+// multipartBody encodes src as a multipart form while it's read. When src
+// is an io.Seeker the body can be rewound for a retry.
+type multipartBody struct {
+	src         io.Reader
+	field       string
+	opts        UploadOptions
+	contentType string
+	boundary    string
+	pr          *io.PipeReader
+	done        chan struct{}
+}
+
+func (b *multipartBody) reset() {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	if b.boundary == "" {
+		b.boundary = mw.Boundary()
+	} else if err := mw.SetBoundary(b.boundary); err != nil {
+		pw.CloseWithError(err)
+	}
+	b.contentType = mw.FormDataContentType()
+	b.pr = pr
+	done := make(chan struct{})
+	b.done = done
+
+	go func() {
+		defer close(done)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, b.field, b.opts.Filename))
+		header.Set("Content-Type", b.opts.ContentType)
+		part, err := mw.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, b.src)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+}
+
+func (b *multipartBody) Read(p []byte) (int, error) {
+	return b.pr.Read(p)
+}
+
+// Close stops the encoding goroutine if the request ends early.
+func (b *multipartBody) Close() error {
+	return b.pr.Close()
+}
+
+// Seek only supports rewinding to the start, re-encoding from a rewound src.
+func (b *multipartBody) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("tubely: upload body can only be rewound")
+	}
+	seeker, ok := b.src.(io.Seeker)
+	if !ok {
+		return 0, errors.New("tubely: upload source can't be rewound for a retry")
+	}
+	// Wait for the encoder to stop touching src before seeking it
+	b.pr.Close()
+	<-b.done
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	b.reset()
+	return 0, nil
+}
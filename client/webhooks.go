@@ -0,0 +1,80 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebhookSignatureHeader is the header a webhook's signature arrives in
+// from a server with the default APP_NAME: "sha256=" followed by the hex
+// HMAC-SHA256 of the body, keyed with the server's WEBHOOK_SECRET.
+const WebhookSignatureHeader = "X-Tubely-Signature"
+
+// WebhookSignatureHeaderFor returns the signature header of a server
+// whose APP_NAME is appName: X-<AppName>-Signature, with anything but
+// letters, digits and hyphens in appName replaced by a hyphen.
+func WebhookSignatureHeaderFor(appName string) string {
+	name := []byte(appName)
+	for i, c := range name {
+		valid := c == '-' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+		if !valid {
+			name[i] = '-'
+		}
+	}
+	return http.CanonicalHeaderKey("X-" + string(name) + "-Signature")
+}
+
+// Webhook events.
+const (
+	WebhookEventVideoReady  = "video.ready"
+	WebhookEventVideoFailed = "video.failed"
+)
+
+// ErrInvalidWebhookSignature is returned by ParseWebhook when a body
+// wasn't signed with the secret.
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// WebhookEvent is sent when an uploaded video finishes processing. Status
+// is its processing status, ready or failed.
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// VerifyWebhookSignature reports whether signature, the value of
+// WebhookSignatureHeader, was computed over body with secret. Pass the
+// body exactly as received; re-encoded JSON won't verify.
+func VerifyWebhookSignature(body []byte, signature, secret string) bool {
+	hexSum, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(hexSum)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// ParseWebhook verifies a webhook's signature and decodes its body.
+func ParseWebhook(body []byte, signature, secret string) (WebhookEvent, error) {
+	if !VerifyWebhookSignature(body, signature, secret) {
+		return WebhookEvent{}, ErrInvalidWebhookSignature
+	}
+	var event WebhookEvent
+	err := json.Unmarshal(body, &event)
+	return event, err
+}
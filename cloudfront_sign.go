@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// cloudFrontSigner issues CloudFront signed URLs with a canned policy, for
+// distributions that restrict viewer access to trusted key groups.
+type cloudFrontSigner struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+	// expiry is CLOUDFRONT_URL_EXPIRY; zero leaves it to PRESIGN_EXPIRY.
+	expiry time.Duration
+}
+
+// parseCloudFrontSigner reads CLOUDFRONT_KEY_PAIR_ID,
+// CLOUDFRONT_PRIVATE_KEY_PATH and CLOUDFRONT_URL_EXPIRY. It returns nil
+// when no key pair is configured, in which case video URLs go out unsigned.
+func parseCloudFrontSigner(getenv func(string) string) (*cloudFrontSigner, error) {
+	keyPairID := getenv("CLOUDFRONT_KEY_PAIR_ID")
+	keyPath := getenv("CLOUDFRONT_PRIVATE_KEY_PATH")
+	if keyPairID == "" && keyPath == "" {
+		return nil, nil
+	}
+	if keyPairID == "" || keyPath == "" {
+		return nil, errors.New("CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH must be set together")
+	}
+
+	var expiry time.Duration
+	if v := getenv("CLOUDFRONT_URL_EXPIRY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return nil, errors.New("CLOUDFRONT_URL_EXPIRY must be a duration of at least 1m")
+		}
+		expiry = d
+	}
+
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CloudFront private key: %w", err)
+	}
+	key, err := parseRSAPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse CloudFront private key: %w", err)
+	}
+	return &cloudFrontSigner{keyPairID: keyPairID, key: key, expiry: expiry}, nil
+}
+
+// parseRSAPrivateKey accepts PKCS#1 keys, as the CloudFront console
+// generates them, as well as PKCS#8.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key isn't RSA")
+	}
+	return key, nil
+}
+
+// sign returns rawURL with the Expires, Signature and Key-Pair-Id query
+// parameters of a canned policy ending expiry after now. The path is left
+// exactly as given, slashes included, since the signature covers it.
+func (s *cloudFrontSigner) sign(rawURL string, now time.Time, expiry time.Duration) (string, error) {
+	expires := now.Add(expiry).Unix()
+	// CloudFront rebuilds a canned policy from the request, so it has to
+	// be byte-for-byte this statement rather than any equivalent JSON
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, rawURL, expires)
+	digest := sha1.Sum([]byte(policy))
+	signature, err := rsa.SignPKCS1v15(nil, s.key, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("Expires", strconv.FormatInt(expires, 10))
+	query.Set("Signature", cloudFrontBase64(signature))
+	query.Set("Key-Pair-Id", s.keyPairID)
+
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + query.Encode(), nil
+}
+
+// cloudFrontBase64 is base64 with the substitutions CloudFront expects in
+// query strings.
+func cloudFrontBase64(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+// signVideoURL replaces video's URL and rendition URLs with signed ones:
+// local storage references and objects in buckets the distribution
+// doesn't serve always, and distribution URLs when a CloudFront key pair
+// is configured. In those last two cases its HLS URL becomes the playlist
+// endpoint, which signs the segments. Thumbnails in S3 are presigned.
+// Stored rows always keep the unsigned URLs.
+func (cfg *apiConfig) signVideoURL(ctx context.Context, video *database.Video) {
+	cfg.signThumbnailURLs(ctx, video)
+	// Videos in the trash can't be played until they are restored
+	if video.DeletedAt != nil {
+		video.VideoURL = nil
+		video.Renditions = nil
+		video.HLSURL = nil
+		return
+	}
+	if presentURL(video.VideoURL) != nil {
+		if signed, _ := cfg.signStoredURL(ctx, video, *video.VideoURL); signed != "" {
+			video.VideoURL = &signed
+		} else {
+			video.VideoURL = nil
+		}
+	}
+	if len(video.Renditions) > 0 {
+		renditions := make(database.Renditions, len(video.Renditions))
+		for label, u := range video.Renditions {
+			if signed, _ := cfg.signStoredURL(ctx, video, u); signed != "" {
+				renditions[label] = signed
+			}
+		}
+		video.Renditions = renditions
+	}
+	// Segments need signing too, so players get a rewritten playlist
+	if presentURL(video.HLSURL) != nil && (cfg.cloudFrontSigner != nil || viewRestricted(*video) || cfg.outsideDistribution(*video.HLSURL)) {
+		playlist := hlsPlaylistPath(video.ID)
+		video.HLSURL = &playlist
+	}
+}
+
+// signStoredURL signs a stored video URL with whichever scheme its
+// storage needs, returning it with how long it's valid for. Objects under
+// publicKeyPrefix of the distribution's bucket are readable by anyone, so
+// their URLs go out unsigned and don't expire; a zero duration means that.
+// Restricted videos never get a permanent URL: "" means one couldn't be
+// signed.
+func (cfg *apiConfig) signStoredURL(ctx context.Context, video *database.Video, rawURL string) (string, time.Duration) {
+	if isLocalVideoURL(rawURL) {
+		return cfg.signLocalVideoURL(ctx, video, rawURL), cfg.urlExpiry(ctx)
+	}
+	if cfg.outsideDistribution(rawURL) {
+		return cfg.presignStoredURL(ctx, video, rawURL)
+	}
+	if viewRestricted(*video) {
+		return cfg.signRestrictedURL(ctx, video, rawURL)
+	}
+	if cfg.cloudFrontSigner == nil {
+		return rawURL, 0
+	}
+	if key, ok := cfg.s3KeyForVideoURL(rawURL); ok && isPublicKey(key) {
+		return rawURL, 0
+	}
+	signed := cfg.signDistributionURL(ctx, video, rawURL)
+	if signed == rawURL {
+		return rawURL, 0
+	}
+	return signed, cfg.cloudFrontExpiry(ctx)
+}
+
+// signRestrictedURL signs a distribution URL of a password or origin
+// restricted video. Without a CloudFront key pair, or if signing with it
+// fails, the object is presigned from the bucket instead, for at most
+// restrictedURLExpiry; "" means neither worked.
+func (cfg *apiConfig) signRestrictedURL(ctx context.Context, video *database.Video, rawURL string) (string, time.Duration) {
+	if cfg.cloudFrontSigner != nil {
+		if signed := cfg.signDistributionURL(ctx, video, rawURL); signed != rawURL {
+			return signed, cfg.cloudFrontExpiry(ctx)
+		}
+	}
+	store, key, ok := cfg.videoObject(rawURL)
+	if !ok {
+		return "", 0
+	}
+	signed, left, err := cfg.presignObject(ctx, store, key, min(cfg.urlExpiry(ctx), restrictedURLExpiry))
+	if err != nil {
+		log.Printf("couldn't presign %s for restricted video %s: %v", key, video.ID, err)
+		return "", 0
+	}
+	return signed, left
+}
+
+// signDistributionURL signs rawURL if it points at the distribution,
+// returning it unchanged otherwise or if signing fails.
+func (cfg *apiConfig) signDistributionURL(ctx context.Context, video *database.Video, rawURL string) string {
+	if !strings.HasPrefix(rawURL, "https://"+cfg.s3CfDistribution+"/") {
+		return rawURL
+	}
+	signed, err := cfg.cloudFrontSigner.sign(rawURL, time.Now(), cfg.cloudFrontExpiry(ctx))
+	if err != nil {
+		log.Printf("couldn't sign URL for video %s: %v", video.ID, err)
+		return rawURL
+	}
+	return signed
+}
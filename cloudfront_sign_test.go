@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner is a CloudFront signer with a freshly generated key.
+func testSigner(t *testing.T) *cloudFrontSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cloudFrontSigner{keyPairID: "K2JCJMDEHXQW5F", key: key}
+}
+
+// verifyCloudFrontURL checks signed the way CloudFront does: it rebuilds
+// the canned policy from the URL and Expires, and verifies Signature
+// against key. It returns the unsigned URL and when it expires.
+func verifyCloudFrontURL(t *testing.T, key *rsa.PublicKey, keyPairID, signed string) (string, time.Time) {
+	t.Helper()
+	i := strings.LastIndex(signed, "Expires=")
+	if i < 1 {
+		t.Fatalf("%s has no Expires", signed)
+	}
+	rawURL, params := signed[:i-1], signed[i:]
+	var expires int64
+	var signature, gotKeyPairID string
+	for _, param := range strings.Split(params, "&") {
+		name, value, _ := strings.Cut(param, "=")
+		switch name {
+		case "Expires":
+			expires, _ = strconv.ParseInt(value, 10, 64)
+		case "Signature":
+			signature = value
+		case "Key-Pair-Id":
+			gotKeyPairID = value
+		}
+	}
+	if gotKeyPairID != keyPairID {
+		t.Errorf("Key-Pair-Id = %q, want %q", gotKeyPairID, keyPairID)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(signature))
+	if err != nil {
+		t.Fatalf("Signature %q: %v", signature, err)
+	}
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, rawURL, expires)
+	digest := sha1.Sum([]byte(policy))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA1, digest[:], sig); err != nil {
+		t.Errorf("signature of %s doesn't verify: %v", signed, err)
+	}
+	return rawURL, time.Unix(expires, 0)
+}
+
+func TestCloudFrontSign(t *testing.T) {
+	signer := testSigner(t)
+	now := time.Unix(1_700_000_000, 0)
+	tests := []string{
+		"https://" + testCDN + "/landscape/abc.mp4",
+		"https://" + testCDN + "/other/a b+c.mp4",
+		"https://" + testCDN + "/landscape/abc.mp4?response-content-disposition=inline",
+	}
+	for _, rawURL := range tests {
+		signed, err := signer.sign(rawURL, now, 90*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The path goes out exactly as signed, slashes included
+		if !strings.HasPrefix(signed, rawURL) {
+			t.Errorf("signed %s, want it to start with %s", signed, rawURL)
+		}
+		got, expires := verifyCloudFrontURL(t, &signer.key.PublicKey, signer.keyPairID, signed)
+		if got != rawURL {
+			t.Errorf("signed resource %s, want %s", got, rawURL)
+		}
+		if !expires.Equal(now.Add(90 * time.Minute)) {
+			t.Errorf("expires %v, want %v", expires, now.Add(90*time.Minute))
+		}
+	}
+}
+
+func writeKey(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseCloudFrontSigner(t *testing.T) {
+	key := testSigner(t).key
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1Path := writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	notPEM := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(notPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+		expiry  time.Duration
+	}{
+		{"unset", map[string]string{}, false, 0},
+		{"pkcs1", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1", "CLOUDFRONT_PRIVATE_KEY_PATH": pkcs1Path}, false, 0},
+		{"pkcs8", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1", "CLOUDFRONT_PRIVATE_KEY_PATH": writeKey(t, "PRIVATE KEY", pkcs8)}, false, 0},
+		{"expiry", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1", "CLOUDFRONT_PRIVATE_KEY_PATH": pkcs1Path, "CLOUDFRONT_URL_EXPIRY": "30m"}, false, 30 * time.Minute},
+		{"key pair id only", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1"}, true, 0},
+		{"key only", map[string]string{"CLOUDFRONT_PRIVATE_KEY_PATH": pkcs1Path}, true, 0},
+		{"short expiry", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1", "CLOUDFRONT_PRIVATE_KEY_PATH": pkcs1Path, "CLOUDFRONT_URL_EXPIRY": "30s"}, true, 0},
+		{"missing key file", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1", "CLOUDFRONT_PRIVATE_KEY_PATH": filepath.Join(t.TempDir(), "missing.pem")}, true, 0},
+		{"not pem", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1", "CLOUDFRONT_PRIVATE_KEY_PATH": notPEM}, true, 0},
+		{"ecdsa key", map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "K1", "CLOUDFRONT_PRIVATE_KEY_PATH": writeKey(t, "PRIVATE KEY", ecPKCS8)}, true, 0},
+	}
+	for _, tt := range tests {
+		signer, err := parseCloudFrontSigner(func(name string) string { return tt.env[name] })
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr || tt.name == "unset" {
+			if signer != nil {
+				t.Errorf("%s: got a signer", tt.name)
+			}
+			continue
+		}
+		if signer == nil || signer.keyPairID != "K1" || !signer.key.Equal(key) || signer.expiry != tt.expiry {
+			t.Errorf("%s: signer = %+v, want K1 with the test key and expiry %v", tt.name, signer, tt.expiry)
+		}
+	}
+}
+
+func TestVideoURLsSignedWithCloudFront(t *testing.T) {
+	signer := testSigner(t)
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.presignExpiry = 2 * time.Hour
+		cfg.presignMaxExpiry = 3 * time.Hour
+	})
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Signed")
+	stored := env.videoRow(t, video.ID).VideoURL
+
+	// Without a key pair the distribution URL goes out as stored
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if got.VideoURL == nil || *got.VideoURL != *stored {
+		t.Fatalf("video_url = %v, want the unsigned %s", got.VideoURL, *stored)
+	}
+
+	env.cfg.cloudFrontSigner = signer
+	tests := []struct {
+		query  string
+		expiry time.Duration
+	}{
+		{"", 2 * time.Hour},
+		{"?expires=600", 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+tt.query, token, nil, http.StatusOK, &got)
+		if got.VideoURL == nil {
+			t.Fatalf("GET %s: no video_url", tt.query)
+		}
+		rawURL, expires := verifyCloudFrontURL(t, &signer.key.PublicKey, signer.keyPairID, *got.VideoURL)
+		if rawURL != *stored {
+			t.Errorf("GET %s: signed %s, want the stored %s", tt.query, rawURL, *stored)
+		}
+		if left := time.Until(expires); left > tt.expiry || left < tt.expiry-time.Minute {
+			t.Errorf("GET %s: expires in %v, want %v", tt.query, left, tt.expiry)
+		}
+	}
+
+	var list []videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos", token, nil, http.StatusOK, &list)
+	if len(list) != 1 || list[0].VideoURL == nil {
+		t.Fatalf("listed %+v, want the video", list)
+	}
+	verifyCloudFrontURL(t, &signer.key.PublicKey, signer.keyPairID, *list[0].VideoURL)
+
+	// CLOUDFRONT_URL_EXPIRY takes over from PRESIGN_EXPIRY
+	signer.expiry = 30 * time.Minute
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if _, expires := verifyCloudFrontURL(t, &signer.key.PublicKey, signer.keyPairID, *got.VideoURL); time.Until(expires) > 30*time.Minute {
+		t.Errorf("expires in %v, want CLOUDFRONT_URL_EXPIRY's 30m", time.Until(expires))
+	}
+
+	if row := env.videoRow(t, video.ID); *row.VideoURL != *stored {
+		t.Errorf("stored video_url = %s, want it left unsigned", *row.VideoURL)
+	}
+}
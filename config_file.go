@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configKeys are the settings a -config file may set, named by the
+// environment variable they stand in for. Keys are written lowercase in the
+// file, e.g. s3_bucket.
+var configKeys = []string{
+	"ACCESS_EVENT_RETENTION_HOURS",
+	"ADMIN_TOKEN",
+	"APP_NAME",
+	"ASSETS_PATH",
+	"ASSETS_ROOT",
+	"CLAMD_ADDR",
+	"CLOUDFRONT_KEY_PAIR_ID",
+	"CLOUDFRONT_PRIVATE_KEY_PATH",
+	"CLOUDFRONT_URL_EXPIRY",
+	"DB_PATH",
+	"DEV_UI",
+	"DOWNLOAD_GLOBAL_RATE_LIMIT_KBPS",
+	"DOWNLOAD_RATE_LIMIT_KBPS",
+	"ENABLE_HLS",
+	"ENABLE_TRANSCODE",
+	"FASTSTART_FAILURE_POLICY",
+	"FFMPEG_TIMEOUT",
+	"FFPROBE_TIMEOUT",
+	"FILEPATH_ROOT",
+	"JWT_SECRET",
+	"LOG_FFMPEG_INVOCATIONS",
+	"LOG_LEVEL",
+	"MAX_VIDEO_BITRATE",
+	"MAX_VIDEO_DURATION",
+	"MAX_VIDEOS_COUNT_DRAFTS",
+	"MAX_VIDEOS_PER_USER",
+	"PLATFORM",
+	"PORT",
+	"PRESIGN_EXPIRY",
+	"PRESIGN_MAX_EXPIRY",
+	"PROCESSING_DRAIN_TIMEOUT",
+	"PROCESSING_RUN_RETENTION_DAYS",
+	"S3_ARTIFACTS_BUCKET",
+	"S3_BUCKET",
+	"S3_CF_DISTRO",
+	"S3_KMS_KEY_ID",
+	"S3_MAX_PART_SIZE_MB",
+	"S3_MAX_UPLOAD_CONCURRENCY",
+	"S3_REGION",
+	"S3_SSE",
+	"S3_UPLOAD_PART_ATTEMPTS",
+	"S3_TAG_OBJECTS",
+	"S3_THUMBNAIL_BUCKET",
+	"SCANNER",
+	"SCANNER_FAIL_OPEN",
+	"SCANNER_MAX_MB",
+	"SHUTDOWN_TIMEOUT",
+	"STORAGE_BACKEND",
+	"THUMBNAIL_FORMATS",
+	"THUMBNAIL_JPEG_QUALITY",
+	"THUMBNAIL_MAX_DIMENSION",
+	"THUMBNAIL_MAX_WIDTH",
+	"THUMBNAIL_PNG_COMPRESSION",
+	"THUMBNAIL_PRESERVE_ORIGINAL",
+	"UPLOAD_MAX_ACTIVE",
+	"UPLOAD_MAX_PROCESSING",
+	"UPLOAD_MAX_SESSIONS_PER_USER",
+	"UPLOAD_MIN_TEMP_FREE_MB",
+	"UPLOAD_SESSION_TTL",
+	"VIDEO_PROCESSING_BACKLOG",
+	"VIDEO_PROCESSING_WORKERS",
+}
+
+// configKeyPrefixes allow families of settings such as CACHE_CONTROL_ASSETS.
+var configKeyPrefixes = []string{"CACHE_CONTROL_"}
+
+// Sources reported for each setting.
+const (
+	configSourceEnv     = "env"
+	configSourceFile    = "file"
+	configSourceDefault = "default"
+)
+
+var configInterpolation = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// applyConfigFile loads the YAML or TOML file at path (chosen by extension)
+// and exports each value as its environment variable unless that variable
+// is already set, so the environment always wins and the rest of startup
+// only has to read the environment. Values may reference other variables as
+// ${NAME}. Unknown keys are warned about and ignored. It returns where each
+// setting came from; an empty path just reports the environment.
+func applyConfigFile(path string) (map[string]string, error) {
+	sources := map[string]string{}
+	for _, key := range configKeys {
+		if _, ok := os.LookupEnv(key); ok {
+			sources[key] = configSourceEnv
+		} else {
+			sources[key] = configSourceDefault
+		}
+	}
+	if path == "" {
+		return sources, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(data)
+	case ".toml":
+		values, err = parseTOMLConfig(data)
+	default:
+		return nil, fmt.Errorf("%s: config file must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ToUpper(key)
+		if !isConfigKey(name) {
+			log.Printf("WARNING: %s: ignoring unknown setting %q", path, key)
+			continue
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			sources[name] = configSourceEnv
+			continue
+		}
+		value := configInterpolation.ReplaceAllStringFunc(values[key], func(ref string) string {
+			return os.Getenv(configInterpolation.FindStringSubmatch(ref)[1])
+		})
+		if err := os.Setenv(name, value); err != nil {
+			return nil, err
+		}
+		sources[name] = configSourceFile
+	}
+	return sources, nil
+}
+
+func isConfigKey(name string) bool {
+	for _, key := range configKeys {
+		if name == key {
+			return true
+		}
+	}
+	for _, prefix := range configKeyPrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseYAMLConfig reads a flat mapping of scalar values.
+func parseYAMLConfig(data []byte) (map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	if len(doc.Content) == 0 {
+		return values, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of settings", root.Line)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: %s must be a string, number or boolean", value.Line, key.Value)
+		}
+		if value.Tag == "!!null" {
+			continue
+		}
+		values[key.Value] = value.Value
+	}
+	return values, nil
+}
+
+// parseTOMLConfig reads top-level scalar values.
+func parseTOMLConfig(data []byte) (map[string]string, error) {
+	var raw map[string]any
+	if _, err := toml.Decode(string(data), &raw); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("line %d: %s", parseErr.Position.Line, parseErr.Message)
+		}
+		return nil, err
+	}
+	values := map[string]string{}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case int64:
+			values[key] = strconv.FormatInt(v, 10)
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("%s must be a string, number or boolean", key)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unsetEnv clears names for the test and restores them afterwards, so
+// values applyConfigFile exports don't leak into other tests.
+func unsetEnv(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		// t.Setenv registers the restore; the variable must then be
+		// absent, not empty, for the file to apply
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+// writeConfig writes content to a config file named name.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	tests := map[string]string{
+		"tubely.yaml": `
+s3_bucket: from-file
+port: 8091
+enable_transcode: true
+cache_control_assets: no-store
+s3_cf_distro: ${TEST_CONFIG_CDN}.example.com
+s3_region: from-file
+platform: ~
+not_a_setting: ignored
+`,
+		"tubely.toml": `
+s3_bucket = "from-file"
+port = 8091
+enable_transcode = true
+cache_control_assets = "no-store"
+s3_cf_distro = "${TEST_CONFIG_CDN}.example.com"
+s3_region = "from-file"
+not_a_setting = "ignored"
+`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			unsetEnv(t, "S3_BUCKET", "PORT", "ENABLE_TRANSCODE", "CACHE_CONTROL_ASSETS", "S3_CF_DISTRO", "PLATFORM", "NOT_A_SETTING", "ADMIN_TOKEN")
+			t.Setenv("S3_REGION", "from-env")
+			t.Setenv("TEST_CONFIG_CDN", "cdn")
+
+			sources, err := applyConfigFile(writeConfig(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{
+				"S3_BUCKET":            "from-file",
+				"PORT":                 "8091",
+				"ENABLE_TRANSCODE":     "true",
+				"CACHE_CONTROL_ASSETS": "no-store",
+				"S3_CF_DISTRO":         "cdn.example.com",
+				"S3_REGION":            "from-env",
+			}
+			for key, value := range want {
+				if got := os.Getenv(key); got != value {
+					t.Errorf("%s = %q, want %q", key, got, value)
+				}
+			}
+			if _, ok := os.LookupEnv("NOT_A_SETTING"); ok {
+				t.Error("an unknown key was exported")
+			}
+			if _, ok := os.LookupEnv("PLATFORM"); ok {
+				t.Error("a null value was exported")
+			}
+			for key, source := range map[string]string{
+				"S3_BUCKET":   configSourceFile,
+				"S3_REGION":   configSourceEnv,
+				"ADMIN_TOKEN": configSourceDefault,
+			} {
+				if sources[key] != source {
+					t.Errorf("%s came from %q, want %q", key, sources[key], source)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileEnvironmentWins(t *testing.T) {
+	unsetEnv(t, "PORT")
+	t.Setenv("S3_BUCKET", "from-env")
+	path := writeConfig(t, "tubely.yaml", "s3_bucket: from-file\nport: 8092\n")
+
+	sources, err := applyConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("S3_BUCKET"); got != "from-env" || sources["S3_BUCKET"] != configSourceEnv {
+		t.Errorf("S3_BUCKET = %q from %s, want the environment's", got, sources["S3_BUCKET"])
+	}
+	if got := os.Getenv("PORT"); got != "8092" || sources["PORT"] != configSourceFile {
+		t.Errorf("PORT = %q from %s, want the file's", got, sources["PORT"])
+	}
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"tubely.json", `{"port": 8091}`, "must be .yaml, .yml or .toml"},
+		{"list.yaml", "- port\n- 8091\n", "expected a mapping"},
+		{"nested.yaml", "s3:\n  bucket: videos\n", "must be a string, number or boolean"},
+		{"broken.toml", "port = \n", "line 1"},
+		{"nested.toml", "[s3]\nbucket = \"videos\"\n", "must be a string, number or boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := applyConfigFile(writeConfig(t, tt.name, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := applyConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("a missing file wasn't an error")
+	}
+	sources, err := applyConfigFile("")
+	if err != nil || len(sources) != len(configKeys) {
+		t.Errorf("without a file: %d sources, %v; want one per key", len(sources), err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+)
+
+// declaredLength returns the Content-Length a multipart part declares, or
+// -1 when it declares none, as with most browsers and chunked uploads.
+func declaredLength(h textproto.MIMEHeader) (int64, error) {
+	v := h.Get("Content-Length")
+	if v == "" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid part Content-Length %q", v)
+	}
+	return n, nil
+}
+
+// respondWithLengthMismatch rejects a transfer whose size differs from the
+// length the client declared, reporting both.
+func respondWithLengthMismatch(w http.ResponseWriter, declared, received int64) {
+	respondWithErrorDetails(w, http.StatusBadRequest, errorCodeLengthMismatch, "Received size doesn't match the declared Content-Length", nil, map[string]any{
+		"declared_bytes": declared,
+		"received_bytes": received,
+	})
+}
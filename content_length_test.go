@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"testing"
+)
+
+func TestDeclaredLength(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"", -1, false},
+		{"0", 0, false},
+		{"1048576", 1 << 20, false},
+		{"-1", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		h := textproto.MIMEHeader{}
+		if tt.value != "" {
+			h.Set("Content-Length", tt.value)
+		}
+		got, err := declaredLength(h)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("declaredLength(%q) = %d, %v; want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// uploadDeclaring uploads data as videoID's video with a part that
+// declares length, or no length when it is negative.
+func (env *testEnv) uploadDeclaring(t *testing.T, token, videoID string, data []byte, length int64) (*http.Response, []byte) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	if length >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+	return env.do(t, http.MethodPost, "/api/video_upload/"+videoID, token, mw.FormDataContentType(), &body)
+}
+
+func TestUploadDeclaredLength(t *testing.T) {
+	data := testVideoBytes(4096)
+	tests := []struct {
+		name     string
+		declared int64
+		want     int
+	}{
+		{"matching", int64(len(data)), http.StatusAccepted},
+		{"undeclared", -1, http.StatusAccepted},
+		{"body shorter than declared", int64(len(data)) + 10, http.StatusBadRequest},
+		{"body longer than declared", int64(len(data)) - 10, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			_, token := env.createUser(t)
+			video := env.createVideo(t, token, tt.name)
+
+			resp, body := env.uploadDeclaring(t, token, video.ID, data, tt.declared)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %d: %s, want %d", resp.StatusCode, body, tt.want)
+			}
+			if tt.want == http.StatusAccepted {
+				env.waitForProcessing(t, token, video.ID)
+				return
+			}
+			var mismatch struct {
+				Error struct {
+					Code          string `json:"code"`
+					DeclaredBytes int64  `json:"declared_bytes"`
+					ReceivedBytes int64  `json:"received_bytes"`
+				} `json:"error"`
+			}
+			decodeJSON(t, body, &mismatch)
+			got := mismatch.Error
+			if got.Code != errorCodeLengthMismatch || got.DeclaredBytes != tt.declared || got.ReceivedBytes != int64(len(data)) {
+				t.Errorf("error = %+v, want %s declaring %d and receiving %d", got, errorCodeLengthMismatch, tt.declared, len(data))
+			}
+			if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+				t.Errorf("mismatched upload was stored: %v", keys)
+			}
+		})
+	}
+}
+
+func TestUploadDeclaredLengthPreflight(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.maxVideoUploadBytes = 1 << 20
+		cfg.admission.freeSpace = func(string) (int64, error) { return 8 << 10, nil }
+	})
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Preflight")
+	data := testVideoBytes(1024)
+
+	// The declared size is trusted up front; no bytes need to arrive
+	resp, body := env.uploadDeclaring(t, token, video.ID, data, 2<<20)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared past the upload limit: got %d: %s, want 413", resp.StatusCode, body)
+	}
+	resp, body = env.uploadDeclaring(t, token, video.ID, data, 16<<10)
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("declared past the free temp space: got %d: %s, want 507", resp.StatusCode, body)
+	}
+}
+
+func TestUploadSessionChunkedBodyLength(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Chunked transfer")
+	data := testVideoBytes(minUploadChunkSize * 2)
+
+	resp, body := env.openSession(t, token, video.ID, int64(len(data)), "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", resp.StatusCode, body)
+	}
+	var session uploadSessionResponse
+	decodeJSON(t, body, &session)
+
+	// Hiding the reader's length makes the client send the body chunked,
+	// so it's only checked as it arrives
+	chunked := func(b []byte) io.Reader { return io.MultiReader(bytes.NewReader(b)) }
+	path := fmt.Sprintf("/api/uploads/%s/chunks/0", session.ID)
+	long := append(append([]byte{}, data[:session.ChunkSize]...), "extra"...)
+	resp, body = env.do(t, http.MethodPut, path, token, "application/octet-stream", chunked(long))
+	if resp.StatusCode != http.StatusBadRequest || errorCode(t, body) != errorCodeLengthMismatch {
+		t.Errorf("long chunked body: got %d: %s, want %s", resp.StatusCode, body, errorCodeLengthMismatch)
+	}
+	resp, body = env.do(t, http.MethodPut, path, token, "application/octet-stream", chunked(data[:session.ChunkSize-1]))
+	if resp.StatusCode != http.StatusBadRequest || errorCode(t, body) != errorCodeLengthMismatch {
+		t.Errorf("short chunked body: got %d: %s, want %s", resp.StatusCode, body, errorCodeLengthMismatch)
+	}
+	resp, body = env.do(t, http.MethodPut, path, token, "application/octet-stream", chunked(data[:session.ChunkSize]))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("exact chunked body: got %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	pngenc "image/png"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"testing"
+)
+
+// jpegBytes is a small JPEG image.
+func jpegBytes(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, solidImage(16, 9, color.White), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadFile posts data as the form's field file, labeled contentType.
+func (env *testEnv) uploadFile(t *testing.T, path, token, field, filename, contentType string, data []byte) (*http.Response, []byte) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, filename))
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+	return env.do(t, http.MethodPost, path, token, mw.FormDataContentType(), &body)
+}
+
+func TestUploadVideoSniffsContent(t *testing.T) {
+	mp4 := mp4File(mp4Box{"ftyp", 8, false}, mp4Box{"moov", 64, false}, mp4Box{"mdat", 1024, false})
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"mp4", mp4, http.StatusAccepted},
+		{"jpeg labeled as mp4", jpegBytes(t), http.StatusBadRequest},
+		{"truncated mp4", mp4[:10], http.StatusBadRequest},
+		{"php labeled as mp4", []byte("<?php system($_GET['c']); ?>"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Uploads are received into TMPDIR, which must be left empty
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+			env := newTestEnv(t)
+			_, token := env.createUser(t)
+			video := env.createVideo(t, token, tt.name)
+
+			resp, body := env.uploadFile(t, "/api/video_upload/"+video.ID, token, "video", "video.mp4", "video/mp4", tt.data)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %d: %s, want %d", resp.StatusCode, body, tt.want)
+			}
+			if tt.want == http.StatusAccepted {
+				env.waitForProcessing(t, token, video.ID)
+				return
+			}
+			if code := errorCode(t, body); code != errorCodeInvalidMediaType {
+				t.Errorf("error code %q, want %q", code, errorCodeInvalidMediaType)
+			}
+			if !bytes.Contains(body, []byte("isn't an MP4 video")) {
+				t.Errorf("body %s, want a clear message", body)
+			}
+			if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+				t.Errorf("rejected upload was stored: %v", keys)
+			}
+			if left, _ := os.ReadDir(tmp); len(left) != 0 {
+				t.Errorf("temp files left behind: %v", left)
+			}
+		})
+	}
+}
+
+func TestUploadThumbnailSniffsContent(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Thumbnail sniffing")
+	path := "/api/thumbnail_upload/" + video.ID
+	var png bytes.Buffer
+	if err := pngenc.Encode(&png, solidImage(16, 9, color.White)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, filename, contentType string
+		data                        []byte
+		want                        int
+	}{
+		{"jpeg", "still.jpg", "image/jpeg", jpegBytes(t), http.StatusOK},
+		{"php renamed to jpg", "shell.jpg", "image/jpeg", []byte("<?php system($_GET['c']); ?>"), http.StatusUnsupportedMediaType},
+		{"png labeled as jpeg", "still.jpg", "image/jpeg", png.Bytes(), http.StatusUnsupportedMediaType},
+		{"mp4 labeled as jpeg", "still.jpg", "image/jpeg", testVideoBytes(1024), http.StatusUnsupportedMediaType},
+		{"unsupported type", "still.gif", "image/gif", []byte("GIF89a"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, body := env.uploadFile(t, path, token, "thumbnail", tt.filename, tt.contentType, tt.data)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d: %s, want %d", tt.name, resp.StatusCode, body, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK && errorCode(t, body) != errorCodeInvalidMediaType {
+			t.Errorf("%s: error code %q, want %q", tt.name, errorCode(t, body), errorCodeInvalidMediaType)
+		}
+	}
+}
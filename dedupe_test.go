@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	pngpkg "image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// keysWithPrefix returns the keys in the test bucket starting with prefix.
+func (env *testEnv) keysWithPrefix(prefix string) []string {
+	var keys []string
+	for _, key := range env.s3.Keys(testBucket) {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestSameContentStoredOnce(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	first := env.createVideo(t, token, "First copy")
+	second := env.createVideo(t, token, "Second copy")
+
+	data := testVideoBytes(64 << 10)
+	var thumbnail bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 32, 18))
+	img.Set(3, 3, color.RGBA{R: 255, A: 255})
+	if err := pngpkg.Encode(&thumbnail, img); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []database.Video
+	for _, video := range []videoResponse{first, second} {
+		resp, body := env.uploadVideo(t, token, video.ID, data)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("video upload: got %d: %s", resp.StatusCode, body)
+		}
+		if status := env.waitForProcessing(t, token, video.ID); status.ProcessingError != nil {
+			t.Fatalf("processing failed: %s", *status.ProcessingError)
+		}
+		env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, map[string]string{
+			"content_type": "image/png",
+			"data_base64":  base64.StdEncoding.EncodeToString(thumbnail.Bytes()),
+		}, http.StatusOK, nil)
+
+		row, err := env.cfg.db.GetVideo(mustParseUUID(t, video.ID), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	if rows[0].VideoURL == nil || rows[1].VideoURL == nil || *rows[0].VideoURL != *rows[1].VideoURL {
+		t.Fatalf("video URLs differ: %v and %v", rows[0].VideoURL, rows[1].VideoURL)
+	}
+	if rows[0].ThumbnailURL == nil || rows[1].ThumbnailURL == nil || *rows[0].ThumbnailURL != *rows[1].ThumbnailURL {
+		t.Fatalf("thumbnail URLs differ: %v and %v", rows[0].ThumbnailURL, rows[1].ThumbnailURL)
+	}
+	if keys := env.keysWithPrefix("other/"); len(keys) != 1 {
+		t.Errorf("video objects = %v, want one", keys)
+	}
+	if keys := env.keysWithPrefix(thumbnailKeyPrefix); len(keys) != 1 {
+		t.Errorf("thumbnail objects = %v, want one", keys)
+	}
+
+	// Purging one video leaves the shared objects to the other
+	ctx := context.Background()
+	if err := env.cfg.deleteVideo(ctx, rows[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.keysWithPrefix("other/")) != 1 || len(env.keysWithPrefix(thumbnailKeyPrefix)) != 1 {
+		t.Fatalf("shared objects were deleted with the first video: %v", env.s3.Keys(testBucket))
+	}
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+second.ID, token, nil, http.StatusOK, &got)
+	if got.VideoURL == nil {
+		t.Error("second video lost its URL")
+	}
+
+	// The last reference takes them with it
+	if err := env.cfg.deleteVideo(ctx, rows[1]); err != nil {
+		t.Fatal(err)
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("objects left after both videos were deleted: %v", keys)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed devui/upload.html
+var devUploadPage []byte
+
+// handlerDevUpload serves a static page for exercising the upload
+// endpoints by hand. It is only routed when DEV_UI=true.
+func handlerDevUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(devUploadPage)
+}
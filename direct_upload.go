@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// directUploadURLExpiry is how long a presigned upload URL can be used.
+const directUploadURLExpiry = time.Hour
+
+// directUploadRetention is how long after its URL expires an uncompleted
+// direct upload is kept before the janitor deletes it. S3 only checks the
+// expiry when a PUT starts, so a slow upload can land well after it.
+const directUploadRetention = 24 * time.Hour
+
+type directUploadURLResponse struct {
+	Key       string            `json:"key"`
+	UploadURL string            `json:"upload_url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt string            `json:"expires_at"`
+}
+
+// handlerDirectUploadURL hands out a presigned PUT URL for a new object the
+// video's content can be uploaded to, bypassing the server. The declared
+// size and video/mp4 content type are part of the signature, so S3 rejects
+// any other body. The client calls upload-complete once the PUT succeeds.
+func (cfg *apiConfig) handlerDirectUploadURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		SizeBytes int64 `json:"size_bytes"`
+	}
+
+	if !cfg.directUploadsSupported(w) {
+		return
+	}
+	video, identity, ok := cfg.ownedVideoIdentity(w, r)
+	if !ok || !checkOverwriteAllowed(w, identity, presentURL(video.VideoURL) != nil) {
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.SizeBytes <= 0 {
+		respondWithError(w, http.StatusBadRequest, "size_bytes must be positive", nil)
+		return
+	}
+	if params.SizeBytes > cfg.maxVideoUploadBytes {
+		respondWithUploadTooLarge(w, "Video is too large", cfg.maxVideoUploadBytes, nil)
+		return
+	}
+
+	// Drafts that don't count toward the limit are counted once they gain content
+	if !cfg.countDraftsTowardLimit && video.VideoURL == nil {
+		count, exceeded, err := cfg.videoLimitExceeded(video.UserID, true)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+			return
+		}
+		if exceeded {
+			respondWithVideoLimit(w, count, cfg.maxVideosPerUser)
+			return
+		}
+	}
+
+	var rnd [32]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate random filename", err)
+		return
+	}
+	key := visibilityKey(fmt.Sprintf("direct/%s/%x.mp4", video.ID, rnd), publiclyStored(video))
+	contentType := "video/mp4"
+
+	var uploadURL string
+	var headers http.Header
+	err := timed(r.Context(), opS3Presign, func() (err error) {
+		opts := storage.PutOptions{ContentType: contentType, Tags: cfg.objectTags(withObjectTags(r.Context(), video.UserID, video.ID))}
+		uploadURL, headers, err = cfg.s3Storage.PresignPut(r.Context(), key, params.SizeBytes, opts, directUploadURLExpiry)
+		return err
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errorCodeSigningFailed, "Couldn't presign upload URL", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	upload := database.DirectUpload{
+		Key:       key,
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		SizeBytes: params.SizeBytes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(directUploadURLExpiry),
+	}
+	if err := cfg.db.CreateDirectUpload(upload); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record direct upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, directUploadURLResponse{
+		Key:       key,
+		UploadURL: uploadURL,
+		Method:    http.MethodPut,
+		Headers:   signedHeaders(headers),
+		ExpiresAt: apiTime(upload.ExpiresAt),
+	})
+}
+
+// signedHeaders flattens the headers a presigned request was signed with
+// for the client to send back.
+func signedHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string, len(h))
+	for name, values := range h {
+		headers[name] = strings.Join(values, ",")
+	}
+	return headers
+}
+
+// handlerDirectUploadComplete checks the object a direct upload sent to S3
+// and makes it the video's content. The object must exist with the
+// declared size and type, start like an MP4 and pass the malware scan and
+// media limits; otherwise it is deleted. Nothing is transcoded or
+// packaged, since the server never holds the file.
+func (cfg *apiConfig) handlerDirectUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	if !cfg.directUploadsSupported(w) {
+		return
+	}
+	video, identity, ok := cfg.ownedVideoIdentity(w, r)
+	if !ok || !checkOverwriteAllowed(w, identity, presentURL(video.VideoURL) != nil) {
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	upload, err := cfg.db.GetDirectUpload(params.Key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve direct upload", err)
+		return
+	}
+	if upload.Key == "" || upload.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Direct upload not found", nil)
+		return
+	}
+
+	ctx := r.Context()
+	head, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &cfg.s3Bucket, Key: &upload.Key})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			respondWithError(w, http.StatusConflict, "Video hasn't been uploaded yet", nil)
+			return
+		}
+		respondWithError(w, http.StatusBadGateway, "Couldn't check uploaded video", err)
+		return
+	}
+	if aws.ToInt64(head.ContentLength) != upload.SizeBytes || aws.ToString(head.ContentType) != "video/mp4" {
+		cfg.discardDirectUpload(ctx, upload)
+		respondWithError(w, http.StatusBadRequest, "Uploaded object doesn't match the upload URL", nil)
+		return
+	}
+
+	object := &s3ObjectReader{ctx: ctx, client: cfg.s3Client, bucket: cfg.s3Bucket, key: upload.Key, size: upload.SizeBytes}
+	if err := checkFtypBox(object); err != nil {
+		if errors.Is(err, errNotMP4) {
+			cfg.discardDirectUpload(ctx, upload)
+			respondWithErrorCode(w, http.StatusBadRequest, errorCodeInvalidMediaType, "Uploaded file isn't an MP4 video", err)
+			return
+		}
+		respondWithError(w, http.StatusBadGateway, "Couldn't read uploaded video", err)
+		return
+	}
+	fastStart, err := isFastStartMP4(object)
+	if err != nil {
+		cfg.discardDirectUpload(ctx, upload)
+		respondWithErrorCode(w, http.StatusBadRequest, errorCodeInvalidMediaType, "Uploaded file isn't an MP4 video", err)
+		return
+	}
+	if err := cfg.scanDirectUpload(ctx, upload); err != nil {
+		// Only a verdict condemns the upload; the client can retry after
+		// an outage
+		var se *statusError
+		if errors.As(err, &se) && se.code == errorCodeMalwareDetected {
+			cfg.discardDirectUpload(ctx, upload)
+		}
+		respondWithStatusError(w, err)
+		return
+	}
+
+	// ffprobe reads only the ranges it needs through a presigned URL
+	var presigned *v4.PresignedHTTPRequest
+	err = timed(ctx, opS3Presign, func() (err error) {
+		presigned, err = cfg.s3Storage.Presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &upload.Key,
+		}, s3.WithPresignExpires(15*time.Minute))
+		return err
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errorCodeSigningFailed, "Couldn't presign video URL", err)
+		return
+	}
+	probe, probeErr := getVideoMetadata(ctx, presigned.URL)
+	if err := cfg.checkMediaLimits(probe, probeErr); err != nil {
+		cfg.discardDirectUpload(ctx, upload)
+		respondWithStatusError(w, err)
+		return
+	}
+
+	replaced := append([]*string{video.VideoURL}, renditionURLs(video.Renditions)...)
+	replacedHLS := video.HLSURL
+	publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, upload.Key)
+	contentType := "video/mp4"
+	branch := processingBranchDirect
+	if !fastStart {
+		branch = processingBranchOriginal
+	}
+	ready := database.ProcessingStatusReady
+	video.VideoURL = &publicURL
+	video.Renditions = nil
+	video.HLSURL = nil
+	video.ChecksumSHA256 = nil
+	video.Status = database.VideoStatusReady
+	video.ProcessingStatus = &ready
+	video.ProcessingError = nil
+	video.ContentType = &contentType
+	video.UploadMetadata = uploadMetadataFromRequest(r, contentType)
+	video.ProcessingWarnings = nil
+	video.ProcessingBranch = &branch
+	video.SizeBytes = &upload.SizeBytes
+	video.DurationSeconds = nil
+	if probeErr == nil && probe.Duration > 0 {
+		video.DurationSeconds = &probe.Duration
+	}
+
+	// The video's visibility may have changed since the URL was issued
+	moved, cleanupMoved, err := cfg.moveVideoObjects(ctx, &video)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't move uploaded video", err)
+		return
+	}
+
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		cleanupMoved()
+		respondWithError(w, http.StatusInternalServerError, "Failed to update video URL", err)
+		return
+	}
+	video.Version++
+	if err := cfg.db.DeleteDirectUpload(upload.Key); err != nil {
+		log.Printf("couldn't delete direct upload record %s: %v", upload.Key, err)
+	}
+	// The row no longer points at the previous objects
+	cfg.deleteReplacedVideo(ctx, append(replaced, moved...)...)
+	cfg.deleteReplacedHLS(ctx, replacedHLS)
+	cfg.notifyVideoProcessed(ctx, video, database.ProcessingStatusReady)
+
+	cfg.auditImpersonation(r, identity, video.ID)
+	cfg.signThumbnailURLs(ctx, &video)
+	respondWithJSON(w, http.StatusOK, newOwnerVideoResponse(video))
+}
+
+// scanDirectUpload streams a direct upload back from S3 through the
+// scanner, since it never passed through the server. Without a scanner
+// configured nothing is read.
+func (cfg *apiConfig) scanDirectUpload(ctx context.Context, upload database.DirectUpload) error {
+	if _, ok := cfg.scanner.(noopScanner); ok {
+		return nil
+	}
+	length := int64(-1)
+	if cfg.scanMaxBytes > 0 {
+		length = min(cfg.scanMaxBytes, upload.SizeBytes)
+	}
+	body, err := cfg.s3Storage.Get(ctx, upload.Key, 0, length)
+	if err != nil {
+		return &statusError{status: http.StatusBadGateway, msg: "Couldn't read uploaded video", err: err}
+	}
+	defer body.Close()
+	return cfg.scanUpload(ctx, body)
+}
+
+// directUploadsSupported responds with 501 unless videos are stored in S3,
+// the only backend clients can upload to directly.
+func (cfg *apiConfig) directUploadsSupported(w http.ResponseWriter) bool {
+	if cfg.videoStorage.Name() == storageBackendS3 {
+		return true
+	}
+	respondWithError(w, http.StatusNotImplemented, "Direct uploads need the s3 storage backend", nil)
+	return false
+}
+
+// discardDirectUpload deletes a direct upload that was rejected, object
+// and record. Failures are logged; the janitor retries them later.
+func (cfg *apiConfig) discardDirectUpload(ctx context.Context, upload database.DirectUpload) {
+	if err := cfg.s3Storage.Delete(ctx, upload.Key); err != nil {
+		log.Printf("couldn't delete rejected direct upload %s: %v", upload.Key, err)
+		return
+	}
+	if err := cfg.db.DeleteDirectUpload(upload.Key); err != nil {
+		log.Printf("couldn't delete direct upload record %s: %v", upload.Key, err)
+	}
+}
+
+// pruneDirectUploads deletes direct uploads that were never completed,
+// along with whatever reached S3. It is a janitor task, so cutoff is
+// compared to the URL expiry.
+func (cfg *apiConfig) pruneDirectUploads(ctx context.Context, cutoff time.Time) (int64, error) {
+	uploads, err := cfg.db.GetDirectUploadsExpiredBefore(cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, upload := range uploads {
+		if err := cfg.s3Storage.Delete(ctx, upload.Key); err != nil {
+			return n, err
+		}
+		if err := cfg.db.DeleteDirectUpload(upload.Key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// s3ObjectReader reads an object with ranged GETs, for inspecting a few
+// boxes of a stored MP4 without downloading it.
+type s3ObjectReader struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	key    string
+	size   int64
+}
+
+func (o *s3ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), o.size-off)
+	rng := fmt.Sprintf("bytes=%d-%d", off, off+want-1)
+	out, err := o.client.GetObject(o.ctx, &s3.GetObjectInput{Bucket: &o.bucket, Key: &o.key, Range: &rng})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+	n, err := io.ReadFull(out.Body, p[:want])
+	if err != nil {
+		return n, err
+	}
+	if want < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
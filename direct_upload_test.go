@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+// directUpload asks for an upload URL for size bytes.
+func (env *testEnv) directUpload(t *testing.T, token, videoID string, size int) directUploadURLResponse {
+	t.Helper()
+	var target directUploadURLResponse
+	env.doJSON(t, http.MethodPost, "/api/videos/"+videoID+"/upload-url", token, map[string]int{"size_bytes": size}, http.StatusCreated, &target)
+	return target
+}
+
+// putPresigned PUTs data to a presigned upload URL as a browser would,
+// with the signed headers, overridden by extra name/value pairs.
+func putPresigned(t *testing.T, target directUploadURLResponse, data []byte, extra ...string) int {
+	t.Helper()
+	req, err := http.NewRequest(target.Method, target.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		req.Header.Set(extra[i], extra[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDirectUploadURLConstraints(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Direct")
+	path := "/api/videos/" + video.ID + "/upload-url"
+
+	for _, tt := range []struct {
+		size int64
+		want int
+	}{
+		{0, http.StatusBadRequest},
+		{-1, http.StatusBadRequest},
+		{env.cfg.maxVideoUploadBytes + 1, http.StatusRequestEntityTooLarge},
+	} {
+		resp, body := env.do(t, http.MethodPost, path, token, "application/json", jsonBody(t, map[string]int64{"size_bytes": tt.size}))
+		if resp.StatusCode != tt.want {
+			t.Errorf("size %d: got %d, want %d: %s", tt.size, resp.StatusCode, tt.want, body)
+		}
+	}
+
+	_, otherToken := env.createUser(t)
+	resp, _ := env.do(t, http.MethodPost, path, otherToken, "application/json", jsonBody(t, map[string]int{"size_bytes": 1024}))
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusNotFound {
+		t.Errorf("another user's video: got %d, want 403 or 404", resp.StatusCode)
+	}
+
+	data := testVideoBytes(4096)
+	target := env.directUpload(t, token, video.ID, len(data))
+	if target.Method != http.MethodPut || !strings.HasPrefix(target.Key, "direct/"+video.ID+"/") {
+		t.Errorf("got %s to key %s, want a PUT under direct/%s/", target.Method, target.Key, video.ID)
+	}
+	if got := target.Headers["Content-Type"]; got != "video/mp4" {
+		t.Errorf("signed Content-Type = %q, want video/mp4", got)
+	}
+
+	// The type and size are signed, so S3 refuses anything else
+	if status := putPresigned(t, target, data, "Content-Type", "text/html"); status != http.StatusForbidden {
+		t.Errorf("PUT with another content type: got %d, want 403", status)
+	}
+	if status := putPresigned(t, target, data[:100], "Content-Length", "100"); status != http.StatusForbidden {
+		t.Errorf("PUT with another size: got %d, want 403", status)
+	}
+	if status := putPresigned(t, target, data); status != http.StatusOK {
+		t.Errorf("PUT as signed: got %d, want 200", status)
+	}
+}
+
+func TestDirectUploadComplete(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.scanner = eicarScanner{}
+	})
+	_, token := env.createUser(t)
+	complete := func(videoID, key string) (*http.Response, []byte) {
+		return env.do(t, http.MethodPost, "/api/videos/"+videoID+"/upload-complete", token, "application/json", jsonBody(t, map[string]string{"key": key}))
+	}
+	data := testVideoBytes(4096)
+
+	tests := []struct {
+		name     string
+		object   []byte // stored at the key; nil leaves it missing
+		want     int
+		wantCode string
+		kept     bool // whether the object and record survive
+	}{
+		{"not uploaded yet", nil, http.StatusConflict, errorCodeConflict, true},
+		{"wrong size", data[:100], http.StatusBadRequest, errorCodeBadRequest, false},
+		{"not an MP4", bytes.Repeat([]byte("<html>"), 4096/6+1)[:4096], http.StatusBadRequest, errorCodeInvalidMediaType, false},
+		{"infected", append(data[:16:16], bytes.Repeat([]byte(eicar+" "), 4096)...)[:4096], http.StatusUnprocessableEntity, errorCodeMalwareDetected, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := env.createVideo(t, token, "Direct "+tt.name)
+			target := env.directUpload(t, token, video.ID, len(data))
+			if tt.object != nil {
+				env.s3.PutObject(testBucket, target.Key, storagetest.FakeObject{Data: tt.object, ContentType: "video/mp4", LastModified: time.Now()})
+			}
+
+			resp, body := complete(video.ID, target.Key)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %d, want %d: %s", resp.StatusCode, tt.want, body)
+			}
+			if code := errorCode(t, body); code != tt.wantCode {
+				t.Errorf("code = %q, want %q", code, tt.wantCode)
+			}
+			_, stored := env.s3.Object(testBucket, target.Key)
+			record, err := env.cfg.db.GetDirectUpload(target.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.kept && (stored || record.Key != "") {
+				t.Errorf("rejected upload kept: object %v, record %v", stored, record.Key != "")
+			}
+			if tt.kept && record.Key == "" {
+				t.Error("upload record was dropped")
+			}
+		})
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		video := env.createVideo(t, token, "Direct verified")
+		target := env.directUpload(t, token, video.ID, len(data))
+		if status := putPresigned(t, target, data); status != http.StatusOK {
+			t.Fatalf("PUT: got %d", status)
+		}
+
+		// Another video's key isn't accepted
+		other := env.createVideo(t, token, "Direct other")
+		if resp, body := complete(other.ID, target.Key); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("completing with another video's key: got %d, want 404: %s", resp.StatusCode, body)
+		}
+
+		var got videoResponse
+		env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/upload-complete", token, map[string]string{"key": target.Key}, http.StatusOK, &got)
+		if got.VideoURL == nil || *got.VideoURL != "https://"+testCDN+"/"+target.Key {
+			t.Errorf("video_url = %v, want the uploaded object on the CDN", got.VideoURL)
+		}
+		if got.SizeBytes == nil || *got.SizeBytes != int64(len(data)) {
+			t.Errorf("size_bytes = %v, want %d", got.SizeBytes, len(data))
+		}
+		if record, _ := env.cfg.db.GetDirectUpload(target.Key); record.Key != "" {
+			t.Error("completed upload is still pending")
+		}
+		if _, ok := env.s3.Object(testBucket, target.Key); !ok {
+			t.Error("completed object was deleted")
+		}
+	})
+}
+
+func TestDirectUploadPrune(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Abandoned direct")
+	target := env.directUpload(t, token, video.ID, 4096)
+	if status := putPresigned(t, target, testVideoBytes(4096)); status != http.StatusOK {
+		t.Fatalf("PUT: got %d", status)
+	}
+
+	// Not expired yet
+	if n, err := env.cfg.pruneDirectUploads(context.Background(), time.Now()); err != nil || n != 0 {
+		t.Fatalf("pruned %d, %v before the URL expired", n, err)
+	}
+	n, err := env.cfg.pruneDirectUploads(context.Background(), time.Now().Add(directUploadURLExpiry+time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("pruned %d, %v; want 1", n, err)
+	}
+	if _, ok := env.s3.Object(testBucket, target.Key); ok {
+		t.Error("abandoned object wasn't deleted")
+	}
+	if record, _ := env.cfg.db.GetDirectUpload(target.Key); record.Key != "" {
+		t.Error("abandoned upload record wasn't deleted")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// diskFreeBytes isn't implemented here, so the free space check is skipped.
+func diskFreeBytes(dir string) (int64, error) {
+	return 0, errors.New("free disk space unavailable on this platform")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const maxEmbedOrigins = 20
+
+// normalizeEmbedOrigins validates a list of origins such as
+// https://example.com or http://localhost:3000 and returns them lowercased
+// and deduplicated.
+func normalizeEmbedOrigins(origins []string) ([]string, error) {
+	if len(origins) > maxEmbedOrigins {
+		return nil, fmt.Errorf("at most %d embed origins are allowed", maxEmbedOrigins)
+	}
+	normalized := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		u, err := url.Parse(strings.TrimSpace(origin))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid embed origin %q: want scheme://host[:port]", origin)
+		}
+		o := strings.ToLower(u.Scheme + "://" + u.Host)
+		if !slices.Contains(normalized, o) {
+			normalized = append(normalized, o)
+		}
+	}
+	return normalized, nil
+}
+
+// requestOrigin returns the origin a request was made from, taken from the
+// Origin header or else the Referer, or "" when the client sent neither.
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return strings.ToLower(origin)
+	}
+	u, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// checkEmbedOrigin refuses to hand out a restricted video's URL to pages on
+// origins its owner hasn't allowed. Requests without Origin or Referer,
+// such as direct navigation, are let through, as is the owner. It writes
+// the error response and returns false when access is denied.
+func (cfg *apiConfig) checkEmbedOrigin(w http.ResponseWriter, r *http.Request, video database.Video) bool {
+	if len(video.AllowedEmbedOrigins) == 0 {
+		return true
+	}
+	origin := requestOrigin(r)
+	if origin == "" || slices.Contains(video.AllowedEmbedOrigins, origin) {
+		return true
+	}
+	if cfg.optionalUserID(r) == video.UserID {
+		return true
+	}
+	respondWithError(w, http.StatusForbidden, "This video can't be embedded on this site", nil)
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// envelopeMediaType opts a client into the v2 response shape.
+const envelopeMediaType = "application/vnd.tubely.v2+json"
+
+type responseEnvelope struct {
+	Data     interface{}            `json:"data"`
+	Meta     map[string]interface{} `json:"meta"`
+	Warnings []string               `json:"warnings"`
+}
+
+// envelopeWriter carries the envelope choice and any extras a handler
+// attaches so respondWithJSON can shape the payload in one place.
+type envelopeWriter struct {
+	http.ResponseWriter
+	enabled  bool
+	meta     map[string]interface{}
+	warnings []string
+}
+
+func (ew *envelopeWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// envelopeFor finds the envelopeWriter behind w, unwrapping any writers
+// route middleware put in front of it.
+func envelopeFor(w http.ResponseWriter) (*envelopeWriter, bool) {
+	for {
+		if ew, ok := w.(*envelopeWriter); ok {
+			return ew, true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, false
+		}
+		w = u.Unwrap()
+	}
+}
+
+func (ew *envelopeWriter) wrap(payload interface{}) responseEnvelope {
+	meta := ew.meta
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	warnings := ew.warnings
+	if warnings == nil {
+		warnings = []string{}
+	}
+	return responseEnvelope{
+		Data:     payload,
+		Meta:     meta,
+		Warnings: warnings,
+	}
+}
+
+func envelopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&envelopeWriter{
+			ResponseWriter: w,
+			enabled:        wantsEnvelope(r),
+		}, r)
+	})
+}
+
+func wantsEnvelope(r *http.Request) bool {
+	if r.URL.Query().Get("envelope") == "true" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.TrimSpace(mediaType) == envelopeMediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addResponseWarning attaches a warning that is rendered only in the
+// enveloped response shape.
+func addResponseWarning(w http.ResponseWriter, warning string) {
+	if ew, ok := envelopeFor(w); ok {
+		ew.warnings = append(ew.warnings, warning)
+	}
+}
+
+// setResponseMeta attaches a meta entry that is rendered only in the
+// enveloped response shape.
+func setResponseMeta(w http.ResponseWriter, key string, value interface{}) {
+	if ew, ok := envelopeFor(w); ok {
+		if ew.meta == nil {
+			ew.meta = map[string]interface{}{}
+		}
+		ew.meta[key] = value
+	}
+}
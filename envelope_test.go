@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// envelopeTestPayload stands in for a handler's payload.
+type envelopeTestPayload struct {
+	ID    string  `json:"id"`
+	Title string  `json:"title"`
+	URL   *string `json:"video_url"`
+}
+
+var envelopeTestVideo = envelopeTestPayload{ID: "abc", Title: "A <title> & more"}
+
+// envelopeTestHandler responds the way handlers do: a payload plus
+// extras only the envelope renders.
+func envelopeTestHandler(w http.ResponseWriter, r *http.Request) {
+	addResponseWarning(w, "thumbnail was re-encoded")
+	setResponseMeta(w, "count", 1)
+	respondWithJSON(w, http.StatusOK, envelopeTestVideo)
+}
+
+func serveEnveloped(r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	envelopeMiddleware(http.HandlerFunc(envelopeTestHandler)).ServeHTTP(rec, r)
+	return rec
+}
+
+func TestRespondWithJSONBareModeIsUnchanged(t *testing.T) {
+	// Before envelopes, respondWithJSON wrote json.Marshal's output as is
+	want, err := json.Marshal(envelopeTestVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveEnveloped(httptest.NewRequest(http.MethodGet, "/api/videos/abc", nil))
+	if !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Errorf("body = %s, want %s", rec.Body.Bytes(), want)
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(want)) {
+		t.Errorf("Content-Length = %s, want %d", got, len(want))
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %s, want application/json", got)
+	}
+}
+
+func TestRespondWithJSONEnvelopeMode(t *testing.T) {
+	for name, r := range map[string]*http.Request{
+		"accept header": func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/abc", nil)
+			r.Header.Set("Accept", "application/json, "+envelopeMediaType+"; q=0.9")
+			return r
+		}(),
+		"query": httptest.NewRequest(http.MethodGet, "/api/videos/abc?envelope=true", nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := serveEnveloped(r)
+			var got struct {
+				Data     envelopeTestPayload `json:"data"`
+				Meta     map[string]any      `json:"meta"`
+				Warnings []string            `json:"warnings"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %s: %v", rec.Body.Bytes(), err)
+			}
+			if got.Data != envelopeTestVideo {
+				t.Errorf("data = %+v, want %+v", got.Data, envelopeTestVideo)
+			}
+			if got.Meta["count"] != float64(1) {
+				t.Errorf("meta = %v, want count 1", got.Meta)
+			}
+			if len(got.Warnings) != 1 || got.Warnings[0] != "thumbnail was re-encoded" {
+				t.Errorf("warnings = %v", got.Warnings)
+			}
+		})
+	}
+}
+
+func TestRespondWithJSONEnvelopeEmptyExtras(t *testing.T) {
+	rec := httptest.NewRecorder()
+	envelopeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, envelopeTestVideo)
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?envelope=true", nil))
+
+	// meta and warnings are always present, never null
+	want := `{"data":{"id":"abc","title":"A \u003ctitle\u003e \u0026 more","video_url":null},"meta":{},"warnings":[]}`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestRespondWithErrorShapes(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"default", "", `{"error":{"code":"video_not_found","message":"Couldn't get video"}}`},
+		{"envelope", "?envelope=true", `{"error":{"code":"video_not_found","message":"Couldn't get video"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			envelopeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				addResponseWarning(w, "ignored on errors")
+				respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
+			})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+tt.query, nil))
+
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", rec.Code)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
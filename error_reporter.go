@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// errorReportTimeout bounds each report. Reports aren't retried;
+	// another failure will be along if the problem persists.
+	errorReportTimeout = 5 * time.Second
+	// maxErrorReportsInFlight caps concurrent reports, so an outage that
+	// fails every request doesn't pile up goroutines. Reports over it are
+	// dropped.
+	maxErrorReportsInFlight = 16
+)
+
+// errorReport is the JSON body posted for each server failure. The shape
+// is what Sentry-style ingestion webhooks accept as a minimal event.
+type errorReport struct {
+	App       string `json:"app"`
+	Message   string `json:"message"`
+	Error     string `json:"error,omitempty"`
+	Status    int    `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// httpErrorReporter is the ErrorReporter set up by ERROR_REPORT_URL: it
+// posts each failure there in the background.
+type httpErrorReporter struct {
+	url      string
+	appName  string
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+func newHTTPErrorReporter(url, appName string) *httpErrorReporter {
+	return &httpErrorReporter{
+		url:      url,
+		appName:  appName,
+		client:   &http.Client{Timeout: errorReportTimeout},
+		inFlight: make(chan struct{}, maxErrorReportsInFlight),
+	}
+}
+
+func (r *httpErrorReporter) ReportError(err error, msg string, status int) {
+	report := errorReport{
+		App:       r.appName,
+		Message:   msg,
+		Status:    status,
+		Timestamp: apiTime(time.Now()),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	body, encodeErr := json.Marshal(report)
+	if encodeErr != nil {
+		log.Printf("couldn't encode error report: %v", encodeErr)
+		return
+	}
+	select {
+	case r.inFlight <- struct{}{}:
+	default:
+		log.Printf("dropped error report, %d already in flight: %s", maxErrorReportsInFlight, msg)
+		return
+	}
+	go func() {
+		defer func() { <-r.inFlight }()
+		if err := r.post(body); err != nil {
+			log.Printf("couldn't send error report: %v", err)
+		}
+	}()
+}
+
+func (r *httpErrorReporter) post(body []byte) error {
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error report endpoint responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errorClass separates failures worth alerting on from ones the client caused.
+type errorClass string
+
+const (
+	errorClassClient        errorClass = "client"
+	errorClassClientAborted errorClass = "client_aborted"
+	errorClassServer        errorClass = "server"
+)
+
+// ErrorReporter receives server-side failures, e.g. to forward them to an
+// error tracking service such as Sentry.
+type ErrorReporter interface {
+	ReportError(err error, msg string, status int)
+}
+
+// errorReporter is set from apiConfig at startup; nil disables reporting.
+var errorReporter ErrorReporter
+
+// classifyError decides whether an error response reflects a server fault.
+// Some 5xx responses are caused by the client going away or sending too
+// much, and those shouldn't page anyone.
+func classifyError(code int, err error) errorClass {
+	if code < 500 {
+		return errorClassClient
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, context.Canceled) || errors.As(err, &maxBytesErr) {
+		return errorClassClientAborted
+	}
+	return errorClassServer
+}
+
+// Machine-readable codes sent with every error message. Codes are stable;
+// messages may be reworded at any time, so clients branch on the code.
+const (
+	errorCodeAssetsDiskFull    = "assets_disk_full"
+	errorCodeInvalidMediaType  = "invalid_media_type"
+	errorCodeInvalidImage      = "invalid_image"
+	errorCodeNotOwner          = "not_owner"
+	errorCodeVideoNotFound     = "video_not_found"
+	errorCodeUploadTooLarge    = "upload_too_large"
+	errorCodeProcessingFailed  = "processing_failed"
+	errorCodeSigningFailed     = "signing_failed"
+	errorCodeBadRequest        = "bad_request"
+	errorCodeUnauthorized      = "unauthorized"
+	errorCodeForbidden         = "forbidden"
+	errorCodeNotFound          = "not_found"
+	errorCodeConflict          = "conflict"
+	errorCodeTooManyRequests   = "too_many_requests"
+	errorCodeInternal          = "internal_error"
+	errorCodeUpstreamFailed    = "upstream_failed"
+	errorCodeUnavailable       = "unavailable"
+	errorCodeInsufficientSpace = "insufficient_storage"
+	errorCodeNotImplemented    = "not_implemented"
+	errorCodeMalwareDetected   = "malware_detected"
+	errorCodeVideoLimit        = "video_limit_reached"
+	errorCodePrecondition      = "precondition_failed"
+	errorCodeUploadsSaturated  = "uploads_saturated"
+	errorCodeLengthMismatch    = "length_mismatch"
+	errorCodeDuplicateTitle    = "duplicate_title"
+)
+
+// defaultErrorCode is the code sent with an error that wasn't given a more
+// specific one.
+func defaultErrorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return errorCodeUnauthorized
+	case http.StatusForbidden:
+		return errorCodeForbidden
+	case http.StatusNotFound:
+		return errorCodeNotFound
+	case http.StatusConflict:
+		return errorCodeConflict
+	case http.StatusPreconditionFailed:
+		return errorCodePrecondition
+	case http.StatusRequestEntityTooLarge:
+		return errorCodeUploadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return errorCodeInvalidMediaType
+	case http.StatusTooManyRequests:
+		return errorCodeTooManyRequests
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return errorCodeUpstreamFailed
+	case http.StatusServiceUnavailable:
+		return errorCodeUnavailable
+	case http.StatusInsufficientStorage:
+		return errorCodeInsufficientSpace
+	case http.StatusNotImplemented:
+		return errorCodeNotImplemented
+	}
+	if status >= 500 {
+		return errorCodeInternal
+	}
+	return errorCodeBadRequest
+}
+
+// statusError carries the response status and client-facing message for a
+// failure raised inside a helper shared by several handlers. code, when
+// set, replaces the default code for the status.
+type statusError struct {
+	status int
+	msg    string
+	code   string
+	err    error
+}
+
+func (e *statusError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// respondWithStatusError writes err using its status, message and code
+// when it is a statusError, and as a generic 500 otherwise.
+func respondWithStatusError(w http.ResponseWriter, err error) {
+	var se *statusError
+	if errors.As(err, &se) {
+		code := se.code
+		if code == "" {
+			code = defaultErrorCode(se.status)
+		}
+		respondWithErrorCode(w, se.status, code, se.msg, se.err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
+}
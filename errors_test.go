@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   errorClass
+	}{
+		{"bad request", http.StatusBadRequest, errors.New("invalid character"), errorClassClient},
+		{"not found", http.StatusNotFound, nil, errorClassClient},
+		{"too large", http.StatusRequestEntityTooLarge, &http.MaxBytesError{Limit: 10}, errorClassClient},
+		{"database failure", http.StatusInternalServerError, errors.New("database is locked"), errorClassServer},
+		{"storage failure", http.StatusBadGateway, errors.New("S3 responded 503"), errorClassServer},
+		{"no cause", http.StatusInternalServerError, nil, errorClassServer},
+		{"client went away", http.StatusInternalServerError, fmt.Errorf("copying upload: %w", context.Canceled), errorClassClientAborted},
+		{"body over limit", http.StatusInternalServerError, fmt.Errorf("reading form: %w", &http.MaxBytesError{Limit: 10}), errorClassClientAborted},
+		{"deadline", http.StatusGatewayTimeout, context.DeadlineExceeded, errorClassServer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.status, tt.err); got != tt.want {
+				t.Errorf("classifyError(%d, %v) = %s, want %s", tt.status, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingReporter keeps what it is sent.
+type recordingReporter struct {
+	mu       sync.Mutex
+	statuses []int
+}
+
+func (r *recordingReporter) ReportError(err error, msg string, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = append(r.statuses, status)
+}
+
+// errorCount is how many errors of class have been counted.
+func errorCount(t *testing.T, class errorClass) float64 {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != metricNamespace(defaultAppName)+"_errors_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "class" && label.GetValue() == string(class) {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestErrorResponsesByHandler(t *testing.T) {
+	reporter := &recordingReporter{}
+	errorReporter = reporter
+	t.Cleanup(func() { errorReporter = nil })
+
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "classified")
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.HLSURL = ptr(env.cfg.storedVideoURL("hls/" + video.ID + "/set/index.m3u8"))
+	})
+
+	tests := []struct {
+		name   string
+		send   func() *http.Response
+		status int
+		class  errorClass
+	}{
+		{"undecodable video metadata", func() *http.Response {
+			resp, _ := env.do(t, http.MethodPost, "/api/videos", token, "application/json", jsonBody(t, "not an object"))
+			return resp
+		}, http.StatusBadRequest, errorClassClient},
+		{"upload without a token", func() *http.Response {
+			resp, _ := env.uploadVideo(t, "", video.ID, []byte("data"))
+			return resp
+		}, http.StatusUnauthorized, errorClassClient},
+		{"missing video", func() *http.Response {
+			resp, _ := env.do(t, http.MethodGet, "/api/videos/00000000-0000-0000-0000-000000000001", token, "", nil)
+			return resp
+		}, http.StatusNotFound, errorClassClient},
+		{"storage failure", func() *http.Response {
+			env.s3.FailWhen(func(op string, r *http.Request) bool { return op == "GetObject" })
+			defer env.s3.FailWhen(nil)
+			resp, _ := env.do(t, http.MethodGet, hlsPlaylistPath(mustParseUUID(t, video.ID)), token, "", nil)
+			return resp
+		}, http.StatusBadGateway, errorClassServer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := errorCount(t, tt.class)
+			reported := len(reporter.statuses)
+
+			if resp := tt.send(); resp.StatusCode != tt.status {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := errorCount(t, tt.class) - before; got != 1 {
+				t.Errorf("%s errors counted %v times, want once", tt.class, got)
+			}
+			wantReported := 0
+			if tt.class == errorClassServer {
+				wantReported = 1
+			}
+			if got := len(reporter.statuses) - reported; got != wantReported {
+				t.Errorf("reported %d times, want %d", got, wantReported)
+			}
+		})
+	}
+}
+
+func TestHTTPErrorReporterPostsReport(t *testing.T) {
+	received := make(chan errorReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report errorReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decoding report: %v", err)
+		}
+		received <- report
+	}))
+	defer server.Close()
+
+	newHTTPErrorReporter(server.URL, "video-site").ReportError(errors.New("database is locked"), "Couldn't get video", http.StatusInternalServerError)
+	select {
+	case report := <-received:
+		if report.App != "video-site" || report.Message != "Couldn't get video" || report.Error != "database is locked" || report.Status != 500 {
+			t.Errorf("report = %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report was posted")
+	}
+}
+
+func TestErrorResponsesWithDetails(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.maxVideosPerUser = 2
+		cfg.countDraftsTowardLimit = true
+	})
+	_, token := env.createUser(t)
+	first := env.createVideo(t, token, "First")
+	second := env.createVideo(t, token, "Second")
+	env.doJSON(t, http.MethodPut, "/api/users/me/title-policy", token, map[string]bool{"unique_titles": true}, http.StatusOK, nil)
+
+	var session uploadSessionResponse
+	resp, body := env.openSession(t, token, first.ID, minUploadChunkSize, "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("opening a session: got %d: %s", resp.StatusCode, body)
+	}
+	decodeJSON(t, body, &session)
+
+	tests := []struct {
+		name   string
+		send   func(query string) (*http.Response, []byte)
+		status int
+		code   string
+		detail string
+	}{
+		{"video limit", func(query string) (*http.Response, []byte) {
+			return env.do(t, http.MethodPost, "/api/videos"+query, token, "application/json", jsonBody(t, map[string]string{"title": "Third"}))
+		}, http.StatusForbidden, errorCodeVideoLimit, "limit"},
+		{"stale If-Match", func(query string) (*http.Response, []byte) {
+			return env.do(t, http.MethodPatch, "/api/videos/"+first.ID+query, token, "application/json",
+				jsonBody(t, map[string]string{"title": "Renamed"}), "If-Match", `"stale"`)
+		}, http.StatusPreconditionFailed, errorCodePrecondition, "current"},
+		{"duplicate title", func(query string) (*http.Response, []byte) {
+			return env.do(t, http.MethodPatch, "/api/videos/"+second.ID+query, token, "application/json",
+				jsonBody(t, map[string]string{"title": "First"}))
+		}, http.StatusConflict, errorCodeDuplicateTitle, "conflicting_video_id"},
+		{"short chunk", func(query string) (*http.Response, []byte) {
+			return env.do(t, http.MethodPut, "/api/uploads/"+session.ID+"/chunks/0"+query, token, "application/octet-stream", bytes.NewReader([]byte("short")))
+		}, http.StatusBadRequest, errorCodeLengthMismatch, "declared_bytes"},
+		{"upload too large", func(query string) (*http.Response, []byte) {
+			return env.do(t, http.MethodPost, "/api/videos/"+first.ID+"/uploads"+query, token, "application/json",
+				jsonBody(t, map[string]int64{"size_bytes": env.cfg.maxVideoUploadBytes + 1}))
+		}, http.StatusRequestEntityTooLarge, errorCodeUploadTooLarge, "limit_bytes"},
+		{"saturated", func(query string) (*http.Response, []byte) {
+			env.cfg.admission.limits.maxActiveUploads = 1
+			env.cfg.admission.active.Add(1)
+			defer func() {
+				env.cfg.admission.active.Add(-1)
+				env.cfg.admission.limits.maxActiveUploads = 0
+			}()
+			return env.uploadVideo(t, token, first.ID+query, []byte("data"))
+		}, http.StatusServiceUnavailable, errorCodeUploadsSaturated, "reason"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := errorCount(t, errorClassFor(tt.status))
+			resp, body := tt.send("")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			var plain struct {
+				Error map[string]any `json:"error"`
+			}
+			decodeJSON(t, body, &plain)
+			if plain.Error["code"] != tt.code || plain.Error["message"] == nil || plain.Error[tt.detail] == nil {
+				t.Errorf("body = %s, want code %q with %q", body, tt.code, tt.detail)
+			}
+			if got := errorCount(t, errorClassFor(tt.status)) - before; got != 1 {
+				t.Errorf("error counted %v times, want once", got)
+			}
+
+			// The v2 envelope doesn't change the error's shape
+			resp, enveloped := tt.send("?envelope=true")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("enveloped: got %d, want %d: %s", resp.StatusCode, tt.status, enveloped)
+			}
+			if string(enveloped) != string(body) {
+				t.Errorf("enveloped body = %s, want %s", enveloped, body)
+			}
+		})
+	}
+}
+
+// errorClassFor is how a response with status and no cause is classified.
+func errorClassFor(status int) errorClass {
+	return classifyError(status, nil)
+}
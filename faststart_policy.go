@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// fastStartFailurePolicy decides what happens to an upload whose faststart
+// copy fails even though ffprobe could read it.
+type fastStartFailurePolicy string
+
+const (
+	fastStartFailureReject        fastStartFailurePolicy = "reject"
+	fastStartFailureStoreOriginal fastStartFailurePolicy = "store-original"
+)
+
+// fastStartSkippedWarning is the processing warning on videos stored by the
+// rescue path. They play, but only after the moov atom has downloaded.
+const fastStartSkippedWarning = "faststart_skipped"
+
+func parseFastStartFailurePolicy(v string) (fastStartFailurePolicy, error) {
+	switch p := fastStartFailurePolicy(v); p {
+	case "":
+		return fastStartFailureReject, nil
+	case fastStartFailureReject, fastStartFailureStoreOriginal:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown faststart failure policy %q", v)
+}
+
+// fastStartRescues counts uploads stored by the rescue path since startup.
+var fastStartRescues atomic.Int64
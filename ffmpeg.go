@@ -2,31 +2,226 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
 )
 
+// Pipeline branches recorded on the video as processing_branch.
+const (
+	processingBranchFastStart  = "faststart"
+	processingBranchDefragment = "defragment"
+	// processingBranchOriginal stores the upload unmodified after the
+	// faststart copy failed; see fastStartFailureStoreOriginal.
+	processingBranchOriginal = "original"
+	// processingBranchDirect marks faststart files uploaded straight to
+	// S3 and stored as sent; others are recorded as original.
+	processingBranchDirect = "direct"
+)
+
+// errInvalidContainer marks uploads whose container ffmpeg couldn't rewrite
+// even through the defragmenting branch.
+var errInvalidContainer = errors.New("invalid_container")
+
+// errFastStartFailed marks uploads whose plain faststart copy failed. Unlike
+// errInvalidContainer, the file may still be playable as uploaded.
+var errFastStartFailed = errors.New("faststart_failed")
+
+// fastStartResult describes the file written by processVideoForFastStart.
+type fastStartResult struct {
+	path     string
+	warnings []string
+	branch   string
+}
+
+// generateThumbnailFromVideo extracts the frame at offset seconds into
+// filePath as a JPEG and returns the path it was written to. The caller
+// removes the file.
+func generateThumbnailFromVideo(ctx context.Context, filePath string, offset float64) (string, error) {
+	outPath := filePath + ".thumb.jpg"
+	cmd, finish := toolCommand(ctx, ffmpegTimeout, "ffmpeg",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-i", filePath,
+		"-frames:v", "1",
+		"-q:v", "3",
+		"-f", "image2",
+		outPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := finish(runTool(cmd, filePath)); err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("ffmpeg frame extraction failed: %w: %s", err, stderr.String())
+	}
+	// Audio-only files make ffmpeg exit cleanly without writing a frame
+	if info, err := os.Stat(outPath); err != nil || info.Size() == 0 {
+		os.Remove(outPath)
+		return "", errors.New("ffmpeg produced no frame")
+	}
+	return outPath, nil
+}
+
+// decodeImageWithFFmpeg converts an image Go has no decoder for, such as
+// AVIF, to PNG. ext is the extension ffmpeg recognizes the input by. The
+// input's temp file is named after appName.
+func decodeImageWithFFmpeg(ctx context.Context, appName string, data []byte, ext string) ([]byte, error) {
+	in, err := tempFiles.create(appName + "-image-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	defer tempFiles.remove(in.Name())
+	_, err = in.Write(data)
+	if closeErr := in.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, finish := toolCommand(ctx, ffmpegTimeout, "ffmpeg",
+		"-i", in.Name(),
+		"-frames:v", "1",
+		"-c:v", "png",
+		"-f", "image2pipe",
+		"pipe:1",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := finish(runTool(cmd, in.Name())); err != nil {
+		return nil, fmt.Errorf("ffmpeg image decode failed: %w: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// transcodeVideo writes an H.264/AAC copy of filePath scaled so its
+// shorter side is height pixels, keeping the aspect ratio, and returns the
+// path it was written to. The caller removes the file.
+func transcodeVideo(ctx context.Context, filePath string, height int) (string, error) {
+	outPath := fmt.Sprintf("%s.%dp.mp4", filePath, height)
+	// Portrait videos are scaled by width so 720p means the same detail
+	scale := fmt.Sprintf("scale='if(gt(iw,ih),-2,%d)':'if(gt(iw,ih),%d,-2)'", height, height)
+	cmd, finish := toolCommand(ctx, ffmpegTimeout, "ffmpeg",
+		"-i", filePath,
+		"-vf", scale,
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "23",
+		"-c:a", "aac",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"-y", outPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := finish(runTool(cmd, filePath)); err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("ffmpeg transcode to %dp failed: %w: %s", height, err, stderr.String())
+	}
+	return outPath, nil
+}
+
+// hlsPlaylistName is the media playlist packageHLS writes next to its
+// segments.
+const hlsPlaylistName = "index.m3u8"
+
+// packageHLS splits filePath into an HLS VOD playlist and MPEG-TS segments
+// in a new temp directory, which it returns. ffmpeg runs inside that
+// directory so the playlist refers to segments by bare relative names,
+// which keeps it valid wherever the set is uploaded. The directory is named
+// after appName, and the caller removes it.
+func packageHLS(ctx context.Context, appName, filePath string) (string, error) {
+	input, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	outDir, err := tempFiles.mkdir(appName + "-hls-")
+	if err != nil {
+		return "", err
+	}
+	cmd, finish := toolCommand(ctx, ffmpegTimeout, "ffmpeg",
+		"-i", input,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", "segment_%05d.ts",
+		hlsPlaylistName,
+	)
+	cmd.Dir = outDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := finish(runTool(cmd, input)); err != nil {
+		tempFiles.remove(outDir)
+		return "", fmt.Errorf("ffmpeg HLS packaging failed: %w: %s", err, stderr.String())
+	}
+	return outDir, nil
+}
+
 // processVideoForFastStart takes the path to a video file and writes a new
 // MP4 file with "fast start" (moov atom at the beginning) so it can begin
-// playback before fully downloading. It returns the new output file path.
-func processVideoForFastStart(filePath string) (string, error) {
+// playback before fully downloading. The result carries the new output file
+// path, the codes of any known warnings ffmpeg printed while still
+// succeeding, and which branch ran. Fragmented MP4s are remuxed into a
+// single moov instead, since a plain faststart copy of them either fails or
+// produces files some players reject.
+func processVideoForFastStart(ctx context.Context, filePath string) (fastStartResult, error) {
 	outPath := filePath + ".processing"
 
-	cmd := exec.Command(
-		"ffmpeg",
+	fragmented, err := isFragmentedMP4(filePath)
+	if err != nil {
+		// Let ffmpeg have the final say on malformed files
+		log.Printf("couldn't inspect MP4 boxes of %s: %v", filePath, err)
+	}
+
+	branch := processingBranchFastStart
+	args := []string{
 		"-i", filePath,
 		"-c", "copy",
 		"-movflags", "faststart",
 		"-f", "mp4",
 		outPath,
-	)
+	}
+	if fragmented {
+		branch = processingBranchDefragment
+		// Fragments often lack presentation timestamps; without fragment
+		// movflags the muxer writes all samples under one moov.
+		args = []string{
+			"-fflags", "+genpts",
+			"-i", filePath,
+			"-c", "copy",
+			"-movflags", "+faststart",
+			"-f", "mp4",
+			outPath,
+		}
+	}
+
+	cmd, finish := toolCommand(ctx, ffmpegTimeout, "ffmpeg", args...)
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffmpeg faststart failed: %v: %s", err, stderr.String())
+	if err := finish(runTool(cmd, filePath)); err != nil {
+		os.Remove(outPath)
+		// A timeout isn't a verdict on the container, so it isn't classed
+		if errors.Is(err, errToolTimeout) {
+			return fastStartResult{}, fmt.Errorf("ffmpeg %s: %w: %s", branch, err, stderr.String())
+		}
+		if fragmented {
+			return fastStartResult{}, fmt.Errorf("%w: ffmpeg defragment failed: %v: %s", errInvalidContainer, err, stderr.String())
+		}
+		return fastStartResult{}, fmt.Errorf("%w: ffmpeg faststart failed: %v: %s", errFastStartFailed, err, stderr.String())
 	}
 
-	return outPath, nil
+	// Raw stderr can contain server paths, so it's only logged
+	warnings := classifyFFmpegWarnings(stderr.String())
+	if len(warnings) > 0 {
+		log.Printf("ffmpeg %s warnings %v for %s: %s", branch, warnings, filePath, stderr.String())
+	}
+
+	return fastStartResult{path: outPath, warnings: warnings, branch: branch}, nil
 }
@@ -0,0 +1,37 @@
+package main
+
+import "strings"
+
+// ffmpegWarningPatterns maps stderr substrings (lowercased) that predict
+// playback problems to the warning code stored on the video.
+var ffmpegWarningPatterns = []struct {
+	substr string
+	code   string
+}{
+	{"non-monotonous dts", "timestamp_discontinuity"},
+	{"non monotonically increasing dts", "timestamp_discontinuity"},
+	{"timestamps are unset", "timestamps_unset"},
+	{"missing frames", "missing_frames"},
+	{"frames missing", "missing_frames"},
+	{"packet corrupt", "corrupt_packets"},
+	{"invalid nal unit", "corrupt_packets"},
+	{"error while decoding", "decode_errors"},
+	{"stream discontinuity", "stream_discontinuity"},
+}
+
+// classifyFFmpegWarnings returns the distinct warning codes found in ffmpeg's
+// stderr, in first-seen order.
+func classifyFFmpegWarnings(stderr string) []string {
+	var codes []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.ToLower(stderr), "\n") {
+		for _, p := range ffmpegWarningPatterns {
+			if seen[p.code] || !strings.Contains(line, p.substr) {
+				continue
+			}
+			seen[p.code] = true
+			codes = append(codes, p.code)
+		}
+	}
+	return codes
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestClassifyFFmpegWarnings(t *testing.T) {
+	tests := []struct {
+		name, stderr string
+		want         []string
+	}{
+		{"clean run", "Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'in.mp4':\n  Duration: 00:00:10.00\n", nil},
+		{"empty", "", nil},
+		{"timestamps", "[mp4 @ 0x1] Application provided invalid, non monotonically increasing dts to muxer", []string{"timestamp_discontinuity"}},
+		{"case insensitive", "NON-MONOTONOUS DTS in output stream 0:0", []string{"timestamp_discontinuity"}},
+		{"one code per kind", "Non-monotonous DTS\nnon monotonically increasing dts\nnon-monotonous DTS", []string{"timestamp_discontinuity"}},
+		{
+			"first seen order",
+			"[h264 @ 0x2] Invalid NAL unit size\n[mp4 @ 0x1] Timestamps are unset in a packet\n[h264 @ 0x2] error while decoding MB 3 4",
+			[]string{"corrupt_packets", "timestamps_unset", "decode_errors"},
+		},
+		{"both spellings of missing frames", "3 frames missing\nmissing frames detected", []string{"missing_frames"}},
+		{"packet corruption", "Packet corrupt (stream = 0, dts = 1024)", []string{"corrupt_packets"}},
+		{"discontinuity", "stream discontinuity detected", []string{"stream_discontinuity"}},
+		// A pattern split over two lines isn't a match
+		{"split line", "non-monotonous\ndts", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFFmpegWarnings(tt.stderr); !slices.Equal(got, tt.want) {
+				t.Errorf("classifyFFmpegWarnings = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoStatusWarnings(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	// Without ffmpeg the upload is stored unprocessed, with a warning
+	env.cfg.tools.FFmpeg = false
+	video := env.uploadedVideo(t, token, "Unprocessed")
+
+	status := env.waitForProcessing(t, token, video.ID)
+	if !slices.Equal(status.ProcessingWarnings, []string{fastStartSkippedWarning}) {
+		t.Errorf("processing_warnings = %q, want %q", status.ProcessingWarnings, fastStartSkippedWarning)
+	}
+
+	// A pending replacement doesn't report the previous upload's warnings
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		pending := database.ProcessingStatusPending
+		v.ProcessingStatus = &pending
+	})
+	var pending videoStatusResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+"/status", token, nil, http.StatusOK, &pending)
+	if pending.ProcessingWarnings == nil || len(pending.ProcessingWarnings) != 0 {
+		t.Errorf("pending processing_warnings = %q, want an empty list", pending.ProcessingWarnings)
+	}
+}
@@ -2,59 +2,122 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math"
-	"os/exec"
+	"strconv"
 )
 
 type ffprobeStream struct {
-	Width  int `json:"width"`
-	Height int `json:"height"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Duration string `json:"duration"`
+	// Older ffprobe versions report rotation as a tag, newer ones as
+	// display matrix side data.
+	Tags struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	SideDataList []struct {
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+func (s ffprobeStream) rotation() int {
+	for _, sd := range s.SideDataList {
+		if sd.Rotation != 0 {
+			return int(sd.Rotation)
+		}
+	}
+	r, _ := strconv.Atoi(s.Tags.Rotate)
+	return r
 }
 
 type ffprobeResult struct {
 	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+		Size     string `json:"size"`
+	} `json:"format"`
 }
 
-// getVideoAspectRatio runs ffprobe on the given file and returns a coarse aspect ratio classification.
-// It returns one of: "16:9", "9:16", or "other".
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command(
+// videoMetadata is what ffprobe reports about a video. Width and height
+// are as displayed, after any rotation; Duration and Bitrate are zero when
+// unknown.
+type videoMetadata struct {
+	Width    int
+	Height   int
+	Duration float64 // seconds
+	Bitrate  int64   // bits per second
+}
+
+// getVideoMetadata runs ffprobe on input, a file path or URL. For URLs
+// ffprobe only fetches the ranges it needs, usually just the moov atom of
+// a faststart file. The duration falls back to the longest stream when the
+// container doesn't report one, and the bitrate to size over duration.
+func getVideoMetadata(ctx context.Context, input string) (videoMetadata, error) {
+	cmd, finish := toolCommand(ctx, ffprobeTimeout,
 		"ffprobe",
 		"-v", "error",
 		"-print_format", "json",
+		"-show_format",
 		"-show_streams",
-		filePath,
+		input,
 	)
-	var stdout bytes.Buffer
+	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
-		return "", err
+	if err := finish(runTool(cmd, input)); err != nil {
+		return videoMetadata{}, fmt.Errorf("ffprobe failed: %w: %s", err, sanitizeToolOutput(stderr.String(), cmd.Args))
 	}
 
 	var result ffprobeResult
 	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
-		return "", err
+		return videoMetadata{}, err
 	}
 	if len(result.Streams) == 0 {
-		return "", errors.New("ffprobe returned no streams")
+		return videoMetadata{}, errors.New("ffprobe returned no streams")
 	}
 
+	var meta videoMetadata
 	// Prefer the first stream that has width and height > 0
-	w, h := 0, 0
 	for _, s := range result.Streams {
 		if s.Width > 0 && s.Height > 0 {
-			w, h = s.Width, s.Height
+			meta.Width, meta.Height = s.Width, s.Height
+			if s.rotation()%180 != 0 {
+				meta.Width, meta.Height = meta.Height, meta.Width
+			}
 			break
 		}
 	}
-	if w == 0 || h == 0 {
+
+	meta.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	if meta.Duration <= 0 {
+		for _, s := range result.Streams {
+			if d, err := strconv.ParseFloat(s.Duration, 64); err == nil {
+				meta.Duration = max(meta.Duration, d)
+			}
+		}
+	}
+
+	meta.Bitrate, _ = strconv.ParseInt(result.Format.BitRate, 10, 64)
+	if size, err := strconv.ParseInt(result.Format.Size, 10, 64); meta.Bitrate <= 0 && err == nil && meta.Duration > 0 {
+		meta.Bitrate = int64(float64(size*8) / meta.Duration)
+	}
+	return meta, nil
+}
+
+// aspectRatio returns a coarse aspect ratio classification: one of "16:9",
+// "9:16", or "other".
+func (m videoMetadata) aspectRatio() (string, error) {
+	if m.Width == 0 || m.Height == 0 {
 		return "", errors.New("ffprobe did not provide valid width/height")
 	}
 
-	ratio := float64(w) / float64(h)
+	ratio := float64(m.Width) / float64(m.Height)
 	const (
 		ratio169 = 16.0 / 9.0
 		ratio916 = 9.0 / 16.0
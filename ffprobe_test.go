@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/testsupport"
+)
+
+// These tests need ffmpeg and ffprobe; testsupport skips them otherwise.
+
+func TestVideoAspectRatio(t *testing.T) {
+	tests := []struct {
+		recipe testsupport.Recipe
+		want   string
+	}{
+		{testsupport.Landscape, "16:9"},
+		{testsupport.Portrait, "9:16"},
+		// Displayed sideways, so width and height swap
+		{testsupport.Rotated, "9:16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.recipe.Name, func(t *testing.T) {
+			meta, err := getVideoMetadata(context.Background(), testsupport.Fixture(t, tt.recipe))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := meta.aspectRatio()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("aspect ratio = %s (%dx%d), want %s", got, meta.Width, meta.Height, tt.want)
+			}
+			if meta.Duration <= 0 {
+				t.Errorf("duration = %v, want > 0", meta.Duration)
+			}
+		})
+	}
+}
+
+func TestVideoWithoutVideoStream(t *testing.T) {
+	meta, err := getVideoMetadata(context.Background(), testsupport.Fixture(t, testsupport.AudioOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := meta.aspectRatio(); err == nil {
+		t.Errorf("aspect ratio of an audio-only file succeeded with %dx%d", meta.Width, meta.Height)
+	}
+
+	// The pipeline files it under other/ rather than failing
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Audio only")
+	url := env.uploadFixture(t, token, video.ID, testsupport.AudioOnly)
+	if !strings.HasPrefix(url, "https://"+testCDN+"/other/") {
+		t.Errorf("video_url = %s, want it under other/", url)
+	}
+}
+
+func TestFastStartProcessing(t *testing.T) {
+	for _, recipe := range []testsupport.Recipe{testsupport.Landscape, testsupport.FastStart, testsupport.Fragmented} {
+		t.Run(recipe.Name, func(t *testing.T) {
+			// processVideoForFastStart writes next to its input
+			input := copyFixture(t, recipe)
+			result, err := processVideoForFastStart(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(result.path)
+			if !isFastStartFile(t, result.path) {
+				t.Errorf("%s branch output doesn't start with its moov atom", result.branch)
+			}
+		})
+	}
+}
+
+func TestFastStartSkippedWithoutFFmpeg(t *testing.T) {
+	fixture := testsupport.Fixture(t, testsupport.Landscape)
+	if isFastStartFile(t, fixture) {
+		t.Fatal("landscape fixture already has faststart")
+	}
+
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.tools.FFmpeg = false
+	})
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Unprocessed")
+	url := env.uploadFixture(t, token, video.ID, testsupport.Landscape)
+	if !strings.HasPrefix(url, "https://"+testCDN+"/landscape/") {
+		t.Errorf("video_url = %s, want it under landscape/", url)
+	}
+
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if !slices.Contains(got.ProcessingWarnings, fastStartSkippedWarning) {
+		t.Errorf("warnings = %v, want %s", got.ProcessingWarnings, fastStartSkippedWarning)
+	}
+	if got.FastStart == nil || *got.FastStart {
+		t.Errorf("faststart = %v, want false", got.FastStart)
+	}
+}
+
+// uploadFixture uploads the fixture r describes as videoID's video, waits
+// for it to be processed and returns its stored URL.
+func (env *testEnv) uploadFixture(t *testing.T, token, videoID string, r testsupport.Recipe) string {
+	t.Helper()
+	data, err := os.ReadFile(testsupport.Fixture(t, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := env.uploadVideo(t, token, videoID, data)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("uploading %s: got %d: %s", r.Name, resp.StatusCode, body)
+	}
+	status := env.waitForProcessing(t, token, videoID)
+	if status.ProcessingError != nil {
+		t.Fatalf("processing %s failed: %s", r.Name, *status.ProcessingError)
+	}
+	stored, err := env.cfg.db.GetVideo(mustParseUUID(t, videoID), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VideoURL == nil {
+		t.Fatalf("%s wasn't stored", r.Name)
+	}
+	return *stored.VideoURL
+}
+
+// copyFixture copies the fixture r describes into a temp dir, for code
+// that writes next to its input.
+func copyFixture(t *testing.T, r testsupport.Recipe) string {
+	t.Helper()
+	data, err := os.ReadFile(testsupport.Fixture(t, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), r.Name+".mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func isFastStartFile(t *testing.T, path string) bool {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ok, err := isFastStartMP4(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	defaultAccessEventPage = 50
+	maxAccessEventPage     = 200
+)
+
+// handlerAccessEventsList returns a page of a video's access events to its
+// owner, newest first. Pass next_before as ?before= for the next page.
+func (cfg *apiConfig) handlerAccessEventsList(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Events     []database.AccessEvent `json:"events"`
+		NextBefore *int64                 `json:"next_before"`
+	}
+
+	video, ok := cfg.ownedVideoFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultAccessEventPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAccessEventPage {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 200", err)
+			return
+		}
+		limit = n
+	}
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, "before must be a positive event ID", err)
+			return
+		}
+		before = n
+	}
+
+	events, err := cfg.db.GetAccessEvents(video.ID, before, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve access events", err)
+		return
+	}
+
+	resp := response{Events: events}
+	if len(events) == limit {
+		next := events[len(events)-1].ID
+		resp.NextBefore = &next
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
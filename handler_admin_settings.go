@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type settingsResponse struct {
+	Settings      runtimeSettings   `json:"settings"`
+	Changes       []settingsChange  `json:"changes"`
+	ConfigSources map[string]string `json:"config_sources"`
+}
+
+func (cfg *apiConfig) handlerSettingsGet(w http.ResponseWriter, r *http.Request) {
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, settingsResponse{
+		Settings:      cfg.settings.load(),
+		Changes:       cfg.settings.changes(),
+		ConfigSources: cfg.configSources,
+	})
+}
+
+func (cfg *apiConfig) handlerSettingsUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// By names the admin making the change, for the audit trail
+		By                string  `json:"by"`
+		LogLevel          *string `json:"log_level"`
+		Maintenance       *bool   `json:"maintenance"`
+		PresignCache      *bool   `json:"presign_cache"`
+		PreviewGeneration *bool   `json:"preview_generation"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.By = strings.TrimSpace(params.By)
+	if params.By == "" {
+		respondWithError(w, http.StatusBadRequest, "by is required, naming the admin making the change", nil)
+		return
+	}
+
+	next := cfg.settings.load()
+	level := cfg.settings.logLevel.Level()
+	if params.LogLevel != nil {
+		if err := level.UnmarshalText([]byte(*params.LogLevel)); err != nil {
+			respondWithError(w, http.StatusBadRequest, "log_level must be debug, info, warn or error", err)
+			return
+		}
+	}
+	if params.Maintenance != nil {
+		next.Maintenance = *params.Maintenance
+	}
+	if params.PresignCache != nil {
+		next.PresignCache = *params.PresignCache
+	}
+	if params.PreviewGeneration != nil {
+		next.PreviewGeneration = *params.PreviewGeneration
+	}
+
+	updated := cfg.settings.update(params.By, level, next)
+	respondWithJSON(w, http.StatusOK, settingsResponse{
+		Settings:      updated,
+		Changes:       cfg.settings.changes(),
+		ConfigSources: cfg.configSources,
+	})
+}
+
+// maintenanceGate rejects requests with 503 while maintenance mode is on.
+// It wraps the routes that start new uploads; uploads already past the gate
+// finish normally, and reads are never gated.
+func (cfg *apiConfig) maintenanceGate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.settings.load().Maintenance {
+			w.Header().Set("Retry-After", "120")
+			respondWithError(w, http.StatusServiceUnavailable, "Uploads are paused for maintenance", nil)
+			return
+		}
+		next(w, r)
+	}
+}
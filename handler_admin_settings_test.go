@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"testing"
+	"time"
+)
+
+// setSettings changes the runtime settings as the admin ops@tubely.test.
+func (env *testEnv) setSettings(t *testing.T, change map[string]any) runtimeSettings {
+	t.Helper()
+	change["by"] = "ops@tubely.test"
+	var resp settingsResponse
+	env.doJSON(t, http.MethodPut, "/admin/settings", testAdmin, change, http.StatusOK, &resp)
+	return resp.Settings
+}
+
+// readinessReasons returns the reasons /readyz gives.
+func (env *testEnv) readinessReasons(t *testing.T) []string {
+	t.Helper()
+	_, got := env.readiness(t)
+	return got.Reasons
+}
+
+func TestSettingsChangesAudited(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(t, http.MethodPut, "/admin/settings", testAdmin, "application/json", jsonBody(t, map[string]any{"maintenance": true}))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("change without by: got %d, want 400: %s", resp.StatusCode, body)
+	}
+	if env.cfg.settings.load().Maintenance {
+		t.Fatal("a rejected change was applied")
+	}
+
+	env.setSettings(t, map[string]any{"log_level": "debug", "presign_cache": false})
+	var got settingsResponse
+	env.doJSON(t, http.MethodGet, "/admin/settings", testAdmin, nil, http.StatusOK, &got)
+	if got.Settings.LogLevel != "DEBUG" || got.Settings.PresignCache || !got.Settings.PreviewGeneration {
+		t.Errorf("settings = %+v", got.Settings)
+	}
+	if len(got.Changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(got.Changes))
+	}
+	change := got.Changes[0]
+	if change.By != "ops@tubely.test" {
+		t.Errorf("change by %q, want the admin who made it", change.By)
+	}
+	if !change.Before.PresignCache || change.After.PresignCache {
+		t.Errorf("change = %+v, want presign_cache turned off", change)
+	}
+}
+
+func TestMaintenanceModeWithoutRestart(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	upload := func() int {
+		video := env.createVideo(t, token, "Upload")
+		resp, _ := env.uploadVideo(t, token, video.ID, testVideoBytes(4<<10))
+		return resp.StatusCode
+	}
+
+	if status := upload(); status != http.StatusAccepted {
+		t.Fatalf("upload before maintenance: got %d, want 202", status)
+	}
+	if slices.Contains(env.readinessReasons(t), "maintenance") {
+		t.Error("readiness reports maintenance before it's on")
+	}
+
+	env.setSettings(t, map[string]any{"maintenance": true})
+	video := env.createVideo(t, token, "Paused")
+	resp, body := env.uploadVideo(t, token, video.ID, testVideoBytes(4<<10))
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("upload in maintenance: got %d, Retry-After %q: %s", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+	// Reads keep working
+	env.doJSON(t, http.MethodGet, "/api/videos", token, nil, http.StatusOK, nil)
+	if !slices.Contains(env.readinessReasons(t), "maintenance") {
+		t.Error("readiness doesn't report maintenance")
+	}
+
+	env.setSettings(t, map[string]any{"maintenance": false})
+	if status := upload(); status != http.StatusAccepted {
+		t.Errorf("upload after maintenance: got %d, want 202", status)
+	}
+	if slices.Contains(env.readinessReasons(t), "maintenance") {
+		t.Error("readiness still reports maintenance")
+	}
+}
+
+func TestMaintenanceModeLetsInFlightUploadFinish(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "In flight")
+	videoID := mustParseUUID(t, video.ID)
+
+	// Stream the upload so maintenance can be turned on partway through
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	req, err := http.NewRequest(http.MethodPost, env.server.URL+"/api/video_upload/"+video.ID, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := env.server.Client().Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- nil
+			return
+		}
+		resp.Body.Close()
+		done <- resp
+	}()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="video"; filename=%q`, "video.mp4"))
+	header.Set("Content-Type", "video/mp4")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testVideoBytes(1 << 20)
+	if _, err := part.Write(data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	// Once progress is reported the upload is past the maintenance gate
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if _, ok := env.cfg.uploadProgress.get(videoID); ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("the upload never started")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	env.setSettings(t, map[string]any{"maintenance": true})
+	if _, err := part.Write(data[len(data)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+	pw.Close()
+
+	resp := <-done
+	if resp == nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("in-flight upload: got %v, want 202", resp)
+	}
+	if status := env.waitForProcessing(t, token, video.ID); status.ProcessingStatus == nil {
+		t.Error("the in-flight upload wasn't processed")
+	}
+}
+
+func TestPresignCacheSetting(t *testing.T) {
+	env := newTestEnv(t)
+	store := &countingPresigner{Storage: env.cfg.localStorage}
+	presign := func() {
+		if _, _, err := env.cfg.presignObject(context.Background(), store, "video.mp4", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	presign()
+	presign()
+	if n := store.signed.Load(); n != 1 {
+		t.Fatalf("with the cache on: signed %d times, want once", n)
+	}
+
+	env.setSettings(t, map[string]any{"presign_cache": false})
+	presign()
+	presign()
+	if n := store.signed.Load(); n != 3 {
+		t.Errorf("with the cache off: signed %d times in all, want 3", n)
+	}
+
+	env.setSettings(t, map[string]any{"presign_cache": true})
+	presign()
+	if n := store.signed.Load(); n != 3 {
+		t.Errorf("with the cache back on: signed %d times in all, want 3", n)
+	}
+}
+
+func TestPreviewGenerationSetting(t *testing.T) {
+	// ffmpeg isn't installed, but the attempt to take a thumbnail is
+	// still recorded as a processing stage
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.tools.FFmpeg = true
+		cfg.fastStartFailurePolicy = fastStartFailureStoreOriginal
+	})
+	_, token := env.createUser(t)
+	stages := func() []string {
+		video := env.createVideo(t, token, "Preview")
+		if resp, body := env.uploadVideo(t, token, video.ID, testVideoBytes(4<<10)); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("upload: got %d: %s", resp.StatusCode, body)
+		}
+		env.waitForProcessing(t, token, video.ID)
+		var runs []struct {
+			Stages []struct {
+				Name string `json:"name"`
+			} `json:"stages"`
+		}
+		env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+"/processing-runs", token, nil, http.StatusOK, &runs)
+		if len(runs) != 1 {
+			t.Fatalf("got %d processing runs, want 1", len(runs))
+		}
+		var names []string
+		for _, stage := range runs[0].Stages {
+			names = append(names, stage.Name)
+		}
+		return names
+	}
+
+	if got := stages(); !slices.Contains(got, "thumbnail") {
+		t.Errorf("stages with previews on = %v, want a thumbnail", got)
+	}
+	env.setSettings(t, map[string]any{"preview_generation": false})
+	if got := stages(); slices.Contains(got, "thumbnail") {
+		t.Errorf("stages with previews off = %v, want no thumbnail", got)
+	}
+}
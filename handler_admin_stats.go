@@ -0,0 +1,63 @@
+package main
+
+import "net/http"
+
+func (cfg *apiConfig) handlerAdminStats(w http.ResponseWriter, r *http.Request) {
+	type uploadStats struct {
+		ThroughputBytesPerSecond float64 `json:"throughput_bytes_per_second"`
+		Samples                  int     `json:"samples"`
+		NextPartSize             int64   `json:"next_part_size"`
+		NextConcurrency          int     `json:"next_concurrency"`
+	}
+	type assetsDiskStats struct {
+		Degraded      bool    `json:"degraded"`
+		DegradedSince *string `json:"degraded_since"`
+	}
+	type downloadStats struct {
+		BytesPerSecond float64 `json:"bytes_per_second"`
+		TotalBytes     int64   `json:"total_bytes"`
+		PerConnLimit   int64   `json:"per_connection_limit_bytes_per_second"`
+		GlobalLimit    int64   `json:"global_limit_bytes_per_second"`
+	}
+	type response struct {
+		S3Upload   uploadStats     `json:"s3_upload"`
+		AssetsDisk assetsDiskStats `json:"assets_disk"`
+		Admission  admissionStats  `json:"admission"`
+		Downloads  downloadStats   `json:"downloads"`
+		// Uploads stored without faststart since startup
+		FastStartRescues int64 `json:"faststart_rescues"`
+		// Uploads received but not yet picked up by a processing worker
+		QueuedVideos int `json:"queued_videos"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	rate, samples := cfg.uploadThroughput.estimate()
+	partSize, concurrency := cfg.uploadThroughput.uploadParams(cfg.maxPartSize, cfg.maxUploadConcurrency)
+	downloads := downloadStats{PerConnLimit: cfg.downloadLimiter.perConn}
+	if cfg.downloadLimiter.global != nil {
+		downloads.GlobalLimit = int64(cfg.downloadLimiter.global.rate)
+	}
+	downloads.BytesPerSecond, downloads.TotalBytes = cfg.downloadLimiter.meter.rate()
+
+	var disk assetsDiskStats
+	if since, degraded := cfg.assetsDisk.degraded(); degraded {
+		s := apiTime(since)
+		disk = assetsDiskStats{Degraded: true, DegradedSince: &s}
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		AssetsDisk:       disk,
+		Admission:        cfg.admission.stats(),
+		Downloads:        downloads,
+		FastStartRescues: fastStartRescues.Load(),
+		QueuedVideos:     cfg.processingQueue.pending(),
+		S3Upload: uploadStats{
+			ThroughputBytesPerSecond: rate,
+			Samples:                  samples,
+			NextPartSize:             partSize,
+			NextConcurrency:          concurrency,
+		},
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	defaultCleanupSuggestions = 5
+	maxCleanupSuggestions     = 50
+	defaultCleanupAgeDays     = 30
+)
+
+type cleanupSuggestion struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Status    string `json:"status"`
+	SizeBytes int64  `json:"size_bytes"`
+	CreatedAt string `json:"created_at"`
+	AgeDays   int    `json:"age_days"`
+}
+
+func newCleanupSuggestions(videos []database.Video, now time.Time) []cleanupSuggestion {
+	resp := make([]cleanupSuggestion, 0, len(videos))
+	for _, video := range videos {
+		var size int64
+		if video.SizeBytes != nil {
+			size = *video.SizeBytes
+		}
+		resp = append(resp, cleanupSuggestion{
+			ID:        video.ID.String(),
+			Title:     video.Title,
+			Status:    video.Status,
+			SizeBytes: size,
+			CreatedAt: apiTime(video.CreatedAt),
+			AgeDays:   int(math.Floor(now.Sub(video.CreatedAt).Hours() / 24)),
+		})
+	}
+	return resp
+}
+
+// handlerCleanupSuggestions tells a user where they stand against the
+// video limit and what to delete to get back under it: their largest
+// videos, uploads nobody has viewed in ?days= days, and drafts that never
+// received content. video_remaining is null when there is no limit.
+// reclaimable_bytes counts each suggested video once, even when it appears
+// in two lists.
+func (cfg *apiConfig) handlerCleanupSuggestions(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoCount       int                 `json:"video_count"`
+		VideoLimit       int                 `json:"video_limit"`
+		VideoRemaining   *int                `json:"video_remaining"`
+		Largest          []cleanupSuggestion `json:"largest"`
+		Unviewed         []cleanupSuggestion `json:"unviewed"`
+		StaleDrafts      []cleanupSuggestion `json:"stale_drafts"`
+		ReclaimableBytes int64               `json:"reclaimable_bytes"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	userID := identity.UserID
+
+	limit := defaultCleanupSuggestions
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCleanupSuggestions {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 50", err)
+			return
+		}
+		limit = n
+	}
+	days := defaultCleanupAgeDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, "days must be a non-negative integer", err)
+			return
+		}
+		days = n
+	}
+
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -days)
+
+	count, err := cfg.db.CountVideos(userID, !cfg.countDraftsTowardLimit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+		return
+	}
+	largest, err := cfg.db.GetLargestVideos(userID, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	unviewed, err := cfg.db.GetUnviewedVideos(userID, cutoff, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	drafts, err := cfg.db.GetStaleDrafts(userID, cutoff, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{
+		VideoCount:     count,
+		VideoLimit:     cfg.maxVideosPerUser,
+		VideoRemaining: cfg.videosRemaining(count),
+		Largest:        newCleanupSuggestions(largest, now),
+		Unviewed:       newCleanupSuggestions(unviewed, now),
+		StaleDrafts:    newCleanupSuggestions(drafts, now),
+	}
+	seen := map[string]bool{}
+	for _, list := range [][]cleanupSuggestion{resp.Largest, resp.Unviewed, resp.StaleDrafts} {
+		for _, s := range list {
+			if !seen[s.ID] {
+				seen[s.ID] = true
+				resp.ReclaimableBytes += s.SizeBytes
+			}
+		}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
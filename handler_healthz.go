@@ -0,0 +1,24 @@
+package main
+
+import "net/http"
+
+// handlerHealth reports which media tools this instance found at startup,
+// so a missing ffmpeg shows up before the first upload fails. It is always
+// 200: without the tools the server still serves everything but uploads.
+func (cfg *apiConfig) handlerHealth(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status             string     `json:"status"`
+		Tools              toolStatus `json:"tools"`
+		UnprocessedUploads bool       `json:"unprocessed_uploads"`
+	}
+
+	status := "ok"
+	if len(cfg.tools.missing()) > 0 {
+		status = "degraded"
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Status:             status,
+		Tools:              cfg.tools,
+		UnprocessedUploads: cfg.allowUnprocessedUploads,
+	})
+}
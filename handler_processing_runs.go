@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerProcessingRunsList returns a video's processing history to its
+// owner or to an admin.
+func (cfg *apiConfig) handlerProcessingRunsList(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	isAdmin := cfg.isAdminToken(token)
+	var userID uuid.UUID
+	if !isAdmin {
+		identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+		userID = identity.UserID
+	}
+
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+		return
+	}
+	if !isAdmin && video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errorCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+
+	runs, err := cfg.db.GetProcessingRuns(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve processing runs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, runs)
+}
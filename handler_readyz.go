@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// readinessCheckBudget bounds the dependency checks as a whole; they run
+// concurrently, so it is also roughly the slowest a probe can get.
+const readinessCheckBudget = 2 * time.Second
+
+// readinessCacheTTL is how long dependency check results are reused, so
+// frequent probes from several load balancers don't each hit S3.
+const readinessCacheTTL = 5 * time.Second
+
+// dependencyCheck is the outcome of checking one thing the server needs.
+// A failed check that isn't required is reported but doesn't make the
+// instance unready.
+type dependencyCheck struct {
+	OK         bool   `json:"ok"`
+	Required   bool   `json:"required"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// readinessChecker caches the latest dependency check results. Probes
+// arriving while a check runs wait for it rather than starting their own.
+type readinessChecker struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	results   map[string]dependencyCheck
+}
+
+// check returns results no older than readinessCacheTTL, calling run for
+// fresh ones when needed.
+func (c *readinessChecker) check(run func() map[string]dependencyCheck) map[string]dependencyCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.results == nil || time.Since(c.checkedAt) >= readinessCacheTTL {
+		c.results = run()
+		c.checkedAt = time.Now()
+	}
+	return c.results
+}
+
+// runDependencyChecks checks the database, S3 when videos are stored
+// there, ffmpeg and ffprobe, and that assetsRoot is writable, all at once
+// within readinessCheckBudget.
+func (cfg *apiConfig) runDependencyChecks(ctx context.Context) map[string]dependencyCheck {
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckBudget)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"database":   cfg.db.Ping,
+		"assets_dir": func(context.Context) error { return checkWritableDir(cfg.assetsRoot) },
+		"ffmpeg":     func(context.Context) error { _, err := exec.LookPath("ffmpeg"); return err },
+		"ffprobe":    func(context.Context) error { _, err := exec.LookPath("ffprobe"); return err },
+	}
+	if cfg.videoStorage.Name() == storageBackendS3 {
+		checks["s3"] = cfg.checkBucketsReachable
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]dependencyCheck, len(checks))
+	for name, fn := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := fn(ctx)
+			result := dependencyCheck{OK: err == nil, Required: true, DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			// Uploads are stored unprocessed without the tools
+			if (name == "ffmpeg" || name == "ffprobe") && cfg.allowUnprocessedUploads {
+				result.Required = false
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// checkBucketsReachable heads every configured bucket.
+func (cfg *apiConfig) checkBucketsReachable(ctx context.Context) error {
+	for _, bucket := range cfg.configuredBuckets() {
+		if _, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWritableDir creates and removes an empty file in dir.
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// handlerLiveness answers as soon as the server is serving, for process
+// supervisors that only need to know it hasn't hung.
+func (cfg *apiConfig) handlerLiveness(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handlerReadiness reports whether this instance can serve uploads. It
+// returns 503 with the reasons when it is degraded, so a load balancer can
+// steer uploads elsewhere while reads keep working. Each dependency check
+// is listed, and a failed required one is a reason of its own, as is
+// maintenance mode.
+func (cfg *apiConfig) handlerReadiness(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status  string                     `json:"status"`
+		Reasons []string                   `json:"reasons"`
+		Checks  map[string]dependencyCheck `json:"checks"`
+	}
+
+	// A probe that hangs up mustn't leave a cancelled result cached
+	ctx := context.WithoutCancel(r.Context())
+	checks := cfg.readiness.check(func() map[string]dependencyCheck {
+		return cfg.runDependencyChecks(ctx)
+	})
+
+	reasons := []string{}
+	if cfg.settings.load().Maintenance {
+		reasons = append(reasons, "maintenance")
+	}
+	for _, name := range []string{"database", "s3", "assets_dir", "ffmpeg", "ffprobe"} {
+		if check, ok := checks[name]; ok && !check.OK && check.Required {
+			reasons = append(reasons, name+"_unavailable")
+		}
+	}
+	if _, degraded := cfg.assetsDisk.degraded(); degraded {
+		reasons = append(reasons, errorCodeAssetsDiskFull)
+	}
+	if reason := cfg.admission.saturated(); reason != "" {
+		reasons = append(reasons, reason)
+	}
+	if len(reasons) > 0 {
+		respondWithJSON(w, http.StatusServiceUnavailable, response{Status: "degraded", Reasons: reasons, Checks: checks})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{Status: "ok", Reasons: reasons, Checks: checks})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type readinessResponse struct {
+	Status  string                     `json:"status"`
+	Reasons []string                   `json:"reasons"`
+	Checks  map[string]dependencyCheck `json:"checks"`
+}
+
+// readiness probes /readyz and returns its status code and body.
+func (env *testEnv) readiness(t *testing.T) (int, readinessResponse) {
+	t.Helper()
+	resp, body := env.do(t, http.MethodGet, "/readyz", "", "", nil)
+	var got readinessResponse
+	decodeJSON(t, body, &got)
+	return resp.StatusCode, got
+}
+
+func TestLiveness(t *testing.T) {
+	env := newTestEnv(t)
+	env.doJSON(t, http.MethodGet, "/healthz", "", nil, http.StatusOK, nil)
+}
+
+func TestReadinessHealthy(t *testing.T) {
+	// ffmpeg and ffprobe aren't installed, but aren't required either
+	env := newTestEnv(t)
+	status, got := env.readiness(t)
+	if status != http.StatusOK || got.Status != "ok" || len(got.Reasons) != 0 {
+		t.Fatalf("got %d %+v, want ready", status, got)
+	}
+	for _, name := range []string{"database", "s3", "assets_dir"} {
+		if check, ok := got.Checks[name]; !ok || !check.OK || !check.Required {
+			t.Errorf("%s check = %+v, want a passing required check", name, check)
+		}
+	}
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if check := got.Checks[name]; check.Required {
+			t.Errorf("%s is required though uploads may be stored unprocessed", name)
+		}
+	}
+}
+
+func TestReadinessS3Unreachable(t *testing.T) {
+	env := newTestEnv(t)
+	env.s3.FailWhen(func(op string, r *http.Request) bool { return op == "HeadBucket" })
+
+	status, got := env.readiness(t)
+	if status != http.StatusServiceUnavailable || got.Status != "degraded" {
+		t.Fatalf("got %d %q, want 503 degraded", status, got.Status)
+	}
+	if !slices.Contains(got.Reasons, "s3_unavailable") {
+		t.Errorf("reasons = %v, want s3_unavailable", got.Reasons)
+	}
+	if check := got.Checks["s3"]; check.OK || check.Error == "" {
+		t.Errorf("s3 check = %+v, want the HeadBucket error", check)
+	}
+	if check := got.Checks["database"]; !check.OK {
+		t.Errorf("database check = %+v, want it unaffected", check)
+	}
+
+	// Results are cached, so a second probe doesn't head the bucket again
+	// and still sees the failure
+	env.s3.FailWhen(nil)
+	if status, _ := env.readiness(t); status != http.StatusServiceUnavailable {
+		t.Errorf("second probe: got %d, want the cached 503", status)
+	}
+	if calls := env.s3.Calls("HeadBucket"); calls != 1 {
+		t.Errorf("HeadBucket called %d times, want once", calls)
+	}
+}
+
+func TestReadinessAssetsDirUnwritable(t *testing.T) {
+	// Tests run as root, which can write to any directory, so the assets
+	// dir is made unwritable by not existing
+	env := newTestEnv(t)
+	env.cfg.assetsRoot = filepath.Join(t.TempDir(), "missing")
+
+	status, got := env.readiness(t)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", status)
+	}
+	if !slices.Contains(got.Reasons, "assets_dir_unavailable") {
+		t.Errorf("reasons = %v, want assets_dir_unavailable", got.Reasons)
+	}
+	if check := got.Checks["assets_dir"]; check.OK || check.Error == "" {
+		t.Errorf("assets_dir check = %+v, want the write error", check)
+	}
+}
+
+func TestReadinessRequiresToolsWithoutFallback(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.allowUnprocessedUploads = false
+	})
+	status, got := env.readiness(t)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503 without ffmpeg", status)
+	}
+	for _, reason := range []string{"ffmpeg_unavailable", "ffprobe_unavailable"} {
+		if !slices.Contains(got.Reasons, reason) {
+			t.Errorf("reasons = %v, want %s", got.Reasons, reason)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultShareLinkTTL = 48 * time.Hour
+	maxShareLinkTTL     = 30 * 24 * time.Hour
+)
+
+// ownedVideoFromPath loads the path's video and checks the caller owns
+// it, writing the error response and returning false otherwise.
+func (cfg *apiConfig) ownedVideoFromPath(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	video, _, ok := cfg.ownedVideoIdentity(w, r)
+	return video, ok
+}
+
+// ownedVideoIdentity is ownedVideoFromPath also returning who the caller
+// is, for handlers that check or audit impersonation.
+func (cfg *apiConfig) ownedVideoIdentity(w http.ResponseWriter, r *http.Request) (database.Video, auth.Identity, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, auth.Identity{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, auth.Identity{}, false
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, auth.Identity{}, false
+	}
+	userID := identity.UserID
+
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return database.Video{}, auth.Identity{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+		return database.Video{}, auth.Identity{}, false
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errorCodeNotOwner, "You don't own this video", nil)
+		return database.Video{}, auth.Identity{}, false
+	}
+	return video, identity, true
+}
+
+func (cfg *apiConfig) handlerShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ExpiresInSeconds int  `json:"expires_in_seconds"`
+		MaxViews         *int `json:"max_views"`
+	}
+
+	video, identity, ok := cfg.ownedVideoIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	ttl := defaultShareLinkTTL
+	if params.ExpiresInSeconds != 0 {
+		ttl = time.Duration(params.ExpiresInSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxShareLinkTTL {
+		respondWithError(w, http.StatusBadRequest, "expires_in_seconds must be between 1 second and 30 days", nil)
+		return
+	}
+	if params.MaxViews != nil && *params.MaxViews <= 0 {
+		respondWithError(w, http.StatusBadRequest, "max_views must be positive", nil)
+		return
+	}
+
+	var rnd [24]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate share token", err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(rnd[:])
+
+	link, err := cfg.db.CreateShareLink(token, database.CreateShareLinkParams{
+		VideoID:   video.ID,
+		CreatedBy: video.UserID,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+		MaxViews:  params.MaxViews,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share link", err)
+		return
+	}
+
+	cfg.auditImpersonation(r, identity, video.ID)
+	respondWithJSON(w, http.StatusCreated, newShareLinkResponse(link))
+}
+
+func (cfg *apiConfig) handlerShareLinksList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := cfg.db.GetShareLinks(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve share links", err)
+		return
+	}
+
+	resp := make([]shareLinkResponse, 0, len(links))
+	for _, link := range links {
+		resp = append(resp, newShareLinkResponse(link))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	video, identity, ok := cfg.ownedVideoIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	link, err := cfg.db.GetShareLink(r.PathValue("token"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve share link", err)
+		return
+	}
+	if link.Token == "" || link.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Share link not found", nil)
+		return
+	}
+
+	if err := cfg.db.DeleteShareLink(link.Token); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share link", err)
+		return
+	}
+	cfg.auditImpersonation(r, identity, video.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerShareLinkOpen is the public side of a share link: it counts the view
+// and redirects to the video. The view is only counted once the redirect is
+// certain, so a link whose video can't be shown keeps its remaining views.
+func (cfg *apiConfig) handlerShareLinkOpen(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	now := time.Now()
+
+	link, err := cfg.db.GetShareLink(token)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open share link", err)
+		return
+	}
+	if link.Token == "" {
+		respondWithError(w, http.StatusNotFound, "Share link not found", nil)
+		return
+	}
+	if !link.ExpiresAt.After(now) || (link.MaxViews != nil && link.Views >= *link.MaxViews) {
+		respondWithError(w, http.StatusGone, "Share link has expired", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(link.VideoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if presentURL(video.VideoURL) == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no content yet", nil)
+		return
+	}
+	if !cfg.checkEmbedOrigin(w, r, video) {
+		return
+	}
+
+	// Counted atomically, so concurrent opens can't exceed max_views
+	videoID, err := cfg.db.UseShareLink(token, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open share link", err)
+		return
+	}
+	if videoID == uuid.Nil {
+		respondWithError(w, http.StatusGone, "Share link has expired", nil)
+		return
+	}
+
+	cfg.recordAccess(r, video.ID, database.AccessEventShareLink, &token)
+
+	cfg.prepareListedVideo(r.Context(), &video)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, *video.VideoURL, http.StatusFound)
+}
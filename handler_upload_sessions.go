@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// errChunkLength means a chunk's body wasn't exactly the chunk's length.
+var errChunkLength = errors.New("chunk length mismatch")
+
+// sessionCaller authenticates the caller of an upload session endpoint.
+func (cfg *apiConfig) sessionCaller(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+	return identity.UserID, true
+}
+
+// parseSHA256Hex normalises a hex SHA-256 digest sent by a client.
+func parseSHA256Hex(v string) (string, bool) {
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != sha256.Size {
+		return "", false
+	}
+	return hex.EncodeToString(b), true
+}
+
+// handlerUploadSessionCreate opens a chunked upload session for a video.
+// The declared size is checked against free temp space, less what other
+// open sessions have yet to write, so an upload that can't fit fails now
+// rather than at the last chunk.
+func (cfg *apiConfig) handlerUploadSessionCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		SizeBytes int64  `json:"size_bytes"`
+		ChunkSize int64  `json:"chunk_size"`
+		SHA256    string `json:"sha256"`
+		Filename  string `json:"filename"`
+	}
+
+	video, identity, ok := cfg.ownedVideoIdentity(w, r)
+	if !ok || !checkOverwriteAllowed(w, identity, presentURL(video.VideoURL) != nil) || !cfg.checkVideoTools(w) {
+		return
+	}
+	releaseUser, ok := cfg.limitUserUpload(w, video.UserID)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.SizeBytes <= 0 {
+		respondWithError(w, http.StatusBadRequest, "size_bytes must be positive", nil)
+		return
+	}
+	if params.SizeBytes > cfg.maxVideoUploadBytes {
+		respondWithUploadTooLarge(w, "Video is too large", cfg.maxVideoUploadBytes, nil)
+		return
+	}
+	if params.ChunkSize == 0 {
+		params.ChunkSize = defaultUploadChunkSize
+	}
+	if params.ChunkSize < minUploadChunkSize || params.ChunkSize > maxUploadChunkSize {
+		respondWithError(w, http.StatusBadRequest, "chunk_size must be between 256KiB and 64MiB", nil)
+		return
+	}
+	digest := ""
+	if params.SHA256 != "" {
+		if digest, ok = parseSHA256Hex(params.SHA256); !ok {
+			respondWithError(w, http.StatusBadRequest, "sha256 must be a hex SHA-256 digest", nil)
+			return
+		}
+	}
+
+	// Drafts that don't count toward the limit are counted once they gain content
+	if !cfg.countDraftsTowardLimit && video.VideoURL == nil {
+		count, exceeded, err := cfg.videoLimitExceeded(video.UserID, true)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+			return
+		}
+		if exceeded {
+			respondWithVideoLimit(w, count, cfg.maxVideosPerUser)
+			return
+		}
+	}
+	tempFile, err := tempFiles.create(cfg.appName + "-session-*.mp4")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create temp file", err)
+		return
+	}
+	err = tempFile.Truncate(params.SizeBytes)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		tempFiles.remove(tempFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Failed to create temp file", err)
+		return
+	}
+
+	session := &uploadSession{
+		videoID:   video.ID,
+		userID:    video.UserID,
+		path:      tempFile.Name(),
+		size:      params.SizeBytes,
+		chunkSize: params.ChunkSize,
+		sha256:    digest,
+		filename:  params.Filename,
+		metadata:  uploadMetadataFromRequest(r, "video/mp4"),
+	}
+	free, err := cfg.admission.freeSpace(cfg.admission.tempDir)
+	if err != nil {
+		free = -1
+	}
+	if err := cfg.uploadSessions.add(session, free); err != nil {
+		tempFiles.remove(tempFile.Name())
+		respondWithStatusError(w, err)
+		return
+	}
+
+	cfg.auditImpersonation(r, identity, video.ID)
+	w.Header().Set("Location", "/api/uploads/"+session.id)
+	respondWithJSON(w, http.StatusCreated, newUploadSessionResponse(*session))
+}
+
+// handlerUploadSessionGet reports which chunks of a session have arrived,
+// so a client that crashed knows what to resend.
+func (cfg *apiConfig) handlerUploadSessionGet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.sessionCaller(w, r)
+	if !ok {
+		return
+	}
+	session, err := cfg.uploadSessions.status(r.PathValue("sessionID"), userID)
+	if err != nil {
+		respondWithStatusError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newUploadSessionResponse(session))
+}
+
+// handlerUploadSessionChunk stores chunk n of a session. The body must be
+// exactly the chunk's length: the session's chunk size, or what remains
+// for the last chunk. An optional Upload-Chunk-SHA256 header is checked
+// against the body. Chunks can be sent in any order, and resending one
+// replaces it.
+func (cfg *apiConfig) handlerUploadSessionChunk(w http.ResponseWriter, r *http.Request) {
+	release, reason := cfg.admission.admit()
+	if reason != "" {
+		respondWithSaturated(w, reason)
+		return
+	}
+	defer release()
+
+	userID, ok := cfg.sessionCaller(w, r)
+	if !ok {
+		return
+	}
+	releaseUser, ok := cfg.limitUserUploadPart(w, userID)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chunk number", err)
+		return
+	}
+	wantDigest := ""
+	if v := r.Header.Get("Upload-Chunk-SHA256"); v != "" {
+		if wantDigest, ok = parseSHA256Hex(v); !ok {
+			respondWithError(w, http.StatusBadRequest, "Upload-Chunk-SHA256 must be a hex SHA-256 digest", nil)
+			return
+		}
+	}
+
+	session, err := cfg.uploadSessions.beginChunk(r.PathValue("sessionID"), userID, n)
+	if err != nil {
+		respondWithStatusError(w, err)
+		return
+	}
+	offset, length := session.chunkBounds(n)
+	// Chunked bodies have no declared length (-1) and are checked as they arrive
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		cfg.uploadSessions.abortChunk(session, n)
+		respondWithLengthMismatch(w, length, r.ContentLength)
+		return
+	}
+
+	received, err := writeSessionChunk(session.path, offset, length, r.Body, wantDigest)
+	cfg.uploadSessions.endChunk(session, n, err == nil)
+	if err != nil {
+		if errors.Is(err, errChunkLength) {
+			respondWithLengthMismatch(w, length, received)
+			return
+		}
+		respondWithStatusError(w, err)
+		return
+	}
+
+	status, err := cfg.uploadSessions.status(session.id, userID)
+	if err != nil {
+		respondWithStatusError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newUploadSessionResponse(status))
+}
+
+// writeSessionChunk copies exactly length bytes of body into the file at
+// path, starting at offset, and returns how many bytes the body held.
+func writeSessionChunk(path string, offset, length int64, body io.Reader, wantDigest string) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, &statusError{status: http.StatusInternalServerError, msg: "Failed to open upload session file", err: err}
+	}
+	hasher := sha256.New()
+	src := &readErrRecorder{r: io.LimitReader(body, length)}
+	received, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(file, offset), hasher), src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case src.err != nil:
+		return received, &statusError{status: http.StatusBadRequest, msg: "Error reading chunk", err: src.err}
+	case err != nil:
+		return received, &statusError{status: http.StatusInternalServerError, msg: "Failed to write chunk", err: err}
+	}
+	if extra, _ := io.Copy(io.Discard, io.LimitReader(body, 1<<20)); extra > 0 || received < length {
+		return received + extra, errChunkLength
+	}
+	if wantDigest != "" && hex.EncodeToString(hasher.Sum(nil)) != wantDigest {
+		return received, &statusError{status: http.StatusBadRequest, msg: "Chunk doesn't match Upload-Chunk-SHA256", code: errorCodeChecksumMismatch}
+	}
+	return received, nil
+}
+
+// handlerUploadSessionComplete checks that every chunk of a session has
+// arrived and, if the session was opened with one, that the file matches
+// its SHA-256, then queues it for processing like any other upload. A
+// checksum mismatch ends the session, since there's no telling which
+// chunk is wrong.
+func (cfg *apiConfig) handlerUploadSessionComplete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.sessionCaller(w, r)
+	if !ok {
+		return
+	}
+	releaseUser, ok := cfg.limitUserUploadPart(w, userID)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+	session, err := cfg.uploadSessions.beginComplete(r.PathValue("sessionID"), userID)
+	if err != nil {
+		respondWithStatusError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(session.videoID, false)
+	if err != nil {
+		cfg.uploadSessions.abortComplete(session)
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.UserID != userID {
+		cfg.uploadSessions.remove(session)
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+		return
+	}
+
+	file, err := os.Open(session.path)
+	if err != nil {
+		cfg.uploadSessions.remove(session)
+		respondWithError(w, http.StatusInternalServerError, "Failed to open upload session file", err)
+		return
+	}
+	if session.sha256 != "" {
+		hasher := sha256.New()
+		_, err := io.Copy(hasher, file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+			cfg.uploadSessions.abortComplete(session)
+			respondWithError(w, http.StatusInternalServerError, "Failed to read upload session file", err)
+			return
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) != session.sha256 {
+			file.Close()
+			cfg.uploadSessions.remove(session)
+			respondWithStatusError(w, &statusError{
+				status: http.StatusConflict,
+				msg:    "Uploaded file doesn't match sha256; restart the upload",
+				code:   errorCodeChecksumMismatch,
+			})
+			return
+		}
+	}
+
+	err = cfg.queueVideoProcessing(r.Context(), &video, videoUpload{
+		file:      file,
+		size:      session.size,
+		mediaType: "video/mp4",
+		filename:  session.filename,
+		metadata:  session.metadata,
+	}, func() {
+		file.Close()
+		tempFiles.remove(session.path)
+	})
+	if err != nil {
+		file.Close()
+		cfg.uploadProgress.stage(video.ID, progressFailed)
+		// A full queue is worth retrying without sending the chunks again
+		if errors.Is(err, errProcessingQueueFull) {
+			cfg.uploadSessions.abortComplete(session)
+		} else {
+			cfg.uploadSessions.remove(session)
+		}
+		respondWithQueueError(w, err)
+		return
+	}
+	// The session is spent once processing owns the file
+	cfg.uploadSessions.detach(session)
+
+	cfg.respondWithAccepted(w, r, video)
+}
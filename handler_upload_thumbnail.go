@@ -1,14 +1,10 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
 	"io"
+	"log/slog"
 	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
@@ -28,20 +24,52 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	userID := identity.UserID
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	requestLogger(r.Context()).Debug("uploading thumbnail",
+		slog.String("video_id", videoID.String()),
+		slog.String("user_id", userID.String()),
+	)
 
-	// Parse the multipart form with a 10MB memory limit
+	// Check the video before reading the body, so a caller who doesn't
+	// own it isn't allowed to send the whole upload first
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errorCodeNotOwner, "You do not own this video", nil)
+		return
+	}
+	if !checkOverwriteAllowed(w, identity, presentURL(video.ThumbnailURL) != nil) {
+		return
+	}
+	releaseUser, ok := cfg.limitUserUpload(w, userID)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	// Parse the multipart form with a 10MB memory limit, leaving room
+	// for the form around the file
 	const maxMemory = int64(10 << 20) // 10 MB
-	if err := r.ParseMultipartForm(maxMemory); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error parsing form data", err)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailBytes+1<<20)
+	cleanupForm, err := parseMultipartForm(r, maxMemory)
+	if err != nil {
+		respondWithFormError(w, err, cfg.maxThumbnailBytes)
 		return
 	}
+	defer cleanupForm()
 
 	// Get the file and header from the form using key "thumbnail"
 	file, fileHeader, err := r.FormFile("thumbnail")
@@ -55,84 +83,36 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	ct := fileHeader.Header.Get("Content-Type")
 	mediaType, _, err := mime.ParseMediaType(ct)
 	if err != nil || mediaType == "" {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
-		return
-	}
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Unsupported media type; only image/jpeg and image/png are allowed", nil)
+		respondWithErrorCode(w, http.StatusBadRequest, errorCodeInvalidMediaType, "Invalid Content-Type header", err)
 		return
 	}
 
-	// Determine a file extension from the Content-Type header
-	var ext string
-	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
-		ext = exts[0]
-	}
-	// Preference/fallbacks for common images
-	switch mediaType {
-	case "image/jpeg":
-		ext = ".jpg" // prefer .jpg over .jpeg
-	case "image/svg+xml":
-		if ext == "" {
-			ext = ".svg"
-		}
-	}
-
-	// Light log for visibility
-	fmt.Printf("received thumbnail: mediaType=%s ext=%s\n", mediaType, ext)
-
-	// Get the video metadata and ensure the authenticated user owns it
-	video, err := cfg.db.GetVideo(videoID)
+	data, err := io.ReadAll(io.LimitReader(file, cfg.maxThumbnailBytes+1))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
-		return
-	}
-	if video.ID == uuid.Nil {
-		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		respondWithError(w, http.StatusInternalServerError, "Failed to read thumbnail", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You do not own this video", nil)
+	if int64(len(data)) > cfg.maxThumbnailBytes {
+		respondWithUploadTooLarge(w, "Thumbnail is too large", cfg.maxThumbnailBytes, nil)
 		return
 	}
 
-	// Create a unique file path using the video ID and save the thumbnail to disk
-	if ext == "" {
-		ext = ".img" // fallback extension if none detected
-	}
-
-	// Create a random 32-byte filename and encode as URL-safe base64 (no padding)
-	var rnd [32]byte // cryptographically secure random bytes
-	if _, err := rand.Read(rnd[:]); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to generate random filename", err)
-		return
-	}
-	randomName := base64.RawURLEncoding.EncodeToString(rnd[:])
-	filename := randomName + ext
-	fullPath := filepath.Join(cfg.assetsRoot, filename)
-
-	out, err := os.Create(fullPath)
+	encoding, warnings, err := cfg.ingestThumbnail(r.Context(), &video, thumbnailUpload{
+		data:      data,
+		mediaType: mediaType,
+		grid:      r.FormValue("grid") == "true",
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create thumbnail file", err)
+		respondWithStatusError(w, err)
 		return
 	}
-	defer out.Close()
-
-	// Stream copy the uploaded file directly to disk
-	if _, err := io.Copy(out, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to write thumbnail to disk", err)
-		return
-	}
-
-	// Set the public URL pointing to the saved asset
-	publicURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename)
-	video.ThumbnailURL = &publicURL
-
-	if err := cfg.db.UpdateVideo(video); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update video thumbnail URL", err)
-		return
+	for _, warning := range warnings {
+		addResponseWarning(w, warning)
 	}
+	setResponseMeta(w, "thumbnail_encoding", encoding)
+	cfg.signThumbnailURLs(r.Context(), &video)
 
 	// Respond with the updated video metadata
-	respondWithJSON(w, http.StatusOK, video)
+	cfg.auditImpersonation(r, identity, video.ID)
+	respondWithJSON(w, http.StatusOK, newOwnerVideoResponse(video))
 }
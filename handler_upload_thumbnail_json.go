@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerUploadThumbnailJSON accepts a base64-encoded thumbnail for clients
+// that can't build multipart bodies. It shares ingestThumbnail with
+// handlerUploadThumbnail and returns the same response.
+func (cfg *apiConfig) handlerUploadThumbnailJSON(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		DataBase64  string `json:"data_base64"`
+		Grid        bool   `json:"grid"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	userID := identity.UserID
+
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errorCodeNotOwner, "You do not own this video", nil)
+		return
+	}
+	if !checkOverwriteAllowed(w, identity, presentURL(video.ThumbnailURL) != nil) {
+		return
+	}
+	releaseUser, ok := cfg.limitUserUpload(w, userID)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	// Base64 inflates by 4/3; leave room for the JSON around it
+	r.Body = http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(int(cfg.maxThumbnailBytes))+4096))
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithUploadTooLarge(w, "Thumbnail is too large", cfg.maxThumbnailBytes, err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(params.ContentType)
+	if err != nil || mediaType == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid content_type", err)
+		return
+	}
+
+	// Reject oversize payloads before spending time decoding them
+	if int64(base64.StdEncoding.DecodedLen(len(params.DataBase64))) > cfg.maxThumbnailBytes {
+		respondWithUploadTooLarge(w, "Thumbnail is too large", cfg.maxThumbnailBytes, nil)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(params.DataBase64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid base64 data", err)
+		return
+	}
+
+	encoding, warnings, err := cfg.ingestThumbnail(r.Context(), &video, thumbnailUpload{
+		data:      data,
+		mediaType: mediaType,
+		grid:      params.Grid,
+	})
+	if err != nil {
+		respondWithStatusError(w, err)
+		return
+	}
+	for _, warning := range warnings {
+		addResponseWarning(w, warning)
+	}
+	setResponseMeta(w, "thumbnail_encoding", encoding)
+	cfg.signThumbnailURLs(r.Context(), &video)
+
+	cfg.auditImpersonation(r, identity, video.ID)
+	respondWithJSON(w, http.StatusOK, newOwnerVideoResponse(video))
+}
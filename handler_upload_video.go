@@ -1,20 +1,46 @@
 package main
 
 import (
-	"context"
-	"crypto/rand"
-	"fmt"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
-	"os"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
 )
 
+// defaultMaxVideoUploadBytes caps a video upload, counting resumed
+// continuations, unless MAX_VIDEO_UPLOAD_BYTES changes it.
+const defaultMaxVideoUploadBytes = 1 << 30 // 1 GB
+
+// uploadChecksumHeader returns the SHA-256 a client sent in
+// X-Upload-Checksum-SHA256, base64 encoded as in S3's checksum headers, or
+// nil when there is none.
+func uploadChecksumHeader(h http.Header) ([]byte, error) {
+	v := h.Get("X-Upload-Checksum-SHA256")
+	if v == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New("X-Upload-Checksum-SHA256 must be a base64 SHA-256 digest")
+	}
+	return sum, nil
+}
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
+	release, reason := cfg.admission.admit()
+	if reason != "" {
+		respondWithSaturated(w, reason)
+		return
+	}
+	defer release()
+
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -28,131 +54,212 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	userID := identity.UserID
 
 	// Get video metadata and check ownership
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(videoID, false)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
 		return
 	}
 	if video.ID == uuid.Nil {
-		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
 		return
 	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You do not own this video", nil)
+		respondWithErrorCode(w, http.StatusUnauthorized, errorCodeNotOwner, "You do not own this video", nil)
 		return
 	}
-
-	// Limit upload size to 1GB
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
-
-	// Parse multipart form (use 32MB memory for large files)
-	const maxMemory = int64(32 << 20) // 32 MB
-	if err := r.ParseMultipartForm(maxMemory); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error parsing form data", err)
+	if !checkOverwriteAllowed(w, identity, presentURL(video.VideoURL) != nil) {
 		return
 	}
+	// A retry after a lost response gets the original one back rather
+	// than storing the video again
+	w, finishIdempotent, ok := cfg.beginIdempotent(w, r, userID, video.ID)
+	if !ok {
+		return
+	}
+	defer finishIdempotent()
+	if !cfg.checkVideoTools(w) {
+		return
+	}
+	releaseUser, ok := cfg.limitUserUpload(w, userID)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	// Drafts that don't count toward the limit are counted once they gain content
+	if !cfg.countDraftsTowardLimit && video.VideoURL == nil {
+		count, exceeded, err := cfg.videoLimitExceeded(userID, true)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+			return
+		}
+		if exceeded {
+			respondWithVideoLimit(w, count, cfg.maxVideosPerUser)
+			return
+		}
+	}
 
-	file, fileHeader, err := r.FormFile("video")
+	// Any parts before the video count toward the limit too
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadBytes)
+
+	// Stream the file part straight to disk rather than letting
+	// ParseMultipartForm buffer it, so an interrupted transfer leaves a
+	// prefix we can resume from.
+	reader, err := r.MultipartReader()
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Missing or invalid 'video' file", err)
+		respondWithError(w, http.StatusBadRequest, "Error parsing form data", err)
 		return
 	}
-	defer file.Close()
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			respondWithError(w, http.StatusBadRequest, "Missing or invalid 'video' file", nil)
+			return
+		}
+		if err != nil {
+			respondWithFormError(w, err, cfg.maxVideoUploadBytes)
+			return
+		}
+		if part.FormName() == "video" && part.FileName() != "" {
+			break
+		}
+	}
+	defer part.Close()
 
-	ct := fileHeader.Header.Get("Content-Type")
+	ct := part.Header.Get("Content-Type")
 	mediaType, _, err := mime.ParseMediaType(ct)
 	if err != nil || mediaType == "" {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errorCodeInvalidMediaType, "Invalid Content-Type header", err)
 		return
 	}
 	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Unsupported media type; only video/mp4 allowed", nil)
+		respondWithErrorCode(w, http.StatusBadRequest, errorCodeInvalidMediaType, "Unsupported media type; only video/mp4 allowed", nil)
 		return
 	}
 
-	// Save to temp file
-	tempFile, err := os.CreateTemp("", "tubely-upload-*.mp4")
+	// A declared length lets oversized or unstorable uploads fail before
+	// any bytes are copied; it is verified against what actually arrives.
+	declared, err := declaredLength(part.Header)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create temp file", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
-
-	if _, err := io.Copy(tempFile, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to save video to temp file", err)
+	if declared > cfg.maxVideoUploadBytes {
+		respondWithUploadTooLarge(w, "Video is too large", cfg.maxVideoUploadBytes, nil)
 		return
 	}
-
-	// Reset file pointer to beginning
-	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to seek temp file", err)
+	if free, err := cfg.admission.freeSpace(cfg.admission.tempDir); declared > 0 && err == nil && declared > free {
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough space to receive this upload", nil)
 		return
 	}
 
-	// Process file for fast start (move moov atom) and open processed file for upload
-	processedPath, err := processVideoForFastStart(tempFile.Name())
+	wantSum, err := uploadChecksumHeader(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to process video for fast start", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
-	defer os.Remove(processedPath)
 
-	processedFile, err := os.Open(processedPath)
+	// Save to temp file
+	tempFile, err := tempFiles.create(cfg.appName + "-upload-*.mp4")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to open processed file for upload", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create temp file", err)
 		return
 	}
-	defer processedFile.Close()
+	keepTempFile, queued := false, false
+	defer func() {
+		if queued {
+			return
+		}
+		tempFile.Close()
+		if !keepTempFile {
+			tempFiles.remove(tempFile.Name())
+		}
+	}()
 
-	// Generate random 32-byte hex filename for S3 key
-	var rnd [32]byte
-	if _, err := io.ReadFull(rand.Reader, rnd[:]); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to generate random filename", err)
-		return
+	hasher := sha256.New()
+	src := &readErrRecorder{r: part}
+	// Without a declared part length the request length is a close
+	// overestimate; the multipart framing is small.
+	total := declared
+	if total < 0 {
+		total = r.ContentLength
 	}
-	// Determine aspect ratio of the saved temp file and choose prefix
-	aspect, err := getVideoAspectRatio(tempFile.Name())
-	prefix := "other"
-	if err == nil {
-		if aspect == "16:9" {
-			prefix = "landscape"
-		} else if aspect == "9:16" {
-			prefix = "portrait"
+	received, err := io.Copy(io.MultiWriter(tempFile, hasher), cfg.uploadProgress.reader(video.ID, src, 0, total))
+	if err != nil {
+		cfg.uploadProgress.stage(video.ID, progressFailed)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			respondWithUploadTooLarge(w, "Video is too large", cfg.maxVideoUploadBytes, err)
+		case src.err != nil && received > 0:
+			// The client went away mid-transfer; keep what arrived
+			partial := &partialUpload{
+				videoID:   video.ID,
+				userID:    userID,
+				path:      tempFile.Name(),
+				received:  received,
+				hash:      hasher,
+				mediaType: mediaType,
+				filename:  part.FileName(),
+				metadata:  uploadMetadataFromRequest(r, ct),
+			}
+			if addErr := cfg.partialUploads.add(partial); addErr != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to save partial upload", addErr)
+				return
+			}
+			keepTempFile = true
+			logError(responseLogger(w), http.StatusBadRequest, "Upload interrupted", err)
+			respondWithResumable(w, http.StatusBadRequest, "Upload interrupted; resume it with the returned token", partial)
+		case src.err != nil:
+			respondWithError(w, http.StatusBadRequest, "Error reading upload", err)
+		default:
+			respondWithError(w, http.StatusInternalServerError, "Failed to save video to temp file", err)
 		}
+		return
 	}
-	s3Key := fmt.Sprintf("%s/%x.mp4", prefix, rnd)
 
-	// Upload to S3
-	putInput := &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &s3Key,
-		Body:        processedFile,
-		ContentType: &mediaType,
+	if declared >= 0 && received != declared {
+		cfg.uploadProgress.stage(video.ID, progressFailed)
+		respondWithLengthMismatch(w, declared, received)
+		return
 	}
-	_, err = cfg.s3Client.PutObject(context.Background(), putInput)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to upload video to S3", err)
+	if wantSum != nil && !bytes.Equal(hasher.Sum(nil), wantSum) {
+		cfg.uploadProgress.stage(video.ID, progressFailed)
+		respondWithStatusError(w, &statusError{
+			status: http.StatusUnprocessableEntity,
+			msg:    "Uploaded file doesn't match X-Upload-Checksum-SHA256",
+			code:   errorCodeChecksumMismatch,
+		})
 		return
 	}
 
-	// Build CloudFront URL using the configured distribution domain and store it in video_url
-	// Expect cfg.s3CfDistribution to be a domain name like "d123.cloudfront.net" or a custom CNAME.
-	publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, s3Key)
-	video.VideoURL = &publicURL
-
-	if err := cfg.db.UpdateVideo(video); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update video URL", err)
+	err = cfg.queueVideoProcessing(r.Context(), &video, videoUpload{
+		file:      tempFile,
+		size:      received,
+		mediaType: mediaType,
+		filename:  part.FileName(),
+		metadata:  uploadMetadataFromRequest(r, ct),
+	}, func() {
+		tempFile.Close()
+		tempFiles.remove(tempFile.Name())
+	})
+	if err != nil {
+		cfg.uploadProgress.stage(video.ID, progressFailed)
+		respondWithQueueError(w, err)
 		return
 	}
+	queued = true
 
-	// Return the updated video (contains the stored CloudFront URL)
-	respondWithJSON(w, http.StatusOK, video)
+	// Processing continues in the background; clients poll the status
+	cfg.auditImpersonation(r, identity, video.ID)
+	cfg.respondWithAccepted(w, r, video)
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// parseContentRange parses "bytes start-end/total".
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, errors.New("Content-Range must use bytes units")
+	}
+	_, err = fmt.Sscanf(spec, "%d-%d/%d", &start, &end, &total)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if start < 0 || end < start || total <= end {
+		return 0, 0, 0, errors.New("invalid Content-Range bounds")
+	}
+	return start, end, total, nil
+}
+
+// resumeCaller authenticates the caller of a resume endpoint.
+func (cfg *apiConfig) resumeCaller(w http.ResponseWriter, r *http.Request) (uuid.UUID, auth.Identity, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return uuid.Nil, auth.Identity{}, false
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, auth.Identity{}, false
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, auth.Identity{}, false
+	}
+	return videoID, identity, true
+}
+
+// handlerUploadVideoResumeStatus reports the latest interrupted upload of
+// a video, for clients that never saw the interrupted response.
+func (cfg *apiConfig) handlerUploadVideoResumeStatus(w http.ResponseWriter, r *http.Request) {
+	videoID, identity, ok := cfg.resumeCaller(w, r)
+	if !ok {
+		return
+	}
+	partial := cfg.partialUploads.latest(videoID, identity.UserID)
+	if partial == nil {
+		respondWithError(w, http.StatusNotFound, "No resumable upload for this video", nil)
+		return
+	}
+	respondWithResumable(w, http.StatusOK, "", partial)
+}
+
+// handlerUploadVideoResume appends the raw bytes in the request body to an
+// interrupted upload identified by the Upload-Token header. Content-Range
+// must start exactly where the received prefix ends; an optional
+// Upload-Prefix-SHA256 header is checked against the prefix so a client
+// resuming a different file is caught. The final chunk runs the usual
+// processing pipeline.
+func (cfg *apiConfig) handlerUploadVideoResume(w http.ResponseWriter, r *http.Request) {
+	release, reason := cfg.admission.admit()
+	if reason != "" {
+		respondWithSaturated(w, reason)
+		return
+	}
+	defer release()
+
+	videoID, identity, ok := cfg.resumeCaller(w, r)
+	if !ok || !cfg.checkVideoTools(w) {
+		return
+	}
+	userID := identity.UserID
+	releaseUser, ok := cfg.limitUserUpload(w, userID)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Range header", err)
+		return
+	}
+	if total > cfg.maxVideoUploadBytes {
+		respondWithUploadTooLarge(w, "Video is too large", cfg.maxVideoUploadBytes, nil)
+		return
+	}
+	// Chunked bodies have no declared length (-1) and are bounded by the range
+	if r.ContentLength >= 0 && r.ContentLength != end-start+1 {
+		respondWithError(w, http.StatusBadRequest, "Content-Length doesn't match Content-Range", nil)
+		return
+	}
+
+	partial, err := cfg.partialUploads.claim(r.Header.Get("Upload-Token"), videoID, userID)
+	if err != nil {
+		respondWithStatusError(w, err)
+		return
+	}
+	defer cfg.partialUploads.release(partial)
+
+	if start != partial.received {
+		respondWithResumable(w, http.StatusConflict, "Content-Range must start at received_bytes", partial)
+		return
+	}
+	if want := r.Header.Get("Upload-Prefix-SHA256"); want != "" && !strings.EqualFold(want, partial.prefixSHA256()) {
+		cfg.partialUploads.remove(partial)
+		respondWithError(w, http.StatusConflict, "Received data doesn't match the client's file; restart the upload", nil)
+		return
+	}
+
+	file, err := os.OpenFile(partial.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		cfg.partialUploads.remove(partial)
+		respondWithError(w, http.StatusInternalServerError, "Failed to open partial upload", err)
+		return
+	}
+	chunk := end - start + 1
+	body := cfg.uploadProgress.reader(videoID, io.LimitReader(r.Body, chunk), partial.received, total)
+	n, err := io.Copy(io.MultiWriter(file, partial.hash), body)
+	partial.received += n
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n < chunk {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		respondWithResumable(w, http.StatusBadRequest, "Upload interrupted; resume it with the returned token", partial)
+		return
+	}
+	// A body longer than its range means the client and server disagree
+	// about the file; start over rather than guess.
+	if extra, _ := io.Copy(io.Discard, io.LimitReader(r.Body, 1<<20)); extra > 0 {
+		cfg.partialUploads.remove(partial)
+		respondWithLengthMismatch(w, chunk, chunk+extra)
+		return
+	}
+	if partial.received < total {
+		respondWithResumable(w, http.StatusAccepted, "", partial)
+		return
+	}
+
+	// Everything has arrived: process it like a direct upload
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.UserID != userID {
+		cfg.partialUploads.remove(partial)
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+		return
+	}
+	if !checkOverwriteAllowed(w, identity, presentURL(video.VideoURL) != nil) {
+		cfg.partialUploads.remove(partial)
+		return
+	}
+
+	file, err = os.Open(partial.path)
+	if err != nil {
+		cfg.partialUploads.remove(partial)
+		respondWithError(w, http.StatusInternalServerError, "Failed to open partial upload", err)
+		return
+	}
+	// The upload is complete, so it can't be resumed any more
+	cfg.partialUploads.detach(partial)
+	removeFile := func() {
+		file.Close()
+		tempFiles.remove(partial.path)
+	}
+
+	err = cfg.queueVideoProcessing(r.Context(), &video, videoUpload{
+		file:      file,
+		size:      partial.received,
+		mediaType: partial.mediaType,
+		filename:  partial.filename,
+		metadata:  partial.metadata,
+	}, removeFile)
+	if err != nil {
+		removeFile()
+		cfg.uploadProgress.stage(videoID, progressFailed)
+		respondWithQueueError(w, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(partial.received, 10))
+	cfg.auditImpersonation(r, identity, video.ID)
+	cfg.respondWithAccepted(w, r, video)
+}
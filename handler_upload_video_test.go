@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dirUsage returns the total size of the files under dir.
+func dirUsage(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+func TestUploadVideoStreamsToOneTempFile(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Large")
+
+	const size = 48 << 20
+	data := testVideoBytes(size)
+
+	// Stream the body so nothing but the server holds it on disk, with an
+	// unrelated field ahead of the video that must be skipped
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		mw.WriteField("note", "ignored")
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="video"; filename="large.mp4"`)
+		header.Set("Content-Type", "video/mp4")
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		for start := 0; start < len(data); start += 1 << 20 {
+			part.Write(data[start:min(start+1<<20, len(data))])
+		}
+		mw.WriteField("after", "ignored too")
+		pw.CloseWithError(mw.Close())
+	}()
+
+	var peak int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			peak = max(peak, dirUsage(tmp))
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	resp, body := env.do(t, http.MethodPost, "/api/video_upload/"+video.ID, token, mw.FormDataContentType(), pr)
+	if resp.StatusCode != http.StatusAccepted {
+		close(done)
+		t.Fatalf("got %d, want 202: %s", resp.StatusCode, body)
+	}
+	status := env.waitForProcessing(t, token, video.ID)
+	close(done)
+	wg.Wait()
+	if status.ProcessingError != nil {
+		t.Fatalf("processing failed: %s", *status.ProcessingError)
+	}
+
+	if peak < size/2 {
+		t.Fatalf("peak temp usage %d bytes; the upload never reached TMPDIR", peak)
+	}
+	if limit := int64(size) + size/10; peak > limit {
+		t.Errorf("peak temp usage %d bytes for a %d byte upload, want about 1x", peak, size)
+	}
+	if left := dirUsage(tmp); left != 0 {
+		t.Errorf("%d bytes left in TMPDIR after processing", left)
+	}
+}
+
+func TestUploadVideoMultipartErrors(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.maxVideoUploadBytes = 1 << 20
+	})
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Broken forms")
+
+	form := func(write func(mw *multipart.Writer)) (string, io.Reader) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		write(mw)
+		mw.Close()
+		return mw.FormDataContentType(), &body
+	}
+	filePart := func(mw *multipart.Writer, name string, data []byte) {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+name+`"; filename="video.mp4"`)
+		header.Set("Content-Type", "video/mp4")
+		part, _ := mw.CreatePart(header)
+		part.Write(data)
+	}
+
+	tests := []struct {
+		name     string
+		write    func(mw *multipart.Writer)
+		want     int
+		wantCode string
+	}{
+		{"no video part", func(mw *multipart.Writer) {
+			mw.WriteField("title", "no file here")
+		}, http.StatusBadRequest, errorCodeBadRequest},
+		{"video as a plain field", func(mw *multipart.Writer) {
+			mw.WriteField("video", "not a file")
+		}, http.StatusBadRequest, errorCodeBadRequest},
+		{"file under another name", func(mw *multipart.Writer) {
+			filePart(mw, "attachment", testVideoBytes(1024))
+		}, http.StatusBadRequest, errorCodeBadRequest},
+		{"over the size limit", func(mw *multipart.Writer) {
+			filePart(mw, "video", testVideoBytes(2<<20))
+		}, http.StatusRequestEntityTooLarge, errorCodeUploadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, body := form(tt.write)
+			resp, data := env.do(t, http.MethodPost, "/api/video_upload/"+video.ID, token, contentType, body)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %d, want %d: %s", resp.StatusCode, tt.want, data)
+			}
+			if code := errorCode(t, data); code != tt.wantCode {
+				t.Errorf("code = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	maxBulkDeleteIDs      = 100
+	bulkDeleteConcurrency = 4
+)
+
+// Per-item outcomes reported by the bulk delete endpoint.
+const (
+	bulkDeleteDeleted       = "deleted"
+	bulkDeleteNotFound      = "not_found"
+	bulkDeleteForbidden     = "forbidden"
+	bulkDeleteCleanupFailed = "cleanup_failed"
+)
+
+func (cfg *apiConfig) handlerVideosBulkDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IDs []uuid.UUID `json:"ids"`
+	}
+	type result struct {
+		ID     uuid.UUID `json:"id"`
+		Result string    `json:"result"`
+	}
+	type response struct {
+		Results []result `json:"results"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	if !checkDestructiveAllowed(w, identity) {
+		return
+	}
+	userID := identity.UserID
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.IDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No video IDs given", nil)
+		return
+	}
+	if len(params.IDs) > maxBulkDeleteIDs {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("At most %d videos can be deleted at once", maxBulkDeleteIDs), nil)
+		return
+	}
+
+	// Each item is independent: one failure must not stop the rest
+	results := make([]result, len(params.IDs))
+	var g errgroup.Group
+	g.SetLimit(bulkDeleteConcurrency)
+	for i, id := range params.IDs {
+		g.Go(func() error {
+			results[i] = result{ID: id, Result: cfg.bulkDeleteOne(r.Context(), id, userID)}
+			return nil
+		})
+	}
+	g.Wait()
+	for _, res := range results {
+		if res.Result == bulkDeleteDeleted {
+			cfg.auditImpersonation(r, identity, res.ID)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Results: results})
+}
+
+func (cfg *apiConfig) bulkDeleteOne(ctx context.Context, videoID, userID uuid.UUID) string {
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		log.Printf("bulk delete: couldn't get video %s: %v", videoID, err)
+		return bulkDeleteCleanupFailed
+	}
+	if video.ID == uuid.Nil {
+		return bulkDeleteNotFound
+	}
+	if video.UserID != userID {
+		return bulkDeleteForbidden
+	}
+	if err := cfg.trashVideo(ctx, video, time.Now()); err != nil {
+		log.Printf("bulk delete: couldn't delete video %s: %v", videoID, err)
+		return bulkDeleteCleanupFailed
+	}
+	return bulkDeleteDeleted
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// maxDownloadFilenameLength bounds the title part of a download's filename,
+// in runes.
+const maxDownloadFilenameLength = 200
+
+// errRangeNotSatisfiable is returned by parseByteRange for a range that
+// starts past the end of the object.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseByteRange resolves a Range header against an object of size bytes
+// to the offset and length to send, and whether that is a partial
+// response. Only a single bytes range is honored: anything else, malformed
+// or multipart, gets the whole object, as RFC 9110 allows.
+func parseByteRange(header string, size int64) (offset, length int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+
+	if first == "" {
+		// A suffix range: the final n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, size, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
+
+// downloadFilename turns a video title into a filename ending in .mp4.
+// Characters filesystems or headers choke on become underscores.
+func downloadFilename(title string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r) || r == unicode.ReplacementChar:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, title)
+	name = strings.Trim(name, " .")
+	if runes := []rune(name); len(runes) > maxDownloadFilenameLength {
+		name = strings.TrimRight(string(runes[:maxDownloadFilenameLength]), " .")
+	}
+	if name == "" {
+		name = "video"
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".mp4") {
+		name += ".mp4"
+	}
+	return name
+}
+
+// contentDispositionAttachment returns a Content-Disposition header saving
+// the response as filename.
+func contentDispositionAttachment(filename string) string {
+	return contentDisposition("attachment", filename)
+}
+
+// contentDisposition returns a Content-Disposition header of type
+// disposition naming filename. Names that aren't plain ASCII also get an
+// RFC 5987 filename*, which browsers prefer, behind an ASCII fallback.
+func contentDisposition(disposition, filename string) string {
+	ascii := strings.Map(func(r rune) rune {
+		// Some browsers decode percent signs even in the plain parameter
+		if r >= utf8.RuneSelf || r == '%' {
+			return '_'
+		}
+		return r
+	}, filename)
+	header := disposition + `; filename="` + ascii + `"`
+	if ascii != filename {
+		header += "; filename*=UTF-8''" + rfc5987Escape(filename)
+	}
+	return header
+}
+
+// rfc5987Escape percent-encodes s as an RFC 5987 ext-value, leaving only
+// attr-chars unescaped.
+func rfc5987Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < utf8.RuneSelf && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// handlerVideoDownload streams a video through the server as an attachment
+// named after its title, for a "Download" button: signed URLs can't set
+// the filename. Single byte ranges are passed on to storage, so
+// interrupted downloads resume. Anyone who may watch the video may
+// download it.
+func (cfg *apiConfig) handlerVideoDownload(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.checkVideoVisible(w, r, video) {
+		return
+	}
+	if !cfg.checkVideoPassword(w, r, video) {
+		return
+	}
+	if presentURL(video.VideoURL) == nil {
+		respondWithError(w, http.StatusNotFound, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	store, key, ok := cfg.videoObject(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Video URL doesn't point at a configured storage backend", nil)
+		return
+	}
+	getter, ok := store.(storage.Getter)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, fmt.Sprintf("%s storage can't stream downloads", store.Name()), nil)
+		return
+	}
+
+	ctx := r.Context()
+	var info storage.ObjectInfo
+	err = timed(ctx, store.Name()+"_head", func() (err error) {
+		info, err = store.Head(ctx, key)
+		return err
+	}, "key", key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video file is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't check video file", err)
+		return
+	}
+
+	offset, length, partial, err := parseByteRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Requested range isn't satisfiable", nil)
+		return
+	}
+
+	// The request's context reaches the storage read, so a client that
+	// hangs up aborts it. The read starts before any headers are set, so a
+	// failure isn't sent as an attachment.
+	body := io.ReadCloser(http.NoBody)
+	if r.Method != http.MethodHead && length > 0 {
+		body, err = getter.Get(ctx, key, offset, length)
+		if errors.Is(err, storage.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, "Video file is missing", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't read video file", err)
+			return
+		}
+	}
+	defer body.Close()
+
+	contentType := "video/mp4"
+	if video.ContentType != nil && *video.ContentType != "" {
+		contentType = *video.ContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDispositionAttachment(downloadFilename(video.Title)))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Cache-Control", "private")
+	status := http.StatusOK
+	if partial {
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	// Resumed downloads aren't counted again
+	if offset == 0 {
+		cfg.recordAccess(r, video.ID, database.AccessEventDownload, nil)
+	}
+	w.WriteHeader(status)
+	if n, err := io.Copy(w, body); err != nil {
+		responseLogger(w).Warn("Download interrupted", slog.Int64("sent", n), slog.Int64("length", length), slog.Any("error", err))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header                 string
+		size                   int64
+		offset, length         int64
+		partial, unsatisfiable bool
+	}{
+		{"", 1000, 0, 1000, false, false},
+		{"bytes=0-99", 1000, 0, 100, true, false},
+		{"bytes=100-199", 1000, 100, 100, true, false},
+		{"bytes=900-", 1000, 900, 100, true, false},
+		{"bytes=999-999", 1000, 999, 1, true, false},
+		// The end is clamped to the object
+		{"bytes=900-5000", 1000, 900, 100, true, false},
+		{"bytes=-100", 1000, 900, 100, true, false},
+		{"bytes=-5000", 1000, 0, 1000, true, false},
+		{"bytes=1000-", 1000, 0, 0, false, true},
+		{"bytes=-0", 1000, 0, 0, false, true},
+		{"bytes=-10", 0, 0, 0, false, true},
+		// Anything not understood gets the whole object
+		{"bytes=0-9,20-29", 1000, 0, 1000, false, false},
+		{"bytes=200-100", 1000, 0, 1000, false, false},
+		{"bytes=abc-", 1000, 0, 1000, false, false},
+		{"bytes=-abc", 1000, 0, 1000, false, false},
+		{"bytes=100", 1000, 0, 1000, false, false},
+		{"items=0-99", 1000, 0, 1000, false, false},
+	}
+	for _, tt := range tests {
+		offset, length, partial, err := parseByteRange(tt.header, tt.size)
+		if tt.unsatisfiable {
+			if err != errRangeNotSatisfiable {
+				t.Errorf("parseByteRange(%q, %d) error = %v, want errRangeNotSatisfiable", tt.header, tt.size, err)
+			}
+			continue
+		}
+		if err != nil || offset != tt.offset || length != tt.length || partial != tt.partial {
+			t.Errorf("parseByteRange(%q, %d) = %d, %d, %v, %v; want %d, %d, %v", tt.header, tt.size, offset, length, partial, err, tt.offset, tt.length, tt.partial)
+		}
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	tests := []struct {
+		title, want string
+	}{
+		{"Holiday", "Holiday.mp4"},
+		{"Holiday.MP4", "Holiday.MP4"},
+		{`a/b\c:d*e?f"g<h>i|j`, "a_b_c_d_e_f_g_h_i_j.mp4"},
+		{"tab\there\x00", "tabhere.mp4"},
+		{"  .hidden. ", "hidden.mp4"},
+		{"", "video.mp4"},
+		{"...", "video.mp4"},
+		{"Café ☕", "Café ☕.mp4"},
+		{strings.Repeat("é", maxDownloadFilenameLength+10), strings.Repeat("é", maxDownloadFilenameLength) + ".mp4"},
+	}
+	for _, tt := range tests {
+		if got := downloadFilename(tt.title); got != tt.want {
+			t.Errorf("downloadFilename(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestContentDispositionAttachment(t *testing.T) {
+	tests := []struct {
+		filename, want string
+	}{
+		{"Holiday.mp4", `attachment; filename="Holiday.mp4"`},
+		{"Café ☕.mp4", `attachment; filename="Caf_ _.mp4"; filename*=UTF-8''Caf%C3%A9%20%E2%98%95.mp4`},
+		{"100%.mp4", `attachment; filename="100_.mp4"; filename*=UTF-8''100%25.mp4`},
+		{"a'b (1).mp4", `attachment; filename="a'b (1).mp4"`},
+	}
+	for _, tt := range tests {
+		if got := contentDispositionAttachment(tt.filename); got != tt.want {
+			t.Errorf("contentDispositionAttachment(%q) =\n%s\nwant\n%s", tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestVideoDownloadRanges(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Café")
+	stored, ok := env.s3.Object(testBucket, env.storedVideoKey(t, video.ID))
+	if !ok {
+		t.Fatal("uploaded video isn't stored")
+	}
+	size := int64(len(stored.Data))
+	path := "/api/videos/" + video.ID + "/download"
+
+	resp, body := env.do(t, http.MethodGet, path, token, "", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, stored.Data) {
+		t.Fatalf("download: got %d with %d bytes, want 200 with the %d stored", resp.StatusCode, len(body), size)
+	}
+	if got, want := resp.Header.Get("Content-Disposition"), `attachment; filename="Caf_.mp4"; filename*=UTF-8''Caf%C3%A9.mp4`; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Accept-Ranges = %q", resp.Header.Get("Accept-Ranges"))
+	}
+
+	resp, body = env.do(t, http.MethodGet, path, token, "", nil, "Range", "bytes=-100")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, stored.Data[size-100:]) {
+		t.Errorf("suffix range: got %d with %d bytes, want 206 with the last 100", resp.StatusCode, len(body))
+	}
+	if got, want := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", size-100, size-1, size); got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+
+	resp, body = env.do(t, http.MethodGet, path, token, "", nil, "Range", fmt.Sprintf("bytes=%d-", size))
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: got %d: %s", resp.StatusCode, body)
+	}
+	if got, want := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes */%d", size); got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	if resp.Header.Get("Content-Disposition") != "" {
+		t.Error("an error was sent as an attachment")
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -14,6 +17,9 @@ import (
 func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		database.CreateVideoParams
+		// AutoSuffix resolves a duplicate title under the unique titles
+		// policy by appending " (2)", " (3)", ... instead of failing.
+		AutoSuffix bool `json:"auto_suffix"`
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
@@ -21,28 +27,57 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	userID := identity.UserID
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
 		return
 	}
 	params.UserID = userID
+	params.Title = strings.TrimSpace(params.Title)
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	if err := validateVideoMetadata(params.Title, params.Description); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	if cfg.countDraftsTowardLimit {
+		count, exceeded, err := cfg.videoLimitExceeded(userID, false)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+			return
+		}
+		if exceeded {
+			respondWithVideoLimit(w, count, cfg.maxVideosPerUser)
+			return
+		}
+	}
+
+	var video database.Video
+	_, err = saveWithUniqueTitle(params.Title, params.AutoSuffix, func(title string) error {
+		create := params.CreateVideoParams
+		create.Title = title
+		video, err = cfg.db.CreateVideo(create)
+		return err
+	})
+	if errors.Is(err, database.ErrDuplicateTitle) {
+		cfg.respondWithDuplicateTitle(w, userID, params.Title)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, video)
+	respondWithJSON(w, http.StatusCreated, newOwnerVideoResponse(video))
 }
 
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
@@ -58,27 +93,36 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	if !checkDestructiveAllowed(w, identity) {
+		return
+	}
+	userID := identity.UserID
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(videoID, false)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
 		return
 	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+		respondWithError(w, http.StatusForbidden, "You can't delete this video", nil)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.trashVideo(r.Context(), video, time.Now())
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.auditImpersonation(r, identity, video.ID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -91,30 +135,49 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(videoID, true)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
-		return
-	}
-
-	// If a video file exists, ensure response has a CloudFront URL when legacy format is encountered
-	if video.VideoURL != nil && *video.VideoURL != "" {
-		// Case 1: legacy DB format "bucket,key"
-		parts := strings.SplitN(*video.VideoURL, ",", 2)
-		if len(parts) == 2 {
-			_ = strings.TrimSpace(parts[0])
-			key := strings.TrimSpace(parts[1])
-			publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
-			video.VideoURL = &publicURL
-		} else if strings.HasPrefix(*video.VideoURL, "https://LOCAL/") {
-			// Case 2: previously stored LOCAL domain, rewrite to CloudFront
-			path := strings.TrimPrefix(*video.VideoURL, "https://LOCAL/")
-			publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, path)
-			video.VideoURL = &publicURL
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	// Owners still see their videos in the trash, flagged and unplayable
+	if video.DeletedAt != nil {
+		if cfg.optionalUserID(r) != video.UserID {
+			respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
+			return
 		}
+		w.Header().Set("ETag", videoETag(video))
+		cfg.prepareListedVideo(r.Context(), &video)
+		respondWithJSON(w, http.StatusOK, newOwnerVideoResponse(video))
+		return
+	}
+	if !cfg.checkVideoVisible(w, r, video) {
+		return
+	}
+	if !cfg.checkVideoPassword(w, r, video) {
+		return
+	}
+	if !cfg.checkEmbedOrigin(w, r, video) {
+		return
+	}
+
+	cfg.rewriteLegacyVideoURL(&video)
+
+	if presentURL(video.VideoURL) != nil {
+		cfg.recordAccess(r, video.ID, database.AccessEventURLIssued, nil)
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	w.Header().Set("ETag", videoETag(video))
+	cfg.signVideoURL(r.Context(), &video)
+	if cfg.optionalUserID(r) == video.UserID {
+		respondWithJSON(w, http.StatusOK, newOwnerVideoResponse(video))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newVideoResponse(video))
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -123,35 +186,69 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	userID := identity.UserID
+
+	includeDrafts := true
+	switch r.URL.Query().Get("drafts") {
+	case "", "include":
+	case "exclude":
+		includeDrafts = false
+	default:
+		respondWithError(w, http.StatusBadRequest, "drafts must be include or exclude", nil)
+		return
+	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	// Any paging parameter opts in to pages; without them the whole list
+	// is returned as a plain array, as it always was
+	query := r.URL.Query()
+	if query.Has("limit") || query.Has("cursor") || query.Has("sort") || query.Has("order") {
+		cfg.respondWithVideoPage(w, r, database.VideoPageParams{UserID: userID, IncludeDrafts: includeDrafts}, true)
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(userID, includeDrafts)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	for i := range videos {
+		cfg.prepareListedVideo(r.Context(), &videos[i])
+	}
 
-	for i, v := range videos {
-		video := v
-		if video.VideoURL != nil && *video.VideoURL != "" {
-			parts := strings.SplitN(*video.VideoURL, ",", 2)
-			if len(parts) == 2 {
-				_ = strings.TrimSpace(parts[0])
-				key := strings.TrimSpace(parts[1])
-				publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
-				video.VideoURL = &publicURL
-			} else if strings.HasPrefix(*video.VideoURL, "https://LOCAL/") {
-				path := strings.TrimPrefix(*video.VideoURL, "https://LOCAL/")
-				publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, path)
-				video.VideoURL = &publicURL
-			}
+	setResponseMeta(w, "count", len(videos))
+	// Without enforcement, duplicates are surfaced so UIs can warn
+	if unique, err := cfg.db.GetUniqueTitles(userID); err == nil && !unique {
+		if conflicts, err := cfg.db.GetTitleConflicts(userID); err == nil {
+			setResponseMeta(w, "title_conflicts", conflicts)
 		}
-		videos[i] = video
 	}
+	respondWithJSON(w, http.StatusOK, newVideoResponses(videos))
+}
 
-	respondWithJSON(w, http.StatusOK, videos)
+// prepareListedVideo rewrites legacy video URLs to the distribution and
+// signs them, as every listing returns them.
+func (cfg *apiConfig) prepareListedVideo(ctx context.Context, video *database.Video) {
+	cfg.rewriteLegacyVideoURL(video)
+	cfg.signVideoURL(ctx, video)
+}
+
+// rewriteLegacyVideoURL points video URLs stored in legacy formats, a
+// "bucket,key" pair or the https://LOCAL/ placeholder domain, at the
+// distribution. Local storage references are left for signVideoURL.
+func (cfg *apiConfig) rewriteLegacyVideoURL(video *database.Video) {
+	if presentURL(video.VideoURL) == nil || isLocalVideoURL(*video.VideoURL) {
+		return
+	}
+	if _, key, ok := strings.Cut(*video.VideoURL, ","); ok {
+		publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, strings.TrimSpace(key))
+		video.VideoURL = &publicURL
+	} else if path, ok := strings.CutPrefix(*video.VideoURL, "https://LOCAL/"); ok {
+		publicURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, path)
+		video.VideoURL = &publicURL
+	}
 }
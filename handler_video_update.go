@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	// Omitted fields are left unchanged; an empty password removes protection.
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+		Password    *string `json:"password"`
+		// An empty list lifts the embed restriction.
+		AllowedEmbedOrigins *[]string `json:"allowed_embed_origins"`
+		AutoSuffix          bool      `json:"auto_suffix"`
+		Visibility          *string   `json:"visibility"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	userID := identity.UserID
+
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+	if !ifMatchSatisfied(r, videoETag(video)) {
+		respondWithPreconditionFailed(w, video)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if params.Title != nil {
+		video.Title = strings.TrimSpace(*params.Title)
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	if err := validateVideoMetadata(video.Title, video.Description); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	// Who may watch the video decides where its objects are stored
+	wasPublic := publiclyStored(video)
+	if params.Password != nil {
+		if *params.Password == "" {
+			video.PasswordHash = nil
+		} else {
+			hash, err := auth.HashPassword(*params.Password)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+				return
+			}
+			video.PasswordHash = &hash
+		}
+		video.PasswordProtected = video.PasswordHash != nil
+	}
+
+	if params.AllowedEmbedOrigins != nil {
+		origins, err := normalizeEmbedOrigins(*params.AllowedEmbedOrigins)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		video.AllowedEmbedOrigins = origins
+	}
+
+	if params.Visibility != nil {
+		if !validVisibility(*params.Visibility) {
+			respondWithError(w, http.StatusBadRequest, "visibility must be private, unlisted or public", nil)
+			return
+		}
+		video.Visibility = *params.Visibility
+	}
+
+	// Moving between private and public storage copies the video's
+	// files first; the copies are dropped again if the row isn't saved
+	saved := false
+	movedFrom, cleanupMoved, err := cfg.relocateVideoObjects(r.Context(), &video, wasPublic)
+	if errors.Is(err, errVisibilityProcessing) {
+		respondWithError(w, http.StatusConflict, "Video is still processing; change who can watch it once it's done", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't move the video's files", err)
+		return
+	}
+	defer func() {
+		if !saved {
+			cleanupMoved()
+		}
+	}()
+
+	// With If-Match, the version check is repeated in the UPDATE so a write
+	// that lands between our read and this one can't be clobbered.
+	updated := true
+	title := video.Title
+	video.Title, err = saveWithUniqueTitle(title, params.AutoSuffix, func(newTitle string) error {
+		candidate := video
+		candidate.Title = newTitle
+		var err error
+		if r.Header.Get("If-Match") != "" {
+			updated, err = cfg.db.UpdateVideoIfVersion(candidate, video.Version)
+		} else {
+			err = cfg.db.UpdateVideo(candidate)
+		}
+		return err
+	})
+	if errors.Is(err, database.ErrDuplicateTitle) {
+		cfg.respondWithDuplicateTitle(w, userID, title)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !updated {
+		current, err := cfg.db.GetVideo(videoID, false)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error retrieving video", err)
+			return
+		}
+		if current.ID == uuid.Nil {
+			respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Video not found", nil)
+			return
+		}
+		respondWithPreconditionFailed(w, current)
+		return
+	}
+	video.Version++
+	saved = true
+	cfg.deleteReplacedVideo(r.Context(), movedFrom...)
+
+	cfg.auditImpersonation(r, identity, video.ID)
+	w.Header().Set("ETag", videoETag(video))
+	cfg.prepareListedVideo(r.Context(), &video)
+	respondWithJSON(w, http.StatusOK, newOwnerVideoResponse(video))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// handlerVideoSignedURL hands an owner a fresh URL for their video, for
+// replacing a signed link that has expired without fetching the whole
+// video. expires_at is null when the URL isn't signed and doesn't expire,
+// as for public and unlisted videos.
+func (cfg *apiConfig) handlerVideoSignedURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoURL  string     `json:"video_url"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	video, ok := cfg.ownedVideoFromPath(w, r)
+	if !ok {
+		return
+	}
+	cfg.rewriteLegacyVideoURL(&video)
+	if presentURL(video.VideoURL) == nil {
+		respondWithError(w, http.StatusNotFound, "Video hasn't been uploaded yet", nil)
+		return
+	}
+
+	issuedAt := time.Now().UTC()
+	rawURL := *video.VideoURL
+	signed, expiry := cfg.signStoredURL(r.Context(), &video, rawURL)
+	if signed == "" {
+		respondWithError(w, http.StatusBadGateway, "Couldn't sign video URL", nil)
+		return
+	}
+	resp := response{VideoURL: signed}
+	if expiry > 0 && signed != rawURL {
+		expiresAt := issuedAt.Add(expiry)
+		resp.ExpiresAt = &expiresAt
+	}
+	cfg.recordAccess(r, video.ID, database.AccessEventURLIssued, nil)
+
+	// The URL is personal and expires; shared caches mustn't keep it
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerRefreshVideoURLs heads the object behind every uploaded video and
+// reports the ones that are gone, to find rows that have drifted from the
+// bucket. Signed URLs are issued per request, so once an object is known
+// to exist its video's next URL is playable; nothing is rewritten.
+func (cfg *apiConfig) handlerRefreshVideoURLs(w http.ResponseWriter, r *http.Request) {
+	type object struct {
+		VideoID string `json:"video_id"`
+		Storage string `json:"storage"`
+		Key     string `json:"key"`
+	}
+	type failure struct {
+		VideoID string `json:"video_id"`
+		Error   string `json:"error"`
+	}
+	type response struct {
+		Checked int       `json:"checked"`
+		Present int       `json:"present"`
+		Missing []object  `json:"missing"`
+		Failed  []failure `json:"failed"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	videos, err := cfg.db.GetVideosWithVideoURLs()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	ctx := r.Context()
+	resp := response{Missing: []object{}, Failed: []failure{}}
+	for _, video := range videos {
+		if ctx.Err() != nil {
+			break
+		}
+		resp.Checked++
+		store, key, ok := cfg.videoObject(*video.VideoURL)
+		if !ok {
+			resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: "video URL doesn't point at a configured storage backend"})
+			continue
+		}
+		err := timed(ctx, store.Name()+"_head", func() error {
+			_, err := store.Head(ctx, key)
+			return err
+		}, "key", key)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			resp.Missing = append(resp.Missing, object{VideoID: video.ID.String(), Storage: storageLabel(store), Key: key})
+		case err != nil:
+			resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: err.Error()})
+		default:
+			resp.Present++
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
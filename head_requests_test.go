@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+func TestHeadMatchesGet(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Probed")
+	env.s3.PutObject(testBucket, "hls/"+video.ID+"/set/index.m3u8", storagetest.FakeObject{Data: []byte("#EXTM3U\nseg0.ts\n")})
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.HLSURL = ptr(env.cfg.storedVideoURL("hls/" + video.ID + "/set/index.m3u8"))
+	})
+	if err := os.WriteFile(filepath.Join(env.cfg.assetsRoot, "probe.jpg"), []byte("not really a jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, path, token string
+		status            int
+	}{
+		{"video", "/api/videos/" + video.ID, token, http.StatusOK},
+		{"missing video", "/api/videos/00000000-0000-0000-0000-000000000000", token, http.StatusNotFound},
+		{"video list without a token", "/api/videos", "", http.StatusUnauthorized},
+		{"manifest", "/api/videos/" + video.ID + "/hls.m3u8", token, http.StatusOK},
+		{"download", "/api/videos/" + video.ID + "/download", token, http.StatusOK},
+		{"asset", defaultAssetsPath + "/probe.jpg", "", http.StatusOK},
+		{"missing asset", defaultAssetsPath + "/missing.jpg", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get, getBody := env.do(t, http.MethodGet, tt.path, tt.token, "", nil)
+			head, headBody := env.do(t, http.MethodHead, tt.path, tt.token, "", nil)
+			if get.StatusCode != tt.status || head.StatusCode != tt.status {
+				t.Fatalf("GET got %d, HEAD got %d, want %d", get.StatusCode, head.StatusCode, tt.status)
+			}
+			if len(headBody) != 0 {
+				t.Errorf("HEAD sent a %d byte body", len(headBody))
+			}
+			if got, want := head.Header.Get("Content-Length"), strconv.Itoa(len(getBody)); got != want {
+				t.Errorf("HEAD Content-Length = %q, want the GET body's %s", got, want)
+			}
+			for _, name := range []string{"Content-Type", "Accept-Ranges", "Content-Disposition", "ETag"} {
+				if got, want := head.Header.Get(name), get.Header.Get(name); got != want {
+					t.Errorf("HEAD %s = %q, GET sent %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadDownloadDoesNotReadObject(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Not read")
+	gets := env.s3.Calls("GetObject")
+
+	resp, body := env.do(t, http.MethodHead, "/api/videos/"+video.ID+"/download", token, "", nil, "Range", "bytes=0-99")
+	if resp.StatusCode != http.StatusPartialContent || len(body) != 0 {
+		t.Fatalf("HEAD with a range: got %d with %d bytes, want 206 and no body", resp.StatusCode, len(body))
+	}
+	if got := resp.Header.Get("Content-Length"); got != "100" {
+		t.Errorf("Content-Length = %q, want 100", got)
+	}
+	if got := env.s3.Calls("GetObject") - gets; got != 0 {
+		t.Errorf("HEAD made %d GetObject calls, want none", got)
+	}
+	if env.s3.Calls("HeadObject") == 0 {
+		t.Error("HEAD didn't check the object with HeadObject")
+	}
+}
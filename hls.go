@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// hlsFailedWarning is added to a video's processing warnings when the HLS
+// set couldn't be made; the MP4 is still stored and playable.
+const hlsFailedWarning = "hls_failed"
+
+const (
+	hlsPlaylistContentType = "application/vnd.apple.mpegurl"
+	hlsSegmentContentType  = "video/mp2t"
+)
+
+// storeHLS packages filePath as HLS and uploads the playlist and segments
+// to the artifacts bucket under hls/{videoID}/{random}/, and returns the
+// playlist's stored URL. Each upload
+// gets a fresh prefix, even for identical content, so replacing a set never
+// deletes the new one. Failures are logged and reported as a warning
+// rather than failing the upload.
+func (cfg *apiConfig) storeHLS(ctx context.Context, filePath string, videoID uuid.UUID) (string, []string) {
+	var rnd [16]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		log.Printf("couldn't name HLS set for video %s: %v", videoID, err)
+		return "", []string{hlsFailedWarning}
+	}
+	prefix := fmt.Sprintf("hls/%s/%x/", videoID, rnd)
+	store := cfg.artifactStore()
+	if err := cfg.storeHLSSet(ctx, store, filePath, prefix); err != nil {
+		log.Printf("couldn't store HLS set %s: %v", prefix, err)
+		if err := cfg.deleteS3Prefix(ctx, cfg.s3ArtifactsBucket, prefix); err != nil {
+			log.Printf("couldn't delete partial HLS set %s: %v", prefix, err)
+		}
+		return "", []string{hlsFailedWarning}
+	}
+	return cfg.storedObjectURL(store, prefix+hlsPlaylistName), nil
+}
+
+func (cfg *apiConfig) storeHLSSet(ctx context.Context, store storage.Storage, filePath, prefix string) error {
+	dir, err := packageHLS(ctx, cfg.appName, filePath)
+	if err != nil {
+		return err
+	}
+	defer tempFiles.remove(dir)
+
+	playlist, err := os.ReadFile(filepath.Join(dir, hlsPlaylistName))
+	if err != nil {
+		return err
+	}
+	segments, err := hlsSegments(playlist)
+	if err != nil {
+		return err
+	}
+	// The playlist goes last so it never names a segment that isn't there
+	for _, name := range segments {
+		if err := cfg.uploadHLSFile(ctx, store, filepath.Join(dir, name), prefix+name, hlsSegmentContentType); err != nil {
+			return err
+		}
+	}
+	return cfg.uploadHLSFile(ctx, store, filepath.Join(dir, hlsPlaylistName), prefix+hlsPlaylistName, hlsPlaylistContentType)
+}
+
+func (cfg *apiConfig) uploadHLSFile(ctx context.Context, store storage.Storage, filePath, key, contentType string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cfg.storeObjectIn(ctx, store, key, contentType, f, nil)
+}
+
+// hlsSegments returns the segment URIs in playlist, checking that each is
+// a bare file name. Anything else would resolve outside the uploaded set.
+func hlsSegments(playlist []byte) ([]string, error) {
+	var segments []string
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.ContainsAny(line, `/\?#:`) || line == "." || line == ".." {
+			return nil, fmt.Errorf("playlist refers to %q, not a relative segment name", line)
+		}
+		segments = append(segments, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("playlist has no segments")
+	}
+	return segments, nil
+}
+
+// hlsPrefix returns the bucket and key prefix holding the HLS set whose
+// playlist is at hlsURL.
+func (cfg *apiConfig) hlsPrefix(hlsURL string) (string, string, bool) {
+	bucket, key, ok := cfg.s3Object(hlsURL)
+	if !ok || !strings.HasPrefix(key, "hls/") {
+		return "", "", false
+	}
+	return bucket, path.Dir(key) + "/", true
+}
+
+// deleteHLS deletes the HLS set behind hlsURL, if any.
+func (cfg *apiConfig) deleteHLS(ctx context.Context, hlsURL *string) error {
+	if presentURL(hlsURL) == nil {
+		return nil
+	}
+	bucket, prefix, ok := cfg.hlsPrefix(*hlsURL)
+	if !ok {
+		return nil
+	}
+	return cfg.deleteS3Prefix(ctx, bucket, prefix)
+}
+
+// deleteReplacedHLS deletes the HLS set behind hlsURL once no row refers to
+// it. Like deleteReplacedVideo, failures are only logged.
+func (cfg *apiConfig) deleteReplacedHLS(ctx context.Context, hlsURL *string) {
+	if err := cfg.deleteHLS(ctx, hlsURL); err != nil {
+		log.Printf("couldn't delete replaced HLS set %s: %v", *hlsURL, err)
+	}
+}
+
+// deleteS3Prefix deletes every object under prefix, a page of keys at a
+// time.
+func (cfg *apiConfig) deleteS3Prefix(ctx context.Context, bucket, prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{Bucket: &bucket, Prefix: &prefix})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		ids := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			ids = append(ids, types.ObjectIdentifier{Key: obj.Key})
+		}
+		out, err := cfg.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: &bucket, Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)}})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("couldn't delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return nil
+}
+
+// hlsPlaylistPath is where clients fetch a video's playlist when segment
+// URLs have to be signed. Canned-policy signatures cover a single URL, so
+// the stored playlist's relative segment names can't be used as they are.
+func hlsPlaylistPath(videoID uuid.UUID) string {
+	return "/api/videos/" + videoID.String() + "/hls.m3u8"
+}
+
+// handlerVideoHLSPlaylist serves a video's HLS playlist with every segment
+// rewritten to an absolute distribution URL, signed when a CloudFront key
+// pair is configured, or presigned when the set is in a bucket the
+// distribution doesn't serve. Access is checked the same way as for the video
+// itself.
+func (cfg *apiConfig) handlerVideoHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.checkVideoVisible(w, r, video) {
+		return
+	}
+	if !cfg.checkVideoPassword(w, r, video) {
+		return
+	}
+	if !cfg.checkEmbedOrigin(w, r, video) {
+		return
+	}
+	if presentURL(video.HLSURL) == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no HLS playlist", nil)
+		return
+	}
+	bucket, key, ok := cfg.s3Object(*video.HLSURL)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Video has no HLS playlist", nil)
+		return
+	}
+
+	out, err := cfg.s3Client.GetObject(r.Context(), &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch HLS playlist", err)
+		return
+	}
+	defer out.Body.Close()
+	playlist, err := io.ReadAll(io.LimitReader(out.Body, 1<<20))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch HLS playlist", err)
+		return
+	}
+
+	base := (*video.HLSURL)[:strings.LastIndex(*video.HLSURL, "/")+1]
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			line, _ = cfg.signStoredURL(r.Context(), &video, base+trimmed)
+			if line == "" {
+				respondWithError(w, http.StatusBadGateway, "Couldn't sign HLS segment", nil)
+				return
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	cfg.recordAccess(r, video.ID, database.AccessEventURLIssued, nil)
+	w.Header().Set("Content-Type", hlsPlaylistContentType)
+	// Signed segment URLs expire, so the rewritten playlist mustn't be reused
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// idempotencyKeyTTL is how long a response is replayed for retries with
+// the same Idempotency-Key, and kept before the janitor deletes it.
+const idempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyScope is an Idempotency-Key as one user sent it for one video.
+type idempotencyScope struct {
+	userID  uuid.UUID
+	videoID uuid.UUID
+	key     string
+}
+
+// idempotencyLocks tracks which keys have a request in flight. It lives in
+// memory so a crash can't leave a key locked until it expires.
+type idempotencyLocks struct {
+	mu       sync.Mutex
+	inFlight map[idempotencyScope]bool
+}
+
+func newIdempotencyLocks() *idempotencyLocks {
+	return &idempotencyLocks{inFlight: map[idempotencyScope]bool{}}
+}
+
+// lock claims scope, reporting false if another request holds it.
+func (l *idempotencyLocks) lock(scope idempotencyScope) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[scope] {
+		return false
+	}
+	l.inFlight[scope] = true
+	return true
+}
+
+func (l *idempotencyLocks) unlock(scope idempotencyScope) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.inFlight, scope)
+}
+
+// validIdempotencyKey reports whether key is non-empty, no longer than
+// maxIdempotencyKeyLength and printable ASCII.
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyRecorder keeps a copy of the response it passes through, so
+// a successful one can be saved for replay.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *idempotencyRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *idempotencyRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// beginIdempotent honors an Idempotency-Key header on a request userID
+// makes for videoID. When a response was saved under the key within
+// idempotencyKeyTTL it is replayed; while another request with the key is
+// in flight it responds 409. Either way, or if the key is invalid, it
+// returns false. Otherwise the handler must respond through the returned
+// writer and defer finish, which saves a successful response under the
+// key. Failures aren't saved, so the client can retry them. Without the
+// header w is returned as is.
+func (cfg *apiConfig) beginIdempotent(w http.ResponseWriter, r *http.Request, userID, videoID uuid.UUID) (_ http.ResponseWriter, finish func(), ok bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return w, func() {}, true
+	}
+	if !validIdempotencyKey(key) {
+		respondWithError(w, http.StatusBadRequest, "Idempotency-Key must be 1 to 255 printable ASCII characters", nil)
+		return nil, nil, false
+	}
+
+	scope := idempotencyScope{userID: userID, videoID: videoID, key: key}
+	if !cfg.idempotencyLocks.lock(scope) {
+		respondWithErrorCode(w, http.StatusConflict, errorCodeConflict, "A request with this Idempotency-Key is in progress", nil)
+		return nil, nil, false
+	}
+	// The lock is held while checking, so a response saved by the
+	// request before this one is always seen
+	saved, err := cfg.db.GetIdempotentResponse(userID, videoID, key, time.Now().Add(-idempotencyKeyTTL))
+	if err != nil {
+		cfg.idempotencyLocks.unlock(scope)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check Idempotency-Key", err)
+		return nil, nil, false
+	}
+	if saved.StatusCode != 0 {
+		cfg.idempotencyLocks.unlock(scope)
+		cfg.replayIdempotentResponse(w, r, saved)
+		return nil, nil, false
+	}
+
+	rec := &idempotencyRecorder{ResponseWriter: w}
+	return rec, func() {
+		defer cfg.idempotencyLocks.unlock(scope)
+		if rec.status < 200 || rec.status >= 300 {
+			return
+		}
+		err := cfg.db.SaveIdempotentResponse(database.IdempotentResponse{
+			UserID:      userID,
+			VideoID:     videoID,
+			Key:         key,
+			StatusCode:  rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Location:    rec.Header().Get("Location"),
+			Body:        rec.body.Bytes(),
+			CreatedAt:   time.Now(),
+		})
+		if err != nil {
+			requestLogger(r.Context()).Error("couldn't save response for Idempotency-Key", slog.String("key", key), slog.Any("error", err))
+		}
+	}, true
+}
+
+// replayIdempotentResponse sends a saved response again, marked with
+// Idempotent-Replayed so clients can tell. An accepted upload's body holds
+// signed thumbnail URLs that may have expired since, so it is rebuilt from
+// the video as it is now; the saved body is only sent if the video is
+// gone.
+func (cfg *apiConfig) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, saved database.IdempotentResponse) {
+	w.Header().Set("Idempotent-Replayed", "true")
+	if saved.StatusCode == http.StatusAccepted {
+		video, err := cfg.db.GetVideo(saved.VideoID, false)
+		if err == nil && video.ID != uuid.Nil {
+			cfg.respondWithAccepted(w, r, video)
+			return
+		}
+	}
+	if saved.ContentType != "" {
+		w.Header().Set("Content-Type", saved.ContentType)
+	}
+	if saved.Location != "" {
+		w.Header().Set("Location", saved.Location)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(saved.Body)))
+	w.WriteHeader(saved.StatusCode)
+	w.Write(saved.Body)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// s3Requests is how many requests of any kind the fake S3 has answered.
+func (env *testEnv) s3Requests() int {
+	n := 0
+	for _, op := range []string{"PutObject", "GetObject", "HeadObject", "CopyObject", "DeleteObject", "CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload"} {
+		n += env.s3.Calls(op)
+	}
+	return n
+}
+
+func TestIdempotentUploadReplay(t *testing.T) {
+	env := newTestEnv(t)
+	userID, token := env.createUser(t)
+	video := env.createVideo(t, token, "Retried")
+	data := testVideoBytes(4096)
+
+	resp, body := env.uploadVideo(t, token, video.ID, data, "Idempotency-Key", "first")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload: got %d: %s", resp.StatusCode, body)
+	}
+	env.waitForProcessing(t, token, video.ID)
+	keys := env.s3.Keys(testBucket)
+	requests := env.s3Requests()
+
+	// A retry with the same key is answered without storing anything
+	resp, body = env.uploadVideo(t, token, video.ID, data, "Idempotency-Key", "first")
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry: got %d, replayed %q: %s", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"), body)
+	}
+	if got := env.s3Requests() - requests; got != 0 {
+		t.Errorf("replay made %d S3 requests, want none", got)
+	}
+	// It describes the video as it is now, not as it was when accepted
+	var replayed videoResponse
+	decodeJSON(t, body, &replayed)
+	if replayed.ID != video.ID || replayed.VideoURL == nil {
+		t.Errorf("replayed video = %+v, want %s with its video_url", replayed, video.ID)
+	}
+	if got := resp.Header.Get("Location"); got != "/api/videos/"+video.ID+"/status" {
+		t.Errorf("replayed Location = %q", got)
+	}
+
+	// A new key is a new upload
+	other := append(testVideoBytes(4096), "other"...)
+	resp, body = env.uploadVideo(t, token, video.ID, other, "Idempotency-Key", "second")
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("new key: got %d, replayed %q: %s", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"), body)
+	}
+	env.waitForProcessing(t, token, video.ID)
+	if got := env.s3.Keys(testBucket); slices.Equal(got, keys) {
+		t.Errorf("keys = %v after an upload with a new key, was %v", got, keys)
+	}
+
+	// While a request holds a key, a duplicate is turned away
+	scope := idempotencyScope{userID: userID, videoID: mustParseUUID(t, video.ID), key: "third"}
+	if !env.cfg.idempotencyLocks.lock(scope) {
+		t.Fatal("couldn't take the key's lock")
+	}
+	resp, body = env.uploadVideo(t, token, video.ID, data, "Idempotency-Key", "third")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate in flight: got %d, want 409: %s", resp.StatusCode, body)
+	}
+	env.cfg.idempotencyLocks.unlock(scope)
+	resp, body = env.uploadVideo(t, token, video.ID, data, "Idempotency-Key", "third")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("after the first request finished: got %d: %s", resp.StatusCode, body)
+	}
+	env.waitForProcessing(t, token, video.ID)
+}
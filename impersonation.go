@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Impersonation tokens are short-lived; admins can ask for less but not more.
+const (
+	defaultImpersonationTTL = 15 * time.Minute
+	maxImpersonationTTL     = time.Hour
+)
+
+const errorCodeImpersonationForbidden = "impersonation_forbidden"
+
+// handlerImpersonate issues an access token that acts as the user in the
+// path, for support staff reproducing what that user sees. The grant is
+// recorded before the token is returned, so an unaudited token is never
+// issued.
+func (cfg *apiConfig) handlerImpersonate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// Impersonator names the staff member; it is recorded on the grant,
+		// in logs and on access events made with the token.
+		Impersonator     string `json:"impersonator"`
+		Reason           string `json:"reason"`
+		TTLSeconds       int    `json:"ttl_seconds"`
+		AllowDestructive bool   `json:"allow_destructive"`
+	}
+	type response struct {
+		Token     string `json:"token"`
+		UserID    string `json:"user_id"`
+		ExpiresAt string `json:"expires_at"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Impersonator = strings.TrimSpace(params.Impersonator)
+	params.Reason = strings.TrimSpace(params.Reason)
+	if params.Impersonator == "" || params.Reason == "" {
+		respondWithError(w, http.StatusBadRequest, "impersonator and reason are required", nil)
+		return
+	}
+	ttl := defaultImpersonationTTL
+	if params.TTLSeconds != 0 {
+		ttl = time.Duration(params.TTLSeconds) * time.Second
+		if ttl < 0 || ttl > maxImpersonationTTL {
+			respondWithError(w, http.StatusBadRequest, "ttl_seconds must be between 1 and "+strconv.Itoa(int(maxImpersonationTTL.Seconds())), nil)
+			return
+		}
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+
+	now := time.Now().UTC()
+	grant := database.ImpersonationGrant{
+		ID:               uuid.New(),
+		UserID:           userID,
+		Impersonator:     params.Impersonator,
+		Reason:           params.Reason,
+		AllowDestructive: params.AllowDestructive,
+		IssuedAt:         now,
+		ExpiresAt:        now.Add(ttl),
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		grant.ClientIP = &ip
+	}
+	if err := cfg.db.CreateImpersonationGrant(grant); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record impersonation grant", err)
+		return
+	}
+
+	token, err := auth.MakeImpersonationJWT(userID, params.Impersonator, params.AllowDestructive, cfg.jwtSecret, ttl)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create impersonation token", err)
+		return
+	}
+
+	slog.Warn("impersonation token issued",
+		slog.String("grant_id", grant.ID.String()),
+		slog.String("user_id", userID.String()),
+		slog.String("impersonator", grant.Impersonator),
+		slog.String("reason", grant.Reason),
+		slog.Bool("allow_destructive", grant.AllowDestructive),
+		slog.Duration("ttl", ttl),
+	)
+	respondWithJSON(w, http.StatusCreated, response{
+		Token:     token,
+		UserID:    userID.String(),
+		ExpiresAt: apiTime(grant.ExpiresAt),
+	})
+}
+
+// handlerImpersonationGrantsList returns the most recent impersonation
+// grants.
+func (cfg *apiConfig) handlerImpersonationGrantsList(w http.ResponseWriter, r *http.Request) {
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+	grants, err := cfg.db.GetImpersonationGrants(200)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list impersonation grants", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, grants)
+}
+
+// checkDestructiveAllowed refuses impersonation tokens on endpoints that
+// delete, restore or overwrite data unless the grant allowed it. It writes
+// the error response and returns false when the request must stop.
+func checkDestructiveAllowed(w http.ResponseWriter, identity auth.Identity) bool {
+	if identity.Impersonator == "" || identity.AllowDestructive {
+		return true
+	}
+	respondWithStatusError(w, &statusError{
+		status: http.StatusForbidden,
+		msg:    "Impersonation tokens can't delete, restore or overwrite videos",
+		code:   errorCodeImpersonationForbidden,
+	})
+	return false
+}
+
+// checkOverwriteAllowed is checkDestructiveAllowed for uploads, which only
+// destroy anything when replacing is set: the video already has content.
+func checkOverwriteAllowed(w http.ResponseWriter, identity auth.Identity, replacing bool) bool {
+	return !replacing || checkDestructiveAllowed(w, identity)
+}
+
+// auditImpersonation records a change to videoID made with an
+// impersonation token as an access event naming the impersonator, so the
+// changes staff made as a user can be told apart from the user's own.
+// Requests made with ordinary logins aren't recorded.
+func (cfg *apiConfig) auditImpersonation(r *http.Request, identity auth.Identity, videoID uuid.UUID) {
+	if identity.Impersonator == "" {
+		return
+	}
+	cfg.recordAccess(r, videoID, database.AccessEventImpersonatedChange, nil)
+}
+
+// impersonationLog logs every request made with an impersonation token, so
+// what support staff did as a user can be told apart from what the user
+// did.
+func (cfg *apiConfig) impersonationLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity := cfg.optionalIdentity(r); identity.Impersonator != "" {
+			requestLogger(r.Context()).Info("impersonated request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("user_id", identity.UserID.String()),
+				slog.String("impersonator", identity.Impersonator),
+			)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
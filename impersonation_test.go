@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// impersonate asks for an impersonation token for userID as the staff
+// member "support@tubely.test".
+func (env *testEnv) impersonate(t *testing.T, userID uuid.UUID, allowDestructive bool) string {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	env.doJSON(t, http.MethodPost, "/admin/impersonate/"+userID.String(), testAdmin, map[string]any{
+		"impersonator":      "support@tubely.test",
+		"reason":            "ticket 1234",
+		"allow_destructive": allowDestructive,
+	}, http.StatusCreated, &resp)
+	return resp.Token
+}
+
+// queuedAccessEvents takes the access events waiting to be written, since
+// the test env doesn't run the recorder.
+func (env *testEnv) queuedAccessEvents() []database.AccessEvent {
+	var events []database.AccessEvent
+	for {
+		select {
+		case event := <-env.cfg.accessEvents.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestImpersonationDestructiveEndpoints(t *testing.T) {
+	env := newTestEnv(t)
+	userID, owner := env.createUser(t)
+	readOnly := env.impersonate(t, userID, false)
+	destructive := env.impersonate(t, userID, true)
+
+	uploaded := env.uploadedVideo(t, owner, "Uploaded")
+	env.updateVideo(t, uploaded.ID, func(v *database.Video) {
+		v.ThumbnailURL = ptr("https://" + testCDN + "/thumbnails/existing.png")
+	})
+	trashed := env.uploadedVideo(t, owner, "Trashed")
+	env.doJSON(t, http.MethodDelete, "/api/videos/"+trashed.ID, owner, nil, http.StatusNoContent, nil)
+
+	tests := []struct {
+		name, method, path string
+		body               any
+	}{
+		{"delete", http.MethodDelete, "/api/videos/" + uploaded.ID, nil},
+		{"bulk delete", http.MethodPost, "/api/videos/bulk-delete", map[string]any{"ids": []string{uploaded.ID}}},
+		{"restore", http.MethodPost, "/api/videos/" + trashed.ID + "/restore", nil},
+		{"replacing thumbnail", http.MethodPost, "/api/videos/" + uploaded.ID + "/thumbnail_json", map[string]string{"content_type": "image/png", "data_base64": ""}},
+		{"replacing upload session", http.MethodPost, "/api/videos/" + uploaded.ID + "/uploads", map[string]any{"size_bytes": 1024, "chunk_size": 1024}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := env.do(t, tt.method, tt.path, readOnly, "application/json", jsonBody(t, tt.body))
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("got %d, want 403: %s", resp.StatusCode, body)
+			}
+			if code := errorCode(t, body); code != errorCodeImpersonationForbidden {
+				t.Errorf("code = %q, want %q", code, errorCodeImpersonationForbidden)
+			}
+		})
+	}
+
+	// Replacing the video itself goes through the multipart upload
+	resp, body := env.uploadVideo(t, readOnly, uploaded.ID, testVideoBytes(4<<10))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("replacing upload: got %d, want 403: %s", resp.StatusCode, body)
+	}
+
+	// Nothing destructive happened, and a grant that allows it can
+	for _, id := range []string{uploaded.ID, trashed.ID} {
+		video, err := env.cfg.db.GetVideo(mustParseUUID(t, id), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := id == trashed.ID; (video.DeletedAt != nil) != want {
+			t.Errorf("video %s in the trash = %v, want %v", id, video.DeletedAt != nil, want)
+		}
+	}
+	env.doJSON(t, http.MethodPost, "/api/videos/"+trashed.ID+"/restore", destructive, nil, http.StatusOK, nil)
+	env.doJSON(t, http.MethodDelete, "/api/videos/"+uploaded.ID, destructive, nil, http.StatusNoContent, nil)
+}
+
+func TestImpersonationNonDestructiveAllowed(t *testing.T) {
+	env := newTestEnv(t)
+	userID, owner := env.createUser(t)
+	token := env.impersonate(t, userID, false)
+
+	// A first upload replaces nothing
+	draft := env.createVideo(t, token, "Draft")
+	resp, body := env.uploadVideo(t, token, draft.ID, testVideoBytes(4<<10))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("first upload: got %d, want 202: %s", resp.StatusCode, body)
+	}
+	env.waitForProcessing(t, owner, draft.ID)
+	env.doJSON(t, http.MethodPatch, "/api/videos/"+draft.ID, token, map[string]string{"title": "Renamed by support"}, http.StatusOK, nil)
+	env.doJSON(t, http.MethodGet, "/api/videos", token, nil, http.StatusOK, nil)
+	env.doJSON(t, http.MethodGet, "/api/videos/"+draft.ID+"/status", token, nil, http.StatusOK, nil)
+}
+
+func TestImpersonatedChangesAudited(t *testing.T) {
+	env := newTestEnv(t)
+	userID, owner := env.createUser(t)
+	token := env.impersonate(t, userID, true)
+	video := env.uploadedVideo(t, owner, "Audited")
+	env.queuedAccessEvents()
+
+	// The owner's own changes aren't audited
+	env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, owner, map[string]string{"title": "By the owner"}, http.StatusOK, nil)
+	if events := env.queuedAccessEvents(); len(events) != 0 {
+		t.Errorf("the owner's change recorded %+v", events)
+	}
+
+	env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, token, map[string]string{"title": "By support"}, http.StatusOK, nil)
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/share-links", token, map[string]any{}, http.StatusCreated, nil)
+	env.doJSON(t, http.MethodDelete, "/api/videos/"+video.ID, token, nil, http.StatusNoContent, nil)
+
+	events := env.queuedAccessEvents()
+	if len(events) != 3 {
+		t.Fatalf("got %d access events, want one per change: %+v", len(events), events)
+	}
+	for _, event := range events {
+		if event.Kind != database.AccessEventImpersonatedChange || event.VideoID.String() != video.ID {
+			t.Errorf("event = %s for %s, want %s for %s", event.Kind, event.VideoID, database.AccessEventImpersonatedChange, video.ID)
+		}
+		if event.Impersonator == nil || *event.Impersonator != "support@tubely.test" {
+			t.Errorf("impersonator = %v, want support@tubely.test", event.Impersonator)
+		}
+		if event.UserID == nil || *event.UserID != userID {
+			t.Errorf("user_id = %v, want the impersonated user %s", event.UserID, userID)
+		}
+	}
+
+	// Grants are listed for admins with who asked for them
+	var grants []database.ImpersonationGrant
+	env.doJSON(t, http.MethodGet, "/admin/impersonations", testAdmin, nil, http.StatusOK, &grants)
+	if len(grants) != 1 || !strings.Contains(grants[0].Reason, "1234") || grants[0].Impersonator != "support@tubely.test" {
+		t.Errorf("grants = %+v", grants)
+	}
+}
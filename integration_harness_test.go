@@ -0,0 +1,453 @@
+//go:build integration
+
+package main
+
+// The integration harness runs the real handler against MinIO and a temp
+// SQLite database. Build with -tags integration. MinIO is started with
+// docker unless INTEGRATION_S3_ENDPOINT points at a running one; either
+// way the harness creates its own bucket and removes it afterwards. The
+// processing steps need ffmpeg and ffprobe on PATH, and fixtures come from
+// internal/testsupport, which skips when ffmpeg is missing.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/testsupport"
+	"github.com/google/uuid"
+)
+
+const (
+	minioImage    = "minio/minio:latest"
+	minioUser     = "minioadmin"
+	minioPassword = "minioadmin"
+	// integrationCDN stands in for the CloudFront domain; video URLs use
+	// it, and s3KeyForVideoURL maps them back to object keys.
+	integrationCDN = "cdn.integration.test"
+)
+
+// integrationEnv is a running server and the storage behind it.
+type integrationEnv struct {
+	cfg    *apiConfig
+	server *httptest.Server
+	s3     *s3.Client
+	bucket string
+}
+
+// newIntegrationEnv starts MinIO if needed, creates a bucket, migrates a
+// temp database, builds a full apiConfig and serves its handler. Everything
+// is torn down when t finishes.
+func newIntegrationEnv(t testing.TB) *integrationEnv {
+	t.Helper()
+	ctx := context.Background()
+
+	endpoint := os.Getenv("INTEGRATION_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = startMinIO(t)
+	}
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: minioUser, SecretAccessKey: minioPassword}, nil
+		}),
+	})
+	bucket := "tubely-it-" + uuid.NewString()[:8]
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: &bucket}); err != nil {
+		t.Fatalf("couldn't create bucket %s: %v", bucket, err)
+	}
+	t.Cleanup(func() { emptyAndDeleteBucket(client, bucket) })
+
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+	assetsRoot := filepath.Join(dir, "assets")
+	if err := os.Mkdir(assetsRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &apiConfig{
+		db:               db,
+		jwtSecret:        "integration-secret",
+		platform:         "dev",
+		filepathRoot:     dir,
+		assetsRoot:       assetsRoot,
+		s3Bucket:         bucket,
+		s3Region:         "us-east-1",
+		s3CfDistribution: integrationCDN,
+		port:             "0",
+		appName:          "tubely-integration",
+		assetsPath:       defaultAssetsPath,
+		s3Client:         client,
+
+		s3ThumbnailBucket: bucket,
+		s3ArtifactsBucket: bucket,
+
+		countDraftsTowardLimit: true,
+		maxThumbnailBytes:      defaultMaxThumbnailBytes,
+		maxVideoUploadBytes:    defaultMaxVideoUploadBytes,
+		passwordAttempts:       newPasswordAttemptLimiter(),
+		scanner:                noopScanner{},
+		adminToken:             "integration-admin",
+		settings:               newSettingsStore(new(slog.LevelVar)),
+
+		uploadThroughput:     &throughputEstimator{},
+		maxPartSize:          64 << 20,
+		maxUploadConcurrency: 4,
+		uploadPartAttempts:   3,
+
+		configSources:    map[string]string{},
+		accessEvents:     newAccessRecorder(db),
+		partialUploads:   newPartialUploadStore(),
+		uploadSessions:   newUploadSessionStore(time.Hour, defaultMaxUploadSessionsPerUser),
+		assetsDisk:       newAssetsDisk(assetsRoot),
+		admission:        newAdmissionController(admissionLimits{}),
+		uploadLimiter:    newUploadRateLimiter(0, 0),
+		trashRetention:   7 * 24 * time.Hour,
+		idempotencyLocks: newIdempotencyLocks(),
+		readiness:        &readinessChecker{},
+		downloadLimiter:  newBandwidthLimiter(0, 0),
+		uploadProgress:   newProgressStore(),
+
+		fastStartFailurePolicy: fastStartFailureReject,
+		thumbnailPolicy:        defaultThumbnailPolicy(),
+		presignExpiry:          defaultURLExpiry,
+		presignMaxExpiry:       defaultMaxURLExpiry,
+		presignCache:           newPresignCache(defaultPresignCacheSize),
+		processingQueue:        newProcessingQueue(4),
+
+		tools: detectTools(),
+	}
+	cfg.initStorage(storageBackendS3)
+	eventsCtx, stopEvents := context.WithCancel(ctx)
+	go cfg.accessEvents.run(eventsCtx)
+	t.Cleanup(stopEvents)
+	cfg.processingQueue.start(1, cfg.processVideoJob)
+	t.Cleanup(func() { cfg.processingQueue.drain(context.Background()) })
+
+	server := httptest.NewServer(cfg.newHandler(false))
+	t.Cleanup(server.Close)
+	return &integrationEnv{cfg: cfg, server: server, s3: client, bucket: bucket}
+}
+
+// startMinIO runs a throwaway MinIO container and returns its endpoint,
+// skipping t when docker isn't available.
+func startMinIO(t testing.TB) string {
+	t.Helper()
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not available and INTEGRATION_S3_ENDPOINT not set")
+	}
+	out, err := exec.Command("docker", "run", "-d", "--rm",
+		"-p", "127.0.0.1::9000",
+		"-e", "MINIO_ROOT_USER="+minioUser,
+		"-e", "MINIO_ROOT_PASSWORD="+minioPassword,
+		minioImage, "server", "/data",
+	).Output()
+	if err != nil {
+		t.Skipf("couldn't start MinIO: %v", err)
+	}
+	container := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", container).Run() })
+
+	out, err = exec.Command("docker", "port", container, "9000/tcp").Output()
+	if err != nil {
+		t.Fatalf("couldn't find MinIO port: %v", err)
+	}
+	hostPort, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	endpoint := "http://" + hostPort
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(endpoint + "/minio/health/live")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return endpoint
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	t.Fatalf("MinIO at %s didn't become ready", endpoint)
+	return ""
+}
+
+func emptyAndDeleteBucket(client *s3.Client, bucket string) {
+	ctx := context.Background()
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: &bucket})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			break
+		}
+		var ids []types.ObjectIdentifier
+		for _, obj := range page.Contents {
+			ids = append(ids, types.ObjectIdentifier{Key: obj.Key})
+		}
+		if len(ids) > 0 {
+			client.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: &bucket, Delete: &types.Delete{Objects: ids}})
+		}
+	}
+	client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: &bucket})
+}
+
+// do sends a request to the server, with token as the bearer token when
+// set, and returns the response with its body read.
+func (env *integrationEnv) do(t testing.TB, method, path, token, contentType string, body io.Reader) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, env.server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := env.server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return resp, data
+}
+
+// doJSON sends in as JSON, fails t unless the response has status want,
+// and decodes the response into out when it isn't nil.
+func (env *integrationEnv) doJSON(t testing.TB, method, path, token string, in any, want int, out any) {
+	t.Helper()
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	resp, data := env.do(t, method, path, token, "application/json", body)
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: got %d, want %d: %s", method, path, resp.StatusCode, want, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", method, path, data, err)
+		}
+	}
+}
+
+// createTestUser signs up a fresh user and logs in, returning the user's
+// ID and access token.
+func createTestUser(t testing.TB, env *integrationEnv) (uuid.UUID, string) {
+	t.Helper()
+	creds := map[string]string{
+		"email":    uuid.NewString() + "@integration.test",
+		"password": "integration-password",
+	}
+	env.doJSON(t, http.MethodPost, "/api/users", "", creds, http.StatusCreated, nil)
+
+	var login struct {
+		ID    uuid.UUID `json:"id"`
+		Token string    `json:"token"`
+	}
+	env.doJSON(t, http.MethodPost, "/api/login", "", creds, http.StatusOK, &login)
+	return login.ID, login.Token
+}
+
+// uploadFixtureVideo creates a video, uploads the fixture built from recipe
+// and waits for it to be processed, returning the processed video.
+func uploadFixtureVideo(t testing.TB, env *integrationEnv, token string, recipe testsupport.Recipe) videoResponse {
+	t.Helper()
+	path := testsupport.Fixture(t, recipe)
+
+	var video videoResponse
+	env.doJSON(t, http.MethodPost, "/api/videos", token, map[string]string{
+		"title":       recipe.Name,
+		"description": "integration fixture",
+	}, http.StatusCreated, &video)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="video"; filename=%q`, recipe.Name+".mp4"))
+	header.Set("Content-Type", "video/mp4")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	resp, respBody := env.do(t, http.MethodPost, "/api/video_upload/"+video.ID, token, mw.FormDataContentType(), &body)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("uploading %s: got %d: %s", recipe.Name, resp.StatusCode, respBody)
+	}
+	waitForProcessing(t, env, token, video.ID)
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &video)
+	return video
+}
+
+// uploadFixtureVideoDirect creates a video and uploads the fixture built
+// from recipe through a presigned URL, PUTting it to MinIO as a browser
+// would, then completes the upload and returns the video.
+func uploadFixtureVideoDirect(t testing.TB, env *integrationEnv, token string, recipe testsupport.Recipe) videoResponse {
+	t.Helper()
+	data, err := os.ReadFile(testsupport.Fixture(t, recipe))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var video videoResponse
+	env.doJSON(t, http.MethodPost, "/api/videos", token, map[string]string{
+		"title":       recipe.Name,
+		"description": "integration fixture",
+	}, http.StatusCreated, &video)
+
+	var target directUploadURLResponse
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/upload-url", token, map[string]int64{
+		"size_bytes": int64(len(data)),
+	}, http.StatusCreated, &target)
+
+	req, err := http.NewRequest(target.Method, target.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range target.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("uploading %s to S3: %v", recipe.Name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("uploading %s to S3: got %d", recipe.Name, resp.StatusCode)
+	}
+
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/upload-complete", token, map[string]string{
+		"key": target.Key,
+	}, http.StatusOK, &video)
+	return video
+}
+
+// uploadFixtureVideoChunked creates a video and uploads the fixture built
+// from recipe through an upload session, sending the chunks last to first
+// to exercise out-of-order writes, then waits for it to be processed.
+func uploadFixtureVideoChunked(t testing.TB, env *integrationEnv, token string, recipe testsupport.Recipe) videoResponse {
+	t.Helper()
+	data, err := os.ReadFile(testsupport.Fixture(t, recipe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+
+	var video videoResponse
+	env.doJSON(t, http.MethodPost, "/api/videos", token, map[string]string{
+		"title":       recipe.Name,
+		"description": "integration fixture",
+	}, http.StatusCreated, &video)
+
+	var session uploadSessionResponse
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/uploads", token, map[string]any{
+		"size_bytes": len(data),
+		"chunk_size": minUploadChunkSize,
+		"sha256":     hex.EncodeToString(sum[:]),
+		"filename":   recipe.Name + ".mp4",
+	}, http.StatusCreated, &session)
+
+	for n := session.ChunkCount - 1; n >= 0; n-- {
+		start := int64(n) * session.ChunkSize
+		chunk := data[start:min(start+session.ChunkSize, int64(len(data)))]
+		path := fmt.Sprintf("/api/uploads/%s/chunks/%d", session.ID, n)
+		resp, body := env.do(t, http.MethodPut, path, token, "application/octet-stream", bytes.NewReader(chunk))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("uploading chunk %d of %s: got %d: %s", n, recipe.Name, resp.StatusCode, body)
+		}
+	}
+
+	env.doJSON(t, http.MethodPost, "/api/uploads/"+session.ID+"/complete", token, nil, http.StatusAccepted, nil)
+	waitForProcessing(t, env, token, video.ID)
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &video)
+	return video
+}
+
+// waitForProcessing polls the status of videoID until its latest upload
+// is ready, failing t if processing fails or takes too long.
+func waitForProcessing(t testing.TB, env *integrationEnv, token, videoID string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Minute)
+	for time.Now().Before(deadline) {
+		var status videoStatusResponse
+		env.doJSON(t, http.MethodGet, "/api/videos/"+videoID+"/status", token, nil, http.StatusOK, &status)
+		if status.ProcessingStatus != nil {
+			switch *status.ProcessingStatus {
+			case database.ProcessingStatusReady:
+				return
+			case database.ProcessingStatusFailed:
+				t.Fatalf("processing video %s failed: %v", videoID, *status.ProcessingError)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("video %s wasn't processed in time", videoID)
+}
+
+// checkStorageConformance runs the storage conformance suite against the
+// harness's bucket, fetching presigned URLs from MinIO directly.
+func checkStorageConformance(t *testing.T, env *integrationEnv) {
+	storagetest.Run(t, env.cfg.s3Storage, "conformance-"+uuid.NewString(), http.Get)
+}
+
+// fetchStoredVideo downloads the object behind video's URL straight from
+// the bucket, standing in for the CDN.
+func fetchStoredVideo(t testing.TB, env *integrationEnv, video videoResponse) []byte {
+	t.Helper()
+	if video.VideoURL == nil {
+		t.Fatalf("video %s has no URL", video.ID)
+	}
+	key, ok := env.cfg.s3KeyForVideoURL(*video.VideoURL)
+	if !ok {
+		t.Fatalf("video URL %s doesn't map to an object key", *video.VideoURL)
+	}
+	out, err := env.s3.GetObject(context.Background(), &s3.GetObjectInput{Bucket: &env.bucket, Key: &key})
+	if err != nil {
+		t.Fatalf("fetching %s: %v", key, err)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
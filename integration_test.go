@@ -0,0 +1,124 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/testsupport"
+)
+
+func TestIntegrationStorageConformance(t *testing.T) {
+	env := newIntegrationEnv(t)
+	checkStorageConformance(t, env)
+}
+
+// TestIntegrationVideoLifecycle uploads a fixture, lets it be processed,
+// fetches it from the bucket and through the download endpoint, then
+// deletes it and purges it from the trash.
+func TestIntegrationVideoLifecycle(t *testing.T) {
+	env := newIntegrationEnv(t)
+	ctx := context.Background()
+	_, token := createTestUser(t, env)
+
+	// Upload and process
+	video := uploadFixtureVideo(t, env, token, testsupport.Landscape)
+	if video.VideoURL == nil || !strings.HasPrefix(*video.VideoURL, "https://"+integrationCDN+"/landscape/") {
+		t.Fatalf("video_url = %v, want it under landscape/ on the CDN", video.VideoURL)
+	}
+	if video.FastStart == nil || !*video.FastStart {
+		t.Errorf("faststart = %v, want true", video.FastStart)
+	}
+
+	// Fetch it from the bucket, where the CDN would
+	stored := fetchStoredVideo(t, env, video)
+	fastStart, err := isFastStartMP4(bytes.NewReader(stored))
+	if err != nil || !fastStart {
+		t.Errorf("stored object isn't faststart: %v", err)
+	}
+	if video.ChecksumSHA256 != nil {
+		sum := sha256.Sum256(stored)
+		if got := base64.StdEncoding.EncodeToString(sum[:]); got != *video.ChecksumSHA256 {
+			t.Errorf("stored object SHA-256 = %s, want %s", got, *video.ChecksumSHA256)
+		}
+	}
+
+	// And through the server, whole and in part
+	resp, body := env.do(t, http.MethodGet, "/api/videos/"+video.ID+"/download", token, "", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, stored) {
+		t.Fatalf("download: got %d with %d bytes, want 200 with the %d stored", resp.StatusCode, len(body), len(stored))
+	}
+	req, err := http.NewRequest(http.MethodGet, env.server.URL+"/api/videos/"+video.ID+"/download", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Range", "bytes=100-199")
+	ranged, err := env.server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := new(bytes.Buffer)
+	part.ReadFrom(ranged.Body)
+	ranged.Body.Close()
+	if ranged.StatusCode != http.StatusPartialContent || !bytes.Equal(part.Bytes(), stored[100:200]) {
+		t.Errorf("ranged download: got %d with %d bytes, want 206 with bytes 100-199", ranged.StatusCode, part.Len())
+	}
+
+	// Delete moves it to the trash; the object stays until it's purged
+	resp, body = env.do(t, http.MethodDelete, "/api/videos/"+video.ID, token, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %d: %s", resp.StatusCode, body)
+	}
+	var trashed videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &trashed)
+	if !trashed.Deleted || trashed.VideoURL != nil {
+		t.Errorf("trashed video: deleted = %v, video_url = %v; want deleted without a URL", trashed.Deleted, trashed.VideoURL)
+	}
+	key, _ := env.cfg.s3KeyForVideoURL(*video.VideoURL)
+	if _, err := env.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &env.bucket, Key: &key}); err != nil {
+		t.Fatalf("object was removed before the purge: %v", err)
+	}
+
+	n, err := env.cfg.purgeTrashedVideos(ctx, time.Now().Add(time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("purge: removed %d, %v; want 1", n, err)
+	}
+	if _, err := env.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &env.bucket, Key: &key}); err == nil {
+		t.Errorf("object %s survived the purge", key)
+	}
+	resp, _ = env.do(t, http.MethodGet, "/api/videos/"+video.ID, token, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after purge: got %d, want 404", resp.StatusCode)
+	}
+}
+
+// TestIntegrationUploadPaths stores the same fixture through the direct and
+// chunked upload flows.
+func TestIntegrationUploadPaths(t *testing.T) {
+	env := newIntegrationEnv(t)
+	_, token := createTestUser(t, env)
+
+	for name, upload := range map[string]func(testing.TB, *integrationEnv, string, testsupport.Recipe) videoResponse{
+		"direct":  uploadFixtureVideoDirect,
+		"chunked": uploadFixtureVideoChunked,
+	} {
+		t.Run(name, func(t *testing.T) {
+			video := upload(t, env, token, testsupport.Portrait)
+			if video.VideoURL == nil {
+				t.Fatalf("%s upload has no video_url", name)
+			}
+			if stored := fetchStoredVideo(t, env, video); len(stored) == 0 {
+				t.Errorf("%s upload stored an empty object", name)
+			}
+		})
+	}
+}
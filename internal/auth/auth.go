@@ -49,35 +49,88 @@ func MakeJWT(
 	return token.SignedString(signingKey)
 }
 
+// accessClaims are the claims carried by access tokens. Impersonation
+// tokens are ordinary access tokens for the target user with the
+// impersonator claims set.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Impersonator            string `json:"impersonator,omitempty"`
+	ImpersonatorDestructive bool   `json:"impersonator_destructive,omitempty"`
+}
+
+// Identity is who an access token acts as and, for impersonation tokens,
+// who is really behind it.
+type Identity struct {
+	UserID uuid.UUID
+	// Impersonator names the admin an impersonation token was issued to;
+	// empty for ordinary logins.
+	Impersonator string
+	// AllowDestructive lets an impersonation token delete videos.
+	AllowDestructive bool
+}
+
+// MakeImpersonationJWT issues an access token for userID on behalf of
+// impersonator.
+func MakeImpersonationJWT(
+	userID uuid.UUID,
+	impersonator string,
+	allowDestructive bool,
+	tokenSecret string,
+	expiresIn time.Duration,
+) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		Impersonator:            impersonator,
+		ImpersonatorDestructive: allowDestructive,
+	})
+	return token.SignedString([]byte(tokenSecret))
+}
+
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+	identity, err := ValidateJWTIdentity(tokenString, tokenSecret)
+	return identity.UserID, err
+}
+
+// ValidateJWTIdentity validates an access token like ValidateJWT and also
+// returns its impersonation claims.
+func ValidateJWTIdentity(tokenString, tokenSecret string) (Identity, error) {
+	claimsStruct := accessClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return Identity{}, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return Identity{}, err
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return Identity{}, err
 	}
 	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+		return Identity{}, errors.New("invalid issuer")
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return Identity{}, fmt.Errorf("invalid user ID: %w", err)
 	}
-	return id, nil
+	return Identity{
+		UserID:           id,
+		Impersonator:     claimsStruct.Impersonator,
+		AllowDestructive: claimsStruct.ImpersonatorDestructive,
+	}, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// AccessEventURLIssued is a video URL handed out by the API; the fetch
+	// itself goes straight to the CDN.
+	AccessEventURLIssued = "url_issued"
+	// AccessEventShareLink is a share link redirect served by us.
+	AccessEventShareLink = "share_link"
+	// AccessEventDownload is a download streamed through us. Resumed
+	// downloads aren't recorded again.
+	AccessEventDownload = "download"
+	// AccessEventImpersonatedChange is a change to the video made with an
+	// impersonation token; Impersonator says by whom.
+	AccessEventImpersonatedChange = "impersonated_change"
+)
+
+type AccessEvent struct {
+	ID         int64      `json:"id"`
+	VideoID    uuid.UUID  `json:"video_id"`
+	OccurredAt time.Time  `json:"occurred_at"`
+	Kind       string     `json:"kind"`
+	UserID     *uuid.UUID `json:"user_id"`
+	ClientIP   *string    `json:"client_ip"`
+	UserAgent  *string    `json:"user_agent"`
+	ShareToken *string    `json:"share_token"`
+	// Impersonator is set when the caller used an impersonation token.
+	Impersonator *string `json:"impersonator"`
+}
+
+// CreateAccessEvents inserts a batch of events in one transaction.
+func (c Client) CreateAccessEvents(events []AccessEvent) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO access_events (
+		video_id,
+		occurred_at,
+		kind,
+		user_id,
+		client_ip,
+		user_agent,
+		share_token,
+		impersonator
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		if _, err := stmt.Exec(e.VideoID, e.OccurredAt.UTC(), e.Kind, e.UserID, e.ClientIP, e.UserAgent, e.ShareToken, e.Impersonator); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetAccessEvents returns up to limit events for videoID, newest first,
+// with IDs below beforeID when it is positive.
+func (c Client) GetAccessEvents(videoID uuid.UUID, beforeID int64, limit int) ([]AccessEvent, error) {
+	query := `
+	SELECT id, video_id, occurred_at, kind, user_id, client_ip, user_agent, share_token, impersonator
+	FROM access_events
+	WHERE video_id = ?
+	AND (? <= 0 OR id < ?)
+	ORDER BY id DESC
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, videoID, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AccessEvent{}
+	for rows.Next() {
+		var e AccessEvent
+		if err := rows.Scan(
+			&e.ID,
+			&e.VideoID,
+			&e.OccurredAt,
+			&e.Kind,
+			&e.UserID,
+			&e.ClientIP,
+			&e.UserAgent,
+			&e.ShareToken,
+			&e.Impersonator,
+		); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// DeleteAccessEventsBefore removes events older than cutoff and returns how
+// many were deleted.
+func (c Client) DeleteAccessEventsBefore(cutoff time.Time) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM access_events WHERE occurred_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
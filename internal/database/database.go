@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -25,6 +26,12 @@ func NewClient(pathToDB string) (Client, error) {
 
 }
 
+// Ping runs a trivial query, to check the database is usable.
+func (c Client) Ping(ctx context.Context) error {
+	var one int
+	return c.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
 func (c *Client) autoMigrate() error {
 	userTable := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -72,10 +79,251 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	shareLinkTable := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		token TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		max_views INTEGER,
+		views INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+	);
+	`
+	_, err = c.db.Exec(shareLinkTable)
+	if err != nil {
+		return err
+	}
+
+	processingRunTable := `
+	CREATE TABLE IF NOT EXISTS processing_runs (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		trigger TEXT NOT NULL,
+		status TEXT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP,
+		stages TEXT,
+		input_size INTEGER,
+		output_size INTEGER,
+		ffmpeg_version TEXT,
+		warnings TEXT,
+		error TEXT,
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+	);
+	`
+	_, err = c.db.Exec(processingRunTable)
+	if err != nil {
+		return err
+	}
+
+	accessEventTable := `
+	CREATE TABLE IF NOT EXISTS access_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		video_id TEXT NOT NULL,
+		occurred_at TIMESTAMP NOT NULL,
+		kind TEXT NOT NULL,
+		user_id TEXT,
+		client_ip TEXT,
+		user_agent TEXT,
+		share_token TEXT
+	);
+	CREATE INDEX IF NOT EXISTS access_events_video_id ON access_events(video_id, id);
+	`
+	_, err = c.db.Exec(accessEventTable)
+	if err != nil {
+		return err
+	}
+
+	impersonationTable := `
+	CREATE TABLE IF NOT EXISTS impersonation_grants (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		impersonator TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		allow_destructive INTEGER NOT NULL DEFAULT 0,
+		client_ip TEXT,
+		issued_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(impersonationTable)
+	if err != nil {
+		return err
+	}
+
+	directUploadTable := `
+	CREATE TABLE IF NOT EXISTS direct_uploads (
+		key TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(directUploadTable)
+	if err != nil {
+		return err
+	}
+
+	idempotentResponseTable := `
+	CREATE TABLE IF NOT EXISTS idempotent_responses (
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		location TEXT NOT NULL,
+		body BLOB NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, video_id, key)
+	);
+	`
+	_, err = c.db.Exec(idempotentResponseTable)
+	if err != nil {
+		return err
+	}
+
+	multipartUploadTable := `
+	CREATE TABLE IF NOT EXISTS multipart_uploads (
+		video_id TEXT NOT NULL,
+		bucket TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		upload_id TEXT NOT NULL,
+		part_size INTEGER NOT NULL,
+		checksum_algorithm TEXT NOT NULL,
+		parts TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (video_id, object_key)
+	);
+	`
+	_, err = c.db.Exec(multipartUploadTable)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the original schema; existing databases get them via ALTER TABLE.
+	videoColumns := []struct{ name, definition string }{
+		{"thumbnail_grid_url", "TEXT"},
+		{"thumbnail_width", "INTEGER"},
+		{"thumbnail_height", "INTEGER"},
+		{"thumbnail_modern_url", "TEXT"},
+		{"status", "TEXT NOT NULL DEFAULT 'draft'"},
+		{"content_type", "TEXT"},
+		{"original_filename", "TEXT"},
+		{"upload_content_type", "TEXT"},
+		{"upload_client_ip", "TEXT"},
+		{"upload_user_agent", "TEXT"},
+		{"processing_warnings", "TEXT"},
+		{"password_hash", "TEXT"},
+		{"processing_branch", "TEXT"},
+		{"processing_status", "TEXT"},
+		{"processing_error", "TEXT"},
+		{"renditions", "TEXT"},
+		{"hls_url", "TEXT"},
+		{"checksum_sha256", "TEXT"},
+		{"version", "INTEGER NOT NULL DEFAULT 1"},
+		{"size_bytes", "INTEGER"},
+		{"duration_seconds", "REAL"},
+		{"allowed_embed_origins", "TEXT"},
+		// Anyone with the ID could watch videos from before visibility
+		// existed, as with unlisted ones; new videos start private
+		{"visibility", "TEXT NOT NULL DEFAULT 'unlisted'"},
+		// Set while the video is in the trash, until it is restored or purged
+		{"deleted_at", "TIMESTAMP"},
+		// Set to the title only while the owner has unique titles turned on
+		{"unique_title", "TEXT"},
+	}
+	for _, col := range videoColumns {
+		if err := c.addColumnIfNotExists("videos", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	if err := c.addColumnIfNotExists("users", "unique_titles", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := c.addColumnIfNotExists("access_events", "impersonator", "TEXT"); err != nil {
+		return err
+	}
+
+	// size_bytes and unique_title only exist after the column loop above
+	_, err = c.db.Exec(`CREATE INDEX IF NOT EXISTS videos_user_size ON videos(user_id, size_bytes)`)
+	if err != nil {
+		return err
+	}
+	// NULLs never collide, so only users with the policy on are constrained
+	_, err = c.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS videos_user_unique_title ON videos(user_id, unique_title)`)
+	if err != nil {
+		return err
+	}
+
+	// Rows uploaded before the status column existed are not drafts
+	_, err = c.db.Exec(`UPDATE videos SET status = 'ready' WHERE status = 'draft' AND video_url IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			ctype      string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultVal, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
 func (c Client) Reset() error {
+	if _, err := c.db.Exec("DELETE FROM share_links"); err != nil {
+		return fmt.Errorf("failed to reset table share_links: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_runs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_runs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM access_events"); err != nil {
+		return fmt.Errorf("failed to reset table access_events: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM impersonation_grants"); err != nil {
+		return fmt.Errorf("failed to reset table impersonation_grants: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM direct_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table direct_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM idempotent_responses"); err != nil {
+		return fmt.Errorf("failed to reset table idempotent_responses: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM multipart_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table multipart_uploads: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DirectUpload is an object key handed out for a browser-to-S3 upload. The
+// row lives until the upload is completed or, if that never happens, the
+// janitor deletes it along with any object that did arrive.
+type DirectUpload struct {
+	Key       string    `json:"key"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const directUploadColumns = `key, video_id, user_id, size_bytes, created_at, expires_at`
+
+func (c Client) CreateDirectUpload(upload DirectUpload) error {
+	query := `
+	INSERT INTO direct_uploads (` + directUploadColumns + `)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, upload.Key, upload.VideoID, upload.UserID, upload.SizeBytes, upload.CreatedAt.UTC(), upload.ExpiresAt.UTC())
+	return err
+}
+
+// GetDirectUpload returns the upload for key, or a zero DirectUpload if
+// there is none.
+func (c Client) GetDirectUpload(key string) (DirectUpload, error) {
+	query := `
+	SELECT ` + directUploadColumns + `
+	FROM direct_uploads
+	WHERE key = ?
+	`
+	var upload DirectUpload
+	err := c.db.QueryRow(query, key).Scan(
+		&upload.Key,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.SizeBytes,
+		&upload.CreatedAt,
+		&upload.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DirectUpload{}, nil
+		}
+		return DirectUpload{}, err
+	}
+	return upload, nil
+}
+
+// GetDirectUploadKeys returns the keys of every uncompleted upload,
+// expired or not.
+func (c Client) GetDirectUploadKeys() ([]string, error) {
+	rows, err := c.db.Query(`SELECT key FROM direct_uploads ORDER BY key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// GetDirectUploadsExpiredBefore returns the uncompleted uploads whose URLs
+// expired before cutoff, oldest first.
+func (c Client) GetDirectUploadsExpiredBefore(cutoff time.Time) ([]DirectUpload, error) {
+	query := `
+	SELECT ` + directUploadColumns + `
+	FROM direct_uploads
+	WHERE expires_at < ?
+	ORDER BY expires_at
+	`
+	rows, err := c.db.Query(query, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []DirectUpload{}
+	for rows.Next() {
+		var upload DirectUpload
+		if err := rows.Scan(
+			&upload.Key,
+			&upload.VideoID,
+			&upload.UserID,
+			&upload.SizeBytes,
+			&upload.CreatedAt,
+			&upload.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+func (c Client) DeleteDirectUpload(key string) error {
+	_, err := c.db.Exec(`DELETE FROM direct_uploads WHERE key = ?`, key)
+	return err
+}
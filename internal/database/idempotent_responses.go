@@ -0,0 +1,73 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotentResponse is a response saved under the Idempotency-Key a
+// client sent with a request, so a retry with the same key gets it back
+// instead of repeating the request. Keys are scoped to a user and video.
+type IdempotentResponse struct {
+	UserID      uuid.UUID
+	VideoID     uuid.UUID
+	Key         string
+	StatusCode  int
+	ContentType string
+	Location    string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// SaveIdempotentResponse stores resp, replacing any response saved under
+// the same key.
+func (c Client) SaveIdempotentResponse(resp IdempotentResponse) error {
+	query := `
+	INSERT OR REPLACE INTO idempotent_responses (user_id, video_id, key, status_code, content_type, location, body, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, resp.UserID, resp.VideoID, resp.Key, resp.StatusCode, resp.ContentType, resp.Location, resp.Body, resp.CreatedAt.UTC())
+	return err
+}
+
+// GetIdempotentResponse returns the response saved under key after the
+// given time, or a zero IdempotentResponse if there is none.
+func (c Client) GetIdempotentResponse(userID, videoID uuid.UUID, key string, after time.Time) (IdempotentResponse, error) {
+	query := `
+	SELECT user_id, video_id, key, status_code, content_type, location, body, created_at
+	FROM idempotent_responses
+	WHERE user_id = ? AND video_id = ? AND key = ?
+	AND created_at > ?
+	`
+	var resp IdempotentResponse
+	err := c.db.QueryRow(query, userID, videoID, key, after.UTC()).Scan(
+		&resp.UserID,
+		&resp.VideoID,
+		&resp.Key,
+		&resp.StatusCode,
+		&resp.ContentType,
+		&resp.Location,
+		&resp.Body,
+		&resp.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotentResponse{}, nil
+		}
+		return IdempotentResponse{}, err
+	}
+	return resp, nil
+}
+
+// DeleteIdempotentResponsesBefore deletes responses saved before cutoff
+// and returns how many were removed.
+func (c Client) DeleteIdempotentResponsesBefore(cutoff time.Time) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM idempotent_responses WHERE created_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
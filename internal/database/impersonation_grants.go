@@ -0,0 +1,79 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ImpersonationGrant records an impersonation token issued to an admin.
+type ImpersonationGrant struct {
+	ID               uuid.UUID `json:"id"`
+	UserID           uuid.UUID `json:"user_id"`
+	Impersonator     string    `json:"impersonator"`
+	Reason           string    `json:"reason"`
+	AllowDestructive bool      `json:"allow_destructive"`
+	ClientIP         *string   `json:"client_ip"`
+	IssuedAt         time.Time `json:"issued_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateImpersonationGrant(grant ImpersonationGrant) error {
+	query := `
+	INSERT INTO impersonation_grants (
+		id,
+		user_id,
+		impersonator,
+		reason,
+		allow_destructive,
+		client_ip,
+		issued_at,
+		expires_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		grant.ID.String(),
+		grant.UserID.String(),
+		grant.Impersonator,
+		grant.Reason,
+		grant.AllowDestructive,
+		grant.ClientIP,
+		grant.IssuedAt.UTC(),
+		grant.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// GetImpersonationGrants returns up to limit grants, newest first.
+func (c Client) GetImpersonationGrants(limit int) ([]ImpersonationGrant, error) {
+	query := `
+	SELECT id, user_id, impersonator, reason, allow_destructive, client_ip, issued_at, expires_at
+	FROM impersonation_grants
+	ORDER BY issued_at DESC
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []ImpersonationGrant{}
+	for rows.Next() {
+		var g ImpersonationGrant
+		if err := rows.Scan(
+			&g.ID,
+			&g.UserID,
+			&g.Impersonator,
+			&g.Reason,
+			&g.AllowDestructive,
+			&g.ClientIP,
+			&g.IssuedAt,
+			&g.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
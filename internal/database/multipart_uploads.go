@@ -0,0 +1,99 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MultipartUpload is a multipart upload of a video's object that failed
+// partway and was left in S3, so the next attempt to store the object
+// can send only the missing parts. The janitor aborts uploads nobody has
+// touched for a while.
+type MultipartUpload struct {
+	VideoID           uuid.UUID
+	Bucket            string
+	Key               string
+	UploadID          string
+	PartSize          int64
+	ChecksumAlgorithm string
+	Parts             MultipartParts
+	UpdatedAt         time.Time
+}
+
+const multipartUploadColumns = `video_id, bucket, object_key, upload_id, part_size, checksum_algorithm, parts, updated_at`
+
+// SaveMultipartUpload records upload, replacing any upload recorded for
+// the same video and key.
+func (c Client) SaveMultipartUpload(upload MultipartUpload) error {
+	query := `
+	INSERT OR REPLACE INTO multipart_uploads (` + multipartUploadColumns + `)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, upload.VideoID, upload.Bucket, upload.Key, upload.UploadID, upload.PartSize, upload.ChecksumAlgorithm, upload.Parts, upload.UpdatedAt.UTC())
+	return err
+}
+
+// GetMultipartUpload returns the upload recorded for key of videoID, or a
+// zero MultipartUpload if there is none.
+func (c Client) GetMultipartUpload(videoID uuid.UUID, key string) (MultipartUpload, error) {
+	query := `
+	SELECT ` + multipartUploadColumns + `
+	FROM multipart_uploads
+	WHERE video_id = ? AND object_key = ?
+	`
+	upload, err := scanMultipartUpload(c.db.QueryRow(query, videoID, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return MultipartUpload{}, nil
+	}
+	return upload, err
+}
+
+// DeleteMultipartUpload forgets the upload recorded for key of videoID.
+func (c Client) DeleteMultipartUpload(videoID uuid.UUID, key string) error {
+	_, err := c.db.Exec(`DELETE FROM multipart_uploads WHERE video_id = ? AND object_key = ?`, videoID, key)
+	return err
+}
+
+// GetMultipartUploadsUpdatedBefore returns the uploads that made no
+// progress since cutoff.
+func (c Client) GetMultipartUploadsUpdatedBefore(cutoff time.Time) ([]MultipartUpload, error) {
+	query := `
+	SELECT ` + multipartUploadColumns + `
+	FROM multipart_uploads
+	WHERE updated_at < ?
+	ORDER BY updated_at
+	`
+	rows, err := c.db.Query(query, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []MultipartUpload{}
+	for rows.Next() {
+		upload, err := scanMultipartUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+func scanMultipartUpload(row rowScanner) (MultipartUpload, error) {
+	var upload MultipartUpload
+	err := row.Scan(
+		&upload.VideoID,
+		&upload.Bucket,
+		&upload.Key,
+		&upload.UploadID,
+		&upload.PartSize,
+		&upload.ChecksumAlgorithm,
+		&upload.Parts,
+		&upload.UpdatedAt,
+	)
+	return upload, err
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ProcessingRunRunning   = "running"
+	ProcessingRunSucceeded = "succeeded"
+	// ProcessingRunPartial runs stored the video but skipped a stage, e.g.
+	// the faststart rescue path.
+	ProcessingRunPartial = "partial"
+	ProcessingRunFailed  = "failed"
+)
+
+// ProcessingRun records one execution of the video pipeline.
+type ProcessingRun struct {
+	ID            uuid.UUID        `json:"id"`
+	VideoID       uuid.UUID        `json:"video_id"`
+	Trigger       string           `json:"trigger"`
+	Status        string           `json:"status"`
+	StartedAt     time.Time        `json:"started_at"`
+	FinishedAt    *time.Time       `json:"finished_at"`
+	Stages        ProcessingStages `json:"stages"`
+	InputSize     *int64           `json:"input_size"`
+	OutputSize    *int64           `json:"output_size"`
+	FFmpegVersion *string          `json:"ffmpeg_version"`
+	Warnings      StringList       `json:"warnings"`
+	Error         *string          `json:"error"`
+}
+
+// CreateProcessingRun inserts run, which should still be running; the
+// pipeline then saves its progress with UpdateProcessingRun.
+func (c Client) CreateProcessingRun(run ProcessingRun) error {
+	query := `
+	INSERT INTO processing_runs (
+		id,
+		video_id,
+		trigger,
+		status,
+		started_at
+	) VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, run.ID, run.VideoID, run.Trigger, run.Status, run.StartedAt.UTC())
+	return err
+}
+
+func (c Client) UpdateProcessingRun(run ProcessingRun) error {
+	query := `
+	UPDATE processing_runs
+	SET
+		status = ?,
+		finished_at = ?,
+		stages = ?,
+		input_size = ?,
+		output_size = ?,
+		ffmpeg_version = ?,
+		warnings = ?,
+		error = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(
+		query,
+		run.Status,
+		run.FinishedAt,
+		run.Stages,
+		run.InputSize,
+		run.OutputSize,
+		run.FFmpegVersion,
+		run.Warnings,
+		run.Error,
+		run.ID,
+	)
+	return err
+}
+
+func (c Client) GetProcessingRuns(videoID uuid.UUID) ([]ProcessingRun, error) {
+	query := `
+	SELECT
+		id,
+		video_id,
+		trigger,
+		status,
+		started_at,
+		finished_at,
+		stages,
+		input_size,
+		output_size,
+		ffmpeg_version,
+		warnings,
+		error
+	FROM processing_runs
+	WHERE video_id = ?
+	ORDER BY started_at DESC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []ProcessingRun{}
+	for rows.Next() {
+		var run ProcessingRun
+		if err := rows.Scan(
+			&run.ID,
+			&run.VideoID,
+			&run.Trigger,
+			&run.Status,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Stages,
+			&run.InputSize,
+			&run.OutputSize,
+			&run.FFmpegVersion,
+			&run.Warnings,
+			&run.Error,
+		); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// DeleteProcessingRunsBefore removes runs that started before cutoff and
+// returns how many were deleted.
+func (c Client) DeleteProcessingRunsBefore(cutoff time.Time) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM processing_runs WHERE started_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
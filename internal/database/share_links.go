@@ -0,0 +1,130 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ShareLink struct {
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+	Views     int       `json:"views"`
+	CreateShareLinkParams
+}
+
+type CreateShareLinkParams struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedBy uuid.UUID `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxViews  *int      `json:"max_views"`
+}
+
+func (c Client) CreateShareLink(token string, params CreateShareLinkParams) (ShareLink, error) {
+	query := `
+	INSERT INTO share_links (
+		token,
+		created_at,
+		video_id,
+		created_by,
+		expires_at,
+		max_views
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, token, params.VideoID, params.CreatedBy, params.ExpiresAt.UTC(), params.MaxViews)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	return c.GetShareLink(token)
+}
+
+func (c Client) GetShareLink(token string) (ShareLink, error) {
+	query := `
+	SELECT token, created_at, video_id, created_by, expires_at, max_views, views
+	FROM share_links
+	WHERE token = ?
+	`
+	var link ShareLink
+	err := c.db.QueryRow(query, token).Scan(
+		&link.Token,
+		&link.CreatedAt,
+		&link.VideoID,
+		&link.CreatedBy,
+		&link.ExpiresAt,
+		&link.MaxViews,
+		&link.Views,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+func (c Client) GetShareLinks(videoID uuid.UUID) ([]ShareLink, error) {
+	query := `
+	SELECT token, created_at, video_id, created_by, expires_at, max_views, views
+	FROM share_links
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var link ShareLink
+		if err := rows.Scan(
+			&link.Token,
+			&link.CreatedAt,
+			&link.VideoID,
+			&link.CreatedBy,
+			&link.ExpiresAt,
+			&link.MaxViews,
+			&link.Views,
+		); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// UseShareLink atomically counts a view if the link is unexpired and has views
+// left, returning the linked video ID. It returns uuid.Nil when the link is
+// missing, expired or exhausted.
+func (c Client) UseShareLink(token string, now time.Time) (uuid.UUID, error) {
+	query := `
+	UPDATE share_links
+	SET views = views + 1
+	WHERE token = ?
+	AND expires_at > ?
+	AND (max_views IS NULL OR views < max_views)
+	RETURNING video_id
+	`
+	var videoID uuid.UUID
+	err := c.db.QueryRow(query, token, now.UTC()).Scan(&videoID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, nil
+		}
+		return uuid.Nil, err
+	}
+	return videoID, nil
+}
+
+func (c Client) DeleteShareLink(token string) error {
+	query := `
+	DELETE FROM share_links
+	WHERE token = ?
+	`
+	_, err := c.db.Exec(query, token)
+	return err
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// StringList is a list of strings stored as a JSON array in a TEXT column.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal([]string(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (l *StringList) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*[]string)(l))
+	case []byte:
+		return json.Unmarshal(v, (*[]string)(l))
+	default:
+		return fmt.Errorf("unsupported type for StringList: %T", src)
+	}
+}
+
+// Renditions maps a rendition label such as "720p" to the URL of that
+// transcode, stored as a JSON object in a TEXT column. The uploaded
+// file itself stays in video_url.
+type Renditions map[string]string
+
+func (r Renditions) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal(map[string]string(r))
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (r *Renditions) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*map[string]string)(r))
+	case []byte:
+		return json.Unmarshal(v, (*map[string]string)(r))
+	default:
+		return fmt.Errorf("unsupported type for Renditions: %T", src)
+	}
+}
+
+// ProcessingStage is one timed step of a processing run.
+type ProcessingStage struct {
+	Name       string `json:"name"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ProcessingStages is stored as a JSON array in a TEXT column.
+type ProcessingStages []ProcessingStage
+
+func (s ProcessingStages) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal([]ProcessingStage(s))
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (s *ProcessingStages) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*[]ProcessingStage)(s))
+	case []byte:
+		return json.Unmarshal(v, (*[]ProcessingStage)(s))
+	default:
+		return fmt.Errorf("unsupported type for ProcessingStages: %T", src)
+	}
+}
+
+// MultipartPart is a part of a multipart upload S3 has received.
+type MultipartPart struct {
+	Number   int32  `json:"number"`
+	ETag     string `json:"etag"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// MultipartParts is stored as a JSON array in a TEXT column.
+type MultipartParts []MultipartPart
+
+func (p MultipartParts) Value() (driver.Value, error) {
+	dat, err := json.Marshal([]MultipartPart(p))
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (p *MultipartParts) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*[]MultipartPart)(p))
+	case []byte:
+		return json.Unmarshal(v, (*[]MultipartPart)(p))
+	default:
+		return fmt.Errorf("unsupported type for MultipartParts: %T", src)
+	}
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrDuplicateTitle is returned when a write would give a user with unique
+// titles turned on two videos with the same title.
+var ErrDuplicateTitle = errors.New("duplicate video title")
+
+// TitleConflict is a title shared by several of a user's videos.
+type TitleConflict struct {
+	Title    string      `json:"title"`
+	VideoIDs []uuid.UUID `json:"video_ids"`
+}
+
+// titleError maps the unique_title index's constraint failure to
+// ErrDuplicateTitle.
+func titleError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique &&
+		strings.Contains(sqliteErr.Error(), "unique_title") {
+		return ErrDuplicateTitle
+	}
+	return err
+}
+
+// GetUniqueTitles reports whether userID has unique titles turned on.
+func (c Client) GetUniqueTitles(userID uuid.UUID) (bool, error) {
+	var enabled bool
+	err := c.db.QueryRow(`SELECT unique_titles FROM users WHERE id = ?`, userID.String()).Scan(&enabled)
+	return enabled, err
+}
+
+// SetUniqueTitles turns the unique titles policy on or off for userID.
+// Turning it on fails with ErrDuplicateTitle, changing nothing, while the
+// user has duplicate titles.
+func (c Client) SetUniqueTitles(userID uuid.UUID, enabled bool) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET unique_titles = ? WHERE id = ?`, enabled, userID.String()); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	UPDATE videos
+	SET unique_title = CASE WHEN ? THEN title END
+	WHERE user_id = ?
+	`, enabled, userID.String())
+	if err != nil {
+		return titleError(err)
+	}
+	return tx.Commit()
+}
+
+// FindVideoIDByTitle returns the ID of one of userID's videos titled
+// title, or uuid.Nil if there is none.
+func (c Client) FindVideoIDByTitle(userID uuid.UUID, title string) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := c.db.QueryRow(`SELECT id FROM videos WHERE user_id = ? AND title = ? LIMIT 1`, userID.String(), title).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, nil
+	}
+	return id, err
+}
+
+// GetTitleConflicts returns every title userID uses more than once.
+func (c Client) GetTitleConflicts(userID uuid.UUID) ([]TitleConflict, error) {
+	query := `
+	SELECT title, id
+	FROM videos
+	WHERE user_id = ?
+	AND title IN (
+		SELECT title FROM videos WHERE user_id = ? GROUP BY title HAVING COUNT(*) > 1
+	)
+	ORDER BY title, created_at
+	`
+	rows, err := c.db.Query(query, userID.String(), userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conflicts := []TitleConflict{}
+	for rows.Next() {
+		var title string
+		var id uuid.UUID
+		if err := rows.Scan(&title, &id); err != nil {
+			return nil, err
+		}
+		if n := len(conflicts); n > 0 && conflicts[n-1].Title == title {
+			conflicts[n-1].VideoIDs = append(conflicts[n-1].VideoIDs, id)
+			continue
+		}
+		conflicts = append(conflicts, TitleConflict{Title: title, VideoIDs: []uuid.UUID{id}})
+	}
+	return conflicts, rows.Err()
+}
@@ -3,43 +3,176 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+const (
+	// VideoStatusDraft is a video row that has never had content uploaded.
+	VideoStatusDraft = "draft"
+	// VideoStatusReady is a video whose content has been uploaded.
+	VideoStatusReady = "ready"
+)
+
+// Processing states of a video's latest upload. Rows uploaded before
+// processing moved off the request have none.
+const (
+	ProcessingStatusPending = "pending"
+	ProcessingStatusReady   = "ready"
+	ProcessingStatusFailed  = "failed"
+)
+
+// Who may watch a video. Unlisted videos are watchable by anyone with the
+// link, like public ones, but are left out of the public listing. Private
+// ones are their owner's, short of a share link.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID                 uuid.UUID  `json:"id"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+	ThumbnailURL       *string    `json:"thumbnail_url"`
+	ThumbnailGridURL   *string    `json:"thumbnail_grid_url"`
+	ThumbnailWidth     *int       `json:"thumbnail_width"`
+	ThumbnailHeight    *int       `json:"thumbnail_height"`
+	ThumbnailModernURL *string    `json:"thumbnail_modern_url"`
+	VideoURL           *string    `json:"video_url"`
+	Status             string     `json:"status"`
+	ContentType        *string    `json:"content_type"`
+	OriginalFilename   *string    `json:"original_filename"`
+	ProcessingWarnings StringList `json:"processing_warnings"`
+	ProcessingBranch   *string    `json:"processing_branch"`
+	ProcessingStatus   *string    `json:"processing_status"`
+	ProcessingError    *string    `json:"processing_error"`
+	Renditions         Renditions `json:"renditions"`
+	HLSURL             *string    `json:"hls_url"`
+	// ChecksumSHA256 is the base64 SHA-256 of the stored file, when known.
+	ChecksumSHA256    *string  `json:"checksum_sha256"`
+	PasswordProtected bool     `json:"password_protected"`
+	PasswordHash      *string  `json:"-"`
+	Version           int      `json:"version"`
+	SizeBytes         *int64   `json:"size_bytes"`
+	DurationSeconds   *float64 `json:"duration_seconds"`
+	// AllowedEmbedOrigins, when non-empty, limits which sites may be handed
+	// the video's URL. Only the owner sees it.
+	AllowedEmbedOrigins StringList `json:"-"`
+	Visibility          string     `json:"visibility"`
+	// DeletedAt is when the video was moved to the trash, or nil.
+	DeletedAt *time.Time `json:"deleted_at"`
+	UploadMetadata
 	CreateVideoParams
 }
 
+// UploadMetadata describes the client that uploaded a video's content. It is
+// kept for support and never serialized.
+type UploadMetadata struct {
+	UploadContentType *string `json:"-"`
+	UploadClientIP    *string `json:"-"`
+	UploadUserAgent   *string `json:"-"`
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// videoColumns is the column list shared by every query that loads a full Video.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_grid_url,
+		thumbnail_width,
+		thumbnail_height,
+		thumbnail_modern_url,
 		video_url,
-		user_id
+		status,
+		content_type,
+		original_filename,
+		upload_content_type,
+		upload_client_ip,
+		upload_user_agent,
+		processing_warnings,
+		processing_branch,
+		processing_status,
+		processing_error,
+		renditions,
+		hls_url,
+		checksum_sha256,
+		password_hash,
+		version,
+		size_bytes,
+		duration_seconds,
+		allowed_embed_origins,
+		visibility,
+		deleted_at,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailGridURL,
+		&video.ThumbnailWidth,
+		&video.ThumbnailHeight,
+		&video.ThumbnailModernURL,
+		&video.VideoURL,
+		&video.Status,
+		&video.ContentType,
+		&video.OriginalFilename,
+		&video.UploadContentType,
+		&video.UploadClientIP,
+		&video.UploadUserAgent,
+		&video.ProcessingWarnings,
+		&video.ProcessingBranch,
+		&video.ProcessingStatus,
+		&video.ProcessingError,
+		&video.Renditions,
+		&video.HLSURL,
+		&video.ChecksumSHA256,
+		&video.PasswordHash,
+		&video.Version,
+		&video.SizeBytes,
+		&video.DurationSeconds,
+		&video.AllowedEmbedOrigins,
+		&video.Visibility,
+		&video.DeletedAt,
+		&video.UserID,
+	)
+	video.PasswordProtected = video.PasswordHash != nil
+	return video, err
+}
+
+func (c Client) GetVideos(userID uuid.UUID, includeDrafts bool) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
+	AND (? OR status != ?)
+	AND deleted_at IS NULL
 	ORDER BY created_at DESC
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, userID, includeDrafts, VideoStatusDraft)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +180,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,6 +190,125 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
+// Sort orders for GetVideoPage.
+const (
+	VideoSortCreatedAt = "created_at"
+	VideoSortTitle     = "title"
+)
+
+// videoSortColumns maps each sort order to the expression rows are ordered
+// and compared by. Titles sort case-insensitively.
+var videoSortColumns = map[string]string{
+	VideoSortCreatedAt: "created_at",
+	VideoSortTitle:     "title COLLATE NOCASE",
+}
+
+// VideoCursor marks where a page of videos ended: the sort column's value
+// in its stored text form, and the ID that breaks ties between rows with
+// the same value.
+type VideoCursor struct {
+	Value string
+	ID    uuid.UUID
+}
+
+type VideoPageParams struct {
+	UserID        uuid.UUID
+	IncludeDrafts bool
+	// PublicOnly pages through every user's uploaded public videos
+	// instead of UserID's.
+	PublicOnly bool
+	// Trashed pages through UserID's videos in the trash instead of the
+	// rest.
+	Trashed    bool
+	Sort       string
+	Descending bool
+	// After, when set, starts the page after this position.
+	After *VideoCursor
+	Limit int
+}
+
+// GetVideoPage returns up to params.Limit of a user's videos, or of all
+// public ones, using keyset
+// pagination, plus the cursor for the next page, or nil on the last one.
+// Ordering is by the sort column and then by ID, so it is stable even for
+// videos created in the same second.
+func (c Client) GetVideoPage(params VideoPageParams) ([]Video, *VideoCursor, error) {
+	column, ok := videoSortColumns[params.Sort]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown video sort %q", params.Sort)
+	}
+	direction, cmp := "ASC", ">"
+	if params.Descending {
+		direction, cmp = "DESC", "<"
+	}
+
+	query := `
+	SELECT` + videoColumns + `, CAST(` + params.Sort + ` AS TEXT)
+	FROM videos
+	WHERE user_id = ?
+	AND (? OR status != ?)
+	AND (deleted_at IS NOT NULL) = ?
+	`
+	args := []any{params.UserID, params.IncludeDrafts, VideoStatusDraft, params.Trashed}
+	if params.PublicOnly {
+		query = `
+	SELECT` + videoColumns + `, CAST(` + params.Sort + ` AS TEXT)
+	FROM videos
+	WHERE visibility = ?
+	AND status != ?
+	AND deleted_at IS NULL
+	`
+		args = []any{VisibilityPublic, VideoStatusDraft}
+	}
+	if params.After != nil {
+		query += `AND (` + column + `, id) ` + cmp + ` (?, ?)
+	`
+		args = append(args, params.After.Value, params.After.ID)
+	}
+	query += `ORDER BY ` + column + ` ` + direction + `, id ` + direction + `
+	LIMIT ?
+	`
+	// One extra row tells whether there is a next page
+	args = append(args, params.Limit+1)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	var lastValue string
+	var next *VideoCursor
+	for rows.Next() {
+		if len(videos) == params.Limit {
+			next = &VideoCursor{Value: lastValue, ID: videos[len(videos)-1].ID}
+			break
+		}
+		var sortValue string
+		video, err := scanVideo(extraColumns{rows, []any{&sortValue}})
+		if err != nil {
+			return nil, nil, err
+		}
+		videos = append(videos, video)
+		lastValue = sortValue
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return videos, next, nil
+}
+
+// extraColumns scans columns selected after videoColumns into extra.
+type extraColumns struct {
+	rowScanner
+	extra []any
+}
+
+func (e extraColumns) Scan(dest ...any) error {
+	return e.rowScanner.Scan(append(dest, e.extra...)...)
+}
+
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
 	query := `
@@ -75,42 +318,32 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		status,
+		visibility,
+		user_id,
+		unique_title
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?,
+		CASE WHEN (SELECT unique_titles FROM users WHERE id = ?) THEN ? END)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, VideoStatusDraft, VisibilityPrivate, params.UserID, params.UserID, params.Title)
 	if err != nil {
-		return Video{}, err
+		return Video{}, titleError(err)
 	}
 
-	return c.GetVideo(id)
+	return c.GetVideo(id, false)
 }
 
-func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+// GetVideo returns the video with the given ID, or a zero Video when there
+// is none. Videos in the trash are only returned with includeDeleted set.
+func (c Client) GetVideo(id uuid.UUID, includeDeleted bool) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
+	AND (? OR deleted_at IS NULL)
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id, includeDeleted))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,31 +354,124 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
+// UpdateVideo writes video and bumps its version unconditionally.
 func (c Client) UpdateVideo(video Video) error {
+	_, err := c.updateVideo(video, nil)
+	return err
+}
+
+// UpdateVideoIfVersion writes video only if its stored version is still
+// version, bumping it in the same statement. It reports whether the row
+// was updated.
+func (c Client) UpdateVideoIfVersion(video Video, version int) (bool, error) {
+	return c.updateVideo(video, &version)
+}
+
+func (c Client) updateVideo(video Video, version *int) (bool, error) {
 	query := `
 	UPDATE videos
 	SET
+		version = version + 1,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_grid_url = ?,
+		thumbnail_width = ?,
+		thumbnail_height = ?,
+		thumbnail_modern_url = ?,
 		video_url = ?,
-		user_id = ?
+		status = ?,
+		content_type = ?,
+		original_filename = ?,
+		upload_content_type = ?,
+		upload_client_ip = ?,
+		upload_user_agent = ?,
+		processing_warnings = ?,
+		processing_branch = ?,
+		processing_status = ?,
+		processing_error = ?,
+		renditions = ?,
+		hls_url = ?,
+		checksum_sha256 = ?,
+		password_hash = ?,
+		size_bytes = ?,
+		duration_seconds = ?,
+		allowed_embed_origins = ?,
+		visibility = ?,
+		deleted_at = ?,
+		user_id = ?,
+		unique_title = CASE WHEN (SELECT unique_titles FROM users WHERE id = ?) THEN ? END
 	WHERE id = ?
+	AND (? IS NULL OR version = ?)
 	`
 
-	_, err := c.db.Exec(
+	res, err := c.db.Exec(
 		query,
 		video.Title,
 		video.Description,
 		video.ThumbnailURL,
+		video.ThumbnailGridURL,
+		video.ThumbnailWidth,
+		video.ThumbnailHeight,
+		video.ThumbnailModernURL,
 		video.VideoURL,
+		video.Status,
+		video.ContentType,
+		video.OriginalFilename,
+		video.UploadContentType,
+		video.UploadClientIP,
+		video.UploadUserAgent,
+		video.ProcessingWarnings,
+		video.ProcessingBranch,
+		video.ProcessingStatus,
+		video.ProcessingError,
+		video.Renditions,
+		video.HLSURL,
+		video.ChecksumSHA256,
+		video.PasswordHash,
+		video.SizeBytes,
+		video.DurationSeconds,
+		video.AllowedEmbedOrigins,
+		video.Visibility,
+		video.DeletedAt,
+		video.UserID,
 		video.UserID,
+		video.Title,
 		video.ID,
+		version,
+		version,
 	)
+	if err != nil {
+		return false, titleError(err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetVideoProcessingStatus records the state of a video's latest upload
+// without touching the rest of the row, which the upload's owner may be
+// editing meanwhile.
+func (c Client) SetVideoProcessingStatus(id uuid.UUID, status, processingError *string) error {
+	_, err := c.db.Exec(`
+	UPDATE videos
+	SET version = version + 1, processing_status = ?, processing_error = ?
+	WHERE id = ?
+	`, status, processingError, id)
 	return err
 }
 
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	// SQLite doesn't enforce foreign keys by default, so cascade by hand
+	if _, err := c.db.Exec(`DELETE FROM share_links WHERE video_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(`DELETE FROM processing_runs WHERE video_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(`DELETE FROM access_events WHERE video_id = ?`, id); err != nil {
+		return err
+	}
+
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
@@ -153,3 +479,233 @@ func (c Client) DeleteVideo(id uuid.UUID) error {
 	_, err := c.db.Exec(query, id)
 	return err
 }
+
+// CountVideos returns how many videos userID owns outside the trash.
+// When withContentOnly is set, drafts that never had a video uploaded are
+// not counted.
+func (c Client) CountVideos(userID uuid.UUID, withContentOnly bool) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE user_id = ?
+	AND deleted_at IS NULL
+	`
+	if withContentOnly {
+		query += ` AND video_url IS NOT NULL`
+	}
+
+	var count int
+	err := c.db.QueryRow(query, userID).Scan(&count)
+	return count, err
+}
+
+// CountVideosReferencing returns how many videos other than exclude use
+// url as their video, thumbnail, grid or a rendition. Stored files are
+// named by content and shared, so they may only be deleted at zero.
+func (c Client) CountVideosReferencing(url string, exclude uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE id != ?
+	AND (
+		video_url = ?
+		OR thumbnail_url = ?
+		OR thumbnail_grid_url = ?
+		OR thumbnail_modern_url = ?
+		OR instr(COALESCE(renditions, ''), '"' || ? || '"') > 0
+	)
+	`
+	var count int
+	err := c.db.QueryRow(query, exclude, url, url, url, url, url).Scan(&count)
+	return count, err
+}
+
+// GetVideosWithThumbnails returns every video that has a thumbnail, across
+// all users, for maintenance jobs.
+func (c Client) GetVideosWithThumbnails() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE thumbnail_url IS NOT NULL
+	ORDER BY created_at
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// GetAllVideos returns every video across all users, oldest first, for
+// maintenance jobs that need everything rows refer to.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	ORDER BY created_at
+	`
+	return c.queryVideos(query)
+}
+
+// GetVideosWithVideoURLs returns every uploaded video across all users,
+// oldest first, for maintenance jobs.
+func (c Client) GetVideosWithVideoURLs() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL
+	ORDER BY created_at
+	`
+	return c.queryVideos(query)
+}
+
+// GetVideosMissingMediaInfo returns up to limit uploaded videos created
+// after the given time whose size or duration hasn't been recorded, oldest
+// first.
+func (c Client) GetVideosMissingMediaInfo(after time.Time, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL
+	AND (size_bytes IS NULL OR duration_seconds IS NULL)
+	AND created_at > ?
+	ORDER BY created_at
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, after.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// CountVideosMissingMediaInfo counts the rows GetVideosMissingMediaInfo
+// would eventually return.
+func (c Client) CountVideosMissingMediaInfo() (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE video_url IS NOT NULL
+	AND (size_bytes IS NULL OR duration_seconds IS NULL)
+	`
+	var count int
+	err := c.db.QueryRow(query).Scan(&count)
+	return count, err
+}
+
+// SetVideoMediaInfo records size and duration without touching anything
+// else, so maintenance jobs can't clobber concurrent edits.
+func (c Client) SetVideoMediaInfo(id uuid.UUID, sizeBytes int64, durationSeconds float64) error {
+	query := `
+	UPDATE videos
+	SET size_bytes = ?, duration_seconds = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, sizeBytes, durationSeconds, id)
+	return err
+}
+
+// GetVideosDeletedBefore returns every video moved to the trash before
+// cutoff, oldest first, for purging.
+func (c Client) GetVideosDeletedBefore(cutoff time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at < ?
+	ORDER BY deleted_at
+	`
+	return c.queryVideos(query, cutoff.UTC())
+}
+
+// queryVideos runs a query selecting videoColumns and scans every row.
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// GetLargestVideos returns up to limit of userID's uploaded videos with a
+// known size, largest first.
+func (c Client) GetLargestVideos(userID uuid.UUID, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	AND deleted_at IS NULL
+	AND video_url IS NOT NULL
+	AND size_bytes IS NOT NULL
+	ORDER BY size_bytes DESC
+	LIMIT ?
+	`
+	return c.queryVideos(query, userID, limit)
+}
+
+// GetUnviewedVideos returns up to limit of userID's uploaded videos created
+// before the given time that have no access events, oldest first.
+func (c Client) GetUnviewedVideos(userID uuid.UUID, createdBefore time.Time, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	AND deleted_at IS NULL
+	AND video_url IS NOT NULL
+	AND created_at < ?
+	AND NOT EXISTS (SELECT 1 FROM access_events WHERE access_events.video_id = videos.id)
+	ORDER BY created_at
+	LIMIT ?
+	`
+	return c.queryVideos(query, userID, createdBefore.UTC(), limit)
+}
+
+// GetStaleDrafts returns up to limit of userID's drafts created before the
+// given time that never received content, oldest first.
+func (c Client) GetStaleDrafts(userID uuid.UUID, createdBefore time.Time, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	AND deleted_at IS NULL
+	AND video_url IS NULL
+	AND created_at < ?
+	ORDER BY created_at
+	LIMIT ?
+	`
+	return c.queryVideos(query, userID, createdBefore.UTC(), limit)
+}
@@ -0,0 +1,170 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+const testKMSKey = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+// putHeaders records the encryption and tagging headers of the requests
+// that start storing an object: PutObject and CreateMultipartUpload.
+type putHeaders struct {
+	mu   sync.Mutex
+	sent map[string]http.Header
+}
+
+func recordPutHeaders(fake *storagetest.FakeS3) *putHeaders {
+	h := &putHeaders{sent: map[string]http.Header{}}
+	fake.FailWhen(func(op string, r *http.Request) bool {
+		if op == "PutObject" || op == "CreateMultipartUpload" {
+			h.mu.Lock()
+			h.sent[op] = r.Header.Clone()
+			h.mu.Unlock()
+		}
+		return false
+	})
+	return h
+}
+
+func (h *putHeaders) get(op string) http.Header {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sent[op]
+}
+
+var testTags = map[string]string{
+	"user_id":  "1b4e28ba-2fa1-11d2-883f-0016d3cca427",
+	"video_id": "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+}
+
+func TestEncodeTags(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{testTags, "user_id=1b4e28ba-2fa1-11d2-883f-0016d3cca427&video_id=6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+		{map[string]string{"team": "video & audio", "cost/center": "a=b"}, "cost%2Fcenter=a%3Db&team=video+%26+audio"},
+	}
+	for _, tt := range tests {
+		got := storage.EncodeTags(tt.tags)
+		if got != tt.want {
+			t.Errorf("EncodeTags(%v) = %q, want %q", tt.tags, got, tt.want)
+		}
+		// S3 reads the header as a query string
+		parsed, err := url.ParseQuery(got)
+		if err != nil || len(parsed) != len(tt.tags) {
+			t.Fatalf("%q parses to %v, %v", got, parsed, err)
+		}
+		for k, v := range tt.tags {
+			if parsed.Get(k) != v {
+				t.Errorf("%q: %s = %q, want %q", got, k, parsed.Get(k), v)
+			}
+		}
+	}
+}
+
+func TestS3PutEncryptionAndTags(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		op   string
+	}{
+		{"single part", 1 << 10, "PutObject"},
+		{"multipart", 2*testPartSize + 1, "CreateMultipartUpload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, store, _ := newMultipartS3(t)
+			store.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+			store.SSEKMSKeyID = testKMSKey
+			sent := recordPutHeaders(fake)
+
+			data := testVideo(tt.size)
+			if err := store.Put(context.Background(), "videos/tagged.mp4", bytes.NewReader(data), int64(len(data)), storage.PutOptions{ContentType: "video/mp4", Tags: testTags}); err != nil {
+				t.Fatal(err)
+			}
+			h := sent.get(tt.op)
+			if h == nil {
+				t.Fatalf("no %s request", tt.op)
+			}
+			if got := h.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+				t.Errorf("encryption = %q, want aws:kms", got)
+			}
+			if got := h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != testKMSKey {
+				t.Errorf("KMS key = %q, want %q", got, testKMSKey)
+			}
+			if got := h.Get("X-Amz-Tagging"); got != storage.EncodeTags(testTags) {
+				t.Errorf("tagging = %q, want %q", got, storage.EncodeTags(testTags))
+			}
+			if obj, _ := fake.Object(testBucket, "videos/tagged.mp4"); !bytes.Equal(obj.Data, data) {
+				t.Error("stored object doesn't hold the data")
+			}
+		})
+	}
+}
+
+func TestS3PutWithoutEncryptionOrTags(t *testing.T) {
+	fake, store, _ := newMultipartS3(t)
+	sent := recordPutHeaders(fake)
+	if err := store.Put(context.Background(), "plain.mp4", strings.NewReader("video"), 5, storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	h := sent.get("PutObject")
+	for _, name := range []string{"X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", "X-Amz-Tagging"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("%s = %q, want it unset", name, got)
+		}
+	}
+}
+
+func TestS3PresignWithEncryption(t *testing.T) {
+	_, store, _ := newMultipartS3(t)
+	store.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+	store.SSEKMSKeyID = testKMSKey
+
+	// Direct uploads sign the encryption and tags, so clients must send them
+	uploadURL, headers, err := store.PresignPut(context.Background(), "direct/video.mp4", 1024, storage.PutOptions{ContentType: "video/mp4", Tags: testTags}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": testKMSKey,
+		"X-Amz-Tagging":                               storage.EncodeTags(testTags),
+		"Content-Type":                                "video/mp4",
+	} {
+		if got := headers.Get(name); got != want {
+			t.Errorf("signed header %s = %q, want %q", name, got, want)
+		}
+	}
+	u, err := url.Parse(uploadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := u.Query().Get("X-Amz-SignedHeaders")
+	for _, name := range []string{"x-amz-server-side-encryption", "x-amz-tagging"} {
+		if !strings.Contains(signed, name) {
+			t.Errorf("X-Amz-SignedHeaders = %q, want %s signed", signed, name)
+		}
+	}
+
+	// Reads need nothing extra: S3 decrypts for anyone allowed the key
+	getURL, err := store.PresignGet(context.Background(), "direct/video.mp4", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(getURL), "server-side-encryption") {
+		t.Errorf("presigned GET %s carries encryption parameters", getURL)
+	}
+}
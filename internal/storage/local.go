@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local stores objects as files under Dir, for development without a
+// cloud account. Its presigned URLs point at BaseURL, where the server is
+// expected to serve Dir, and carry an HMAC signature that Verify checks.
+type Local struct {
+	Dir string
+	// BaseURL is the URL Dir is served at, without a trailing slash.
+	BaseURL string
+	// Secret keys the URL signatures.
+	Secret []byte
+}
+
+// NewLocal returns storage under dir, served at baseURL.
+func NewLocal(dir, baseURL string, secret []byte) *Local {
+	return &Local{Dir: dir, BaseURL: strings.TrimSuffix(baseURL, "/"), Secret: secret}
+}
+
+func (l *Local) Name() string {
+	return "local"
+}
+
+// Path returns the file key is stored in, so local tools can read it
+// without going through a URL.
+func (l *Local) Path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temp file beside the destination and renames it into
+// place, so a reader never sees a partial object.
+func (l *Local) Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error {
+	dst, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), contextReader{ctx: ctx, r: body})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if opts.ChecksumSHA256 != nil && !bytes.Equal(hash.Sum(nil), opts.ChecksumSHA256) {
+		return ErrChecksumMismatch
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Copy reads the source file back through Put, so the copy appears
+// atomically like any other object.
+func (l *Local) Copy(ctx context.Context, srcKey, dstKey string) error {
+	src, err := l.Path(srcKey)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return l.Put(ctx, dstKey, f, info.Size(), PutOptions{})
+}
+
+// Get opens key's file at offset.
+func (l *Local) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		if err == nil {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// List walks the files under Dir, using their modification times. Put's
+// temp files are skipped, as are names outside what Path accepts.
+func (l *Local) List(ctx context.Context, prefix string, fn func(ListedObject) error) error {
+	// Only the prefix's directory can hold matches
+	root := l.Dir
+	if dir := path.Dir(prefix); strings.Contains(prefix, "/") && !strings.HasPrefix(dir, "..") {
+		root = filepath.Join(l.Dir, filepath.FromSlash(dir))
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(ListedObject{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Head reports the file's size, and a content type from its extension.
+func (l *Local) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: info.Size(), ContentType: mime.TypeByExtension(path.Ext(key))}, nil
+}
+
+// PresignGet returns key's URL under BaseURL with expires and signature
+// query parameters.
+func (l *Local) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, err := l.Path(key); err != nil {
+		return "", err
+	}
+	exp := time.Now().Add(expires).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(exp, 10))
+	query.Set("signature", l.signature(key, exp))
+	return l.BaseURL + "/" + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// Verify reports whether query holds an unexpired signature for key, as
+// issued by PresignGet.
+func (l *Local) Verify(key string, query url.Values) bool {
+	exp, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("signature")), []byte(l.signature(key, exp)))
+}
+
+func (l *Local) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, l.Secret)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// contextReader stops reading once ctx is done, so a cancelled Put doesn't
+// keep copying.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
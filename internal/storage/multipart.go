@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// MultipartJournal records multipart uploads S3 kept after a failed Put,
+// so a later Put of the same object can send only the parts that are
+// missing. Uploads are recorded under the PutOptions.ResumeScope they were
+// made for.
+type MultipartJournal interface {
+	// Find returns the upload recorded for key under scope, if any.
+	Find(ctx context.Context, scope, key string) (MultipartUpload, bool, error)
+	// Save records upload under scope, replacing any record for its key.
+	Save(ctx context.Context, scope string, upload MultipartUpload) error
+	// Remove forgets the upload recorded for key under scope.
+	Remove(ctx context.Context, scope, key string) error
+}
+
+// MultipartUpload is a multipart upload left unfinished in S3.
+type MultipartUpload struct {
+	Bucket   string
+	Key      string
+	UploadID string
+	// PartSize is the size of every part but the last.
+	PartSize int64
+	// ChecksumAlgorithm is what each part's Checksum was computed with,
+	// e.g. "SHA256" or "CRC32".
+	ChecksumAlgorithm string
+	Parts             []UploadedPart
+}
+
+// UploadedPart is a part S3 has received.
+type UploadedPart struct {
+	Number   int32
+	ETag     string
+	Checksum string
+}
+
+// journalTimeout bounds recording a failed upload, which happens after
+// the upload's own context may have been cancelled.
+const journalTimeout = 30 * time.Second
+
+// partSize returns the part size a multipart upload of size bytes uses:
+// PartParams' choice, grown as the SDK would if it needs more than
+// MaxUploadParts parts.
+func (s *S3) partSize(size int64) (int64, int) {
+	partSize, concurrency := manager.DefaultUploadPartSize, manager.DefaultUploadConcurrency
+	if s.PartParams != nil {
+		partSize, concurrency = s.PartParams()
+	}
+	if size/partSize >= int64(manager.MaxUploadParts) {
+		partSize = size/int64(manager.MaxUploadParts) + 1
+	}
+	return partSize, concurrency
+}
+
+// putMultipart sends input in parts with the SDK's uploader. With a
+// Journal and a ResumeScope, an upload that fails is left in S3 and
+// recorded, and the next putMultipart of the same key resumes it.
+func (s *S3) putMultipart(ctx context.Context, input *s3.PutObjectInput, size int64, scope string) error {
+	resumable := s.Journal != nil && scope != ""
+	if body, ok := input.Body.(io.ReadSeeker); ok && resumable {
+		start, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		done, err := s.resumeMultipart(ctx, input, start, size, scope)
+		if done || err != nil {
+			return err
+		}
+		// Starting afresh, from wherever the body started
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	partSize, concurrency := s.partSize(size)
+	uploader := manager.NewUploader(s.Client, func(u *manager.Uploader) {
+		u.PartSize, u.Concurrency = partSize, concurrency
+		u.LeavePartsOnError = resumable
+		if s.PartAttempts > 0 {
+			u.ClientOptions = append(u.ClientOptions, func(o *s3.Options) {
+				o.RetryMaxAttempts = s.PartAttempts
+			})
+		}
+	})
+	_, err := uploader.Upload(ctx, input)
+	var failure manager.MultiUploadFailure
+	if resumable && errors.As(err, &failure) && failure.UploadID() != "" {
+		s.recordFailedUpload(ctx, scope, aws.ToString(input.Key), failure.UploadID(), partSize)
+	}
+	return err
+}
+
+// recordFailedUpload journals the parts of uploadID that made it to S3.
+// If they can't be listed the upload is aborted instead, so its parts
+// aren't billed for nothing.
+func (s *S3) recordFailedUpload(ctx context.Context, scope, key, uploadID string, partSize int64) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), journalTimeout)
+	defer cancel()
+	upload := MultipartUpload{Bucket: s.Bucket, Key: key, UploadID: uploadID, PartSize: partSize}
+	err := s.listParts(ctx, &upload)
+	if err == nil {
+		err = s.Journal.Save(ctx, scope, upload)
+	}
+	if err != nil {
+		log.Printf("couldn't record multipart upload %s of %s for resuming, aborting it: %v", uploadID, key, err)
+		s.AbortMultipart(ctx, upload)
+	}
+}
+
+// listParts fills in upload's parts and checksum algorithm from S3.
+func (s *S3) listParts(ctx context.Context, upload *MultipartUpload) error {
+	upload.Parts = nil
+	paginator := s3.NewListPartsPaginator(s.Client, &s3.ListPartsInput{
+		Bucket:   &upload.Bucket,
+		Key:      &upload.Key,
+		UploadId: &upload.UploadID,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if page.ChecksumAlgorithm != "" {
+			upload.ChecksumAlgorithm = string(page.ChecksumAlgorithm)
+		}
+		for _, p := range page.Parts {
+			part := UploadedPart{Number: aws.ToInt32(p.PartNumber), ETag: aws.ToString(p.ETag)}
+			switch {
+			case p.ChecksumSHA256 != nil:
+				upload.ChecksumAlgorithm, part.Checksum = string(types.ChecksumAlgorithmSha256), *p.ChecksumSHA256
+			case p.ChecksumCRC32 != nil:
+				upload.ChecksumAlgorithm, part.Checksum = string(types.ChecksumAlgorithmCrc32), *p.ChecksumCRC32
+			}
+			upload.Parts = append(upload.Parts, part)
+		}
+	}
+	return nil
+}
+
+// resumeMultipart finishes an upload of input's key journaled under scope,
+// sending only the parts S3 doesn't have. input.Body must be an
+// io.ReadSeeker, since parts are read by offset from start. It reports false, with no
+// error, when there was nothing to resume or the recorded upload can't be
+// used, in which case the caller starts afresh. A failed resume stays
+// journaled with the parts it added.
+func (s *S3) resumeMultipart(ctx context.Context, input *s3.PutObjectInput, start, size int64, scope string) (bool, error) {
+	key := aws.ToString(input.Key)
+	upload, ok, err := s.Journal.Find(ctx, scope, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	body := input.Body.(io.ReadSeeker)
+	if upload.Bucket != s.Bucket || upload.PartSize < manager.MinUploadPartSize {
+		s.discardUpload(ctx, scope, upload)
+		return false, nil
+	}
+
+	have := map[int32]UploadedPart{}
+	for _, p := range upload.Parts {
+		have[p.Number] = p
+	}
+	parts := int32((size + upload.PartSize - 1) / upload.PartSize)
+	completed := make([]types.CompletedPart, 0, parts)
+	buf := make([]byte, upload.PartSize)
+	for n := int32(1); n <= parts; n++ {
+		offset := int64(n-1) * upload.PartSize
+		chunk := buf[:min(upload.PartSize, size-offset)]
+		if _, err := body.Seek(start+offset, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return true, err
+		}
+
+		// A recorded part is only reused if it holds these bytes
+		part, ok := have[n]
+		if !ok || part.Checksum == "" || partChecksum(upload.ChecksumAlgorithm, chunk) != part.Checksum {
+			part, err = s.uploadPart(ctx, upload, n, chunk)
+			if errors.Is(err, errNoSuchUpload) {
+				// S3 no longer has it, e.g. a lifecycle rule aborted it
+				s.discardUpload(ctx, scope, upload)
+				return false, nil
+			}
+			if err != nil {
+				return true, err
+			}
+			have[n] = part
+			upload.Parts = sortedParts(have)
+			// Saved as we go, so another failure keeps this progress
+			if err := s.Journal.Save(ctx, scope, upload); err != nil {
+				return true, err
+			}
+		}
+		completed = append(completed, completedPart(upload.ChecksumAlgorithm, part))
+	}
+
+	_, err = s.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &upload.Bucket,
+		Key:             &upload.Key,
+		UploadId:        &upload.UploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		if isNoSuchUpload(err) {
+			s.discardUpload(ctx, scope, upload)
+			return false, nil
+		}
+		return true, err
+	}
+	return true, s.Journal.Remove(ctx, scope, key)
+}
+
+func sortedParts(parts map[int32]UploadedPart) []UploadedPart {
+	sorted := make([]UploadedPart, 0, len(parts))
+	for _, p := range parts {
+		sorted = append(sorted, p)
+	}
+	slices.SortFunc(sorted, func(a, b UploadedPart) int { return cmp.Compare(a.Number, b.Number) })
+	return sorted
+}
+
+// errNoSuchUpload is returned by uploadPart when S3 doesn't know the
+// upload.
+var errNoSuchUpload = errors.New("storage: no such multipart upload")
+
+func (s *S3) uploadPart(ctx context.Context, upload MultipartUpload, number int32, chunk []byte) (UploadedPart, error) {
+	input := &s3.UploadPartInput{
+		Bucket:     &upload.Bucket,
+		Key:        &upload.Key,
+		UploadId:   &upload.UploadID,
+		PartNumber: aws.Int32(number),
+		Body:       bytes.NewReader(chunk),
+	}
+	checksum := partChecksum(upload.ChecksumAlgorithm, chunk)
+	switch types.ChecksumAlgorithm(upload.ChecksumAlgorithm) {
+	case types.ChecksumAlgorithmSha256:
+		input.ChecksumSHA256 = &checksum
+	case types.ChecksumAlgorithmCrc32:
+		input.ChecksumCRC32 = &checksum
+	}
+	out, err := s.Client.UploadPart(ctx, input, func(o *s3.Options) {
+		if s.PartAttempts > 0 {
+			o.RetryMaxAttempts = s.PartAttempts
+		}
+	})
+	if isNoSuchUpload(err) {
+		return UploadedPart{}, fmt.Errorf("%w: %w", errNoSuchUpload, err)
+	}
+	if err != nil {
+		return UploadedPart{}, err
+	}
+	return UploadedPart{Number: number, ETag: aws.ToString(out.ETag), Checksum: checksum}, nil
+}
+
+// partChecksum is the base64 checksum S3 records for a part with the
+// given algorithm, or "" for algorithms not used here.
+func partChecksum(algorithm string, data []byte) string {
+	var h hash.Hash
+	switch types.ChecksumAlgorithm(algorithm) {
+	case types.ChecksumAlgorithmSha256:
+		h = sha256.New()
+	case types.ChecksumAlgorithmCrc32:
+		h = crc32.NewIEEE()
+	default:
+		return ""
+	}
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func completedPart(algorithm string, part UploadedPart) types.CompletedPart {
+	completed := types.CompletedPart{PartNumber: aws.Int32(part.Number), ETag: aws.String(part.ETag)}
+	switch types.ChecksumAlgorithm(algorithm) {
+	case types.ChecksumAlgorithmSha256:
+		completed.ChecksumSHA256 = aws.String(part.Checksum)
+	case types.ChecksumAlgorithmCrc32:
+		completed.ChecksumCRC32 = aws.String(part.Checksum)
+	}
+	return completed
+}
+
+// discardUpload aborts upload and forgets it.
+func (s *S3) discardUpload(ctx context.Context, scope string, upload MultipartUpload) {
+	if err := s.AbortMultipart(ctx, upload); err != nil {
+		log.Printf("couldn't abort multipart upload %s of %s: %v", upload.UploadID, upload.Key, err)
+	}
+	if err := s.Journal.Remove(ctx, scope, upload.Key); err != nil {
+		log.Printf("couldn't forget multipart upload %s of %s: %v", upload.UploadID, upload.Key, err)
+	}
+}
+
+// AbortMultipart aborts upload, deleting its parts. Aborting an upload S3
+// no longer knows succeeds.
+func (s *S3) AbortMultipart(ctx context.Context, upload MultipartUpload) error {
+	_, err := s.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &upload.Bucket,
+		Key:      &upload.Key,
+		UploadId: &upload.UploadID,
+	})
+	if isNoSuchUpload(err) {
+		return nil
+	}
+	return err
+}
+
+// isNoSuchUpload reports whether err is S3 not knowing an upload ID. Only
+// some operations model the error, so the code is checked too.
+func isNoSuchUpload(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload"
+}
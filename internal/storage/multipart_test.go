@@ -0,0 +1,284 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+const (
+	testBucket   = "tubely-test"
+	testPartSize = 5 << 20
+)
+
+// memoryJournal is a storage.MultipartJournal in a map.
+type memoryJournal struct {
+	mu      sync.Mutex
+	uploads map[string]storage.MultipartUpload
+}
+
+func (j *memoryJournal) Find(ctx context.Context, scope, key string) (storage.MultipartUpload, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	upload, ok := j.uploads[scope+"/"+key]
+	return upload, ok, nil
+}
+
+func (j *memoryJournal) Save(ctx context.Context, scope string, upload storage.MultipartUpload) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.uploads[scope+"/"+upload.Key] = upload
+	return nil
+}
+
+func (j *memoryJournal) Remove(ctx context.Context, scope, key string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.uploads, scope+"/"+key)
+	return nil
+}
+
+func newMultipartS3(t *testing.T) (*storagetest.FakeS3, *storage.S3, *memoryJournal) {
+	t.Helper()
+	fake := storagetest.NewFakeS3(t)
+	journal := &memoryJournal{uploads: map[string]storage.MultipartUpload{}}
+	store := &storage.S3{
+		Client:             fake.Client(),
+		Bucket:             testBucket,
+		MultipartThreshold: testPartSize,
+		// One part at a time, so which parts made it is predictable
+		PartParams: func() (int64, int) { return testPartSize, 1 },
+		Journal:    journal,
+	}
+	return fake, store, journal
+}
+
+// testVideo returns n bytes that differ from part to part.
+func testVideo(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i / 1013)
+	}
+	return data
+}
+
+func failPart(number string) func(op string, r *http.Request) bool {
+	return func(op string, r *http.Request) bool {
+		return op == "UploadPart" && r.URL.Query().Get("partNumber") == number
+	}
+}
+
+func TestS3PutResumesFailedMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	fake, store, journal := newMultipartS3(t)
+	data := testVideo(2*testPartSize + 1<<20) // three parts
+	opts := storage.PutOptions{ContentType: "video/mp4", ResumeScope: "video-1"}
+
+	fake.FailWhen(failPart("2"))
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), opts); err == nil {
+		t.Fatal("Put succeeded with part 2 failing")
+	}
+	recorded, ok, _ := journal.Find(ctx, "video-1", "videos/a.mp4")
+	if !ok {
+		t.Fatal("failed upload wasn't journaled")
+	}
+	if len(recorded.Parts) == 0 || recorded.Parts[0].Number != 1 {
+		t.Fatalf("journaled parts = %+v, want part 1", recorded.Parts)
+	}
+	if ids := fake.UploadIDs(); len(ids) != 1 || ids[0] != recorded.UploadID {
+		t.Fatalf("open uploads = %v, want just %s", ids, recorded.UploadID)
+	}
+
+	fake.FailWhen(nil)
+	sent := fake.Calls("UploadPart")
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), opts); err != nil {
+		t.Fatalf("resumed Put: %v", err)
+	}
+	if got, want := fake.Calls("UploadPart")-sent, 3-len(recorded.Parts); got != want {
+		t.Errorf("resume sent %d parts, want the %d missing ones", got, want)
+	}
+	if n := fake.Calls("CreateMultipartUpload"); n != 1 {
+		t.Errorf("CreateMultipartUpload called %d times, want 1", n)
+	}
+	obj, ok := fake.Object(testBucket, "videos/a.mp4")
+	if !ok || !bytes.Equal(obj.Data, data) {
+		t.Fatal("resumed object doesn't hold the uploaded bytes")
+	}
+	if obj.ContentType != "video/mp4" {
+		t.Errorf("content type = %q, want video/mp4", obj.ContentType)
+	}
+	if _, ok, _ := journal.Find(ctx, "video-1", "videos/a.mp4"); ok {
+		t.Error("completed upload is still journaled")
+	}
+	if ids := fake.UploadIDs(); len(ids) != 0 {
+		t.Errorf("open uploads = %v, want none", ids)
+	}
+}
+
+func TestS3PutResendsPartsThatChanged(t *testing.T) {
+	ctx := context.Background()
+	fake, store, _ := newMultipartS3(t)
+	data := testVideo(2*testPartSize + 1<<20)
+	opts := storage.PutOptions{ResumeScope: "video-1"}
+
+	fake.FailWhen(failPart("2"))
+	store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), opts)
+	fake.FailWhen(nil)
+
+	changed := bytes.Clone(data)
+	changed[10] ^= 0xff
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(changed), int64(len(changed)), opts); err != nil {
+		t.Fatalf("resumed Put: %v", err)
+	}
+	obj, _ := fake.Object(testBucket, "videos/a.mp4")
+	if !bytes.Equal(obj.Data, changed) {
+		t.Fatal("a recorded part was reused for different bytes")
+	}
+}
+
+func TestS3PutStartsAfreshWhenUploadIsGone(t *testing.T) {
+	ctx := context.Background()
+	fake, store, journal := newMultipartS3(t)
+	data := testVideo(2*testPartSize + 1<<20)
+	opts := storage.PutOptions{ResumeScope: "video-1"}
+
+	fake.FailWhen(failPart("2"))
+	store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), opts)
+	fake.FailWhen(nil)
+
+	// e.g. a bucket lifecycle rule aborted it
+	recorded, _, _ := journal.Find(ctx, "video-1", "videos/a.mp4")
+	if err := store.AbortMultipart(ctx, recorded); err != nil {
+		t.Fatalf("AbortMultipart: %v", err)
+	}
+
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), opts); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	obj, _ := fake.Object(testBucket, "videos/a.mp4")
+	if !bytes.Equal(obj.Data, data) {
+		t.Fatal("object doesn't hold the uploaded bytes")
+	}
+	if n := fake.Calls("CreateMultipartUpload"); n != 2 {
+		t.Errorf("CreateMultipartUpload called %d times, want 2", n)
+	}
+	if _, ok, _ := journal.Find(ctx, "video-1", "videos/a.mp4"); ok {
+		t.Error("upload is still journaled")
+	}
+}
+
+func TestS3PutAbortsFailedUploadWithoutScope(t *testing.T) {
+	ctx := context.Background()
+	fake, store, journal := newMultipartS3(t)
+	data := testVideo(2*testPartSize + 1<<20)
+
+	fake.FailWhen(failPart("2"))
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), storage.PutOptions{}); err == nil {
+		t.Fatal("Put succeeded with part 2 failing")
+	}
+	if ids := fake.UploadIDs(); len(ids) != 0 {
+		t.Errorf("open uploads = %v, want the failed one aborted", ids)
+	}
+	if len(journal.uploads) != 0 {
+		t.Errorf("journal = %v, want empty", journal.uploads)
+	}
+}
+
+func TestS3AbortMultipartOfUnknownUpload(t *testing.T) {
+	_, store, _ := newMultipartS3(t)
+	upload := storage.MultipartUpload{Bucket: testBucket, Key: "videos/a.mp4", UploadID: "gone"}
+	if err := store.AbortMultipart(context.Background(), upload); err != nil {
+		t.Fatalf("AbortMultipart of an unknown upload: %v", err)
+	}
+}
+
+func TestS3PutSplitsLargeObjectsIntoParts(t *testing.T) {
+	ctx := context.Background()
+	fake, store, _ := newMultipartS3(t)
+
+	small := testVideo(testPartSize - 1)
+	if err := store.Put(ctx, "videos/small.mp4", bytes.NewReader(small), int64(len(small)), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n, parts := fake.Calls("PutObject"), fake.Calls("UploadPart"); n != 1 || parts != 0 {
+		t.Errorf("object under the threshold: %d PutObject, %d UploadPart; want a single PutObject", n, parts)
+	}
+
+	data := testVideo(2*testPartSize + 1<<20)
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for op, want := range map[string]int{"CreateMultipartUpload": 1, "UploadPart": 3, "CompleteMultipartUpload": 1, "PutObject": 1} {
+		if got := fake.Calls(op); got != want {
+			t.Errorf("%s called %d times, want %d", op, got, want)
+		}
+	}
+	if obj, ok := fake.Object(testBucket, "videos/a.mp4"); !ok || !bytes.Equal(obj.Data, data) {
+		t.Error("object doesn't hold the uploaded bytes")
+	}
+}
+
+func TestS3PutRetriesTransientPartFailure(t *testing.T) {
+	ctx := context.Background()
+	fake, store, _ := newMultipartS3(t)
+	store.PartAttempts = 3
+	data := testVideo(2*testPartSize + 1<<20)
+
+	// Part 2 fails once; FailWhen's match runs under the fake's lock
+	failed := false
+	fake.FailWhen(func(op string, r *http.Request) bool {
+		if failed || !failPart("2")(op, r) {
+			return false
+		}
+		failed = true
+		return true
+	})
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), storage.PutOptions{}); err != nil {
+		t.Fatalf("Put with a transient part failure: %v", err)
+	}
+	if n := fake.Calls("UploadPart"); n != 4 {
+		t.Errorf("UploadPart called %d times, want 3 parts and a retry", n)
+	}
+	if n := fake.Calls("AbortMultipartUpload"); n != 0 {
+		t.Errorf("AbortMultipartUpload called %d times, want 0", n)
+	}
+	if obj, ok := fake.Object(testBucket, "videos/a.mp4"); !ok || !bytes.Equal(obj.Data, data) {
+		t.Error("object doesn't hold the uploaded bytes")
+	}
+}
+
+func TestS3PutAbortsWhenPartAttemptsRunOut(t *testing.T) {
+	ctx := context.Background()
+	fake, store, _ := newMultipartS3(t)
+	store.PartAttempts = 2
+	data := testVideo(2*testPartSize + 1<<20)
+
+	attempts := 0
+	fake.FailWhen(func(op string, r *http.Request) bool {
+		if !failPart("2")(op, r) {
+			return false
+		}
+		attempts++
+		return true
+	})
+	if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), int64(len(data)), storage.PutOptions{}); err == nil {
+		t.Fatal("Put succeeded with part 2 always failing")
+	}
+	if attempts != 2 {
+		t.Errorf("part 2 tried %d times, want PartAttempts", attempts)
+	}
+	if n := fake.Calls("AbortMultipartUpload"); n != 1 {
+		t.Errorf("AbortMultipartUpload called %d times, want 1", n)
+	}
+	if ids := fake.UploadIDs(); len(ids) != 0 {
+		t.Errorf("open uploads = %v, want the failed one aborted", ids)
+	}
+	if _, ok := fake.Object(testBucket, "videos/a.mp4"); ok {
+		t.Error("a failed upload was stored")
+	}
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3 stores objects in one S3 bucket.
+type S3 struct {
+	Client *s3.Client
+	Bucket string
+	// MultipartThreshold is the size from which objects are sent with the
+	// SDK's multipart uploader instead of a single PutObject, so a dropped
+	// connection only costs the in-flight parts.
+	MultipartThreshold int64
+	// PartParams picks the part size and concurrency of a multipart
+	// upload. The SDK's defaults are used when it is nil.
+	PartParams func() (partSize int64, concurrency int)
+	// PartAttempts is how many tries each part gets; when one runs out the
+	// upload is aborted so stray parts aren't billed. Zero keeps the
+	// client's retry setting.
+	PartAttempts int
+	// ServerSideEncryption, when set, is requested for every object put,
+	// with SSEKMSKeyID as the key for aws:kms; an empty ID uses the
+	// bucket's default KMS key. Reads need no changes, since S3 decrypts
+	// for anyone allowed to use the key.
+	ServerSideEncryption types.ServerSideEncryption
+	SSEKMSKeyID          string
+	// Journal, when set, records multipart uploads that fail partway for
+	// Puts with a ResumeScope, so retrying the Put resumes them. Without
+	// it a failed upload is aborted.
+	Journal MultipartJournal
+	// Presigner signs PresignGet and PresignPut URLs. It holds no bucket,
+	// so copies from WithBucket share it; when nil one is made per call.
+	Presigner *s3.PresignClient
+}
+
+// NewS3 returns storage in bucket with the default multipart threshold.
+func NewS3(client *s3.Client, bucket string) *S3 {
+	return &S3{Client: client, Bucket: bucket, MultipartThreshold: 64 << 20, Presigner: s3.NewPresignClient(client)}
+}
+
+// presigner returns s.Presigner, or a new one when it isn't set.
+func (s *S3) presigner() *s3.PresignClient {
+	if s.Presigner != nil {
+		return s.Presigner
+	}
+	return s3.NewPresignClient(s.Client)
+}
+
+// WithBucket returns a copy of s storing objects in bucket instead, for
+// objects recorded in another bucket.
+func (s *S3) WithBucket(bucket string) *S3 {
+	c := *s
+	c.Bucket = bucket
+	return &c
+}
+
+func (s *S3) Name() string {
+	return "s3"
+}
+
+// Put sends small objects in one PutObject and large ones in parts. A
+// whole-object SHA-256 is only verified by S3 on a single PutObject;
+// multipart uploads switch to SHA-256 checksums for every part.
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+		Body:   body,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = &opts.ContentType
+	}
+	if opts.ChecksumSHA256 != nil {
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(opts.ChecksumSHA256))
+	}
+	s.applyPutOptions(input, opts)
+
+	var err error
+	if size < s.MultipartThreshold {
+		_, err = s.Client.PutObject(ctx, input)
+	} else {
+		err = s.putMultipart(ctx, input, size, opts.ResumeScope)
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "BadDigest" {
+		return fmt.Errorf("%w: %w", ErrChecksumMismatch, err)
+	}
+	return err
+}
+
+// PresignPut returns a URL a client can PUT size bytes to key at until
+// expires has passed, and the headers it must send with them. The content
+// type, size, encryption and tags are all signed, so S3 rejects a request
+// that changes them.
+func (s *S3) PresignPut(ctx context.Context, key string, size int64, opts PutOptions, expires time.Duration) (string, http.Header, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        &s.Bucket,
+		Key:           &key,
+		ContentLength: aws.Int64(size),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = &opts.ContentType
+	}
+	s.applyPutOptions(input, opts)
+	presigned, err := s.presigner().PresignPutObject(ctx, input, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", nil, err
+	}
+	headers := presigned.SignedHeader.Clone()
+	headers.Del("Host")
+	return presigned.URL, headers, nil
+}
+
+// applyPutOptions sets the encryption and tagging every put carries.
+// PutObject and the multipart uploader both take them from input.
+func (s *S3) applyPutOptions(input *s3.PutObjectInput, opts PutOptions) {
+	if s.ServerSideEncryption != "" {
+		input.ServerSideEncryption = s.ServerSideEncryption
+		if s.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = &s.SSEKMSKeyID
+		}
+	}
+	if len(opts.Tags) > 0 {
+		input.Tagging = aws.String(EncodeTags(opts.Tags))
+	}
+}
+
+// EncodeTags encodes tags as the URL query string S3 expects in the
+// x-amz-tagging header, sorted by key.
+func EncodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.Bucket, Key: &key})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil
+	}
+	return err
+}
+
+func (s *S3) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.Bucket, Key: &key})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Size:               aws.ToInt64(out.ContentLength),
+		ContentType:        aws.ToString(out.ContentType),
+		ContentDisposition: aws.ToString(out.ContentDisposition),
+	}, nil
+}
+
+// Copy uses CopyObject, which keeps the object's metadata and tags and
+// handles objects up to 5 GB. The copy is encrypted like anything else Put.
+func (s *S3) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return s.copyObject(ctx, s.copyInput(srcKey, dstKey))
+}
+
+// ReplaceMetadata copies key onto itself with MetadataDirective REPLACE,
+// the only way S3 changes an object's headers. Tags are copied as they
+// are, and the object stays encrypted like anything else Put.
+func (s *S3) ReplaceMetadata(ctx context.Context, key string, meta ObjectMetadata) error {
+	input := s.copyInput(key, key)
+	input.MetadataDirective = types.MetadataDirectiveReplace
+	if meta.ContentType != "" {
+		input.ContentType = &meta.ContentType
+	}
+	if meta.ContentDisposition != "" {
+		input.ContentDisposition = &meta.ContentDisposition
+	}
+	return s.copyObject(ctx, input)
+}
+
+func (s *S3) copyInput(srcKey, dstKey string) *s3.CopyObjectInput {
+	input := &s3.CopyObjectInput{
+		Bucket:     &s.Bucket,
+		Key:        &dstKey,
+		CopySource: aws.String(url.PathEscape(s.Bucket) + "/" + (&url.URL{Path: srcKey}).EscapedPath()),
+	}
+	if s.ServerSideEncryption != "" {
+		input.ServerSideEncryption = s.ServerSideEncryption
+		if s.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = &s.SSEKMSKeyID
+		}
+	}
+	return input
+}
+
+func (s *S3) copyObject(ctx context.Context, input *s3.CopyObjectInput) error {
+	_, err := s.Client.CopyObject(ctx, input)
+	// CopyObject doesn't model NoSuchKey, so it arrives as a generic error
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Get uses a ranged GetObject. Cancelling ctx aborts the read.
+func (s *S3) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{Bucket: &s.Bucket, Key: &key}
+	if offset > 0 || length >= 0 {
+		rng := fmt.Sprintf("bytes=%d-", offset)
+		if length >= 0 {
+			rng += strconv.FormatInt(offset+length-1, 10)
+		}
+		input.Range = &rng
+	}
+	out, err := s.Client.GetObject(ctx, input)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// List pages through ListObjectsV2, a thousand keys at a time.
+func (s *S3) List(ctx context.Context, prefix string, fn func(ListedObject) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{Bucket: &s.Bucket, Prefix: &prefix})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			err := fn(ListedObject{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *S3) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	presigned, err := s.presigner().PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return presigned.URL, nil
+}
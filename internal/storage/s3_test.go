@@ -0,0 +1,43 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+func TestS3Conformance(t *testing.T) {
+	fake := storagetest.NewFakeS3(t)
+	store := &storage.S3{Client: fake.Client(), Bucket: testBucket}
+	storagetest.Run(t, store, "s3", http.Get)
+}
+
+func TestS3ReplaceMetadata(t *testing.T) {
+	fake := storagetest.NewFakeS3(t)
+	store := &storage.S3{Client: fake.Client(), Bucket: testBucket}
+	fake.PutObject(testBucket, "legacy.mp4", storagetest.FakeObject{Data: []byte("video"), ContentType: "application/octet-stream", Tagging: "video_id=abc"})
+
+	meta := storage.ObjectMetadata{ContentType: "video/mp4", ContentDisposition: `inline; filename="Holiday.mp4"`}
+	if err := store.ReplaceMetadata(context.Background(), "legacy.mp4", meta); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Head(context.Background(), "legacy.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != meta.ContentType || info.ContentDisposition != meta.ContentDisposition {
+		t.Errorf("after ReplaceMetadata: %+v, want %+v", info, meta)
+	}
+	obj, _ := fake.Object(testBucket, "legacy.mp4")
+	if string(obj.Data) != "video" || obj.Tagging != "video_id=abc" {
+		t.Errorf("object = %q tagged %q, want its data and tags kept", obj.Data, obj.Tagging)
+	}
+
+	if err := store.ReplaceMetadata(context.Background(), "missing.mp4", meta); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("ReplaceMetadata of a missing key: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Package storage abstracts where uploaded videos are kept, so the server
+// can run against S3 (or anything speaking its API, such as MinIO) or,
+// without any cloud account, against the local filesystem.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by Head for a key that isn't stored.
+	ErrNotFound = errors.New("storage: object not found")
+	// ErrChecksumMismatch is returned by Put when the body doesn't match
+	// PutOptions.ChecksumSHA256.
+	ErrChecksumMismatch = errors.New("storage: checksum mismatch")
+	// ErrInvalidKey is returned for keys a backend can't store, such as
+	// ones that would escape a local directory.
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// Storage stores objects under slash-separated keys.
+type Storage interface {
+	// Name identifies the backend, e.g. "s3" or "local".
+	Name() string
+	// Put stores size bytes read from body under key, replacing any
+	// object already there.
+	Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error
+	// Delete removes key. Deleting a key that isn't stored succeeds.
+	Delete(ctx context.Context, key string) error
+	// Head describes the object stored under key, or returns ErrNotFound.
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	// PresignGet returns a URL anyone can fetch key from until expires
+	// has passed.
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// Lister is implemented by backends that can enumerate what they store,
+// for finding objects nothing refers to.
+type Lister interface {
+	// List calls fn for every object whose key starts with prefix, in key
+	// order, stopping at the first error fn returns.
+	List(ctx context.Context, prefix string, fn func(ListedObject) error) error
+}
+
+// Copier is implemented by backends that can copy an object without the
+// caller downloading it, for moving objects between key prefixes.
+type Copier interface {
+	// Copy stores a copy of srcKey under dstKey, replacing any object
+	// there. It returns ErrNotFound if srcKey isn't stored.
+	Copy(ctx context.Context, srcKey, dstKey string) error
+}
+
+// MetadataReplacer is implemented by backends that keep headers with each
+// object, for correcting objects stored with the wrong ones.
+type MetadataReplacer interface {
+	// ReplaceMetadata rewrites key's headers to meta, keeping its data and
+	// tags. It returns ErrNotFound if key isn't stored.
+	ReplaceMetadata(ctx context.Context, key string, meta ObjectMetadata) error
+}
+
+// ObjectMetadata is the headers an object is served with.
+type ObjectMetadata struct {
+	ContentType        string
+	ContentDisposition string
+}
+
+// Getter is implemented by backends that can stream an object's bytes, for
+// serving it through the server rather than by URL.
+type Getter interface {
+	// Get reads length bytes of key starting at offset, or to the end
+	// when length is negative. It returns ErrNotFound if key isn't
+	// stored. The caller closes the reader.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// ListedObject is an object found by List.
+type ListedObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// PutOptions describe an object being stored.
+type PutOptions struct {
+	ContentType string
+	// ChecksumSHA256 is the SHA-256 of the body, when known. The object is
+	// rejected with ErrChecksumMismatch if the body doesn't match it.
+	ChecksumSHA256 []byte
+	// Tags label the object for billing and lifecycle rules, where the
+	// backend supports them. Local storage ignores them.
+	Tags map[string]string
+	// ResumeScope names who the object is stored for, such as a video ID.
+	// A multipart upload to S3 that fails partway is kept under it and
+	// resumed by the next Put of the same key in the same scope.
+	ResumeScope string
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size int64
+	// ContentType and ContentDisposition are empty when the backend
+	// doesn't know them.
+	ContentType        string
+	ContentDisposition string
+}
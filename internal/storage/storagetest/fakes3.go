@@ -0,0 +1,625 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// FakeS3 is an in-memory S3 speaking just enough of the API for the calls
+// storage.S3 and the handlers make: objects, ranged reads, copies,
+// paginated listing and multipart uploads. Buckets spring into existence
+// when first used. Tests point an s3.Client at it with Client and can
+// make chosen requests fail with FailWhen. Presigned URLs are checked
+// against Client's credentials, so tampered or expired ones are refused.
+type FakeS3 struct {
+	URL string
+	// PageSize caps the keys in one ListObjectsV2 page, as max-keys does;
+	// S3's own cap is 1000.
+	PageSize int
+
+	mu      sync.Mutex
+	objects map[string]*FakeObject
+	uploads map[string]*fakeUpload
+	calls   map[string]int
+	fail    func(op string, r *http.Request) bool
+	nextID  int
+}
+
+// FakeObject is an object stored in a FakeS3.
+type FakeObject struct {
+	Data               []byte
+	ContentType        string
+	ContentDisposition string
+	LastModified       time.Time
+	// Tagging is the x-amz-tagging header the object was stored with.
+	Tagging string
+}
+
+type fakeUpload struct {
+	bucket, key string
+	contentType string
+	algorithm   string
+	parts       map[int32]fakePart
+}
+
+type fakePart struct {
+	data     []byte
+	etag     string
+	checksum string
+}
+
+// NewFakeS3 starts a FakeS3, stopped when t finishes.
+func NewFakeS3(t testing.TB) *FakeS3 {
+	f := &FakeS3{
+		PageSize: 1000,
+		objects:  map[string]*FakeObject{},
+		uploads:  map[string]*fakeUpload{},
+		calls:    map[string]int{},
+	}
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+	f.URL = server.URL
+	return f
+}
+
+// Client returns an S3 client talking to f. It doesn't retry, so a
+// failure injected with FailWhen reaches the caller.
+func (f *FakeS3) Client() *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(f.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "fake", SecretAccessKey: "fake"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+}
+
+// FailWhen makes every request match reports true for fail with a 500,
+// until FailWhen is called again. op is the S3 operation, such as
+// "UploadPart". A nil match stops failing requests.
+func (f *FakeS3) FailWhen(match func(op string, r *http.Request) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = match
+}
+
+// Calls returns how many requests for op f has answered, failed or not.
+func (f *FakeS3) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// Object returns the object stored under key in bucket.
+func (f *FakeS3) Object(bucket, key string) (FakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		return FakeObject{}, false
+	}
+	return *obj, true
+}
+
+// PutObject stores an object directly, as if something else uploaded it.
+func (f *FakeS3) PutObject(bucket, key string, obj FakeObject) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if obj.LastModified.IsZero() {
+		obj.LastModified = time.Now()
+	}
+	f.objects[bucket+"/"+key] = &obj
+}
+
+// Keys returns the keys stored in bucket, sorted.
+func (f *FakeS3) Keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		if key, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UploadIDs returns the IDs of multipart uploads that have been neither
+// completed nor aborted.
+func (f *FakeS3) UploadIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for id := range f.uploads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// operation names the S3 operation r is, from its method, query and
+// headers.
+func operation(r *http.Request, key string) string {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodHead:
+		if key == "" {
+			return "HeadBucket"
+		}
+		return "HeadObject"
+	case http.MethodGet:
+		switch {
+		case key == "":
+			return "ListObjectsV2"
+		case q.Has("uploadId"):
+			return "ListParts"
+		}
+		return "GetObject"
+	case http.MethodPut:
+		switch {
+		case key == "":
+			return "CreateBucket"
+		case q.Has("partNumber"):
+			return "UploadPart"
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			return "CopyObject"
+		}
+		return "PutObject"
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			return "CreateMultipartUpload"
+		case q.Has("uploadId"):
+			return "CompleteMultipartUpload"
+		}
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			return "AbortMultipartUpload"
+		}
+		return "DeleteObject"
+	}
+	return "Unknown"
+}
+
+func (f *FakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	op := operation(r, key)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	if r.URL.Query().Has("X-Amz-Signature") && !validPresign(r) {
+		fakeError(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[op]++
+	if f.fail != nil && f.fail(op, r) {
+		fakeError(w, http.StatusInternalServerError, "InternalError", "injected failure")
+		return
+	}
+
+	switch op {
+	case "HeadObject", "GetObject":
+		f.getObject(w, r, bucket, key, op == "HeadObject")
+	case "PutObject":
+		f.putObject(w, r, bucket, key, body)
+	case "CopyObject":
+		f.copyObject(w, r, bucket, key)
+	case "DeleteObject":
+		delete(f.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	case "ListObjectsV2":
+		f.listObjects(w, r, bucket)
+	case "CreateBucket", "HeadBucket":
+		w.WriteHeader(http.StatusOK)
+	case "CreateMultipartUpload":
+		f.createUpload(w, r, bucket, key)
+	case "UploadPart":
+		f.uploadPart(w, r, body)
+	case "ListParts":
+		f.listParts(w, r)
+	case "CompleteMultipartUpload":
+		f.completeUpload(w, r, body)
+	case "AbortMultipartUpload":
+		if _, ok := f.uploads[r.URL.Query().Get("uploadId")]; !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+			return
+		}
+		delete(f.uploads, r.URL.Query().Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented", op+" isn't supported by the fake")
+	}
+}
+
+// validPresign reports whether r is a presigned request that Client's
+// credentials signed, for the method, path, query and signed headers it
+// carries, and that hasn't expired.
+func validPresign(r *http.Request) bool {
+	query := r.URL.Query()
+	signedAt, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || time.Now().After(signedAt.Add(time.Duration(expires)*time.Second)) {
+		return false
+	}
+
+	// Sign the request again without the signer's own parameters
+	signature := query.Get("X-Amz-Signature")
+	signedHeaders := strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	for _, name := range []string{"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-SignedHeaders", "X-Amz-Signature"} {
+		query.Del(name)
+	}
+	u := *r.URL
+	u.Scheme, u.Host, u.RawQuery = "http", r.Host, query.Encode()
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	for _, name := range signedHeaders {
+		if name != "host" {
+			req.Header[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+		}
+	}
+	if slices.Contains(signedHeaders, "content-length") {
+		req.ContentLength = r.ContentLength
+	}
+
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	creds := aws.Credentials{AccessKeyID: "fake", SecretAccessKey: "fake"}
+	signed, _, err := signer.PresignHTTP(context.Background(), creds, req, "UNSIGNED-PAYLOAD", "s3", "us-east-1", signedAt)
+	if err != nil {
+		return false
+	}
+	resigned, err := url.Parse(signed)
+	return err == nil && resigned.Query().Get("X-Amz-Signature") == signature
+}
+
+func (f *FakeS3) getObject(w http.ResponseWriter, r *http.Request, bucket, key string, head bool) {
+	obj, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		if head {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	data := obj.Data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && !head {
+		var start, end int64
+		spec := strings.TrimPrefix(rng, "bytes=")
+		first, last, _ := strings.Cut(spec, "-")
+		start, _ = strconv.ParseInt(first, 10, 64)
+		end = int64(len(data)) - 1
+		if last != "" {
+			end, _ = strconv.ParseInt(last, 10, 64)
+			end = min(end, int64(len(data))-1)
+		}
+		if start >= int64(len(data)) {
+			fakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	if obj.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", obj.ContentDisposition)
+	}
+	w.Header().Set("ETag", etag(obj.Data))
+	w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if !head {
+		w.Write(data)
+	}
+}
+
+func (f *FakeS3) putObject(w http.ResponseWriter, r *http.Request, bucket, key string, body []byte) {
+	if want := r.Header.Get("X-Amz-Checksum-Sha256"); want != "" {
+		sum := sha256.Sum256(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != want {
+			fakeError(w, http.StatusBadRequest, "BadDigest", "The SHA256 you specified did not match the calculated checksum.")
+			return
+		}
+	}
+	f.objects[bucket+"/"+key] = &FakeObject{
+		Data:               body,
+		ContentType:        r.Header.Get("Content-Type"),
+		ContentDisposition: r.Header.Get("Content-Disposition"),
+		LastModified:       time.Now(),
+		Tagging:            r.Header.Get("X-Amz-Tagging"),
+	}
+	w.Header().Set("ETag", etag(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *FakeS3) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	obj, ok := f.objects[source]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	// As in S3, copying an object onto itself has to change its metadata
+	replace := r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE"
+	if source == bucket+"/"+key && !replace {
+		fakeError(w, http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata.")
+		return
+	}
+	copied := *obj
+	copied.LastModified = time.Now()
+	if replace {
+		copied.ContentType = r.Header.Get("Content-Type")
+		copied.ContentDisposition = r.Header.Get("Content-Disposition")
+	}
+	f.objects[bucket+"/"+key] = &copied
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: etag(copied.Data), LastModified: copied.LastModified.UTC().Format(time.RFC3339)})
+}
+
+func (f *FakeS3) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	after := q.Get("continuation-token")
+	pageSize := f.PageSize
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n > 0 && n < pageSize {
+		pageSize = n
+	}
+
+	var keys []string
+	for k := range f.objects {
+		key, ok := strings.CutPrefix(k, bucket+"/")
+		if ok && strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: bucket, Prefix: prefix, MaxKeys: pageSize}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := f.objects[bucket+"/"+key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: obj.LastModified.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(obj.Data),
+			Size:         len(obj.Data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func (f *FakeS3) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = &fakeUpload{
+		bucket:      bucket,
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		algorithm:   strings.ToUpper(r.Header.Get("X-Amz-Checksum-Algorithm")),
+		parts:       map[int32]fakePart{},
+	}
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (f *FakeS3) uploadPart(w http.ResponseWriter, r *http.Request, body []byte) {
+	q := r.URL.Query()
+	upload, ok := f.uploads[q.Get("uploadId")]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	number, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		fakeError(w, http.StatusBadRequest, "InvalidArgument", "bad part number")
+		return
+	}
+	part := fakePart{data: body, etag: etag(body)}
+	switch upload.algorithm {
+	case "SHA256":
+		sum := sha256.Sum256(body)
+		part.checksum = base64.StdEncoding.EncodeToString(sum[:])
+		if sent := r.Header.Get("X-Amz-Checksum-Sha256"); sent != "" && sent != part.checksum {
+			fakeError(w, http.StatusBadRequest, "BadDigest", "The SHA256 you specified did not match the calculated checksum.")
+			return
+		}
+		w.Header().Set("X-Amz-Checksum-Sha256", part.checksum)
+	case "CRC32":
+		var sum [4]byte
+		crc := crc32.ChecksumIEEE(body)
+		sum[0], sum[1], sum[2], sum[3] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+		part.checksum = base64.StdEncoding.EncodeToString(sum[:])
+		w.Header().Set("X-Amz-Checksum-Crc32", part.checksum)
+	}
+	upload.parts[int32(number)] = part
+	w.Header().Set("ETag", part.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *FakeS3) listParts(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("uploadId")
+	upload, ok := f.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	type part struct {
+		PartNumber     int32
+		ETag           string
+		Size           int
+		ChecksumSHA256 string `xml:",omitempty"`
+		ChecksumCRC32  string `xml:",omitempty"`
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Bucket      string
+		Key         string
+		UploadId    string
+		IsTruncated bool
+		Parts       []part `xml:"Part"`
+	}{Bucket: upload.bucket, Key: upload.key, UploadId: id}
+	for _, n := range upload.partNumbers() {
+		p := upload.parts[n]
+		listed := part{PartNumber: n, ETag: p.etag, Size: len(p.data)}
+		switch upload.algorithm {
+		case "SHA256":
+			listed.ChecksumSHA256 = p.checksum
+		case "CRC32":
+			listed.ChecksumCRC32 = p.checksum
+		}
+		result.Parts = append(result.Parts, listed)
+	}
+	writeXML(w, result)
+}
+
+func (u *fakeUpload) partNumbers() []int32 {
+	var numbers []int32
+	for n := range u.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers
+}
+
+func (f *FakeS3) completeUpload(w http.ResponseWriter, r *http.Request, body []byte) {
+	id := r.URL.Query().Get("uploadId")
+	upload, ok := f.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber     int32
+			ETag           string
+			ChecksumSHA256 string
+			ChecksumCRC32  string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		fakeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	var data bytes.Buffer
+	for i, p := range req.Parts {
+		stored, ok := upload.parts[p.PartNumber]
+		if !ok || stored.etag != p.ETag || (i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber) {
+			fakeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d wasn't uploaded as listed", p.PartNumber))
+			return
+		}
+		if sent := p.ChecksumSHA256 + p.ChecksumCRC32; sent != "" && sent != stored.checksum {
+			fakeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d checksum doesn't match", p.PartNumber))
+			return
+		}
+		if i < len(req.Parts)-1 && len(stored.data) < 5<<20 {
+			fakeError(w, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.")
+			return
+		}
+		data.Write(stored.data)
+	}
+	delete(f.uploads, id)
+	f.objects[upload.bucket+"/"+upload.key] = &FakeObject{
+		Data:         data.Bytes(),
+		ContentType:  upload.contentType,
+		LastModified: time.Now(),
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: upload.bucket, Key: upload.key, ETag: etag(data.Bytes())})
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func fakeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, msg)
+}
@@ -0,0 +1,204 @@
+// Package storagetest is a conformance suite for storage.Storage
+// implementations, so every backend behaves the same to the handlers.
+// Backends that need a service, such as S3 against MinIO, run it from
+// their integration tests.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Run checks store against the Storage contract. Keys are created under
+// prefix, which should be unique to the run, and deleted afterwards.
+// Presigned URLs are fetched with fetch, which lets a backend whose URLs
+// point at the server under test route them to its handler.
+func Run(t *testing.T, store storage.Storage, prefix string, fetch func(url string) (*http.Response, error)) {
+	ctx := context.Background()
+	key := prefix + "/conformance/object.mp4"
+	body := []byte("not really a video")
+	t.Cleanup(func() { store.Delete(ctx, key) })
+
+	t.Run("head missing", func(t *testing.T) {
+		if _, err := store.Head(ctx, prefix+"/conformance/missing.mp4"); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("Head of a missing key: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("put and head", func(t *testing.T) {
+		if err := store.Put(ctx, key, bytes.NewReader(body), int64(len(body)), storage.PutOptions{ContentType: "video/mp4"}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		info, err := store.Head(ctx, key)
+		if err != nil {
+			t.Fatalf("Head: %v", err)
+		}
+		if info.Size != int64(len(body)) {
+			t.Errorf("Head size = %d, want %d", info.Size, len(body))
+		}
+		if info.ContentType != "" && info.ContentType != "video/mp4" {
+			t.Errorf("Head content type = %q, want video/mp4", info.ContentType)
+		}
+	})
+
+	t.Run("put replaces", func(t *testing.T) {
+		replacement := append(body, " at all"...)
+		if err := store.Put(ctx, key, bytes.NewReader(replacement), int64(len(replacement)), storage.PutOptions{ContentType: "video/mp4"}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		info, err := store.Head(ctx, key)
+		if err != nil {
+			t.Fatalf("Head: %v", err)
+		}
+		if info.Size != int64(len(replacement)) {
+			t.Errorf("Head size after replacing = %d, want %d", info.Size, len(replacement))
+		}
+		body = replacement
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		sum := sha256.Sum256(body)
+		if err := store.Put(ctx, key, bytes.NewReader(body), int64(len(body)), storage.PutOptions{ContentType: "video/mp4", ChecksumSHA256: sum[:]}); err != nil {
+			t.Fatalf("Put with a matching checksum: %v", err)
+		}
+		other := prefix + "/conformance/corrupt.mp4"
+		t.Cleanup(func() { store.Delete(ctx, other) })
+		wrong := sha256.Sum256([]byte("something else"))
+		err := store.Put(ctx, other, bytes.NewReader(body), int64(len(body)), storage.PutOptions{ContentType: "video/mp4", ChecksumSHA256: wrong[:]})
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Fatalf("Put with a wrong checksum: got %v, want ErrChecksumMismatch", err)
+		}
+		if _, err := store.Head(ctx, other); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("object rejected for its checksum was stored anyway: %v", err)
+		}
+	})
+
+	t.Run("presign get", func(t *testing.T) {
+		u, err := store.PresignGet(ctx, key, time.Minute)
+		if err != nil {
+			t.Fatalf("PresignGet: %v", err)
+		}
+		resp, err := fetch(u)
+		if err != nil {
+			t.Fatalf("fetching presigned URL: %v", err)
+		}
+		defer resp.Body.Close()
+		got, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+			t.Errorf("presigned URL returned %d %q, want 200 %q", resp.StatusCode, got, body)
+		}
+
+		// Point the signed URL at another object that does exist
+		other := prefix + "/conformance/other.mp4"
+		t.Cleanup(func() { store.Delete(ctx, other) })
+		if err := store.Put(ctx, other, bytes.NewReader(body), int64(len(body)), storage.PutOptions{ContentType: "video/mp4"}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		tampered := strings.Replace(u, "object.mp4", "other.mp4", 1)
+		resp, err = fetch(tampered)
+		if err != nil {
+			t.Fatalf("fetching tampered URL: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("URL signed for another key was accepted")
+		}
+	})
+
+	if lister, ok := store.(storage.Lister); ok {
+		t.Run("list", func(t *testing.T) {
+			var found []storage.ListedObject
+			err := lister.List(ctx, prefix+"/conformance/", func(obj storage.ListedObject) error {
+				found = append(found, obj)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			var listed bool
+			for _, obj := range found {
+				if obj.Key != key {
+					continue
+				}
+				listed = true
+				if obj.Size != int64(len(body)) {
+					t.Errorf("List size = %d, want %d", obj.Size, len(body))
+				}
+				if obj.LastModified.IsZero() || time.Since(obj.LastModified) > time.Hour {
+					t.Errorf("List last modified = %v, want about now", obj.LastModified)
+				}
+			}
+			if !listed {
+				t.Errorf("List under %s/conformance/ didn't return %s", prefix, key)
+			}
+		})
+	}
+
+	if getter, ok := store.(storage.Getter); ok {
+		t.Run("get", func(t *testing.T) {
+			ranges := []struct{ offset, length int64 }{{0, -1}, {4, -1}, {4, 6}, {0, 1}}
+			for _, rng := range ranges {
+				rc, err := getter.Get(ctx, key, rng.offset, rng.length)
+				if err != nil {
+					t.Fatalf("Get(%d, %d): %v", rng.offset, rng.length, err)
+				}
+				got, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("reading Get(%d, %d): %v", rng.offset, rng.length, err)
+				}
+				want := body[rng.offset:]
+				if rng.length >= 0 {
+					want = want[:rng.length]
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("Get(%d, %d) = %q, want %q", rng.offset, rng.length, got, want)
+				}
+			}
+			if _, err := getter.Get(ctx, prefix+"/conformance/missing.mp4", 0, -1); !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("Get of a missing key: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+
+	if copier, ok := store.(storage.Copier); ok {
+		t.Run("copy", func(t *testing.T) {
+			dst := prefix + "/conformance/copy/object.mp4"
+			t.Cleanup(func() { store.Delete(ctx, dst) })
+			if err := copier.Copy(ctx, key, dst); err != nil {
+				t.Fatalf("Copy: %v", err)
+			}
+			info, err := store.Head(ctx, dst)
+			if err != nil {
+				t.Fatalf("Head of copy: %v", err)
+			}
+			if info.Size != int64(len(body)) {
+				t.Errorf("copy size = %d, want %d", info.Size, len(body))
+			}
+			if err := copier.Copy(ctx, prefix+"/conformance/missing.mp4", dst); !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("Copy of a missing key: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		if err := store.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := store.Head(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Head after Delete: got %v, want ErrNotFound", err)
+		}
+		if err := store.Delete(ctx, key); err != nil {
+			t.Errorf("Delete of a deleted key: %v", err)
+		}
+	})
+}
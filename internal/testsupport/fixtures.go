@@ -0,0 +1,260 @@
+// Package testsupport synthesizes video fixtures with ffmpeg so tests don't
+// depend on committed binaries. Fixtures are generated on first use and
+// cached under testdata/gen at the module root, keyed by a hash of the
+// recipe and the ffmpeg version, so editing a recipe or upgrading ffmpeg
+// regenerates them. Tests that ask for a fixture are skipped when ffmpeg,
+// or an encoder the recipe needs, isn't installed.
+package testsupport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Recipe describes how to synthesize one fixture.
+type Recipe struct {
+	// Name identifies the fixture and prefixes its cached file name.
+	Name string
+	// Args are the ffmpeg arguments before the output path.
+	Args []string
+	// Encoders lists encoders the recipe needs, e.g. libx265. The fixture is
+	// skipped when ffmpeg lacks any of them.
+	Encoders []string
+}
+
+// Short lavfi sources shared by the recipes.
+var (
+	landscapeSource = []string{"-f", "lavfi", "-i", "testsrc=duration=1:size=320x180:rate=25"}
+	portraitSource  = []string{"-f", "lavfi", "-i", "testsrc=duration=1:size=180x320:rate=25"}
+	toneSource      = []string{"-f", "lavfi", "-i", "sine=frequency=440:duration=1"}
+	h264            = []string{"-c:v", "libx264", "-pix_fmt", "yuv420p"}
+)
+
+func join(parts ...[]string) []string {
+	var args []string
+	for _, p := range parts {
+		args = append(args, p...)
+	}
+	return args
+}
+
+// Built-in recipes for the cases the processing pipeline cares about.
+var (
+	// Landscape is a 16:9 H.264 clip with its moov atom at the end.
+	Landscape = Recipe{
+		Name:     "landscape",
+		Args:     join(landscapeSource, h264, []string{"-f", "mp4"}),
+		Encoders: []string{"libx264"},
+	}
+	// Portrait is a 9:16 H.264 clip.
+	Portrait = Recipe{
+		Name:     "portrait",
+		Args:     join(portraitSource, h264, []string{"-f", "mp4"}),
+		Encoders: []string{"libx264"},
+	}
+	// Rotated is a landscape clip flagged with a 90 degree display rotation.
+	Rotated = Recipe{
+		Name:     "rotated",
+		Args:     join(landscapeSource, h264, []string{"-metadata:s:v:0", "rotate=90", "-f", "mp4"}),
+		Encoders: []string{"libx264"},
+	}
+	// FastStart already has its moov atom first.
+	FastStart = Recipe{
+		Name:     "faststart",
+		Args:     join(landscapeSource, h264, []string{"-movflags", "+faststart", "-f", "mp4"}),
+		Encoders: []string{"libx264"},
+	}
+	// Fragmented is a fragmented MP4 with an empty initial moov.
+	Fragmented = Recipe{
+		Name:     "fragmented",
+		Args:     join(landscapeSource, h264, []string{"-movflags", "frag_keyframe+empty_moov", "-f", "mp4"}),
+		Encoders: []string{"libx264"},
+	}
+	// VariableFrameRate changes frame spacing halfway through.
+	VariableFrameRate = Recipe{
+		Name: "vfr",
+		Args: join(landscapeSource, h264, []string{
+			"-vf", "setpts='if(lt(N,12),N/25/TB,(12/25+(N-12)/10)/TB)'",
+			"-fps_mode", "vfr",
+			"-f", "mp4",
+		}),
+		Encoders: []string{"libx264"},
+	}
+	// MultiTrack has one video and two audio tracks.
+	MultiTrack = Recipe{
+		Name: "multitrack",
+		Args: join(landscapeSource, toneSource, toneSource, h264, []string{
+			"-map", "0:v", "-map", "1:a", "-map", "2:a",
+			"-c:a", "aac", "-shortest",
+			"-f", "mp4",
+		}),
+		Encoders: []string{"libx264", "aac"},
+	}
+	// HEVC is a landscape clip encoded with H.265.
+	HEVC = Recipe{
+		Name:     "hevc",
+		Args:     join(landscapeSource, []string{"-c:v", "libx265", "-pix_fmt", "yuv420p", "-tag:v", "hvc1", "-f", "mp4"}),
+		Encoders: []string{"libx265"},
+	}
+	// AudioOnly is an MP4 without a video stream.
+	AudioOnly = Recipe{
+		Name:     "audio-only",
+		Args:     join(toneSource, []string{"-c:a", "aac", "-f", "mp4"}),
+		Encoders: []string{"aac"},
+	}
+)
+
+var (
+	ffmpegOnce     sync.Once
+	ffmpegVersion  string
+	ffmpegEncoders string
+	ffmpegErr      error
+
+	// genMu serializes generation within a test binary; the rename in
+	// generate keeps separate binaries from seeing half-written files.
+	genMu sync.Mutex
+)
+
+func probeFFmpeg() {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		ffmpegErr = err
+		return
+	}
+	out, err := exec.Command("ffmpeg", "-version").Output()
+	if err != nil {
+		ffmpegErr = err
+		return
+	}
+	ffmpegVersion, _, _ = strings.Cut(string(out), "\n")
+	out, err = exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		ffmpegErr = err
+		return
+	}
+	ffmpegEncoders = string(out)
+}
+
+func hasEncoder(name string) bool {
+	for _, line := range strings.Split(ffmpegEncoders, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the cache key for r under the installed ffmpeg.
+func (r Recipe) Key() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", r.Name, ffmpegVersion)
+	for _, arg := range r.Args {
+		fmt.Fprintf(h, "%s\x00", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Fixture returns the path to the fixture r describes, generating it if
+// the cache has no current copy. It skips t when ffmpeg or a required
+// encoder is missing and fails it when generation fails. Callers must not
+// modify the returned file; copy it first.
+func Fixture(t testing.TB, r Recipe) string {
+	t.Helper()
+
+	ffmpegOnce.Do(probeFFmpeg)
+	if ffmpegErr != nil {
+		t.Skipf("ffmpeg not available: %v", ffmpegErr)
+	}
+	for _, enc := range r.Encoders {
+		if !hasEncoder(enc) {
+			t.Skipf("ffmpeg lacks encoder %s needed by fixture %s", enc, r.Name)
+		}
+	}
+
+	dir, err := cacheDir()
+	if err != nil {
+		t.Fatalf("testsupport: %v", err)
+	}
+
+	genMu.Lock()
+	defer genMu.Unlock()
+
+	path := filepath.Join(dir, r.Name+"-"+r.Key()+".mp4")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if err := generate(dir, path, r); err != nil {
+		t.Fatalf("testsupport: generating %s: %v", r.Name, err)
+	}
+	removeStale(dir, r, path)
+	return path
+}
+
+// generate writes the fixture to a temporary file in dir and renames it
+// into place, so an interrupted run never leaves a truncated fixture.
+func generate(dir, path string, r Recipe) error {
+	tmp, err := os.CreateTemp(dir, r.Name+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	args := append([]string{"-hide_banner", "-loglevel", "error", "-y"}, r.Args...)
+	args = append(args, tmpPath)
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// removeStale deletes cached copies of r made from older recipes or
+// ffmpeg versions.
+func removeStale(dir string, r Recipe, keep string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, r.Name+"-*.mp4"))
+	for _, m := range matches {
+		if m == keep {
+			continue
+		}
+		// Only our own names: name, dash, 16 hex characters
+		key := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), r.Name+"-"), ".mp4")
+		if len(key) == 16 {
+			os.Remove(m)
+		}
+	}
+}
+
+// cacheDir returns testdata/gen under the module root, found by walking up
+// from the working directory, which go test sets to the package directory.
+// TESTSUPPORT_CACHE_DIR overrides it.
+func cacheDir() (string, error) {
+	if dir := os.Getenv("TESTSUPPORT_CACHE_DIR"); dir != "" {
+		return dir, os.MkdirAll(dir, 0o755)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			gen := filepath.Join(dir, "testdata", "gen")
+			return gen, os.MkdirAll(gen, 0o755)
+		}
+		if filepath.Dir(dir) == dir {
+			return "", errors.New("no go.mod above " + wd)
+		}
+	}
+}
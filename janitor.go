@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// janitorTask deletes records older than its retention.
+type janitorTask struct {
+	name      string
+	retention time.Duration
+	prune     func(cutoff time.Time) (int64, error)
+}
+
+// runJanitor runs every task now and then every interval until ctx is done.
+func runJanitor(ctx context.Context, tasks []janitorTask, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, task := range tasks {
+			n, err := task.prune(time.Now().Add(-task.retention))
+			if err != nil {
+				log.Printf("couldn't prune %s: %v", task.name, err)
+			} else if n > 0 {
+				log.Printf("pruned %d %s older than %s", n, task.name, task.retention)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,32 +3,86 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"log/slog"
+	"maps"
 	"net/http"
+	"strconv"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
-	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
-	}
-	type errorResponse struct {
-		Error string `json:"error"`
-	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+// respondWithError responds with msg and the default code for status.
+func respondWithError(w http.ResponseWriter, status int, msg string, err error) {
+	respondWithErrorCode(w, status, defaultErrorCode(status), msg, err)
+}
+
+// apiError is the body of every error response, under "error".
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// respondWithErrorCode responds with msg and a machine-readable code, as
+// {"error": {"code", "message"}} whether or not the client asked for the
+// v2 envelope.
+func respondWithErrorCode(w http.ResponseWriter, status int, code, msg string, err error) {
+	logError(responseLogger(w), status, msg, err)
+	respondWithJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: msg}})
+}
+
+// respondWithErrorDetails is respondWithErrorCode for errors that carry
+// more than a message, such as the limit an upload exceeded. Each detail
+// sits beside "code" and "message".
+func respondWithErrorDetails(w http.ResponseWriter, status int, code, msg string, err error, details map[string]any) {
+	logError(responseLogger(w), status, msg, err)
+	body := map[string]any{"code": code, "message": msg}
+	maps.Copy(body, details)
+	respondWithJSON(w, status, map[string]any{"error": body})
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
+	// Successful payloads are enveloped when the client asked for v2;
+	// errors have the same shape either way.
+	if ew, ok := envelopeFor(w); ok && ew.enabled && code < 400 {
+		payload = ew.wrap(payload)
+	}
 	dat, err := json.Marshal(payload)
 	if err != nil {
 		log.Printf("Error marshalling JSON: %s", err)
 		w.WriteHeader(500)
 		return
 	}
+	// Declare the length up front so HEAD requests (which net/http answers
+	// without a body) still report the size of the GET representation.
+	w.Header().Set("Content-Length", strconv.Itoa(len(dat)))
 	w.WriteHeader(code)
 	w.Write(dat)
 }
+
+// logError logs an error response to logger, at a level matching its
+// class, counts it in errorsTotal, and hands server failures to the
+// configured error reporter.
+func logError(logger *slog.Logger, code int, msg string, err error) {
+	class := classifyError(code, err)
+	errorsTotal.WithLabelValues(string(class)).Inc()
+	attrs := []any{
+		slog.Int("status", code),
+		slog.String("class", string(class)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+
+	switch class {
+	case errorClassServer:
+		logger.Error(msg, attrs...)
+		if errorReporter != nil {
+			errorReporter.ReportError(err, msg, code)
+		}
+	case errorClassClientAborted:
+		logger.Warn(msg, attrs...)
+	default:
+		logger.Debug(msg, attrs...)
+	}
+}
@@ -2,14 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -25,14 +38,175 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
+	appName          string
+	assetsPath       string
 	s3Client         *s3.Client
+
+	// baseURL is where clients reach the server, for expanding asset
+	// paths; empty derives it from each request. trustProxy lets
+	// X-Forwarded-Proto and X-Forwarded-Host decide it then.
+	baseURL    string
+	trustProxy bool
+
+	// videoStorage holds uploaded videos: s3Storage or localStorage, as
+	// STORAGE_BACKEND selects. localStorage is always set, so videos
+	// stored locally stay reachable after switching to S3.
+	videoStorage storage.Storage
+	s3Storage    *storage.S3
+	localStorage *storage.Local
+
+	// Optional per-artifact buckets; both fall back to s3Bucket.
+	s3ThumbnailBucket string
+	s3ArtifactsBucket string
+
+	// s3SSE is the server-side encryption requested for every object, with
+	// s3KMSKeyID as its key for aws:kms. Empty leaves the bucket default.
+	s3SSE      types.ServerSideEncryption
+	s3KMSKeyID string
+	// s3TagObjects tags objects with the user and video they belong to,
+	// for cost allocation. It needs s3:PutObjectTagging, so it is opt-in.
+	s3TagObjects bool
+
+	maxVideosPerUser       int
+	countDraftsTowardLimit bool
+
+	maxThumbnailBytes   int64
+	maxVideoUploadBytes int64
+
+	passwordAttempts *passwordAttemptLimiter
+
+	// errorReporter optionally receives 5xx failures; nil disables it.
+	errorReporter ErrorReporter
+
+	scanner      Scanner
+	scanMaxBytes int64
+	scanFailOpen bool
+
+	// adminToken guards /admin endpoints; empty disables them
+	adminToken string
+	settings   *settingsStore
+
+	// Multipart uploads adapt to measured throughput within these bounds
+	uploadThroughput     *throughputEstimator
+	maxPartSize          int64
+	maxUploadConcurrency int
+	uploadPartAttempts   int
+
+	// configSources records whether each setting came from the
+	// environment, the -config file or its default.
+	configSources map[string]string
+
+	accessEvents *accessRecorder
+
+	partialUploads *partialUploadStore
+
+	uploadSessions *uploadSessionStore
+
+	assetsDisk *assetsDisk
+
+	admission *admissionController
+
+	uploadLimiter *uploadRateLimiter
+
+	// trashRetention is how long deleted videos can be restored
+	trashRetention time.Duration
+
+	idempotencyLocks *idempotencyLocks
+
+	// webhooks is nil unless WEBHOOK_URL is set
+	webhooks *webhookNotifier
+
+	readiness *readinessChecker
+
+	downloadLimiter *bandwidthLimiter
+
+	uploadProgress *progressStore
+
+	fastStartFailurePolicy fastStartFailurePolicy
+
+	thumbnailPolicy thumbnailPolicy
+
+	// cloudFrontSigner signs video URLs handed to viewers; nil leaves
+	// them unsigned.
+	cloudFrontSigner *cloudFrontSigner
+
+	// presignExpiry is how long signed URLs are valid, and
+	// presignMaxExpiry the most a request can ask for. presignCache keeps
+	// presigned URLs for reuse until they are near expiry.
+	presignExpiry    time.Duration
+	presignMaxExpiry time.Duration
+	presignCache     *presignCache
+
+	processingQueue *processingQueue
+
+	// Uploads over these are rejected; zero disables a limit.
+	maxVideoDuration time.Duration
+	maxVideoBitrate  int64
+
+	// transcodeRenditions adds smaller renditions alongside each upload.
+	transcodeRenditions bool
+
+	// hlsPackaging adds an HLS playlist and segments alongside each upload.
+	hlsPackaging bool
+
+	// tools records whether ffmpeg and ffprobe were found at startup.
+	// Without them uploads are refused, unless allowUnprocessedUploads
+	// stores them as they arrived.
+	tools                   toolStatus
+	allowUnprocessedUploads bool
 }
 
+// defaultAssetsPath is where assets were always served; it stays mounted as
+// an alias when ASSETS_PATH renames the route.
+const defaultAssetsPath = "/assets"
+
+// defaultAppName names temp files, metrics and the like when APP_NAME
+// isn't set.
+const defaultAppName = "tubely"
+
+// On shutdown, in-flight requests get SHUTDOWN_TIMEOUT to finish and queued
+// videos get PROCESSING_DRAIN_TIMEOUT on top, since a large one can take
+// minutes. These are the defaults.
+const (
+	defaultShutdownTimeout        = 30 * time.Second
+	defaultProcessingDrainTimeout = 5 * time.Minute
+)
+
 // Removed in-memory thumbnail storage; using data URLs stored in DB instead
 
 func main() {
+	selfTest := flag.Bool("selftest", false, "run the processing pipeline against a generated clip and exit")
+	configPath := flag.String("config", "", "YAML or TOML settings file; environment variables take precedence")
+	flag.Parse()
+
 	godotenv.Load(".env")
 
+	configSources, err := applyConfigFile(*configPath)
+	if err != nil {
+		log.Fatalf("Couldn't load config file: %v", err)
+	}
+
+	logLevel := new(slog.LevelVar)
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			log.Fatal("LOG_LEVEL must be debug, info, warn or error")
+		}
+		logLevel.Set(level)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	logToolInvocations.Store(os.Getenv("LOG_FFMPEG_INVOCATIONS") == "true")
+	if v := os.Getenv("FFMPEG_TIMEOUT"); v != "" {
+		if ffmpegTimeout, err = time.ParseDuration(v); err != nil || ffmpegTimeout <= 0 {
+			log.Fatal("FFMPEG_TIMEOUT must be a positive duration such as 2m")
+		}
+	}
+	if v := os.Getenv("FFPROBE_TIMEOUT"); v != "" {
+		if ffprobeTimeout, err = time.ParseDuration(v); err != nil || ffprobeTimeout <= 0 {
+			log.Fatal("FFPROBE_TIMEOUT must be a positive duration such as 15s")
+		}
+	}
+
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
 		log.Fatal("DB_PATH must be set")
@@ -63,26 +237,347 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
+	// Videos go to S3 unless STORAGE_BACKEND=local keeps them on disk, in
+	// which case none of the S3 settings are needed
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	switch storageBackend {
+	case "":
+		storageBackend = storageBackendS3
+	case storageBackendS3, storageBackendLocal:
+	default:
+		log.Fatal("STORAGE_BACKEND must be s3 or local")
+	}
+	needS3 := storageBackend == storageBackendS3
+
 	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
+	if s3Bucket == "" && needS3 {
 		log.Fatal("S3_BUCKET environment variable is not set")
 	}
 
+	s3ThumbnailBucket := os.Getenv("S3_THUMBNAIL_BUCKET")
+	if s3ThumbnailBucket == "" {
+		s3ThumbnailBucket = s3Bucket
+	}
+
+	s3ArtifactsBucket := os.Getenv("S3_ARTIFACTS_BUCKET")
+	if s3ArtifactsBucket == "" {
+		s3ArtifactsBucket = s3Bucket
+	}
+
 	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
+	if s3Region == "" && needS3 {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
+	if s3CfDistribution == "" && needS3 {
 		log.Fatal("S3_CF_DISTRO environment variable is not set")
 	}
 
+	s3SSE := types.ServerSideEncryption(os.Getenv("S3_SSE"))
+	if s3SSE != "" && !slices.Contains(s3SSE.Values(), s3SSE) {
+		log.Fatalf("S3_SSE must be one of %v", s3SSE.Values())
+	}
+	s3KMSKeyID := os.Getenv("S3_KMS_KEY_ID")
+	if s3KMSKeyID != "" && s3SSE != types.ServerSideEncryptionAwsKms && s3SSE != types.ServerSideEncryptionAwsKmsDsse {
+		log.Fatal("S3_KMS_KEY_ID needs S3_SSE=aws:kms or aws:kms:dsse")
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable is not set")
 	}
 
+	appName := os.Getenv("APP_NAME")
+	if appName == "" {
+		appName = defaultAppName
+	}
+	initMetrics(appName)
+
+	assetsPath := strings.TrimSuffix(os.Getenv("ASSETS_PATH"), "/")
+	if assetsPath == "" {
+		assetsPath = defaultAssetsPath
+	}
+	if !strings.HasPrefix(assetsPath, "/") {
+		log.Fatal("ASSETS_PATH must start with /")
+	}
+
+	var baseURL string
+	if v := os.Getenv("BASE_URL"); v != "" {
+		if baseURL, err = parseBaseURL(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	maxVideosPerUser := 0
+	if v := os.Getenv("MAX_VIDEOS_PER_USER"); v != "" {
+		maxVideosPerUser, err = strconv.Atoi(v)
+		if err != nil || maxVideosPerUser < 0 {
+			log.Fatal("MAX_VIDEOS_PER_USER must be a non-negative integer")
+		}
+	}
+
+	countDraftsTowardLimit := os.Getenv("MAX_VIDEOS_COUNT_DRAFTS") != "false"
+
+	maxVideoUploadBytes := int64(defaultMaxVideoUploadBytes)
+	if v := os.Getenv("MAX_VIDEO_UPLOAD_BYTES"); v != "" {
+		maxVideoUploadBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxVideoUploadBytes < 1 {
+			log.Fatal("MAX_VIDEO_UPLOAD_BYTES must be a positive integer")
+		}
+	}
+
+	// THUMBNAIL_MAX_MB predates the byte-exact setting, which wins
+	maxThumbnailBytes := int64(defaultMaxThumbnailBytes)
+	if v := os.Getenv("MAX_THUMBNAIL_UPLOAD_BYTES"); v != "" {
+		maxThumbnailBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxThumbnailBytes < 1 {
+			log.Fatal("MAX_THUMBNAIL_UPLOAD_BYTES must be a positive integer")
+		}
+	} else if v := os.Getenv("THUMBNAIL_MAX_MB"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 1 {
+			log.Fatal("THUMBNAIL_MAX_MB must be a positive integer")
+		}
+		maxThumbnailBytes = int64(mb) << 20
+	}
+
+	processingRunRetentionDays := 90
+	if v := os.Getenv("PROCESSING_RUN_RETENTION_DAYS"); v != "" {
+		processingRunRetentionDays, err = strconv.Atoi(v)
+		if err != nil || processingRunRetentionDays < 0 {
+			log.Fatal("PROCESSING_RUN_RETENTION_DAYS must be a non-negative integer")
+		}
+	}
+
+	accessEventRetentionHours := 72
+	if v := os.Getenv("ACCESS_EVENT_RETENTION_HOURS"); v != "" {
+		accessEventRetentionHours, err = strconv.Atoi(v)
+		if err != nil || accessEventRetentionHours < 1 {
+			log.Fatal("ACCESS_EVENT_RETENTION_HOURS must be a positive integer")
+		}
+	}
+
+	trashRetention := defaultTrashRetention
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			log.Fatal("TRASH_RETENTION_DAYS must be a positive integer")
+		}
+		trashRetention = time.Duration(days) * 24 * time.Hour
+	}
+
+	// Upload admission watermarks; zero disables a check
+	uploadLimits := admissionLimits{minTempFreeBytes: 512 << 20}
+	if v := os.Getenv("UPLOAD_MAX_ACTIVE"); v != "" {
+		uploadLimits.maxActiveUploads, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || uploadLimits.maxActiveUploads < 0 {
+			log.Fatal("UPLOAD_MAX_ACTIVE must be a non-negative integer")
+		}
+	}
+	if v := os.Getenv("UPLOAD_MAX_PROCESSING"); v != "" {
+		uploadLimits.maxProcessing, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || uploadLimits.maxProcessing < 0 {
+			log.Fatal("UPLOAD_MAX_PROCESSING must be a non-negative integer")
+		}
+	}
+	if v := os.Getenv("UPLOAD_MIN_TEMP_FREE_MB"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 0 {
+			log.Fatal("UPLOAD_MIN_TEMP_FREE_MB must be a non-negative integer")
+		}
+		uploadLimits.minTempFreeBytes = int64(mb) << 20
+	}
+
+	// Per-user upload limits; zero disables one
+	uploadRatePerMinute := defaultUploadRatePerMinute
+	if v := os.Getenv("UPLOAD_RATE_PER_MINUTE"); v != "" {
+		uploadRatePerMinute, err = strconv.Atoi(v)
+		if err != nil || uploadRatePerMinute < 0 {
+			log.Fatal("UPLOAD_RATE_PER_MINUTE must be a non-negative integer")
+		}
+	}
+	uploadConcurrency := defaultUploadConcurrency
+	if v := os.Getenv("UPLOAD_MAX_CONCURRENT_PER_USER"); v != "" {
+		uploadConcurrency, err = strconv.Atoi(v)
+		if err != nil || uploadConcurrency < 0 {
+			log.Fatal("UPLOAD_MAX_CONCURRENT_PER_USER must be a non-negative integer")
+		}
+	}
+
+	uploadSessionTTL := defaultUploadSessionTTL
+	if v := os.Getenv("UPLOAD_SESSION_TTL"); v != "" {
+		uploadSessionTTL, err = time.ParseDuration(v)
+		if err != nil || uploadSessionTTL < time.Minute {
+			log.Fatal("UPLOAD_SESSION_TTL must be a duration of at least 1m")
+		}
+	}
+
+	maxUploadSessions := defaultMaxUploadSessionsPerUser
+	if v := os.Getenv("UPLOAD_MAX_SESSIONS_PER_USER"); v != "" {
+		maxUploadSessions, err = strconv.Atoi(v)
+		if err != nil || maxUploadSessions < 0 {
+			log.Fatal("UPLOAD_MAX_SESSIONS_PER_USER must be a non-negative integer")
+		}
+	}
+
+	shutdownTimeout := defaultShutdownTimeout
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		shutdownTimeout, err = time.ParseDuration(v)
+		if err != nil || shutdownTimeout <= 0 {
+			log.Fatal("SHUTDOWN_TIMEOUT must be a positive duration")
+		}
+	}
+	processingDrainTimeout := defaultProcessingDrainTimeout
+	if v := os.Getenv("PROCESSING_DRAIN_TIMEOUT"); v != "" {
+		processingDrainTimeout, err = time.ParseDuration(v)
+		if err != nil || processingDrainTimeout <= 0 {
+			log.Fatal("PROCESSING_DRAIN_TIMEOUT must be a positive duration")
+		}
+	}
+
+	// Processing outcomes are posted here when set
+	var webhooks *webhookNotifier
+	if v := os.Getenv("WEBHOOK_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("WEBHOOK_URL must be an http or https URL")
+		}
+		secret := os.Getenv("WEBHOOK_SECRET")
+		if secret == "" {
+			log.Fatal("WEBHOOK_SECRET must be set when WEBHOOK_URL is")
+		}
+		webhooks = newWebhookNotifier(v, secret, appName)
+	}
+
+	// 5xx failures are posted here when set
+	var reporter ErrorReporter
+	if v := os.Getenv("ERROR_REPORT_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("ERROR_REPORT_URL must be an http or https URL")
+		}
+		reporter = newHTTPErrorReporter(v, appName)
+	}
+
+	// Asset download bandwidth caps in KB/s; zero leaves them unlimited
+	var downloadRateLimit, downloadGlobalRateLimit int64
+	if v := os.Getenv("DOWNLOAD_RATE_LIMIT_KBPS"); v != "" {
+		kbps, err := strconv.Atoi(v)
+		if err != nil || kbps < 0 {
+			log.Fatal("DOWNLOAD_RATE_LIMIT_KBPS must be a non-negative integer")
+		}
+		downloadRateLimit = int64(kbps) << 10
+	}
+	if v := os.Getenv("DOWNLOAD_GLOBAL_RATE_LIMIT_KBPS"); v != "" {
+		kbps, err := strconv.Atoi(v)
+		if err != nil || kbps < 0 {
+			log.Fatal("DOWNLOAD_GLOBAL_RATE_LIMIT_KBPS must be a non-negative integer")
+		}
+		downloadGlobalRateLimit = int64(kbps) << 10
+	}
+
+	fastStartPolicy, err := parseFastStartFailurePolicy(os.Getenv("FASTSTART_FAILURE_POLICY"))
+	if err != nil {
+		log.Fatal("FASTSTART_FAILURE_POLICY must be reject or store-original")
+	}
+
+	thumbnailPolicy, err := parseThumbnailPolicy(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cloudFrontSigner, err := parseCloudFrontSigner(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	presignExpiry, presignMaxExpiry, err := parseURLExpiry(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var scanner Scanner = noopScanner{}
+	switch os.Getenv("SCANNER") {
+	case "", "none":
+	case "clamd":
+		clamdAddr := os.Getenv("CLAMD_ADDR")
+		if clamdAddr == "" {
+			clamdAddr = "localhost:3310"
+		}
+		scanner = clamdScanner{addr: clamdAddr, timeout: 10 * time.Second}
+	default:
+		log.Fatal("SCANNER must be none or clamd")
+	}
+
+	// Only the first SCANNER_MAX_MB of larger uploads is scanned
+	scanMaxBytes := int64(100 << 20)
+	if v := os.Getenv("SCANNER_MAX_MB"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 0 {
+			log.Fatal("SCANNER_MAX_MB must be a non-negative integer")
+		}
+		scanMaxBytes = int64(mb) << 20
+	}
+
+	scanFailOpen := os.Getenv("SCANNER_FAIL_OPEN") == "true"
+
+	maxPartSize := int64(64 << 20)
+	if v := os.Getenv("S3_MAX_PART_SIZE_MB"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 5 {
+			log.Fatal("S3_MAX_PART_SIZE_MB must be an integer of at least 5")
+		}
+		maxPartSize = int64(mb) << 20
+	}
+
+	maxUploadConcurrency := 16
+	if v := os.Getenv("S3_MAX_UPLOAD_CONCURRENCY"); v != "" {
+		maxUploadConcurrency, err = strconv.Atoi(v)
+		if err != nil || maxUploadConcurrency < 1 {
+			log.Fatal("S3_MAX_UPLOAD_CONCURRENCY must be a positive integer")
+		}
+	}
+
+	uploadPartAttempts := 5
+	if v := os.Getenv("S3_UPLOAD_PART_ATTEMPTS"); v != "" {
+		uploadPartAttempts, err = strconv.Atoi(v)
+		if err != nil || uploadPartAttempts < 1 {
+			log.Fatal("S3_UPLOAD_PART_ATTEMPTS must be a positive integer")
+		}
+	}
+
+	var maxVideoDuration time.Duration
+	if v := os.Getenv("MAX_VIDEO_DURATION"); v != "" {
+		maxVideoDuration, err = time.ParseDuration(v)
+		if err != nil || maxVideoDuration < 0 {
+			log.Fatal("MAX_VIDEO_DURATION must be a duration such as 10m")
+		}
+	}
+
+	var maxVideoBitrate int64
+	if v := os.Getenv("MAX_VIDEO_BITRATE"); v != "" {
+		maxVideoBitrate, err = parseBitrate(v)
+		if err != nil {
+			log.Fatal("MAX_VIDEO_BITRATE must be bits per second, optionally with a k or M suffix")
+		}
+	}
+
+	processingWorkers := 2
+	if v := os.Getenv("VIDEO_PROCESSING_WORKERS"); v != "" {
+		processingWorkers, err = strconv.Atoi(v)
+		if err != nil || processingWorkers < 1 {
+			log.Fatal("VIDEO_PROCESSING_WORKERS must be a positive integer")
+		}
+	}
+
+	processingBacklog := 16
+	if v := os.Getenv("VIDEO_PROCESSING_BACKLOG"); v != "" {
+		processingBacklog, err = strconv.Atoi(v)
+		if err != nil || processingBacklog < 0 {
+			log.Fatal("VIDEO_PROCESSING_BACKLOG must be a non-negative integer")
+		}
+	}
+
 	// Load AWS config
 	awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
 	if err != nil {
@@ -102,7 +597,104 @@ func main() {
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
+		appName:          appName,
+		assetsPath:       assetsPath,
 		s3Client:         s3Client,
+
+		baseURL:    baseURL,
+		trustProxy: os.Getenv("TRUST_PROXY") == "true",
+
+		s3ThumbnailBucket: s3ThumbnailBucket,
+		s3ArtifactsBucket: s3ArtifactsBucket,
+
+		s3SSE:        s3SSE,
+		s3KMSKeyID:   s3KMSKeyID,
+		s3TagObjects: os.Getenv("S3_TAG_OBJECTS") == "true",
+
+		maxVideosPerUser:       maxVideosPerUser,
+		countDraftsTowardLimit: countDraftsTowardLimit,
+
+		maxThumbnailBytes:   maxThumbnailBytes,
+		maxVideoUploadBytes: maxVideoUploadBytes,
+
+		passwordAttempts: newPasswordAttemptLimiter(),
+
+		errorReporter: reporter,
+
+		scanner:      scanner,
+		scanMaxBytes: scanMaxBytes,
+		scanFailOpen: scanFailOpen,
+
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+		settings:   newSettingsStore(logLevel),
+
+		uploadThroughput:     &throughputEstimator{},
+		maxPartSize:          maxPartSize,
+		maxUploadConcurrency: maxUploadConcurrency,
+		uploadPartAttempts:   uploadPartAttempts,
+
+		configSources: configSources,
+
+		accessEvents: newAccessRecorder(db),
+
+		partialUploads: newPartialUploadStore(),
+
+		uploadSessions: newUploadSessionStore(uploadSessionTTL, maxUploadSessions),
+
+		assetsDisk: newAssetsDisk(assetsRoot),
+
+		admission: newAdmissionController(uploadLimits),
+
+		uploadLimiter:    newUploadRateLimiter(uploadRatePerMinute, uploadConcurrency),
+		trashRetention:   trashRetention,
+		idempotencyLocks: newIdempotencyLocks(),
+		webhooks:         webhooks,
+
+		readiness: &readinessChecker{},
+
+		downloadLimiter: newBandwidthLimiter(downloadRateLimit, downloadGlobalRateLimit),
+
+		uploadProgress: newProgressStore(),
+
+		fastStartFailurePolicy: fastStartPolicy,
+
+		thumbnailPolicy: thumbnailPolicy,
+
+		cloudFrontSigner: cloudFrontSigner,
+		presignExpiry:    presignExpiry,
+		presignMaxExpiry: presignMaxExpiry,
+		presignCache:     newPresignCache(defaultPresignCacheSize),
+
+		processingQueue: newProcessingQueue(processingBacklog),
+
+		maxVideoDuration: maxVideoDuration,
+		maxVideoBitrate:  maxVideoBitrate,
+
+		transcodeRenditions: os.Getenv("ENABLE_TRANSCODE") == "true",
+
+		hlsPackaging: os.Getenv("ENABLE_HLS") == "true",
+
+		tools:                   detectTools(),
+		allowUnprocessedUploads: os.Getenv("ALLOW_UNPROCESSED_UPLOADS") == "true",
+	}
+
+	errorReporter = cfg.errorReporter
+
+	if missing := cfg.tools.missing(); len(missing) > 0 {
+		fallback := "video uploads will be refused"
+		if cfg.allowUnprocessedUploads {
+			fallback = "video uploads will be stored unprocessed"
+		}
+		log.Printf("WARNING: %s not found on PATH; %s. Install ffmpeg to process videos.", strings.Join(missing, " and "), fallback)
+	}
+
+	cfg.initStorage(storageBackend)
+	if storageBackend == storageBackendLocal && cfg.hlsPackaging {
+		log.Fatal("ENABLE_HLS needs STORAGE_BACKEND=s3")
+	}
+
+	if needS3 {
+		cfg.checkBuckets(context.Background())
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -110,33 +702,116 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
-	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
-	mux.Handle("/app/", appHandler)
-
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", cacheMiddleware(assetsHandler))
-
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	if *selfTest {
+		if !cfg.runSelfTest(context.Background()) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	// serverCtx outlives requests; it is cancelled to abort whatever is
+	// still running once shutdown gives up waiting
+	serverCtx, cancelServer := context.WithCancel(context.Background())
+	defer cancelServer()
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	// A server that was killed rather than shut down leaves its temp files
+	sweepStaleTempFiles(os.TempDir(), appName+"-upload-", appName+"-session-", appName+"-hls-", appName+"-image-")
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	var janitorTasks []janitorTask
+	if processingRunRetentionDays > 0 {
+		janitorTasks = append(janitorTasks, janitorTask{
+			name:      "processing runs",
+			retention: time.Duration(processingRunRetentionDays) * 24 * time.Hour,
+			prune:     db.DeleteProcessingRunsBefore,
+		})
+	}
+	janitorTasks = append(janitorTasks, janitorTask{
+		name:      "access events",
+		retention: time.Duration(accessEventRetentionHours) * time.Hour,
+		prune:     db.DeleteAccessEventsBefore,
+	}, janitorTask{
+		name:      "partial uploads",
+		retention: partialUploadTTL,
+		prune:     cfg.partialUploads.prune,
+	}, janitorTask{
+		name:  "upload sessions",
+		prune: cfg.uploadSessions.prune,
+	}, janitorTask{
+		name:      "direct uploads",
+		retention: directUploadRetention,
+		prune: func(cutoff time.Time) (int64, error) {
+			return cfg.pruneDirectUploads(serverCtx, cutoff)
+		},
+	}, janitorTask{
+		name:      "multipart uploads",
+		retention: multipartUploadRetention,
+		prune: func(cutoff time.Time) (int64, error) {
+			return cfg.pruneMultipartUploads(serverCtx, cutoff)
+		},
+	}, janitorTask{
+		name:      "upload progress",
+		retention: progressRetention,
+		prune:     cfg.uploadProgress.prune,
+	}, janitorTask{
+		name:      "upload rate limits",
+		retention: uploadRateIdle,
+		prune:     cfg.uploadLimiter.prune,
+	}, janitorTask{
+		name:      "idempotent responses",
+		retention: idempotencyKeyTTL,
+		prune:     db.DeleteIdempotentResponsesBefore,
+	}, janitorTask{
+		name:      "trashed videos",
+		retention: trashRetention,
+		prune: func(cutoff time.Time) (int64, error) {
+			return cfg.purgeTrashedVideos(serverCtx, cutoff)
+		},
+	})
+	go runJanitor(serverCtx, janitorTasks, time.Hour)
+	go cfg.accessEvents.run(context.Background())
+	go cfg.assetsDisk.watch(serverCtx, time.Minute)
+	cfg.processingQueue.start(processingWorkers, cfg.processVideoJob)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: cfg.newHandler(os.Getenv("DEV_UI") == "true"),
+		// Requests, and the S3 calls they make, are cancelled if they
+		// outlast the shutdown timeout
+		BaseContext: func(net.Listener) context.Context { return serverCtx },
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		log.Printf("Serving on: http://localhost:%s/app/\n", port)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	stop, cancelStop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelStop()
+	<-stop.Done()
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Couldn't finish in-flight requests: %v", err)
+		cancelServer()
+	}
+	// Uploads have all been received by now, so nothing new gets queued
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), processingDrainTimeout)
+	defer cancelDrain()
+	if err := cfg.processingQueue.drain(drainCtx); err != nil {
+		log.Printf("Gave up waiting for video processing: %v", err)
+	}
+	// Processing outcomes are only notified once the queue has drained
+	webhookCtx, cancelWebhooks := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelWebhooks()
+	if err := cfg.webhooks.wait(webhookCtx); err != nil {
+		log.Printf("Gave up waiting for webhook deliveries: %v", err)
+	}
+	cancelServer()
+	if n := tempFiles.removeAll(); n > 0 {
+		log.Printf("Removed %d temp files left by unfinished uploads", n)
+	}
 }
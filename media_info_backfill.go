@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	defaultMediaInfoBackfillBatch = 100
+	maxMediaInfoBackfillBatch     = 1000
+	// mediaInfoBackfillInterval spaces out storage requests so a backfill can't
+	// crowd out live traffic.
+	mediaInfoBackfillInterval = 500 * time.Millisecond
+)
+
+// s3KeyForVideoURL recovers the object key from a stored video URL,
+// including the legacy formats handlerVideoGet rewrites.
+func (cfg *apiConfig) s3KeyForVideoURL(videoURL string) (string, bool) {
+	if _, key, ok := strings.Cut(videoURL, ","); ok {
+		key = strings.TrimSpace(key)
+		return key, key != ""
+	}
+	if key, ok := strings.CutPrefix(videoURL, "https://LOCAL/"); ok {
+		return key, key != ""
+	}
+	u, err := url.Parse(videoURL)
+	if err != nil || u.Host != cfg.s3CfDistribution {
+		return "", false
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	return key, key != ""
+}
+
+// storedMediaInfo finds a stored video's size with Head and its duration
+// by pointing ffprobe at the object. For S3 that is a presigned URL, which
+// only downloads the parts of the file ffprobe reads.
+func storedMediaInfo(ctx context.Context, store storage.Storage, key string) (int64, float64, error) {
+	info, err := store.Head(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	source, err := probeSource(ctx, store, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	meta, err := getVideoMetadata(ctx, source)
+	if err != nil {
+		return 0, 0, err
+	}
+	if meta.Duration <= 0 {
+		return 0, 0, errors.New("ffprobe did not report a duration")
+	}
+	return info.Size, meta.Duration, nil
+}
+
+// handlerMediaInfoBackfill fills in size and duration for up to ?limit=
+// uploaded videos missing them. Each row is saved as soon as it's done and
+// only rows still missing data are selected, so an interrupted run is
+// resumed by calling it again. Passing the returned next_after as ?after=
+// moves past rows that keep failing.
+func (cfg *apiConfig) handlerMediaInfoBackfill(w http.ResponseWriter, r *http.Request) {
+	type failure struct {
+		VideoID string `json:"video_id"`
+		Error   string `json:"error"`
+	}
+	type response struct {
+		Processed int       `json:"processed"`
+		Updated   int       `json:"updated"`
+		Failed    []failure `json:"failed"`
+		Remaining int       `json:"remaining"`
+		NextAfter *string   `json:"next_after"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	limit := defaultMediaInfoBackfillBatch
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMediaInfoBackfillBatch {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 1000", err)
+			return
+		}
+		limit = n
+	}
+
+	var after time.Time
+	if v := r.URL.Query().Get("after"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "after must be an RFC 3339 timestamp", err)
+			return
+		}
+		after = t
+	}
+
+	videos, err := cfg.db.GetVideosMissingMediaInfo(after, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	ctx := r.Context()
+	ticker := time.NewTicker(mediaInfoBackfillInterval)
+	defer ticker.Stop()
+
+	resp := response{Failed: []failure{}}
+	for i, video := range videos {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		resp.Processed++
+		next := video.CreatedAt.UTC().Format(time.RFC3339Nano)
+		resp.NextAfter = &next
+
+		if err := cfg.backfillMediaInfo(ctx, video); err != nil {
+			resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: err.Error()})
+			continue
+		}
+		resp.Updated++
+		log.Printf("media info backfill: %d/%d done", i+1, len(videos))
+	}
+
+	resp.Remaining, err = cfg.db.CountVideosMissingMediaInfo()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count remaining videos", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) backfillMediaInfo(ctx context.Context, video database.Video) error {
+	store, key, ok := cfg.videoObject(*video.VideoURL)
+	if !ok {
+		return errors.New("video URL doesn't point at a configured storage backend")
+	}
+	size, duration, err := storedMediaInfo(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	return cfg.db.SetVideoMediaInfo(video.ID, size, duration)
+}
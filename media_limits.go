@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codes sent when an upload exceeds a media limit.
+const (
+	errorCodeVideoTooLong    = "video_too_long"
+	errorCodeBitrateTooHigh  = "bitrate_too_high"
+	errorCodeMediaInfoNeeded = "media_info_unavailable"
+)
+
+// parseBitrate parses MAX_VIDEO_BITRATE: bits per second, optionally with
+// a k or M suffix, e.g. 8M.
+func parseBitrate(v string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "k"):
+		mult, v = 1000, strings.TrimSuffix(v, "k")
+	case strings.HasSuffix(v, "M"):
+		mult, v = 1000*1000, strings.TrimSuffix(v, "M")
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", v)
+	}
+	return n * mult, nil
+}
+
+// checkMediaLimits rejects an upload longer than cfg.maxVideoDuration or
+// denser than cfg.maxVideoBitrate. While a limit is set, a file whose
+// duration ffprobe couldn't read is rejected too, since it can't be
+// checked.
+func (cfg *apiConfig) checkMediaLimits(probe videoMetadata, probeErr error) error {
+	if cfg.maxVideoDuration <= 0 && cfg.maxVideoBitrate <= 0 {
+		return nil
+	}
+	if probeErr != nil || probe.Duration <= 0 {
+		return &statusError{status: http.StatusBadRequest, msg: "Couldn't read the video's duration", code: errorCodeMediaInfoNeeded, err: probeErr}
+	}
+	if cfg.maxVideoDuration > 0 && probe.Duration > cfg.maxVideoDuration.Seconds() {
+		return &statusError{
+			status: http.StatusBadRequest,
+			msg:    fmt.Sprintf("Video is longer than the %s limit", cfg.maxVideoDuration),
+			code:   errorCodeVideoTooLong,
+		}
+	}
+	if cfg.maxVideoBitrate > 0 && probe.Bitrate > cfg.maxVideoBitrate {
+		return &statusError{
+			status: http.StatusBadRequest,
+			msg:    fmt.Sprintf("Video bitrate is over the %d kbit/s limit", cfg.maxVideoBitrate/1000),
+			code:   errorCodeBitrateTooHigh,
+		}
+	}
+	return nil
+}
+
+// probeUpload runs ffprobe on upload's file, recording the result on it.
+func probeUpload(ctx context.Context, upload *videoUpload) {
+	start := time.Now()
+	upload.probe, upload.probeErr = getVideoMetadata(ctx, upload.file.Name())
+	upload.probeTook = time.Since(start)
+}
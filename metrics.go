@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// opS3Presign is the operation S3 presigning is timed as. ffmpeg and
+// ffprobe runs are recorded under the tool's name, and storage writes as
+// the backend's name with _put, e.g. s3_put.
+const opS3Presign = "s3_presign"
+
+// Upload types, the type label of the upload metrics.
+const (
+	uploadTypeThumbnail     = "thumbnail"
+	uploadTypeThumbnailJSON = "thumbnail_json"
+	uploadTypeVideo         = "video"
+	uploadTypeVideoResume   = "video_resume"
+	uploadTypeVideoChunk    = "video_chunk"
+	uploadTypeVideoComplete = "video_complete"
+	uploadTypeVideoDirect   = "video_direct"
+)
+
+// metricsRegistry holds everything served on /metrics. It is separate
+// from the default registry so only our own collectors are exposed.
+var metricsRegistry *prometheus.Registry
+
+var (
+	uploadsTotal      *prometheus.CounterVec
+	uploadSizeBytes   *prometheus.HistogramVec
+	uploadsInFlight   *prometheus.GaugeVec
+	operationDuration *prometheus.HistogramVec
+	errorsTotal       *prometheus.CounterVec
+)
+
+func init() {
+	initMetrics(defaultAppName)
+}
+
+// initMetrics replaces the metrics with fresh ones named after appName,
+// e.g. tubely_uploads_total. main calls it once APP_NAME is known, before
+// anything is recorded.
+func initMetrics(appName string) {
+	namespace := metricNamespace(appName)
+	uploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_total",
+		Help:      "Upload requests by type and result (accepted, rejected or failed).",
+	}, []string{"type", "result"})
+
+	uploadSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_size_bytes",
+		Help:      "Request body bytes received by upload requests.",
+		Buckets:   prometheus.ExponentialBuckets(1<<10, 4, 13), // 1KiB to 16GiB
+	}, []string{"type"})
+
+	uploadsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "uploads_in_flight",
+		Help:      "Upload requests being received.",
+	}, []string{"type"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of ffmpeg, ffprobe and storage operations by result (ok or error).",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16), // 10ms to ~5m
+	}, []string{"operation", "result"})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Error responses by class (client, client_aborted or server).",
+	}, []string{"class"})
+
+	metricsRegistry = prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		uploadsTotal,
+		uploadSizeBytes,
+		uploadsInFlight,
+		operationDuration,
+		errorsTotal,
+	)
+}
+
+// metricNamespace turns appName into a metric name prefix, replacing what
+// Prometheus doesn't allow in names with underscores.
+func metricNamespace(appName string) string {
+	namespace := []byte(appName)
+	for i, c := range namespace {
+		valid := c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9'
+		if !valid {
+			namespace[i] = '_'
+		}
+	}
+	return string(namespace)
+}
+
+// metricsHandler serves metricsRegistry in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// recordOperation records an operation that started at start and ended
+// with err, in operationDuration and at debug level in ctx's request log.
+func recordOperation(ctx context.Context, operation string, start time.Time, err error, attrs ...any) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	operationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+	logDuration(ctx, operation, start, err, attrs...)
+}
+
+// timed runs fn and records it as operation.
+func timed(ctx context.Context, operation string, fn func() error, attrs ...any) error {
+	start := time.Now()
+	err := fn()
+	recordOperation(ctx, operation, start, err, attrs...)
+	return err
+}
+
+// instrumentUpload counts the requests to an upload route by outcome and
+// records how much each one sent. Only the outcome of receiving the
+// upload is counted; queued processing finishes later.
+func instrumentUpload(uploadType string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight := uploadsInFlight.WithLabelValues(uploadType)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		sw := &statusRecorder{ResponseWriter: w}
+		next(sw, r)
+
+		uploadsTotal.WithLabelValues(uploadType, uploadResult(sw.status)).Inc()
+		uploadSizeBytes.WithLabelValues(uploadType).Observe(float64(body.n))
+	}
+}
+
+func uploadResult(status int) string {
+	switch {
+	case status >= 500:
+		return "failed"
+	case status >= 400:
+		return "rejected"
+	default:
+		return "accepted"
+	}
+}
+
+// statusRecorder records the status a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
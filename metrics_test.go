@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsNamedAfterApp(t *testing.T) {
+	t.Cleanup(func() { initMetrics(defaultAppName) })
+	initMetrics("video-site")
+
+	uploadsTotal.WithLabelValues(uploadTypeVideo, "accepted").Inc()
+	uploadSizeBytes.WithLabelValues(uploadTypeVideo).Observe(1)
+	uploadsInFlight.WithLabelValues(uploadTypeVideo).Inc()
+	operationDuration.WithLabelValues(opS3Presign, "ok").Observe(1)
+	errorsTotal.WithLabelValues(string(errorClassServer)).Inc()
+
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := 0
+	for _, family := range families {
+		name := family.GetName()
+		if strings.Contains(name, "tubely") {
+			t.Errorf("metric %s is named after the default app", name)
+		}
+		if strings.HasPrefix(name, "video_site_") {
+			own++
+		}
+	}
+	if own != 5 {
+		t.Errorf("found %d video_site_ metrics, want 5", own)
+	}
+}
+
+func TestMetricNamespace(t *testing.T) {
+	tests := map[string]string{
+		"tubely":     "tubely",
+		"video-site": "video_site",
+		"my.app v2":  "my_app_v2",
+		"9lives":     "_lives",
+	}
+	for appName, want := range tests {
+		if got := metricNamespace(appName); got != want {
+			t.Errorf("metricNamespace(%q) = %q, want %q", appName, got, want)
+		}
+	}
+}
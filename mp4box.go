@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errNotMP4 marks uploads that don't start with an ISO BMFF ftyp box,
+// whatever Content-Type they were labeled with.
+var errNotMP4 = errors.New("file is not an MP4 container")
+
+// checkFtypBox verifies that r starts with an ftyp box large enough to hold
+// its major brand and minor version, as every MP4 does.
+func checkFtypBox(r io.ReaderAt) error {
+	var header [16]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: too short", errNotMP4)
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if string(header[4:8]) != "ftyp" || (size != 1 && size < 16) {
+		return errNotMP4
+	}
+	return nil
+}
+
+// isFragmentedMP4 walks the top-level boxes of the MP4 at path and reports
+// whether it contains movie fragments (moof), as written by many streaming
+// recorders. Only box headers are read, so this is cheap for large files.
+func isFragmentedMP4(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fragmented := false
+	err = walkTopLevelBoxes(f, func(boxType string) bool {
+		fragmented = boxType == "moof"
+		return !fragmented
+	})
+	return fragmented, err
+}
+
+// isFastStartMP4 reports whether the moov box in r comes before the mdat
+// box, so playback can start before the whole file has downloaded.
+func isFastStartMP4(r io.ReaderAt) (bool, error) {
+	fastStart := false
+	err := walkTopLevelBoxes(r, func(boxType string) bool {
+		fastStart = boxType == "moov"
+		return boxType != "moov" && boxType != "mdat"
+	})
+	return fastStart, err
+}
+
+// walkTopLevelBoxes calls visit with the type of each top-level box in r,
+// in order, until visit returns false or r ends.
+func walkTopLevelBoxes(r io.ReaderAt, visit func(boxType string) bool) error {
+	var offset int64
+	var header [16]byte
+	for {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerLen := int64(8)
+
+		switch size {
+		case 0:
+			// The box extends to the end of the file
+			visit(boxType)
+			return nil
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return fmt.Errorf("truncated %s box at offset %d", boxType, offset)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen {
+			return fmt.Errorf("invalid %s box size %d at offset %d", boxType, size, offset)
+		}
+
+		if !visit(boxType) {
+			return nil
+		}
+		offset += size
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4Box is one box of size 8+len(payload), or a 64-bit sized box when
+// large is set.
+type mp4Box struct {
+	boxType string
+	payload int
+	large   bool
+}
+
+// mp4File lays out boxes one after another.
+func mp4File(boxes ...mp4Box) []byte {
+	var buf bytes.Buffer
+	for _, box := range boxes {
+		if box.large {
+			binary.Write(&buf, binary.BigEndian, uint32(1))
+			buf.WriteString(box.boxType)
+			binary.Write(&buf, binary.BigEndian, uint64(16+box.payload))
+		} else {
+			binary.Write(&buf, binary.BigEndian, uint32(8+box.payload))
+			buf.WriteString(box.boxType)
+		}
+		buf.Write(make([]byte, box.payload))
+	}
+	return buf.Bytes()
+}
+
+func TestIsFragmentedMP4(t *testing.T) {
+	ftyp := mp4Box{"ftyp", 8, false}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    bool
+		wantErr bool
+	}{
+		{"faststart", mp4File(ftyp, mp4Box{"moov", 64, false}, mp4Box{"mdat", 256, false}), false, false},
+		{"moov at the end", mp4File(ftyp, mp4Box{"mdat", 256, false}, mp4Box{"moov", 64, false}), false, false},
+		{"fragmented", mp4File(ftyp, mp4Box{"moov", 16, false}, mp4Box{"moof", 32, false}, mp4Box{"mdat", 256, false}), true, false},
+		{"fragment after a large mdat", mp4File(ftyp, mp4Box{"moov", 16, false}, mp4Box{"mdat", 1024, true}, mp4Box{"moof", 32, false}), true, false},
+		{"box to the end of the file", append(mp4File(ftyp, mp4Box{"moov", 16, false}), 0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3), false, false},
+		{"box smaller than its header", append(mp4File(ftyp), 0, 0, 0, 4, 'm', 'o', 'o', 'v'), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.mp4")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := isFragmentedMP4(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("isFragmentedMP4 = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFastStartMP4(t *testing.T) {
+	ftyp := mp4Box{"ftyp", 8, false}
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"moov first", mp4File(ftyp, mp4Box{"moov", 64, false}, mp4Box{"mdat", 256, false}), true},
+		{"mdat first", mp4File(ftyp, mp4Box{"mdat", 256, false}, mp4Box{"moov", 64, false}), false},
+		{"free box before moov", mp4File(ftyp, mp4Box{"free", 4, false}, mp4Box{"moov", 64, false}, mp4Box{"mdat", 8, false}), true},
+		{"no moov", mp4File(ftyp, mp4Box{"mdat", 256, false}), false},
+	}
+	for _, tt := range tests {
+		got, err := isFastStartMP4(bytes.NewReader(tt.data))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: isFastStartMP4 = %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckFtypBox(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"ftyp", mp4File(mp4Box{"ftyp", 8, false}), true},
+		{"large ftyp", mp4File(mp4Box{"ftyp", 8, true}), true},
+		{"ftyp too small for its brand", mp4File(mp4Box{"ftyp", 0, false}, mp4Box{"moov", 8, false}), false},
+		{"no ftyp", mp4File(mp4Box{"moov", 8, false}, mp4Box{"mdat", 8, false}), false},
+		{"too short", []byte("\x00\x00\x00\x10ftyp"), false},
+	}
+	for _, tt := range tests {
+		err := checkFtypBox(bytes.NewReader(tt.data))
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: checkFtypBox = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, errNotMP4) {
+			t.Errorf("%s: error %v isn't errNotMP4", tt.name, err)
+		}
+	}
+}
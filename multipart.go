@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// respondWithFormError answers a failure to read a multipart body. A body
+// cut off by http.MaxBytesReader is too large rather than malformed; limit
+// is the size the route allows.
+//
+// The reader limit covers the whole body, so every part counts toward it,
+// not just the file the route reads: a small file sent alongside large
+// unrelated parts is rejected too. Handlers give the limit some headroom
+// for the form around their file and check the file's own size separately.
+func respondWithFormError(w http.ResponseWriter, err error, limit int64) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithUploadTooLarge(w, "Upload is too large", limit, err)
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, "Error parsing form data", err)
+}
+
+// respondWithUploadTooLarge responds 413 with the size limit the upload
+// exceeded, so clients can tell users what they may send.
+func respondWithUploadTooLarge(w http.ResponseWriter, msg string, limit int64, err error) {
+	respondWithErrorDetails(w, http.StatusRequestEntityTooLarge, errorCodeUploadTooLarge, msg, err, map[string]any{
+		"limit_bytes": limit,
+	})
+}
+
+// parseMultipartForm wraps r.ParseMultipartForm for upload handlers. The
+// returned cleanup removes file parts that spilled over maxMemory to disk;
+// callers should defer it. net/http only does this once the request is
+// finished, and only for the *http.Request it passed in, so a middleware
+// that clones the request would leak them, and a video would otherwise sit
+// on disk twice while it's processed and uploaded. A form cut off part way
+// removes its own spilled parts before returning the error.
+func parseMultipartForm(r *http.Request, maxMemory int64) (cleanup func(), err error) {
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		return func() {}, err
+	}
+	return func() {
+		if err := r.MultipartForm.RemoveAll(); err != nil {
+			log.Printf("couldn't remove multipart temp files: %v", err)
+		}
+	}, nil
+}
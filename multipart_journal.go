@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// multipartUploadRetention is how long a multipart upload left behind by a
+// failed store can go without progress before the janitor aborts it. A
+// retry of the upload or reprocessing the video resumes it until then.
+const multipartUploadRetention = 24 * time.Hour
+
+// multipartJournal keeps the S3 multipart uploads of failed stores in the
+// database, scoped by the ID of the video they were for.
+type multipartJournal struct {
+	db database.Client
+}
+
+func (j multipartJournal) Find(ctx context.Context, scope, key string) (storage.MultipartUpload, bool, error) {
+	videoID, err := uuid.Parse(scope)
+	if err != nil {
+		return storage.MultipartUpload{}, false, err
+	}
+	row, err := j.db.GetMultipartUpload(videoID, key)
+	if err != nil || row.UploadID == "" {
+		return storage.MultipartUpload{}, false, err
+	}
+	return storageMultipartUpload(row), true, nil
+}
+
+func (j multipartJournal) Save(ctx context.Context, scope string, upload storage.MultipartUpload) error {
+	videoID, err := uuid.Parse(scope)
+	if err != nil {
+		return err
+	}
+	parts := make(database.MultipartParts, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		parts = append(parts, database.MultipartPart{Number: part.Number, ETag: part.ETag, Checksum: part.Checksum})
+	}
+	return j.db.SaveMultipartUpload(database.MultipartUpload{
+		VideoID:           videoID,
+		Bucket:            upload.Bucket,
+		Key:               upload.Key,
+		UploadID:          upload.UploadID,
+		PartSize:          upload.PartSize,
+		ChecksumAlgorithm: upload.ChecksumAlgorithm,
+		Parts:             parts,
+		UpdatedAt:         time.Now(),
+	})
+}
+
+func (j multipartJournal) Remove(ctx context.Context, scope, key string) error {
+	videoID, err := uuid.Parse(scope)
+	if err != nil {
+		return err
+	}
+	return j.db.DeleteMultipartUpload(videoID, key)
+}
+
+func storageMultipartUpload(row database.MultipartUpload) storage.MultipartUpload {
+	upload := storage.MultipartUpload{
+		Bucket:            row.Bucket,
+		Key:               row.Key,
+		UploadID:          row.UploadID,
+		PartSize:          row.PartSize,
+		ChecksumAlgorithm: row.ChecksumAlgorithm,
+	}
+	for _, part := range row.Parts {
+		upload.Parts = append(upload.Parts, storage.UploadedPart{Number: part.Number, ETag: part.ETag, Checksum: part.Checksum})
+	}
+	return upload
+}
+
+// pruneMultipartUploads aborts the multipart uploads that made no progress
+// since cutoff, so S3 stops billing for their parts.
+func (cfg *apiConfig) pruneMultipartUploads(ctx context.Context, cutoff time.Time) (int64, error) {
+	uploads, err := cfg.db.GetMultipartUploadsUpdatedBefore(cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, upload := range uploads {
+		if err := cfg.s3Storage.AbortMultipart(ctx, storageMultipartUpload(upload)); err != nil {
+			return n, err
+		}
+		if err := cfg.db.DeleteMultipartUpload(upload.VideoID, upload.Key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
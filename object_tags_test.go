@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestUploadedVideoTagged(t *testing.T) {
+	for _, tagging := range []bool{true, false} {
+		env := newTestEnv(t, func(cfg *apiConfig) {
+			cfg.s3TagObjects = tagging
+			cfg.s3SSE = types.ServerSideEncryptionAwsKms
+		})
+		userID, token := env.createUser(t)
+		video := env.uploadedVideo(t, token, "Tagged")
+
+		obj, ok := env.s3.Object(testBucket, env.storedVideoKey(t, video.ID))
+		if !ok {
+			t.Fatal("video object not stored")
+		}
+		if !tagging {
+			if obj.Tagging != "" {
+				t.Errorf("tagging off: object tagged %q", obj.Tagging)
+			}
+			continue
+		}
+		tags, err := url.ParseQuery(obj.Tagging)
+		if err != nil {
+			t.Fatalf("tagging %q: %v", obj.Tagging, err)
+		}
+		if tags.Get("user_id") != userID.String() || tags.Get("video_id") != video.ID {
+			t.Errorf("tags %v, want user_id %s and video_id %s", tags, userID, video.ID)
+		}
+
+		// Encrypted objects are served as usual
+		var got videoResponse
+		env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+		if got.VideoURL == nil {
+			t.Error("no video_url for an encrypted object")
+		}
+	}
+}
+
+func TestDirectUploadSignsTags(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.s3TagObjects = true
+		cfg.s3SSE = types.ServerSideEncryptionAwsKms
+		cfg.s3KMSKeyID = "alias/tubely"
+	})
+	userID, token := env.createUser(t)
+	video := env.createVideo(t, token, "Direct")
+
+	data := testVideoBytes(1024)
+	target := env.directUpload(t, token, video.ID, len(data))
+	if got := target.Headers["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"]; got != "alias/tubely" {
+		t.Errorf("headers %v, want the KMS key for the client to send", target.Headers)
+	}
+
+	// The object a client PUTs with the signed headers carries the tags
+	if status := putPresigned(t, target, data); status != http.StatusOK {
+		t.Fatalf("PUT: got %d", status)
+	}
+	obj, _ := env.s3.Object(testBucket, target.Key)
+	tags, err := url.ParseQuery(obj.Tagging)
+	if err != nil || tags.Get("user_id") != userID.String() || tags.Get("video_id") != video.ID {
+		t.Errorf("object tagged %q, want the user and video", obj.Tagging)
+	}
+}
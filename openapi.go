@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// routeAuth is how a route authenticates its caller.
+type routeAuth int
+
+const (
+	authNone routeAuth = iota
+	// authUser requires a user's access JWT.
+	authUser
+	// authOptional accepts a user JWT but doesn't require one.
+	authOptional
+	// authRefresh requires a refresh token as the bearer token.
+	authRefresh
+	// authAdmin requires ADMIN_TOKEN as the bearer token.
+	authAdmin
+	// authUserOrAdmin accepts either the owner's JWT or ADMIN_TOKEN.
+	authUserOrAdmin
+)
+
+// formField is one part of a multipart request body.
+type formField struct {
+	name        string
+	file        bool
+	description string
+}
+
+// routeDoc describes a route for the OpenAPI document. request and
+// response are zero values of the types the handler decodes and encodes;
+// their schemas are derived by reflection.
+type routeDoc struct {
+	summary  string
+	auth     routeAuth
+	request  any
+	form     []formField
+	rawBody  string // content type of a raw request body
+	query    []string
+	response any
+	// rawResponse is the content type of a non-JSON response body.
+	rawResponse string
+	// status is the success status; 200 when unset.
+	status int
+	// Headers-only successes carry no response schema.
+	noContent bool
+	redirect  bool
+}
+
+// routeRegistry registers handlers on a mux and remembers the patterns, so
+// the OpenAPI document lists exactly the routes that are served.
+type routeRegistry struct {
+	mux      *http.ServeMux
+	patterns []string
+
+	once sync.Once
+	doc  []byte
+	err  error
+}
+
+func newRouteRegistry(mux *http.ServeMux) *routeRegistry {
+	return &routeRegistry{mux: mux}
+}
+
+// HandleFunc registers handler for pattern, a "METHOD /path" ServeMux
+// pattern. Patterns without a routeDoc are logged so they get one.
+func (rr *routeRegistry) HandleFunc(pattern string, handler http.HandlerFunc) {
+	rr.mux.HandleFunc(pattern, handler)
+	rr.patterns = append(rr.patterns, pattern)
+	if _, ok := routeDocs[pattern]; !ok {
+		log.Printf("route %q has no OpenAPI documentation", pattern)
+	}
+}
+
+// handlerOpenAPI serves the generated document. It is built on first
+// request, after every route has been registered.
+func (rr *routeRegistry) handlerOpenAPI(w http.ResponseWriter, r *http.Request) {
+	rr.once.Do(func() {
+		rr.doc, rr.err = json.Marshal(rr.openAPI())
+	})
+	if rr.err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build OpenAPI document", rr.err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rr.doc)
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+func (rr *routeRegistry) openAPI() map[string]any {
+	gen := &schemaGen{components: map[string]any{}}
+	gen.components["Error"] = map[string]any{
+		"type":     "object",
+		"required": []string{"error"},
+		"properties": map[string]any{
+			"error": map[string]any{
+				"type":     "object",
+				"required": []string{"code", "message"},
+				"properties": map[string]any{
+					"code":    map[string]any{"type": "string", "description": "Machine-readable code"},
+					"message": map[string]any{"type": "string"},
+				},
+				"additionalProperties": true,
+			},
+		},
+	}
+
+	paths := map[string]any{}
+	patterns := append([]string(nil), rr.patterns...)
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			continue
+		}
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(method)] = gen.operation(pattern, path, routeDocs[pattern])
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Tubely API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": gen.components,
+			"securitySchemes": map[string]any{
+				"userJWT":      map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"refreshToken": map[string]any{"type": "http", "scheme": "bearer", "description": "A refresh token from /api/login"},
+				"adminToken":   map[string]any{"type": "http", "scheme": "bearer", "description": "The server's ADMIN_TOKEN"},
+			},
+		},
+	}
+}
+
+func (g *schemaGen) operation(pattern, path string, doc routeDoc) map[string]any {
+	op := map[string]any{"operationId": pattern}
+	if doc.summary != "" {
+		op["summary"] = doc.summary
+	}
+
+	var params []any
+	for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]any{
+			"name": m[1], "in": "path", "required": true,
+			"schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, q := range doc.query {
+		params = append(params, map[string]any{
+			"name": q, "in": "query",
+			"schema": map[string]any{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	switch doc.auth {
+	case authUser:
+		op["security"] = []any{map[string]any{"userJWT": []string{}}}
+	case authOptional:
+		op["security"] = []any{map[string]any{"userJWT": []string{}}, map[string]any{}}
+	case authRefresh:
+		op["security"] = []any{map[string]any{"refreshToken": []string{}}}
+	case authAdmin:
+		op["security"] = []any{map[string]any{"adminToken": []string{}}}
+	case authUserOrAdmin:
+		op["security"] = []any{map[string]any{"userJWT": []string{}}, map[string]any{"adminToken": []string{}}}
+	}
+
+	switch {
+	case doc.request != nil:
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(doc.request))},
+			},
+		}
+	case len(doc.form) > 0:
+		props := map[string]any{}
+		var required []string
+		for _, f := range doc.form {
+			s := map[string]any{"type": "string"}
+			if f.file {
+				s["format"] = "binary"
+				required = append(required, f.name)
+			}
+			if f.description != "" {
+				s["description"] = f.description
+			}
+			props[f.name] = s
+		}
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"multipart/form-data": map[string]any{"schema": map[string]any{
+					"type": "object", "properties": props, "required": required,
+				}},
+			},
+		}
+	case doc.rawBody != "":
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{
+				doc.rawBody: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+			},
+		}
+	}
+
+	status := doc.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case doc.rawResponse != "":
+		success["content"] = map[string]any{
+			doc.rawResponse: map[string]any{"schema": map[string]any{"type": "string"}},
+		}
+	case doc.response != nil && !doc.noContent && !doc.redirect:
+		success["content"] = map[string]any{
+			"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(doc.response))},
+		}
+	}
+	op["responses"] = map[string]any{
+		strconv.Itoa(status): success,
+		"default": map[string]any{
+			"description": "Error",
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+			},
+		},
+	}
+	return op
+}
+
+// schemaGen derives JSON schemas from Go types. Named struct types become
+// components referenced by $ref; everything else is inlined.
+type schemaGen struct {
+	components map[string]any
+	names      map[reflect.Type]string
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+)
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case uuidType:
+		return map[string]any{"type": "string", "format": "uuid"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := g.componentName(t)
+		if _, ok := g.components[name]; !ok {
+			// Reserve the name first so recursive types terminate
+			g.components[name] = map[string]any{}
+			g.components[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+// componentName names a struct's schema after the type, prefixed with its
+// package when two packages use the same name.
+func (g *schemaGen) componentName(t reflect.Type) string {
+	if g.names == nil {
+		g.names = map[reflect.Type]string{}
+	}
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	for other, used := range g.names {
+		if used == name && other != t {
+			pkg := t.PkgPath()
+			name = pkg[strings.LastIndex(pkg, "/")+1:] + "." + name
+			break
+		}
+	}
+	g.names[t] = name
+	return name
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	g.addFields(t, props, &required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// addFields follows encoding/json: untagged embedded structs are flattened,
+// "-" is skipped, and omitempty fields aren't required.
+func (g *schemaGen) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Shapes of handler-local request and response types, mirrored here for
+// the OpenAPI document. Keep them in step with the handlers; responses
+// built from the shared api_types DTOs are referenced directly.
+type (
+	credentialsRequest struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	loginResponseDoc struct {
+		userResponse
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	refreshResponseDoc struct {
+		Token string `json:"token"`
+	}
+	videoCreateRequest struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		AutoSuffix  bool   `json:"auto_suffix,omitempty"`
+	}
+	titlePolicyRequest struct {
+		UniqueTitles bool `json:"unique_titles"`
+	}
+	videoUpdateRequest struct {
+		Title               *string   `json:"title"`
+		Description         *string   `json:"description"`
+		Password            *string   `json:"password"`
+		AllowedEmbedOrigins *[]string `json:"allowed_embed_origins"`
+		AutoSuffix          bool      `json:"auto_suffix,omitempty"`
+		Visibility          *string   `json:"visibility"`
+	}
+	thumbnailJSONRequest struct {
+		ContentType string `json:"content_type"`
+		DataBase64  string `json:"data_base64"`
+		Grid        bool   `json:"grid"`
+	}
+	bulkDeleteRequest struct {
+		IDs []uuid.UUID `json:"ids"`
+	}
+	bulkDeleteResponseDoc struct {
+		Results []struct {
+			ID     uuid.UUID `json:"id"`
+			Result string    `json:"result"`
+		} `json:"results"`
+	}
+	shareLinkRequest struct {
+		ExpiresInSeconds int  `json:"expires_in_seconds"`
+		MaxViews         *int `json:"max_views"`
+	}
+	resumableResponseDoc struct {
+		Error         string `json:"error,omitempty"`
+		ResumeToken   string `json:"resume_token"`
+		ReceivedBytes int64  `json:"received_bytes"`
+		PrefixSHA256  string `json:"prefix_sha256"`
+		ExpiresAt     string `json:"expires_at"`
+	}
+	accessEventsResponseDoc struct {
+		Events     []database.AccessEvent `json:"events"`
+		NextBefore *int64                 `json:"next_before"`
+	}
+	cleanupSuggestionsResponseDoc struct {
+		VideoCount       int                 `json:"video_count"`
+		VideoLimit       int                 `json:"video_limit"`
+		VideoRemaining   *int                `json:"video_remaining"`
+		Largest          []cleanupSuggestion `json:"largest"`
+		Unviewed         []cleanupSuggestion `json:"unviewed"`
+		StaleDrafts      []cleanupSuggestion `json:"stale_drafts"`
+		ReclaimableBytes int64               `json:"reclaimable_bytes"`
+	}
+	directUploadURLRequest struct {
+		SizeBytes int64 `json:"size_bytes"`
+	}
+	uploadSessionRequest struct {
+		SizeBytes int64  `json:"size_bytes"`
+		ChunkSize int64  `json:"chunk_size,omitempty"`
+		SHA256    string `json:"sha256,omitempty"`
+		Filename  string `json:"filename,omitempty"`
+	}
+	directUploadCompleteRequest struct {
+		Key string `json:"key"`
+	}
+	settingsUpdateRequest struct {
+		By                string  `json:"by"`
+		LogLevel          *string `json:"log_level"`
+		Maintenance       *bool   `json:"maintenance"`
+		PresignCache      *bool   `json:"presign_cache"`
+		PreviewGeneration *bool   `json:"preview_generation"`
+	}
+	signedURLResponseDoc struct {
+		VideoURL  string  `json:"video_url"`
+		ExpiresAt *string `json:"expires_at"`
+	}
+	livenessResponseDoc struct {
+		Status string `json:"status"`
+	}
+	readinessResponseDoc struct {
+		Status  string                     `json:"status"`
+		Reasons []string                   `json:"reasons"`
+		Checks  map[string]dependencyCheck `json:"checks"`
+	}
+	healthResponseDoc struct {
+		Status             string     `json:"status"`
+		Tools              toolStatus `json:"tools"`
+		UnprocessedUploads bool       `json:"unprocessed_uploads"`
+	}
+	impersonateRequest struct {
+		Impersonator     string `json:"impersonator"`
+		Reason           string `json:"reason"`
+		TTLSeconds       int    `json:"ttl_seconds,omitempty"`
+		AllowDestructive bool   `json:"allow_destructive,omitempty"`
+	}
+	impersonateResponseDoc struct {
+		Token     string `json:"token"`
+		UserID    string `json:"user_id"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	// Admin reports are documented as free-form objects.
+	adminReportDoc map[string]any
+)
+
+// routeDocs documents every route registered through routeRegistry, keyed
+// by its ServeMux pattern.
+var routeDocs = map[string]routeDoc{
+	"GET /healthz": {
+		summary:  "Liveness probe; 200 whenever the server is up",
+		response: livenessResponseDoc{},
+	},
+	"GET /readyz": {
+		summary:  "Readiness probe; 503 while uploads are refused or a dependency is down",
+		response: readinessResponseDoc{},
+	},
+	"GET /api/healthz": {
+		summary:  "Which media tools were found at startup",
+		response: healthResponseDoc{},
+	},
+	"GET /api/openapi.json": {
+		summary:  "This document",
+		response: map[string]any{},
+	},
+
+	"POST /api/login": {
+		summary:  "Log in with email and password",
+		request:  credentialsRequest{},
+		response: loginResponseDoc{},
+	},
+	"POST /api/refresh": {
+		summary:  "Exchange a refresh token for an access token",
+		auth:     authRefresh,
+		response: refreshResponseDoc{},
+	},
+	"POST /api/revoke": {
+		summary:   "Revoke a refresh token",
+		auth:      authRefresh,
+		status:    204,
+		noContent: true,
+	},
+
+	"POST /api/users": {
+		summary:  "Create a user",
+		request:  credentialsRequest{},
+		response: userResponse{},
+		status:   201,
+	},
+	"GET /api/users/me/cleanup-suggestions": {
+		summary:  "Videos worth deleting to get under the video limit",
+		auth:     authUser,
+		query:    []string{"limit", "days"},
+		response: cleanupSuggestionsResponseDoc{},
+	},
+
+	"GET /api/users/me/title-policy": {
+		summary:  "Whether the caller's video titles must be unique",
+		auth:     authUser,
+		response: titlePolicyResponse{},
+	},
+	"PUT /api/users/me/title-policy": {
+		summary:  "Turn unique titles on or off; 409 lists duplicates blocking it",
+		auth:     authUser,
+		request:  titlePolicyRequest{},
+		response: titlePolicyResponse{},
+	},
+
+	"POST /api/videos": {
+		summary:  "Create a draft video",
+		auth:     authUser,
+		request:  videoCreateRequest{},
+		response: videoResponse{},
+		status:   201,
+	},
+	"POST /api/thumbnail_upload/{videoID}": {
+		summary: "Upload a thumbnail",
+		auth:    authUser,
+		form: []formField{
+			{name: "thumbnail", file: true, description: "image/jpeg, image/png, image/webp or image/avif"},
+			{name: "grid", description: "\"true\" to also build a 16:9 grid variant"},
+		},
+		response: videoResponse{},
+	},
+	"POST /api/videos/{videoID}/thumbnail_json": {
+		summary:  "Upload a base64-encoded thumbnail",
+		auth:     authUser,
+		request:  thumbnailJSONRequest{},
+		response: videoResponse{},
+	},
+	"POST /api/video_upload/{videoID}": {
+		summary: "Upload video content and queue it for processing; an optional X-Upload-Checksum-SHA256 header (base64) is verified, and interrupted transfers return a resume token. A retry with the same Idempotency-Key header within 24 hours replays the first successful response, and gets 409 while the first is still in flight",
+		auth:    authUser,
+		form: []formField{
+			{name: "video", file: true, description: "video/mp4"},
+		},
+		status:   202,
+		response: videoResponse{},
+	},
+	"GET /api/video_upload/{videoID}/resume": {
+		summary:  "Latest interrupted upload of a video",
+		auth:     authUser,
+		response: resumableResponseDoc{},
+	},
+	"POST /api/video_upload/{videoID}/resume": {
+		summary:  "Append bytes to an interrupted upload (Upload-Token, Content-Range); the last chunk queues it for processing",
+		auth:     authUser,
+		rawBody:  "application/octet-stream",
+		status:   202,
+		response: videoResponse{},
+	},
+	"POST /api/videos/{videoID}/upload-url": {
+		summary:  "Presigned PUT URL for uploading video content straight to S3; size and type are signed",
+		auth:     authUser,
+		request:  directUploadURLRequest{},
+		status:   201,
+		response: directUploadURLResponse{},
+	},
+	"POST /api/videos/{videoID}/upload-complete": {
+		summary:  "Verify a direct upload in S3 and make it the video's content",
+		auth:     authUser,
+		request:  directUploadCompleteRequest{},
+		response: videoResponse{},
+	},
+	"POST /api/videos/{videoID}/uploads": {
+		summary:  "Open a chunked upload session; chunk_size defaults to 8MiB and sha256 is checked on complete",
+		auth:     authUser,
+		request:  uploadSessionRequest{},
+		status:   201,
+		response: uploadSessionResponse{},
+	},
+	"GET /api/uploads/{sessionID}": {
+		summary:  "Chunks received and missing in an upload session",
+		auth:     authUser,
+		response: uploadSessionResponse{},
+	},
+	"PUT /api/uploads/{sessionID}/chunks/{n}": {
+		summary:  "Store chunk n of an upload session, in any order; an optional Upload-Chunk-SHA256 header is verified",
+		auth:     authUser,
+		rawBody:  "application/octet-stream",
+		response: uploadSessionResponse{},
+	},
+	"POST /api/uploads/{sessionID}/complete": {
+		summary:  "Verify an upload session's size and checksum and queue the video for processing",
+		auth:     authUser,
+		status:   202,
+		response: videoResponse{},
+	},
+	"GET /api/video_upload/{videoID}/progress": {
+		summary:  "Progress of the latest upload, from receiving through storing",
+		auth:     authUser,
+		response: uploadProgress{},
+	},
+	"GET /api/videos": {
+		summary:  "List the caller's videos; any of limit, cursor, sort (created_at, title) or order (asc, desc) returns pages of {videos, next_cursor} instead",
+		auth:     authUser,
+		query:    []string{"drafts", "limit", "cursor", "sort", "order", "expires"},
+		response: []videoResponse{},
+	},
+	"GET /api/videos/public": {
+		summary:  "Page through everyone's public videos; takes the same limit, cursor, sort and order as GET /api/videos",
+		query:    []string{"limit", "cursor", "sort", "order", "expires"},
+		response: videoPageResponse{},
+	},
+	"GET /api/videos/trash": {
+		summary:  "Page through the caller's videos in the trash; takes the same limit, cursor, sort and order as GET /api/videos",
+		auth:     authUser,
+		query:    []string{"limit", "cursor", "sort", "order", "expires"},
+		response: videoPageResponse{},
+	},
+	"GET /api/videos/{videoID}": {
+		summary:  "Get a video; owner-only fields appear for the owner, who also sees it while it is in the trash",
+		auth:     authOptional,
+		query:    []string{"expires"},
+		response: videoResponse{},
+	},
+	"PATCH /api/videos/{videoID}": {
+		summary:  "Update a video's metadata; honours If-Match",
+		auth:     authUser,
+		request:  videoUpdateRequest{},
+		response: videoResponse{},
+	},
+	"DELETE /api/videos/{videoID}": {
+		summary:   "Move a video to the trash; it is purged with its files once the trash retention passes",
+		auth:      authUser,
+		status:    204,
+		noContent: true,
+	},
+	"POST /api/videos/{videoID}/restore": {
+		summary:  "Take a video out of the trash; 410 once its trash retention has passed",
+		auth:     authUser,
+		response: videoResponse{},
+	},
+	"POST /api/videos/bulk-delete": {
+		summary:  "Move several videos to the trash",
+		auth:     authUser,
+		request:  bulkDeleteRequest{},
+		response: bulkDeleteResponseDoc{},
+	},
+	"GET /api/videos/{videoID}/status": {
+		summary:  "Processing status of a video's latest upload, for polling after a 202",
+		auth:     authUser,
+		response: videoStatusResponse{},
+	},
+	"GET /api/videos/{videoID}/signed-url": {
+		summary:  "A fresh playable URL for one of the caller's videos",
+		auth:     authUser,
+		query:    []string{"expires"},
+		response: signedURLResponseDoc{},
+	},
+	"GET /api/videos/{videoID}/download": {
+		summary:     "Download a video as an attachment named after its title; a single Range header is honored with 206, for resuming",
+		auth:        authOptional,
+		rawResponse: "video/mp4",
+	},
+	"GET /api/videos/{videoID}/hls.m3u8": {
+		summary:     "HLS playlist with absolute, signed segment URLs; hls_url points here when signing is on",
+		auth:        authOptional,
+		query:       []string{"expires"},
+		rawResponse: hlsPlaylistContentType,
+	},
+	"GET /api/videos/{videoID}/processing-runs": {
+		summary:  "Processing history of a video",
+		auth:     authUserOrAdmin,
+		response: []database.ProcessingRun{},
+	},
+	"GET /api/videos/{videoID}/access": {
+		summary:  "Recent access events of a video, newest first",
+		auth:     authUser,
+		query:    []string{"limit", "before"},
+		response: accessEventsResponseDoc{},
+	},
+
+	"POST /api/videos/{videoID}/share-links": {
+		summary:  "Create a share link",
+		auth:     authUser,
+		request:  shareLinkRequest{},
+		response: shareLinkResponse{},
+		status:   201,
+	},
+	"GET /api/videos/{videoID}/share-links": {
+		summary:  "List a video's share links",
+		auth:     authUser,
+		response: []shareLinkResponse{},
+	},
+	"DELETE /api/videos/{videoID}/share-links/{token}": {
+		summary:   "Revoke a share link",
+		auth:      authUser,
+		status:    204,
+		noContent: true,
+	},
+	"GET /s/{token}": {
+		summary:  "Open a share link; redirects to the video",
+		status:   302,
+		redirect: true,
+	},
+
+	"POST /admin/reset": {
+		summary:   "Delete all data (dev platform only)",
+		noContent: true,
+	},
+	"GET /admin/settings": {
+		summary:  "Runtime settings and their history",
+		auth:     authAdmin,
+		response: settingsResponse{},
+	},
+	"PUT /admin/settings": {
+		summary:  "Change runtime settings",
+		auth:     authAdmin,
+		request:  settingsUpdateRequest{},
+		response: settingsResponse{},
+	},
+	"GET /admin/stats": {
+		summary:  "Upload, disk and admission statistics",
+		auth:     authAdmin,
+		response: adminReportDoc{},
+	},
+	"POST /admin/thumbnails/fix-extensions": {
+		summary:  "Rename thumbnails stored under the wrong extension",
+		auth:     authAdmin,
+		response: adminReportDoc{},
+	},
+	"POST /admin/assets/shard": {
+		summary:  "Move flat thumbnail files into the sharded layout",
+		auth:     authAdmin,
+		response: adminReportDoc{},
+	},
+	"POST /admin/assets/normalize-urls": {
+		summary:  "Store absolute localhost thumbnail URLs as relative paths",
+		auth:     authAdmin,
+		response: adminReportDoc{},
+	},
+	"POST /admin/impersonate/{userID}": {
+		summary:  "Issue a short-lived token acting as a user, for support",
+		auth:     authAdmin,
+		request:  impersonateRequest{},
+		response: impersonateResponseDoc{},
+	},
+	"GET /admin/impersonations": {
+		summary:  "Recent impersonation grants",
+		auth:     authAdmin,
+		response: []database.ImpersonationGrant{},
+	},
+	"POST /admin/videos/backfill-media-info": {
+		summary:  "Fill in missing video size and duration",
+		auth:     authAdmin,
+		query:    []string{"limit", "after"},
+		response: adminReportDoc{},
+	},
+	"POST /admin/videos/refresh-urls": {
+		summary:  "Check every uploaded video's object still exists and report missing ones",
+		auth:     authAdmin,
+		response: adminReportDoc{},
+	},
+	"POST /admin/storage/reconcile": {
+		summary:  "Report stored objects no video refers to and references to missing objects; optionally delete old orphans and fix videos stored with the wrong Content-Type",
+		auth:     authAdmin,
+		query:    []string{"delete", "min_age", "fix_metadata"},
+		response: reconcileReport{},
+	},
+}
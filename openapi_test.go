@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// servedOpenAPI builds the full handler, dev routes included, and returns
+// its OpenAPI document along with anything logged while registering routes.
+func servedOpenAPI(t *testing.T, cfg *apiConfig) (doc map[string]any, logged string) {
+	t.Helper()
+	var logs bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&logs)
+	handler := cfg.newHandler(true)
+	log.SetOutput(previous)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json: got %d: %s", rec.Code, rec.Body)
+	}
+	decodeJSON(t, rec.Body.Bytes(), &doc)
+	return doc, logs.String()
+}
+
+// schemaRefs collects every $ref under v.
+func schemaRefs(v any, refs *[]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		if ref, ok := v["$ref"].(string); ok {
+			*refs = append(*refs, ref)
+		}
+		for _, child := range v {
+			schemaRefs(child, refs)
+		}
+	case []any:
+		for _, child := range v {
+			schemaRefs(child, refs)
+		}
+	}
+}
+
+// checkSchema reports schema keywords OpenAPI 3.0 wouldn't accept.
+func checkSchema(t *testing.T, where string, v any) {
+	t.Helper()
+	s, ok := v.(map[string]any)
+	if !ok {
+		t.Errorf("%s: schema is %T, want an object", where, v)
+		return
+	}
+	if typ, ok := s["type"]; ok && !slices.Contains([]any{"string", "integer", "number", "boolean", "array", "object"}, typ) {
+		t.Errorf("%s: type %v", where, typ)
+	}
+	if s["type"] == "array" {
+		checkSchema(t, where+"[]", s["items"])
+	}
+	props, _ := s["properties"].(map[string]any)
+	for name, prop := range props {
+		checkSchema(t, where+"."+name, prop)
+	}
+	if required, ok := s["required"].([]any); ok {
+		for _, name := range required {
+			if _, ok := props[name.(string)]; !ok {
+				t.Errorf("%s: %v is required but has no property", where, name)
+			}
+		}
+	}
+	if extra, ok := s["additionalProperties"].(map[string]any); ok {
+		checkSchema(t, where+"{}", extra)
+	}
+	if all, ok := s["allOf"].([]any); ok {
+		for _, sub := range all {
+			checkSchema(t, where, sub)
+		}
+	}
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	env := newTestEnv(t)
+	doc, logged := servedOpenAPI(t, env.cfg)
+	if strings.Contains(logged, "has no OpenAPI documentation") {
+		t.Errorf("undocumented routes:\n%s", logged)
+	}
+
+	paths, _ := doc["paths"].(map[string]any)
+	for pattern := range routeDocs {
+		method, path, _ := strings.Cut(pattern, " ")
+		item, _ := paths[path].(map[string]any)
+		if _, ok := item[strings.ToLower(method)]; !ok {
+			t.Errorf("%s is documented but isn't served", pattern)
+		}
+	}
+	for path, item := range paths {
+		for method := range item.(map[string]any) {
+			if _, ok := routeDocs[strings.ToUpper(method)+" "+path]; !ok {
+				t.Errorf("%s %s is served without a routeDoc", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIDocumentIsValid(t *testing.T) {
+	env := newTestEnv(t)
+	doc, _ := servedOpenAPI(t, env.cfg)
+
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("openapi = %v, want 3.0.3", doc["openapi"])
+	}
+	if info, _ := doc["info"].(map[string]any); info["title"] == nil || info["version"] == nil {
+		t.Errorf("info = %v, want a title and version", info)
+	}
+	components, _ := doc["components"].(map[string]any)
+	schemas, _ := components["schemas"].(map[string]any)
+	schemes, _ := components["securitySchemes"].(map[string]any)
+	for name, schema := range schemas {
+		checkSchema(t, name, schema)
+	}
+
+	// Every reference resolves
+	var refs []string
+	schemaRefs(doc, &refs)
+	for _, ref := range refs {
+		name, ok := strings.CutPrefix(ref, "#/components/schemas/")
+		if _, exists := schemas[name]; !ok || !exists {
+			t.Errorf("unresolved $ref %q", ref)
+		}
+	}
+
+	paths, _ := doc["paths"].(map[string]any)
+	for path, item := range paths {
+		var want []string
+		for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+			want = append(want, m[1])
+		}
+		for method, raw := range item.(map[string]any) {
+			where := strings.ToUpper(method) + " " + path
+			op := raw.(map[string]any)
+			if !slices.Contains([]string{"get", "put", "post", "delete", "patch"}, method) {
+				t.Errorf("%s: method %q", where, method)
+			}
+
+			var got []string
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				p := p.(map[string]any)
+				if p["in"] == "path" {
+					got = append(got, p["name"].(string))
+				}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: path parameters %v, want %v", where, got, want)
+			}
+
+			security, _ := op["security"].([]any)
+			for _, requirement := range security {
+				for scheme := range requirement.(map[string]any) {
+					if _, ok := schemes[scheme]; !ok {
+						t.Errorf("%s: unknown security scheme %q", where, scheme)
+					}
+				}
+			}
+
+			responses, _ := op["responses"].(map[string]any)
+			if len(responses) < 2 {
+				t.Errorf("%s: responses %v, want a success and the error default", where, responses)
+			}
+			errResponse, _ := responses["default"].(map[string]any)
+			var errRefs []string
+			schemaRefs(errResponse, &errRefs)
+			if !slices.Equal(errRefs, []string{"#/components/schemas/Error"}) {
+				t.Errorf("%s: default response %v, want the Error envelope", where, errResponse)
+			}
+			for status, resp := range responses {
+				content, _ := resp.(map[string]any)["content"].(map[string]any)
+				for mediaType, media := range content {
+					checkSchema(t, where+" "+status+" "+mediaType, media.(map[string]any)["schema"])
+				}
+			}
+			if body, ok := op["requestBody"].(map[string]any); ok {
+				content, _ := body["content"].(map[string]any)
+				for mediaType, media := range content {
+					checkSchema(t, where+" request "+mediaType, media.(map[string]any)["schema"])
+				}
+			}
+		}
+	}
+}
+
+func TestOpenAPIAnnotations(t *testing.T) {
+	env := newTestEnv(t)
+	doc, _ := servedOpenAPI(t, env.cfg)
+	paths, _ := doc["paths"].(map[string]any)
+	operation := func(method, path string) map[string]any {
+		t.Helper()
+		item, _ := paths[path].(map[string]any)
+		op, ok := item[method].(map[string]any)
+		if !ok {
+			t.Fatalf("%s %s isn't documented", method, path)
+		}
+		return op
+	}
+
+	// Multipart uploads describe their parts, files as binary
+	upload := operation("post", "/api/video_upload/{videoID}")
+	body, _ := json.Marshal(upload["requestBody"])
+	for _, want := range []string{`"multipart/form-data"`, `"video":{"description":"video/mp4","format":"binary","type":"string"}`, `"required":["video"]`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("video upload body %s, want %s", body, want)
+		}
+	}
+	if _, ok := upload["responses"].(map[string]any)["202"]; !ok {
+		t.Errorf("video upload responses %v, want 202", upload["responses"])
+	}
+
+	// Raw bodies and responses keep their media types
+	chunk, _ := json.Marshal(operation("put", "/api/uploads/{sessionID}/chunks/{n}")["requestBody"])
+	if !strings.Contains(string(chunk), `"application/octet-stream"`) {
+		t.Errorf("chunk body %s, want application/octet-stream", chunk)
+	}
+	download, _ := json.Marshal(operation("get", "/api/videos/{videoID}/download")["responses"])
+	if !strings.Contains(string(download), `"video/mp4"`) {
+		t.Errorf("download responses %s, want video/mp4", download)
+	}
+
+	// Auth requirements name their schemes
+	security, _ := json.Marshal(operation("get", "/admin/stats")["security"])
+	if string(security) != `[{"adminToken":[]}]` {
+		t.Errorf("admin stats security = %s", security)
+	}
+	if _, ok := operation("post", "/api/login")["security"]; ok {
+		t.Error("login requires authentication")
+	}
+}
+
+func TestOpenAPIMatchesResponses(t *testing.T) {
+	env := newTestEnv(t)
+	doc, _ := servedOpenAPI(t, env.cfg)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Described")
+
+	var got map[string]any
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	schema := doc["components"].(map[string]any)["schemas"].(map[string]any)["videoResponse"].(map[string]any)
+	props := schema["properties"].(map[string]any)
+	for key := range got {
+		if _, ok := props[key]; !ok {
+			t.Errorf("the response has %q, which the schema doesn't describe", key)
+		}
+	}
+	for _, key := range schema["required"].([]any) {
+		if _, ok := got[key.(string)]; !ok {
+			t.Errorf("the schema requires %q, which the response lacks", key)
+		}
+	}
+}
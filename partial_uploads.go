@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// partialUploadTTL is how long an interrupted upload waits to be resumed
+// before the janitor removes it.
+const partialUploadTTL = time.Hour
+
+// partialUpload is a video upload that was cut off mid-transfer. The
+// received prefix stays on disk with a running SHA-256 of it, so a resume
+// can check the client is continuing the same file.
+type partialUpload struct {
+	token     string
+	videoID   uuid.UUID
+	userID    uuid.UUID
+	path      string
+	received  int64
+	hash      hash.Hash
+	mediaType string
+	filename  string
+	metadata  database.UploadMetadata
+	createdAt time.Time
+	// busy is set while a continuation request is appending to the file
+	busy bool
+}
+
+func (p *partialUpload) prefixSHA256() string {
+	return hex.EncodeToString(p.hash.Sum(nil))
+}
+
+type partialUploadStore struct {
+	mu      sync.Mutex
+	byToken map[string]*partialUpload
+}
+
+func newPartialUploadStore() *partialUploadStore {
+	return &partialUploadStore{byToken: map[string]*partialUpload{}}
+}
+
+// add registers p under a new random token, taking ownership of its file.
+func (s *partialUploadStore) add(p *partialUpload) error {
+	var rnd [24]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return err
+	}
+	p.token = base64.RawURLEncoding.EncodeToString(rnd[:])
+	p.createdAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byToken[p.token] = p
+	return nil
+}
+
+// claim marks the upload behind token as in use by a continuation. It
+// fails with a *statusError if the token is unknown, belongs to someone
+// else or is already being resumed.
+func (s *partialUploadStore) claim(token string, videoID, userID uuid.UUID) (*partialUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.byToken[token]
+	if !ok || p.videoID != videoID || p.userID != userID {
+		return nil, &statusError{status: http.StatusNotFound, msg: "Resumable upload not found"}
+	}
+	if p.busy {
+		return nil, &statusError{status: http.StatusConflict, msg: "Upload is already being resumed"}
+	}
+	p.busy = true
+	return p, nil
+}
+
+func (s *partialUploadStore) release(p *partialUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.busy = false
+}
+
+// remove forgets p and deletes its file.
+func (s *partialUploadStore) remove(p *partialUpload) {
+	s.detach(p)
+	tempFiles.remove(p.path)
+}
+
+// detach forgets p, handing ownership of its file back to the caller.
+func (s *partialUploadStore) detach(p *partialUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byToken, p.token)
+}
+
+// latest returns the most recent partial upload of videoID by userID.
+func (s *partialUploadStore) latest(videoID, userID uuid.UUID) *partialUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found *partialUpload
+	for _, p := range s.byToken {
+		if p.videoID == videoID && p.userID == userID && (found == nil || p.createdAt.After(found.createdAt)) {
+			found = p
+		}
+	}
+	return found
+}
+
+// prune removes idle partial uploads created before cutoff. It matches the
+// janitorTask signature.
+func (s *partialUploadStore) prune(cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	var expired []*partialUpload
+	for token, p := range s.byToken {
+		if !p.busy && p.createdAt.Before(cutoff) {
+			expired = append(expired, p)
+			delete(s.byToken, token)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range expired {
+		tempFiles.remove(p.path)
+	}
+	return int64(len(expired)), nil
+}
+
+// respondWithResumable tells the client how to continue an interrupted
+// upload.
+func respondWithResumable(w http.ResponseWriter, code int, msg string, p *partialUpload) {
+	type response struct {
+		Error         string    `json:"error,omitempty"`
+		ResumeToken   string    `json:"resume_token"`
+		ReceivedBytes int64     `json:"received_bytes"`
+		PrefixSHA256  string    `json:"prefix_sha256"`
+		ExpiresAt     time.Time `json:"expires_at"`
+	}
+	respondWithJSON(w, code, response{
+		Error:         msg,
+		ResumeToken:   p.token,
+		ReceivedBytes: p.received,
+		PrefixSHA256:  p.prefixSHA256(),
+		ExpiresAt:     p.createdAt.Add(partialUploadTTL).UTC(),
+	})
+}
+
+// readErrRecorder remembers the error from the source side of a copy, so a
+// dropped client can be told apart from a failing disk.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
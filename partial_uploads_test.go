@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resumableResponse is the body of an interrupted upload's response.
+type resumableResponse struct {
+	ResumeToken   string `json:"resume_token"`
+	ReceivedBytes int64  `json:"received_bytes"`
+	PrefixSHA256  string `json:"prefix_sha256"`
+}
+
+// interruptedUpload starts a multipart upload of data as videoID's video,
+// sends only the first sent bytes of the file and then hangs up, the way
+// a phone losing signal would.
+func (env *testEnv) interruptedUpload(t *testing.T, token, videoID string, data []byte, sent int) resumableResponse {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partStart := body.Len()
+	part.Write(data)
+	mw.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(env.server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /api/video_upload/%s HTTP/1.1\r\nHost: unit\r\nAuthorization: Bearer %s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n",
+		videoID, token, mw.FormDataContentType(), body.Len())
+	conn.Write(body.Bytes()[:partStart+sent])
+	// Half-close so the server sees the body end early but can still answer
+	conn.(*net.TCPConn).CloseWrite()
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("interrupted upload: got %d, want 400", resp.StatusCode)
+	}
+	var resumable resumableResponse
+	if err := json.NewDecoder(resp.Body).Decode(&resumable); err != nil {
+		t.Fatal(err)
+	}
+	if resumable.ResumeToken == "" || resumable.ReceivedBytes <= 0 || resumable.ReceivedBytes > int64(sent) {
+		t.Fatalf("interrupted upload: got %+v after sending %d bytes", resumable, sent)
+	}
+	return resumable
+}
+
+// resume sends data[start:end] as a continuation of an interrupted upload.
+func (env *testEnv) resume(t *testing.T, token, videoID, uploadToken string, data []byte, start, end int, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	headers = append([]string{
+		"Upload-Token", uploadToken,
+		"Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)),
+	}, headers...)
+	return env.do(t, http.MethodPost, "/api/video_upload/"+videoID+"/resume", token, "application/octet-stream", bytes.NewReader(data[start:end]), headers...)
+}
+
+func testVideoBytes(n int) []byte {
+	data := append([]byte("\x00\x00\x00\x10ftypisom\x00\x00\x02\x00"), bytes.Repeat([]byte("tubely"), n/6)...)
+	return data[:n]
+}
+
+func TestPartialUploadResume(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Flaky signal")
+	data := testVideoBytes(256 << 10)
+
+	partial := env.interruptedUpload(t, token, video.ID, data, 100<<10)
+	received := int(partial.ReceivedBytes)
+	prefix := sha256.Sum256(data[:received])
+	if partial.PrefixSHA256 != hex.EncodeToString(prefix[:]) {
+		t.Errorf("prefix_sha256 = %s, want the SHA-256 of the first %d bytes", partial.PrefixSHA256, received)
+	}
+
+	// A client that missed the response can still find the token
+	var status resumableResponse
+	env.doJSON(t, http.MethodGet, "/api/video_upload/"+video.ID+"/resume", token, nil, http.StatusOK, &status)
+	if status.ResumeToken != partial.ResumeToken || status.ReceivedBytes != partial.ReceivedBytes {
+		t.Errorf("resume status = %+v, want %+v", status, partial)
+	}
+
+	// Continuing from the wrong offset is refused with the right one
+	resp, body := env.resume(t, token, video.ID, partial.ResumeToken, data, received+1, len(data))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("wrong offset: got %d, want 409: %s", resp.StatusCode, body)
+	}
+	var conflict resumableResponse
+	if err := json.Unmarshal(body, &conflict); err != nil || conflict.ReceivedBytes != partial.ReceivedBytes {
+		t.Errorf("wrong offset: body %s, want received_bytes %d", body, received)
+	}
+
+	// A middle chunk, then the rest
+	middle := received + 50<<10
+	resp, body = env.resume(t, token, video.ID, partial.ResumeToken, data, received, middle, "Upload-Prefix-SHA256", partial.PrefixSHA256)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("middle chunk: got %d, want 202: %s", resp.StatusCode, body)
+	}
+	resp, body = env.resume(t, token, video.ID, partial.ResumeToken, data, middle, len(data))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("last chunk: got %d, want 202: %s", resp.StatusCode, body)
+	}
+	if status := env.waitForProcessing(t, token, video.ID); status.ProcessingError != nil {
+		t.Fatalf("processing failed: %s", *status.ProcessingError)
+	}
+
+	stored, err := env.cfg.db.GetVideo(mustParseUUID(t, video.ID), false)
+	if err != nil || stored.VideoURL == nil {
+		t.Fatalf("video wasn't stored: %v", err)
+	}
+	key := strings.TrimPrefix(*stored.VideoURL, "https://"+testCDN+"/")
+	obj, ok := env.s3.Object(testBucket, key)
+	if !ok {
+		t.Fatalf("no object at %s", key)
+	}
+	if !bytes.Equal(obj.Data, data) {
+		t.Errorf("stored %d bytes, want the %d uploaded", len(obj.Data), len(data))
+	}
+
+	// Completed uploads can't be resumed again
+	resp, body = env.resume(t, token, video.ID, partial.ResumeToken, data, len(data)-1, len(data))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("resuming a finished upload: got %d, want 404: %s", resp.StatusCode, body)
+	}
+}
+
+func TestPartialUploadPrefixMismatch(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Different file")
+	data := testVideoBytes(128 << 10)
+
+	partial := env.interruptedUpload(t, token, video.ID, data, 64<<10)
+	other := sha256.Sum256([]byte("some other file"))
+	resp, body := env.resume(t, token, video.ID, partial.ResumeToken, data, int(partial.ReceivedBytes), len(data),
+		"Upload-Prefix-SHA256", hex.EncodeToString(other[:]))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("got %d, want 409: %s", resp.StatusCode, body)
+	}
+
+	// The mismatched prefix is thrown away
+	resp, body = env.do(t, http.MethodGet, "/api/video_upload/"+video.ID+"/resume", token, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("resume status after a mismatch: got %d, want 404: %s", resp.StatusCode, body)
+	}
+}
+
+func TestPartialUploadPrune(t *testing.T) {
+	env := newTestEnv(t)
+	userID, token := env.createUser(t)
+	video := env.createVideo(t, token, "Abandoned")
+
+	env.interruptedUpload(t, token, video.ID, testVideoBytes(128<<10), 64<<10)
+	partial := env.cfg.partialUploads.latest(mustParseUUID(t, video.ID), userID)
+	if partial == nil {
+		t.Fatal("no partial upload was kept")
+	}
+
+	if n, _ := env.cfg.partialUploads.prune(time.Now().Add(-time.Minute)); n != 0 {
+		t.Errorf("pruned %d fresh uploads, want 0", n)
+	}
+	if n, _ := env.cfg.partialUploads.prune(time.Now().Add(time.Minute)); n != 1 {
+		t.Errorf("pruned %d expired uploads, want 1", n)
+	}
+	if _, err := os.Stat(partial.path); !os.IsNotExist(err) {
+		t.Errorf("temp file of a pruned upload still exists: %v", err)
+	}
+}
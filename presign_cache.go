@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// defaultPresignCacheSize bounds how many presigned URLs are kept; past
+// it the least recently used go first.
+const defaultPresignCacheSize = 10000
+
+// presignRefreshFraction is how much of a cached URL's lifetime must be
+// left for it to be handed out again; past that it is re-signed, so no
+// client gets a URL about to expire.
+const presignRefreshFraction = 0.2
+
+// presignCacheKey identifies a presigned URL: the object, and the lifetime
+// it was asked for, since a URL signed for an hour mustn't answer a
+// request for one valid a minute.
+type presignCacheKey struct {
+	object string
+	expiry time.Duration
+}
+
+type presignCacheEntry struct {
+	key       presignCacheKey
+	url       string
+	expiresAt time.Time
+}
+
+// presignCache keeps presigned URLs so listing a page of videos doesn't
+// sign each of them again on every request. A nil cache stores nothing.
+type presignCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[presignCacheKey]*list.Element
+	// lru holds *presignCacheEntry, most recently used first
+	lru *list.List
+	now func() time.Time
+}
+
+func newPresignCache(size int) *presignCache {
+	return &presignCache{
+		size:    size,
+		entries: map[presignCacheKey]*list.Element{},
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// presignObjectKey names key in store for the cache: S3 objects by bucket
+// and key, since one S3 storage serves several buckets.
+func presignObjectKey(store storage.Storage, key string) string {
+	if s3Store, ok := store.(*storage.S3); ok {
+		return strings.Join([]string{store.Name(), s3Store.Bucket, key}, ",")
+	}
+	return store.Name() + "," + key
+}
+
+// get returns the URL cached for object and expiry, and how long it is
+// still valid, if more than presignRefreshFraction of its lifetime is left.
+func (c *presignCache) get(object string, expiry time.Duration) (string, time.Duration, bool) {
+	if c == nil {
+		return "", 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := presignCacheKey{object, expiry}
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", 0, false
+	}
+	entry := elem.Value.(*presignCacheEntry)
+	left := entry.expiresAt.Sub(c.now())
+	if float64(left) <= float64(expiry)*presignRefreshFraction {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return "", 0, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.url, left, true
+}
+
+// put caches url, signed just now for object to be valid for expiry.
+func (c *presignCache) put(object string, expiry time.Duration, url string) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := presignCacheKey{object, expiry}
+	entry := &presignCacheEntry{key: key, url: url, expiresAt: c.now().Add(expiry)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*presignCacheEntry).key)
+	}
+}
+
+// len reports how many URLs are cached.
+func (c *presignCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// fakeClock is a settable clock for presignCache.now.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// countingPresigner counts the URLs its storage signs, numbering each so
+// a re-signed URL differs from the one before.
+type countingPresigner struct {
+	storage.Storage
+	signed atomic.Int64
+}
+
+func (s *countingPresigner) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	n := s.signed.Add(1)
+	return fmt.Sprintf("https://signed.test/%s?expires=%d&n=%d", key, int(expires.Seconds()), n), nil
+}
+
+func TestPresignCacheRefresh(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	cache := newPresignCache(10)
+	cache.now = clock.now
+
+	if _, _, ok := cache.get("s3,bucket,a", time.Hour); ok {
+		t.Fatal("empty cache hit")
+	}
+	cache.put("s3,bucket,a", time.Hour, "url-a")
+
+	clock.advance(30 * time.Minute)
+	url, left, ok := cache.get("s3,bucket,a", time.Hour)
+	if !ok || url != "url-a" || left != 30*time.Minute {
+		t.Errorf("after 30m: get = %q, %v, %v; want url-a with 30m left", url, left, ok)
+	}
+	if _, _, ok := cache.get("s3,bucket,a", time.Minute); ok {
+		t.Error("a URL signed for an hour answered a request for a minute")
+	}
+	if _, _, ok := cache.get("s3,other,a", time.Hour); ok {
+		t.Error("an object in another bucket hit")
+	}
+
+	// Down to a fifth of its lifetime, the URL is signed again
+	clock.advance(17 * time.Minute)
+	if _, _, ok := cache.get("s3,bucket,a", time.Hour); !ok {
+		t.Error("URL with 13m of 1h left wasn't reused")
+	}
+	clock.advance(2 * time.Minute)
+	if _, _, ok := cache.get("s3,bucket,a", time.Hour); ok {
+		t.Error("URL with 11m of 1h left was reused")
+	}
+	if n := cache.len(); n != 0 {
+		t.Errorf("%d entries left after the refresh, want the stale one dropped", n)
+	}
+}
+
+func TestPresignCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newPresignCache(2)
+	cache.put("a", time.Hour, "url-a")
+	cache.put("b", time.Hour, "url-b")
+	cache.get("a", time.Hour)
+	cache.put("c", time.Hour, "url-c")
+
+	if _, _, ok := cache.get("b", time.Hour); ok {
+		t.Error("b was kept over the more recently used a")
+	}
+	for _, object := range []string{"a", "c"} {
+		if _, _, ok := cache.get(object, time.Hour); !ok {
+			t.Errorf("%s was evicted", object)
+		}
+	}
+	if n := cache.len(); n != 2 {
+		t.Errorf("cache holds %d URLs, want its size of 2", n)
+	}
+}
+
+func TestPresignObjectCached(t *testing.T) {
+	env := newTestEnv(t)
+	clock := &fakeClock{t: time.Now()}
+	env.cfg.presignCache.now = clock.now
+	store := &countingPresigner{Storage: env.cfg.localStorage}
+	ctx := context.Background()
+
+	first, left, err := env.cfg.presignObject(ctx, store, "video.mp4", time.Hour)
+	if err != nil || left != time.Hour {
+		t.Fatalf("presignObject = %q, %v, %v", first, left, err)
+	}
+	clock.advance(10 * time.Minute)
+	again, left, err := env.cfg.presignObject(ctx, store, "video.mp4", time.Hour)
+	if err != nil || again != first || left != 50*time.Minute {
+		t.Errorf("second presignObject = %q, %v, %v; want the first URL with 50m left", again, left, err)
+	}
+	if n := store.signed.Load(); n != 1 {
+		t.Errorf("signed %d times, want once", n)
+	}
+
+	clock.advance(45 * time.Minute)
+	refreshed, left, err := env.cfg.presignObject(ctx, store, "video.mp4", time.Hour)
+	if err != nil || refreshed == first || left != time.Hour {
+		t.Errorf("presignObject near expiry = %q, %v, %v; want a new URL valid for 1h", refreshed, left, err)
+	}
+	if n := store.signed.Load(); n != 2 {
+		t.Errorf("signed %d times, want twice", n)
+	}
+}
+
+func TestPresignObjectConcurrent(t *testing.T) {
+	env := newTestEnv(t)
+	// Smaller than the number of objects, so evictions race with reads
+	env.cfg.presignCache = newPresignCache(4)
+	store := &countingPresigner{Storage: env.cfg.localStorage}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("video-%d.mp4", (i+j)%8)
+				signed, _, err := env.cfg.presignObject(context.Background(), store, key, time.Hour)
+				if err != nil || signed == "" {
+					t.Errorf("presignObject(%s) = %q, %v", key, signed, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := env.cfg.presignCache.len(); n > 4 {
+		t.Errorf("cache grew to %d URLs past its size of 4", n)
+	}
+}
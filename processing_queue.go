@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// errProcessingQueueFull is returned when every worker is busy and the
+// backlog is at capacity.
+var errProcessingQueueFull = errors.New("processing queue is full")
+
+// videoJob is a received upload waiting to be processed. The job owns
+// upload.file; done releases it once processing has finished, whatever
+// the outcome.
+type videoJob struct {
+	video  database.Video
+	upload videoUpload
+	done   func()
+	// requestID is the ID of the upload request, so processing logs can
+	// be tied back to it
+	requestID string
+}
+
+// processingQueue runs uploaded videos through ingestVideo on a fixed pool
+// of workers, so upload requests return as soon as the bytes have arrived.
+type processingQueue struct {
+	jobs chan videoJob
+
+	mu     sync.Mutex
+	closed bool
+
+	workers sync.WaitGroup
+	// ctx is cancelled when a drain gives up waiting, to abort jobs in
+	// flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newProcessingQueue(backlog int) *processingQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &processingQueue{jobs: make(chan videoJob, backlog), ctx: ctx, cancel: cancel}
+}
+
+// start launches n workers that hand each job to process.
+func (q *processingQueue) start(n int, process func(context.Context, videoJob)) {
+	for range n {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for job := range q.jobs {
+				process(q.ctx, job)
+			}
+		}()
+	}
+}
+
+// enqueue adds job without blocking. It fails when the backlog is full or
+// the queue is draining, in which case the caller still owns the job.
+func (q *processingQueue) enqueue(job videoJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errProcessingQueueFull
+	}
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return errProcessingQueueFull
+	}
+}
+
+// pending returns how many jobs are waiting for a worker.
+func (q *processingQueue) pending() int {
+	return len(q.jobs)
+}
+
+// drain stops accepting jobs and waits for the queued and running ones to
+// finish. If ctx expires first, running jobs are cancelled at their next
+// cancellable stage and marked failed, and so is whatever was still queued.
+func (q *processingQueue) drain(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-finished
+		return ctx.Err()
+	}
+}
+
+// queueVideoProcessing checks that upload looks like an MP4 within the
+// media limits, marks video pending and hands the upload to the workers. On success the queue owns
+// upload.file and calls done when it is finished with it; on failure the
+// caller keeps it. Failures are returned as *statusError, except for
+// errProcessingQueueFull.
+func (cfg *apiConfig) queueVideoProcessing(ctx context.Context, video *database.Video, upload videoUpload, done func()) error {
+	// Reject obvious non-videos now rather than after the client has gone
+	if err := checkFtypBox(upload.file); err != nil {
+		if errors.Is(err, errNotMP4) {
+			return &statusError{status: http.StatusBadRequest, msg: "Uploaded file isn't an MP4 video", code: errorCodeInvalidMediaType, err: err}
+		}
+		return &statusError{status: http.StatusInternalServerError, msg: "Failed to read temp file", err: err}
+	}
+	// Probing is cheap next to faststart, so limits are enforced up front
+	probeUpload(ctx, &upload)
+	if err := cfg.checkMediaLimits(upload.probe, upload.probeErr); err != nil {
+		return err
+	}
+
+	// Pending has to be recorded before a worker can pick the job up
+	previousStatus, previousError := video.ProcessingStatus, video.ProcessingError
+	pending := database.ProcessingStatusPending
+	if err := cfg.db.SetVideoProcessingStatus(video.ID, &pending, nil); err != nil {
+		return &statusError{status: http.StatusInternalServerError, msg: "Couldn't queue video for processing", err: err}
+	}
+	video.ProcessingStatus = &pending
+	video.ProcessingError = nil
+	video.Version++
+
+	cfg.uploadProgress.stage(video.ID, progressQueued)
+	err := cfg.processingQueue.enqueue(videoJob{video: *video, upload: upload, done: done, requestID: requestIDFrom(ctx)})
+	if err != nil {
+		if err := cfg.db.SetVideoProcessingStatus(video.ID, previousStatus, previousError); err != nil {
+			log.Printf("couldn't restore processing status of video %s: %v", video.ID, err)
+		}
+		video.ProcessingStatus, video.ProcessingError = previousStatus, previousError
+		video.Version++
+		return err
+	}
+	return nil
+}
+
+// processVideoJob is the workers' job handler. Outcomes are recorded on the
+// row and in the upload progress; there is no client waiting for them.
+func (cfg *apiConfig) processVideoJob(ctx context.Context, job videoJob) {
+	defer job.done()
+
+	ctx = withRequestID(ctx, job.requestID)
+	video := job.video
+	if ctx.Err() != nil {
+		cfg.failVideoProcessing(ctx, video, &statusError{status: http.StatusServiceUnavailable, msg: "Server shut down before processing started", err: ctx.Err()})
+		return
+	}
+	if _, err := cfg.ingestVideo(ctx, &video, job.upload); err != nil {
+		cfg.failVideoProcessing(ctx, video, err)
+		return
+	}
+	cfg.uploadProgress.stage(video.ID, progressDone)
+	cfg.notifyVideoProcessed(ctx, video, database.ProcessingStatusReady)
+}
+
+// failVideoProcessing marks video's latest upload failed, with the message
+// a synchronous upload would have responded with.
+func (cfg *apiConfig) failVideoProcessing(ctx context.Context, video database.Video, err error) {
+	cfg.uploadProgress.stage(video.ID, progressFailed)
+
+	status, msg := http.StatusInternalServerError, "Failed to process video"
+	var se *statusError
+	if errors.As(err, &se) {
+		status, msg = se.status, se.msg
+	}
+	logError(requestLogger(ctx), status, "Video processing failed", err)
+	failed := database.ProcessingStatusFailed
+	if err := cfg.db.SetVideoProcessingStatus(video.ID, &failed, &msg); err != nil {
+		log.Printf("couldn't mark video %s failed: %v", video.ID, err)
+	}
+	cfg.notifyVideoProcessed(ctx, video, database.ProcessingStatusFailed)
+}
+
+// respondWithQueueError reports a failure from queueVideoProcessing.
+func respondWithQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errProcessingQueueFull) {
+		respondWithSaturated(w, admissionQueueFull)
+		return
+	}
+	respondWithStatusError(w, err)
+}
+
+// respondWithAccepted answers an upload that was queued for processing,
+// pointing the client at the status to poll.
+func (cfg *apiConfig) respondWithAccepted(w http.ResponseWriter, r *http.Request, video database.Video) {
+	w.Header().Set("Location", "/api/videos/"+video.ID.String()+"/status")
+	cfg.signThumbnailURLs(r.Context(), &video)
+	respondWithJSON(w, http.StatusAccepted, newOwnerVideoResponse(video))
+}
+
+// videoStatusResponse is what clients poll while an upload is processed.
+// Stage is the upload progress stage while the server still tracks it.
+// ProcessingWarnings are those of the latest upload once it's ready, since
+// the upload response no longer carries them.
+type videoStatusResponse struct {
+	VideoID            string   `json:"video_id"`
+	ProcessingStatus   *string  `json:"processing_status"`
+	ProcessingError    *string  `json:"processing_error"`
+	ProcessingWarnings []string `json:"processing_warnings"`
+	Stage              *string  `json:"stage"`
+}
+
+func (cfg *apiConfig) handlerVideoStatus(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromPath(w, r)
+	if !ok {
+		return
+	}
+	resp := videoStatusResponse{
+		VideoID:            video.ID.String(),
+		ProcessingStatus:   video.ProcessingStatus,
+		ProcessingError:    video.ProcessingError,
+		ProcessingWarnings: []string{},
+	}
+	// While an upload is pending or failed, the row's warnings are the
+	// previous upload's
+	if video.ProcessingStatus == nil || *video.ProcessingStatus == database.ProcessingStatusReady {
+		resp.ProcessingWarnings = append(resp.ProcessingWarnings, video.ProcessingWarnings...)
+	}
+	if p, ok := cfg.uploadProgress.get(video.ID); ok {
+		resp.Stage = &p.Stage
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Processing run triggers.
+const (
+	processingTriggerUpload  = "upload"
+	processingTriggerReplace = "replace"
+)
+
+// processingRecorder writes a processing run as the pipeline progresses.
+// Recording is best effort: database failures are logged and never fail
+// the upload itself.
+type processingRecorder struct {
+	cfg *apiConfig
+
+	mu  sync.Mutex
+	run database.ProcessingRun
+}
+
+func (cfg *apiConfig) startProcessingRun(videoID uuid.UUID, trigger string, inputSize int64) *processingRecorder {
+	p := &processingRecorder{
+		cfg: cfg,
+		run: database.ProcessingRun{
+			ID:        uuid.New(),
+			VideoID:   videoID,
+			Trigger:   trigger,
+			Status:    database.ProcessingRunRunning,
+			StartedAt: time.Now().UTC(),
+			InputSize: &inputSize,
+		},
+	}
+	if v := ffmpegVersion(); v != "" {
+		p.run.FFmpegVersion = &v
+	}
+	if err := cfg.db.CreateProcessingRun(p.run); err != nil {
+		log.Printf("couldn't record processing run for video %s: %v", videoID, err)
+	}
+	return p
+}
+
+// stage records a finished stage that began at start. It is safe to call
+// from concurrently running stages.
+func (p *processingRecorder) stage(name string, start time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stage := database.ProcessingStage{Name: name, DurationMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		stage.Error = err.Error()
+	}
+	p.run.Stages = append(p.run.Stages, stage)
+	p.save()
+}
+
+// succeed marks the run successful; finish then records it as such.
+func (p *processingRecorder) succeed(outputSize int64, warnings []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.run.Status = database.ProcessingRunSucceeded
+	p.run.OutputSize = &outputSize
+	p.run.Warnings = warnings
+}
+
+// succeedPartial marks the run as stored with a stage skipped.
+func (p *processingRecorder) succeedPartial(outputSize int64, warnings []string) {
+	p.succeed(outputSize, warnings)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.run.Status = database.ProcessingRunPartial
+}
+
+// finish closes the run; runs that never reached succeed are failed, with
+// the last stage error as the reason.
+func (p *processingRecorder) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now().UTC()
+	p.run.FinishedAt = &now
+	if p.run.Status == database.ProcessingRunRunning {
+		p.run.Status = database.ProcessingRunFailed
+		reason := "aborted"
+		for _, stage := range p.run.Stages {
+			if stage.Error != "" {
+				reason = stage.Error
+			}
+		}
+		p.run.Error = &reason
+	}
+	p.save()
+}
+
+func (p *processingRecorder) save() {
+	if err := p.cfg.db.UpdateProcessingRun(p.run); err != nil {
+		log.Printf("couldn't update processing run %s: %v", p.run.ID, err)
+	}
+}
+
+var (
+	ffmpegVersionOnce  sync.Once
+	ffmpegVersionValue string
+)
+
+// ffmpegVersion returns the first line of `ffmpeg -version`, or "" when it
+// can't be run.
+func ffmpegVersion() string {
+	ffmpegVersionOnce.Do(func() {
+		var out bytes.Buffer
+		cmd := exec.Command("ffmpeg", "-version")
+		cmd.Stdout = &out
+		if err := cmd.Run(); err != nil {
+			return
+		}
+		line, _, _ := strings.Cut(out.String(), "\n")
+		ffmpegVersionValue = strings.TrimSpace(line)
+	})
+	return ffmpegVersionValue
+}
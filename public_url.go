@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseBaseURL validates BASE_URL: an http or https URL with a host and
+// at most a path prefix, returned without its trailing slash.
+func parseBaseURL(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", errors.New("BASE_URL must be an http or https URL such as https://tubely.example.com")
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+type baseURLKey struct{}
+
+// baseURLMiddleware records the URL clients reach the server at in each
+// request's context, for expanding the relative asset paths rows store.
+func (cfg *apiConfig) baseURLMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), baseURLKey{}, cfg.requestBaseURL(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestBaseURL returns BASE_URL when it is set. Otherwise the scheme
+// and host come from r, or from X-Forwarded-Proto and X-Forwarded-Host
+// when TRUST_PROXY says a proxy in front of us sets them; untrusted, a
+// client could point other users' URLs anywhere.
+func (cfg *apiConfig) requestBaseURL(r *http.Request) string {
+	if cfg.baseURL != "" {
+		return cfg.baseURL
+	}
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if cfg.trustProxy {
+		if proto := firstForwardedValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := firstForwardedValue(r.Header.Get("X-Forwarded-Host")); validForwardedHost(fwdHost) {
+			host = fwdHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// firstForwardedValue returns the value the outermost proxy set in a
+// header that each proxy on the way may append to.
+func firstForwardedValue(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.ToLower(strings.TrimSpace(first))
+}
+
+// validForwardedHost accepts a host with an optional port and nothing
+// that could turn it into a different URL.
+func validForwardedHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/\\@?# ") {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h != ""
+	}
+	return true
+}
+
+// absoluteURL expands u against ctx's base URL if it is a path, as asset
+// URLs are stored. Absolute URLs, and paths outside a request, are
+// returned unchanged.
+func absoluteURL(ctx context.Context, u string) string {
+	base, _ := ctx.Value(baseURLKey{}).(string)
+	if base == "" || !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") {
+		return u
+	}
+	return base + u
+}
+
+// publicAssetURL returns the URL clients fetch a stored asset URL from.
+// Rows written before asset URLs were stored relative hold
+// http://localhost:<port>/assets/... URLs, which are served from the base
+// URL like the rest.
+func (cfg *apiConfig) publicAssetURL(ctx context.Context, storedURL string) string {
+	if rel, ok := cfg.relativeAssetURL(storedURL); ok {
+		storedURL = rel
+	}
+	return absoluteURL(ctx, storedURL)
+}
+
+// relativeAssetURL returns the path of an absolute localhost URL for an
+// asset under assetsRoot, as assetURL once built them.
+func (cfg *apiConfig) relativeAssetURL(storedURL string) (string, bool) {
+	u, err := url.Parse(storedURL)
+	if err != nil || !u.IsAbs() {
+		return "", false
+	}
+	if host := u.Hostname(); host != "localhost" && host != "127.0.0.1" {
+		return "", false
+	}
+	if _, ok := cfg.localAssetName(storedURL); !ok {
+		return "", false
+	}
+	return u.EscapedPath(), true
+}
+
+// handlerNormalizeAssetURLs rewrites thumbnail URLs stored as absolute
+// localhost URLs to the relative paths rows hold now. Responses already
+// serve both, so it only tidies the data; a video whose row changed
+// meanwhile is left for the next run.
+func (cfg *apiConfig) handlerNormalizeAssetURLs(w http.ResponseWriter, r *http.Request) {
+	type failure struct {
+		VideoID string `json:"video_id"`
+		Error   string `json:"error"`
+	}
+	type response struct {
+		Checked    int       `json:"checked"`
+		Normalized int       `json:"normalized"`
+		Skipped    int       `json:"skipped"`
+		Failed     []failure `json:"failed"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	videos, err := cfg.db.GetVideosWithThumbnails()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{Failed: []failure{}}
+	for _, video := range videos {
+		resp.Checked++
+		changed := 0
+		for _, field := range []**string{&video.ThumbnailURL, &video.ThumbnailGridURL, &video.ThumbnailModernURL} {
+			if presentURL(*field) == nil {
+				continue
+			}
+			if rel, ok := cfg.relativeAssetURL(**field); ok {
+				*field = &rel
+				changed++
+			}
+		}
+		if changed == 0 {
+			continue
+		}
+		updated, err := cfg.db.UpdateVideoIfVersion(video, video.Version)
+		switch {
+		case err != nil:
+			resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: "couldn't update video: " + err.Error()})
+		case !updated:
+			resp.Skipped++
+		default:
+			resp.Normalized += changed
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// defaultOrphanMinAge is how old an unreferenced object must be before
+// reconciliation deletes it, unless ?min_age= changes it. Processing
+// stores a video's objects before its row refers to them, so anything
+// younger may belong to an upload still in flight.
+const defaultOrphanMinAge = 24 * time.Hour
+
+// minOrphanMinAge is the shortest ?min_age= accepted.
+const minOrphanMinAge = time.Hour
+
+// videoKeyPrefixes are where processed videos and their renditions are
+// stored, by aspect ratio.
+var videoKeyPrefixes = []string{"landscape/", "portrait/", "other/"}
+
+// reconcileScope is a store and the key prefixes in it that tubely
+// manages. Anything else in the bucket is left alone.
+type reconcileScope struct {
+	name     string
+	store    storage.Storage
+	prefixes []string
+}
+
+// reconcileScopes returns what reconciliation lists: the video prefixes of
+// the current backend, public ones included, and, in S3, direct uploads,
+// the artifacts bucket's renditions and HLS sets, and the thumbnail
+// bucket's thumbnails. Buckets shared between them are listed once.
+func (cfg *apiConfig) reconcileScopes() []reconcileScope {
+	prefixes := append(append([]string{}, videoKeyPrefixes...), publicKeyPrefix)
+	if cfg.videoStorage.Name() != storageBackendS3 {
+		return []reconcileScope{{name: storageLabel(cfg.localStorage), store: cfg.localStorage, prefixes: prefixes}}
+	}
+
+	var scopes []reconcileScope
+	add := func(store *storage.S3, prefixes ...string) {
+		for i := range scopes {
+			if scopes[i].name != store.Bucket {
+				continue
+			}
+			for _, prefix := range prefixes {
+				if !slices.Contains(scopes[i].prefixes, prefix) {
+					scopes[i].prefixes = append(scopes[i].prefixes, prefix)
+				}
+			}
+			return
+		}
+		scopes = append(scopes, reconcileScope{name: store.Bucket, store: store, prefixes: prefixes})
+	}
+	// HLS sets stored before the artifacts bucket was split off stay in s3Bucket
+	add(cfg.s3Storage, slices.Concat(prefixes, []string{"hls/", "direct/"})...)
+	add(cfg.s3Storage.WithBucket(cfg.s3ArtifactsBucket), slices.Concat(prefixes, []string{"hls/"})...)
+	add(cfg.thumbnailStore(), thumbnailKeyPrefix)
+	return scopes
+}
+
+// covers reports whether key is listed by s.
+func (s reconcileScope) covers(storageName, key string) bool {
+	if storageName != s.name {
+		return false
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// storageLabel names where a store keeps objects in reports: its bucket
+// for S3, and the backend otherwise.
+func storageLabel(store storage.Storage) string {
+	if s3Store, ok := store.(*storage.S3); ok {
+		return s3Store.Bucket
+	}
+	return store.Name()
+}
+
+// objectLocation identifies an object, or with a trailing slash a set of
+// them, across stores.
+type objectLocation struct {
+	storage string
+	key     string
+}
+
+type orphanObject struct {
+	Storage      string    `json:"storage"`
+	Key          string    `json:"key"`
+	SizeBytes    int64     `json:"size_bytes"`
+	LastModified time.Time `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+}
+
+type danglingReference struct {
+	VideoID string `json:"video_id"`
+	Field   string `json:"field"`
+	Storage string `json:"storage"`
+	Key     string `json:"key"`
+}
+
+// staleMetadata is a stored video whose Content-Type doesn't match its
+// row's.
+type staleMetadata struct {
+	VideoID     string `json:"video_id"`
+	Field       string `json:"field"`
+	Storage     string `json:"storage"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Fixed       bool   `json:"fixed"`
+}
+
+type reconcileFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// reconcileReport is what reconciliation found. Protected objects are
+// unreferenced but belong to uploads still in progress.
+type reconcileReport struct {
+	Listed      int                 `json:"listed"`
+	Referenced  int                 `json:"referenced"`
+	Protected   int                 `json:"protected"`
+	Orphans     []orphanObject      `json:"orphans"`
+	OrphanBytes int64               `json:"orphan_bytes"`
+	Dangling    []danglingReference `json:"dangling"`
+	Deleted     int                 `json:"deleted"`
+	Failed      []reconcileFailure  `json:"failed"`
+	// StaleMetadata is only checked with ?fix_metadata=true
+	StaleMetadata []staleMetadata `json:"stale_metadata,omitempty"`
+	MetadataFixed int             `json:"metadata_fixed"`
+}
+
+// storageReferences is every object the database refers to, with who
+// refers to it, and what mustn't be deleted while uploads are in flight.
+type storageReferences struct {
+	objects map[objectLocation][]danglingReference
+	// hlsSets are referenced by playlist, which implies the whole prefix
+	hlsSets map[objectLocation][]danglingReference
+	// directKeys are handed out for browser uploads not yet completed
+	directKeys map[string]bool
+	// pendingVideos are processing, so their HLS and direct prefixes may
+	// be written at any moment
+	pendingVideos map[string]bool
+}
+
+// loadStorageReferences reads every video row and uncompleted direct
+// upload.
+func (cfg *apiConfig) loadStorageReferences() (storageReferences, error) {
+	refs := storageReferences{
+		objects:       map[objectLocation][]danglingReference{},
+		hlsSets:       map[objectLocation][]danglingReference{},
+		directKeys:    map[string]bool{},
+		pendingVideos: map[string]bool{},
+	}
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return refs, fmt.Errorf("couldn't retrieve videos: %w", err)
+	}
+	keys, err := cfg.db.GetDirectUploadKeys()
+	if err != nil {
+		return refs, fmt.Errorf("couldn't retrieve direct uploads: %w", err)
+	}
+	for _, key := range keys {
+		refs.directKeys[key] = true
+	}
+	for _, video := range videos {
+		refs.add(cfg, video)
+	}
+	return refs, nil
+}
+
+func (refs storageReferences) add(cfg *apiConfig, video database.Video) {
+	if video.ProcessingStatus != nil && *video.ProcessingStatus == database.ProcessingStatusPending {
+		refs.pendingVideos[video.ID.String()] = true
+	}
+	ref := func(field, storedURL string) {
+		store, key, ok := cfg.videoObject(storedURL)
+		if !ok {
+			return
+		}
+		loc := objectLocation{storage: storageLabel(store), key: key}
+		refs.objects[loc] = append(refs.objects[loc], danglingReference{VideoID: video.ID.String(), Field: field, Storage: loc.storage, Key: key})
+	}
+	if presentURL(video.VideoURL) != nil {
+		ref("video_url", *video.VideoURL)
+	}
+	for label, u := range video.Renditions {
+		ref("renditions."+label, u)
+	}
+	if presentURL(video.HLSURL) != nil {
+		if bucket, prefix, ok := cfg.hlsPrefix(*video.HLSURL); ok {
+			loc := objectLocation{storage: bucket, key: prefix}
+			refs.hlsSets[loc] = append(refs.hlsSets[loc], danglingReference{VideoID: video.ID.String(), Field: "hls_url", Storage: bucket, Key: prefix})
+		}
+	}
+	thumbnails := map[string]*string{
+		"thumbnail_url":        video.ThumbnailURL,
+		"thumbnail_grid_url":   video.ThumbnailGridURL,
+		"thumbnail_modern_url": video.ThumbnailModernURL,
+	}
+	for field, u := range thumbnails {
+		if presentURL(u) == nil {
+			continue
+		}
+		if store, key, ok := cfg.thumbnailObject(*u); ok {
+			loc := objectLocation{storage: store.Bucket, key: key}
+			refs.objects[loc] = append(refs.objects[loc], danglingReference{VideoID: video.ID.String(), Field: field, Storage: store.Bucket, Key: key})
+		}
+	}
+}
+
+// protected reports whether an unreferenced key belongs to an upload in
+// progress: a direct upload's key, or a pending video's HLS or direct
+// prefix, which are named hls/<videoID>/ and direct/<videoID>/, the
+// latter under publicKeyPrefix too.
+func (refs storageReferences) protected(key string) bool {
+	if refs.directKeys[key] {
+		return true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, publicKeyPrefix), "/", 3)
+	return len(parts) == 3 && (parts[0] == "hls" || parts[0] == "direct") && refs.pendingVideos[parts[1]]
+}
+
+// reconcileStorage lists every object in reconcileScopes and compares them
+// with what the database refers to, reporting objects nothing refers to
+// and references to objects that are gone. With del set, orphans last
+// modified more than minAge before now are deleted.
+//
+// Content-addressed objects can be picked up again by an upload of the
+// same bytes, which reuses an existing object whatever its age, so each
+// is checked for references once more just before it is deleted.
+func (cfg *apiConfig) reconcileStorage(ctx context.Context, del bool, minAge time.Duration, now time.Time) (reconcileReport, error) {
+	report := reconcileReport{Orphans: []orphanObject{}, Dangling: []danglingReference{}, Failed: []reconcileFailure{}}
+	refs, err := cfg.loadStorageReferences()
+	if err != nil {
+		return report, err
+	}
+
+	scopes := cfg.reconcileScopes()
+	seen := map[objectLocation]bool{}
+	var orphanStores []storage.Storage
+	for _, scope := range scopes {
+		lister, ok := scope.store.(storage.Lister)
+		if !ok {
+			return report, fmt.Errorf("%s storage can't list its objects", scope.store.Name())
+		}
+		for _, prefix := range scope.prefixes {
+			err := timed(ctx, scope.store.Name()+"_list", func() error {
+				return lister.List(ctx, prefix, func(obj storage.ListedObject) error {
+					report.Listed++
+					loc := objectLocation{storage: scope.name, key: obj.Key}
+					set := objectLocation{storage: scope.name, key: path.Dir(obj.Key) + "/"}
+					switch {
+					case refs.objects[loc] != nil:
+						seen[loc] = true
+						report.Referenced++
+					case strings.HasPrefix(obj.Key, "hls/") && refs.hlsSets[set] != nil:
+						seen[set] = true
+						report.Referenced++
+					case refs.protected(obj.Key):
+						report.Protected++
+					default:
+						report.Orphans = append(report.Orphans, orphanObject{Storage: scope.name, Key: obj.Key, SizeBytes: obj.Size, LastModified: obj.LastModified.UTC()})
+						report.OrphanBytes += obj.Size
+						orphanStores = append(orphanStores, scope.store)
+					}
+					return nil
+				})
+			}, "storage", scope.name, "prefix", prefix)
+			if err != nil {
+				return report, fmt.Errorf("couldn't list %s in %s: %w", prefix, scope.name, err)
+			}
+		}
+	}
+
+	// Only what was listed can be known to be missing
+	for _, tracked := range []map[objectLocation][]danglingReference{refs.objects, refs.hlsSets} {
+		for loc, referrers := range tracked {
+			if seen[loc] {
+				continue
+			}
+			for _, scope := range scopes {
+				if scope.covers(loc.storage, loc.key) {
+					report.Dangling = append(report.Dangling, referrers...)
+					break
+				}
+			}
+		}
+	}
+
+	if !del {
+		return report, nil
+	}
+	cutoff := now.Add(-minAge)
+	for i := range report.Orphans {
+		orphan := &report.Orphans[i]
+		if !orphan.LastModified.Before(cutoff) || ctx.Err() != nil {
+			continue
+		}
+		if cfg.orphanReferenced(orphanStores[i], orphan.Key) {
+			continue
+		}
+		if err := orphanStores[i].Delete(ctx, orphan.Key); err != nil {
+			report.Failed = append(report.Failed, reconcileFailure{Key: orphan.Key, Error: err.Error()})
+			continue
+		}
+		orphan.Deleted = true
+		report.Deleted++
+	}
+	return report, nil
+}
+
+// orphanReferenced checks again whether a row refers to a
+// content-addressed object in store, as the URL it would be stored under
+// now.
+// HLS sets and direct uploads are never reused, so they aren't checked.
+func (cfg *apiConfig) orphanReferenced(store storage.Storage, key string) bool {
+	if strings.HasPrefix(key, thumbnailKeyPrefix) {
+		return cfg.referencedElsewhere(storageLabel(store)+","+key, uuid.Nil)
+	}
+	for _, prefix := range videoKeyPrefixes {
+		if strings.HasPrefix(strings.TrimPrefix(key, publicKeyPrefix), prefix) {
+			return cfg.referencedElsewhere(cfg.storedObjectURL(store, key), uuid.Nil)
+		}
+	}
+	return false
+}
+
+// reconcileMetadata heads every stored video and rendition and rewrites
+// the Content-Type and Content-Disposition of those whose Content-Type
+// doesn't match their row's. Objects uploaded before the type was
+// recorded, or imported, may be served as application/octet-stream.
+// Backends that don't keep headers with objects are skipped, and missing
+// objects are left to the listing to report as dangling.
+func (cfg *apiConfig) reconcileMetadata(ctx context.Context, report *reconcileReport) error {
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return fmt.Errorf("couldn't retrieve videos: %w", err)
+	}
+	for _, video := range videos {
+		contentType := "video/mp4"
+		if video.ContentType != nil && *video.ContentType != "" {
+			contentType = *video.ContentType
+		}
+		objects := map[string]string{}
+		if presentURL(video.VideoURL) != nil {
+			objects["video_url"] = *video.VideoURL
+		}
+		for label, u := range video.Renditions {
+			objects["renditions."+label] = u
+		}
+		for _, field := range slices.Sorted(maps.Keys(objects)) {
+			store, key, ok := cfg.videoObject(objects[field])
+			if !ok {
+				continue
+			}
+			replacer, ok := store.(storage.MetadataReplacer)
+			if !ok {
+				continue
+			}
+			// Renditions are always transcoded to MP4
+			want := contentType
+			if field != "video_url" {
+				want = "video/mp4"
+			}
+			info, err := store.Head(ctx, key)
+			if errors.Is(err, storage.ErrNotFound) || err == nil && info.ContentType == want {
+				continue
+			}
+			if err != nil {
+				report.Failed = append(report.Failed, reconcileFailure{Key: key, Error: err.Error()})
+				continue
+			}
+
+			stale := staleMetadata{VideoID: video.ID.String(), Field: field, Storage: storageLabel(store), Key: key, ContentType: info.ContentType}
+			meta := storage.ObjectMetadata{ContentType: want, ContentDisposition: contentDisposition("inline", downloadFilename(video.Title))}
+			err = timed(ctx, store.Name()+"_replace_metadata", func() error {
+				return replacer.ReplaceMetadata(ctx, key, meta)
+			}, "key", key)
+			if err != nil {
+				report.Failed = append(report.Failed, reconcileFailure{Key: key, Error: err.Error()})
+			} else {
+				stale.Fixed = true
+				report.MetadataFixed++
+			}
+			report.StaleMetadata = append(report.StaleMetadata, stale)
+		}
+	}
+	return nil
+}
+
+// handlerReconcileStorage reports objects in storage that no video refers
+// to and references to objects that no longer exist. With ?delete=true it
+// also deletes orphans older than ?min_age= (default 24h), and with
+// ?fix_metadata=true it corrects the headers of videos stored with the
+// wrong Content-Type.
+func (cfg *apiConfig) handlerReconcileStorage(w http.ResponseWriter, r *http.Request) {
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	del := r.URL.Query().Get("delete") == "true"
+	minAge := defaultOrphanMinAge
+	if v := r.URL.Query().Get("min_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minOrphanMinAge {
+			respondWithError(w, http.StatusBadRequest, "min_age must be a duration of at least 1h", err)
+			return
+		}
+		minAge = d
+	}
+
+	report, err := cfg.reconcileStorage(r.Context(), del, minAge, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reconcile storage", err)
+		return
+	}
+	if r.URL.Query().Get("fix_metadata") == "true" {
+		if err := cfg.reconcileMetadata(r.Context(), &report); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't reconcile object metadata", err)
+			return
+		}
+	}
+	log.Printf("storage reconciliation: %d listed, %d orphaned, %d dangling, %d deleted, %d metadata fixed", report.Listed, len(report.Orphans), len(report.Dangling), report.Deleted, report.MetadataFixed)
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+const testArtifactsBucket = "tubely-test-artifacts"
+
+func withArtifactsBucket(cfg *apiConfig) {
+	cfg.s3ArtifactsBucket = testArtifactsBucket
+}
+
+// storeArtifacts records a video with a source in the video bucket and a
+// rendition and HLS set in the artifacts bucket, all present in S3.
+func storeArtifacts(t *testing.T, env *testEnv, token string) videoResponse {
+	t.Helper()
+	video := env.createVideo(t, token, "artifacts")
+	old := time.Now().Add(-48 * time.Hour)
+	for bucket, keys := range map[string][]string{
+		testBucket:          {"landscape/abc.mp4"},
+		testArtifactsBucket: {"landscape/abc_720p.mp4", "hls/" + video.ID + "/set/index.m3u8", "hls/" + video.ID + "/set/seg0.ts"},
+	} {
+		for _, key := range keys {
+			env.s3.PutObject(bucket, key, storagetest.FakeObject{Data: []byte("#EXTM3U\nseg0.ts\n"), LastModified: old})
+		}
+	}
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.VideoURL = ptr(env.cfg.storedVideoURL("landscape/abc.mp4"))
+		v.Renditions = database.Renditions{"720p": testArtifactsBucket + ",landscape/abc_720p.mp4"}
+		v.HLSURL = ptr(testArtifactsBucket + ",hls/" + video.ID + "/set/index.m3u8")
+	})
+	return video
+}
+
+func TestArtifactsStoredOutsideDistributionArePresigned(t *testing.T) {
+	env := newTestEnv(t, withArtifactsBucket)
+	_, token := env.createUser(t)
+	video := storeArtifacts(t, env, token)
+
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if got.VideoURL == nil || *got.VideoURL != "https://"+testCDN+"/landscape/abc.mp4" {
+		t.Errorf("video_url = %v, want the distribution URL", got.VideoURL)
+	}
+	rendition, err := url.Parse(got.Renditions["720p"])
+	if err != nil || !strings.Contains(rendition.Path, testArtifactsBucket+"/landscape/abc_720p.mp4") || rendition.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("720p rendition = %s, want a presigned URL in the artifacts bucket", got.Renditions["720p"])
+	}
+	if got.HLSURL == nil || *got.HLSURL != hlsPlaylistPath(mustParseUUID(t, video.ID)) {
+		t.Fatalf("hls_url = %v, want the playlist endpoint", got.HLSURL)
+	}
+
+	resp, playlist := env.do(t, http.MethodGet, *got.HLSURL, token, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("playlist: got %d: %s", resp.StatusCode, playlist)
+	}
+	lines := strings.Split(strings.TrimSpace(string(playlist)), "\n")
+	segment, err := url.Parse(lines[len(lines)-1])
+	if err != nil || !strings.Contains(segment.Path, testArtifactsBucket+"/hls/"+video.ID+"/set/seg0.ts") || segment.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("segment = %s, want a presigned URL in the artifacts bucket", lines[len(lines)-1])
+	}
+}
+
+func TestReconcileListsArtifactsBucket(t *testing.T) {
+	env := newTestEnv(t, withArtifactsBucket)
+	_, token := env.createUser(t)
+	storeArtifacts(t, env, token)
+	old := time.Now().Add(-48 * time.Hour)
+	env.s3.PutObject(testArtifactsBucket, "landscape/orphan_720p.mp4", storagetest.FakeObject{Data: []byte("x"), LastModified: old})
+	env.s3.PutObject(testArtifactsBucket, "unmanaged/file", storagetest.FakeObject{Data: []byte("x"), LastModified: old})
+
+	report, err := env.cfg.reconcileStorage(context.Background(), true, defaultOrphanMinAge, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Referenced != 4 {
+		t.Errorf("referenced = %d, want the source, rendition and two HLS files", report.Referenced)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Storage != testArtifactsBucket || report.Orphans[0].Key != "landscape/orphan_720p.mp4" {
+		t.Fatalf("orphans = %+v, want the unreferenced rendition", report.Orphans)
+	}
+	if len(report.Dangling) != 0 {
+		t.Errorf("dangling = %+v, want none", report.Dangling)
+	}
+	if _, ok := env.s3.Object(testArtifactsBucket, "landscape/orphan_720p.mp4"); ok {
+		t.Error("orphaned rendition wasn't deleted")
+	}
+	if _, ok := env.s3.Object(testArtifactsBucket, "landscape/abc_720p.mp4"); !ok {
+		t.Error("referenced rendition was deleted")
+	}
+	if _, ok := env.s3.Object(testArtifactsBucket, "unmanaged/file"); !ok {
+		t.Error("object outside the managed prefixes was deleted")
+	}
+}
+
+func TestReconcileScopesShareBuckets(t *testing.T) {
+	env := newTestEnv(t)
+	scopes := env.cfg.reconcileScopes()
+	if len(scopes) != 1 {
+		t.Fatalf("got %d scopes for a single bucket, want 1", len(scopes))
+	}
+	for _, prefix := range []string{"landscape/", "hls/", "direct/", thumbnailKeyPrefix} {
+		if !scopes[0].covers(testBucket, prefix+"x") {
+			t.Errorf("scope doesn't cover %s", prefix)
+		}
+	}
+}
+
+func TestReconcilePagesThroughListings(t *testing.T) {
+	env := newTestEnv(t)
+	env.s3.PageSize = 3
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "paged")
+	old := time.Now().Add(-48 * time.Hour)
+	for i := range 10 {
+		env.s3.PutObject(testBucket, fmt.Sprintf("landscape/orphan%02d.mp4", i), storagetest.FakeObject{Data: []byte("x"), LastModified: old})
+	}
+	env.s3.PutObject(testBucket, "landscape/kept.mp4", storagetest.FakeObject{Data: []byte("x"), LastModified: old})
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.VideoURL = ptr(env.cfg.storedVideoURL("landscape/kept.mp4"))
+	})
+
+	report, err := env.cfg.reconcileStorage(context.Background(), true, defaultOrphanMinAge, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Listed != 11 || report.Referenced != 1 || len(report.Orphans) != 10 || report.Deleted != 10 {
+		t.Errorf("report = listed %d, referenced %d, orphans %d, deleted %d; want 11, 1, 10, 10",
+			report.Listed, report.Referenced, len(report.Orphans), report.Deleted)
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 1 || keys[0] != "landscape/kept.mp4" {
+		t.Errorf("keys left = %v, want only the referenced one", keys)
+	}
+}
+
+func TestReconcileMinAge(t *testing.T) {
+	env := newTestEnv(t)
+	now := time.Now()
+	for key, age := range map[string]time.Duration{
+		"landscape/old.mp4":        defaultOrphanMinAge + time.Minute,
+		"landscape/borderline.mp4": defaultOrphanMinAge - time.Minute,
+		"landscape/new.mp4":        time.Minute,
+	} {
+		env.s3.PutObject(testBucket, key, storagetest.FakeObject{Data: []byte("x"), LastModified: now.Add(-age)})
+	}
+
+	report, err := env.cfg.reconcileStorage(context.Background(), true, defaultOrphanMinAge, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 3 || report.Deleted != 1 {
+		t.Errorf("orphans %d, deleted %d; want all three reported and one deleted", len(report.Orphans), report.Deleted)
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 2 || slices.Contains(keys, "landscape/old.mp4") {
+		t.Errorf("keys left = %v, want the two younger orphans", keys)
+	}
+
+	// A dry run deletes nothing, however old
+	env.s3.PutObject(testBucket, "landscape/old.mp4", storagetest.FakeObject{Data: []byte("x"), LastModified: now.Add(-30 * 24 * time.Hour)})
+	report, err = env.cfg.reconcileStorage(context.Background(), false, defaultOrphanMinAge, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 0 || len(env.s3.Keys(testBucket)) != 3 {
+		t.Errorf("dry run deleted %d objects", report.Deleted)
+	}
+}
+
+func TestReconcileProtectsUploadsInProgress(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	old := time.Now().Add(-48 * time.Hour)
+
+	// A direct upload whose client hasn't called complete yet
+	direct := env.createVideo(t, token, "direct")
+	target := env.directUpload(t, token, direct.ID, 100)
+	env.s3.PutObject(testBucket, target.Key, storagetest.FakeObject{Data: []byte("x"), LastModified: old})
+
+	// A video still processing, part way through writing its HLS set
+	pending := env.createVideo(t, token, "pending")
+	env.updateVideo(t, pending.ID, func(v *database.Video) {
+		v.ProcessingStatus = ptr(database.ProcessingStatusPending)
+	})
+	segment := "hls/" + pending.ID + "/set/seg0.ts"
+	env.s3.PutObject(testBucket, segment, storagetest.FakeObject{Data: []byte("x"), LastModified: old})
+
+	// The same layout for a video that isn't processing is an orphan
+	idle := env.createVideo(t, token, "idle")
+	stale := "hls/" + idle.ID + "/set/seg0.ts"
+	env.s3.PutObject(testBucket, stale, storagetest.FakeObject{Data: []byte("x"), LastModified: old})
+
+	report, err := env.cfg.reconcileStorage(context.Background(), true, defaultOrphanMinAge, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Protected != 2 {
+		t.Errorf("protected = %d, want the direct upload and the pending HLS segment", report.Protected)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Key != stale || !report.Orphans[0].Deleted {
+		t.Errorf("orphans = %+v, want only the idle video's segment, deleted", report.Orphans)
+	}
+	for _, key := range []string{target.Key, segment} {
+		if _, ok := env.s3.Object(testBucket, key); !ok {
+			t.Errorf("%s was deleted while its upload was in progress", key)
+		}
+	}
+}
+
+func TestReconcileFixesLegacyMetadata(t *testing.T) {
+	env := newTestEnv(t, withArtifactsBucket)
+	_, token := env.createUser(t)
+	video := storeArtifacts(t, env, token)
+	env.s3.PutObject(testBucket, "landscape/abc.mp4", storagetest.FakeObject{Data: []byte("legacy"), ContentType: "application/octet-stream", Tagging: "video_id=" + video.ID})
+	env.s3.PutObject(testArtifactsBucket, "landscape/abc_720p.mp4", storagetest.FakeObject{Data: []byte("rendition"), ContentType: "video/mp4"})
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.Title = "Café trip"
+		v.ContentType = ptr("video/quicktime")
+	})
+
+	// Metadata is only checked when asked for
+	var report reconcileReport
+	env.doJSON(t, http.MethodPost, "/admin/storage/reconcile", testAdmin, nil, http.StatusOK, &report)
+	if len(report.StaleMetadata) != 0 || env.s3.Calls("CopyObject") != 0 {
+		t.Fatalf("plain reconcile touched metadata: %+v", report.StaleMetadata)
+	}
+
+	env.doJSON(t, http.MethodPost, "/admin/storage/reconcile?fix_metadata=true", testAdmin, nil, http.StatusOK, &report)
+	want := []staleMetadata{{VideoID: video.ID, Field: "video_url", Storage: testBucket, Key: "landscape/abc.mp4", ContentType: "application/octet-stream", Fixed: true}}
+	if !slices.Equal(report.StaleMetadata, want) || report.MetadataFixed != 1 {
+		t.Fatalf("stale metadata = %+v, fixed %d; want only the legacy video, fixed", report.StaleMetadata, report.MetadataFixed)
+	}
+	obj, _ := env.s3.Object(testBucket, "landscape/abc.mp4")
+	if obj.ContentType != "video/quicktime" || obj.ContentDisposition != `inline; filename="Caf_ trip.mp4"; filename*=UTF-8''Caf%C3%A9%20trip.mp4` {
+		t.Errorf("fixed object is %q, %q", obj.ContentType, obj.ContentDisposition)
+	}
+	if string(obj.Data) != "legacy" || obj.Tagging != "video_id="+video.ID {
+		t.Errorf("fixed object = %q tagged %q, want its data and tags kept", obj.Data, obj.Tagging)
+	}
+
+	var again reconcileReport
+	env.doJSON(t, http.MethodPost, "/admin/storage/reconcile?fix_metadata=true", testAdmin, nil, http.StatusOK, &again)
+	if len(again.StaleMetadata) != 0 {
+		t.Errorf("second run found %+v, want nothing left to fix", again.StaleMetadata)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// renditionHeights are the sizes transcoded when ENABLE_TRANSCODE is set,
+// by their shorter side in pixels.
+var renditionHeights = []int{720, 480}
+
+// renditionSource labels the uploaded file in API rendition maps.
+const renditionSource = "source"
+
+// renditionFailedWarning is added to a video's processing warnings when a
+// rendition couldn't be made; the others and the source are still stored.
+const renditionFailedWarning = "rendition_failed"
+
+// storeRenditions transcodes path to each rendition smaller than the
+// source and uploads it to the artifacts store under a key next to the
+// source's, e.g. landscape/abc.mp4 gets landscape/abc_720p.mp4.
+// Renditions are never upscaled. Failures
+// are logged and reported as warnings rather than failing the upload.
+func (cfg *apiConfig) storeRenditions(ctx context.Context, path, sourceKey, mediaType string, probe videoMetadata) (database.Renditions, []string) {
+	sourceHeight := min(probe.Width, probe.Height)
+	store := cfg.artifactStore()
+	renditions := database.Renditions{}
+	failed := false
+	for _, height := range renditionHeights {
+		if height >= sourceHeight {
+			continue
+		}
+		label := fmt.Sprintf("%dp", height)
+		key := strings.TrimSuffix(sourceKey, ".mp4") + "_" + label + ".mp4"
+		if err := cfg.storeRendition(ctx, store, path, key, mediaType, height); err != nil {
+			log.Printf("couldn't store %s rendition %s: %v", label, key, err)
+			failed = true
+			continue
+		}
+		renditions[label] = cfg.storedObjectURL(store, key)
+	}
+	if failed {
+		return renditions, []string{renditionFailedWarning}
+	}
+	return renditions, nil
+}
+
+func (cfg *apiConfig) storeRendition(ctx context.Context, store storage.Storage, path, key, mediaType string, height int) error {
+	// Source keys are named by content, so so are their renditions
+	if exists, err := objectExistsIn(ctx, store, key); err != nil || exists {
+		return err
+	}
+	outPath, err := transcodeVideo(ctx, path, height)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outPath)
+	f, err := os.Open(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cfg.storeObjectIn(ctx, store, key, mediaType, f, nil)
+}
+
+// renditionURLs lists the URLs stored in renditions, for cleanup.
+func renditionURLs(renditions database.Renditions) []*string {
+	urls := make([]*string, 0, len(renditions))
+	for _, u := range renditions {
+		urls = append(urls, &u)
+	}
+	return urls
+}
+
+// apiRenditions is the rendition map clients see: the stored renditions
+// plus the uploaded file as "source". It is never null.
+func apiRenditions(video database.Video) map[string]string {
+	renditions := make(map[string]string, len(video.Renditions)+1)
+	for label, u := range video.Renditions {
+		renditions[label] = u
+	}
+	if u := presentURL(video.VideoURL); u != nil {
+		renditions[renditionSource] = *u
+	}
+	return renditions
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries a request's ID. An ID sent by the client or a
+// proxy in front of us is kept, so one ID follows the request end to end.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds a client-supplied request ID.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying id, for work that outlives the
+// request, such as queued processing.
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID in ctx, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the default logger, tagged with ctx's request ID
+// when there is one.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return slog.With(slog.String("request_id", id))
+	}
+	return slog.Default()
+}
+
+// validRequestID accepts IDs of URL-safe characters, so a client can't
+// inject anything odd into logs or response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var rnd [16]byte
+	rand.Read(rnd[:])
+	return hex.EncodeToString(rnd[:])
+}
+
+// loggingWriter records what a handler sent, for the request log.
+type loggingWriter struct {
+	http.ResponseWriter
+	requestID string
+	status    int
+	written   int64
+}
+
+func (w *loggingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *loggingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseLogger is requestLogger for helpers that only have the
+// ResponseWriter: it finds the request ID by unwrapping w down to the
+// request log's writer.
+func responseLogger(w http.ResponseWriter) *slog.Logger {
+	for w != nil {
+		if lw, ok := w.(*loggingWriter); ok {
+			return slog.With(slog.String("request_id", lw.requestID))
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	return slog.Default()
+}
+
+// countingBody counts the request body bytes a handler reads.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// requestLog assigns every request an ID, echoed in X-Request-ID and
+// carried in its context, and logs one line per request with its outcome,
+// duration, bytes received and sent, and the caller when authenticated.
+func (cfg *apiConfig) requestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		lw := &loggingWriter{ResponseWriter: w, requestID: id}
+		start := time.Now()
+		defer func() {
+			status := lw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			attrs := []any{
+				slog.String("request_id", id),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+				slog.Int64("bytes_in", body.n),
+				slog.Int64("bytes_out", lw.written),
+			}
+			if identity := cfg.optionalIdentity(r); identity.UserID != uuid.Nil {
+				attrs = append(attrs, slog.String("user_id", identity.UserID.String()))
+			}
+			// A handler panic still gets its line before net/http recovers it
+			if p := recover(); p != nil {
+				slog.Error("request panicked", append(attrs, slog.Any("panic", p))...)
+				panic(p)
+			}
+			slog.Info("request", attrs...)
+		}()
+		next.ServeHTTP(lw, r)
+	})
+}
+
+// logDuration logs how long an operation took at debug level, tagged with
+// ctx's request ID. Pass the operation's error, if any.
+func logDuration(ctx context.Context, msg string, start time.Time, err error, attrs ...any) {
+	attrs = append(attrs, slog.Int64("duration_ms", time.Since(start).Milliseconds()))
+	if err != nil && !errors.Is(err, context.Canceled) {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	requestLogger(ctx).Debug(msg, attrs...)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// videoKeys returns the keys in the test bucket that aren't thumbnails.
+func (env *testEnv) videoKeys() []string {
+	var keys []string
+	for _, key := range env.s3.Keys(testBucket) {
+		if !strings.HasPrefix(key, thumbnailKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (env *testEnv) reupload(t *testing.T, token, videoID string, data []byte) {
+	t.Helper()
+	if resp, body := env.uploadVideo(t, token, videoID, data); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload: got %d: %s", resp.StatusCode, body)
+	}
+	if status := env.waitForProcessing(t, token, videoID); status.ProcessingError != nil {
+		t.Fatalf("processing failed: %s", *status.ProcessingError)
+	}
+}
+
+// drainProcessing waits for the workers to finish, including deleting
+// the objects an upload replaced after its row was saved. Nothing can be
+// processed afterwards.
+func (env *testEnv) drainProcessing(t *testing.T) {
+	t.Helper()
+	if err := env.cfg.processingQueue.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReuploadRemovesReplacedVideo(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Reuploaded")
+
+	env.reupload(t, token, video.ID, testVideoBytes(4<<10))
+	first := env.storedVideoKey(t, video.ID)
+	env.reupload(t, token, video.ID, testVideoBytes(8<<10))
+	env.drainProcessing(t)
+	second := env.storedVideoKey(t, video.ID)
+
+	if first == second {
+		t.Fatalf("both uploads stored under %s", first)
+	}
+	if keys := env.videoKeys(); !slices.Equal(keys, []string{second}) {
+		t.Errorf("video objects = %v, want only the new %s", keys, second)
+	}
+}
+
+func TestReuploadKeepsSharedObject(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	reuploaded := env.createVideo(t, token, "Reuploaded")
+	other := env.createVideo(t, token, "Same content")
+
+	// Identical uploads share one object
+	data := testVideoBytes(4 << 10)
+	env.reupload(t, token, reuploaded.ID, data)
+	env.reupload(t, token, other.ID, data)
+	shared := env.storedVideoKey(t, other.ID)
+
+	env.reupload(t, token, reuploaded.ID, testVideoBytes(8<<10))
+	env.drainProcessing(t)
+	if _, ok := env.s3.Object(testBucket, shared); !ok {
+		t.Errorf("object %s went while another video still refers to it", shared)
+	}
+	if keys := env.videoKeys(); len(keys) != 2 {
+		t.Errorf("video objects = %v, want the shared one and the new one", keys)
+	}
+}
+
+func TestReuploadWhenReplacedDeleteFails(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Stuck object")
+	env.reupload(t, token, video.ID, testVideoBytes(4<<10))
+	first := env.storedVideoKey(t, video.ID)
+
+	// The old object is only an orphan, so the upload still succeeds
+	logs := captureLogs(t)
+	env.s3.FailWhen(func(op string, r *http.Request) bool { return op == "DeleteObject" })
+	env.reupload(t, token, video.ID, testVideoBytes(8<<10))
+	env.drainProcessing(t)
+	if second := env.storedVideoKey(t, video.ID); second == first {
+		t.Errorf("row still points at %s", first)
+	}
+	if _, ok := env.s3.Object(testBucket, first); !ok {
+		t.Error("the replaced object is gone despite the failing delete")
+	}
+	if !strings.Contains(logs.String(), "couldn't delete replaced") {
+		t.Errorf("logs %s, want the failed delete logged", logs)
+	}
+}
+
+func TestReplacedThumbnailRemoved(t *testing.T) {
+	for _, backend := range []string{storageBackendS3, storageBackendLocal} {
+		t.Run(backend, func(t *testing.T) {
+			env := newTestEnv(t)
+			if backend == storageBackendLocal {
+				env.cfg.videoStorage = env.cfg.localStorage
+			}
+			_, token := env.createUser(t)
+			old := env.videoWithThumbnail(t, token, "New thumbnail")
+
+			env.doJSON(t, http.MethodPost, "/api/videos/"+old.ID.String()+"/thumbnail_json", token, thumbnailJSON(t, 32, 18, color.Black), http.StatusOK, nil)
+			current := env.videoRow(t, old.ID.String())
+			if *current.ThumbnailURL == *old.ThumbnailURL {
+				t.Fatalf("thumbnail_url still %s", *old.ThumbnailURL)
+			}
+			if got := env.thumbnailsStored(t, old); !slices.Equal(got, []bool{false, false}) {
+				t.Errorf("old thumbnail and grid stored = %v, want both removed", got)
+			}
+			// The new upload has no grid, so check its thumbnail twice
+			current.ThumbnailGridURL = current.ThumbnailURL
+			if got := env.thumbnailsStored(t, current); !slices.Equal(got, []bool{true, true}) {
+				t.Errorf("new thumbnail stored = %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import "net/http"
+
+// newHandler builds the server's full handler: static files, assets, every
+// API route and the middleware around them. devUI mounts /dev/upload.
+func (cfg *apiConfig) newHandler(devUI bool) http.Handler {
+	mux := http.NewServeMux()
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
+	mux.Handle("/app/", appHandler)
+
+	assetsHandler := http.StripPrefix(cfg.assetsPath, cfg.signedVideoAssets(cfg.assetHandler()))
+	mux.Handle(cfg.assetsPath+"/", cfg.downloadLimiter.middleware(assetsHandler))
+	if cfg.assetsPath != defaultAssetsPath {
+		legacyAssetsHandler := http.StripPrefix(defaultAssetsPath, cfg.signedVideoAssets(cfg.assetHandler()))
+		mux.Handle(defaultAssetsPath+"/", cfg.downloadLimiter.middleware(legacyAssetsHandler))
+	}
+
+	// API routes go through the registry so /api/openapi.json lists them
+	routes := newRouteRegistry(mux)
+	routes.HandleFunc("GET /healthz", cfg.handlerLiveness)
+	routes.HandleFunc("GET /readyz", cfg.handlerReadiness)
+	routes.HandleFunc("GET /api/healthz", cfg.handlerHealth)
+	routes.HandleFunc("GET /api/openapi.json", routes.handlerOpenAPI)
+
+	routes.HandleFunc("POST /api/login", cfg.handlerLogin)
+	routes.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	routes.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+
+	routes.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	routes.HandleFunc("GET /api/users/me/cleanup-suggestions", cfg.handlerCleanupSuggestions)
+	routes.HandleFunc("GET /api/users/me/title-policy", cfg.handlerTitlePolicyGet)
+	routes.HandleFunc("PUT /api/users/me/title-policy", cfg.handlerTitlePolicyUpdate)
+
+	routes.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
+	routes.HandleFunc("POST /api/thumbnail_upload/{videoID}", instrumentUpload(uploadTypeThumbnail, cfg.maintenanceGate(cfg.handlerUploadThumbnail)))
+	routes.HandleFunc("POST /api/videos/{videoID}/thumbnail_json", instrumentUpload(uploadTypeThumbnailJSON, cfg.maintenanceGate(cfg.handlerUploadThumbnailJSON)))
+	routes.HandleFunc("POST /api/video_upload/{videoID}", instrumentUpload(uploadTypeVideo, cfg.maintenanceGate(cfg.handlerUploadVideo)))
+	routes.HandleFunc("GET /api/video_upload/{videoID}/resume", cfg.handlerUploadVideoResumeStatus)
+	routes.HandleFunc("POST /api/video_upload/{videoID}/resume", instrumentUpload(uploadTypeVideoResume, cfg.maintenanceGate(cfg.handlerUploadVideoResume)))
+	routes.HandleFunc("GET /api/video_upload/{videoID}/progress", cfg.handlerUploadProgress)
+	routes.HandleFunc("POST /api/videos/{videoID}/uploads", cfg.maintenanceGate(cfg.handlerUploadSessionCreate))
+	routes.HandleFunc("GET /api/uploads/{sessionID}", cfg.handlerUploadSessionGet)
+	routes.HandleFunc("PUT /api/uploads/{sessionID}/chunks/{n}", instrumentUpload(uploadTypeVideoChunk, cfg.maintenanceGate(cfg.handlerUploadSessionChunk)))
+	routes.HandleFunc("POST /api/uploads/{sessionID}/complete", instrumentUpload(uploadTypeVideoComplete, cfg.maintenanceGate(cfg.handlerUploadSessionComplete)))
+	routes.HandleFunc("POST /api/videos/{videoID}/upload-url", cfg.maintenanceGate(cfg.handlerDirectUploadURL))
+	routes.HandleFunc("POST /api/videos/{videoID}/upload-complete", instrumentUpload(uploadTypeVideoDirect, cfg.maintenanceGate(cfg.handlerDirectUploadComplete)))
+	routes.HandleFunc("GET /api/videos", cfg.urlExpiryParam(cfg.handlerVideosRetrieve))
+	routes.HandleFunc("GET /api/videos/public", cfg.urlExpiryParam(cfg.handlerPublicVideos))
+	routes.HandleFunc("GET /api/videos/trash", cfg.urlExpiryParam(cfg.handlerVideosTrash))
+	// GET patterns also match HEAD; the server discards the body for HEAD.
+	routes.HandleFunc("GET /api/videos/{videoID}", cfg.urlExpiryParam(cfg.handlerVideoGet))
+	routes.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	routes.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	routes.HandleFunc("POST /api/videos/{videoID}/restore", cfg.handlerVideoRestore)
+	routes.HandleFunc("POST /api/videos/bulk-delete", cfg.handlerVideosBulkDelete)
+	routes.HandleFunc("GET /api/videos/{videoID}/status", cfg.handlerVideoStatus)
+	routes.HandleFunc("GET /api/videos/{videoID}/signed-url", cfg.urlExpiryParam(cfg.handlerVideoSignedURL))
+	routes.HandleFunc("GET /api/videos/{videoID}/download", cfg.downloadLimiter.middleware(http.HandlerFunc(cfg.handlerVideoDownload)).ServeHTTP)
+	routes.HandleFunc("GET /api/videos/{videoID}/hls.m3u8", cfg.urlExpiryParam(cfg.handlerVideoHLSPlaylist))
+	routes.HandleFunc("GET /api/videos/{videoID}/processing-runs", cfg.handlerProcessingRunsList)
+	routes.HandleFunc("GET /api/videos/{videoID}/access", cfg.handlerAccessEventsList)
+
+	routes.HandleFunc("POST /api/videos/{videoID}/share-links", cfg.handlerShareLinkCreate)
+	routes.HandleFunc("GET /api/videos/{videoID}/share-links", cfg.handlerShareLinksList)
+	routes.HandleFunc("DELETE /api/videos/{videoID}/share-links/{token}", cfg.handlerShareLinkRevoke)
+	routes.HandleFunc("GET /s/{token}", cfg.handlerShareLinkOpen)
+
+	// Served straight on the mux: /metrics isn't part of the API, and no
+	// cache policy covers it
+	mux.Handle("GET /metrics", metricsHandler())
+
+	if devUI {
+		mux.HandleFunc("GET /dev/upload", handlerDevUpload)
+	}
+
+	routes.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	routes.HandleFunc("GET /admin/settings", cfg.handlerSettingsGet)
+	routes.HandleFunc("PUT /admin/settings", cfg.handlerSettingsUpdate)
+	routes.HandleFunc("GET /admin/stats", cfg.handlerAdminStats)
+	routes.HandleFunc("POST /admin/thumbnails/fix-extensions", cfg.handlerThumbnailExtensionBackfill)
+	routes.HandleFunc("POST /admin/assets/shard", cfg.handlerShardAssets)
+	routes.HandleFunc("POST /admin/assets/normalize-urls", cfg.handlerNormalizeAssetURLs)
+	routes.HandleFunc("POST /admin/videos/backfill-media-info", cfg.handlerMediaInfoBackfill)
+	routes.HandleFunc("POST /admin/videos/refresh-urls", cfg.handlerRefreshVideoURLs)
+	routes.HandleFunc("POST /admin/storage/reconcile", cfg.handlerReconcileStorage)
+	routes.HandleFunc("POST /admin/impersonate/{userID}", cfg.handlerImpersonate)
+	routes.HandleFunc("GET /admin/impersonations", cfg.handlerImpersonationGrantsList)
+
+	cachePolicies := defaultCachePolicies(cfg.assetsPath)
+	applyCacheOverrides(cachePolicies)
+
+	return cfg.requestLog(cfg.baseURLMiddleware(cacheMiddleware(cachePolicies, envelopeMiddleware(cfg.impersonationLog(mux)))))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// configuredBuckets returns each distinct bucket the server is configured to use.
+func (cfg *apiConfig) configuredBuckets() []string {
+	var buckets []string
+	seen := map[string]bool{}
+	for _, b := range []string{cfg.s3Bucket, cfg.s3ThumbnailBucket, cfg.s3ArtifactsBucket} {
+		if b == "" || seen[b] {
+			continue
+		}
+		seen[b] = true
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// checkBuckets verifies every configured bucket is reachable. Failures are
+// logged rather than fatal so thumbnail-only local development still starts.
+func (cfg *apiConfig) checkBuckets(ctx context.Context) {
+	for _, bucket := range cfg.configuredBuckets() {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket})
+		cancel()
+		if err != nil {
+			log.Printf("WARNING: S3 bucket %q is not reachable: %v", bucket, err)
+		}
+	}
+}
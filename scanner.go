@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ScanVerdict is the outcome of scanning one upload.
+type ScanVerdict struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner inspects uploads before anything is written to assetsRoot or S3.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanVerdict, error)
+}
+
+// noopScanner is used when no scanner is configured.
+type noopScanner struct{}
+
+func (noopScanner) Scan(ctx context.Context, r io.Reader) (ScanVerdict, error) {
+	return ScanVerdict{}, nil
+}
+
+// clamdScanner streams uploads to a clamd daemon using the INSTREAM command.
+type clamdScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+// clamdChunkSize is the size of each INSTREAM chunk; clamd's default
+// StreamMaxLength applies to the total, not to a chunk.
+const clamdChunkSize = 64 << 10
+
+func (s clamdScanner) Scan(ctx context.Context, r io.Reader) (ScanVerdict, error) {
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanVerdict{}, err
+	}
+	buf := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return ScanVerdict{}, err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return ScanVerdict{}, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanVerdict{}, readErr
+		}
+	}
+	// A zero-length chunk ends the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return ScanVerdict{}, err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply interprets replies like "stream: OK" and
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (ScanVerdict, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return ScanVerdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return ScanVerdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return ScanVerdict{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
+
+// scanUpload runs the configured scanner over at most scanMaxBytes of r.
+// Infected uploads are rejected with 422; scanner failures are rejected
+// with 503 unless the scanner is configured to fail open.
+func (cfg *apiConfig) scanUpload(ctx context.Context, r io.Reader) error {
+	if cfg.scanMaxBytes > 0 {
+		r = io.LimitReader(r, cfg.scanMaxBytes)
+	}
+	verdict, err := cfg.scanner.Scan(ctx, r)
+	if err != nil {
+		if cfg.scanFailOpen {
+			log.Printf("WARNING: virus scan failed, accepting upload: %v", err)
+			return nil
+		}
+		return &statusError{status: http.StatusServiceUnavailable, msg: "Upload scanning is unavailable", err: err}
+	}
+	if verdict.Infected {
+		return &statusError{status: http.StatusUnprocessableEntity, msg: "Upload rejected: malware detected", code: errorCodeMalwareDetected, err: fmt.Errorf("signature %s", verdict.Signature)}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// eicar is the standard antivirus test file: harmless, but every scanner
+// reports it as infected.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// eicarScanner flags any upload containing the EICAR test string, the way
+// clamd would.
+type eicarScanner struct{}
+
+func (eicarScanner) Scan(ctx context.Context, r io.Reader) (ScanVerdict, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	if bytes.Contains(data, []byte(eicar)) {
+		return ScanVerdict{Infected: true, Signature: "Eicar-Signature"}, nil
+	}
+	return ScanVerdict{}, nil
+}
+
+func TestUploadsRejectEICAR(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.scanner = eicarScanner{}
+	})
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Infected")
+
+	// Thumbnails are scanned before the response is sent
+	png := append([]byte("\x89PNG\r\n\x1a\n"), eicar...)
+	resp, body := env.do(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, "application/json", jsonBody(t, map[string]string{
+		"content_type": "image/png",
+		"data_base64":  base64.StdEncoding.EncodeToString(png),
+	}))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("thumbnail: got %d, want 422: %s", resp.StatusCode, body)
+	}
+	if code := errorCode(t, body); code != errorCodeMalwareDetected {
+		t.Errorf("thumbnail: code = %q, want %q", code, errorCodeMalwareDetected)
+	}
+
+	// Videos are scanned by the processing workers, so the verdict lands
+	// on the status
+	mp4 := append([]byte("\x00\x00\x00\x10ftypisom\x00\x00\x02\x00"), eicar...)
+	resp, body = env.uploadVideo(t, token, video.ID, mp4)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("video: got %d, want 202: %s", resp.StatusCode, body)
+	}
+	status := env.waitForProcessing(t, token, video.ID)
+	if status.ProcessingStatus == nil || *status.ProcessingStatus != database.ProcessingStatusFailed ||
+		status.ProcessingError == nil || !strings.Contains(*status.ProcessingError, "malware") {
+		t.Errorf("video status = %+v, want failed with malware detected", status)
+	}
+
+	if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("infected uploads were stored: %v", keys)
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    ScanVerdict
+		wantErr bool
+	}{
+		{reply: "stream: OK"},
+		{reply: "stream: Eicar-Signature FOUND", want: ScanVerdict{Infected: true, Signature: "Eicar-Signature"}},
+		{reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClamdReply(tt.reply)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClamdReply(%q) error = %v, wantErr %v", tt.reply, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("parseClamdReply(%q) = %+v, want %+v", tt.reply, got, tt.want)
+		}
+	}
+}
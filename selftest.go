@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// selfTestPrefix keeps self-test objects apart from real uploads.
+const selfTestPrefix = "selftest/"
+
+// selfTest holds state shared between self-test stages and what needs
+// cleaning up afterwards.
+type selfTest struct {
+	cfg     *apiConfig
+	workDir string
+
+	userID    uuid.UUID
+	videoID   uuid.UUID
+	fixture   string
+	processed string
+	key       string
+}
+
+type selfTestStage struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runSelfTest exercises the database, disk, ffmpeg, ffprobe and storage with a
+// throwaway user, video row and one-second generated clip, prints a
+// stage-by-stage report, cleans everything up and reports overall success.
+func (cfg *apiConfig) runSelfTest(ctx context.Context) bool {
+	workDir, err := os.MkdirTemp("", cfg.appName+"-selftest-*")
+	if err != nil {
+		fmt.Printf("FAIL  setup: %v\n", err)
+		return false
+	}
+	st := &selfTest{cfg: cfg, workDir: workDir}
+	defer st.cleanup(ctx)
+
+	stages := []selfTestStage{
+		{"database", st.checkDatabase},
+		{"assets directory", st.checkAssetsDir},
+		{"ffmpeg fixture", st.generateFixture},
+		{"ffprobe", st.probe},
+		{"ffmpeg faststart", st.faststart},
+		{cfg.videoStorage.Name() + " upload", st.upload},
+		{cfg.videoStorage.Name() + " presigned fetch", st.fetch},
+	}
+
+	ok := true
+	for _, stage := range stages {
+		if !ok {
+			fmt.Printf("SKIP  %s\n", stage.name)
+			continue
+		}
+		start := time.Now()
+		if err := stage.run(ctx); err != nil {
+			fmt.Printf("FAIL  %s (%s): %v\n", stage.name, time.Since(start).Round(time.Millisecond), err)
+			ok = false
+			continue
+		}
+		fmt.Printf("OK    %s (%s)\n", stage.name, time.Since(start).Round(time.Millisecond))
+	}
+	return ok
+}
+
+func (st *selfTest) checkDatabase(ctx context.Context) error {
+	var rnd [8]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return err
+	}
+	user, err := st.cfg.db.CreateUser(database.CreateUserParams{
+		Email:    fmt.Sprintf("selftest-%x@selftest.invalid", rnd),
+		Password: "!",
+	})
+	if err != nil {
+		return err
+	}
+	st.userID = user.ID
+
+	video, err := st.cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:  "self-test",
+		UserID: user.ID,
+	})
+	if err != nil {
+		return err
+	}
+	st.videoID = video.ID
+	return nil
+}
+
+func (st *selfTest) checkAssetsDir(ctx context.Context) error {
+	f, err := os.CreateTemp(st.cfg.assetsRoot, ".selftest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("selftest")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (st *selfTest) generateFixture(ctx context.Context) error {
+	st.fixture = filepath.Join(st.workDir, "fixture.mp4")
+	cmd := exec.CommandContext(ctx,
+		"ffmpeg",
+		"-f", "lavfi", "-i", "testsrc=duration=1:size=320x180:rate=25",
+		"-pix_fmt", "yuv420p",
+		"-y", st.fixture,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runTool(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+func (st *selfTest) probe(ctx context.Context) error {
+	meta, err := getVideoMetadata(ctx, st.fixture)
+	if err != nil {
+		return err
+	}
+	aspect, err := meta.aspectRatio()
+	if err != nil {
+		return err
+	}
+	if aspect != "16:9" {
+		return fmt.Errorf("expected 16:9 fixture, got %s", aspect)
+	}
+	return nil
+}
+
+func (st *selfTest) faststart(ctx context.Context) error {
+	result, err := processVideoForFastStart(ctx, st.fixture)
+	if err != nil {
+		return err
+	}
+	st.processed = result.path
+	return nil
+}
+
+func (st *selfTest) upload(ctx context.Context) error {
+	f, err := os.Open(st.processed)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	key := selfTestPrefix + hex.EncodeToString(st.videoID[:]) + ".mp4"
+	if err := st.cfg.storeObject(withObjectTags(ctx, st.userID, st.videoID), key, "video/mp4", f); err != nil {
+		return err
+	}
+	st.key = key
+	return nil
+}
+
+func (st *selfTest) fetch(ctx context.Context) error {
+	presigned, err := st.cfg.videoStorage.PresignGet(ctx, st.key, time.Minute)
+	if err != nil {
+		return err
+	}
+	if local, ok := st.cfg.videoStorage.(*storage.Local); ok {
+		// The server isn't running to serve the URL, so check the
+		// signature it would and read the file directly
+		return st.checkLocalFetch(local, presigned)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, presigned, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("presigned GET returned %s", resp.Status)
+	}
+
+	want, err := os.Stat(st.processed)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	if n != want.Size() {
+		return fmt.Errorf("fetched %d bytes, uploaded %d", n, want.Size())
+	}
+	return nil
+}
+
+// checkLocalFetch checks that a URL presigned by local storage carries a
+// signature the assets route accepts and that the file behind it is the
+// one uploaded.
+func (st *selfTest) checkLocalFetch(local *storage.Local, presigned string) error {
+	u, err := url.Parse(presigned)
+	if err != nil {
+		return err
+	}
+	if !local.Verify(st.key, u.Query()) {
+		return errors.New("presigned URL signature doesn't verify")
+	}
+	path, err := local.Path(st.key)
+	if err != nil {
+		return err
+	}
+	got, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	want, err := os.Stat(st.processed)
+	if err != nil {
+		return err
+	}
+	if got.Size() != want.Size() {
+		return fmt.Errorf("stored %d bytes, uploaded %d", got.Size(), want.Size())
+	}
+	return nil
+}
+
+// cleanup removes everything the self-test created, reporting failures
+// without changing the overall result.
+func (st *selfTest) cleanup(ctx context.Context) {
+	if st.key != "" {
+		if err := st.cfg.videoStorage.Delete(ctx, st.key); err != nil {
+			fmt.Printf("WARN  cleanup of %s object %s: %v\n", st.cfg.videoStorage.Name(), st.key, err)
+		}
+	}
+	if st.videoID != uuid.Nil {
+		if err := st.cfg.db.DeleteVideo(st.videoID); err != nil {
+			fmt.Printf("WARN  cleanup of video row: %v\n", err)
+		}
+	}
+	if st.userID != uuid.Nil {
+		if err := st.cfg.db.DeleteUser(st.userID); err != nil {
+			fmt.Printf("WARN  cleanup of user row: %v\n", err)
+		}
+	}
+	if st.processed != "" {
+		os.Remove(st.processed)
+	}
+	os.RemoveAll(st.workDir)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeSettings can be changed through the admin API without a restart.
+type runtimeSettings struct {
+	LogLevel string `json:"log_level"`
+	// Maintenance rejects new uploads while still serving reads
+	Maintenance bool `json:"maintenance"`
+	// PresignCache reuses presigned URLs from presignCache; off, every
+	// URL is signed afresh
+	PresignCache bool `json:"presign_cache"`
+	// PreviewGeneration takes a thumbnail from uploads that have none
+	PreviewGeneration bool `json:"preview_generation"`
+}
+
+// settingsChange is one audited update to the runtime settings.
+type settingsChange struct {
+	At     time.Time       `json:"at"`
+	By     string          `json:"by"`
+	Before runtimeSettings `json:"before"`
+	After  runtimeSettings `json:"after"`
+}
+
+// maxSettingsHistory bounds the audit trail kept in memory.
+const maxSettingsHistory = 50
+
+// settingsStore holds an immutable snapshot that handlers load once per
+// request, so a change never applies halfway through one.
+type settingsStore struct {
+	current  atomic.Pointer[runtimeSettings]
+	logLevel *slog.LevelVar
+
+	mu      sync.Mutex
+	history []settingsChange
+}
+
+func newSettingsStore(logLevel *slog.LevelVar) *settingsStore {
+	s := &settingsStore{logLevel: logLevel}
+	s.current.Store(&runtimeSettings{
+		LogLevel:          logLevel.Level().String(),
+		PresignCache:      true,
+		PreviewGeneration: true,
+	})
+	return s
+}
+
+func (s *settingsStore) load() runtimeSettings {
+	return *s.current.Load()
+}
+
+// update applies next, records who changed what and logs the change.
+func (s *settingsStore) update(by string, level slog.Level, next runtimeSettings) runtimeSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := s.load()
+	s.logLevel.Set(level)
+	next.LogLevel = level.String()
+	s.current.Store(&next)
+
+	s.history = append(s.history, settingsChange{At: time.Now().UTC(), By: by, Before: before, After: next})
+	if len(s.history) > maxSettingsHistory {
+		s.history = s.history[len(s.history)-maxSettingsHistory:]
+	}
+	slog.Warn("runtime settings changed", slog.String("by", by), slog.Any("before", before), slog.Any("after", next))
+	return next
+}
+
+func (s *settingsStore) changes() []settingsChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]settingsChange{}, s.history...)
+}
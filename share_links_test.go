@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestShareLinkViewCountedOnlyOnRedirect(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Shared")
+
+	var link shareLinkResponse
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/share-links", token,
+		map[string]any{"expires_in_seconds": 3600, "max_views": 1}, http.StatusCreated, &link)
+
+	views := func() int {
+		t.Helper()
+		var links []shareLinkResponse
+		env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+"/share-links", token, nil, http.StatusOK, &links)
+		if len(links) != 1 {
+			t.Fatalf("got %d links, want 1", len(links))
+		}
+		return links[0].Views
+	}
+	open := func(want int, headers ...string) {
+		t.Helper()
+		resp, body := env.do(t, http.MethodGet, link.Path, "", "", nil, headers...)
+		if resp.StatusCode != want {
+			t.Fatalf("GET %s: got %d, want %d: %s", link.Path, resp.StatusCode, want, body)
+		}
+	}
+
+	// No content yet: nothing to redirect to
+	open(http.StatusNotFound)
+	if got := views(); got != 0 {
+		t.Fatalf("views = %d after a 404, want 0", got)
+	}
+
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.VideoURL = ptr("https://" + testCDN + "/videos/shared.mp4")
+		v.AllowedEmbedOrigins = database.StringList{"https://allowed.example"}
+	})
+	open(http.StatusForbidden, "Origin", "https://elsewhere.example")
+	if got := views(); got != 0 {
+		t.Fatalf("views = %d after a 403, want 0", got)
+	}
+
+	open(http.StatusFound)
+	if got := views(); got != 1 {
+		t.Fatalf("views = %d after the redirect, want 1", got)
+	}
+	open(http.StatusGone)
+}
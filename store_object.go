@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// multipartThreshold is the file size above which objects are sent to S3
+// with the SDK's multipart uploader instead of a single PutObject, so a
+// dropped connection only costs the in-flight parts.
+const multipartThreshold = int64(64 << 20) // 64 MB
+
+// storeObject stores file under key in the video storage backend. On S3,
+// each part of a multipart upload gets cfg.uploadPartAttempts tries. When
+// one runs out for an object stored for a video (see withObjectTags), the
+// parts S3 has are kept and the next store of the key for that video
+// resumes the upload; the janitor aborts uploads left too long. Other
+// failed uploads are aborted so stray parts aren't billed.
+func (cfg *apiConfig) storeObject(ctx context.Context, key, contentType string, file *os.File) error {
+	return cfg.storeObjectWithChecksum(ctx, key, contentType, file, nil)
+}
+
+// storeObjectWithChecksum is storeObject with the SHA-256 of file, when
+// known. The backend rejects a body that doesn't match it.
+func (cfg *apiConfig) storeObjectWithChecksum(ctx context.Context, key, contentType string, file *os.File, sum []byte) error {
+	return cfg.storeObjectIn(ctx, cfg.videoStorage, key, contentType, file, sum)
+}
+
+// storeObjectIn is storeObjectWithChecksum for a store other than the
+// video storage backend, such as the artifacts bucket.
+func (cfg *apiConfig) storeObjectIn(ctx context.Context, store storage.Storage, key, contentType string, file *os.File, sum []byte) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	opts := storage.PutOptions{
+		ContentType:    contentType,
+		ChecksumSHA256: sum,
+		Tags:           cfg.objectTags(ctx),
+		ResumeScope:    objectVideoID(ctx),
+	}
+	err = store.Put(ctx, key, file, info.Size(), opts)
+	recordOperation(ctx, store.Name()+"_put", start, err,
+		slog.String("key", key),
+		slog.Int64("bytes", info.Size()),
+		slog.Bool("multipart", info.Size() >= multipartThreshold),
+	)
+	if err != nil {
+		return err
+	}
+
+	cfg.uploadThroughput.observe(info.Size(), time.Since(start))
+	return nil
+}
+
+// storeObjectOnce stores file under key unless an object is already
+// stored there. Keys named by content hold the same bytes whenever they
+// exist, so the upload would only rewrite them. A shared object keeps the
+// tags of whoever stored it first.
+func (cfg *apiConfig) storeObjectOnce(ctx context.Context, key, contentType string, file *os.File, sum []byte) error {
+	exists, err := cfg.objectExists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return cfg.storeObjectWithChecksum(ctx, key, contentType, file, sum)
+}
+
+// objectExists reports whether key is stored in the video storage backend.
+func (cfg *apiConfig) objectExists(ctx context.Context, key string) (bool, error) {
+	return objectExistsIn(ctx, cfg.videoStorage, key)
+}
+
+// objectExistsIn reports whether key is stored in store.
+func objectExistsIn(ctx context.Context, store storage.Storage, key string) (bool, error) {
+	_, err := store.Head(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staleTempFileAge is how old a leftover temp file has to be before the
+// startup sweep deletes it. Files that young may belong to another
+// instance sharing the temp directory.
+const staleTempFileAge = time.Hour
+
+// tempFiles tracks the temp files and directories uploads and processing
+// are using, so shutdown can delete whatever in-flight work left behind.
+var tempFiles = newTempFileRegistry()
+
+type tempFileRegistry struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+func newTempFileRegistry() *tempFileRegistry {
+	return &tempFileRegistry{paths: map[string]struct{}{}}
+}
+
+// create is os.CreateTemp in the default temp directory, tracking the file.
+func (t *tempFileRegistry) create(pattern string) (*os.File, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, err
+	}
+	t.track(f.Name())
+	return f, nil
+}
+
+// mkdir is os.MkdirTemp in the default temp directory, tracking the
+// directory.
+func (t *tempFileRegistry) mkdir(pattern string) (string, error) {
+	dir, err := os.MkdirTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	t.track(dir)
+	return dir, nil
+}
+
+func (t *tempFileRegistry) track(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paths[path] = struct{}{}
+}
+
+// remove deletes path and stops tracking it.
+func (t *tempFileRegistry) remove(path string) {
+	t.mu.Lock()
+	delete(t.paths, path)
+	t.mu.Unlock()
+	os.RemoveAll(path)
+}
+
+// removeAll deletes every tracked path, along with the files processing
+// derives from an upload by adding a suffix to its name (.processing,
+// .thumb.jpg and the like), and returns how many tracked paths there were.
+func (t *tempFileRegistry) removeAll() int {
+	t.mu.Lock()
+	paths := t.paths
+	t.paths = map[string]struct{}{}
+	t.mu.Unlock()
+
+	for path := range paths {
+		os.RemoveAll(path)
+		derived, _ := filepath.Glob(globEscape(path) + ".*")
+		for _, p := range derived {
+			os.RemoveAll(p)
+		}
+	}
+	return len(paths)
+}
+
+func globEscape(path string) string {
+	return strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`).Replace(path)
+}
+
+// sweepStaleTempFiles deletes temp files and directories whose names
+// start with one of prefixes and that haven't been modified in
+// staleTempFileAge: leftovers of a server that was killed rather than
+// shut down.
+func sweepStaleTempFiles(dir string, prefixes ...string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("couldn't sweep temp directory %s: %v", dir, err)
+		return
+	}
+	cutoff := time.Now().Add(-staleTempFileAge)
+	removed := 0
+	for _, entry := range entries {
+		if !hasAnyPrefix(entry.Name(), prefixes) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("couldn't remove stale temp file %s: %v", entry.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("removed %d stale temp files from %s", removed, dir)
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
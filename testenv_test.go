@@ -0,0 +1,292 @@
+package main
+
+// testEnv is the unit-test counterpart of the integration harness: the
+// real handler over a temp SQLite database, with S3 played by an in-memory
+// fake so no service or docker is needed. ffmpeg isn't required either;
+// when it's missing, uploads are stored unprocessed.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+	"github.com/google/uuid"
+)
+
+const (
+	testBucket = "tubely-test"
+	testCDN    = "cdn.unit.test"
+	testAdmin  = "test-admin"
+)
+
+type testEnv struct {
+	cfg    *apiConfig
+	server *httptest.Server
+	s3     *storagetest.FakeS3
+}
+
+// newTestEnv builds an apiConfig like main does, with every limit off,
+// lets configure adjust it before the handler is built, and serves it.
+func newTestEnv(t testing.TB, configure ...func(cfg *apiConfig)) *testEnv {
+	t.Helper()
+	fake := storagetest.NewFakeS3(t)
+
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+	assetsRoot := filepath.Join(dir, "assets")
+	if err := os.Mkdir(assetsRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &apiConfig{
+		db:               db,
+		jwtSecret:        "unit-secret",
+		platform:         "dev",
+		filepathRoot:     dir,
+		assetsRoot:       assetsRoot,
+		s3Bucket:         testBucket,
+		s3Region:         "us-east-1",
+		s3CfDistribution: testCDN,
+		port:             "0",
+		appName:          defaultAppName,
+		assetsPath:       defaultAssetsPath,
+		s3Client:         fake.Client(),
+
+		s3ThumbnailBucket: testBucket,
+		s3ArtifactsBucket: testBucket,
+
+		passwordAttempts: newPasswordAttemptLimiter(),
+		scanner:          noopScanner{},
+		adminToken:       testAdmin,
+		settings:         newSettingsStore(new(slog.LevelVar)),
+
+		uploadThroughput:     &throughputEstimator{},
+		maxThumbnailBytes:    defaultMaxThumbnailBytes,
+		maxVideoUploadBytes:  defaultMaxVideoUploadBytes,
+		maxPartSize:          64 << 20,
+		maxUploadConcurrency: 4,
+		uploadPartAttempts:   1,
+
+		configSources:    map[string]string{},
+		accessEvents:     newAccessRecorder(db),
+		partialUploads:   newPartialUploadStore(),
+		uploadSessions:   newUploadSessionStore(time.Hour, defaultMaxUploadSessionsPerUser),
+		assetsDisk:       newAssetsDisk(assetsRoot),
+		admission:        newAdmissionController(admissionLimits{}),
+		uploadLimiter:    newUploadRateLimiter(0, 0),
+		trashRetention:   7 * 24 * time.Hour,
+		idempotencyLocks: newIdempotencyLocks(),
+		readiness:        &readinessChecker{},
+		downloadLimiter:  newBandwidthLimiter(0, 0),
+		uploadProgress:   newProgressStore(),
+
+		fastStartFailurePolicy: fastStartFailureReject,
+		thumbnailPolicy:        defaultThumbnailPolicy(),
+		presignExpiry:          defaultURLExpiry,
+		presignMaxExpiry:       defaultMaxURLExpiry,
+		presignCache:           newPresignCache(defaultPresignCacheSize),
+		processingQueue:        newProcessingQueue(4),
+
+		tools:                   detectTools(),
+		allowUnprocessedUploads: true,
+	}
+	for _, f := range configure {
+		f(cfg)
+	}
+	cfg.initStorage(storageBackendS3)
+
+	cfg.processingQueue.start(1, cfg.processVideoJob)
+	t.Cleanup(func() { cfg.processingQueue.drain(context.Background()) })
+
+	server := httptest.NewServer(cfg.newHandler(false))
+	t.Cleanup(server.Close)
+	return &testEnv{cfg: cfg, server: server, s3: fake}
+}
+
+// do sends a request to the server, with token as the bearer token when
+// set, and returns the response with its body read.
+func (env *testEnv) do(t testing.TB, method, path, token, contentType string, body io.Reader, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, env.server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	client := env.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return resp, data
+}
+
+// doJSON sends in as JSON, fails t unless the response has status want,
+// and decodes the response into out when it isn't nil.
+func (env *testEnv) doJSON(t testing.TB, method, path, token string, in any, want int, out any) {
+	t.Helper()
+	var body io.Reader
+	if in != nil {
+		body = jsonBody(t, in)
+	}
+	resp, data := env.do(t, method, path, token, "application/json", body)
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: got %d, want %d: %s", method, path, resp.StatusCode, want, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", method, path, data, err)
+		}
+	}
+}
+
+// jsonBody encodes v as a request body.
+func jsonBody(t testing.TB, v any) io.Reader {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(data)
+}
+
+// createUser signs up a fresh user and logs in, returning the user's ID
+// and access token.
+func (env *testEnv) createUser(t testing.TB) (uuid.UUID, string) {
+	t.Helper()
+	creds := map[string]string{
+		"email":    uuid.NewString() + "@unit.test",
+		"password": "unit-password",
+	}
+	env.doJSON(t, http.MethodPost, "/api/users", "", creds, http.StatusCreated, nil)
+
+	var login struct {
+		ID    uuid.UUID `json:"id"`
+		Token string    `json:"token"`
+	}
+	env.doJSON(t, http.MethodPost, "/api/login", "", creds, http.StatusOK, &login)
+	return login.ID, login.Token
+}
+
+// createVideo creates a draft titled title and returns it.
+func (env *testEnv) createVideo(t testing.TB, token, title string) videoResponse {
+	t.Helper()
+	var video videoResponse
+	env.doJSON(t, http.MethodPost, "/api/videos", token, map[string]string{
+		"title":       title,
+		"description": "unit test video",
+	}, http.StatusCreated, &video)
+	return video
+}
+
+// uploadVideo sends data as videoID's video in a multipart form and
+// returns the response.
+func (env *testEnv) uploadVideo(t testing.TB, token, videoID string, data []byte, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="video"; filename=%q`, "video.mp4"))
+	header.Set("Content-Type", "video/mp4")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+	return env.do(t, http.MethodPost, "/api/video_upload/"+videoID, token, mw.FormDataContentType(), &body, headers...)
+}
+
+// updateVideo applies change to the stored row of videoID, for setting up
+// state no endpoint produces without ffmpeg.
+func (env *testEnv) updateVideo(t testing.TB, videoID string, change func(video *database.Video)) {
+	t.Helper()
+	video, err := env.cfg.db.GetVideo(mustParseUUID(t, videoID), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(&video)
+	if err := env.cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForProcessing polls videoID's status until its latest upload is no
+// longer pending and returns that status.
+func (env *testEnv) waitForProcessing(t testing.TB, token, videoID string) videoStatusResponse {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status videoStatusResponse
+		env.doJSON(t, http.MethodGet, "/api/videos/"+videoID+"/status", token, nil, http.StatusOK, &status)
+		if status.ProcessingStatus == nil || *status.ProcessingStatus != database.ProcessingStatusPending {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("video %s was still pending after 5s", videoID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mustParseUUID(t testing.TB, s string) uuid.UUID {
+	t.Helper()
+	id, err := uuid.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// errorCode returns the code of an error response body.
+func errorCode(t testing.TB, body []byte) string {
+	t.Helper()
+	var resp struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decoding error %s: %v", body, err)
+	}
+	return resp.Error.Code
+}
+
+// decodeJSON unmarshals a response body into out.
+func decodeJSON(t testing.TB, body []byte, out any) {
+	t.Helper()
+	if err := json.Unmarshal(body, out); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+}
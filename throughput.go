@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+const (
+	// throughputSmoothing weights the newest sample in the moving average.
+	throughputSmoothing = 0.3
+	// minThroughputSample skips uploads too small to say anything about
+	// bandwidth; they're dominated by request latency.
+	minThroughputSample = int64(8 << 20)
+	// targetPartDuration is how long one part should take at the estimated
+	// rate: long enough to amortize request overhead, short enough that a
+	// retry is cheap.
+	targetPartDuration = 2 * time.Second
+	// bytesPerSecondPerStream is the rate one upload stream is assumed to
+	// sustain when deciding how many to run at once.
+	bytesPerSecondPerStream = 25 << 20
+)
+
+// throughputEstimator keeps a moving average of server-to-S3 upload speed.
+type throughputEstimator struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+	samples     int
+}
+
+// observe records one completed upload.
+func (e *throughputEstimator) observe(size int64, elapsed time.Duration) {
+	if size < minThroughputSample || elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed.Seconds()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.bytesPerSec = rate
+	} else {
+		e.bytesPerSec = throughputSmoothing*rate + (1-throughputSmoothing)*e.bytesPerSec
+	}
+	e.samples++
+}
+
+// estimate returns the current average in bytes per second and how many
+// uploads it's based on.
+func (e *throughputEstimator) estimate() (float64, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bytesPerSec, e.samples
+}
+
+// uploadParams picks the multipart part size and concurrency for the next
+// large upload, within [manager.MinUploadPartSize, maxPartSize] and
+// [1, maxConcurrency]. Without samples it keeps the SDK defaults.
+func (e *throughputEstimator) uploadParams(maxPartSize int64, maxConcurrency int) (int64, int) {
+	rate, samples := e.estimate()
+	if samples == 0 {
+		return manager.DefaultUploadPartSize, min(manager.DefaultUploadConcurrency, maxConcurrency)
+	}
+
+	partSize := int64(rate * targetPartDuration.Seconds())
+	partSize = max(manager.MinUploadPartSize, min(partSize, maxPartSize))
+
+	concurrency := int(rate/bytesPerSecondPerStream) + 1
+	concurrency = max(1, min(concurrency, maxConcurrency))
+	return partSize, concurrency
+}
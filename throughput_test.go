@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+func TestThroughputEstimatorAverages(t *testing.T) {
+	var e throughputEstimator
+
+	// Small uploads say nothing about bandwidth
+	e.observe(1<<20, time.Second)
+	if _, samples := e.estimate(); samples != 0 {
+		t.Fatalf("a 1MiB upload was sampled")
+	}
+
+	e.observe(100<<20, 10*time.Second)
+	rate, samples := e.estimate()
+	if samples != 1 || rate != 10<<20 {
+		t.Fatalf("estimate = %v from %d, want the first sample's 10MiB/s", rate, samples)
+	}
+
+	// Later samples move the average by throughputSmoothing
+	e.observe(200<<20, 10*time.Second)
+	rate, samples = e.estimate()
+	want := throughputSmoothing*(20<<20) + (1-throughputSmoothing)*(10<<20)
+	if samples != 2 || math.Abs(rate-want) > 1 {
+		t.Errorf("estimate = %v from %d, want %v from 2", rate, samples, want)
+	}
+}
+
+func TestThroughputUploadParams(t *testing.T) {
+	const maxPartSize, maxConcurrency = 64 << 20, 4
+	tests := []struct {
+		name           string
+		rate           float64
+		partSize       int64
+		concurrency    int
+		withoutSamples bool
+	}{
+		{name: "no samples", withoutSamples: true, partSize: manager.DefaultUploadPartSize, concurrency: min(manager.DefaultUploadConcurrency, maxConcurrency)},
+		{name: "slow link", rate: 1 << 20, partSize: manager.MinUploadPartSize, concurrency: 1},
+		{name: "moderate link", rate: 10 << 20, partSize: 20 << 20, concurrency: 1},
+		{name: "fast link", rate: 60 << 20, partSize: maxPartSize, concurrency: 3},
+		{name: "very fast link", rate: 500 << 20, partSize: maxPartSize, concurrency: maxConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e throughputEstimator
+			if !tt.withoutSamples {
+				e.observe(int64(tt.rate*10), 10*time.Second)
+			}
+			partSize, concurrency := e.uploadParams(maxPartSize, maxConcurrency)
+			if partSize != tt.partSize || concurrency != tt.concurrency {
+				t.Errorf("uploadParams = %d, %d; want %d, %d", partSize, concurrency, tt.partSize, tt.concurrency)
+			}
+		})
+	}
+}
+
+func TestAdminStatsReportThroughput(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.uploadThroughput.observe(300<<20, 10*time.Second)
+
+	var stats struct {
+		S3Upload struct {
+			ThroughputBytesPerSecond float64 `json:"throughput_bytes_per_second"`
+			Samples                  int     `json:"samples"`
+			NextPartSize             int64   `json:"next_part_size"`
+			NextConcurrency          int     `json:"next_concurrency"`
+		} `json:"s3_upload"`
+	}
+	env.doJSON(t, http.MethodGet, "/admin/stats", testAdmin, nil, http.StatusOK, &stats)
+	got := stats.S3Upload
+	if got.Samples != 1 || got.ThroughputBytesPerSecond != 30<<20 {
+		t.Errorf("throughput = %v from %d samples, want 30MiB/s from 1", got.ThroughputBytesPerSecond, got.Samples)
+	}
+	if got.NextPartSize != 60<<20 || got.NextConcurrency != 2 {
+		t.Errorf("next part size %d at concurrency %d, want 60MiB at 2", got.NextPartSize, got.NextConcurrency)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// defaultMaxThumbnailBytes caps the decoded size of an uploaded thumbnail
+// unless MAX_THUMBNAIL_UPLOAD_BYTES or THUMBNAIL_MAX_MB changes it.
+const defaultMaxThumbnailBytes = 10 << 20 // 10 MB
+
+// contentAssetName names a stored asset by the hex SHA-256 of its bytes,
+// so uploading the same image twice stores it once.
+func contentAssetName(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// thumbnailUpload is a thumbnail received by one of the upload endpoints.
+type thumbnailUpload struct {
+	data      []byte
+	mediaType string
+	grid      bool
+}
+
+// ingestThumbnail validates, stores and records a thumbnail for video. The
+// multipart and JSON endpoints both go through here so the two can't drift.
+// It returns how the thumbnail was stored under cfg.thumbnailPolicy and
+// warnings for optional steps that failed.
+func (cfg *apiConfig) ingestThumbnail(ctx context.Context, video *database.Video, upload thumbnailUpload) (thumbnailEncoding, []string, error) {
+	format, ok := thumbnailFormats[upload.mediaType]
+	if !ok {
+		return thumbnailEncoding{}, nil, &statusError{status: http.StatusBadRequest, msg: "Unsupported media type; only " + thumbnailTypeNames + " are allowed", code: errorCodeInvalidMediaType}
+	}
+	if int64(len(upload.data)) > cfg.maxThumbnailBytes {
+		return thumbnailEncoding{}, nil, &statusError{status: http.StatusRequestEntityTooLarge, msg: "Thumbnail is too large", code: errorCodeUploadTooLarge}
+	}
+	// The extension is only trusted because the bytes match the declared type
+	if !format.sniff(upload.data) {
+		return thumbnailEncoding{}, nil, &statusError{status: http.StatusUnsupportedMediaType, msg: "Thumbnail content doesn't match its declared type", code: errorCodeInvalidMediaType}
+	}
+	if err := cfg.scanUpload(ctx, bytes.NewReader(upload.data)); err != nil {
+		return thumbnailEncoding{}, nil, err
+	}
+
+	encoding := thumbnailEncoding{UploadedType: upload.mediaType}
+	source, err := cfg.decodableThumbnail(ctx, upload.data, format)
+	var data []byte
+	if err == nil {
+		data, encoding, err = cfg.thumbnailPolicy.apply(source, upload.mediaType)
+	}
+	var invalid *invalidThumbnailError
+	if errors.As(err, &invalid) {
+		return encoding, nil, &statusError{status: http.StatusBadRequest, msg: "Invalid thumbnail: " + invalid.reason, code: errorCodeInvalidImage, err: err}
+	}
+	if err != nil {
+		return encoding, nil, &statusError{status: http.StatusUnprocessableEntity, msg: "Couldn't re-encode thumbnail", err: err}
+	}
+	mediaType := encoding.StoredType
+	ext := thumbnailFormats[mediaType].ext
+
+	name := contentAssetName(data)
+	filename := shardedAssetName(name + ext)
+
+	storedURL, err := cfg.storeThumbnail(ctx, filename, mediaType, data)
+	if err != nil {
+		if errors.Is(err, errAssetsDiskFull) {
+			return encoding, nil, &statusError{status: http.StatusInsufficientStorage, msg: "Thumbnail storage is full", code: errorCodeAssetsDiskFull, err: err}
+		}
+		return encoding, nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to store thumbnail", err: err}
+	}
+
+	previousURL, previousGridURL, previousModernURL := video.ThumbnailURL, video.ThumbnailGridURL, video.ThumbnailModernURL
+	video.ThumbnailURL = &storedURL
+	video.ThumbnailWidth, video.ThumbnailHeight = &encoding.Width, &encoding.Height
+	video.ThumbnailGridURL = nil
+	video.ThumbnailModernURL = nil
+
+	var warnings []string
+	if format.modern {
+		modernURL, warning := cfg.storeModernThumbnail(ctx, video, upload, format, encoding)
+		if modernURL != "" {
+			video.ThumbnailModernURL = &modernURL
+			encoding.ModernType = upload.mediaType
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	// Optionally produce a 16:9 grid variant alongside the native thumbnail
+	// Grids are optional, so they're skipped while the disk is full
+	if upload.grid && cfg.thumbnailDiskFull() {
+		warnings = append(warnings, "Skipped grid thumbnail: storage is full")
+	} else if upload.grid {
+		gridURL, err := cfg.storeGridThumbnail(ctx, name, mediaType, data)
+		if err != nil {
+			log.Printf("couldn't create grid thumbnail for video %s: %v", video.ID, err)
+			warnings = append(warnings, "Couldn't create grid thumbnail")
+		} else {
+			video.ThumbnailGridURL = &gridURL
+		}
+	}
+
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		cfg.removeThumbnails(ctx, video.ThumbnailURL, video.ThumbnailGridURL, video.ThumbnailModernURL)
+		return encoding, nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to update video thumbnail URL", err: err}
+	}
+	cfg.removeThumbnails(ctx, previousURL, previousGridURL, previousModernURL)
+	return encoding, warnings, nil
+}
+
+// storeGridThumbnail stores the 16:9 grid variant of the thumbnail data,
+// whose asset name is name, and returns its URL. The grid is derived from
+// the thumbnail, so an existing one is reused.
+func (cfg *apiConfig) storeGridThumbnail(ctx context.Context, name, mediaType string, data []byte) (string, error) {
+	gridFilename := shardedAssetName(name + "_grid" + thumbnailFormats[mediaType].ext)
+	return cfg.storeDerivedThumbnail(ctx, gridFilename, mediaType, func() ([]byte, error) {
+		return gridThumbnail(data, mediaType, cfg.thumbnailPolicy)
+	})
+}
+
+// decodableThumbnail returns data in a form the image package can decode:
+// as uploaded, or converted to PNG by ffmpeg for formats Go can't read.
+// The declared dimensions are checked before ffmpeg allocates anything.
+func (cfg *apiConfig) decodableThumbnail(ctx context.Context, data []byte, format thumbnailFormat) ([]byte, error) {
+	if !format.external {
+		return data, nil
+	}
+	if width, height, ok := avifDimensions(data); ok {
+		if err := cfg.thumbnailPolicy.checkDimensions(width, height); err != nil {
+			return nil, err
+		}
+	}
+	decoded, err := decodeImageWithFFmpeg(ctx, cfg.appName, data, format.ext)
+	if err != nil {
+		log.Printf("couldn't decode thumbnail with ffmpeg: %v", err)
+		return nil, &invalidThumbnailError{"couldn't decode image"}
+	}
+	return decoded, nil
+}
+
+// storeModernThumbnail stores a WebP or AVIF upload as it was sent, next
+// to the fallback ingestThumbnail stored, so pages can offer both with
+// <picture>. The original is only kept when it needed no scaling and its
+// metadata can be removed, since it can't be re-encoded. It returns the
+// stored URL, or a warning when the original couldn't be kept.
+func (cfg *apiConfig) storeModernThumbnail(ctx context.Context, video *database.Video, upload thumbnailUpload, format thumbnailFormat, encoding thumbnailEncoding) (string, string) {
+	if encoding.Resized {
+		return "", ""
+	}
+	var data []byte
+	switch upload.mediaType {
+	case "image/webp":
+		stripped, ok := stripWebPMetadata(upload.data)
+		if !ok {
+			return "", ""
+		}
+		data = stripped
+	case "image/avif":
+		if avifHasMetadata(upload.data) {
+			return "", ""
+		}
+		data = upload.data
+	}
+	if cfg.thumbnailDiskFull() {
+		return "", "Skipped " + upload.mediaType + " thumbnail: storage is full"
+	}
+	filename := shardedAssetName(contentAssetName(data) + format.ext)
+	storedURL, err := cfg.storeThumbnail(ctx, filename, upload.mediaType, data)
+	if err != nil {
+		log.Printf("couldn't store %s thumbnail for video %s: %v", upload.mediaType, video.ID, err)
+		return "", "Couldn't store " + upload.mediaType + " thumbnail"
+	}
+	return storedURL, ""
+}
+
+// autoThumbnailOffset is where the frame for a generated thumbnail is taken
+// from, pulled in to a tenth of the duration for very short clips.
+const autoThumbnailOffset = 1.0
+
+// autoThumbnail gives video a thumbnail taken from the video file at path,
+// for the many uploads that never get one of their own. It is best effort:
+// failures, e.g. for audio-only files, are logged and leave the thumbnail
+// unset.
+func (cfg *apiConfig) autoThumbnail(ctx context.Context, video *database.Video, path string, duration *float64) {
+	if cfg.thumbnailDiskFull() {
+		return
+	}
+	offset := autoThumbnailOffset
+	if duration != nil {
+		offset = min(offset, *duration/10)
+	}
+	framePath, err := generateThumbnailFromVideo(ctx, path, offset)
+	if err != nil {
+		log.Printf("couldn't generate thumbnail for video %s: %v", video.ID, err)
+		return
+	}
+	defer os.Remove(framePath)
+
+	if err := cfg.storeGeneratedThumbnail(ctx, video, framePath); err != nil {
+		log.Printf("couldn't store generated thumbnail for video %s: %v", video.ID, err)
+	}
+}
+
+// storeGeneratedThumbnail stores the JPEG at framePath as video's
+// thumbnail, following the thumbnail policy, along with its grid variant.
+// Generated thumbnails always get a grid, since no form asked for one; a
+// grid that can't be stored is logged and left out.
+func (cfg *apiConfig) storeGeneratedThumbnail(ctx context.Context, video *database.Video, framePath string) error {
+	frame, err := os.ReadFile(framePath)
+	if err != nil {
+		return err
+	}
+	data, encoding, err := cfg.thumbnailPolicy.apply(frame, "image/jpeg")
+	if err != nil {
+		return err
+	}
+	name := contentAssetName(data)
+	filename := shardedAssetName(name + thumbnailFormats[encoding.StoredType].ext)
+	storedURL, err := cfg.storeThumbnail(ctx, filename, encoding.StoredType, data)
+	if err != nil {
+		return err
+	}
+	video.ThumbnailURL = &storedURL
+	video.ThumbnailWidth, video.ThumbnailHeight = &encoding.Width, &encoding.Height
+	video.ThumbnailGridURL = nil
+
+	if cfg.thumbnailDiskFull() {
+		return nil
+	}
+	gridURL, err := cfg.storeGridThumbnail(ctx, name, encoding.StoredType, data)
+	if err != nil {
+		log.Printf("couldn't create grid thumbnail for video %s: %v", video.ID, err)
+		return nil
+	}
+	video.ThumbnailGridURL = &gridURL
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errNotLocalAsset marks thumbnail URLs that don't point into assetsRoot.
+var errNotLocalAsset = errors.New("not a local asset")
+
+// fixThumbnailExtension renames the asset behind thumbnailURL so its
+// extension matches its sniffed format, returning the new URL and whether
+// anything changed.
+func (cfg *apiConfig) fixThumbnailExtension(thumbnailURL string) (string, bool, error) {
+	filename, ok := cfg.localAssetName(thumbnailURL)
+	if !ok {
+		return "", false, errNotLocalAsset
+	}
+
+	oldPath := cfg.assetPath(filename)
+	f, err := os.Open(oldPath)
+	if err != nil {
+		return "", false, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	f.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", false, err
+	}
+
+	format, ok := thumbnailFormats[sniffThumbnailType(head[:n])]
+	if !ok {
+		return "", false, errors.New("unrecognized image format")
+	}
+	ext := format.ext
+	currentExt := filepath.Ext(filename)
+	if currentExt == ext {
+		return thumbnailURL, false, nil
+	}
+
+	newName := strings.TrimSuffix(filename, currentExt) + ext
+	newPath := cfg.assetPath(newName)
+	if _, err := os.Stat(newPath); err == nil {
+		return "", false, errors.New("target " + newName + " already exists")
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return "", false, err
+	}
+	return cfg.assetURL(newName), true, nil
+}
+
+// handlerThumbnailExtensionBackfill renames legacy thumbnails stored as
+// .img or under an extension that doesn't match their content, and points
+// the videos at the new files.
+func (cfg *apiConfig) handlerThumbnailExtensionBackfill(w http.ResponseWriter, r *http.Request) {
+	type failure struct {
+		VideoID string `json:"video_id"`
+		Error   string `json:"error"`
+	}
+	type response struct {
+		Checked int       `json:"checked"`
+		Renamed int       `json:"renamed"`
+		Failed  []failure `json:"failed"`
+	}
+
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	videos, err := cfg.db.GetVideosWithThumbnails()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	resp := response{Failed: []failure{}}
+	for _, video := range videos {
+		changed := false
+		for _, field := range []**string{&video.ThumbnailURL, &video.ThumbnailGridURL, &video.ThumbnailModernURL} {
+			if *field == nil {
+				continue
+			}
+			newURL, renamed, err := cfg.fixThumbnailExtension(**field)
+			if errors.Is(err, errNotLocalAsset) {
+				continue
+			}
+			resp.Checked++
+			if err != nil {
+				resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: err.Error()})
+				continue
+			}
+			if renamed {
+				*field = &newURL
+				changed = true
+				resp.Renamed++
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := cfg.db.UpdateVideo(video); err != nil {
+			resp.Failed = append(resp.Failed, failure{VideoID: video.ID.String(), Error: "couldn't update video: " + err.Error()})
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path"
+
+	// Registers the WebP decoder with the image package
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailFormat describes one accepted thumbnail type.
+type thumbnailFormat struct {
+	// ext is the one extension the type is stored under.
+	ext string
+	// sniff reports whether data starts like the format.
+	sniff func(data []byte) bool
+	// modern formats aren't supported everywhere, so they are stored
+	// next to a JPEG (or PNG) fallback rather than instead of one.
+	modern bool
+	// external formats have no Go decoder and are decoded with ffmpeg.
+	external bool
+}
+
+// thumbnailFormats is the allowlist of thumbnail types. Anything else is
+// rejected as an unsupported media type.
+var thumbnailFormats = map[string]thumbnailFormat{
+	"image/jpeg": {ext: ".jpg", sniff: isJPEG},
+	"image/png":  {ext: ".png", sniff: isPNG},
+	"image/webp": {ext: ".webp", sniff: isWebP, modern: true},
+	"image/avif": {ext: ".avif", sniff: isAVIF, modern: true, external: true},
+}
+
+// thumbnailTypeNames lists the accepted types for error messages.
+const thumbnailTypeNames = "image/jpeg, image/png, image/webp and image/avif"
+
+// sniffThumbnailType returns the thumbnail type data's magic bytes match,
+// or "" if none does.
+func sniffThumbnailType(data []byte) string {
+	for mediaType, format := range thumbnailFormats {
+		if format.sniff(data) {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// thumbnailTypeForName returns the type of a stored thumbnail from its
+// extension, or "" for one that isn't a thumbnail format.
+func thumbnailTypeForName(name string) string {
+	ext := path.Ext(name)
+	for mediaType, format := range thumbnailFormats {
+		if format.ext == ext {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+func isJPEG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff})
+}
+
+func isPNG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n"))
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// isAVIF checks for an ftyp box naming avif or avis as its major or a
+// compatible brand.
+func isAVIF(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 16 || size > len(data) {
+		return false
+	}
+	// Major brand, minor version, then compatible brands
+	brands := append([]byte{}, data[8:12]...)
+	brands = append(brands, data[16:size]...)
+	for i := 0; i+4 <= len(brands); i += 4 {
+		if brand := string(brands[i : i+4]); brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+	return false
+}
+
+// stripWebPMetadata returns data without its EXIF and XMP chunks, so the
+// stored original doesn't leak what re-encoding strips from the fallback.
+// Chunks are otherwise kept as they are; the VP8X header's flags for the
+// removed chunks are cleared.
+func stripWebPMetadata(data []byte) ([]byte, bool) {
+	if !isWebP(data) {
+		return nil, false
+	}
+	out := append([]byte{}, data[:12]...)
+	vp8x := -1
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, false
+		}
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(data) {
+			return nil, false
+		}
+		if fourCC != "EXIF" && fourCC != "XMP " {
+			if fourCC == "VP8X" {
+				vp8x = len(out)
+			}
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	if vp8x >= 0 && vp8x+9 <= len(out) {
+		// Clear the EXIF (0x08) and XMP (0x04) flags
+		out[vp8x+8] &^= 0x0c
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, true
+}
+
+// avifHasMetadata reports whether the AVIF in data carries EXIF or XMP
+// items, looking for their item types in the top-level meta box. It errs
+// towards yes for anything it can't parse.
+func avifHasMetadata(data []byte) bool {
+	for i := 0; i+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		boxType := string(data[i+4 : i+8])
+		if size < 8 || i+size > len(data) {
+			return true
+		}
+		if boxType == "meta" {
+			meta := data[i : i+size]
+			return bytes.Contains(meta, []byte("Exif")) || bytes.Contains(meta, []byte("mime"))
+		}
+		i += size
+	}
+	return true
+}
+
+// avifDimensions reads the image size from the AVIF in data's ispe
+// property, so it can be checked before anything decodes the image.
+func avifDimensions(data []byte) (int, int, bool) {
+	i := bytes.Index(data, []byte("ispe"))
+	// Box type, version and flags, then 32-bit width and height
+	if i < 0 || i+16 > len(data) {
+		return 0, 0, false
+	}
+	width := binary.BigEndian.Uint32(data[i+8:])
+	height := binary.BigEndian.Uint32(data[i+12:])
+	return int(width), int(height), true
+}
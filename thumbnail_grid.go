@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Grid thumbnails are normalized to a 16:9 canvas so portrait and landscape
+// videos line up in grid UIs.
+const (
+	gridAspectW = 16
+	gridAspectH = 9
+)
+
+// gridThumbnail decodes the thumbnail data, pads it onto a 16:9 canvas and
+// encodes it as mediaType per policy.
+func gridThumbnail(data []byte, mediaType string, policy thumbnailPolicy) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode thumbnail: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := policy.encode(&buf, padToGrid(img), mediaType); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// padToGrid centers img on the smallest 16:9 canvas that contains it, filling
+// the bars with the image's average color.
+func padToGrid(img image.Image) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	cw, ch := w, h
+	if w*gridAspectH >= h*gridAspectW {
+		ch = (w*gridAspectH + gridAspectW/2) / gridAspectW
+	} else {
+		cw = (h*gridAspectW + gridAspectH/2) / gridAspectH
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, cw, ch))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{averageColor(img)}, image.Point{}, draw.Src)
+
+	offset := image.Pt((cw-w)/2, (ch-h)/2)
+	draw.Draw(canvas, image.Rectangle{Min: offset, Max: offset.Add(b.Size())}, img, b.Min, draw.Over)
+	return canvas
+}
+
+// averageColor approximates the dominant color by averaging a sparse sample
+// of pixels.
+func averageColor(img image.Image) color.Color {
+	b := img.Bounds()
+	step := max(1, min(b.Dx(), b.Dy())/64)
+
+	var r, g, bl, n uint64
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			pr, pg, pb, _ := img.At(x, y).RGBA()
+			r += uint64(pr >> 8)
+			g += uint64(pg >> 8)
+			bl += uint64(pb >> 8)
+			n++
+		}
+	}
+	if n == 0 {
+		return color.Black
+	}
+	return color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: 0xff}
+}
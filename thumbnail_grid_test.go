@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// solidImage is a w×h image filled with c.
+func solidImage(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	return img
+}
+
+func TestPadToGridDimensions(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		gridW, gridH  int
+	}{
+		{"portrait", 90, 160, 284, 160},
+		{"landscape", 1920, 1080, 1920, 1080},
+		{"wide landscape", 400, 100, 400, 225},
+		{"square", 300, 300, 533, 300},
+		{"odd sizes", 101, 57, 101, 57},
+	}
+	red := color.RGBA{R: 0xc0, A: 0xff}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grid := padToGrid(solidImage(tt.width, tt.height, red))
+			b := grid.Bounds()
+			if b.Dx() != tt.gridW || b.Dy() != tt.gridH {
+				t.Fatalf("padToGrid(%dx%d) = %dx%d, want %dx%d", tt.width, tt.height, b.Dx(), b.Dy(), tt.gridW, tt.gridH)
+			}
+			// The bars take the color of the image they surround
+			for _, p := range []image.Point{{0, 0}, {b.Dx() - 1, b.Dy() - 1}, {b.Dx() / 2, b.Dy() / 2}} {
+				if got := color.RGBAModel.Convert(grid.At(p.X, p.Y)); got != red {
+					t.Errorf("pixel at %v = %v, want %v", p, got, red)
+				}
+			}
+		})
+	}
+}
+
+func TestPadToGridCentersImage(t *testing.T) {
+	// Mark the image's corners to find where it was drawn
+	img := solidImage(90, 160, color.White)
+	img.Set(0, 0, color.Black)
+	img.Set(89, 159, color.Black)
+
+	grid := padToGrid(img)
+	left := (grid.Bounds().Dx() - 90) / 2
+	for _, p := range []image.Point{{left, 0}, {left + 89, 159}} {
+		if got := color.GrayModel.Convert(grid.At(p.X, p.Y)).(color.Gray); got.Y > 0x10 {
+			t.Errorf("pixel at %v = %v, want the image's black corner", p, got)
+		}
+	}
+}
+
+func TestGeneratedThumbnailGetsGrid(t *testing.T) {
+	env := newTestEnv(t)
+	var frame bytes.Buffer
+	if err := jpeg.Encode(&frame, solidImage(90, 160, color.RGBA{B: 0xc0, A: 0xff}), nil); err != nil {
+		t.Fatal(err)
+	}
+	framePath := filepath.Join(t.TempDir(), "frame.jpg")
+	if err := os.WriteFile(framePath, frame.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var video database.Video
+	if err := env.cfg.storeGeneratedThumbnail(context.Background(), &video, framePath); err != nil {
+		t.Fatal(err)
+	}
+	if video.ThumbnailURL == nil || video.ThumbnailGridURL == nil {
+		t.Fatalf("thumbnail_url = %v, thumbnail_grid_url = %v; want both", video.ThumbnailURL, video.ThumbnailGridURL)
+	}
+
+	for name, storedURL := range map[string]string{"native": *video.ThumbnailURL, "grid": *video.ThumbnailGridURL} {
+		bucket, key, ok := strings.Cut(storedURL, ",")
+		if !ok {
+			t.Fatalf("%s thumbnail URL %q isn't a bucket and key", name, storedURL)
+		}
+		object, ok := env.s3.Object(bucket, key)
+		if !ok {
+			t.Fatalf("%s thumbnail %s isn't stored", name, storedURL)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(object.Data))
+		if err != nil {
+			t.Fatalf("decoding %s thumbnail: %v", name, err)
+		}
+		want := image.Pt(90, 160)
+		if name == "grid" {
+			want = image.Pt(284, 160)
+		}
+		if config.Width != want.X || config.Height != want.Y {
+			t.Errorf("%s thumbnail is %dx%d, want %dx%d", name, config.Width, config.Height, want.X, want.Y)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// maxThumbnailPixels caps width × height, whatever the per-side limit, so
+// a small file declaring huge dimensions (a decompression bomb) is
+// rejected before anything is allocated for it.
+const maxThumbnailPixels = 40_000_000
+
+// invalidThumbnailError is a thumbnail that can't be decoded or whose
+// dimensions are out of bounds: a problem with the upload, not the server.
+type invalidThumbnailError struct {
+	reason string
+}
+
+func (e *invalidThumbnailError) Error() string {
+	return "invalid thumbnail: " + e.reason
+}
+
+// thumbnailFormatNames are the format names accepted in THUMBNAIL_FORMATS.
+var thumbnailFormatNames = map[string]string{
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// pngCompressionNames maps THUMBNAIL_PNG_COMPRESSION values to levels.
+var pngCompressionNames = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// thumbnailPolicy decides how stored thumbnails and their variants are
+// encoded. The stored format is recorded by each file's extension, so
+// changing the policy only affects thumbnails uploaded afterwards.
+type thumbnailPolicy struct {
+	// outputs maps an upload's media type to the type it's stored as.
+	// Types without an entry are stored as JPEG, or as PNG when the image
+	// has transparency.
+	outputs        map[string]string
+	jpegQuality    int
+	pngCompression string
+	// maxDimension rejects images wider or taller than this many pixels.
+	maxDimension int
+	// maxWidth is the width larger images are scaled down to, keeping
+	// their aspect ratio.
+	maxWidth int
+	// preserveOriginal keeps the uploaded bytes when no conversion or
+	// scaling is needed, metadata included. Otherwise every thumbnail is
+	// re-encoded with the settings above, which strips EXIF and the like.
+	preserveOriginal bool
+}
+
+func defaultThumbnailPolicy() thumbnailPolicy {
+	return thumbnailPolicy{
+		outputs:        map[string]string{},
+		jpegQuality:    85,
+		pngCompression: "default",
+		maxDimension:   8192,
+		maxWidth:       1280,
+	}
+}
+
+// parseThumbnailFormats parses THUMBNAIL_FORMATS, a comma-separated list of
+// input=output format names such as "png=jpeg".
+func parseThumbnailFormats(v string) (map[string]string, error) {
+	outputs := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't input=output", pair)
+		}
+		in, ok := thumbnailFormatNames[strings.ToLower(strings.TrimSpace(from))]
+		if !ok {
+			return nil, fmt.Errorf("unknown input format %q", from)
+		}
+		out, ok := thumbnailFormatNames[strings.ToLower(strings.TrimSpace(to))]
+		if !ok || thumbnailFormats[out].modern {
+			// WebP and AVIF would need encoders the standard library doesn't have
+			return nil, fmt.Errorf("unsupported output format %q", to)
+		}
+		outputs[in] = out
+	}
+	return outputs, nil
+}
+
+// parseThumbnailPolicy builds the policy from the THUMBNAIL_* settings
+// returned by getenv.
+func parseThumbnailPolicy(getenv func(string) string) (thumbnailPolicy, error) {
+	policy := defaultThumbnailPolicy()
+	var err error
+	if policy.outputs, err = parseThumbnailFormats(getenv("THUMBNAIL_FORMATS")); err != nil {
+		return policy, fmt.Errorf("THUMBNAIL_FORMATS: %w", err)
+	}
+	if v := getenv("THUMBNAIL_JPEG_QUALITY"); v != "" {
+		policy.jpegQuality, err = strconv.Atoi(v)
+		if err != nil || policy.jpegQuality < 1 || policy.jpegQuality > 100 {
+			return policy, fmt.Errorf("THUMBNAIL_JPEG_QUALITY must be an integer from 1 to 100")
+		}
+	}
+	if v := getenv("THUMBNAIL_PNG_COMPRESSION"); v != "" {
+		if _, ok := pngCompressionNames[v]; !ok {
+			return policy, fmt.Errorf("THUMBNAIL_PNG_COMPRESSION must be default, none, speed or best")
+		}
+		policy.pngCompression = v
+	}
+	if v := getenv("THUMBNAIL_MAX_DIMENSION"); v != "" {
+		policy.maxDimension, err = strconv.Atoi(v)
+		if err != nil || policy.maxDimension < 1 {
+			return policy, fmt.Errorf("THUMBNAIL_MAX_DIMENSION must be a positive integer")
+		}
+	}
+	if v := getenv("THUMBNAIL_MAX_WIDTH"); v != "" {
+		policy.maxWidth, err = strconv.Atoi(v)
+		if err != nil || policy.maxWidth < 1 {
+			return policy, fmt.Errorf("THUMBNAIL_MAX_WIDTH must be a positive integer")
+		}
+	}
+	policy.preserveOriginal = getenv("THUMBNAIL_PRESERVE_ORIGINAL") == "true"
+	return policy, nil
+}
+
+// outputType returns the media type an upload of mediaType decoded as img
+// is stored as.
+func (p thumbnailPolicy) outputType(mediaType string, img image.Image) string {
+	if out, ok := p.outputs[mediaType]; ok {
+		return out
+	}
+	if hasTransparency(img) {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// hasTransparency reports whether any pixel of img isn't fully opaque.
+func hasTransparency(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDimensions rejects images too large to decode safely.
+func (p thumbnailPolicy) checkDimensions(width, height int) error {
+	if width < 1 || height < 1 {
+		return &invalidThumbnailError{"image is empty"}
+	}
+	if width > p.maxDimension || height > p.maxDimension {
+		return &invalidThumbnailError{fmt.Sprintf("%dx%d is larger than %dpx on a side", width, height, p.maxDimension)}
+	}
+	if width*height > maxThumbnailPixels {
+		return &invalidThumbnailError{fmt.Sprintf("%dx%d has more than %d pixels", width, height, maxThumbnailPixels)}
+	}
+	return nil
+}
+
+// downscale scales img down to maxWidth if it is wider, keeping its aspect
+// ratio, and reports whether it did.
+func (p thumbnailPolicy) downscale(img image.Image) (image.Image, bool) {
+	b := img.Bounds()
+	if b.Dx() <= p.maxWidth {
+		return img, false
+	}
+	height := max(1, (b.Dy()*p.maxWidth+b.Dx()/2)/b.Dx())
+	scaled := image.NewRGBA(image.Rect(0, 0, p.maxWidth, height))
+	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, xdraw.Src, nil)
+	return scaled, true
+}
+
+// encode writes img as mediaType using the policy's settings. JPEG has no
+// alpha channel, so transparent areas are flattened onto white.
+func (p thumbnailPolicy) encode(w io.Writer, img image.Image, mediaType string) error {
+	if mediaType == "image/png" {
+		enc := png.Encoder{CompressionLevel: pngCompressionNames[p.pngCompression]}
+		return enc.Encode(w, img)
+	}
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: p.jpegQuality})
+}
+
+// thumbnailEncoding tells the uploader what happened to their bytes.
+type thumbnailEncoding struct {
+	UploadedType string `json:"uploaded_type"`
+	StoredType   string `json:"stored_type"`
+	Reencoded    bool   `json:"reencoded"`
+	Resized      bool   `json:"resized"`
+	// ModernType is set when a WebP or AVIF upload was also stored as
+	// sent, next to the fallback in StoredType.
+	ModernType     string `json:"modern_type,omitempty"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	JPEGQuality    *int   `json:"jpeg_quality,omitempty"`
+	PNGCompression string `json:"png_compression,omitempty"`
+}
+
+// apply returns the bytes to store for a thumbnail of mediaType, scaled
+// down and re-encoded as the policy calls for, along with a description of
+// what was done. Images that can't be decoded or are too large fail with
+// an *invalidThumbnailError; the header is checked before any pixels are.
+func (p thumbnailPolicy) apply(data []byte, mediaType string) ([]byte, thumbnailEncoding, error) {
+	enc := thumbnailEncoding{UploadedType: mediaType}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, enc, &invalidThumbnailError{err.Error()}
+	}
+	if err := p.checkDimensions(config.Width, config.Height); err != nil {
+		return nil, enc, err
+	}
+	// Modern formats always get a fallback, so there's nothing to preserve
+	out, mapped := p.outputs[mediaType]
+	if p.preserveOriginal && !thumbnailFormats[mediaType].modern && config.Width <= p.maxWidth && (!mapped || out == mediaType) {
+		enc.StoredType, enc.Width, enc.Height = mediaType, config.Width, config.Height
+		return data, enc, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, enc, &invalidThumbnailError{err.Error()}
+	}
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+	img, enc.Resized = p.downscale(img)
+	outType := p.outputType(mediaType, img)
+	enc.StoredType = outType
+	enc.Width, enc.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	var buf bytes.Buffer
+	if err := p.encode(&buf, img, outType); err != nil {
+		return nil, enc, err
+	}
+	enc.Reencoded = true
+	if outType == "image/jpeg" {
+		quality := p.jpegQuality
+		enc.JPEGQuality = &quality
+	} else {
+		enc.PNGCompression = p.pngCompression
+	}
+	return buf.Bytes(), enc, nil
+}
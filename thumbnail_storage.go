@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// thumbnailKeyPrefix is where thumbnails are kept in the thumbnail bucket.
+const thumbnailKeyPrefix = "thumbnails/"
+
+// thumbnailStore returns the bucket thumbnails are stored in, or nil when
+// they are kept under assetsRoot. They follow STORAGE_BACKEND, so with S3
+// every instance serves the same thumbnails.
+func (cfg *apiConfig) thumbnailStore() *storage.S3 {
+	if cfg.videoStorage.Name() != storageBackendS3 {
+		return nil
+	}
+	return cfg.s3Storage.WithBucket(cfg.s3ThumbnailBucket)
+}
+
+// thumbnailDiskFull reports whether thumbnails can't be written because
+// they are kept under assetsRoot and its disk is full.
+func (cfg *apiConfig) thumbnailDiskFull() bool {
+	if cfg.thumbnailStore() != nil {
+		return false
+	}
+	_, degraded := cfg.assetsDisk.degraded()
+	return degraded
+}
+
+// storeThumbnail stores data as the thumbnail called name unless it is
+// already stored, and returns what the video row records for it: a
+// "bucket,key" pair in S3, or an assets URL.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, name, mediaType string, data []byte) (string, error) {
+	return cfg.storeDerivedThumbnail(ctx, name, mediaType, func() ([]byte, error) {
+		return data, nil
+	})
+}
+
+// storeDerivedThumbnail is storeThumbnail for a thumbnail rendered from
+// another; render is only called when name isn't stored yet. Names come
+// from the content, so an existing one already holds these bytes.
+func (cfg *apiConfig) storeDerivedThumbnail(ctx context.Context, name, mediaType string, render func() ([]byte, error)) (string, error) {
+	store := cfg.thumbnailStore()
+	if store == nil {
+		if _, err := os.Stat(cfg.assetPath(name)); err == nil {
+			return cfg.assetURL(name), nil
+		}
+		data, err := render()
+		if err != nil {
+			return "", err
+		}
+		if err := cfg.assetsDisk.writeFile(cfg.assetPath(name), data); err != nil {
+			return "", err
+		}
+		return cfg.assetURL(name), nil
+	}
+
+	key := thumbnailKeyPrefix + name
+	_, err := store.Head(ctx, key)
+	if err == nil {
+		return store.Bucket + "," + key, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+	data, err := render()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	err = timed(ctx, store.Name()+"_put", func() error {
+		opts := storage.PutOptions{ContentType: mediaType, ChecksumSHA256: sum[:], Tags: cfg.objectTags(ctx)}
+		return store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), opts)
+	}, "key", key)
+	if err != nil {
+		return "", err
+	}
+	return store.Bucket + "," + key, nil
+}
+
+// thumbnailObject returns the bucket storage and key behind a thumbnail
+// stored in S3. Anything else, such as an assets URL or a data URL, isn't
+// one.
+func (cfg *apiConfig) thumbnailObject(storedURL string) (*storage.S3, string, bool) {
+	bucket, key, ok := strings.Cut(storedURL, ",")
+	if !ok || bucket == "" || strings.ContainsAny(bucket, ":/;") || !strings.HasPrefix(key, thumbnailKeyPrefix) {
+		return nil, "", false
+	}
+	return cfg.s3Storage.WithBucket(bucket), key, true
+}
+
+// signThumbnailURLs replaces video's thumbnails with URLs clients can
+// fetch: those stored in S3 are presigned, and assets URLs are made
+// absolute against the request's base URL. A thumbnail that fails to sign
+// is left unchanged.
+func (cfg *apiConfig) signThumbnailURLs(ctx context.Context, video *database.Video) {
+	for _, field := range []**string{&video.ThumbnailURL, &video.ThumbnailGridURL, &video.ThumbnailModernURL} {
+		if presentURL(*field) == nil {
+			continue
+		}
+		store, key, ok := cfg.thumbnailObject(**field)
+		if !ok {
+			public := cfg.publicAssetURL(ctx, **field)
+			*field = &public
+			continue
+		}
+		signed, _, err := cfg.presignObject(ctx, store, key, cfg.urlExpiry(ctx))
+		if err != nil {
+			log.Printf("couldn't sign thumbnail URL for video %s: %v", video.ID, err)
+			continue
+		}
+		*field = &signed
+	}
+}
+
+// removeThumbnails deletes the thumbnails behind thumbnailURLs that no row
+// refers to, whether in S3 or under assetsRoot. Failures only leave an
+// orphan behind, so they are logged.
+func (cfg *apiConfig) removeThumbnails(ctx context.Context, thumbnailURLs ...*string) {
+	var local []*string
+	for _, u := range thumbnailURLs {
+		if presentURL(u) == nil {
+			continue
+		}
+		store, key, ok := cfg.thumbnailObject(*u)
+		if !ok {
+			local = append(local, u)
+			continue
+		}
+		if cfg.referencedElsewhere(*u, uuid.Nil) {
+			continue
+		}
+		if err := store.Delete(ctx, key); err != nil {
+			log.Printf("couldn't delete thumbnail object %s: %v", key, err)
+		}
+	}
+	cfg.removeLocalAssets(local...)
+}
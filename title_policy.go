@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxTitleSuffix bounds how far auto-suffixing counts before giving up.
+const maxTitleSuffix = 100
+
+// suffixedTitle returns title with " (n)" appended, trimming the title so
+// the result still fits maxVideoTitleLength.
+func suffixedTitle(title string, n int) string {
+	suffix := fmt.Sprintf(" (%d)", n)
+	runes := []rune(title)
+	if room := maxVideoTitleLength - utf8.RuneCountInString(suffix); len(runes) > room {
+		runes = runes[:room]
+	}
+	return string(runes) + suffix
+}
+
+// saveWithUniqueTitle calls save with title and, when it fails with
+// database.ErrDuplicateTitle and autoSuffix is set, retries with " (2)",
+// " (3)" and so on. The unique index does the checking, so concurrent
+// writers can't both win. It returns the title that was saved.
+func saveWithUniqueTitle(title string, autoSuffix bool, save func(title string) error) (string, error) {
+	err := save(title)
+	if !autoSuffix {
+		return title, err
+	}
+	for n := 2; errors.Is(err, database.ErrDuplicateTitle) && n <= maxTitleSuffix; n++ {
+		candidate := suffixedTitle(title, n)
+		if err = save(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return title, err
+}
+
+// respondWithDuplicateTitle rejects a write that would duplicate a title,
+// naming the video that already has it.
+func (cfg *apiConfig) respondWithDuplicateTitle(w http.ResponseWriter, userID uuid.UUID, title string) {
+	var conflicting *uuid.UUID
+	if id, err := cfg.db.FindVideoIDByTitle(userID, title); err == nil && id != uuid.Nil {
+		conflicting = &id
+	}
+	respondWithErrorDetails(w, http.StatusConflict, errorCodeDuplicateTitle, "You already have a video with this title", nil, map[string]any{
+		"conflicting_video_id": conflicting,
+	})
+}
+
+type titlePolicyResponse struct {
+	UniqueTitles bool `json:"unique_titles"`
+}
+
+func (cfg *apiConfig) handlerTitlePolicyGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	userID := identity.UserID
+
+	enabled, err := cfg.db.GetUniqueTitles(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get title policy", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, titlePolicyResponse{UniqueTitles: enabled})
+}
+
+// handlerTitlePolicyUpdate turns the caller's unique titles policy on or
+// off. It can't be turned on while titles are duplicated; the conflicts
+// are returned so they can be renamed first.
+func (cfg *apiConfig) handlerTitlePolicyUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		UniqueTitles bool `json:"unique_titles"`
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	userID := identity.UserID
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	err = cfg.db.SetUniqueTitles(userID, params.UniqueTitles)
+	if errors.Is(err, database.ErrDuplicateTitle) {
+		conflicts, err := cfg.db.GetTitleConflicts(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't list title conflicts", err)
+			return
+		}
+		respondWithErrorDetails(w, http.StatusConflict, errorCodeDuplicateTitle, "Rename duplicate titles before turning on unique titles", nil, map[string]any{
+			"conflicts": conflicts,
+		})
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update title policy", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, titlePolicyResponse{UniqueTitles: params.UniqueTitles})
+}
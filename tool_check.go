@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os/exec"
+)
+
+// errorCodeFFmpegUnavailable is sent when uploads can't be processed
+// because ffmpeg or ffprobe isn't installed.
+const errorCodeFFmpegUnavailable = "ffmpeg_unavailable"
+
+// errToolUnavailable marks processing skipped because its tool wasn't
+// found at startup.
+var errToolUnavailable = errors.New("tool_unavailable")
+
+// toolStatus records which of the media tools were found on PATH at
+// startup.
+type toolStatus struct {
+	FFmpeg  bool `json:"ffmpeg"`
+	FFprobe bool `json:"ffprobe"`
+}
+
+// detectTools looks ffmpeg and ffprobe up on PATH.
+func detectTools() toolStatus {
+	_, ffmpegErr := exec.LookPath("ffmpeg")
+	_, ffprobeErr := exec.LookPath("ffprobe")
+	return toolStatus{FFmpeg: ffmpegErr == nil, FFprobe: ffprobeErr == nil}
+}
+
+// missing returns the names of the tools that weren't found.
+func (t toolStatus) missing() []string {
+	var names []string
+	if !t.FFmpeg {
+		names = append(names, "ffmpeg")
+	}
+	if !t.FFprobe {
+		names = append(names, "ffprobe")
+	}
+	return names
+}
+
+// checkVideoTools responds 503 and returns false when a video upload
+// couldn't be processed for lack of ffmpeg or ffprobe, before the client
+// sends it. With ALLOW_UNPROCESSED_UPLOADS set, such uploads are stored
+// as they arrive instead.
+func (cfg *apiConfig) checkVideoTools(w http.ResponseWriter) bool {
+	if len(cfg.tools.missing()) == 0 || cfg.allowUnprocessedUploads {
+		return true
+	}
+	respondWithErrorCode(w, http.StatusServiceUnavailable, errorCodeFFmpegUnavailable, "Video processing is unavailable: ffmpeg and ffprobe must be installed", nil)
+	return false
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// logToolInvocations turns on structured logging of every ffmpeg and
+// ffprobe run. It is set from LOG_FFMPEG_INVOCATIONS at startup.
+var logToolInvocations atomic.Bool
+
+// maxLoggedStderr bounds how much of a tool's stderr is logged.
+const maxLoggedStderr = 4096
+
+// Deadlines for a single ffmpeg or ffprobe run, set from FFMPEG_TIMEOUT
+// and FFPROBE_TIMEOUT at startup.
+var (
+	ffmpegTimeout  = 2 * time.Minute
+	ffprobeTimeout = 15 * time.Second
+)
+
+// errToolTimeout marks a tool run killed for overrunning its deadline,
+// which usually means a corrupt file sent it spinning.
+var errToolTimeout = errors.New("tool_timeout")
+
+// toolCommand returns a command running name that is killed, along with
+// anything it spawned, once ctx is done or timeout has passed. Pass the
+// result of running it through finish, which releases the deadline, wraps
+// errToolTimeout when the deadline killed the tool, and logs how long the
+// run took:
+//
+//	cmd, finish := toolCommand(ctx, ffprobeTimeout, "ffprobe", args...)
+//	err := finish(runTool(cmd, path))
+func toolCommand(ctx context.Context, timeout time.Duration, name string, args ...string) (*exec.Cmd, func(error) error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	cmd := exec.CommandContext(ctx, name, args...)
+	killProcessGroup(cmd)
+	// Don't wait forever on output pipes held open by a killed tool
+	cmd.WaitDelay = 5 * time.Second
+	start := time.Now()
+	finish := func(err error) error {
+		defer cancel()
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %s killed after %s: %w", errToolTimeout, name, timeout, err)
+		}
+		recordOperation(ctx, name, start, err)
+		return err
+	}
+	return cmd, finish
+}
+
+// runTool runs cmd and, when logToolInvocations is set, logs what support
+// needs to reproduce it: argv, duration, exit code, the SHA-256 of each
+// local input file, and the start of stderr. inputs are the files the
+// command reads; URLs are logged without hashing. Paths and URL query
+// strings are sanitized before logging.
+func runTool(cmd *exec.Cmd, inputs ...string) error {
+	if !logToolInvocations.Load() {
+		return cmd.Run()
+	}
+
+	stderr := &cappedBuffer{limit: maxLoggedStderr}
+	if cmd.Stderr == nil {
+		cmd.Stderr = stderr
+	} else {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	}
+
+	hashes := make(map[string]string, len(inputs))
+	for _, input := range inputs {
+		if isURL(input) {
+			continue
+		}
+		sum, err := fileSHA256(input)
+		if err != nil {
+			sum = "error: " + err.Error()
+		}
+		hashes[sanitizeToolArg(input)] = sum
+	}
+
+	start := time.Now()
+	err := cmd.Run()
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = sanitizeToolArg(arg)
+	}
+	attrs := []any{
+		slog.Any("argv", args),
+		slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+		slog.Int("exit_code", exitCode),
+		slog.Any("input_sha256", hashes),
+		slog.String("stderr", sanitizeToolOutput(stderr.String(), cmd.Args)),
+	}
+	if len(cmd.Env) > 0 {
+		attrs = append(attrs, slog.Any("env", sanitizeToolEnv(cmd.Env)))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	slog.Info("tool invocation", attrs...)
+	return err
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty tool can't grow the log without bound.
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sanitizeToolArg drops query strings from URLs, since presigned URLs
+// carry credentials, and reduces absolute paths to their base name under a
+// placeholder directory.
+func sanitizeToolArg(arg string) string {
+	if isURL(arg) {
+		u, _ := url.Parse(arg)
+		if u.RawQuery != "" {
+			u.RawQuery = "REDACTED"
+		}
+		u.User = nil
+		return u.String()
+	}
+	if filepath.IsAbs(arg) {
+		return filepath.Join("$DIR", filepath.Base(arg))
+	}
+	return arg
+}
+
+// sanitizeToolOutput applies sanitizeToolArg to every argument quoted back
+// in a tool's output.
+func sanitizeToolOutput(out string, args []string) string {
+	for _, arg := range args {
+		if clean := sanitizeToolArg(arg); clean != arg {
+			out = strings.ReplaceAll(out, arg, clean)
+		}
+	}
+	return out
+}
+
+// sanitizeToolEnv hides the values of variables that look like secrets.
+func sanitizeToolEnv(env []string) []string {
+	clean := make([]string, len(env))
+	for i, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		upper := strings.ToUpper(name)
+		if strings.Contains(upper, "SECRET") || strings.Contains(upper, "TOKEN") ||
+			strings.Contains(upper, "KEY") || strings.Contains(upper, "PASSWORD") {
+			kv = name + "=REDACTED"
+		}
+		clean[i] = kv
+	}
+	return clean
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves cmd's default cancellation, which kills only the
+// tool itself; there are no process groups to kill here.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// defaultTrashRetention is how long a deleted video stays in the trash,
+// restorable, before it is purged, unless TRASH_RETENTION_DAYS changes it.
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// errTrashExpired is returned when restoring a video that has been in the
+// trash longer than trashRetention and is only waiting to be purged.
+var errTrashExpired = errors.New("video has been in the trash too long to restore")
+
+// trashVideo moves video to the trash as of now. Public and unlisted
+// videos' objects move out of publicKeyPrefix, so links to them stop
+// working until the video is restored. Nothing is deleted until
+// purgeTrashedVideos runs.
+func (cfg *apiConfig) trashVideo(ctx context.Context, video database.Video, now time.Time) error {
+	deletedAt := now.UTC()
+	video.DeletedAt = &deletedAt
+	return cfg.saveTrashState(ctx, &video)
+}
+
+// restoreVideo takes video out of the trash, unless it has been there
+// longer than trashRetention as of now.
+func (cfg *apiConfig) restoreVideo(ctx context.Context, video database.Video, now time.Time) (database.Video, error) {
+	if video.DeletedAt == nil {
+		return video, nil
+	}
+	if !video.DeletedAt.After(now.Add(-cfg.trashRetention)) {
+		return video, errTrashExpired
+	}
+	video.DeletedAt = nil
+	if err := cfg.saveTrashState(ctx, &video); err != nil {
+		return video, err
+	}
+	video.Version++
+	return video, nil
+}
+
+// saveTrashState saves video's DeletedAt, moving its objects to match.
+func (cfg *apiConfig) saveTrashState(ctx context.Context, video *database.Video) error {
+	movedFrom, cleanup, err := cfg.moveVideoObjects(ctx, video)
+	if err != nil {
+		return err
+	}
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		cleanup()
+		return err
+	}
+	cfg.deleteReplacedVideo(ctx, movedFrom...)
+	return nil
+}
+
+// purgeTrashedVideos permanently deletes videos moved to the trash before
+// cutoff, with everything stored for them. It has the janitor's
+// signature once ctx is bound.
+func (cfg *apiConfig) purgeTrashedVideos(ctx context.Context, cutoff time.Time) (int64, error) {
+	videos, err := cfg.db.GetVideosDeletedBefore(cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, video := range videos {
+		// One video's storage failing mustn't keep the rest in the trash
+		if err := cfg.deleteVideo(ctx, video); err != nil {
+			log.Printf("couldn't purge video %s: %v", video.ID, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// handlerVideoRestore takes one of the caller's videos out of the trash.
+// Restoring a video that isn't in the trash is a no-op.
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	userID := identity.UserID
+
+	video, err := cfg.db.GetVideo(videoID, true)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Others can't tell trashed videos from ones that never existed
+	if video.ID == uuid.Nil || (video.DeletedAt != nil && video.UserID != userID) {
+		respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errorCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+	if !checkDestructiveAllowed(w, identity) {
+		return
+	}
+	// Trashed videos don't count toward the limit, so restoring one may
+	// take the user past it
+	if video.DeletedAt != nil && (cfg.countDraftsTowardLimit || video.VideoURL != nil) {
+		count, exceeded, err := cfg.videoLimitExceeded(userID, !cfg.countDraftsTowardLimit)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+			return
+		}
+		if exceeded {
+			respondWithVideoLimit(w, count, cfg.maxVideosPerUser)
+			return
+		}
+	}
+
+	video, err = cfg.restoreVideo(r.Context(), video, time.Now())
+	if errors.Is(err, errTrashExpired) {
+		respondWithError(w, http.StatusGone, "Video has been in the trash too long to restore", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+
+	cfg.auditImpersonation(r, identity, video.ID)
+	w.Header().Set("ETag", videoETag(video))
+	cfg.prepareListedVideo(r.Context(), &video)
+	respondWithJSON(w, http.StatusOK, newOwnerVideoResponse(video))
+}
+
+// handlerVideosTrash pages through the caller's videos in the trash, most
+// recently created first by default, taking the same paging parameters as
+// GET /api/videos.
+func (cfg *apiConfig) handlerVideosTrash(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	userID := identity.UserID
+	cfg.respondWithVideoPage(w, r, database.VideoPageParams{UserID: userID, IncludeDrafts: true, Trashed: true}, true)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestTrashRestoreWithinRetention(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Trashed")
+	env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, token, map[string]string{"visibility": database.VisibilityPublic}, http.StatusOK, nil)
+	publicKey := env.storedVideoKey(t, video.ID)
+
+	env.doJSON(t, http.MethodDelete, "/api/videos/"+video.ID, token, nil, http.StatusNoContent, nil)
+	trashedKey := env.storedVideoKey(t, video.ID)
+	if isPublicKey(trashedKey) {
+		t.Errorf("trashed video still stored under %s", trashedKey)
+	}
+
+	// Nothing hands out a URL to a trashed video, even to its owner
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if got.VideoURL != nil || got.DeletedAt == nil {
+		t.Errorf("trashed video = %+v, want deleted_at and no video_url", got)
+	}
+	resp, body := env.do(t, http.MethodGet, "/api/videos/"+video.ID+"/download", token, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download of a trashed video: got %d: %s", resp.StatusCode, body)
+	}
+	resp, body = env.do(t, http.MethodPost, "/api/videos/"+video.ID+"/upload-url", token, "application/json", jsonBody(t, map[string]int{"size_bytes": 100}))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("upload URL for a trashed video: got %d: %s", resp.StatusCode, body)
+	}
+
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/restore", token, nil, http.StatusOK, &got)
+	if got.VideoURL == nil || got.DeletedAt != nil {
+		t.Errorf("restored video = %+v, want a video_url and no deleted_at", got)
+	}
+	if key := env.storedVideoKey(t, video.ID); key != publicKey {
+		t.Errorf("restored video stored under %s, want %s", key, publicKey)
+	}
+}
+
+func TestTrashPurgedAfterRetention(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Purged")
+	env.doJSON(t, http.MethodDelete, "/api/videos/"+video.ID, token, nil, http.StatusNoContent, nil)
+	key := env.storedVideoKey(t, video.ID)
+
+	// Past the retention it can't be restored, even before the purge runs
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.DeletedAt = ptr(time.Now().Add(-env.cfg.trashRetention - time.Minute))
+	})
+	resp, body := env.do(t, http.MethodPost, "/api/videos/"+video.ID+"/restore", token, "", nil)
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("restore past retention: got %d: %s", resp.StatusCode, body)
+	}
+
+	n, err := env.cfg.purgeTrashedVideos(context.Background(), time.Now().Add(-env.cfg.trashRetention))
+	if err != nil || n != 1 {
+		t.Fatalf("purge = %d, %v; want 1 video", n, err)
+	}
+	if _, ok := env.s3.Object(testBucket, key); ok {
+		t.Errorf("purged video's file %s is still stored", key)
+	}
+	resp, body = env.do(t, http.MethodGet, "/api/videos/"+video.ID, token, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET purged video: got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestTrashRestoreRespectsVideoLimit(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.maxVideosPerUser = 1
+		cfg.countDraftsTowardLimit = true
+	})
+	_, token := env.createUser(t)
+	trashed := env.createVideo(t, token, "Trashed")
+	env.doJSON(t, http.MethodDelete, "/api/videos/"+trashed.ID, token, nil, http.StatusNoContent, nil)
+
+	// The trash doesn't count toward the limit, so there's room for another
+	replacement := env.createVideo(t, token, "Replacement")
+
+	resp, body := env.do(t, http.MethodPost, "/api/videos/"+trashed.ID+"/restore", token, "", nil)
+	if resp.StatusCode != http.StatusForbidden || errorCode(t, body) != errorCodeVideoLimit {
+		t.Fatalf("restore at the limit: got %d: %s", resp.StatusCode, body)
+	}
+
+	env.doJSON(t, http.MethodDelete, "/api/videos/"+replacement.ID, token, nil, http.StatusNoContent, nil)
+	env.doJSON(t, http.MethodPost, "/api/videos/"+trashed.ID+"/restore", token, nil, http.StatusOK, nil)
+}
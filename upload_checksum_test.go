@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestUploadChecksumHeader(t *testing.T) {
+	sum := sha256.Sum256([]byte("video"))
+	tests := []struct {
+		value   string
+		want    []byte
+		wantErr bool
+	}{
+		{"", nil, false},
+		{base64.StdEncoding.EncodeToString(sum[:]), sum[:], false},
+		{"not base64!", nil, true},
+		{base64.StdEncoding.EncodeToString(sum[:16]), nil, true},
+		// S3 checksums are standard base64, not hex
+		{strings.Repeat("ab", sha256.Size), nil, true},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set("X-Upload-Checksum-SHA256", tt.value)
+		got, err := uploadChecksumHeader(h)
+		if (err != nil) != tt.wantErr || !bytes.Equal(got, tt.want) {
+			t.Errorf("uploadChecksumHeader(%q) = %x, %v; want %x, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestUploadWithMatchingChecksum(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Verified")
+	data := testVideoBytes(16 << 10)
+
+	// Record the checksum the object was stored with
+	var sent []string
+	env.s3.FailWhen(func(op string, r *http.Request) bool {
+		if op == "PutObject" && strings.HasSuffix(r.URL.Path, ".mp4") {
+			sent = append(sent, r.Header.Get("X-Amz-Checksum-Sha256"))
+		}
+		return false
+	})
+	resp, body := env.uploadVideo(t, token, video.ID, data, "X-Upload-Checksum-SHA256", sha256Base64(data))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload: got %d: %s", resp.StatusCode, body)
+	}
+	if status := env.waitForProcessing(t, token, video.ID); status.ProcessingError != nil {
+		t.Fatalf("processing failed: %s", *status.ProcessingError)
+	}
+	env.s3.FailWhen(nil)
+
+	// Without ffmpeg the stored file is the upload itself
+	if len(sent) != 1 || sent[0] != sha256Base64(data) {
+		t.Errorf("PutObject checksums %q, want the file's %s", sent, sha256Base64(data))
+	}
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if got.ChecksumSHA256 == nil || *got.ChecksumSHA256 != sha256Base64(data) {
+		t.Errorf("checksum_sha256 = %v, want %s", got.ChecksumSHA256, sha256Base64(data))
+	}
+}
+
+func TestUploadWithFlippedBit(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Corrupted")
+	data := testVideoBytes(16 << 10)
+	checksum := sha256Base64(data)
+	corrupted := bytes.Clone(data)
+	corrupted[len(corrupted)/2] ^= 0x01
+
+	resp, body := env.uploadVideo(t, token, video.ID, corrupted, "X-Upload-Checksum-SHA256", checksum)
+	if resp.StatusCode != http.StatusUnprocessableEntity || errorCode(t, body) != errorCodeChecksumMismatch {
+		t.Fatalf("got %d: %s, want 422 %s", resp.StatusCode, body, errorCodeChecksumMismatch)
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("corrupted upload was stored: %v", keys)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+
+	resp, body = env.uploadVideo(t, token, video.ID, data, "X-Upload-Checksum-SHA256", "sha256:"+checksum)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed header: got %d: %s, want 400", resp.StatusCode, body)
+	}
+}
+
+func TestUploadWithoutChecksumHeader(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Unverified")
+
+	// The stored file's checksum is recorded all the same
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &got)
+	if got.ChecksumSHA256 == nil {
+		t.Fatal("no checksum_sha256")
+	}
+	obj, ok := env.s3.Object(testBucket, env.storedVideoKey(t, video.ID))
+	if !ok || sha256Base64(obj.Data) != *got.ChecksumSHA256 {
+		t.Errorf("checksum_sha256 = %s doesn't match the stored object", *got.ChecksumSHA256)
+	}
+}
+
+func TestStoragePutRejectsChecksumMismatch(t *testing.T) {
+	env := newTestEnv(t)
+	data := []byte("stored bytes")
+	wrong := sha256.Sum256([]byte("other bytes"))
+	for _, store := range []storage.Storage{env.cfg.s3Storage, env.cfg.localStorage} {
+		err := store.Put(context.Background(), "checksums/object.bin", bytes.NewReader(data), int64(len(data)), storage.PutOptions{ChecksumSHA256: wrong[:]})
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Errorf("%s: Put with a wrong checksum = %v, want ErrChecksumMismatch", store.Name(), err)
+		}
+		if _, err := store.Head(context.Background(), "checksums/object.bin"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("%s: mismatched object stored: %v", store.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const maxOriginalFilenameLength = 255
+
+// sanitizeDisplayFilename cleans a client-supplied filename for display.
+// The result is never used to build paths; directory components and control
+// characters are dropped anyway so it's safe to echo back in headers.
+func sanitizeDisplayFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if runes := []rune(name); len(runes) > maxOriginalFilenameLength {
+		name = string(runes[:maxOriginalFilenameLength])
+	}
+	return name
+}
+
+// uploadMetadataFromRequest captures who uploaded a file for support purposes.
+func uploadMetadataFromRequest(r *http.Request, declaredContentType string) database.UploadMetadata {
+	meta := database.UploadMetadata{}
+	if declaredContentType != "" {
+		meta.UploadContentType = &declaredContentType
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		meta.UploadClientIP = &ip
+	}
+	if ua := r.UserAgent(); ua != "" {
+		meta.UploadUserAgent = &ua
+	}
+	return meta
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload progress stages, in order.
+const (
+	progressReceiving  = "receiving"
+	progressQueued     = "queued"
+	progressProcessing = "processing"
+	progressStoring    = "storing"
+	progressDone       = "done"
+	progressFailed     = "failed"
+)
+
+const (
+	// progressUpdateInterval throttles updates from the copy loop.
+	progressUpdateInterval = 250 * time.Millisecond
+	// progressRetention keeps finished entries around for late pollers.
+	progressRetention = 10 * time.Minute
+)
+
+// uploadProgress is a video upload's latest reported state. TotalBytes and
+// Percent are null when the client didn't declare a length.
+type uploadProgress struct {
+	Stage         string    `json:"stage"`
+	ReceivedBytes int64     `json:"received_bytes"`
+	TotalBytes    *int64    `json:"total_bytes"`
+	Percent       *float64  `json:"percent"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// progressStore holds the latest progress of each video being uploaded.
+type progressStore struct {
+	mu       sync.Mutex
+	progress map[uuid.UUID]uploadProgress
+}
+
+func newProgressStore() *progressStore {
+	return &progressStore{progress: map[uuid.UUID]uploadProgress{}}
+}
+
+func (s *progressStore) get(videoID uuid.UUID) (uploadProgress, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.progress[videoID]
+	return p, ok
+}
+
+// received records bytes received so far out of total, or -1 if unknown.
+func (s *progressStore) received(videoID uuid.UUID, received, total int64) {
+	p := uploadProgress{Stage: progressReceiving, ReceivedBytes: received, UpdatedAt: time.Now().UTC()}
+	if total > 0 {
+		pct := min(100, float64(received)*100/float64(total))
+		p.TotalBytes = &total
+		p.Percent = &pct
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress[videoID] = p
+}
+
+// stage moves a video to a later stage, keeping its byte counts.
+func (s *progressStore) stage(videoID uuid.UUID, stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.progress[videoID]
+	p.Stage = stage
+	p.UpdatedAt = time.Now().UTC()
+	s.progress[videoID] = p
+}
+
+// prune drops entries not updated since cutoff. It has the janitor's
+// signature.
+func (s *progressStore) prune(cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, p := range s.progress {
+		if p.UpdatedAt.Before(cutoff) {
+			delete(s.progress, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// progressReader reports bytes read through it to a progressStore, at most
+// once per progressUpdateInterval and once more at EOF.
+type progressReader struct {
+	r       io.Reader
+	store   *progressStore
+	videoID uuid.UUID
+	n       int64 // including bytes received before a resume
+	total   int64
+	last    time.Time
+}
+
+func (s *progressStore) reader(videoID uuid.UUID, r io.Reader, already, total int64) *progressReader {
+	s.received(videoID, already, total)
+	return &progressReader{r: r, store: s, videoID: videoID, n: already, total: total, last: time.Now()}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); err != nil || now.Sub(p.last) >= progressUpdateInterval {
+		p.last = now
+		p.store.received(p.videoID, p.n, p.total)
+	}
+	return n, err
+}
+
+// handlerUploadProgress reports how far the latest upload of a video has
+// got, including the client-to-server transfer.
+func (cfg *apiConfig) handlerUploadProgress(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromPath(w, r)
+	if !ok {
+		return
+	}
+	p, ok := cfg.uploadProgress.get(video.ID)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "No upload in progress for this video", nil)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// slowReader returns at most step bytes per read, pausing before each.
+type slowReader struct {
+	r     io.Reader
+	step  int
+	pause time.Duration
+}
+
+func (s *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(s.pause)
+	return s.r.Read(b[:min(len(b), s.step)])
+}
+
+func TestProgressReaderThrottles(t *testing.T) {
+	store := newProgressStore()
+	id := uuid.New()
+	data := testVideoBytes(1000)
+
+	// Reads every 10ms are reported every progressUpdateInterval
+	r := store.reader(id, &slowReader{r: bytes.NewReader(data), step: 10, pause: 10 * time.Millisecond}, 0, int64(len(data)))
+	var updates int
+	last, _ := store.get(id)
+	buf := make([]byte, 10)
+	for {
+		_, err := r.Read(buf)
+		if p, _ := store.get(id); p.UpdatedAt != last.UpdatedAt || p.ReceivedBytes != last.ReceivedBytes {
+			updates++
+			last = p
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	// 100 reads take about a second: a handful of updates plus EOF
+	if updates < 2 || updates > 10 {
+		t.Errorf("%d updates for 100 reads, want them throttled", updates)
+	}
+	if last.ReceivedBytes != int64(len(data)) || last.Percent == nil || *last.Percent != 100 {
+		t.Errorf("final progress = %+v, want every byte at 100%%", last)
+	}
+}
+
+func TestProgressStoreStages(t *testing.T) {
+	store := newProgressStore()
+	id := uuid.New()
+	store.received(id, 50, 200)
+	store.stage(id, progressStoring)
+	p, _ := store.get(id)
+	if p.Stage != progressStoring || p.ReceivedBytes != 50 || p.Percent == nil || *p.Percent != 25 {
+		t.Errorf("progress = %+v, want storing with the byte counts kept", p)
+	}
+
+	// Unknown lengths report bytes only
+	store.received(id, 50, -1)
+	if p, _ := store.get(id); p.TotalBytes != nil || p.Percent != nil {
+		t.Errorf("progress = %+v, want no total or percent", p)
+	}
+
+	if n, _ := store.prune(time.Now().Add(time.Minute)); n != 1 {
+		t.Errorf("pruned %d, want 1", n)
+	}
+}
+
+// uploadSlowly sends data as videoID's video in steps of step bytes, with
+// a part Content-Length when declare is set, and polls the progress
+// endpoint until the upload's response arrives.
+func (env *testEnv) uploadSlowly(t *testing.T, token, videoID string, data []byte, step int, declare bool) (resp *http.Response, samples []uploadProgress) {
+	t.Helper()
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+		header.Set("Content-Type", "video/mp4")
+		if declare {
+			header.Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		part, err := mw.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, &slowReader{r: bytes.NewReader(data), step: step, pause: 150 * time.Millisecond})
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	// The pipe hides the body's length, so the request is chunked
+	client := env.server.Client()
+	req, _ := http.NewRequest(http.MethodPost, env.server.URL+"/api/video_upload/"+videoID, pr)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- resp
+	}()
+
+	url := fmt.Sprintf("%s/api/video_upload/%s/progress", env.server.URL, videoID)
+	for {
+		select {
+		case resp := <-done:
+			return resp, samples
+		case <-time.After(50 * time.Millisecond):
+		}
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		var p uploadProgress
+		if r.StatusCode == http.StatusOK && json.NewDecoder(r.Body).Decode(&p) == nil && p.Stage == progressReceiving {
+			samples = append(samples, p)
+		}
+		r.Body.Close()
+	}
+}
+
+func TestUploadReportsTransferProgress(t *testing.T) {
+	data := testVideoBytes(64 << 10)
+	for _, declare := range []bool{true, false} {
+		t.Run(fmt.Sprintf("declared length %v", declare), func(t *testing.T) {
+			env := newTestEnv(t)
+			_, token := env.createUser(t)
+			video := env.createVideo(t, token, "Slow transfer")
+
+			resp, samples := env.uploadSlowly(t, token, video.ID, data, 8<<10, declare)
+			if resp == nil || resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("upload: got %v", resp)
+			}
+
+			var partial int
+			for i, p := range samples {
+				if p.ReceivedBytes > 0 && p.ReceivedBytes < int64(len(data)) {
+					partial++
+				}
+				if i > 0 && p.ReceivedBytes < samples[i-1].ReceivedBytes {
+					t.Errorf("received bytes went from %d to %d", samples[i-1].ReceivedBytes, p.ReceivedBytes)
+				}
+				if declare {
+					if p.TotalBytes == nil || *p.TotalBytes != int64(len(data)) || p.Percent == nil {
+						t.Fatalf("progress %+v, want a total and percentage", p)
+					}
+					if i > 0 && *p.Percent < *samples[i-1].Percent {
+						t.Errorf("percent went from %v to %v", *samples[i-1].Percent, *p.Percent)
+					}
+				} else if p.TotalBytes != nil || p.Percent != nil {
+					t.Fatalf("progress %+v, want bytes only without a declared length", p)
+				}
+			}
+			if partial < 2 {
+				t.Errorf("%d samples mid-transfer in %+v, want the transfer reported as it happens", partial, samples)
+			}
+
+			// Afterwards the same entry follows the server-side stages
+			env.waitForProcessing(t, token, video.ID)
+			var final uploadProgress
+			env.doJSON(t, http.MethodGet, "/api/video_upload/"+video.ID+"/progress", token, nil, http.StatusOK, &final)
+			if final.Stage != progressDone || final.ReceivedBytes != int64(len(data)) {
+				t.Errorf("final progress = %+v, want done with every byte", final)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Per-user upload limits unless UPLOAD_RATE_PER_MINUTE and
+// UPLOAD_MAX_CONCURRENT_PER_USER change them.
+const (
+	defaultUploadRatePerMinute = 10
+	defaultUploadConcurrency   = 2
+)
+
+// uploadRateIdle is how long a user's bucket is kept after their last
+// upload. By then it has refilled, so dropping it changes nothing.
+const uploadRateIdle = 10 * time.Minute
+
+// uploadConcurrencyRetryAfter is the Retry-After sent to a user at their
+// concurrent upload cap; there is no telling when one of theirs finishes.
+const uploadConcurrencyRetryAfter = 5 * time.Second
+
+// uploadRateLimiter limits each user's uploads with a token bucket that
+// refills perMinute tokens a minute, up to a minute's worth, and caps how
+// many of their uploads are in flight at once. Zero disables either limit.
+type uploadRateLimiter struct {
+	perMinute     int
+	maxConcurrent int
+
+	mu      sync.Mutex
+	buckets map[uuid.UUID]*uploadBucket
+}
+
+type uploadBucket struct {
+	tokens   float64
+	updated  time.Time
+	inFlight int
+}
+
+func newUploadRateLimiter(perMinute, maxConcurrent int) *uploadRateLimiter {
+	return &uploadRateLimiter{perMinute: perMinute, maxConcurrent: maxConcurrent, buckets: map[uuid.UUID]*uploadBucket{}}
+}
+
+// acquire starts an upload request for userID at now, spending tokens from
+// their bucket. On success the returned release must be called when the
+// request finishes, however it ends; otherwise it returns how long to wait
+// before retrying.
+func (l *uploadRateLimiter) acquire(userID uuid.UUID, now time.Time, tokens float64) (release func(), retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[userID]
+	if !ok {
+		b = &uploadBucket{tokens: float64(l.perMinute), updated: now}
+		l.buckets[userID] = b
+	}
+	if l.perMinute > 0 {
+		refill := now.Sub(b.updated).Minutes() * float64(l.perMinute)
+		b.tokens = min(float64(l.perMinute), b.tokens+refill)
+	}
+	b.updated = now
+
+	if l.maxConcurrent > 0 && b.inFlight >= l.maxConcurrent {
+		return nil, uploadConcurrencyRetryAfter
+	}
+	if l.perMinute > 0 && tokens > 0 {
+		if b.tokens < tokens {
+			return nil, time.Duration((tokens - b.tokens) / float64(l.perMinute) * float64(time.Minute))
+		}
+		b.tokens -= tokens
+	}
+	b.inFlight++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			b.inFlight--
+		})
+	}, 0
+}
+
+// prune drops the buckets of users with nothing in flight who haven't
+// uploaded since cutoff. It has the janitor's signature.
+func (l *uploadRateLimiter) prune(cutoff time.Time) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var n int64
+	for userID, b := range l.buckets {
+		if b.inFlight == 0 && b.updated.Before(cutoff) {
+			delete(l.buckets, userID)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// limitUserUpload counts an upload against userID's limits. When they are
+// exceeded it responds 429 with a Retry-After and returns false;
+// otherwise the caller must defer the returned release.
+func (cfg *apiConfig) limitUserUpload(w http.ResponseWriter, userID uuid.UUID) (func(), bool) {
+	return cfg.limitUserUploadTokens(w, userID, 1)
+}
+
+// limitUserUploadPart is limitUserUpload for requests that carry part of
+// an upload already counted when it started, such as the chunks of an
+// upload session: they count toward the user's concurrent uploads but
+// don't spend from the rate, or a large upload could never finish.
+func (cfg *apiConfig) limitUserUploadPart(w http.ResponseWriter, userID uuid.UUID) (func(), bool) {
+	return cfg.limitUserUploadTokens(w, userID, 0)
+}
+
+func (cfg *apiConfig) limitUserUploadTokens(w http.ResponseWriter, userID uuid.UUID, tokens float64) (func(), bool) {
+	release, retryAfter := cfg.uploadLimiter.acquire(userID, time.Now(), tokens)
+	if release != nil {
+		return release, true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	respondWithErrorCode(w, http.StatusTooManyRequests, errorCodeTooManyRequests, "Too many uploads; retry later", nil)
+	return nil, false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUploadRateLimiterRefills(t *testing.T) {
+	l := newUploadRateLimiter(2, 0)
+	userID := uuid.New()
+	now := time.Now()
+
+	for i := range 2 {
+		if release, _ := l.acquire(userID, now, 1); release == nil {
+			t.Fatalf("upload %d refused within the rate", i+1)
+		}
+	}
+	release, retryAfter := l.acquire(userID, now, 1)
+	if release != nil {
+		t.Fatal("third upload in the same instant was allowed")
+	}
+	if retryAfter != 30*time.Second {
+		t.Errorf("retryAfter = %v, want 30s for a token at 2/min", retryAfter)
+	}
+	// Parts of an upload already counted don't need a token
+	if release, _ := l.acquire(userID, now, 0); release == nil {
+		t.Error("part of an upload refused by the rate")
+	}
+
+	if release, _ := l.acquire(userID, now.Add(retryAfter), 1); release == nil {
+		t.Error("upload refused after waiting Retry-After")
+	}
+	// Another user has their own bucket
+	if release, _ := l.acquire(uuid.New(), now, 1); release == nil {
+		t.Error("another user's upload was refused")
+	}
+}
+
+func TestUploadSessionRateLimited(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.uploadLimiter = newUploadRateLimiter(1, 1)
+	})
+	userID, token := env.createUser(t)
+	video := env.createVideo(t, token, "Rate limited")
+	data := testVideoBytes(minUploadChunkSize + 100)
+
+	resp, body := env.openSession(t, token, video.ID, int64(len(data)), "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first session: got %d: %s", resp.StatusCode, body)
+	}
+	var session uploadSessionResponse
+	decodeJSON(t, body, &session)
+
+	wantLimited := func(name string, resp *http.Response, body []byte) {
+		t.Helper()
+		if resp.StatusCode != http.StatusTooManyRequests || errorCode(t, body) != errorCodeTooManyRequests {
+			t.Fatalf("%s: got %d, want 429: %s", name, resp.StatusCode, body)
+		}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 {
+			t.Errorf("%s: Retry-After = %q, want whole seconds", name, resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// The session spent the minute's only token
+	resp, body = env.openSession(t, token, video.ID, int64(len(data)), "")
+	wantLimited("second session", resp, body)
+	resp, body = env.do(t, http.MethodPost, "/api/video_upload/"+video.ID+"/resume", token, "application/octet-stream", nil)
+	wantLimited("resume", resp, body)
+
+	// Chunks of the open session aren't charged against the rate, but do
+	// count toward concurrent uploads
+	release, _ := env.cfg.uploadLimiter.acquire(userID, time.Now(), 0)
+	resp, body = env.do(t, http.MethodPut, "/api/uploads/"+session.ID+"/chunks/0", token, "application/octet-stream", nil)
+	wantLimited("chunk while another upload is in flight", resp, body)
+	resp, body = env.do(t, http.MethodPost, "/api/uploads/"+session.ID+"/complete", token, "", nil)
+	wantLimited("complete while another upload is in flight", resp, body)
+	release()
+
+	env.sendChunk(t, token, session, data, 0)
+	env.sendChunk(t, token, session, data, 1)
+	env.doJSON(t, http.MethodPost, "/api/uploads/"+session.ID+"/complete", token, nil, http.StatusAccepted, nil)
+	env.waitForProcessing(t, token, video.ID)
+}
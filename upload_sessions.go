@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// defaultUploadSessionTTL is how long an upload session lasts when
+// UPLOAD_SESSION_TTL isn't set.
+const defaultUploadSessionTTL = 24 * time.Hour
+
+// defaultMaxUploadSessionsPerUser caps how many sessions one user may have
+// open when UPLOAD_MAX_SESSIONS_PER_USER isn't set.
+const defaultMaxUploadSessionsPerUser = 5
+
+// Chunk sizes a session may be opened with. Every chunk but the last is
+// exactly the session's chunk size.
+const (
+	defaultUploadChunkSize = 8 << 20
+	minUploadChunkSize     = 256 << 10
+	maxUploadChunkSize     = 64 << 20
+)
+
+// Error codes for upload session failures a client acts on.
+const (
+	errorCodeUploadSessionNotFound = "upload_session_not_found"
+	errorCodeUploadSessionBusy     = "upload_session_busy"
+	errorCodeUploadIncomplete      = "upload_incomplete"
+	errorCodeChecksumMismatch      = "checksum_mismatch"
+	errorCodeTooManyUploadSessions = "too_many_upload_sessions"
+)
+
+// uploadSession is a video upload sent as numbered fixed-size chunks, so a
+// client on a poor connection only ever resends the chunks it lost. Chunk
+// n is written at n*chunkSize in a temp file already sized to the whole
+// upload, which lets chunks arrive in any order.
+type uploadSession struct {
+	id        string
+	videoID   uuid.UUID
+	userID    uuid.UUID
+	path      string
+	size      int64
+	chunkSize int64
+	// sha256 is the client's hex digest of the whole file, if it sent one
+	sha256    string
+	filename  string
+	metadata  database.UploadMetadata
+	received  []bool
+	createdAt time.Time
+	expiresAt time.Time
+	// writing holds the chunks being written; completing is set once the
+	// session is being handed to processing
+	writing    map[int]bool
+	completing bool
+}
+
+func chunkCount(size, chunkSize int64) int {
+	return int((size + chunkSize - 1) / chunkSize)
+}
+
+// chunkBounds returns the offset and length of chunk n.
+func (s *uploadSession) chunkBounds(n int) (int64, int64) {
+	off := int64(n) * s.chunkSize
+	return off, min(s.chunkSize, s.size-off)
+}
+
+// missingBytes is how much of the session is still to be written. Session
+// files are sparse, so this is disk space the session will yet take up.
+func (s *uploadSession) missingBytes() int64 {
+	var n int64
+	for i, ok := range s.received {
+		if !ok {
+			_, length := s.chunkBounds(i)
+			n += length
+		}
+	}
+	return n
+}
+
+type uploadSessionStore struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	// maxPerUser caps each user's open sessions; zero means no cap
+	maxPerUser int
+	byID       map[string]*uploadSession
+}
+
+func newUploadSessionStore(ttl time.Duration, maxPerUser int) *uploadSessionStore {
+	return &uploadSessionStore{ttl: ttl, maxPerUser: maxPerUser, byID: map[string]*uploadSession{}}
+}
+
+// add registers s under a new random ID, taking ownership of its file. It
+// fails if the user already has maxPerUser sessions open, or if s doesn't
+// fit in free bytes once the unwritten parts of every open session are set
+// aside. A negative free skips the space check.
+func (st *uploadSessionStore) add(s *uploadSession, free int64) error {
+	var rnd [24]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return err
+	}
+	s.id = base64.RawURLEncoding.EncodeToString(rnd[:])
+	s.received = make([]bool, chunkCount(s.size, s.chunkSize))
+	s.writing = map[int]bool{}
+	s.createdAt = time.Now()
+	s.expiresAt = s.createdAt.Add(st.ttl)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	open := 0
+	var reserved int64
+	for _, other := range st.byID {
+		if other.completing || time.Now().After(other.expiresAt) {
+			continue
+		}
+		reserved += other.missingBytes()
+		if other.userID == s.userID {
+			open++
+		}
+	}
+	if st.maxPerUser > 0 && open >= st.maxPerUser {
+		return &statusError{status: http.StatusTooManyRequests, msg: "Too many open upload sessions", code: errorCodeTooManyUploadSessions}
+	}
+	if free >= 0 && s.size > free-reserved {
+		return &statusError{status: http.StatusInsufficientStorage, msg: "Not enough space to receive this upload"}
+	}
+	st.byID[s.id] = s
+	return nil
+}
+
+// lookup returns userID's session with the given ID. Callers must hold
+// st.mu.
+func (st *uploadSessionStore) lookup(id string, userID uuid.UUID) (*uploadSession, error) {
+	s, ok := st.byID[id]
+	if !ok || s.userID != userID || time.Now().After(s.expiresAt) {
+		return nil, &statusError{status: http.StatusNotFound, msg: "Upload session not found", code: errorCodeUploadSessionNotFound}
+	}
+	return s, nil
+}
+
+// status returns a copy of the session for reporting, with its own
+// received slice.
+func (st *uploadSessionStore) status(id string, userID uuid.UUID) (uploadSession, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, err := st.lookup(id, userID)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	snapshot := *s
+	snapshot.received = append([]bool(nil), s.received...)
+	snapshot.writing = nil
+	return snapshot, nil
+}
+
+// beginChunk reserves chunk n of the session for writing. The caller must
+// call endChunk when done.
+func (st *uploadSessionStore) beginChunk(id string, userID uuid.UUID, n int) (*uploadSession, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, err := st.lookup(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n >= len(s.received) {
+		return nil, &statusError{status: http.StatusBadRequest, msg: "Chunk number out of range"}
+	}
+	if s.completing {
+		return nil, &statusError{status: http.StatusConflict, msg: "Upload session is already being completed", code: errorCodeUploadSessionBusy}
+	}
+	if s.writing[n] {
+		return nil, &statusError{status: http.StatusConflict, msg: "Chunk is already being uploaded", code: errorCodeUploadSessionBusy}
+	}
+	s.writing[n] = true
+	return s, nil
+}
+
+// endChunk releases a beginChunk, recording whether chunk n is now
+// present. A failed rewrite of a received chunk may have left it
+// half-overwritten, so it counts as missing again.
+func (st *uploadSessionStore) endChunk(s *uploadSession, n int, ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(s.writing, n)
+	s.received[n] = ok
+}
+
+// abortChunk releases a beginChunk that never touched the file.
+func (st *uploadSessionStore) abortChunk(s *uploadSession, n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(s.writing, n)
+}
+
+// beginComplete claims the session for completion. It fails while chunks
+// are still being written, and reports missing chunks with a 409 so the
+// client knows to keep uploading.
+func (st *uploadSessionStore) beginComplete(id string, userID uuid.UUID) (*uploadSession, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, err := st.lookup(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if s.completing || len(s.writing) > 0 {
+		return nil, &statusError{status: http.StatusConflict, msg: "Upload session is busy", code: errorCodeUploadSessionBusy}
+	}
+	for _, ok := range s.received {
+		if !ok {
+			return nil, &statusError{status: http.StatusConflict, msg: "Upload session is missing chunks", code: errorCodeUploadIncomplete}
+		}
+	}
+	s.completing = true
+	return s, nil
+}
+
+// abortComplete undoes beginComplete after a failure the client can retry.
+func (st *uploadSessionStore) abortComplete(s *uploadSession) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s.completing = false
+}
+
+// remove forgets s and deletes its file.
+func (st *uploadSessionStore) remove(s *uploadSession) {
+	st.detach(s)
+	tempFiles.remove(s.path)
+}
+
+// detach forgets s, handing ownership of its file back to the caller.
+func (st *uploadSessionStore) detach(s *uploadSession) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.byID, s.id)
+}
+
+// prune removes idle sessions that expired before cutoff and deletes their
+// files. It matches the janitorTask signature, with a retention of zero
+// since sessions carry their own expiry.
+func (st *uploadSessionStore) prune(cutoff time.Time) (int64, error) {
+	st.mu.Lock()
+	var expired []*uploadSession
+	for id, s := range st.byID {
+		if len(s.writing) == 0 && !s.completing && s.expiresAt.Before(cutoff) {
+			expired = append(expired, s)
+			delete(st.byID, id)
+		}
+	}
+	st.mu.Unlock()
+
+	for _, s := range expired {
+		tempFiles.remove(s.path)
+	}
+	return int64(len(expired)), nil
+}
+
+// uploadSessionResponse describes a session's progress. ReceivedChunks and
+// MissingChunks list chunk numbers, so a client that crashed can resume by
+// sending just the missing ones.
+type uploadSessionResponse struct {
+	ID             string `json:"id"`
+	VideoID        string `json:"video_id"`
+	SizeBytes      int64  `json:"size_bytes"`
+	ChunkSize      int64  `json:"chunk_size"`
+	ChunkCount     int    `json:"chunk_count"`
+	SHA256         string `json:"sha256,omitempty"`
+	ReceivedChunks []int  `json:"received_chunks"`
+	MissingChunks  []int  `json:"missing_chunks"`
+	ExpiresAt      string `json:"expires_at"`
+}
+
+func newUploadSessionResponse(s uploadSession) uploadSessionResponse {
+	resp := uploadSessionResponse{
+		ID:             s.id,
+		VideoID:        s.videoID.String(),
+		SizeBytes:      s.size,
+		ChunkSize:      s.chunkSize,
+		ChunkCount:     len(s.received),
+		SHA256:         s.sha256,
+		ReceivedChunks: []int{},
+		MissingChunks:  []int{},
+		ExpiresAt:      apiTime(s.expiresAt),
+	}
+	for n, ok := range s.received {
+		if ok {
+			resp.ReceivedChunks = append(resp.ReceivedChunks, n)
+		} else {
+			resp.MissingChunks = append(resp.MissingChunks, n)
+		}
+	}
+	return resp
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// openSession starts a chunked upload of size bytes in minimum-size chunks
+// and returns the response.
+func (env *testEnv) openSession(t testing.TB, token, videoID string, size int64, digest string) (*http.Response, []byte) {
+	t.Helper()
+	params := map[string]any{"size_bytes": size, "chunk_size": minUploadChunkSize}
+	if digest != "" {
+		params["sha256"] = digest
+	}
+	return env.do(t, http.MethodPost, "/api/videos/"+videoID+"/uploads", token, "application/json", jsonBody(t, params))
+}
+
+// sendChunk uploads chunk n of data to the session.
+func (env *testEnv) sendChunk(t testing.TB, token string, session uploadSessionResponse, data []byte, n int) uploadSessionResponse {
+	t.Helper()
+	off := int64(n) * session.ChunkSize
+	end := min(off+session.ChunkSize, int64(len(data)))
+	var resp uploadSessionResponse
+	path := fmt.Sprintf("/api/uploads/%s/chunks/%d", session.ID, n)
+	r, body := env.do(t, http.MethodPut, path, token, "application/octet-stream", bytes.NewReader(data[off:end]))
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("PUT %s: got %d: %s", path, r.StatusCode, body)
+	}
+	decodeJSON(t, body, &resp)
+	return resp
+}
+
+func TestUploadSessionChunksOutOfOrder(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Chunked")
+	data := testVideoBytes(minUploadChunkSize*2 + 1000)
+	sum := sha256.Sum256(data)
+
+	resp, body := env.openSession(t, token, video.ID, int64(len(data)), hex.EncodeToString(sum[:]))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", resp.StatusCode, body)
+	}
+	var session uploadSessionResponse
+	decodeJSON(t, body, &session)
+	if session.ChunkCount != 3 {
+		t.Fatalf("chunk_count = %d, want 3", session.ChunkCount)
+	}
+
+	// The short last chunk arrives first, then the first; the middle one is lost
+	env.sendChunk(t, token, session, data, 2)
+	got := env.sendChunk(t, token, session, data, 0)
+	if !slices.Equal(got.MissingChunks, []int{1}) || !slices.Equal(got.ReceivedChunks, []int{0, 2}) {
+		t.Fatalf("after chunks 2 and 0: received %v, missing %v", got.ReceivedChunks, got.MissingChunks)
+	}
+
+	complete := "/api/uploads/" + session.ID + "/complete"
+	resp, body = env.do(t, http.MethodPost, complete, token, "", nil)
+	if resp.StatusCode != http.StatusConflict || errorCode(t, body) != errorCodeUploadIncomplete {
+		t.Fatalf("complete with a missing chunk: got %d: %s", resp.StatusCode, body)
+	}
+
+	// A client resuming asks what's missing and sends only that
+	env.doJSON(t, http.MethodGet, "/api/uploads/"+session.ID, token, nil, http.StatusOK, &got)
+	for _, n := range got.MissingChunks {
+		env.sendChunk(t, token, session, data, n)
+	}
+	env.doJSON(t, http.MethodPost, complete, token, nil, http.StatusAccepted, nil)
+
+	status := env.waitForProcessing(t, token, video.ID)
+	if status.ProcessingStatus == nil || *status.ProcessingStatus != database.ProcessingStatusReady {
+		t.Fatalf("status = %+v, want ready", status)
+	}
+	var stored videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, token, nil, http.StatusOK, &stored)
+	if stored.VideoURL == nil {
+		t.Fatal("video has no URL after completing the session")
+	}
+	found := false
+	for _, key := range env.s3.Keys(testBucket) {
+		if obj, ok := env.s3.Object(testBucket, key); ok && bytes.Equal(obj.Data, data) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no stored object matches the uploaded bytes; keys %v", env.s3.Keys(testBucket))
+	}
+}
+
+func TestUploadSessionChecksumMismatch(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Corrupted")
+	data := testVideoBytes(minUploadChunkSize + 10)
+	sum := sha256.Sum256([]byte("something else"))
+
+	resp, body := env.openSession(t, token, video.ID, int64(len(data)), hex.EncodeToString(sum[:]))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", resp.StatusCode, body)
+	}
+	var session uploadSessionResponse
+	decodeJSON(t, body, &session)
+	env.sendChunk(t, token, session, data, 0)
+	env.sendChunk(t, token, session, data, 1)
+
+	resp, body = env.do(t, http.MethodPost, "/api/uploads/"+session.ID+"/complete", token, "", nil)
+	if resp.StatusCode != http.StatusConflict || errorCode(t, body) != errorCodeChecksumMismatch {
+		t.Fatalf("complete: got %d: %s", resp.StatusCode, body)
+	}
+	// The session is spent: the client has to start over
+	resp, body = env.do(t, http.MethodGet, "/api/uploads/"+session.ID, token, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("session after mismatch: got %d: %s", resp.StatusCode, body)
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("mismatched upload was stored: %v", keys)
+	}
+}
+
+func TestUploadSessionLimits(t *testing.T) {
+	const free = 4 * minUploadChunkSize
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.uploadSessions = newUploadSessionStore(defaultUploadSessionTTL, 2)
+		cfg.admission.freeSpace = func(string) (int64, error) { return free, nil }
+	})
+	_, token := env.createUser(t)
+	_, other := env.createUser(t)
+	video := env.createVideo(t, token, "Limited")
+	data := testVideoBytes(2 * minUploadChunkSize)
+
+	resp, body := env.openSession(t, token, video.ID, int64(len(data)), "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first session: got %d: %s", resp.StatusCode, body)
+	}
+	var first uploadSessionResponse
+	decodeJSON(t, body, &first)
+
+	// Half the free space is promised to the first session
+	resp, body = env.openSession(t, token, video.ID, free-minUploadChunkSize, "")
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("session beyond reserved space: got %d: %s", resp.StatusCode, body)
+	}
+	otherVideo := env.createVideo(t, other, "Other user")
+	resp, body = env.openSession(t, other, otherVideo.ID, free-minUploadChunkSize, "")
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("other user's session beyond reserved space: got %d: %s", resp.StatusCode, body)
+	}
+
+	// Written chunks are on disk already, so they stop being reserved
+	env.sendChunk(t, token, first, data, 0)
+	resp, body = env.openSession(t, token, video.ID, free-minUploadChunkSize, "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("session after a chunk landed: got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = env.openSession(t, token, video.ID, 1000, "")
+	if resp.StatusCode != http.StatusTooManyRequests || errorCode(t, body) != errorCodeTooManyUploadSessions {
+		t.Fatalf("third session: got %d: %s", resp.StatusCode, body)
+	}
+	// The cap is per user; the other user is only short of space
+	resp, body = env.openSession(t, other, otherVideo.ID, 1000, "")
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("other user's session: got %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Lifetimes of the signed URLs handed to clients. S3 refuses to presign
+// for longer than a week.
+const (
+	defaultURLExpiry    = time.Hour
+	defaultMaxURLExpiry = 12 * time.Hour
+	minURLExpiry        = time.Minute
+	maxURLExpiry        = 7 * 24 * time.Hour
+)
+
+// parseURLExpiry reads PRESIGN_EXPIRY, how long signed video, thumbnail
+// and artifact URLs are valid, and PRESIGN_MAX_EXPIRY, the most a request
+// can ask for with ?expires=. Both are durations between 1m and 168h; the
+// maximum defaults to 12h, or PRESIGN_EXPIRY when that's longer.
+func parseURLExpiry(getenv func(string) string) (expiry, maxExpiry time.Duration, err error) {
+	expiry = defaultURLExpiry
+	if v := getenv("PRESIGN_EXPIRY"); v != "" {
+		expiry, err = time.ParseDuration(v)
+		if err != nil || expiry < minURLExpiry || expiry > maxURLExpiry {
+			return 0, 0, errors.New("PRESIGN_EXPIRY must be a duration between 1m and 168h")
+		}
+	}
+	if v := getenv("PRESIGN_MAX_EXPIRY"); v != "" {
+		maxExpiry, err = time.ParseDuration(v)
+		if err != nil || maxExpiry < minURLExpiry || maxExpiry > maxURLExpiry {
+			return 0, 0, errors.New("PRESIGN_MAX_EXPIRY must be a duration between 1m and 168h")
+		}
+		if maxExpiry < expiry {
+			return 0, 0, errors.New("PRESIGN_MAX_EXPIRY can't be shorter than PRESIGN_EXPIRY")
+		}
+		return expiry, maxExpiry, nil
+	}
+	return expiry, max(defaultMaxURLExpiry, expiry), nil
+}
+
+type urlExpiryKey struct{}
+
+// withURLExpiry returns ctx asking for signed URLs valid for expiry.
+func withURLExpiry(ctx context.Context, expiry time.Duration) context.Context {
+	return context.WithValue(ctx, urlExpiryKey{}, expiry)
+}
+
+// urlExpiry is how long URLs signed under ctx are valid: what the request
+// asked for with ?expires=, or PRESIGN_EXPIRY.
+func (cfg *apiConfig) urlExpiry(ctx context.Context) time.Duration {
+	if expiry, ok := ctx.Value(urlExpiryKey{}).(time.Duration); ok {
+		return expiry
+	}
+	return cfg.presignExpiry
+}
+
+// cloudFrontExpiry is urlExpiry for CloudFront signed URLs, which keep
+// CLOUDFRONT_URL_EXPIRY as their default when it's set.
+func (cfg *apiConfig) cloudFrontExpiry(ctx context.Context) time.Duration {
+	if _, ok := ctx.Value(urlExpiryKey{}).(time.Duration); !ok && cfg.cloudFrontSigner.expiry > 0 {
+		return cfg.cloudFrontSigner.expiry
+	}
+	return cfg.urlExpiry(ctx)
+}
+
+// clampURLExpiry turns an ?expires= value, in seconds, into the expiry to
+// sign with, clamped to PRESIGN_MAX_EXPIRY.
+func (cfg *apiConfig) clampURLExpiry(v string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seconds < 1 {
+		return 0, errors.New("expires must be a positive number of seconds")
+	}
+	if seconds > int64(cfg.presignMaxExpiry/time.Second) {
+		return cfg.presignMaxExpiry, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// urlExpiryParam lets the video GET endpoints take ?expires=, the lifetime
+// in seconds of the signed URLs in the response.
+func (cfg *apiConfig) urlExpiryParam(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query().Get("expires")
+		if v == "" {
+			next(w, r)
+			return
+		}
+		expiry, err := cfg.clampURLExpiry(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		next(w, r.WithContext(withURLExpiry(r.Context(), expiry)))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestParseURLExpiry(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		expiry, maximum time.Duration
+		wantErr         bool
+	}{
+		{name: "defaults", expiry: time.Hour, maximum: 12 * time.Hour},
+		{name: "expiry", env: map[string]string{"PRESIGN_EXPIRY": "4h"}, expiry: 4 * time.Hour, maximum: 12 * time.Hour},
+		{name: "expiry past the default maximum", env: map[string]string{"PRESIGN_EXPIRY": "24h"}, expiry: 24 * time.Hour, maximum: 24 * time.Hour},
+		{name: "maximum", env: map[string]string{"PRESIGN_MAX_EXPIRY": "2h"}, expiry: time.Hour, maximum: 2 * time.Hour},
+		{name: "a week", env: map[string]string{"PRESIGN_EXPIRY": "168h", "PRESIGN_MAX_EXPIRY": "168h"}, expiry: 168 * time.Hour, maximum: 168 * time.Hour},
+		{name: "not a duration", env: map[string]string{"PRESIGN_EXPIRY": "3600"}, wantErr: true},
+		{name: "too short", env: map[string]string{"PRESIGN_EXPIRY": "30s"}, wantErr: true},
+		{name: "longer than S3 allows", env: map[string]string{"PRESIGN_EXPIRY": "169h"}, wantErr: true},
+		{name: "maximum below expiry", env: map[string]string{"PRESIGN_EXPIRY": "2h", "PRESIGN_MAX_EXPIRY": "1h"}, wantErr: true},
+		{name: "maximum too long", env: map[string]string{"PRESIGN_MAX_EXPIRY": "200h"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expiry, maximum, err := parseURLExpiry(func(k string) string { return tt.env[k] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if expiry != tt.expiry || maximum != tt.maximum {
+				t.Errorf("got %v, %v; want %v, %v", expiry, maximum, tt.expiry, tt.maximum)
+			}
+		})
+	}
+}
+
+func TestClampURLExpiry(t *testing.T) {
+	cfg := &apiConfig{presignExpiry: time.Hour, presignMaxExpiry: 2 * time.Hour}
+	tests := []struct {
+		v       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{v: "300", want: 5 * time.Minute},
+		{v: "1", want: time.Second},
+		{v: "7200", want: 2 * time.Hour},
+		{v: "7201", want: 2 * time.Hour},
+		{v: "99999999999", want: 2 * time.Hour},
+		{v: "0", wantErr: true},
+		{v: "-5", wantErr: true},
+		{v: "1h", wantErr: true},
+		{v: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := cfg.clampURLExpiry(tt.v)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("clampURLExpiry(%q) = %v, %v; want %v, error %v", tt.v, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// amzExpires returns the X-Amz-Expires of a presigned URL.
+func amzExpires(t *testing.T, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("X-Amz-Expires")
+}
+
+func TestURLExpiryParam(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.presignExpiry = 2 * time.Hour
+		cfg.presignMaxExpiry = 3 * time.Hour
+	})
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Expiring")
+	var thumbnail bytes.Buffer
+	if err := png.Encode(&thumbnail, solidImage(16, 9, color.Black)); err != nil {
+		t.Fatal(err)
+	}
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, map[string]string{
+		"content_type": "image/png",
+		"data_base64":  base64.StdEncoding.EncodeToString(thumbnail.Bytes()),
+	}, http.StatusOK, nil)
+
+	tests := []struct {
+		query, want string
+	}{
+		{"", "7200"},
+		{"?expires=300", "300"},
+		{"?expires=86400", "10800"},
+	}
+	for _, tt := range tests {
+		var got videoResponse
+		env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+tt.query, token, nil, http.StatusOK, &got)
+		if got.ThumbnailURL == nil {
+			t.Fatal("no thumbnail_url")
+		}
+		if expires := amzExpires(t, *got.ThumbnailURL); expires != tt.want {
+			t.Errorf("GET %s: thumbnail X-Amz-Expires = %s, want %s", tt.query, expires, tt.want)
+		}
+		var list []videoResponse
+		env.doJSON(t, http.MethodGet, "/api/videos"+tt.query, token, nil, http.StatusOK, &list)
+		if len(list) != 1 || list[0].ThumbnailURL == nil || amzExpires(t, *list[0].ThumbnailURL) != tt.want {
+			t.Errorf("GET /api/videos%s: listed thumbnail doesn't expire in %s", tt.query, tt.want)
+		}
+	}
+
+	resp, body := env.do(t, http.MethodGet, "/api/videos/"+video.ID+"?expires=soon", token, "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("?expires=soon: got %d, want 400: %s", resp.StatusCode, body)
+	}
+
+	// Restricted videos are presigned for at most restrictedURLExpiry,
+	// but a request can ask for less
+	env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, token, map[string]any{"password": "hunter22"}, http.StatusOK, nil)
+	for query, want := range map[string]time.Duration{"": restrictedURLExpiry, "?expires=60": time.Minute} {
+		var signed struct {
+			VideoURL  string     `json:"video_url"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+"/signed-url"+query, token, nil, http.StatusOK, &signed)
+		if got := amzExpires(t, signed.VideoURL); got != strconv.Itoa(int(want.Seconds())) {
+			t.Errorf("signed-url%s: X-Amz-Expires = %s, want %v", query, got, want)
+		}
+		if signed.ExpiresAt == nil || time.Until(*signed.ExpiresAt) > want || time.Until(*signed.ExpiresAt) < want-time.Minute {
+			t.Errorf("signed-url%s: expires_at = %v, want in %v", query, signed.ExpiresAt, want)
+		}
+	}
+}
+
+func TestLocalVideoURLExpiry(t *testing.T) {
+	env := newTestEnv(t)
+	video := &database.Video{}
+	for ctx, want := range map[context.Context]time.Duration{
+		context.Background(): defaultURLExpiry,
+		withURLExpiry(context.Background(), 10*time.Minute): 10 * time.Minute,
+	} {
+		signed, expiry := env.cfg.signStoredURL(ctx, video, "local,other/video.mp4")
+		if expiry != want {
+			t.Errorf("expiry = %v, want %v", expiry, want)
+		}
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+		if err != nil {
+			t.Fatalf("signed local URL %s has no expires", signed)
+		}
+		if d := time.Until(time.Unix(expires, 0)); d > want || d < want-time.Minute {
+			t.Errorf("local URL expires in %v, want %v", d, want)
+		}
+	}
+}
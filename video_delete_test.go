@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+// videoRow returns videoID's row, trashed or not.
+func (env *testEnv) videoRow(t *testing.T, videoID string) database.Video {
+	t.Helper()
+	video, err := env.cfg.db.GetVideo(mustParseUUID(t, videoID), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+// videoWithThumbnail is an uploaded video with a thumbnail and its grid.
+func (env *testEnv) videoWithThumbnail(t *testing.T, token, title string) database.Video {
+	t.Helper()
+	video := env.uploadedVideo(t, token, title)
+	body := thumbnailJSON(t, 32, 18, color.White)
+	body["grid"] = true
+	env.doJSON(t, http.MethodPost, "/api/videos/"+video.ID+"/thumbnail_json", token, body, http.StatusOK, nil)
+	return env.videoRow(t, video.ID)
+}
+
+// thumbnailsStored reports which of row's thumbnails are still stored,
+// whether in S3 or under assetsRoot.
+func (env *testEnv) thumbnailsStored(t *testing.T, row database.Video) []bool {
+	t.Helper()
+	var stored []bool
+	for _, u := range []*string{row.ThumbnailURL, row.ThumbnailGridURL} {
+		if u == nil {
+			t.Fatal("video has no thumbnail or grid")
+		}
+		if store, key, ok := env.cfg.thumbnailObject(*u); ok {
+			_, found := env.s3.Object(store.Bucket, key)
+			stored = append(stored, found)
+			continue
+		}
+		name, ok := env.cfg.localAssetName(*u)
+		if !ok {
+			t.Fatalf("thumbnail %s is stored neither in S3 nor under assetsRoot", *u)
+		}
+		_, err := os.Stat(env.cfg.assetPath(name))
+		stored = append(stored, err == nil)
+	}
+	return stored
+}
+
+func TestDeleteVideoRemovesStoredFiles(t *testing.T) {
+	for _, backend := range []string{storageBackendS3, storageBackendLocal} {
+		t.Run(backend, func(t *testing.T) {
+			env := newTestEnv(t)
+			if backend == storageBackendLocal {
+				env.cfg.videoStorage = env.cfg.localStorage
+			}
+			_, token := env.createUser(t)
+			row := env.videoWithThumbnail(t, token, "Deleted")
+			store, key, ok := env.cfg.videoObject(*row.VideoURL)
+			if !ok {
+				t.Fatalf("video_url %s isn't a stored object", *row.VideoURL)
+			}
+			if got := env.thumbnailsStored(t, row); !slices.Equal(got, []bool{true, true}) {
+				t.Fatalf("thumbnails stored = %v before the delete", got)
+			}
+
+			if err := env.cfg.deleteVideo(context.Background(), row); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Head(context.Background(), key); err == nil {
+				t.Errorf("video object %s is still stored", key)
+			}
+			if got := env.thumbnailsStored(t, row); !slices.Equal(got, []bool{false, false}) {
+				t.Errorf("thumbnails stored = %v, want both removed", got)
+			}
+			if got, _ := env.cfg.db.GetVideo(row.ID, true); got.ID == row.ID {
+				t.Error("the row is still there")
+			}
+		})
+	}
+}
+
+func TestDeleteVideoKeepsRowWhenStorageFails(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	row := env.videoWithThumbnail(t, token, "Undeletable")
+	key := env.storedVideoKey(t, row.ID.String())
+
+	env.s3.FailWhen(func(op string, r *http.Request) bool { return op == "DeleteObject" })
+	if err := env.cfg.deleteVideo(context.Background(), row); err == nil {
+		t.Fatal("deleteVideo succeeded with S3 failing")
+	}
+	if got, _ := env.cfg.db.GetVideo(row.ID, true); got.ID != row.ID {
+		t.Error("the row went with the object still stored")
+	}
+	if got := env.thumbnailsStored(t, row); !slices.Equal(got, []bool{true, true}) {
+		t.Errorf("thumbnails stored = %v, want a kept row's thumbnails kept", got)
+	}
+
+	// Retrying once S3 is back finishes the job
+	env.s3.FailWhen(nil)
+	if err := env.cfg.deleteVideo(context.Background(), row); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if _, ok := env.s3.Object(testBucket, key); ok {
+		t.Errorf("video object %s is still stored", key)
+	}
+}
+
+func TestDeleteVideoWithObjectAlreadyGone(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.uploadedVideo(t, token, "Already gone")
+	row := env.videoRow(t, video.ID)
+	key := env.storedVideoKey(t, video.ID)
+	if err := env.cfg.s3Storage.Delete(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.cfg.deleteVideo(context.Background(), row); err != nil {
+		t.Fatalf("deleteVideo of a missing object: %v", err)
+	}
+	if got, _ := env.cfg.db.GetVideo(row.ID, true); got.ID == row.ID {
+		t.Error("the row is still there")
+	}
+}
+
+func TestDeleteVideoLegacyBucketValue(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	video := env.createVideo(t, token, "Legacy")
+	env.s3.PutObject("legacy-bucket", "videos/old.mp4", storagetest.FakeObject{Data: []byte("old video")})
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.VideoURL = ptr("legacy-bucket,videos/old.mp4")
+		// Thumbnails outside assetsRoot are left alone
+		v.ThumbnailURL = ptr("data:image/png;base64,AAAA")
+	})
+
+	bucket, key, ok := env.cfg.s3Object("legacy-bucket,videos/old.mp4")
+	if !ok || bucket != "legacy-bucket" || key != "videos/old.mp4" {
+		t.Errorf("s3Object = %s, %s, %v; want the value's bucket and key", bucket, key, ok)
+	}
+	if err := env.cfg.deleteVideo(context.Background(), env.videoRow(t, video.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := env.s3.Object("legacy-bucket", "videos/old.mp4"); ok {
+		t.Error("the legacy object is still stored")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoETag derives a video's entity tag from its version counter, which
+// every write bumps.
+func videoETag(video database.Video) string {
+	return `"` + strconv.Itoa(video.Version) + `"`
+}
+
+// ifMatchSatisfied reports whether r's If-Match header, if any, matches
+// etag. Requests without the header always match, keeping last-write-wins
+// for clients that don't send it.
+func ifMatchSatisfied(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// respondWithPreconditionFailed returns 412 with the current video so the
+// client can merge its changes and retry.
+func respondWithPreconditionFailed(w http.ResponseWriter, current database.Video) {
+	w.Header().Set("ETag", videoETag(current))
+	respondWithErrorDetails(w, http.StatusPreconditionFailed, errorCodePrecondition, "Video was modified since it was read", nil, map[string]any{
+		"current": newOwnerVideoResponse(current),
+	})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+// videoUpload is a complete video file received by one of the upload
+// endpoints and saved to a temp file.
+type videoUpload struct {
+	file      *os.File
+	size      int64
+	mediaType string
+	filename  string
+	metadata  database.UploadMetadata
+
+	// probe is ffprobe's view of the file, taken when it was queued. A
+	// failed probe doesn't stop processing; ffmpeg has the final say.
+	probe     videoMetadata
+	probeErr  error
+	probeTook time.Duration
+}
+
+// ingestVideo scans, processes and stores upload as video's content and
+// saves the row. It runs on the processing workers for both the direct and
+// resumed upload endpoints, after queueVideoProcessing has checked the
+// container. It returns warnings for problems that didn't stop processing;
+// failures are returned as *statusError.
+func (cfg *apiConfig) ingestVideo(ctx context.Context, video *database.Video, upload videoUpload) ([]string, error) {
+	trigger := processingTriggerUpload
+	if video.VideoURL != nil {
+		trigger = processingTriggerReplace
+	}
+
+	defer cfg.admission.startProcessing()()
+	cfg.uploadProgress.stage(video.ID, progressProcessing)
+	ctx = withObjectTags(ctx, video.UserID, video.ID)
+
+	run := cfg.startProcessingRun(video.ID, trigger, upload.size)
+	defer run.finish()
+
+	// Reset file pointer to beginning
+	if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+		return nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to seek temp file", err: err}
+	}
+
+	// The probe ran before queueing; a failed one just means the "other" prefix
+	run.stage("probe", time.Now().Add(-upload.probeTook), upload.probeErr)
+	aspectErr := upload.probeErr
+	var aspect string
+	if aspectErr == nil {
+		aspect, aspectErr = upload.probe.aspectRatio()
+	}
+	var duration *float64
+	if upload.probeErr == nil && upload.probe.Duration > 0 {
+		d := upload.probe.Duration
+		duration = &d
+	}
+
+	// Optional stages (thumbnail, renditions, HLS) run beside the essential
+	// ones and only add warnings. They're stopped once processing fails,
+	// and all have finished before the files they read are removed.
+	optionalCtx, cancelOptional := context.WithCancel(ctx)
+	var optional sync.WaitGroup
+	var processedPath string
+	defer func() {
+		cancelOptional()
+		optional.Wait()
+		if processedPath != "" {
+			os.Remove(processedPath)
+		}
+	}()
+	// Outputs of the optional stages, removed by discard if processing fails
+	var renditions database.Renditions
+	var hlsURL *string
+	discard := func() {
+		cancelOptional()
+		optional.Wait()
+		cfg.deleteReplacedVideo(ctx, renditionURLs(renditions)...)
+		cfg.deleteReplacedHLS(ctx, hlsURL)
+	}
+
+	// The remux doesn't move frames, so the thumbnail can come from the
+	// upload itself. It's only kept if the video still has none once saved.
+	var generated database.Video
+	if presentURL(video.ThumbnailURL) == nil && cfg.tools.FFmpeg && cfg.settings.load().PreviewGeneration {
+		generated.ID = video.ID
+		optional.Add(1)
+		go func() {
+			defer optional.Done()
+			thumbnailStart := time.Now()
+			cfg.autoThumbnail(optionalCtx, &generated, upload.file.Name(), duration)
+			run.stage("thumbnail", thumbnailStart, nil)
+		}()
+	}
+
+	// Scanning and the fast start remux both only read the upload; either
+	// failing cancels the other
+	essential, essentialCtx := errgroup.WithContext(ctx)
+	essential.Go(func() error {
+		scanStart := time.Now()
+		err := cfg.scanUpload(essentialCtx, upload.file)
+		run.stage("scan", scanStart, err)
+		return err
+	})
+	var processed fastStartResult
+	rescued := false
+	essential.Go(func() error {
+		var err error
+		processed, rescued, err = cfg.fastStartUpload(essentialCtx, video.ID, upload, aspectErr, run)
+		return err
+	})
+	err := essential.Wait()
+	if !rescued {
+		processedPath = processed.path
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// HLS packaging only needs the remuxed file, so it runs while the
+	// video is hashed and stored
+	var hlsWarnings []string
+	if cfg.hlsPackaging && cfg.tools.FFmpeg {
+		optional.Add(1)
+		go func() {
+			defer optional.Done()
+			hlsStart := time.Now()
+			playlistURL, warnings := cfg.storeHLS(optionalCtx, processed.path, video.ID)
+			run.stage("hls", hlsStart, nil)
+			hlsWarnings = warnings
+			if playlistURL != "" {
+				hlsURL = &playlistURL
+			}
+		}()
+	}
+
+	processedFile, err := os.Open(processed.path)
+	if err != nil {
+		discard()
+		return nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to open processed file for upload", err: err}
+	}
+	defer processedFile.Close()
+
+	// Name the object by its content so identical uploads share one object
+	hash := sha256.New()
+	if _, err := io.Copy(hash, processedFile); err != nil {
+		discard()
+		return nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to read processed file", err: err}
+	}
+	if _, err := processedFile.Seek(0, io.SeekStart); err != nil {
+		discard()
+		return nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to read processed file", err: err}
+	}
+	// Choose the key prefix from the probed aspect ratio
+	prefix := "other"
+	if aspectErr == nil {
+		if aspect == "16:9" {
+			prefix = "landscape"
+		} else if aspect == "9:16" {
+			prefix = "portrait"
+		}
+	}
+	sum := hash.Sum(nil)
+	key := visibilityKey(fmt.Sprintf("%s/%x.mp4", prefix, sum), publiclyStored(*video))
+
+	// Renditions are named after the video's key, so they're transcoded
+	// while it's stored
+	var renditionWarnings []string
+	if cfg.transcodeRenditions && cfg.tools.FFmpeg && upload.probeErr == nil {
+		optional.Add(1)
+		go func() {
+			defer optional.Done()
+			transcodeStart := time.Now()
+			renditions, renditionWarnings = cfg.storeRenditions(optionalCtx, processed.path, key, upload.mediaType, upload.probe)
+			run.stage("transcode", transcodeStart, nil)
+		}()
+	}
+
+	cfg.uploadProgress.stage(video.ID, progressStoring)
+	uploadStart := time.Now()
+	err = cfg.storeObjectOnce(ctx, key, upload.mediaType, processedFile, sum)
+	// Reported as s3_upload whatever the backend, to keep the stats stable
+	run.stage("s3_upload", uploadStart, err)
+	if err != nil {
+		discard()
+		return nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to store video", err: err}
+	}
+
+	optional.Wait()
+	// Warnings keep the order the stages ran in before they were concurrent
+	processed.warnings = append(processed.warnings, renditionWarnings...)
+	processed.warnings = append(processed.warnings, hlsWarnings...)
+
+	// Objects to remove again if the row can't be saved
+	stored := renditionURLs(renditions)
+
+	// The CloudFront URL for S3, or a local reference signed when served
+	publicURL := cfg.storedVideoURL(key)
+	stored = append(stored, &publicURL)
+
+	// Processing takes a while; keep edits the owner made meanwhile. A
+	// video moved to the trash still gets its upload, in case it's restored
+	current, err := cfg.db.GetVideo(video.ID, true)
+	if err != nil || current.ID == uuid.Nil {
+		run.stage("save", time.Now(), err)
+		cfg.deleteReplacedVideo(ctx, stored...)
+		cfg.deleteReplacedHLS(ctx, hlsURL)
+		if err == nil {
+			return nil, &statusError{status: http.StatusNotFound, msg: "Video was deleted during processing"}
+		}
+		return nil, &statusError{status: http.StatusInternalServerError, msg: "Error retrieving video", err: err}
+	}
+	*video = current
+
+	replaced := append([]*string{video.VideoURL}, renditionURLs(video.Renditions)...)
+	replacedHLS := video.HLSURL
+	video.VideoURL = &publicURL
+	video.Renditions = renditions
+	video.HLSURL = hlsURL
+	// The owner may have changed the video's visibility meanwhile
+	if publiclyStored(*video) != isPublicKey(key) {
+		moved, _, err := cfg.moveVideoObjects(ctx, video)
+		if err != nil {
+			run.stage("save", time.Now(), err)
+			cfg.deleteReplacedVideo(ctx, stored...)
+			cfg.deleteReplacedHLS(ctx, hlsURL)
+			return nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to store video", err: err}
+		}
+		stored = append(stored, renditionURLs(video.Renditions)...)
+		stored = append(stored, video.VideoURL)
+		cfg.deleteReplacedVideo(ctx, moved...)
+	}
+	checksum := base64.StdEncoding.EncodeToString(sum)
+	video.ChecksumSHA256 = &checksum
+	video.Status = database.VideoStatusReady
+	ready := database.ProcessingStatusReady
+	video.ProcessingStatus = &ready
+	video.ProcessingError = nil
+	// Record the served content type so playback doesn't depend on object metadata
+	video.ContentType = &upload.mediaType
+	video.UploadMetadata = upload.metadata
+	video.ProcessingWarnings = processed.warnings
+	video.ProcessingBranch = &processed.branch
+	video.SizeBytes = nil
+	if info, err := processedFile.Stat(); err == nil {
+		size := info.Size()
+		video.SizeBytes = &size
+	}
+	video.DurationSeconds = duration
+	// The owner may have uploaded a thumbnail meanwhile
+	if presentURL(video.ThumbnailURL) == nil && generated.ThumbnailURL != nil {
+		video.ThumbnailURL, video.ThumbnailGridURL = generated.ThumbnailURL, generated.ThumbnailGridURL
+		video.ThumbnailWidth, video.ThumbnailHeight = generated.ThumbnailWidth, generated.ThumbnailHeight
+	}
+	if name := sanitizeDisplayFilename(upload.filename); name != "" {
+		video.OriginalFilename = &name
+	} else {
+		video.OriginalFilename = nil
+	}
+
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		run.stage("save", time.Now(), err)
+		cfg.deleteReplacedVideo(ctx, stored...)
+		cfg.deleteReplacedHLS(ctx, hlsURL)
+		return nil, &statusError{status: http.StatusInternalServerError, msg: "Failed to update video URL", err: err}
+	}
+	video.Version++
+	// The row no longer points at the previous objects
+	cfg.deleteReplacedVideo(ctx, replaced...)
+	cfg.deleteReplacedHLS(ctx, replacedHLS)
+
+	var outputSize int64
+	if video.SizeBytes != nil {
+		outputSize = *video.SizeBytes
+	}
+	if rescued {
+		run.succeedPartial(outputSize, processed.warnings)
+	} else {
+		run.succeed(outputSize, processed.warnings)
+	}
+	return processed.warnings, nil
+}
+
+// fastStartUpload remuxes upload for fast start (moving the moov atom to
+// the front). An upload it can't remux is stored as it is under the store
+// original failure policy, or without ffmpeg when ALLOW_UNPROCESSED_UPLOADS
+// is set, which rescued reports; other failures are returned as
+// *statusError.
+func (cfg *apiConfig) fastStartUpload(ctx context.Context, videoID uuid.UUID, upload videoUpload, aspectErr error, run *processingRecorder) (processed fastStartResult, rescued bool, err error) {
+	faststartStart := time.Now()
+	if cfg.tools.FFmpeg {
+		processed, err = processVideoForFastStart(ctx, upload.file.Name())
+	} else {
+		err = fmt.Errorf("%w: ffmpeg wasn't found at startup", errToolUnavailable)
+	}
+	run.stage("faststart", faststartStart, err)
+	switch {
+	case err == nil:
+		return processed, false, nil
+	case errors.Is(err, errToolTimeout):
+		return processed, false, &statusError{status: http.StatusUnprocessableEntity, msg: "Video could not be processed", code: errorCodeProcessingFailed, err: err}
+	case errors.Is(err, errInvalidContainer):
+		return processed, false, &statusError{status: http.StatusUnprocessableEntity, msg: "Invalid or unsupported video container", code: errorCodeInvalidMediaType, err: err}
+	case errors.Is(err, errFastStartFailed) && aspectErr == nil && cfg.fastStartFailurePolicy == fastStartFailureStoreOriginal,
+		errors.Is(err, errToolUnavailable) && cfg.allowUnprocessedUploads:
+		// The probe could read it, so browsers most likely can too;
+		// store the upload as-is rather than failing after the transfer.
+		// Without ffmpeg, ALLOW_UNPROCESSED_UPLOADS asks for the same.
+		log.Printf("storing video %s without faststart: %v", videoID, err)
+		fastStartRescues.Add(1)
+		return fastStartResult{
+			path:     upload.file.Name(),
+			warnings: []string{fastStartSkippedWarning},
+			branch:   processingBranchOriginal,
+		}, true, nil
+	case errors.Is(err, errToolUnavailable):
+		return processed, false, &statusError{status: http.StatusServiceUnavailable, msg: "Video processing is unavailable: ffmpeg isn't installed", code: errorCodeFFmpegUnavailable, err: err}
+	default:
+		return processed, false, &statusError{status: http.StatusInternalServerError, msg: "Failed to process video for fast start", code: errorCodeProcessingFailed, err: err}
+	}
+}
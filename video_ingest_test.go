@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// gatedScanner holds each scan until release is closed or the scan is
+// cancelled, reporting the cancellation on cancelled.
+type gatedScanner struct {
+	started   chan struct{}
+	release   chan struct{}
+	cancelled chan struct{}
+}
+
+func newGatedScanner() *gatedScanner {
+	return &gatedScanner{started: make(chan struct{}, 1), release: make(chan struct{}), cancelled: make(chan struct{}, 1)}
+}
+
+func (s *gatedScanner) Scan(ctx context.Context, r io.Reader) (ScanVerdict, error) {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return ScanVerdict{}, nil
+	case <-ctx.Done():
+		s.cancelled <- struct{}{}
+		return ScanVerdict{}, ctx.Err()
+	}
+}
+
+// ingestFixture returns the video row for a new video and an upload of
+// data for it, as queueVideoProcessing would hand them to ingestVideo.
+func (env *testEnv) ingestFixture(t testing.TB, data []byte) (database.Video, videoUpload) {
+	t.Helper()
+	_, token := env.createUser(t)
+	created := env.createVideo(t, token, "Ingested")
+	video, err := env.cfg.db.GetVideo(mustParseUUID(t, created.ID), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "upload.mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	upload := videoUpload{file: file, size: int64(len(data)), mediaType: "video/mp4"}
+	probeUpload(context.Background(), &upload)
+	return video, upload
+}
+
+// ingestAsync runs ingestVideo and returns its error on the channel.
+func (env *testEnv) ingestAsync(video database.Video, upload videoUpload) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := env.cfg.ingestVideo(context.Background(), &video, upload)
+		done <- err
+	}()
+	return done
+}
+
+func TestIngestFastStartFailureCancelsScan(t *testing.T) {
+	scanner := newGatedScanner()
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.scanner = scanner
+		cfg.tools.FFmpeg = false
+		cfg.allowUnprocessedUploads = false
+	})
+	video, upload := env.ingestFixture(t, testVideoBytes(64<<10))
+
+	// The scan never finishes by itself, so only the faststart failure
+	// cancelling it can end processing
+	done := env.ingestAsync(video, upload)
+	select {
+	case err := <-done:
+		var se *statusError
+		if !errors.As(err, &se) || se.status != http.StatusServiceUnavailable {
+			t.Fatalf("ingestVideo = %v, want the 503 for a missing ffmpeg", err)
+		}
+	case <-time.After(5 * time.Second):
+		close(scanner.release)
+		t.Fatal("ingestVideo waited for the scan after faststart had failed")
+	}
+	select {
+	case <-scanner.cancelled:
+	default:
+		t.Error("the scan wasn't cancelled")
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("a failed ingest stored %v", keys)
+	}
+}
+
+func TestIngestStoresOnlyAfterScan(t *testing.T) {
+	scanner := newGatedScanner()
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.scanner = scanner
+		cfg.tools.FFmpeg = false
+	})
+	video, upload := env.ingestFixture(t, testVideoBytes(64<<10))
+
+	done := env.ingestAsync(video, upload)
+	<-scanner.started
+	// Let faststart (here, its rescue) finish while the scan is held
+	time.Sleep(50 * time.Millisecond)
+	if puts := env.s3.Calls("PutObject"); puts != 0 {
+		t.Fatalf("%d objects were stored before the scan passed", puts)
+	}
+	close(scanner.release)
+	if err := <-done; err != nil {
+		t.Fatalf("ingestVideo: %v", err)
+	}
+	stored, err := env.cfg.db.GetVideo(video.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VideoURL == nil || stored.Status != database.VideoStatusReady {
+		t.Errorf("video_url = %v, status = %q; want stored and ready", stored.VideoURL, stored.Status)
+	}
+	if got := []string(stored.ProcessingWarnings); len(got) != 1 || got[0] != fastStartSkippedWarning {
+		t.Errorf("processing warnings = %q, want only %q", got, fastStartSkippedWarning)
+	}
+}
+
+func TestIngestInfectedUploadAfterFastStart(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.scanner = eicarScanner{}
+	})
+	video, upload := env.ingestFixture(t, append(testVideoBytes(64<<10), eicar...))
+
+	_, err := env.cfg.ingestVideo(context.Background(), &video, upload)
+	var se *statusError
+	if !errors.As(err, &se) || se.code != errorCodeMalwareDetected {
+		t.Fatalf("ingestVideo = %v, want malware detected", err)
+	}
+	if keys := env.s3.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("an infected upload was stored: %v", keys)
+	}
+}
+
+// BenchmarkIngestVideo times ingestVideo on the horizontal sample from
+// samplesdownload.sh, or on generated bytes when it hasn't been fetched.
+// Each iteration changes the upload's last bytes so none is deduplicated.
+func BenchmarkIngestVideo(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("samples", "boots-video-horizontal.mp4"))
+	if err != nil {
+		data = testVideoBytes(8 << 20)
+	}
+	env := newTestEnv(b)
+	video, upload := env.ingestFixture(b, data)
+	path := upload.file.Name()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		data[len(data)-1], data[len(data)-2] = byte(i), byte(i>>8)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if _, err := env.cfg.ingestVideo(context.Background(), &video, upload); err != nil {
+			b.Fatalf("ingestVideo: %v", err)
+		}
+	}
+}
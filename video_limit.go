@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// videoLimitExceeded reports whether userID is already at the per-user video
+// limit. Drafts without uploaded content only count when
+// cfg.countDraftsTowardLimit is set; uploads of such drafts check with
+// withContentOnly so they're counted at the moment they gain content.
+func (cfg *apiConfig) videoLimitExceeded(userID uuid.UUID, withContentOnly bool) (int, bool, error) {
+	if cfg.maxVideosPerUser <= 0 {
+		return 0, false, nil
+	}
+	count, err := cfg.db.CountVideos(userID, withContentOnly)
+	if err != nil {
+		return 0, false, err
+	}
+	return count, count >= cfg.maxVideosPerUser, nil
+}
+
+// videosRemaining is how many more videos a user with count videos can
+// have, or nil when there is no limit.
+func (cfg *apiConfig) videosRemaining(count int) *int {
+	if cfg.maxVideosPerUser <= 0 {
+		return nil
+	}
+	remaining := max(cfg.maxVideosPerUser-count, 0)
+	return &remaining
+}
+
+func respondWithVideoLimit(w http.ResponseWriter, count, limit int) {
+	respondWithErrorDetails(w, http.StatusForbidden, errorCodeVideoLimit, "Video limit reached", nil, map[string]any{
+		"count": count,
+		"limit": limit,
+	})
+}
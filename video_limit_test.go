@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+type videoLimitStats struct {
+	VideoCount     int  `json:"video_count"`
+	VideoLimit     int  `json:"video_limit"`
+	VideoRemaining *int `json:"video_remaining"`
+}
+
+func TestVideoLimitBoundary(t *testing.T) {
+	env := newTestEnv(t, func(cfg *apiConfig) {
+		cfg.maxVideosPerUser = 2
+		cfg.countDraftsTowardLimit = true
+	})
+	_, token := env.createUser(t)
+
+	remaining := func() int {
+		t.Helper()
+		var stats videoLimitStats
+		env.doJSON(t, http.MethodGet, "/api/users/me/cleanup-suggestions", token, nil, http.StatusOK, &stats)
+		if stats.VideoRemaining == nil {
+			t.Fatal("video_remaining is null with a limit set")
+		}
+		return *stats.VideoRemaining
+	}
+
+	if got := remaining(); got != 2 {
+		t.Errorf("remaining with no videos = %d, want 2", got)
+	}
+	env.createVideo(t, token, "first")
+	// One below the limit, creating is still allowed
+	if got := remaining(); got != 1 {
+		t.Errorf("remaining with one video = %d, want 1", got)
+	}
+	env.createVideo(t, token, "second")
+	if got := remaining(); got != 0 {
+		t.Errorf("remaining at the limit = %d, want 0", got)
+	}
+
+	resp, body := env.do(t, http.MethodPost, "/api/videos", token, "application/json",
+		jsonBody(t, map[string]string{"title": "third"}))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("creating past the limit: got %d, want 403: %s", resp.StatusCode, body)
+	}
+	var limit struct {
+		Error struct {
+			Count int `json:"count"`
+			Limit int `json:"limit"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &limit)
+	if limit.Error.Count != 2 || limit.Error.Limit != 2 {
+		t.Errorf("limit error = %s, want count 2 and limit 2", body)
+	}
+
+	// Other users have their own allowance
+	_, other := env.createUser(t)
+	env.createVideo(t, other, "theirs")
+}
+
+func TestVideoLimitRemainingUnlimited(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	env.createVideo(t, token, "first")
+
+	var stats videoLimitStats
+	env.doJSON(t, http.MethodGet, "/api/users/me/cleanup-suggestions", token, nil, http.StatusOK, &stats)
+	if stats.VideoRemaining != nil {
+		t.Errorf("video_remaining = %d without a limit, want null", *stats.VideoRemaining)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultVideoPage = 20
+	maxVideoPage     = 100
+)
+
+// videoPageCursor is the opaque next_cursor of a video page. It carries
+// the sort and order it was issued for, so it can't be replayed against a
+// different ordering.
+type videoPageCursor struct {
+	Sort  string    `json:"s"`
+	Order string    `json:"o"`
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+func encodeVideoPageCursor(c videoPageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeVideoPageCursor(s string) (videoPageCursor, error) {
+	var c videoPageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	if c.ID == uuid.Nil {
+		return c, errors.New("cursor has no ID")
+	}
+	return c, nil
+}
+
+type videoPageResponse struct {
+	Videos     []videoResponse `json:"videos"`
+	NextCursor *string         `json:"next_cursor"`
+}
+
+// respondWithVideoPage answers GET /api/videos when it is called with
+// ?limit=, ?cursor=, ?sort=created_at|title or ?order=asc|desc, and the
+// public listing always. params picks whose videos are listed; owner says
+// the caller owns them all and sees the owner-only fields. Pages default
+// to the newest 20 videos; limit is capped at 100. Only the returned page
+// is signed.
+func (cfg *apiConfig) respondWithVideoPage(w http.ResponseWriter, r *http.Request, params database.VideoPageParams, owner bool) {
+	query := r.URL.Query()
+
+	limit := defaultVideoPage
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer", err)
+			return
+		}
+		limit = min(n, maxVideoPage)
+	}
+
+	sort := query.Get("sort")
+	switch sort {
+	case "":
+		sort = database.VideoSortCreatedAt
+	case database.VideoSortCreatedAt, database.VideoSortTitle:
+	default:
+		respondWithError(w, http.StatusBadRequest, "sort must be created_at or title", nil)
+		return
+	}
+	order := query.Get("order")
+	switch order {
+	case "":
+		order = "desc"
+		if sort == database.VideoSortTitle {
+			order = "asc"
+		}
+	case "asc", "desc":
+	default:
+		respondWithError(w, http.StatusBadRequest, "order must be asc or desc", nil)
+		return
+	}
+
+	params.Sort = sort
+	params.Descending = order == "desc"
+	params.Limit = limit
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeVideoPageCursor(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+		if cursor.Sort != sort || cursor.Order != order {
+			respondWithError(w, http.StatusBadRequest, "Cursor was issued for a different sort or order", nil)
+			return
+		}
+		params.After = &database.VideoCursor{Value: cursor.Value, ID: cursor.ID}
+	}
+
+	videos, next, err := cfg.db.GetVideoPage(params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	for i := range videos {
+		// Others get these URLs only from the video itself, once its
+		// password and embed origin are checked
+		if !owner && viewRestricted(videos[i]) {
+			videos[i].VideoURL = nil
+			videos[i].Renditions = nil
+			videos[i].HLSURL = nil
+		}
+		cfg.prepareListedVideo(r.Context(), &videos[i])
+	}
+
+	resp := videoPageResponse{Videos: newVideoResponses(videos)}
+	if !owner {
+		resp.Videos = make([]videoResponse, 0, len(videos))
+		for _, video := range videos {
+			resp.Videos = append(resp.Videos, newVideoResponse(video))
+		}
+	}
+	if next != nil {
+		cursor := encodeVideoPageCursor(videoPageCursor{Sort: sort, Order: order, Value: next.Value, ID: next.ID})
+		resp.NextCursor = &cursor
+	}
+	setResponseMeta(w, "count", len(videos))
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videosCreatedTogether creates n videos for userID that all share one
+// created_at, and returns their IDs.
+func (env *testEnv) videosCreatedTogether(t *testing.T, userID uuid.UUID, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := range n {
+		video, err := env.cfg.db.CreateVideo(database.CreateVideoParams{Title: fmt.Sprintf("Video %03d", i), UserID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, video.ID.String())
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(env.cfg.filepathRoot, "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`UPDATE videos SET created_at = '2026-01-02 03:04:05' WHERE user_id = ?`, userID); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// videoPages follows next_cursor from the first page of query to the
+// last, returning the IDs of each page.
+func (env *testEnv) videoPages(t *testing.T, token string, query url.Values) [][]string {
+	t.Helper()
+	var pages [][]string
+	for {
+		var page videoPageResponse
+		env.doJSON(t, http.MethodGet, "/api/videos?"+query.Encode(), token, nil, http.StatusOK, &page)
+		var ids []string
+		for _, video := range page.Videos {
+			ids = append(ids, video.ID)
+		}
+		pages = append(pages, ids)
+		if page.NextCursor == nil {
+			return pages
+		}
+		if len(pages) > 100 {
+			t.Fatal("next_cursor never ran out")
+		}
+		query.Set("cursor", *page.NextCursor)
+	}
+}
+
+func TestVideoPagesWithIdenticalTimestamps(t *testing.T) {
+	env := newTestEnv(t)
+	userID, token := env.createUser(t)
+	ids := env.videosCreatedTogether(t, userID, 7)
+
+	// Ties on created_at fall back to ID order
+	byID := slices.Clone(ids)
+	slices.Sort(byID)
+	reversed := slices.Clone(byID)
+	slices.Reverse(reversed)
+	for order, want := range map[string][]string{"asc": byID, "desc": reversed} {
+		pages := env.videoPages(t, token, url.Values{"limit": {"3"}, "order": {order}})
+		var sizes []int
+		for _, page := range pages {
+			sizes = append(sizes, len(page))
+		}
+		if !slices.Equal(sizes, []int{3, 3, 1}) {
+			t.Errorf("order=%s: page sizes %v, want 3, 3 and 1", order, sizes)
+		}
+		if got := slices.Concat(pages...); !slices.Equal(got, want) {
+			t.Errorf("order=%s: videos %v, want %v", order, got, want)
+		}
+	}
+}
+
+func TestVideoPagesSortByTitle(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	for _, title := range []string{"banana", "Cherry", "apple", "Banana split"} {
+		env.createVideo(t, token, title)
+	}
+
+	var titles []string
+	query := url.Values{"sort": {"title"}, "limit": {"2"}}
+	for _, ids := range env.videoPages(t, token, query) {
+		for _, id := range ids {
+			var video videoResponse
+			env.doJSON(t, http.MethodGet, "/api/videos/"+id, token, nil, http.StatusOK, &video)
+			titles = append(titles, video.Title)
+		}
+	}
+	// Titles sort case-insensitively, ascending by default
+	if want := []string{"apple", "banana", "Banana split", "Cherry"}; !slices.Equal(titles, want) {
+		t.Errorf("titles %v, want %v", titles, want)
+	}
+}
+
+func TestVideoPageLimits(t *testing.T) {
+	env := newTestEnv(t)
+	userID, token := env.createUser(t)
+	env.videosCreatedTogether(t, userID, maxVideoPage+5)
+
+	tests := map[string]int{
+		"order=desc": defaultVideoPage,
+		"limit=5":    5,
+		"limit=500":  maxVideoPage,
+	}
+	for query, want := range tests {
+		var page videoPageResponse
+		env.doJSON(t, http.MethodGet, "/api/videos?"+query, token, nil, http.StatusOK, &page)
+		if len(page.Videos) != want || page.NextCursor == nil {
+			t.Errorf("?%s: %d videos, next_cursor %v; want %d and a next page", query, len(page.Videos), page.NextCursor, want)
+		}
+	}
+
+	// Without paging parameters the full list comes back as an array
+	var all []videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos", token, nil, http.StatusOK, &all)
+	if len(all) != maxVideoPage+5 {
+		t.Errorf("unpaged listing has %d videos, want %d", len(all), maxVideoPage+5)
+	}
+}
+
+func TestVideoPageRejectsBadParameters(t *testing.T) {
+	env := newTestEnv(t)
+	userID, token := env.createUser(t)
+	env.videosCreatedTogether(t, userID, 3)
+	var page videoPageResponse
+	env.doJSON(t, http.MethodGet, "/api/videos?sort=title&limit=1", token, nil, http.StatusOK, &page)
+	titleCursor := *page.NextCursor
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=ten",
+		"sort=views",
+		"order=sideways",
+		"cursor=not-a-cursor",
+		"cursor=" + encodeVideoPageCursor(videoPageCursor{Sort: "created_at", Order: "desc"}),
+		// A cursor only continues the ordering it was issued for
+		"cursor=" + titleCursor,
+		"sort=title&order=desc&cursor=" + titleCursor,
+	} {
+		resp, body := env.do(t, http.MethodGet, "/api/videos?"+query, token, "", nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("?%s: got %d: %s, want 400", query, resp.StatusCode, body)
+		}
+		if strings.Contains(string(body), `"next_cursor"`) {
+			t.Errorf("?%s: got a page instead of an error", query)
+		}
+	}
+}
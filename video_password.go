@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	videoPasswordHeader      = "X-Video-Password"
+	maxVideoPasswordFailures = 5
+	videoPasswordWindow      = 15 * time.Minute
+)
+
+// passwordAttemptLimiter counts failed video password attempts per client IP
+// and video within a fixed window.
+type passwordAttemptLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*passwordFailures
+}
+
+type passwordFailures struct {
+	count       int
+	windowStart time.Time
+}
+
+func newPasswordAttemptLimiter() *passwordAttemptLimiter {
+	return &passwordAttemptLimiter{failures: map[string]*passwordFailures{}}
+}
+
+func (l *passwordAttemptLimiter) blocked(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[key]
+	if !ok {
+		return false
+	}
+	if now.Sub(f.windowStart) > videoPasswordWindow {
+		delete(l.failures, key)
+		return false
+	}
+	return f.count >= maxVideoPasswordFailures
+}
+
+func (l *passwordAttemptLimiter) recordFailure(key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Drop expired entries as we go so the map can't grow without bound
+	for k, f := range l.failures {
+		if now.Sub(f.windowStart) > videoPasswordWindow {
+			delete(l.failures, k)
+		}
+	}
+	f, ok := l.failures[key]
+	if !ok {
+		f = &passwordFailures{windowStart: now}
+		l.failures[key] = f
+	}
+	f.count++
+}
+
+// optionalUserID returns the authenticated user, or uuid.Nil for anonymous
+// or invalid credentials on endpoints that don't require auth.
+func (cfg *apiConfig) optionalUserID(r *http.Request) uuid.UUID {
+	return cfg.optionalIdentity(r).UserID
+}
+
+// optionalIdentity is optionalUserID including impersonation claims; the
+// zero Identity means anonymous.
+func (cfg *apiConfig) optionalIdentity(r *http.Request) auth.Identity {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return auth.Identity{}
+	}
+	identity, err := auth.ValidateJWTIdentity(token, cfg.jwtSecret)
+	if err != nil {
+		return auth.Identity{}
+	}
+	return identity
+}
+
+// checkVideoPassword enforces per-video passwords for non-owners. It writes
+// the error response and returns false when access is denied.
+func (cfg *apiConfig) checkVideoPassword(w http.ResponseWriter, r *http.Request, video database.Video) bool {
+	if video.PasswordHash == nil || cfg.optionalUserID(r) == video.UserID {
+		return true
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	key := ip + "|" + video.ID.String()
+	now := time.Now()
+	if cfg.passwordAttempts.blocked(key, now) {
+		respondWithError(w, http.StatusTooManyRequests, "Too many password attempts", nil)
+		return false
+	}
+
+	password := r.Header.Get(videoPasswordHeader)
+	if password == "" {
+		respondWithError(w, http.StatusUnauthorized, "This video is password protected", nil)
+		return false
+	}
+	if err := auth.CheckPasswordHash(password, *video.PasswordHash); err != nil {
+		cfg.passwordAttempts.recordFailure(key, now)
+		respondWithError(w, http.StatusUnauthorized, "Incorrect video password", nil)
+		return false
+	}
+	return true
+}
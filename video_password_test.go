@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+// checkExpiringURL fails t unless rawURL is presigned to expire within
+// restrictedURLExpiry; an unsigned distribution URL would never expire.
+func checkExpiringURL(t *testing.T, what, rawURL string) {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("%s %q: %v", what, rawURL, err)
+	}
+	if u.Host == testCDN {
+		t.Errorf("%s is a distribution URL: %s", what, rawURL)
+	}
+	if got, want := u.Query().Get("X-Amz-Expires"), "900"; got != want {
+		t.Errorf("%s X-Amz-Expires = %q, want %s: %s", what, got, want, rawURL)
+	}
+}
+
+func TestPasswordProtectedVideoURLsExpire(t *testing.T) {
+	env := newTestEnv(t)
+	_, owner := env.createUser(t)
+	_, viewer := env.createUser(t)
+	video := env.uploadedVideo(t, owner, "Protected")
+	env.s3.PutObject(testBucket, "hls/"+video.ID+"/set/index.m3u8", storagetest.FakeObject{Data: []byte("#EXTM3U\nseg0.ts\n")})
+	env.updateVideo(t, video.ID, func(v *database.Video) {
+		v.HLSURL = ptr(env.cfg.storedVideoURL("hls/" + video.ID + "/set/index.m3u8"))
+	})
+	env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, owner, map[string]any{"password": "hunter22", "visibility": database.VisibilityUnlisted}, http.StatusOK, nil)
+	if env.cfg.cloudFrontSigner != nil {
+		t.Fatal("the test env signs distribution URLs; this test is about when nothing does")
+	}
+
+	var got videoResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, owner, nil, http.StatusOK, &got)
+	if got.VideoURL == nil {
+		t.Fatal("the owner got no video_url")
+	}
+	checkExpiringURL(t, "owner's video_url", *got.VideoURL)
+	if got.HLSURL == nil || *got.HLSURL != hlsPlaylistPath(mustParseUUID(t, video.ID)) {
+		t.Errorf("hls_url = %v, want the playlist endpoint", got.HLSURL)
+	}
+
+	resp, body := env.do(t, http.MethodGet, "/api/videos/"+video.ID, viewer, "", nil, videoPasswordHeader, "hunter22")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("with the password: got %d: %s", resp.StatusCode, body)
+	}
+	decodeJSON(t, body, &got)
+	checkExpiringURL(t, "viewer's video_url", *got.VideoURL)
+
+	var signed struct {
+		VideoURL  string     `json:"video_url"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+"/signed-url", owner, nil, http.StatusOK, &signed)
+	checkExpiringURL(t, "signed-url", signed.VideoURL)
+	if signed.ExpiresAt == nil || time.Until(*signed.ExpiresAt) > restrictedURLExpiry {
+		t.Errorf("expires_at = %v, want within %v", signed.ExpiresAt, restrictedURLExpiry)
+	}
+
+	resp, body = env.do(t, http.MethodGet, "/api/videos/"+video.ID+"/hls.m3u8", owner, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("playlist: got %d: %s", resp.StatusCode, body)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			checkExpiringURL(t, "segment", line)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// STORAGE_BACKEND values.
+const (
+	storageBackendS3    = "s3"
+	storageBackendLocal = "local"
+)
+
+// localVideoDir is the directory under assetsRoot, and the path under the
+// assets route, that the local backend keeps videos in.
+const localVideoDir = "videos"
+
+// localStorageSecret derives the key local video URLs are signed with from
+// the JWT secret, so there is no second secret to configure.
+func localStorageSecret(jwtSecret string) []byte {
+	sum := sha256.Sum256([]byte("tubely local storage\x00" + jwtSecret))
+	return sum[:]
+}
+
+// initStorage sets up both storage backends and picks the one new videos
+// go to. Both always exist, so videos stored before STORAGE_BACKEND
+// changed can still be served and deleted.
+func (cfg *apiConfig) initStorage(backend string) {
+	cfg.s3Storage = &storage.S3{
+		Client:             cfg.s3Client,
+		Bucket:             cfg.s3Bucket,
+		MultipartThreshold: multipartThreshold,
+		PartParams: func() (int64, int) {
+			return cfg.uploadThroughput.uploadParams(cfg.maxPartSize, cfg.maxUploadConcurrency)
+		},
+		PartAttempts:         cfg.uploadPartAttempts,
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyID:          cfg.s3KMSKeyID,
+		Journal:              multipartJournal{db: cfg.db},
+		Presigner:            s3.NewPresignClient(cfg.s3Client),
+	}
+	cfg.localStorage = storage.NewLocal(cfg.assetPath(localVideoDir), cfg.assetURL(localVideoDir), localStorageSecret(cfg.jwtSecret))
+	cfg.videoStorage = cfg.s3Storage
+	if backend == storageBackendLocal {
+		cfg.videoStorage = cfg.localStorage
+	}
+}
+
+// storedVideoURL is what a video row records for an object stored under
+// key: the distribution URL for S3, and "local,<key>" for the local
+// backend, which has no public URL until one is signed.
+func (cfg *apiConfig) storedVideoURL(key string) string {
+	if cfg.videoStorage.Name() == storageBackendLocal {
+		return storageBackendLocal + "," + key
+	}
+	return fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
+}
+
+// artifactStore returns where renditions and HLS sets are stored: the
+// artifacts bucket with S3, and the video storage backend otherwise.
+func (cfg *apiConfig) artifactStore() storage.Storage {
+	if cfg.videoStorage.Name() != storageBackendS3 {
+		return cfg.videoStorage
+	}
+	return cfg.s3Storage.WithBucket(cfg.s3ArtifactsBucket)
+}
+
+// storedObjectURL is what a video row records for key in store: what
+// storedVideoURL returns, except for S3 buckets other than s3Bucket. The
+// distribution only serves s3Bucket, so those are recorded as
+// "bucket,key" and presigned when handed out.
+func (cfg *apiConfig) storedObjectURL(store storage.Storage, key string) string {
+	if s3Store, ok := store.(*storage.S3); ok && s3Store.Bucket != cfg.s3Bucket {
+		return s3Store.Bucket + "," + key
+	}
+	return cfg.storedVideoURL(key)
+}
+
+// outsideDistribution reports whether storedURL is an object in an S3
+// bucket the distribution doesn't serve.
+func (cfg *apiConfig) outsideDistribution(storedURL string) bool {
+	bucket, _, ok := strings.Cut(storedURL, ",")
+	bucket = strings.TrimSpace(bucket)
+	return ok && bucket != storageBackendLocal && bucket != "" && bucket != cfg.s3Bucket
+}
+
+// restrictedURLExpiry is how long a presigned URL for a password or origin
+// restricted video is valid, kept short since it can be passed around.
+const restrictedURLExpiry = 15 * time.Minute
+
+// presignStoredURL returns a presigned URL for storedURL with how long
+// it's valid for, or storedURL unchanged if signing fails.
+func (cfg *apiConfig) presignStoredURL(ctx context.Context, video *database.Video, storedURL string) (string, time.Duration) {
+	store, key, ok := cfg.videoObject(storedURL)
+	if !ok {
+		return storedURL, 0
+	}
+	signed, left, err := cfg.presignObject(ctx, store, key, cfg.urlExpiry(ctx))
+	if err != nil {
+		log.Printf("couldn't presign %s for video %s: %v", key, video.ID, err)
+		return storedURL, 0
+	}
+	return signed, left
+}
+
+// presignObject returns a URL for key in store valid for expiry, and how
+// long it has left: a URL from presignCache may have been signed earlier.
+// The cache is bypassed while the presign_cache setting is off.
+func (cfg *apiConfig) presignObject(ctx context.Context, store storage.Storage, key string, expiry time.Duration) (string, time.Duration, error) {
+	cache := cfg.presignCache
+	if !cfg.settings.load().PresignCache {
+		cache = nil
+	}
+	object := presignObjectKey(store, key)
+	if signed, left, ok := cache.get(object, expiry); ok {
+		return signed, left, nil
+	}
+	var signed string
+	err := timed(ctx, store.Name()+"_presign", func() (err error) {
+		signed, err = store.PresignGet(ctx, key, expiry)
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	cache.put(object, expiry, signed)
+	return signed, expiry, nil
+}
+
+// videoObject returns the storage and key holding a stored video.
+// "local,<key>" values are in the local backend; legacy "bucket,key"
+// values name their S3 bucket; distribution URLs are in s3Bucket.
+func (cfg *apiConfig) videoObject(videoURL string) (storage.Storage, string, bool) {
+	if key, ok := strings.CutPrefix(videoURL, storageBackendLocal+","); ok {
+		key = strings.TrimSpace(key)
+		return cfg.localStorage, key, key != ""
+	}
+	bucket, key, ok := cfg.s3Object(videoURL)
+	if !ok {
+		return nil, "", false
+	}
+	return cfg.s3Storage.WithBucket(bucket), key, true
+}
+
+// isLocalVideoURL reports whether a stored video URL refers to the local
+// backend.
+func isLocalVideoURL(videoURL string) bool {
+	return strings.HasPrefix(videoURL, storageBackendLocal+",")
+}
+
+// signLocalVideoURL returns a signed assets URL for a video stored
+// locally, or rawURL unchanged if it isn't one or signing fails. Public
+// objects get a plain assets URL.
+func (cfg *apiConfig) signLocalVideoURL(ctx context.Context, video *database.Video, rawURL string) string {
+	store, key, ok := cfg.videoObject(rawURL)
+	if !ok || !isLocalVideoURL(rawURL) {
+		return rawURL
+	}
+	if isPublicKey(key) {
+		return absoluteURL(ctx, cfg.assetURL(localVideoDir+"/"+key))
+	}
+	signed, err := store.PresignGet(ctx, key, cfg.urlExpiry(ctx))
+	if err != nil {
+		log.Printf("couldn't sign local URL for video %s: %v", video.ID, err)
+		return rawURL
+	}
+	return absoluteURL(ctx, signed)
+}
+
+type objectTagsKey struct{}
+
+// withObjectTags returns ctx carrying the user and video objects stored
+// under it belong to, for S3 cost allocation tags. Storage helpers read
+// them from ctx, so renditions and HLS segments are tagged too.
+func withObjectTags(ctx context.Context, userID, videoID uuid.UUID) context.Context {
+	return context.WithValue(ctx, objectTagsKey{}, map[string]string{
+		"user_id":  userID.String(),
+		"video_id": videoID.String(),
+	})
+}
+
+// objectTags returns the tags for objects stored under ctx, or nil when
+// tagging is off.
+func (cfg *apiConfig) objectTags(ctx context.Context) map[string]string {
+	if !cfg.s3TagObjects {
+		return nil
+	}
+	tags, _ := ctx.Value(objectTagsKey{}).(map[string]string)
+	return tags
+}
+
+// objectVideoID returns the ID of the video objects stored under ctx
+// belong to, or "" when ctx doesn't say.
+func objectVideoID(ctx context.Context) string {
+	tags, _ := ctx.Value(objectTagsKey{}).(map[string]string)
+	return tags["video_id"]
+}
+
+// probeSource returns what ffprobe should read to inspect key in store: a
+// file path for local storage, so nothing goes over HTTP, and a presigned
+// URL otherwise.
+func probeSource(ctx context.Context, store storage.Storage, key string) (string, error) {
+	if local, ok := store.(*storage.Local); ok {
+		return local.Path(key)
+	}
+	var u string
+	err := timed(ctx, store.Name()+"_presign", func() (err error) {
+		u, err = store.PresignGet(ctx, key, 15*time.Minute)
+		return err
+	})
+	return u, err
+}
+
+// signedVideoAssets guards the local backend's videos under the assets
+// route: they are only served with an unexpired signature, as handed out
+// in video responses. Public videos and other assets pass straight
+// through.
+func (cfg *apiConfig) signedVideoAssets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.URL.Path, "/"+localVideoDir+"/")
+		if !ok || isPublicKey(key) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !cfg.localStorage.Verify(key, r.URL.Query()) {
+			w.Header().Set("Cache-Control", "no-store")
+			respondWithError(w, http.StatusForbidden, "Video URL is missing a valid signature", nil)
+			return
+		}
+		// The URL is personal and expires; shared caches mustn't keep it
+		w.Header().Set("Cache-Control", "private, max-age="+fmt.Sprint(int(cfg.presignExpiry.Seconds())))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/storagetest"
+)
+
+type signedURLResponse struct {
+	VideoURL  string     `json:"video_url"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func TestVideoSignedURL(t *testing.T) {
+	env := newTestEnv(t)
+	_, owner := env.createUser(t)
+	_, other := env.createUser(t)
+	video := env.uploadedVideo(t, owner, "Signed URL")
+	stored := *env.videoRow(t, video.ID).VideoURL
+	path := "/api/videos/" + video.ID + "/signed-url"
+
+	// Distribution URLs without a key pair don't expire
+	var got signedURLResponse
+	env.doJSON(t, http.MethodGet, path, owner, nil, http.StatusOK, &got)
+	if got.VideoURL != stored || got.ExpiresAt != nil {
+		t.Errorf("got %+v, want the stored %s without an expiry", got, stored)
+	}
+
+	env.cfg.cloudFrontSigner = testSigner(t)
+	resp, body := env.do(t, http.MethodGet, path, owner, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d: %s", resp.StatusCode, body)
+	}
+	decodeJSON(t, body, &got)
+	if !strings.HasPrefix(got.VideoURL, stored+"?") || got.ExpiresAt == nil {
+		t.Errorf("got %+v, want a signed URL with its expiry", got)
+	} else if left := time.Until(*got.ExpiresAt); left > defaultURLExpiry || left < defaultURLExpiry-time.Minute {
+		t.Errorf("expires in %v, want %v", left, defaultURLExpiry)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+
+	draft := env.createVideo(t, owner, "Not uploaded")
+	for _, tt := range []struct {
+		path, token string
+		want        int
+	}{
+		{path, other, http.StatusForbidden},
+		{path, "", http.StatusUnauthorized},
+		{"/api/videos/" + draft.ID + "/signed-url", owner, http.StatusNotFound},
+	} {
+		if resp, body := env.do(t, http.MethodGet, tt.path, tt.token, "", nil); resp.StatusCode != tt.want {
+			t.Errorf("GET %s: got %d: %s, want %d", tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+}
+
+func TestVideoSignedURLLocalStorage(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.videoStorage = env.cfg.localStorage
+	_, owner := env.createUser(t)
+	video := env.uploadedVideo(t, owner, "Local")
+
+	var got signedURLResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID+"/signed-url", owner, nil, http.StatusOK, &got)
+	if got.ExpiresAt == nil {
+		t.Fatalf("got %+v, want an expiring local URL", got)
+	}
+	if resp, _ := env.do(t, http.MethodGet, strings.TrimPrefix(got.VideoURL, env.server.URL), "", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET %s: got %d, want the video", got.VideoURL, resp.StatusCode)
+	}
+}
+
+type refreshURLsResponse struct {
+	Checked int `json:"checked"`
+	Present int `json:"present"`
+	Missing []struct {
+		VideoID string `json:"video_id"`
+		Storage string `json:"storage"`
+		Key     string `json:"key"`
+	} `json:"missing"`
+	Failed []struct {
+		VideoID string `json:"video_id"`
+		Error   string `json:"error"`
+	} `json:"failed"`
+}
+
+func TestRefreshVideoURLsReportsMissingObjects(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	present := env.uploadedVideo(t, token, "Present")
+	gone := env.uploadedVideo(t, token, "Gone")
+	goneKey := env.storedVideoKey(t, gone.ID)
+	if err := env.cfg.s3Storage.Delete(context.Background(), goneKey); err != nil {
+		t.Fatal(err)
+	}
+	legacy := env.createVideo(t, token, "Legacy")
+	env.s3.PutObject("legacy-bucket", "videos/old.mp4", storagetest.FakeObject{Data: []byte("old video")})
+	env.updateVideo(t, legacy.ID, func(v *database.Video) { v.VideoURL = ptr("legacy-bucket,videos/old.mp4") })
+	unreachable := env.createVideo(t, token, "Unreachable")
+	env.updateVideo(t, unreachable.ID, func(v *database.Video) { v.VideoURL = ptr("https://elsewhere.example.com/video.mp4") })
+	// Drafts have nothing to check
+	env.createVideo(t, token, "Draft")
+
+	var got refreshURLsResponse
+	env.doJSON(t, http.MethodPost, "/admin/videos/refresh-urls", testAdmin, nil, http.StatusOK, &got)
+	if got.Checked != 4 || got.Present != 2 {
+		t.Errorf("checked %d with %d present, want 4 and 2 (%s and %s)", got.Checked, got.Present, present.ID, legacy.ID)
+	}
+	if len(got.Missing) != 1 || got.Missing[0].VideoID != gone.ID || got.Missing[0].Key != goneKey || got.Missing[0].Storage != testBucket {
+		t.Errorf("missing = %+v, want %s's %s/%s", got.Missing, gone.ID, testBucket, goneKey)
+	}
+	if len(got.Failed) != 1 || got.Failed[0].VideoID != unreachable.ID {
+		t.Errorf("failed = %+v, want %s", got.Failed, unreachable.ID)
+	}
+
+	// S3 errors other than a missing object are failures, not drift
+	env.s3.FailWhen(func(op string, r *http.Request) bool { return op == "HeadObject" })
+	env.doJSON(t, http.MethodPost, "/admin/videos/refresh-urls", testAdmin, nil, http.StatusOK, &got)
+	if len(got.Missing) != 0 || len(got.Failed) != 4 {
+		t.Errorf("with S3 failing: missing %+v, failed %d; want every video failed", got.Missing, len(got.Failed))
+	}
+}
+
+func TestRefreshVideoURLsNeedsAdmin(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createUser(t)
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{token, http.StatusForbidden},
+	} {
+		if resp, body := env.do(t, http.MethodPost, "/admin/videos/refresh-urls", tt.token, "", nil); resp.StatusCode != tt.want {
+			t.Errorf("token %q: got %d: %s, want %d", tt.token, resp.StatusCode, body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxVideoTitleLength       = 200
+	maxVideoDescriptionLength = 5000
+)
+
+// validateVideoMetadata checks user-editable video fields. Both creation and
+// metadata updates go through it so the rules can't drift.
+func validateVideoMetadata(title, description string) error {
+	if strings.TrimSpace(title) == "" {
+		return errors.New("Title is required")
+	}
+	if utf8.RuneCountInString(title) > maxVideoTitleLength {
+		return errors.New("Title is too long")
+	}
+	if utf8.RuneCountInString(description) > maxVideoDescriptionLength {
+		return errors.New("Description is too long")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// publicKeyPrefix is where the objects of public and unlisted videos are
+// stored, so a bucket policy or an unrestricted CloudFront behavior can
+// allow reads of them alone. Their URLs are handed out unsigned.
+const publicKeyPrefix = "public/"
+
+// validVisibility reports whether v is a visibility level.
+func validVisibility(v string) bool {
+	switch v {
+	case database.VisibilityPrivate, database.VisibilityUnlisted, database.VisibilityPublic:
+		return true
+	}
+	return false
+}
+
+// publiclyStored reports whether a video's objects belong under
+// publicKeyPrefix: anyone with the link may watch it, it isn't in the
+// trash, and watching it takes nothing more than the link.
+func publiclyStored(video database.Video) bool {
+	return video.Visibility != database.VisibilityPrivate && video.DeletedAt == nil && !viewRestricted(video)
+}
+
+// viewRestricted reports whether watching video takes more than being
+// allowed to see it: a password, or a page on one of its embed origins.
+// Its URLs must then be signed and only handed out once those checks pass.
+func viewRestricted(video database.Video) bool {
+	return video.PasswordHash != nil || len(video.AllowedEmbedOrigins) > 0
+}
+
+// isPublicKey reports whether key is under publicKeyPrefix.
+func isPublicKey(key string) bool {
+	return strings.HasPrefix(key, publicKeyPrefix)
+}
+
+// visibilityKey returns key under publicKeyPrefix when public is set, and
+// without it otherwise.
+func visibilityKey(key string, public bool) string {
+	key = strings.TrimPrefix(key, publicKeyPrefix)
+	if public {
+		return publicKeyPrefix + key
+	}
+	return key
+}
+
+// canViewVideo reports whether r's caller may watch video: anyone for
+// public and unlisted videos, and only the owner for private ones. Share
+// links are checked on their own route.
+func (cfg *apiConfig) canViewVideo(r *http.Request, video database.Video) bool {
+	if video.Visibility != database.VisibilityPrivate && video.DeletedAt == nil {
+		return true
+	}
+	return cfg.optionalUserID(r) == video.UserID
+}
+
+// checkVideoVisible responds 404, as if video didn't exist, when the
+// caller may not see it, so private video IDs can't be probed.
+func (cfg *apiConfig) checkVideoVisible(w http.ResponseWriter, r *http.Request, video database.Video) bool {
+	if cfg.canViewVideo(r, video) {
+		return true
+	}
+	respondWithErrorCode(w, http.StatusNotFound, errorCodeVideoNotFound, "Couldn't get video", nil)
+	return false
+}
+
+// videoURLForKey returns storedURL rewritten to refer to key in the same
+// store, in the format it was stored in.
+func (cfg *apiConfig) videoURLForKey(storedURL, key string) string {
+	if isLocalVideoURL(storedURL) {
+		return storageBackendLocal + "," + key
+	}
+	if bucket, _, ok := strings.Cut(storedURL, ","); ok {
+		return strings.TrimSpace(bucket) + "," + key
+	}
+	return fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
+}
+
+// moveVideoObjects copies video's file and renditions under or out of
+// publicKeyPrefix to match its visibility, and points video at the
+// copies. It returns the URLs video referred to before, to delete once
+// the row is saved, and a cleanup that deletes the copies if it isn't.
+// HLS sets stay where they are; their playlist is always signed.
+func (cfg *apiConfig) moveVideoObjects(ctx context.Context, video *database.Video) (replaced []*string, cleanup func(), err error) {
+	public := publiclyStored(*video)
+	var copied []string
+	cleanup = func() {
+		for _, u := range copied {
+			if cfg.referencedElsewhere(u, video.ID) {
+				continue
+			}
+			if store, key, ok := cfg.videoObject(u); ok {
+				if err := store.Delete(ctx, key); err != nil {
+					log.Printf("couldn't delete moved copy %s: %v", key, err)
+				}
+			}
+		}
+	}
+	move := func(storedURL string) (string, error) {
+		store, key, ok := cfg.videoObject(storedURL)
+		if !ok {
+			return "", fmt.Errorf("video URL %q doesn't point at a configured storage backend", storedURL)
+		}
+		newKey := visibilityKey(key, public)
+		if newKey == key {
+			return storedURL, nil
+		}
+		copier, ok := store.(storage.Copier)
+		if !ok {
+			return "", fmt.Errorf("%s storage can't copy objects", store.Name())
+		}
+		err := timed(ctx, store.Name()+"_copy", func() error {
+			return copier.Copy(ctx, key, newKey)
+		}, "key", newKey)
+		if err != nil {
+			return "", err
+		}
+		newURL := cfg.videoURLForKey(storedURL, newKey)
+		copied = append(copied, newURL)
+		old := storedURL
+		replaced = append(replaced, &old)
+		return newURL, nil
+	}
+
+	if presentURL(video.VideoURL) != nil {
+		newURL, err := move(*video.VideoURL)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		video.VideoURL = &newURL
+	}
+	if len(video.Renditions) > 0 {
+		renditions := make(database.Renditions, len(video.Renditions))
+		for label, u := range video.Renditions {
+			newURL, err := move(u)
+			if err != nil {
+				cleanup()
+				return nil, func() {}, err
+			}
+			renditions[label] = newURL
+		}
+		video.Renditions = renditions
+	}
+	return replaced, cleanup, nil
+}
+
+// errVisibilityProcessing is returned when who may watch a video changes
+// while an upload is being processed, which would store it under the old
+// keys.
+var errVisibilityProcessing = errors.New("video is still processing")
+
+// relocateVideoObjects moves video's objects to match a change to its
+// visibility, password or embed origins, given whether they were
+// publicly stored before it. The caller saves the row, then deletes the
+// returned URLs, or calls cleanup if saving fails.
+func (cfg *apiConfig) relocateVideoObjects(ctx context.Context, video *database.Video, wasPublic bool) (replaced []*string, cleanup func(), err error) {
+	if publiclyStored(*video) == wasPublic {
+		return nil, func() {}, nil
+	}
+	if video.ProcessingStatus != nil && *video.ProcessingStatus == database.ProcessingStatusPending {
+		return nil, func() {}, errVisibilityProcessing
+	}
+	return cfg.moveVideoObjects(ctx, video)
+}
+
+// handlerPublicVideos pages through every user's public videos, newest
+// first by default. Unlisted and private videos are never listed, and
+// password-protected or embed-restricted ones are listed without their
+// URLs.
+func (cfg *apiConfig) handlerPublicVideos(w http.ResponseWriter, r *http.Request) {
+	cfg.respondWithVideoPage(w, r, database.VideoPageParams{PublicOnly: true}, false)
+}
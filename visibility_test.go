@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// storedVideoKey is the key videoID's file is stored under.
+func (env *testEnv) storedVideoKey(t *testing.T, videoID string) string {
+	t.Helper()
+	video, err := env.cfg.db.GetVideo(mustParseUUID(t, videoID), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.VideoURL == nil {
+		t.Fatalf("video %s has no file", videoID)
+	}
+	_, key, ok := env.cfg.videoObject(*video.VideoURL)
+	if !ok {
+		t.Fatalf("video %s URL %q isn't in a configured store", videoID, *video.VideoURL)
+	}
+	return key
+}
+
+// uploadedVideo creates a video with content, published like any upload.
+// The content is unique to title, so it isn't shared with other videos.
+func (env *testEnv) uploadedVideo(t *testing.T, token, title string) videoResponse {
+	t.Helper()
+	video := env.createVideo(t, token, title)
+	resp, body := env.uploadVideo(t, token, video.ID, append(testVideoBytes(4096), title...))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload: got %d: %s", resp.StatusCode, body)
+	}
+	env.waitForProcessing(t, token, video.ID)
+	return video
+}
+
+// publicListing returns the public listing's entry for videoID.
+func (env *testEnv) publicListing(t *testing.T, videoID string) (videoResponse, bool) {
+	t.Helper()
+	var page videoPageResponse
+	env.doJSON(t, http.MethodGet, "/api/videos/public", "", nil, http.StatusOK, &page)
+	for _, video := range page.Videos {
+		if video.ID == videoID {
+			return video, true
+		}
+	}
+	return videoResponse{}, false
+}
+
+func TestVideoAccessByVisibility(t *testing.T) {
+	env := newTestEnv(t)
+	_, owner := env.createUser(t)
+	_, other := env.createUser(t)
+
+	tests := []struct {
+		visibility string
+		// status for the owner, another user and an anonymous caller
+		owner, other, anonymous int
+		listed                  bool
+	}{
+		{database.VisibilityPrivate, http.StatusOK, http.StatusNotFound, http.StatusNotFound, false},
+		{database.VisibilityUnlisted, http.StatusOK, http.StatusOK, http.StatusOK, false},
+		{database.VisibilityPublic, http.StatusOK, http.StatusOK, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.visibility, func(t *testing.T) {
+			video := env.uploadedVideo(t, owner, tt.visibility)
+			env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, owner, map[string]string{"visibility": tt.visibility}, http.StatusOK, nil)
+
+			for _, caller := range []struct {
+				name, token string
+				want        int
+			}{
+				{"owner", owner, tt.owner},
+				{"other user", other, tt.other},
+				{"anonymous", "", tt.anonymous},
+			} {
+				for _, path := range []string{"/api/videos/" + video.ID, "/api/videos/" + video.ID + "/download"} {
+					resp, body := env.do(t, http.MethodGet, path, caller.token, "", nil)
+					if resp.StatusCode != caller.want {
+						t.Errorf("%s GET %s: got %d, want %d: %s", caller.name, path, resp.StatusCode, caller.want, body)
+					}
+				}
+			}
+			if _, listed := env.publicListing(t, video.ID); listed != tt.listed {
+				t.Errorf("listed publicly = %v, want %v", listed, tt.listed)
+			}
+			if public := isPublicKey(env.storedVideoKey(t, video.ID)); public != (tt.visibility != database.VisibilityPrivate) {
+				t.Errorf("stored under %s, public = %v", env.storedVideoKey(t, video.ID), public)
+			}
+		})
+	}
+}
+
+func TestRestrictedVideosStoredPrivately(t *testing.T) {
+	env := newTestEnv(t)
+	_, owner := env.createUser(t)
+	_, other := env.createUser(t)
+
+	tests := []struct {
+		name string
+		// restrict and lift are PATCH bodies
+		restrict, lift map[string]any
+		// headers that get a non-owner past the restriction
+		pass []string
+	}{
+		{
+			"password",
+			map[string]any{"password": "hunter22"},
+			map[string]any{"password": ""},
+			[]string{videoPasswordHeader, "hunter22"},
+		},
+		{
+			"embed origins",
+			map[string]any{"allowed_embed_origins": []string{"https://allowed.example"}},
+			map[string]any{"allowed_embed_origins": []string{}},
+			[]string{"Origin", "https://allowed.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := env.uploadedVideo(t, owner, tt.name)
+			env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, owner, map[string]string{"visibility": database.VisibilityPublic}, http.StatusOK, nil)
+			publicKey := env.storedVideoKey(t, video.ID)
+			if !isPublicKey(publicKey) {
+				t.Fatalf("public video stored under %s", publicKey)
+			}
+
+			env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, owner, tt.restrict, http.StatusOK, nil)
+			privateKey := env.storedVideoKey(t, video.ID)
+			if isPublicKey(privateKey) {
+				t.Errorf("restricted video still stored under %s", privateKey)
+			}
+			if _, ok := env.s3.Object(testBucket, publicKey); ok {
+				t.Errorf("public copy %s wasn't deleted", publicKey)
+			}
+
+			// Listed, but without anything to play
+			listed, ok := env.publicListing(t, video.ID)
+			if !ok {
+				t.Fatal("restricted public video isn't listed")
+			}
+			if listed.VideoURL != nil || listed.HLSURL != nil || len(listed.Renditions) > 0 {
+				t.Errorf("listing hands out URLs: %+v", listed)
+			}
+
+			// Others get the URL from the video once past the restriction
+			var got videoResponse
+			for _, token := range []string{other, ""} {
+				resp, body := env.do(t, http.MethodGet, "/api/videos/"+video.ID, token, "", nil, "Origin", "https://elsewhere.example")
+				if resp.StatusCode == http.StatusOK {
+					t.Errorf("GET without passing the restriction: got 200: %s", body)
+				}
+				resp, body = env.do(t, http.MethodGet, "/api/videos/"+video.ID, token, "", nil, tt.pass...)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("GET past the restriction: got %d: %s", resp.StatusCode, body)
+				}
+				decodeJSON(t, body, &got)
+				if got.VideoURL == nil {
+					t.Fatal("no video_url past the restriction")
+				}
+				// Presigned, since nothing signs distribution URLs here
+				if u, err := url.Parse(*got.VideoURL); err != nil || !strings.HasSuffix(u.Path, "/"+privateKey) {
+					t.Errorf("video_url = %s, want the private key %s", *got.VideoURL, privateKey)
+				}
+			}
+			env.doJSON(t, http.MethodGet, "/api/videos/"+video.ID, owner, nil, http.StatusOK, &got)
+			if got.VideoURL == nil {
+				t.Error("owner got no video_url")
+			}
+
+			env.doJSON(t, http.MethodPatch, "/api/videos/"+video.ID, owner, tt.lift, http.StatusOK, nil)
+			if key := env.storedVideoKey(t, video.ID); !isPublicKey(key) {
+				t.Errorf("video stored under %s after lifting the restriction", key)
+			}
+			if listed, _ := env.publicListing(t, video.ID); listed.VideoURL == nil {
+				t.Error("listing has no video_url after lifting the restriction")
+			}
+		})
+	}
+}
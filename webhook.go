@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// webhookSignatureHeader names the header that carries "sha256=" and the
+// hex HMAC-SHA256 of a webhook's body, keyed with WEBHOOK_SECRET, after
+// appName: X-Tubely-Signature by default. Anything but letters, digits
+// and hyphens in appName becomes a hyphen. client.WebhookSignatureHeaderFor
+// derives the same name, and client.VerifyWebhookSignature checks the
+// value.
+func webhookSignatureHeader(appName string) string {
+	name := []byte(appName)
+	for i, c := range name {
+		valid := c == '-' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+		if !valid {
+			name[i] = '-'
+		}
+	}
+	return http.CanonicalHeaderKey("X-" + string(name) + "-Signature")
+}
+
+// Events a webhook is sent for.
+const (
+	webhookEventVideoReady  = "video.ready"
+	webhookEventVideoFailed = "video.failed"
+)
+
+const (
+	// webhookRetries is how many times a failed delivery is retried, with
+	// the delay doubling from webhookRetryDelay each time.
+	webhookRetries    = 3
+	webhookRetryDelay = time.Second
+	// webhookTimeout bounds each delivery attempt.
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookEvent is the JSON body of a webhook. Status is the video's
+// processing status.
+type webhookEvent struct {
+	Event     string `json:"event"`
+	VideoID   string `json:"video_id"`
+	UserID    string `json:"user_id"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// webhookNotifier posts events to WEBHOOK_URL in the background. A nil
+// notifier sends nothing.
+type webhookNotifier struct {
+	url             string
+	secret          []byte
+	signatureHeader string
+	client          *http.Client
+	retryDelay      time.Duration
+
+	deliveries sync.WaitGroup
+}
+
+func newWebhookNotifier(url, secret, appName string) *webhookNotifier {
+	return &webhookNotifier{
+		url:             url,
+		secret:          []byte(secret),
+		signatureHeader: webhookSignatureHeader(appName),
+		client:          &http.Client{Timeout: webhookTimeout},
+		retryDelay:      webhookRetryDelay,
+	}
+}
+
+// signWebhook returns the signature header value for body.
+func signWebhook(body, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify delivers event without blocking the caller. Delivery is logged
+// against ctx's request, but outlives it.
+func (n *webhookNotifier) notify(ctx context.Context, event webhookEvent) {
+	if n == nil {
+		return
+	}
+	logger := requestLogger(ctx).With(slog.String("event", event.Event), slog.String("video_id", event.VideoID))
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("couldn't encode webhook", slog.Any("error", err))
+		return
+	}
+	n.deliveries.Add(1)
+	go func() {
+		defer n.deliveries.Done()
+		n.deliver(logger, body)
+	}()
+}
+
+// deliver posts body, retrying failures with exponential backoff. Each
+// failed attempt is logged with the response status, or 0 if there was
+// no response.
+func (n *webhookNotifier) deliver(logger *slog.Logger, body []byte) {
+	signature := signWebhook(body, n.secret)
+	delay := n.retryDelay
+	for attempt := 0; ; attempt++ {
+		status, err := n.post(body, signature)
+		if err == nil {
+			return
+		}
+		attrs := []any{slog.Int("status", status), slog.Int("attempt", attempt+1), slog.Any("error", err)}
+		if attempt == webhookRetries {
+			logger.Error("gave up delivering webhook", attrs...)
+			return
+		}
+		logger.Warn("couldn't deliver webhook, retrying", append(attrs, slog.Duration("retry_in", delay))...)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes one delivery attempt, returning the response status. Anything
+// but a 2xx is a failure.
+func (n *webhookNotifier) post(body []byte, signature string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(n.signatureHeader, signature)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// wait blocks until deliveries in flight finish or ctx is done, so a
+// shutdown doesn't drop them.
+func (n *webhookNotifier) wait(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		n.deliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notifyVideoProcessed sends the webhook for an upload to video that
+// finished processing, with status ready or failed.
+func (cfg *apiConfig) notifyVideoProcessed(ctx context.Context, video database.Video, status string) {
+	event := webhookEventVideoReady
+	if status == database.ProcessingStatusFailed {
+		event = webhookEventVideoFailed
+	}
+	cfg.webhooks.notify(ctx, webhookEvent{
+		Event:     event,
+		VideoID:   video.ID.String(),
+		UserID:    video.UserID.String(),
+		Status:    status,
+		Timestamp: apiTime(time.Now()),
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/google/uuid"
+)
+
+// webhookReceiver records deliveries, answering each with the next of
+// statuses and 200 once they run out.
+type webhookReceiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (rcv *webhookReceiver) serve(header string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.bodies = append(rcv.bodies, body)
+		rcv.signatures = append(rcv.signatures, r.Header.Get(header))
+		if len(rcv.statuses) > 0 {
+			w.WriteHeader(rcv.statuses[0])
+			rcv.statuses = rcv.statuses[1:]
+		}
+	}
+}
+
+func TestWebhookSignatureHeader(t *testing.T) {
+	for appName, want := range map[string]string{
+		defaultAppName: "X-Tubely-Signature",
+		"video-site":   "X-Video-Site-Signature",
+		"my app.v2":    "X-My-App-V2-Signature",
+	} {
+		if got := webhookSignatureHeader(appName); got != want {
+			t.Errorf("webhookSignatureHeader(%q) = %q, want %q", appName, got, want)
+		}
+		if got := client.WebhookSignatureHeaderFor(appName); got != want {
+			t.Errorf("client.WebhookSignatureHeaderFor(%q) = %q, want %q", appName, got, want)
+		}
+	}
+	if client.WebhookSignatureHeader != webhookSignatureHeader(defaultAppName) {
+		t.Errorf("client.WebhookSignatureHeader = %q, want the default app's", client.WebhookSignatureHeader)
+	}
+}
+
+func TestWebhookDeliverySigned(t *testing.T) {
+	const secret = "webhook-secret"
+	header := client.WebhookSignatureHeaderFor("video-site")
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv.serve(header))
+	defer server.Close()
+
+	n := newWebhookNotifier(server.URL, secret, "video-site")
+	videoID := uuid.New()
+	n.notify(context.Background(), webhookEvent{Event: webhookEventVideoReady, VideoID: videoID.String(), UserID: uuid.NewString(), Status: "ready", Timestamp: apiTime(time.Now())})
+	if err := n.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rcv.bodies) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(rcv.bodies))
+	}
+	event, err := client.ParseWebhook(rcv.bodies[0], rcv.signatures[0], secret)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v (signature %q)", err, rcv.signatures[0])
+	}
+	if event.Event != client.WebhookEventVideoReady || event.VideoID != videoID {
+		t.Errorf("event = %+v", event)
+	}
+	if _, err := client.ParseWebhook(rcv.bodies[0], rcv.signatures[0], "wrong secret"); err != client.ErrInvalidWebhookSignature {
+		t.Errorf("ParseWebhook with the wrong secret: %v", err)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	tests := []struct {
+		name       string
+		statuses   []int
+		deliveries int
+		gaveUp     bool
+	}{
+		{"recovers", []int{http.StatusInternalServerError, http.StatusBadGateway}, 3, false},
+		{"gives up", []int{500, 500, 500, 500, 500}, webhookRetries + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			rcv := &webhookReceiver{statuses: tt.statuses}
+			server := httptest.NewServer(rcv.serve(webhookSignatureHeader(defaultAppName)))
+			defer server.Close()
+
+			n := newWebhookNotifier(server.URL, "secret", defaultAppName)
+			n.retryDelay = time.Millisecond
+			n.notify(context.Background(), webhookEvent{Event: webhookEventVideoFailed, VideoID: uuid.NewString()})
+			if err := n.wait(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rcv.bodies) != tt.deliveries {
+				t.Errorf("got %d attempts, want %d", len(rcv.bodies), tt.deliveries)
+			}
+			for i := 1; i < len(rcv.bodies); i++ {
+				if !bytes.Equal(rcv.bodies[i], rcv.bodies[0]) || rcv.signatures[i] != rcv.signatures[0] {
+					t.Errorf("retry %d sent a different body or signature", i)
+				}
+			}
+			if !strings.Contains(logs.String(), "status=500") {
+				t.Errorf("logs don't carry the response status:\n%s", logs.String())
+			}
+			if got := strings.Contains(logs.String(), "gave up"); got != tt.gaveUp {
+				t.Errorf("gave up = %v, want %v:\n%s", got, tt.gaveUp, logs.String())
+			}
+		})
+	}
+}